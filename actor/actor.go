@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/mailgun/log"
 )
 
 type ID struct {
 	absoluteName string
+	name         string
+	parent       *ID
 
 	childrenMu       sync.Mutex
 	childrenCounters map[string]int32
@@ -19,6 +23,46 @@ type ID struct {
 // RootID is the root of the context id hierarchy.
 var RootID = &ID{}
 
+var (
+	liveActorsMu sync.Mutex
+	liveActors   = make(map[*ID]*liveActor)
+)
+
+// liveActor describes goroutines currently running with a particular ID.
+type liveActor struct {
+	startedAt    time.Time
+	goroutines   int
+	failures     int
+	lastError    string
+	lastFailedAt time.Time
+}
+
+// Node is a snapshot of a node of the actor ID hierarchy.
+type Node struct {
+	Name string
+
+	// Time when the earliest running goroutine with the node ID was started.
+	// It is zero if there are no goroutines running with the node ID, that
+	// is the case for namespace nodes.
+	StartedAt time.Time
+
+	// Number of goroutines running with the node ID.
+	Goroutines int
+
+	// Number of goroutines running with the node ID or IDs of its
+	// descendants.
+	TotalGoroutines int
+
+	// Number of times a supervised actor function running with the node ID
+	// failed, along with the last failure error and time.
+	Failures     int
+	LastError    string
+	LastFailedAt time.Time
+
+	// Children nodes sorted by name.
+	Children []*Node
+}
+
 // NewChild creates a child id.
 func (id *ID) NewChild(nameParts ...interface{}) *ID {
 	if len(nameParts) == 0 {
@@ -41,7 +85,12 @@ func (id *ID) NewChild(nameParts ...interface{}) *ID {
 	idx := id.childrenCounters[name]
 	id.childrenCounters[name] = idx + 1
 	id.childrenMu.Unlock()
-	return &ID{absoluteName: fmt.Sprintf("%s/%s[%d]", id.absoluteName, name, idx)}
+	localName := fmt.Sprintf("%s[%d]", name, idx)
+	return &ID{
+		absoluteName: fmt.Sprintf("%s/%s", id.absoluteName, localName),
+		name:         localName,
+		parent:       id,
+	}
 }
 
 func (id *ID) String() string {
@@ -58,6 +107,8 @@ func Spawn(actorID *ID, wg *sync.WaitGroup, f func()) {
 		if wg != nil {
 			defer wg.Done()
 		}
+		registerLive(actorID)
+		defer unregisterLive(actorID)
 		log.Infof("<%s> started", actorID)
 		defer func() {
 			if p := recover(); p != nil {
@@ -69,3 +120,77 @@ func Spawn(actorID *ID, wg *sync.WaitGroup, f func()) {
 		f()
 	}()
 }
+
+// Tree returns a snapshot of the actor ID hierarchy that contains all IDs
+// that have goroutines running with them, along with their ancestors.
+func Tree() *Node {
+	liveActorsMu.Lock()
+	defer liveActorsMu.Unlock()
+
+	nodes := make(map[*ID]*Node)
+	var nodeOf func(id *ID) *Node
+	nodeOf = func(id *ID) *Node {
+		if node := nodes[id]; node != nil {
+			return node
+		}
+		node := &Node{Name: id.name}
+		nodes[id] = node
+		if id.parent != nil {
+			parentNode := nodeOf(id.parent)
+			parentNode.Children = append(parentNode.Children, node)
+		}
+		return node
+	}
+	for id, la := range liveActors {
+		node := nodeOf(id)
+		node.StartedAt = la.startedAt
+		node.Goroutines = la.goroutines
+		node.Failures = la.failures
+		node.LastError = la.lastError
+		node.LastFailedAt = la.lastFailedAt
+		for ; id != nil; id = id.parent {
+			nodes[id].TotalGoroutines += la.goroutines
+		}
+	}
+	for _, node := range nodes {
+		sort.Slice(node.Children, func(i, j int) bool {
+			return node.Children[i].Name < node.Children[j].Name
+		})
+	}
+	return nodeOf(RootID)
+}
+
+func registerLive(actorID *ID) {
+	liveActorsMu.Lock()
+	defer liveActorsMu.Unlock()
+	la := liveActors[actorID]
+	if la == nil {
+		la = &liveActor{startedAt: time.Now().UTC()}
+		liveActors[actorID] = la
+	}
+	la.goroutines += 1
+}
+
+// recordFailure records a failure of an actor function running with the
+// specified ID, so that it is reported in the actor tree.
+func recordFailure(actorID *ID, err error) {
+	liveActorsMu.Lock()
+	defer liveActorsMu.Unlock()
+	la := liveActors[actorID]
+	if la == nil {
+		return
+	}
+	la.failures += 1
+	la.lastError = err.Error()
+	la.lastFailedAt = time.Now().UTC()
+}
+
+func unregisterLive(actorID *ID) {
+	liveActorsMu.Lock()
+	defer liveActorsMu.Unlock()
+	la := liveActors[actorID]
+	la.goroutines -= 1
+	if la.goroutines == 0 {
+		delete(liveActors, actorID)
+	}
+}
@@ -2,6 +2,7 @@ package actor
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -49,3 +50,66 @@ func (s *IDSuite) TestNewChildEmpty(c *C) {
 func (s *IDSuite) TestNewChildComplex(c *C) {
 	c.Assert(RootID.NewChild("foo", 0, []string{"d"}, nil, "bar").String(), Equals, "/foo_0_[d]_<nil>_bar[0]")
 }
+
+type TreeSuite struct{}
+
+var _ = Suite(&TreeSuite{})
+
+// Tree contains running actors along with their ancestors, and goroutine
+// counts are rolled up to the ancestors.
+func (s *TreeSuite) TestTree(c *C) {
+	ns := RootID.NewChild("tree")
+	id1 := ns.NewChild("foo")
+	id2 := id1.NewChild("bar")
+	id3 := ns.NewChild("bazz").NewChild("blah")
+	stopCh := make(chan struct{})
+	var startedWG, wg sync.WaitGroup
+	for _, id := range []*ID{id1, id2, id2, id3} {
+		startedWG.Add(1)
+		Spawn(id, &wg, func() {
+			startedWG.Done()
+			<-stopCh
+		})
+	}
+	startedWG.Wait()
+
+	// When
+	tree := Tree()
+
+	// Then
+	close(stopCh)
+	wg.Wait()
+
+	var nsNode *Node
+	for _, node := range tree.Children {
+		if node.Name == "tree[0]" {
+			nsNode = node
+		}
+	}
+	c.Assert(nsNode, NotNil)
+	c.Assert(nsNode.Goroutines, Equals, 0)
+	c.Assert(nsNode.TotalGoroutines, Equals, 4)
+	c.Assert(len(nsNode.Children), Equals, 2)
+
+	bazzNode := nsNode.Children[0]
+	c.Assert(bazzNode.Name, Equals, "bazz[0]")
+	c.Assert(bazzNode.StartedAt.IsZero(), Equals, true)
+	c.Assert(bazzNode.TotalGoroutines, Equals, 1)
+	c.Assert(len(bazzNode.Children), Equals, 1)
+	c.Assert(bazzNode.Children[0].Name, Equals, "blah[0]")
+	c.Assert(bazzNode.Children[0].Goroutines, Equals, 1)
+
+	fooNode := nsNode.Children[1]
+	c.Assert(fooNode.Name, Equals, "foo[0]")
+	c.Assert(fooNode.StartedAt.IsZero(), Equals, false)
+	c.Assert(fooNode.Goroutines, Equals, 1)
+	c.Assert(fooNode.TotalGoroutines, Equals, 3)
+	c.Assert(len(fooNode.Children), Equals, 1)
+	c.Assert(fooNode.Children[0].Name, Equals, "bar[0]")
+	c.Assert(fooNode.Children[0].Goroutines, Equals, 2)
+
+	// Once actors stop they are not in the tree anymore.
+	for _, node := range Tree().Children {
+		c.Assert(node.Name, Not(Equals), "tree[0]")
+	}
+}
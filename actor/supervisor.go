@@ -0,0 +1,134 @@
+package actor
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+)
+
+// RestartPolicy defines how a supervisor reacts to failures of its actors.
+// The zero value means that failures are never restarted but escalated right
+// away.
+type RestartPolicy struct {
+	// Maximum number of times an actor can be restarted within `Period`. If
+	// an actor fails more often, then the failure is escalated. If negative,
+	// then an actor is restarted for as long as it takes.
+	MaxRestarts int
+
+	// Period of time that `MaxRestarts` is counted within.
+	Period time.Duration
+
+	// Time to wait before an actor is restarted.
+	Backoff time.Duration
+}
+
+// Supervisor takes care of the goroutine plumbing that is common for most
+// actors: it runs actor functions, lets them know when they should stop via
+// a stop channel, and waits for them to terminate on stop.
+//
+// An actor function fails if it either returns an error or panics. A failed
+// actor function is restarted in accordance with the supervisor restart
+// policy, unless the supervisor has been ordered to stop. If the restart
+// policy is exhausted, then the failure is escalated: passed to the escalate
+// function provided on creation, or if there is none, then it is re-panicked
+// crashing the process.
+type Supervisor struct {
+	actorID    *ID
+	policy     RestartPolicy
+	escalateFn func(err error)
+	stopCh     chan none.T
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewSupervisor creates a supervisor with the specified restart policy. If
+// `escalateFn` is nil, then escalated failures crash the process.
+func NewSupervisor(actorID *ID, policy RestartPolicy, escalateFn func(err error)) *Supervisor {
+	return &Supervisor{
+		actorID:    actorID,
+		policy:     policy,
+		escalateFn: escalateFn,
+		stopCh:     make(chan none.T),
+	}
+}
+
+// Spawn starts actor function `f` as a supervised goroutine.
+func (s *Supervisor) Spawn(actorID *ID, f func() error) {
+	Spawn(actorID, &s.wg, func() {
+		var restarts []time.Time
+		for {
+			err := runSafely(f)
+			if err == nil {
+				return
+			}
+			recordFailure(actorID, err)
+			select {
+			case <-s.stopCh:
+				log.Errorf("<%s> failed while stopping: err=(%+v)", actorID, err)
+				return
+			default:
+			}
+			restarts = trimRestarts(restarts, time.Now().Add(-s.policy.Period))
+			if s.policy.MaxRestarts >= 0 && len(restarts) >= s.policy.MaxRestarts {
+				s.escalate(actorID, err)
+				return
+			}
+			log.Errorf("<%s> failed, restarting in %v: err=(%+v)", actorID, s.policy.Backoff, err)
+			select {
+			case <-time.After(s.policy.Backoff):
+			case <-s.stopCh:
+				return
+			}
+			restarts = append(restarts, time.Now())
+		}
+	})
+}
+
+// StopCh returns a channel that is closed when the supervisor is ordered to
+// stop. Actor functions should terminate as soon as the channel is closed.
+func (s *Supervisor) StopCh() <-chan none.T {
+	return s.stopCh
+}
+
+// Stop signals all supervised actors to stop and waits for them to terminate.
+// It is safe to call Stop more then once.
+func (s *Supervisor) Stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	s.wg.Wait()
+}
+
+// Wait blocks until all supervised actors terminate.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Supervisor) escalate(actorID *ID, err error) {
+	err = errors.Wrapf(err, "<%s> failure escalated", actorID)
+	if s.escalateFn == nil {
+		panic(err)
+	}
+	log.Errorf("<%s> %+v", s.actorID, err)
+	s.escalateFn(err)
+}
+
+// runSafely calls `f` converting a panic to an error.
+func runSafely(f func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Errorf("panic: %v, stack=%s", p, debug.Stack())
+		}
+	}()
+	return f()
+}
+
+// trimRestarts removes restart times that are before `since`.
+func trimRestarts(restarts []time.Time, since time.Time) []time.Time {
+	i := 0
+	for ; i < len(restarts) && restarts[i].Before(since); i++ {
+	}
+	return restarts[i:]
+}
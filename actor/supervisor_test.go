@@ -0,0 +1,164 @@
+package actor
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type SupervisorSuite struct {
+	ns *ID
+}
+
+var _ = Suite(&SupervisorSuite{})
+
+func (s *SupervisorSuite) SetUpTest(c *C) {
+	s.ns = RootID.NewChild("T")
+}
+
+// An actor function that completes successfully is not restarted.
+func (s *SupervisorSuite) TestNoFailure(c *C) {
+	sup := NewSupervisor(s.ns, RestartPolicy{}, nil)
+	calls := 0
+
+	// When
+	sup.Spawn(s.ns.NewChild("a"), func() error {
+		calls += 1
+		return nil
+	})
+	sup.Wait()
+
+	// Then
+	c.Assert(calls, Equals, 1)
+}
+
+// Both returned errors and panics are restarted until the policy is exhausted,
+// then the failure is escalated.
+func (s *SupervisorSuite) TestRestartAndEscalate(c *C) {
+	var escalated error
+	sup := NewSupervisor(s.ns, RestartPolicy{MaxRestarts: 2, Period: time.Minute}, func(err error) {
+		escalated = err
+	})
+	calls := 0
+
+	// When
+	actorID := s.ns.NewChild("a")
+	sup.Spawn(actorID, func() error {
+		calls += 1
+		if calls == 2 {
+			panic("Kaboom!")
+		}
+		return errors.Errorf("failure #%d", calls)
+	})
+	sup.Wait()
+
+	// Then
+	c.Assert(calls, Equals, 3)
+	c.Assert(escalated.Error(), Equals, "<"+actorID.String()+"> failure escalated: failure #3")
+}
+
+// A failed actor function is restarted again once restarts that happened
+// before the policy period are over.
+func (s *SupervisorSuite) TestRestartPeriod(c *C) {
+	sup := NewSupervisor(s.ns, RestartPolicy{MaxRestarts: 1, Period: 50 * time.Millisecond}, func(err error) {
+		c.Errorf("must not be escalated: %v", err)
+	})
+	calls := 0
+
+	// When
+	sup.Spawn(s.ns.NewChild("a"), func() error {
+		calls += 1
+		if calls < 4 {
+			time.Sleep(100 * time.Millisecond)
+			return errors.New("Kaboom!")
+		}
+		return nil
+	})
+	sup.Wait()
+
+	// Then
+	c.Assert(calls, Equals, 4)
+}
+
+// With negative MaxRestarts an actor function is restarted indefinitely, and
+// its failures are reported in the actor tree.
+func (s *SupervisorSuite) TestRestartIndefinitely(c *C) {
+	sup := NewSupervisor(s.ns, RestartPolicy{MaxRestarts: -1}, func(err error) {
+		c.Errorf("must not be escalated: %v", err)
+	})
+	calls := 0
+	actorID := s.ns.NewChild("a")
+	var node *Node
+
+	// When
+	sup.Spawn(actorID, func() error {
+		calls += 1
+		if calls <= 10 {
+			return errors.Errorf("failure #%d", calls)
+		}
+		node = findNode(Tree(), actorID)
+		return nil
+	})
+	sup.Wait()
+
+	// Then
+	c.Assert(calls, Equals, 11)
+	c.Assert(node.Failures, Equals, 10)
+	c.Assert(node.LastError, Equals, "failure #10")
+	c.Assert(node.LastFailedAt.IsZero(), Equals, false)
+}
+
+// Failures that happen after stop is signalled are not restarted.
+func (s *SupervisorSuite) TestNoRestartOnStop(c *C) {
+	sup := NewSupervisor(s.ns, RestartPolicy{MaxRestarts: 10, Period: time.Minute}, nil)
+	calls := 0
+
+	// When
+	sup.Spawn(s.ns.NewChild("a"), func() error {
+		calls += 1
+		<-sup.StopCh()
+		return errors.New("Kaboom!")
+	})
+	sup.Stop()
+
+	// Then
+	c.Assert(calls, Equals, 1)
+}
+
+// Stop interrupts the restart backoff.
+func (s *SupervisorSuite) TestStopDuringBackoff(c *C) {
+	sup := NewSupervisor(s.ns, RestartPolicy{MaxRestarts: 10, Period: time.Minute, Backoff: time.Minute}, nil)
+	failedCh := make(chan struct{})
+
+	sup.Spawn(s.ns.NewChild("a"), func() error {
+		close(failedCh)
+		return errors.New("Kaboom!")
+	})
+	<-failedCh
+
+	// When
+	begin := time.Now()
+	sup.Stop()
+
+	// Then
+	c.Assert(time.Now().Sub(begin) < time.Second, Equals, true)
+}
+
+// findNode returns a node of the actor tree that corresponds to the specified
+// actor ID.
+func findNode(node *Node, actorID *ID) *Node {
+	if actorID.parent == nil {
+		return node
+	}
+	parent := findNode(node, actorID.parent)
+	if parent == nil {
+		return nil
+	}
+	for _, child := range parent.Children {
+		if child.Name == actorID.name {
+			return child
+		}
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package admin
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"regexp"
 	"sort"
 	"strconv"
 	"sync"
@@ -10,6 +13,7 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/pkg/errors"
 	"github.com/samuel/go-zookeeper/zk"
 )
@@ -18,6 +22,13 @@ type (
 	ErrInvalidParam error
 )
 
+// ErrTopicExists is returned on an attempt to create a topic that already
+// exists.
+var ErrTopicExists = errors.New("topic already exists")
+
+// Topic names that Kafka accepts.
+var validTopicRE = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
 const (
 	ProtocolVer1 = 1 // Supported by Kafka v0.8.2 and later
 )
@@ -92,68 +103,8 @@ func (a *T) getGroupOffsets(group, topic string) ([]PartitionOffset, error) {
 	if err != nil {
 		return nil, err
 	}
-	partitions, err := kafkaClt.Partitions(topic)
+	offsets, err := getOffsetRanges(kafkaClt, topic)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get topic partitions")
-	}
-
-	// Figure out distribution of partitions among brokers.
-	brokerToPartitions := make(map[*sarama.Broker][]indexedPartition)
-	for i, p := range partitions {
-		broker, err := kafkaClt.Leader(topic, p)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get partition leader, partition=%d", p)
-		}
-		brokerToPartitions[broker] = append(brokerToPartitions[broker], indexedPartition{i, p})
-	}
-
-	// Query brokers for the oldest and newest offsets of the partitions that
-	// they are leaders for.
-	offsets := make([]PartitionOffset, len(partitions))
-	var wg sync.WaitGroup
-	errorsCh := make(chan error, len(brokerToPartitions))
-	for broker, brokerPartitions := range brokerToPartitions {
-		broker, brokerPartitions := broker, brokerPartitions
-		var reqNewest sarama.OffsetRequest
-		var reqOldest sarama.OffsetRequest
-		for _, p := range brokerPartitions {
-			reqNewest.AddBlock(topic, p.partition, sarama.OffsetNewest, 1)
-			reqOldest.AddBlock(topic, p.partition, sarama.OffsetOldest, 1)
-		}
-		actorID := actor.RootID.NewChild("adminOffsetFetcher")
-		actor.Spawn(actorID, &wg, func() {
-			resOldest, err := broker.GetAvailableOffsets(&reqOldest)
-			if err != nil {
-				errorsCh <- errors.Wrapf(err, "failed to fetch oldest offset, broker=%v", broker.ID())
-				return
-			}
-			resNewest, err := broker.GetAvailableOffsets(&reqNewest)
-			if err != nil {
-				errorsCh <- errors.Wrapf(err, "failed to fetch newest offset, broker=%v", broker.ID())
-				return
-			}
-			for _, xp := range brokerPartitions {
-				begin, err := getOffsetResult(resOldest, topic, xp.partition)
-				if err != nil {
-					errorsCh <- errors.Wrapf(err, "failed to fetch oldest offset, broker=%v", broker.ID())
-					return
-				}
-				end, err := getOffsetResult(resNewest, topic, xp.partition)
-				if err != nil {
-					errorsCh <- errors.Wrapf(err, "failed to fetch newest offset, broker=%v", broker.ID())
-					return
-				}
-				offsets[xp.index].Partition = xp.partition
-				offsets[xp.index].Begin = begin
-				offsets[xp.index].End = end
-			}
-		})
-	}
-	wg.Wait()
-	// If we failed to get offset range for at least one of the partitions then
-	// return the first error that was reported.
-	close(errorsCh)
-	if err, ok := <-errorsCh; ok {
 		return nil, err
 	}
 
@@ -163,17 +114,17 @@ func (a *T) getGroupOffsets(group, topic string) ([]PartitionOffset, error) {
 		return nil, errors.Wrapf(err, "failed to get coordinator")
 	}
 	req := sarama.OffsetFetchRequest{ConsumerGroup: group, Version: ProtocolVer1}
-	for _, p := range partitions {
-		req.AddPartition(topic, p)
+	for _, po := range offsets {
+		req.AddPartition(topic, po.Partition)
 	}
 	res, err := coordinator.FetchOffset(&req)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to fetch offsets")
 	}
-	for i, p := range partitions {
-		block := res.GetBlock(topic, p)
+	for i, po := range offsets {
+		block := res.GetBlock(topic, po.Partition)
 		if block == nil {
-			return nil, errors.Wrapf(nil, "offset block is missing, partition=%d", p)
+			return nil, errors.Wrapf(nil, "offset block is missing, partition=%d", po.Partition)
 		}
 		offsets[i].Offset = block.Offset
 		offsets[i].Metadata = block.Metadata
@@ -182,6 +133,25 @@ func (a *T) getGroupOffsets(group, topic string) ([]PartitionOffset, error) {
 	return offsets, nil
 }
 
+// GetTopicOffsets returns the oldest and newest offsets of all partitions of
+// the specified topic.
+func (a *T) GetTopicOffsets(topic string) ([]PartitionOffset, error) {
+	results, err := a.getTopicOffsets(topic)
+	if err != nil {
+		a.ResetKafkaClt()
+		return a.getTopicOffsets(topic)
+	}
+	return results, nil
+}
+
+func (a *T) getTopicOffsets(topic string) ([]PartitionOffset, error) {
+	kafkaClt, err := a.lazyKafkaClt()
+	if err != nil {
+		return nil, err
+	}
+	return getOffsetRanges(kafkaClt, topic)
+}
+
 // SetGroupOffsets commits specific offset values along with metadata for a list
 // of partitions of a particular topic on behalf of the specified group.
 func (a *T) SetGroupOffsets(group, topic string, offsets []PartitionOffset) error {
@@ -222,6 +192,207 @@ func (a *T) setGroupOffsets(group, topic string, offsets []PartitionOffset) erro
 	return nil
 }
 
+// GetTimeOffsets for every partition of the specified topic returns the
+// offset of the first message with a timestamp that is greater than or equal
+// to `ts`, or the newest offset if there is no such message. Kafka older than
+// 0.10.1.0 resolves the offset with a log segment granularity, and the oldest
+// offset is returned if all log segments are newer than `ts`.
+func (a *T) GetTimeOffsets(topic string, ts time.Time) ([]PartitionOffset, error) {
+	results, err := a.getTimeOffsets(topic, ts)
+	if err != nil {
+		a.ResetKafkaClt()
+		return a.getTimeOffsets(topic, ts)
+	}
+	return results, nil
+}
+
+func (a *T) getTimeOffsets(topic string, ts time.Time) ([]PartitionOffset, error) {
+	kafkaClt, err := a.lazyKafkaClt()
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := kafkaClt.Partitions(topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get topic partitions")
+	}
+	tsMs := ts.UnixNano() / int64(time.Millisecond)
+	offsets := make([]PartitionOffset, len(partitions))
+	for i, p := range partitions {
+		offset, err := kafkaClt.GetOffset(topic, p, tsMs)
+		switch {
+		case err == sarama.ErrOffsetOutOfRange:
+			offset, err = kafkaClt.GetOffset(topic, p, sarama.OffsetOldest)
+		case err == nil && offset < 0:
+			offset, err = kafkaClt.GetOffset(topic, p, sarama.OffsetNewest)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get offset, partition=%d", p)
+		}
+		offsets[i].Partition = p
+		offsets[i].Offset = offset
+	}
+	return offsets, nil
+}
+
+// PeekMessages returns up to `count` messages of the specified topic that
+// the specified consumer group would be given next, without affecting the
+// group offsets in any way. Messages are taken starting from the committed
+// offsets, or from the offsets defined by the group initial offset policy if
+// nothing has been committed yet, alternating between partitions.
+func (a *T) PeekMessages(group, topic string, count int) ([]consumer.Message, error) {
+	msgs, err := a.peekMessages(group, topic, count)
+	if err != nil {
+		a.ResetKafkaClt()
+		return a.peekMessages(group, topic, count)
+	}
+	return msgs, nil
+}
+
+func (a *T) peekMessages(group, topic string, count int) ([]consumer.Message, error) {
+	offsets, err := a.getGroupOffsets(group, topic)
+	if err != nil {
+		return nil, err
+	}
+	kafkaClt, err := a.lazyKafkaClt()
+	if err != nil {
+		return nil, err
+	}
+	consumerParams := a.cfg.ConsumerParams(group, topic)
+	partitionMsgs := make([][]consumer.Message, len(offsets))
+	for i, po := range offsets {
+		offset := po.Offset
+		if offset < 0 {
+			offset = po.End
+			if consumerParams.InitialOffset == config.InitialOffsetEarliest {
+				offset = po.Begin
+			}
+		}
+		if offset < po.Begin {
+			offset = po.Begin
+		}
+		if offset >= po.End {
+			continue
+		}
+		msgs, err := a.fetchMessages(kafkaClt, topic, po.Partition, offset, count)
+		if err != nil {
+			return nil, err
+		}
+		partitionMsgs[i] = msgs
+	}
+	// Take messages from partitions in turns, so that one partition with a
+	// large backlog does not hide the others.
+	var peeked []consumer.Message
+	for i := 0; len(peeked) < count; i++ {
+		taken := false
+		for _, msgs := range partitionMsgs {
+			if i < len(msgs) && len(peeked) < count {
+				peeked = append(peeked, msgs[i])
+				taken = true
+			}
+		}
+		if !taken {
+			break
+		}
+	}
+	return peeked, nil
+}
+
+// GetMessages returns up to `count` messages of a topic partition starting
+// from `offset`. No consumer group is involved, so offsets of consumer groups
+// are not affected in any way.
+func (a *T) GetMessages(topic string, partition int32, offset int64, count int) ([]consumer.Message, error) {
+	msgs, err := a.getMessages(topic, partition, offset, count)
+	if err != nil && errors.Cause(err) != sarama.ErrOffsetOutOfRange {
+		a.ResetKafkaClt()
+		return a.getMessages(topic, partition, offset, count)
+	}
+	return msgs, err
+}
+
+func (a *T) getMessages(topic string, partition int32, offset int64, count int) ([]consumer.Message, error) {
+	kafkaClt, err := a.lazyKafkaClt()
+	if err != nil {
+		return nil, err
+	}
+	return a.fetchMessages(kafkaClt, topic, partition, offset, count)
+}
+
+// fetchMessages fetches up to `count` messages of a topic partition starting
+// from `offset` from the partition leader. It makes as many fetch requests as
+// needed to either collect `count` messages or reach the high water mark.
+func (a *T) fetchMessages(kafkaClt sarama.Client, topic string, partition int32, offset int64, count int) ([]consumer.Message, error) {
+	broker, err := kafkaClt.Leader(topic, partition)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get partition leader, partition=%d", partition)
+	}
+	fetchMaxBytes := a.cfg.ConsumerParams("", topic).FetchMaxBytes
+	var msgs []consumer.Message
+	for len(msgs) < count {
+		req := sarama.FetchRequest{MinBytes: 1}
+		if a.cfg.Kafka.Version.IsAtLeast(sarama.V0_10_0_0) {
+			req.Version = 2
+		}
+		req.AddBlock(topic, partition, offset, int32(fetchMaxBytes))
+		res, err := broker.Fetch(&req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch messages, partition=%d", partition)
+		}
+		fetched, err := parseFetchResponse(res, topic, partition, offset, count-len(msgs))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch messages, partition=%d", partition)
+		}
+		if len(fetched) == 0 {
+			break
+		}
+		msgs = append(msgs, fetched...)
+		last := fetched[len(fetched)-1]
+		offset = last.Offset + 1
+		if offset >= last.HighWaterMark {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// parseFetchResponse returns up to `count` messages of a topic partition
+// starting from `offset` contained in a fetch response.
+func parseFetchResponse(res *sarama.FetchResponse, topic string, partition int32, offset int64, count int) ([]consumer.Message, error) {
+	block := res.GetBlock(topic, partition)
+	if block == nil {
+		return nil, errors.New("incomplete fetch response")
+	}
+	if block.Err != sarama.ErrNoError {
+		return nil, block.Err
+	}
+	var msgs []consumer.Message
+	for _, msgBlock := range block.MsgSet.Messages {
+		lastMsgIdx := len(msgBlock.Messages()) - 1
+		baseOffset := msgBlock.Offset - msgBlock.Messages()[lastMsgIdx].Offset
+		for _, msg := range msgBlock.Messages() {
+			msgOffset := msg.Offset
+			if msg.Msg.Version >= 1 {
+				msgOffset += baseOffset
+			}
+			if msgOffset < offset {
+				continue
+			}
+			if len(msgs) >= count {
+				return msgs, nil
+			}
+			msgs = append(msgs, consumer.Message{
+				Topic:         topic,
+				Partition:     partition,
+				Key:           msg.Msg.Key,
+				Value:         msg.Msg.Value,
+				Offset:        msgOffset,
+				Timestamp:     msg.Msg.Timestamp,
+				HighWaterMark: block.HighWaterMarkOffset,
+			})
+		}
+	}
+	return msgs, nil
+}
+
 // GetTopicConsumers returns client-id -> consumed-partitions-list mapping
 // for a clients from a particular consumer group and a particular topic.
 func (a *T) GetTopicConsumers(group, topic string) (map[string][]int32, error) {
@@ -261,6 +432,26 @@ func (a *T) GetTopicConsumers(group, topic string) (map[string][]int32, error) {
 	return consumers, nil
 }
 
+// GetGroupTopics returns a sorted list of topics that the specified consumer
+// group has partition owners registered for in ZooKeeper, that is topics that
+// are or have been consumed by the group.
+func (a *T) GetGroupTopics(group string) ([]string, error) {
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return nil, err
+	}
+	ownersPath := fmt.Sprintf("%s/consumers/%s/owners", a.cfg.ZooKeeper.Chroot, group)
+	topics, _, err := zkConn.Children(ownersPath)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil, ErrInvalidParam(errors.New("unknown group"))
+		}
+		return nil, errors.Wrapf(err, "failed to fetch group topics")
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
 // GetAllTopicConsumers returns group -> client-id -> consumed-partitions-list
 // mapping for a particular topic. Warning, the function performs scan of all
 // consumer groups registered in ZooKeeper and therefore can take a lot of time.
@@ -291,6 +482,367 @@ func (a *T) GetAllTopicConsumers(topic string) (map[string]map[string][]int32, e
 	return consumers, nil
 }
 
+// GroupMember describes a member of a consumer group as it is registered in
+// ZooKeeper. Members that own partitions but are not registered, e.g. those
+// that have left the group but have not released partitions yet, are
+// reported with Registered set to false.
+type GroupMember struct {
+	ID            string
+	Registered    bool
+	Subscriptions []string
+	Partitions    map[string][]int32
+}
+
+// memberRegistration is the part of a member registration znode that we care
+// about. It is written by kazoo-go.
+type memberRegistration struct {
+	Subscription map[string]int `json:"subscription"`
+}
+
+// GetGroups returns a sorted list of consumer groups registered in ZooKeeper.
+func (a *T) GetGroups() ([]string, error) {
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return nil, err
+	}
+	groups, _, err := zkConn.Children(a.cfg.ZooKeeper.Chroot + "/consumers")
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return []string{}, nil
+		}
+		return nil, errors.Wrapf(err, "failed to fetch consumer groups")
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// GetGroupMembers returns members of a consumer group sorted by ID, along
+// with topics they are subscribed to and partitions they own.
+func (a *T) GetGroupMembers(group string) ([]GroupMember, error) {
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return nil, err
+	}
+	groupPath := fmt.Sprintf("%s/consumers/%s", a.cfg.ZooKeeper.Chroot, group)
+	ok, _, err := zkConn.Exists(groupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check group")
+	}
+	if !ok {
+		return nil, ErrInvalidParam(errors.New("unknown group"))
+	}
+
+	membersByID := make(map[string]*GroupMember)
+	memberIDs, _, err := zkConn.Children(groupPath + "/ids")
+	if err != nil && err != zk.ErrNoNode {
+		return nil, errors.Wrapf(err, "failed to fetch group members")
+	}
+	for _, memberID := range memberIDs {
+		data, _, err := zkConn.Get(groupPath + "/ids/" + memberID)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to fetch registration, member=%s", memberID)
+		}
+		var registration memberRegistration
+		if err := json.Unmarshal(data, &registration); err != nil {
+			return nil, errors.Wrapf(err, "bad registration, member=%s", memberID)
+		}
+		subscriptions := make([]string, 0, len(registration.Subscription))
+		for topic := range registration.Subscription {
+			subscriptions = append(subscriptions, topic)
+		}
+		sort.Strings(subscriptions)
+		membersByID[memberID] = &GroupMember{
+			ID:            memberID,
+			Registered:    true,
+			Subscriptions: subscriptions,
+			Partitions:    make(map[string][]int32),
+		}
+	}
+
+	topics, _, err := zkConn.Children(groupPath + "/owners")
+	if err != nil && err != zk.ErrNoNode {
+		return nil, errors.Wrapf(err, "failed to fetch group topics")
+	}
+	for _, topic := range topics {
+		topicConsumers, err := a.GetTopicConsumers(group, topic)
+		if err != nil {
+			// The topic owners node may be gone by now.
+			if _, ok := err.(ErrInvalidParam); ok {
+				continue
+			}
+			return nil, err
+		}
+		for memberID, partitions := range topicConsumers {
+			member := membersByID[memberID]
+			if member == nil {
+				member = &GroupMember{
+					ID:            memberID,
+					Subscriptions: []string{},
+					Partitions:    make(map[string][]int32),
+				}
+				membersByID[memberID] = member
+			}
+			member.Partitions[topic] = partitions
+		}
+	}
+
+	members := make([]GroupMember, 0, len(membersByID))
+	for _, member := range membersByID {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+// TopicMetadata describes partitions of a topic.
+type TopicMetadata struct {
+	Topic      string
+	Partitions []PartitionMetadata
+}
+
+// PartitionMetadata describes replicas of a partition. Replicas are given by
+// broker IDs.
+type PartitionMetadata struct {
+	Partition int32
+	Leader    int32
+	Replicas  []int32
+	ISR       []int32
+}
+
+// GetTopicsMetadata returns metadata of the specified topics, or of all
+// topics if none is specified, sorted by topic name. Partitions of a topic
+// are sorted by partition ID.
+func (a *T) GetTopicsMetadata(topics ...string) ([]TopicMetadata, error) {
+	results, err := a.getTopicsMetadata(topics)
+	if err != nil {
+		if _, ok := err.(ErrInvalidParam); ok {
+			return nil, err
+		}
+		a.ResetKafkaClt()
+		return a.getTopicsMetadata(topics)
+	}
+	return results, nil
+}
+
+func (a *T) getTopicsMetadata(topics []string) ([]TopicMetadata, error) {
+	kafkaClt, err := a.lazyKafkaClt()
+	if err != nil {
+		return nil, err
+	}
+	// The Kafka client does not expose in-sync replicas, so metadata is
+	// requested from a broker directly. Any broker will do, and a leader of
+	// a known topic is one that the client is connected to.
+	knownTopics, err := kafkaClt.Topics()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get topics")
+	}
+	if len(knownTopics) == 0 {
+		if len(topics) != 0 {
+			return nil, ErrInvalidParam(errors.Errorf("unknown topic: %s", topics[0]))
+		}
+		return []TopicMetadata{}, nil
+	}
+	broker, err := kafkaClt.Leader(knownTopics[0], 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get partition leader, topic=%s", knownTopics[0])
+	}
+	res, err := broker.GetMetadata(&sarama.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get metadata")
+	}
+
+	results := make([]TopicMetadata, 0, len(res.Topics))
+	for _, tm := range res.Topics {
+		if tm.Err == sarama.ErrUnknownTopicOrPartition {
+			return nil, ErrInvalidParam(errors.Errorf("unknown topic: %s", tm.Name))
+		}
+		if tm.Err != sarama.ErrNoError {
+			return nil, errors.Wrapf(tm.Err, "failed to get topic metadata, topic=%s", tm.Name)
+		}
+		topicMeta := TopicMetadata{Topic: tm.Name, Partitions: make([]PartitionMetadata, len(tm.Partitions))}
+		for i, pm := range tm.Partitions {
+			topicMeta.Partitions[i] = PartitionMetadata{
+				Partition: pm.ID,
+				Leader:    pm.Leader,
+				Replicas:  pm.Replicas,
+				ISR:       pm.Isr,
+			}
+		}
+		sort.Slice(topicMeta.Partitions, func(i, j int) bool {
+			return topicMeta.Partitions[i].Partition < topicMeta.Partitions[j].Partition
+		})
+		results = append(results, topicMeta)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Topic < results[j].Topic })
+	return results, nil
+}
+
+// TopicSpec describes a topic to be created.
+type TopicSpec struct {
+	Topic             string
+	Partitions        int32
+	ReplicationFactor int32
+	Config            map[string]string
+}
+
+// CreateTopic creates a topic the same way Kafka tools of the Kafka versions
+// supported by Kafka-Pixy do it: partition replicas are assigned to brokers
+// registered in ZooKeeper, and the assignment is stored in ZooKeeper after
+// topic config overrides. The Kafka controller picks it up and creates
+// the partitions asynchronously. Config overrides are not validated.
+func (a *T) CreateTopic(spec TopicSpec) error {
+	switch {
+	case !validTopicRE.MatchString(spec.Topic) || spec.Topic == "." || spec.Topic == "..":
+		return ErrInvalidParam(errors.Errorf("bad topic name: %s", spec.Topic))
+	case spec.Partitions <= 0:
+		return ErrInvalidParam(errors.New("partitions must be > 0"))
+	case spec.ReplicationFactor <= 0:
+		return ErrInvalidParam(errors.New("replication factor must be > 0"))
+	}
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return err
+	}
+	brokerIDStrs, _, err := zkConn.Children(a.cfg.ZooKeeper.Chroot + "/brokers/ids")
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch brokers")
+	}
+	brokerIDs := make([]int32, len(brokerIDStrs))
+	for i, brokerIDStr := range brokerIDStrs {
+		brokerID, err := strconv.ParseInt(brokerIDStr, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "bad broker ID: %s", brokerIDStr)
+		}
+		brokerIDs[i] = int32(brokerID)
+	}
+	if int(spec.ReplicationFactor) > len(brokerIDs) {
+		return ErrInvalidParam(errors.Errorf("replication factor %d is larger than the number of brokers %d",
+			spec.ReplicationFactor, len(brokerIDs)))
+	}
+	sort.Sort(int32Slice(brokerIDs))
+	assignment := assignReplicas(brokerIDs, spec.Partitions, spec.ReplicationFactor,
+		rand.Intn(len(brokerIDs)), rand.Intn(len(brokerIDs)))
+
+	topicConfig := spec.Config
+	if topicConfig == nil {
+		topicConfig = map[string]string{}
+	}
+	configData, err := json.Marshal(topicConfigZNode{Version: 1, Config: topicConfig})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal topic config")
+	}
+	partitions := make(map[string][]int32, len(assignment))
+	for p, replicas := range assignment {
+		partitions[strconv.Itoa(p)] = replicas
+	}
+	assignmentData, err := json.Marshal(topicAssignmentZNode{Version: 1, Partitions: partitions})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal partition assignment")
+	}
+	topicPath := a.cfg.ZooKeeper.Chroot + "/brokers/topics/" + spec.Topic
+	ok, _, err := zkConn.Exists(topicPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to check topic")
+	}
+	if ok {
+		return ErrTopicExists
+	}
+	// Config of a deleted topic may have been left behind, so it is
+	// overwritten, like Kafka tools do it.
+	acl := zk.WorldACL(zk.PermAll)
+	configPath := a.cfg.ZooKeeper.Chroot + "/config/topics/" + spec.Topic
+	if _, err = zkConn.Create(configPath, configData, 0, acl); err == zk.ErrNodeExists {
+		_, err = zkConn.Set(configPath, configData, -1)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write topic config")
+	}
+	if _, err = zkConn.Create(topicPath, assignmentData, 0, acl); err != nil {
+		if err == zk.ErrNodeExists {
+			return ErrTopicExists
+		}
+		return errors.Wrap(err, "failed to write partition assignment")
+	}
+	return nil
+}
+
+// DeleteTopic marks a topic for deletion. Kafka deletes it asynchronously,
+// and only if brokers are configured with `delete.topic.enable=true`,
+// otherwise the topic stays marked for deletion but intact.
+func (a *T) DeleteTopic(topic string) error {
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return err
+	}
+	ok, _, err := zkConn.Exists(a.cfg.ZooKeeper.Chroot + "/brokers/topics/" + topic)
+	if err != nil {
+		return errors.Wrap(err, "failed to check topic")
+	}
+	if !ok {
+		return ErrInvalidParam(errors.Errorf("unknown topic: %s", topic))
+	}
+	_, err = zkConn.Create(a.cfg.ZooKeeper.Chroot+"/admin/delete_topics/"+topic, nil, 0, zk.WorldACL(zk.PermAll))
+	if err != nil && err != zk.ErrNodeExists {
+		return errors.Wrap(err, "failed to mark topic for deletion")
+	}
+	return nil
+}
+
+// topicConfigZNode is the format of `/config/topics/<topic>` nodes.
+type topicConfigZNode struct {
+	Version int               `json:"version"`
+	Config  map[string]string `json:"config"`
+}
+
+// topicAssignmentZNode is the format of `/brokers/topics/<topic>` nodes.
+type topicAssignmentZNode struct {
+	Version    int                `json:"version"`
+	Partitions map[string][]int32 `json:"partitions"`
+}
+
+// assignReplicas assigns partition replicas to brokers the same way Kafka
+// does it when rack awareness is disabled. The first replica of partitions
+// goes round-robin over brokers starting from `startIndex`, and the other
+// replicas follow it shifted by `shift`, that increases every time the first
+// replicas wrap around, so that replicas of the same broker are spread over
+// other brokers. `brokerIDs` must be sorted.
+func assignReplicas(brokerIDs []int32, partitions, replicationFactor int32, startIndex, shift int) [][]int32 {
+	brokerCount := len(brokerIDs)
+	assignment := make([][]int32, partitions)
+	for p := 0; p < int(partitions); p++ {
+		if p > 0 && p%brokerCount == 0 {
+			shift++
+		}
+		firstIndex := (p + startIndex) % brokerCount
+		replicas := []int32{brokerIDs[firstIndex]}
+		for j := 0; j < int(replicationFactor)-1; j++ {
+			replicaShift := 1 + (shift+j)%(brokerCount-1)
+			replicas = append(replicas, brokerIDs[(firstIndex+replicaShift)%brokerCount])
+		}
+		assignment[p] = replicas
+	}
+	return assignment
+}
+
+// CheckZooKeeper verifies that a ZooKeeper session is established and that
+// the broker registry can be read.
+func (a *T) CheckZooKeeper() error {
+	zkConn, err := a.lazyZKConn()
+	if err != nil {
+		return err
+	}
+	if state := zkConn.State(); state != zk.StateHasSession {
+		return errors.Errorf("no session, state=%s", state)
+	}
+	if _, _, err := zkConn.Exists(a.cfg.ZooKeeper.Chroot + "/brokers/ids"); err != nil {
+		return errors.Wrap(err, "failed to read broker registry")
+	}
+	return nil
+}
+
 func (a *T) lazyKafkaClt() (sarama.Client, error) {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
@@ -315,6 +867,76 @@ func (a *T) lazyZKConn() (*zk.Conn, error) {
 	return a.zkConn, nil
 }
 
+// getOffsetRanges returns the oldest and newest offsets of all partitions of
+// the specified topic.
+func getOffsetRanges(kafkaClt sarama.Client, topic string) ([]PartitionOffset, error) {
+	partitions, err := kafkaClt.Partitions(topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get topic partitions")
+	}
+
+	// Figure out distribution of partitions among brokers.
+	brokerToPartitions := make(map[*sarama.Broker][]indexedPartition)
+	for i, p := range partitions {
+		broker, err := kafkaClt.Leader(topic, p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get partition leader, partition=%d", p)
+		}
+		brokerToPartitions[broker] = append(brokerToPartitions[broker], indexedPartition{i, p})
+	}
+
+	// Query brokers for the oldest and newest offsets of the partitions that
+	// they are leaders for.
+	offsets := make([]PartitionOffset, len(partitions))
+	var wg sync.WaitGroup
+	errorsCh := make(chan error, len(brokerToPartitions))
+	for broker, brokerPartitions := range brokerToPartitions {
+		broker, brokerPartitions := broker, brokerPartitions
+		var reqNewest sarama.OffsetRequest
+		var reqOldest sarama.OffsetRequest
+		for _, p := range brokerPartitions {
+			reqNewest.AddBlock(topic, p.partition, sarama.OffsetNewest, 1)
+			reqOldest.AddBlock(topic, p.partition, sarama.OffsetOldest, 1)
+		}
+		actorID := actor.RootID.NewChild("adminOffsetFetcher")
+		actor.Spawn(actorID, &wg, func() {
+			resOldest, err := broker.GetAvailableOffsets(&reqOldest)
+			if err != nil {
+				errorsCh <- errors.Wrapf(err, "failed to fetch oldest offset, broker=%v", broker.ID())
+				return
+			}
+			resNewest, err := broker.GetAvailableOffsets(&reqNewest)
+			if err != nil {
+				errorsCh <- errors.Wrapf(err, "failed to fetch newest offset, broker=%v", broker.ID())
+				return
+			}
+			for _, xp := range brokerPartitions {
+				begin, err := getOffsetResult(resOldest, topic, xp.partition)
+				if err != nil {
+					errorsCh <- errors.Wrapf(err, "failed to fetch oldest offset, broker=%v", broker.ID())
+					return
+				}
+				end, err := getOffsetResult(resNewest, topic, xp.partition)
+				if err != nil {
+					errorsCh <- errors.Wrapf(err, "failed to fetch newest offset, broker=%v", broker.ID())
+					return
+				}
+				offsets[xp.index].Partition = xp.partition
+				offsets[xp.index].Begin = begin
+				offsets[xp.index].End = end
+			}
+		})
+	}
+	wg.Wait()
+	// If we failed to get offset range for at least one of the partitions then
+	// return the first error that was reported.
+	close(errorsCh)
+	if err, ok := <-errorsCh; ok {
+		return nil, err
+	}
+	return offsets, nil
+}
+
 func getOffsetResult(res *sarama.OffsetResponse, topic string, partition int32) (int64, error) {
 	block := res.GetBlock(topic, partition)
 	if block == nil {
@@ -1,8 +1,10 @@
 package admin
 
 import (
+	"fmt"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
@@ -110,3 +112,151 @@ func (s *AdminSuite) TestSetOffsetsPartialUpdate(c *C) {
 
 	a.Stop()
 }
+
+// Metadata of all topics or of particular topics can be retrieved.
+func (s *AdminSuite) TestGetTopicsMetadata(c *C) {
+	a, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	defer a.Stop()
+
+	// When
+	all, err := a.GetTopicsMetadata()
+	c.Assert(err, IsNil)
+	some, err := a.GetTopicsMetadata("test.4", "test.1")
+	c.Assert(err, IsNil)
+
+	// Then
+	topics := make(map[string]int)
+	for _, tm := range all {
+		topics[tm.Topic] = len(tm.Partitions)
+	}
+	c.Assert(topics["test.1"], Equals, 1)
+	c.Assert(topics["test.4"], Equals, 4)
+	c.Assert(topics["test.64"], Equals, 64)
+
+	c.Assert(len(some), Equals, 2)
+	c.Assert(some[0].Topic, Equals, "test.1")
+	c.Assert(some[1].Topic, Equals, "test.4")
+	for i, pm := range some[1].Partitions {
+		c.Assert(pm.Partition, Equals, int32(i))
+		c.Assert(pm.Replicas, Not(HasLen), 0)
+		c.Assert(pm.ISR, Not(HasLen), 0)
+	}
+}
+
+func (s *AdminSuite) TestGetTopicsMetadataUnknownTopic(c *C) {
+	a, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	defer a.Stop()
+
+	// When
+	_, err = a.GetTopicsMetadata("no-such-topic")
+
+	// Then
+	c.Assert(err.Error(), Equals, "unknown topic: no-such-topic")
+	_, ok := err.(ErrInvalidParam)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *AdminSuite) TestAssignReplicas(c *C) {
+	for i, tc := range []struct {
+		brokerIDs         []int32
+		partitions        int32
+		replicationFactor int32
+		startIndex        int
+		shift             int
+		want              [][]int32
+	}{{
+		brokerIDs: []int32{5}, partitions: 2, replicationFactor: 1,
+		want: [][]int32{{5}, {5}},
+	}, {
+		brokerIDs: []int32{1, 2, 3}, partitions: 4, replicationFactor: 2,
+		want: [][]int32{{1, 2}, {2, 3}, {3, 1}, {1, 3}},
+	}, {
+		brokerIDs: []int32{1, 2, 3}, partitions: 3, replicationFactor: 3, startIndex: 1, shift: 1,
+		want: [][]int32{{2, 1, 3}, {3, 2, 1}, {1, 3, 2}},
+	}} {
+		// When
+		assignment := assignReplicas(tc.brokerIDs, tc.partitions, tc.replicationFactor, tc.startIndex, tc.shift)
+
+		// Then
+		c.Assert(assignment, DeepEquals, tc.want, Commentf("case #%d", i))
+	}
+}
+
+// A created topic shows up in metadata, and can be deleted.
+func (s *AdminSuite) TestCreateDeleteTopic(c *C) {
+	a, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	defer a.Stop()
+	topic := fmt.Sprintf("test.created.%d", time.Now().UnixNano())
+
+	// When
+	err = a.CreateTopic(TopicSpec{Topic: topic, Partitions: 3, ReplicationFactor: 1,
+		Config: map[string]string{"retention.ms": "3600000"}})
+
+	// Then
+	c.Assert(err, IsNil)
+	var topicsMeta []TopicMetadata
+	for i := 0; i < 50; i++ {
+		if topicsMeta, err = a.GetTopicsMetadata(topic); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(len(topicsMeta[0].Partitions), Equals, 3)
+	c.Assert(a.CreateTopic(TopicSpec{Topic: topic, Partitions: 1, ReplicationFactor: 1}), Equals, ErrTopicExists)
+
+	// When
+	err = a.DeleteTopic(topic)
+
+	// Then
+	c.Assert(err, IsNil)
+}
+
+func (s *AdminSuite) TestCreateTopicInvalid(c *C) {
+	a, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	defer a.Stop()
+
+	for i, tc := range []struct {
+		spec TopicSpec
+		err  string
+	}{{
+		spec: TopicSpec{Topic: "foo/bar", Partitions: 1, ReplicationFactor: 1},
+		err:  "bad topic name: foo/bar",
+	}, {
+		spec: TopicSpec{Topic: "..", Partitions: 1, ReplicationFactor: 1},
+		err:  "bad topic name: ..",
+	}, {
+		spec: TopicSpec{Topic: "foo", Partitions: 0, ReplicationFactor: 1},
+		err:  "partitions must be > 0",
+	}, {
+		spec: TopicSpec{Topic: "foo", Partitions: 1, ReplicationFactor: 0},
+		err:  "replication factor must be > 0",
+	}, {
+		spec: TopicSpec{Topic: "foo", Partitions: 1, ReplicationFactor: 100},
+		err:  "replication factor 100 is larger than the number of brokers .*",
+	}} {
+		// When
+		err := a.CreateTopic(tc.spec)
+
+		// Then
+		c.Assert(err, ErrorMatches, tc.err, Commentf("case #%d", i))
+		_, ok := err.(ErrInvalidParam)
+		c.Assert(ok, Equals, true, Commentf("case #%d", i))
+	}
+}
+
+func (s *AdminSuite) TestDeleteTopicUnknown(c *C) {
+	a, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	defer a.Stop()
+
+	// When
+	err = a.DeleteTopic("no-such-topic")
+
+	// Then
+	c.Assert(err.Error(), Equals, "unknown topic: no-such-topic")
+}
@@ -0,0 +1,109 @@
+// Package audit implements recording of administrative requests that change
+// state, e.g. offsets, topics or the log level, to a file and/or a Kafka
+// topic, so that it is known who did what and when.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+)
+
+// Record describes an administrative request.
+type Record struct {
+	Time time.Time `json:"time"`
+
+	// ID of an authenticated client, empty if the listener does not require
+	// authentication.
+	Principal  string `json:"principal,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+
+	Operation string `json:"operation"`
+	Cluster   string `json:"cluster,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Query     string `json:"query,omitempty"`
+
+	// Request body as read by the request handler. If it is longer than
+	// `MaxBodyLen`, then only that many first bytes are recorded.
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+
+	// Status of the response.
+	Status int `json:"status"`
+}
+
+// MaxBodyLen is the maximum number of request body bytes recorded.
+const MaxBodyLen = 64 * 1024
+
+// Producer is the subset of `proxy.T` methods that an auditor needs to
+// produce records to a Kafka topic.
+type Producer interface {
+	AsyncProduce(ctx context.Context, topic string, key, message sarama.Encoder) error
+}
+
+// T writes records to sinks configured by `HTTPAudit`. It is safe for
+// concurrent use.
+type T struct {
+	cfg      *config.HTTPAudit
+	producer Producer
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// New creates an auditor with the specified configuration. Records are
+// produced to `HTTPAudit.Topic` with `producer`. It returns nil if no sink
+// is configured.
+func New(cfg *config.HTTPAudit, producer Producer) (*T, error) {
+	if cfg.File == "" && cfg.Topic == "" {
+		return nil, nil
+	}
+	t := &T{cfg: cfg, producer: producer}
+	if cfg.File != "" {
+		var err error
+		if t.file, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640); err != nil {
+			return nil, errors.Wrap(err, "failed to open audit file")
+		}
+	}
+	return t, nil
+}
+
+// Record writes a record to all configured sinks. Records produced to Kafka
+// are keyed by the principal, so that records of a client are ordered.
+// Failures are logged, they never fail the request being recorded.
+func (t *T) Record(rec Record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("Failed to encode audit record: err=(%s)", err)
+		return
+	}
+	if t.file != nil {
+		t.mu.Lock()
+		_, err := t.file.Write(append(data, '\n'))
+		t.mu.Unlock()
+		if err != nil {
+			log.Errorf("Failed to write audit record: err=(%s)", err)
+		}
+	}
+	if t.cfg.Topic != "" {
+		if err := t.producer.AsyncProduce(context.Background(), t.cfg.Topic, sarama.StringEncoder(rec.Principal), sarama.ByteEncoder(data)); err != nil {
+			log.Errorf("Failed to produce audit record: err=(%s)", err)
+		}
+	}
+}
+
+// Close closes the audit file, if one is configured.
+func (t *T) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
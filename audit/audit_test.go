@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type AuditSuite struct {
+	rec Record
+}
+
+var _ = Suite(&AuditSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *AuditSuite) SetUpTest(c *C) {
+	s.rec = Record{
+		Time:       time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC),
+		Principal:  "key#0",
+		RemoteAddr: "127.0.0.1:5000",
+		Operation:  "set_offsets",
+		Method:     "POST",
+		Path:       "/topics/foo/offsets",
+		Query:      "group=bar",
+		Body:       `[{"partition":0,"offset":1}]`,
+		Status:     200,
+	}
+}
+
+// If no sink is configured, then no auditor is created.
+func (s *AuditSuite) TestDisabled(c *C) {
+	t, err := New(&config.HTTPAudit{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(t, IsNil)
+}
+
+// Records are appended to the file as JSON lines.
+func (s *AuditSuite) TestFile(c *C) {
+	file, err := ioutil.TempFile("", "kafka-pixy-audit")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	file.WriteString("previous\n")
+	file.Close()
+	t, err := New(&config.HTTPAudit{File: file.Name()}, nil)
+	c.Assert(err, IsNil)
+
+	// When
+	t.Record(s.rec)
+	c.Assert(t.Close(), IsNil)
+
+	// Then
+	data, err := ioutil.ReadFile(file.Name())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "previous\n"+
+		`{"time":"2017-04-01T12:00:00Z","principal":"key#0","remote_addr":"127.0.0.1:5000",`+
+		`"operation":"set_offsets","method":"POST","path":"/topics/foo/offsets","query":"group=bar",`+
+		`"body":"[{\"partition\":0,\"offset\":1}]","status":200}`+"\n")
+}
+
+// Records are produced to the topic keyed by the principal.
+func (s *AuditSuite) TestTopic(c *C) {
+	producer := &fakeProducer{}
+	t, err := New(&config.HTTPAudit{Topic: "__audit"}, producer)
+	c.Assert(err, IsNil)
+
+	// When
+	t.Record(s.rec)
+
+	// Then
+	c.Assert(producer.topics, DeepEquals, []string{"__audit"})
+	c.Assert(producer.keys, DeepEquals, []string{"key#0"})
+	c.Assert(len(producer.values), Equals, 1)
+	c.Assert(producer.values[0], Matches, `\{"time":"2017-04-01T12:00:00Z",.*"status":200\}`)
+}
+
+type fakeProducer struct {
+	topics []string
+	keys   []string
+	values []string
+}
+
+func (p *fakeProducer) AsyncProduce(ctx context.Context, topic string, key, message sarama.Encoder) error {
+	keyBytes, _ := key.Encode()
+	value, _ := message.Encode()
+	p.topics = append(p.topics, topic)
+	p.keys = append(p.keys, string(keyBytes))
+	p.values = append(p.values, string(value))
+	return nil
+}
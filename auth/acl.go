@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+// Maximum number of ACL decisions remembered. When it is reached all of them
+// are forgotten.
+const maxCachedDecisions = 10000
+
+// Request describes an API request that a principal is authorized to make.
+type Request struct {
+	Operation config.ACLOperation
+	Method    string
+	Path      string
+	Topics    []string
+	Groups    []string
+}
+
+// acl grants principals operations according to a list of rules. Decisions
+// depend only on the principal ID and the request, so they are cached.
+type acl struct {
+	rules []config.ACLRule
+
+	mu        sync.Mutex
+	decisions map[string]error
+}
+
+func newACL(rules []config.ACLRule) *acl {
+	return &acl{rules: rules, decisions: make(map[string]error)}
+}
+
+func (a *acl) authorize(p *Principal, rq Request) error {
+	key := p.id + "\x00" + string(rq.Operation) + "\x00" + strings.Join(rq.Topics, ",") + "\x00" + strings.Join(rq.Groups, ",")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err, ok := a.decisions[key]; ok {
+		return err
+	}
+	err := a.decide(p, rq)
+	if len(a.decisions) >= maxCachedDecisions {
+		a.decisions = make(map[string]error)
+	}
+	a.decisions[key] = err
+	return err
+}
+
+// decide returns nil if any rule grants the request, or an error that tells
+// why none does.
+func (a *acl) decide(p *Principal, rq Request) error {
+	for _, rule := range a.rules {
+		if ruleGrants(rule, p, rq) {
+			return nil
+		}
+	}
+	var details []string
+	if len(rq.Topics) > 0 {
+		details = append(details, "topics="+strings.Join(rq.Topics, ","))
+	}
+	if len(rq.Groups) > 0 {
+		details = append(details, "groups="+strings.Join(rq.Groups, ","))
+	}
+	if len(details) == 0 {
+		return errors.Errorf("operation %s is not allowed", rq.Operation)
+	}
+	return errors.Errorf("operation %s is not allowed: %s", rq.Operation, strings.Join(details, ", "))
+}
+
+func ruleGrants(rule config.ACLRule, p *Principal, rq Request) bool {
+	if !matchAny(rule.Principals, p.id) {
+		return false
+	}
+	var opOK bool
+	for _, op := range rule.Operations {
+		if op == rq.Operation {
+			opOK = true
+			break
+		}
+	}
+	if !opOK {
+		return false
+	}
+	if len(rq.Topics) == 0 && len(rq.Groups) == 0 {
+		return len(rule.Topics) == 0 && len(rule.Groups) == 0
+	}
+	for _, topic := range rq.Topics {
+		if !matchAny(rule.Topics, topic) {
+			return false
+		}
+	}
+	for _, group := range rq.Groups {
+		if !matchAny(rule.Groups, group) {
+			return false
+		}
+	}
+	return true
+}
+
+// auditLog appends authorization decisions to a file as JSON lines.
+type auditLog struct {
+	clock func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+type auditEntry struct {
+	Time      string              `json:"time"`
+	Principal string              `json:"principal"`
+	Operation config.ACLOperation `json:"operation"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"`
+	Topics    []string            `json:"topics,omitempty"`
+	Groups    []string            `json:"groups,omitempty"`
+	Allowed   bool                `json:"allowed"`
+	Reason    string              `json:"reason,omitempty"`
+}
+
+func openAuditLog(filename string) (*auditLog, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+	return &auditLog{clock: time.Now, file: file}, nil
+}
+
+func (l *auditLog) record(p *Principal, rq Request, decision error) error {
+	entry := auditEntry{
+		Time:      l.clock().UTC().Format(time.RFC3339Nano),
+		Principal: p.id,
+		Operation: rq.Operation,
+		Method:    rq.Method,
+		Path:      rq.Path,
+		Topics:    rq.Topics,
+		Groups:    rq.Groups,
+		Allowed:   decision == nil,
+	}
+	if decision != nil {
+		entry.Reason = decision.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode audit entry")
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return errors.Wrap(err, "failed to write audit entry")
+	}
+	return nil
+}
+
+func (l *auditLog) close() error {
+	return l.file.Close()
+}
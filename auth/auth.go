@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os/user"
+	"path"
+	"strconv"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidToken is returned by Authenticate if a token is neither one of
+// configured tokens or API keys, nor a valid JWT.
+var ErrInvalidToken = errors.New("missing or invalid token")
+
+// ErrUnknownPeer is returned by AuthenticatePeer if a local user is not one
+// of configured peers.
+var ErrUnknownPeer = errors.New("missing token and unknown peer")
+
+// Principal describes topics and consumer groups that an authenticated
+// client has access to.
+type Principal struct {
+	id        string
+	topics    []string
+	groups    []string
+	rateLimit config.RateLimit
+	tenant    string
+}
+
+// ID returns a string that identifies the client, e.g. for rate limiting.
+func (p *Principal) ID() string {
+	return p.id
+}
+
+// RateLimit returns the rate limit configured for the client. It is zero if
+// the client is subject to the default per client limit.
+func (p *Principal) RateLimit() config.RateLimit {
+	return p.rateLimit
+}
+
+// Tenant returns the name of a tenant that the client belongs to, or an
+// empty string if it does not belong to any.
+func (p *Principal) Tenant() string {
+	return p.tenant
+}
+
+// Restricted tells whether the principal has access to some topics or groups
+// only.
+func (p *Principal) Restricted() bool {
+	return len(p.topics) > 0 || len(p.groups) > 0
+}
+
+// AllTopics tells whether the principal has access to all topics.
+func (p *Principal) AllTopics() bool {
+	return len(p.topics) == 0
+}
+
+// CanAccessTopic tells whether the principal has access to a topic.
+func (p *Principal) CanAccessTopic(topic string) bool {
+	return matchAny(p.topics, topic)
+}
+
+// CanAccessGroup tells whether the principal has access to a consumer group.
+func (p *Principal) CanAccessGroup(group string) bool {
+	return matchAny(p.groups, group)
+}
+
+// T authenticates clients by bearer tokens. A token can be either one of
+// statically configured tokens or API keys, or a JSON Web Token. Clients
+// connected over a Unix domain socket can also be authenticated by their
+// local user.
+type T struct {
+	tokens [][]byte
+	keys   []apiKey
+	peers  map[uint32]Principal
+	jwt    *jwtValidator
+	acl    *acl
+	audit  *auditLog
+}
+
+type apiKey struct {
+	key       []byte
+	principal Principal
+}
+
+// New creates an authenticator with the specified configuration. API keys,
+// peers and JSON Web Tokens assigned to a tenant grant access to topics and
+// groups whose names start with prefixes of the tenant defined in `tenants`.
+func New(cfg *config.ListenerAuth, tenants map[string]config.Tenant) (*T, error) {
+	a := &T{}
+	for _, token := range cfg.Tokens {
+		a.tokens = append(a.tokens, []byte(token))
+	}
+	for i, key := range cfg.Keys {
+		topics, groups := key.Topics, key.Groups
+		if key.Tenant != "" {
+			var err error
+			if topics, groups, err = tenantPatterns(tenants, key.Tenant); err != nil {
+				return nil, err
+			}
+		}
+		id := key.Name
+		if id == "" {
+			id = fmt.Sprintf("key#%d", i)
+		}
+		a.keys = append(a.keys, apiKey{
+			key: []byte(key.Key),
+			principal: Principal{
+				id:        id,
+				topics:    topics,
+				groups:    groups,
+				rateLimit: key.RateLimit,
+				tenant:    key.Tenant,
+			},
+		})
+	}
+	for _, peer := range cfg.Peers {
+		uid, err := lookupUID(peer.User)
+		if err != nil {
+			return nil, err
+		}
+		if a.peers == nil {
+			a.peers = make(map[uint32]Principal)
+		}
+		topics, groups := peer.Topics, peer.Groups
+		if peer.Tenant != "" {
+			if topics, groups, err = tenantPatterns(tenants, peer.Tenant); err != nil {
+				return nil, err
+			}
+		}
+		a.peers[uid] = Principal{id: "unix:" + peer.User, topics: topics, groups: groups, tenant: peer.Tenant}
+	}
+	if cfg.JWT.HS256Secret != "" || cfg.JWT.RS256PublicKeyFile != "" {
+		var err error
+		if a.jwt, err = newJWTValidator(cfg, tenants); err != nil {
+			return nil, errors.Wrap(err, "failed to configure JWT validation")
+		}
+	}
+	if len(cfg.ACL) > 0 {
+		a.acl = newACL(cfg.ACL)
+	}
+	if cfg.AuditLog != "" {
+		var err error
+		if a.audit, err = openAuditLog(cfg.AuditLog); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Authorize checks that ACL rules grant a principal the request. If no rules
+// are configured, then all requests are granted.
+func (a *T) Authorize(p *Principal, rq Request) error {
+	if a.acl == nil {
+		return nil
+	}
+	return a.acl.authorize(p, rq)
+}
+
+// Audit records an authorization decision to the audit log, if it is
+// configured. `decision` is nil if the request was granted, or an error that
+// tells why it was denied.
+func (a *T) Audit(p *Principal, rq Request, decision error) error {
+	if a.audit == nil {
+		return nil
+	}
+	return a.audit.record(p, rq, decision)
+}
+
+// Close releases resources held by the authenticator.
+func (a *T) Close() error {
+	if a.audit == nil {
+		return nil
+	}
+	return a.audit.close()
+}
+
+// Authenticate returns a principal that the token grants access to.
+func (a *T) Authenticate(token string) (*Principal, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	tokenBytes := []byte(token)
+	for i, validToken := range a.tokens {
+		if subtle.ConstantTimeCompare(tokenBytes, validToken) == 1 {
+			return &Principal{id: fmt.Sprintf("token#%d", i)}, nil
+		}
+	}
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(tokenBytes, key.key) == 1 {
+			principal := key.principal
+			return &principal, nil
+		}
+	}
+	if a.jwt != nil {
+		return a.jwt.validate(token)
+	}
+	return nil, ErrInvalidToken
+}
+
+// AuthenticatePeer returns a principal that a local user with the specified
+// ID is granted, as identified by peer credentials of a Unix domain socket
+// connection.
+func (a *T) AuthenticatePeer(uid uint32) (*Principal, error) {
+	principal, ok := a.peers[uid]
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	return &principal, nil
+}
+
+// lookupUID returns the ID of a local user given by either name or ID.
+func lookupUID(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unknown peer user, %s", name)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad peer user id, %s", u.Uid)
+	}
+	return uint32(uid), nil
+}
+
+// matchAny tells whether a name matches any of the glob patterns. An empty
+// list of patterns matches everything, and a malformed pattern nothing.
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantPatterns returns glob patterns of topics and groups that a tenant
+// grants access to.
+func tenantPatterns(tenants map[string]config.Tenant, name string) ([]string, []string, error) {
+	tenant, ok := tenants[name]
+	if !ok {
+		return nil, nil, errors.Errorf("unknown tenant, %s", name)
+	}
+	return prefixPatterns(tenant.TopicPrefixes), prefixPatterns(tenant.GroupPrefixes), nil
+}
+
+// prefixPatterns returns glob patterns that match names starting with any of
+// the prefixes. Prefixes are known to have no glob meta characters.
+func prefixPatterns(prefixes []string) []string {
+	var patterns []string
+	for _, prefix := range prefixes {
+		patterns = append(patterns, prefix+"*")
+	}
+	return patterns
+}
@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *AuthSuite) TestTokensAndKeys(c *C) {
+	cfg := &config.ListenerAuth{
+		Tokens: []string{"t1"},
+		Keys: []config.APIKey{
+			{Key: "k1", Topics: []string{"orders.*", "users"}},
+			{Key: "k2", Groups: []string{"billing"}},
+		},
+	}
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+
+	for i, tc := range []struct {
+		token      string
+		err        error
+		restricted bool
+		topic      string
+		topicOK    bool
+		group      string
+		groupOK    bool
+	}{
+		{token: "", err: ErrInvalidToken},
+		{token: "t2", err: ErrInvalidToken},
+		{token: "t1", topic: "foo", topicOK: true, group: "bar", groupOK: true},
+		{token: "k1", restricted: true, topic: "orders.eu", topicOK: true, group: "bar", groupOK: true},
+		{token: "k1", restricted: true, topic: "users", topicOK: true},
+		{token: "k1", restricted: true, topic: "orders", topicOK: false},
+		{token: "k2", restricted: true, topic: "foo", topicOK: true, group: "billing", groupOK: true},
+		{token: "k2", restricted: true, group: "shipping", groupOK: false},
+	} {
+		// When
+		principal, err := a.Authenticate(tc.token)
+
+		// Then
+		c.Assert(err, Equals, tc.err, Commentf("case #%d", i))
+		if err != nil {
+			continue
+		}
+		c.Assert(principal.Restricted(), Equals, tc.restricted, Commentf("case #%d", i))
+		if tc.topic != "" {
+			c.Assert(principal.CanAccessTopic(tc.topic), Equals, tc.topicOK, Commentf("case #%d", i))
+		}
+		if tc.group != "" {
+			c.Assert(principal.CanAccessGroup(tc.group), Equals, tc.groupOK, Commentf("case #%d", i))
+		}
+	}
+}
+
+// API keys assigned to a tenant grant access to topics and groups with the
+// tenant prefixes.
+func (s *AuthSuite) TestTenantKeys(c *C) {
+	cfg := &config.ListenerAuth{
+		Keys: []config.APIKey{
+			{Key: "k1", Tenant: "billing"},
+			{Key: "k2", Tenant: "shared"},
+		},
+	}
+	tenants := map[string]config.Tenant{
+		"billing": {TopicPrefixes: []string{"billing.", "invoices."}, GroupPrefixes: []string{"billing."}},
+		"shared":  {},
+	}
+	a, err := New(cfg, tenants)
+	c.Assert(err, IsNil)
+
+	for i, tc := range []struct {
+		token      string
+		tenant     string
+		restricted bool
+		topic      string
+		topicOK    bool
+		group      string
+		groupOK    bool
+	}{
+		{token: "k1", tenant: "billing", restricted: true, topic: "billing.eu", topicOK: true, group: "billing.reports", groupOK: true},
+		{token: "k1", tenant: "billing", restricted: true, topic: "invoices.eu", topicOK: true, group: "billing", groupOK: false},
+		{token: "k1", tenant: "billing", restricted: true, topic: "orders", topicOK: false, group: "orders", groupOK: false},
+		{token: "k2", tenant: "shared", restricted: false, topic: "orders", topicOK: true, group: "orders", groupOK: true},
+	} {
+		// When
+		principal, err := a.Authenticate(tc.token)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(principal.Tenant(), Equals, tc.tenant, Commentf("case #%d", i))
+		c.Assert(principal.Restricted(), Equals, tc.restricted, Commentf("case #%d", i))
+		c.Assert(principal.CanAccessTopic(tc.topic), Equals, tc.topicOK, Commentf("case #%d", i))
+		c.Assert(principal.CanAccessGroup(tc.group), Equals, tc.groupOK, Commentf("case #%d", i))
+	}
+}
+
+// Local users can be assigned to a tenant the same way API keys are.
+func (s *AuthSuite) TestTenantPeers(c *C) {
+	cfg := &config.ListenerAuth{
+		Peers: []config.UnixPeer{{User: "root", Tenant: "billing"}},
+	}
+	tenants := map[string]config.Tenant{
+		"billing": {TopicPrefixes: []string{"billing."}, GroupPrefixes: []string{"billing."}},
+	}
+	a, err := New(cfg, tenants)
+	c.Assert(err, IsNil)
+
+	// When
+	principal, err := a.AuthenticatePeer(0)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(principal.Tenant(), Equals, "billing")
+	c.Assert(principal.CanAccessTopic("billing.eu"), Equals, true)
+	c.Assert(principal.CanAccessTopic("orders"), Equals, false)
+	c.Assert(principal.CanAccessGroup("billing.reports"), Equals, true)
+
+	// Unknown tenants are rejected.
+	cfg.Peers[0].Tenant = "orders"
+	_, err = New(cfg, tenants)
+	c.Assert(err, ErrorMatches, "unknown tenant, orders")
+}
+
+// Local users are granted access by their name or ID, and identified by the
+// name they are configured with.
+func (s *AuthSuite) TestPeers(c *C) {
+	cfg := &config.ListenerAuth{
+		Peers: []config.UnixPeer{
+			{User: "root", Topics: []string{"orders.*"}},
+			{User: "1000"},
+		},
+	}
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+
+	// When
+	root, err1 := a.AuthenticatePeer(0)
+	other, err2 := a.AuthenticatePeer(1000)
+	_, err3 := a.AuthenticatePeer(1001)
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(root.ID(), Equals, "unix:root")
+	c.Assert(root.CanAccessTopic("orders.eu"), Equals, true)
+	c.Assert(root.CanAccessTopic("users"), Equals, false)
+	c.Assert(err2, IsNil)
+	c.Assert(other.ID(), Equals, "unix:1000")
+	c.Assert(other.Restricted(), Equals, false)
+	c.Assert(err3, Equals, ErrUnknownPeer)
+}
+
+func (s *AuthSuite) TestPeersUnknownUser(c *C) {
+	cfg := &config.ListenerAuth{Peers: []config.UnixPeer{{User: "no-such-user-here"}}}
+
+	// When
+	_, err := New(cfg, nil)
+
+	// Then
+	c.Assert(err, ErrorMatches, "unknown peer user, no-such-user-here: .*")
+}
+
+// ACL rules grant principals operations on topics and groups, and a rule
+// that is not restricted to topics and groups is needed for requests that
+// name neither.
+func (s *AuthSuite) TestACL(c *C) {
+	cfg := &config.ListenerAuth{
+		Tokens: []string{"t1"},
+		Keys:   []config.APIKey{{Key: "k1", Name: "billing"}, {Key: "k2"}},
+		ACL: []config.ACLRule{{
+			Principals: []string{"billing"},
+			Operations: []config.ACLOperation{config.ACLProduce, config.ACLConsume},
+			Topics:     []string{"billing.*"},
+			Groups:     []string{"billing"},
+		}, {
+			Principals: []string{"key#*", "token#0"},
+			Operations: []config.ACLOperation{config.ACLAdmin},
+		}},
+	}
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+
+	for i, tc := range []struct {
+		token string
+		rq    Request
+		err   string
+	}{{
+		token: "k1",
+		rq:    Request{Operation: config.ACLProduce, Topics: []string{"billing.eu"}},
+	}, {
+		token: "k1",
+		rq:    Request{Operation: config.ACLConsume, Topics: []string{"billing.eu"}, Groups: []string{"billing"}},
+	}, {
+		token: "k1",
+		rq:    Request{Operation: config.ACLConsume, Topics: []string{"billing.eu"}, Groups: []string{"other"}},
+		err:   "operation consume is not allowed: topics=billing.eu, groups=other",
+	}, {
+		token: "k1",
+		rq:    Request{Operation: config.ACLAdmin, Topics: []string{"billing.eu"}},
+		err:   "operation admin is not allowed: topics=billing.eu",
+	}, {
+		token: "k1",
+		rq:    Request{Operation: config.ACLConsume},
+		err:   "operation consume is not allowed",
+	}, {
+		token: "k2",
+		rq:    Request{Operation: config.ACLAdmin},
+	}, {
+		token: "t1",
+		rq:    Request{Operation: config.ACLAdmin, Topics: []string{"foo"}},
+	}, {
+		token: "t1",
+		rq:    Request{Operation: config.ACLProduce, Topics: []string{"foo"}},
+		err:   "operation produce is not allowed: topics=foo",
+	}} {
+		principal, err := a.Authenticate(tc.token)
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+
+		// When
+		err = a.Authorize(principal, tc.rq)
+
+		// Then
+		if tc.err == "" {
+			c.Assert(err, IsNil, Commentf("case #%d", i))
+			continue
+		}
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+	// Decisions are cached.
+	c.Assert(len(a.acl.decisions), Equals, 8)
+}
+
+// Authorization decisions are appended to the audit log as JSON lines.
+func (s *AuthSuite) TestAuditLog(c *C) {
+	auditFile, err := ioutil.TempFile("", "kafka-pixy-audit")
+	c.Assert(err, IsNil)
+	defer os.Remove(auditFile.Name())
+	auditFile.Close()
+	cfg := &config.ListenerAuth{Tokens: []string{"t1"}, AuditLog: auditFile.Name()}
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+	a.audit.clock = func() time.Time { return time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC) }
+	principal, err := a.Authenticate("t1")
+	c.Assert(err, IsNil)
+
+	// When
+	c.Assert(a.Audit(principal, Request{Operation: config.ACLProduce, Method: "POST", Path: "/topics/foo/messages", Topics: []string{"foo"}}, nil), IsNil)
+	c.Assert(a.Audit(principal, Request{Operation: config.ACLAdmin, Method: "GET", Path: "/topics"}, errors.New("kaboom")), IsNil)
+	c.Assert(a.Close(), IsNil)
+
+	// Then
+	data, err := ioutil.ReadFile(auditFile.Name())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, ""+
+		`{"time":"2017-04-01T12:00:00Z","principal":"token#0","operation":"produce","method":"POST","path":"/topics/foo/messages","topics":["foo"],"allowed":true}`+"\n"+
+		`{"time":"2017-04-01T12:00:00Z","principal":"token#0","operation":"admin","method":"GET","path":"/topics","allowed":false,"reason":"kaboom"}`+"\n")
+}
+
+func (s *AuthSuite) TestJWTHS256(c *C) {
+	cfg := &config.ListenerAuth{}
+	cfg.JWT.HS256Secret = "s3cr3t"
+	cfg.JWT.Issuer = "issuer"
+	cfg.JWT.Audience = "pixy"
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+	now := time.Now().Unix()
+
+	for i, tc := range []struct {
+		header string
+		claims map[string]interface{}
+		secret string
+		err    error
+	}{{
+		claims: map[string]interface{}{"iss": "issuer", "aud": "pixy", "exp": now + 60, "topics": []string{"foo"}},
+	}, {
+		claims: map[string]interface{}{"iss": "issuer", "aud": []string{"other", "pixy"}, "nbf": now - 60},
+	}, {
+		// Wrong secret
+		claims: map[string]interface{}{"iss": "issuer", "aud": "pixy"},
+		secret: "foo",
+		err:    ErrInvalidToken,
+	}, {
+		// Expired
+		claims: map[string]interface{}{"iss": "issuer", "aud": "pixy", "exp": now - 1},
+		err:    ErrInvalidToken,
+	}, {
+		// Not valid yet
+		claims: map[string]interface{}{"iss": "issuer", "aud": "pixy", "nbf": now + 60},
+		err:    ErrInvalidToken,
+	}, {
+		// Wrong issuer
+		claims: map[string]interface{}{"iss": "other", "aud": "pixy"},
+		err:    ErrInvalidToken,
+	}, {
+		// Wrong audience
+		claims: map[string]interface{}{"iss": "issuer", "aud": []string{"other"}},
+		err:    ErrInvalidToken,
+	}, {
+		// Unsigned
+		header: `{"alg":"none"}`,
+		claims: map[string]interface{}{"iss": "issuer", "aud": "pixy"},
+		err:    ErrInvalidToken,
+	}} {
+		secret := tc.secret
+		if secret == "" {
+			secret = "s3cr3t"
+		}
+		token := signHS256(c, tc.header, tc.claims, secret)
+
+		// When
+		principal, err := a.Authenticate(token)
+
+		// Then
+		c.Assert(err, Equals, tc.err, Commentf("case #%d", i))
+		if err == nil {
+			_, restricted := tc.claims["topics"]
+			c.Assert(principal.Restricted(), Equals, restricted, Commentf("case #%d", i))
+		}
+	}
+}
+
+// A token with the `tenant` claim grants access to topics and groups of the
+// tenant, and cannot have `topics` and `groups` claims along with it.
+func (s *AuthSuite) TestJWTTenant(c *C) {
+	cfg := &config.ListenerAuth{}
+	cfg.JWT.HS256Secret = "s3cr3t"
+	tenants := map[string]config.Tenant{
+		"billing": {TopicPrefixes: []string{"billing."}, GroupPrefixes: []string{"billing."}},
+	}
+	a, err := New(cfg, tenants)
+	c.Assert(err, IsNil)
+
+	for i, tc := range []struct {
+		claims map[string]interface{}
+		err    error
+	}{{
+		claims: map[string]interface{}{"sub": "foo", "tenant": "billing"},
+	}, {
+		// Unknown tenant
+		claims: map[string]interface{}{"sub": "foo", "tenant": "orders"},
+		err:    ErrInvalidToken,
+	}, {
+		// Topics along with a tenant
+		claims: map[string]interface{}{"sub": "foo", "tenant": "billing", "topics": []string{"orders"}},
+		err:    ErrInvalidToken,
+	}} {
+		// When
+		principal, err := a.Authenticate(signHS256(c, "", tc.claims, "s3cr3t"))
+
+		// Then
+		c.Assert(err, Equals, tc.err, Commentf("case #%d", i))
+		if err == nil {
+			c.Assert(principal.Tenant(), Equals, "billing", Commentf("case #%d", i))
+			c.Assert(principal.CanAccessTopic("billing.eu"), Equals, true, Commentf("case #%d", i))
+			c.Assert(principal.CanAccessTopic("orders"), Equals, false, Commentf("case #%d", i))
+		}
+	}
+}
+
+func (s *AuthSuite) TestJWTRS256(c *C) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	c.Assert(err, IsNil)
+	keyFile, err := ioutil.TempFile("", "kafka-pixy-jwt")
+	c.Assert(err, IsNil)
+	defer os.Remove(keyFile.Name())
+	c.Assert(pem.Encode(keyFile, &pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER}), IsNil)
+	keyFile.Close()
+
+	cfg := &config.ListenerAuth{}
+	cfg.JWT.RS256PublicKeyFile = keyFile.Name()
+	a, err := New(cfg, nil)
+	c.Assert(err, IsNil)
+	claims := map[string]interface{}{"groups": []string{"foo"}}
+	signingInput := encodeSegment(c, `{"alg":"RS256"}`) + "." + encodeSegment(c, claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	c.Assert(err, IsNil)
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	// When
+	principal, err := a.Authenticate(token)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(principal.CanAccessGroup("foo"), Equals, true)
+	c.Assert(principal.CanAccessGroup("bar"), Equals, false)
+
+	// A token signed with HS256 using the public key as a secret is rejected.
+	_, err = a.Authenticate(signHS256(c, `{"alg":"HS256"}`, claims, string(publicKeyDER)))
+	c.Assert(err, Equals, ErrInvalidToken)
+}
+
+func signHS256(c *C, header string, claims map[string]interface{}, secret string) string {
+	if header == "" {
+		header = `{"alg":"HS256","typ":"JWT"}`
+	}
+	signingInput := encodeSegment(c, header) + "." + encodeSegment(c, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeSegment(c *C, v interface{}) string {
+	data, ok := v.(string)
+	if !ok {
+		encoded, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+		data = string(encoded)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(data))
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+)
+
+// jwtValidator verifies JSON Web Tokens signed with either HS256 or RS256,
+// depending on the configured key. Tokens signed with any other algorithm,
+// including `none`, are rejected.
+type jwtValidator struct {
+	alg       string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	tenants   map[string]config.Tenant
+	clock     func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Topics    []string        `json:"topics"`
+	Groups    []string        `json:"groups"`
+	Tenant    string          `json:"tenant"`
+}
+
+func newJWTValidator(cfg *config.ListenerAuth, tenants map[string]config.Tenant) (*jwtValidator, error) {
+	v := &jwtValidator{
+		issuer:   cfg.JWT.Issuer,
+		audience: cfg.JWT.Audience,
+		tenants:  tenants,
+		clock:    time.Now,
+	}
+	if cfg.JWT.HS256Secret != "" {
+		v.alg = algHS256
+		v.secret = []byte(cfg.JWT.HS256Secret)
+		return v, nil
+	}
+	keyPEM, err := ioutil.ReadFile(cfg.JWT.RS256PublicKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read public key file")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found in %s", cfg.JWT.RS256PublicKeyFile)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("not an RSA public key in %s", cfg.JWT.RS256PublicKeyFile)
+	}
+	v.alg = algRS256
+	v.publicKey = rsaPublicKey
+	return v, nil
+}
+
+// validate verifies the token signature and claims, and returns a principal
+// with access restricted by the `topics` and `groups` claims, or by prefixes
+// of the tenant given by the `tenant` claim.
+func (v *jwtValidator) validate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != v.alg {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signingInput := parts[0] + "." + parts[1]
+	if !v.verifySignature(signingInput, signature) {
+		return nil, ErrInvalidToken
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := float64(v.clock().Unix())
+	switch {
+	case claims.ExpiresAt != nil && now >= *claims.ExpiresAt:
+		return nil, ErrInvalidToken
+	case claims.NotBefore != nil && now < *claims.NotBefore:
+		return nil, ErrInvalidToken
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return nil, ErrInvalidToken
+	case v.audience != "" && !audienceContains(claims.Audience, v.audience):
+		return nil, ErrInvalidToken
+	}
+	// Clients are told apart by the subject, or by the signature if there is
+	// none, since it is unique for the token.
+	id := "jwt:" + claims.Subject
+	if claims.Subject == "" {
+		id = "jwt#" + parts[2]
+	}
+	topics, groups := claims.Topics, claims.Groups
+	if claims.Tenant != "" {
+		if len(topics) > 0 || len(groups) > 0 {
+			return nil, ErrInvalidToken
+		}
+		var err error
+		if topics, groups, err = tenantPatterns(v.tenants, claims.Tenant); err != nil {
+			return nil, ErrInvalidToken
+		}
+	}
+	return &Principal{id: id, topics: topics, groups: groups, tenant: claims.Tenant}, nil
+}
+
+func (v *jwtValidator) verifySignature(signingInput string, signature []byte) bool {
+	if v.alg == algHS256 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	return rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature) == nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains tells whether the `aud` claim, that can be either a
+// string or a list of strings, contains the specified audience.
+func audienceContains(claim json.RawMessage, audience string) bool {
+	var single string
+	if err := json.Unmarshal(claim, &single); err == nil {
+		return single == audience
+	}
+	var list []string
+	if err := json.Unmarshal(claim, &list); err != nil {
+		return false
+	}
+	for _, aud := range list {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package avro
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type AvroSuite struct{}
+
+var _ = Suite(&AvroSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+const userSchema = `{
+  "type": "record",
+  "name": "User",
+  "namespace": "com.example",
+  "fields": [
+    {"name": "id", "type": "long"},
+    {"name": "name", "type": "string"},
+    {"name": "email", "type": ["null", "string"], "default": null},
+    {"name": "score", "type": "double", "default": 0},
+    {"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["ADMIN", "GUEST"]}},
+    {"name": "tags", "type": {"type": "array", "items": "string"}},
+    {"name": "attrs", "type": {"type": "map", "values": "int"}},
+    {"name": "hash", "type": {"type": "fixed", "name": "Hash", "size": 2}},
+    {"name": "friend", "type": ["null", "User"], "default": null}
+  ]
+}`
+
+// Encoding produces the Avro binary format as defined by the specification.
+func (s *AvroSuite) TestEncodePrimitives(c *C) {
+	for i, tc := range []struct {
+		schema  string
+		json    string
+		encoded []byte
+	}{
+		{schema: `"null"`, json: `null`, encoded: nil},
+		{schema: `"boolean"`, json: `true`, encoded: []byte{1}},
+		{schema: `"int"`, json: `-64`, encoded: []byte{0x7F}},
+		{schema: `"long"`, json: `64`, encoded: []byte{0x80, 0x01}},
+		{schema: `{"type": "long", "logicalType": "timestamp-millis"}`, json: `1`, encoded: []byte{0x02}},
+		{schema: `"float"`, json: `1.5`, encoded: []byte{0x00, 0x00, 0xC0, 0x3F}},
+		{schema: `"double"`, json: `-2`, encoded: []byte{0, 0, 0, 0, 0, 0, 0x00, 0xC0}},
+		{schema: `"string"`, json: `"foo"`, encoded: []byte{0x06, 'f', 'o', 'o'}},
+		{schema: `"bytes"`, json: `"\u0000ÿ"`, encoded: []byte{0x04, 0x00, 0xFF}},
+		{schema: `["null", "string"]`, json: `"a"`, encoded: []byte{0x02, 0x02, 'a'}},
+		{schema: `["null", "string"]`, json: `{"string": "a"}`, encoded: []byte{0x02, 0x02, 'a'}},
+		{schema: `["null", "string"]`, json: `null`, encoded: []byte{0x00}},
+		{schema: `{"type": "array", "items": "int"}`, json: `[1, 2]`, encoded: []byte{0x04, 0x02, 0x04, 0x00}},
+		{schema: `{"type": "array", "items": "int"}`, json: `[]`, encoded: []byte{0x00}},
+	} {
+		schema, err := Parse(tc.schema)
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+
+		// When
+		encoded, err := EncodeJSON(schema, []byte(tc.json))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(encoded, DeepEquals, tc.encoded, Commentf("case #%d", i))
+	}
+}
+
+// A record decoded from its encoded form is the same as the original, with
+// missing fields set to defaults and fields in the schema order.
+func (s *AvroSuite) TestRoundTrip(c *C) {
+	schema, err := Parse(userSchema)
+	c.Assert(err, IsNil)
+
+	// When
+	encoded, err := EncodeJSON(schema, []byte(`{
+	  "tags": ["a", "b"], "name": "Bob", "id": 42, "kind": "GUEST",
+	  "attrs": {"x": 1}, "hash": "\u0001\u0002",
+	  "friend": {"id": 1, "name": "Ann", "email": "ann@example.com", "kind": "ADMIN",
+	             "tags": [], "attrs": {}, "hash": "zz"}}`))
+	c.Assert(err, IsNil)
+	decoded, err := DecodeJSON(schema, encoded)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, `{"id":42,"name":"Bob","email":null,"score":0,`+
+		`"kind":"GUEST","tags":["a","b"],"attrs":{"x":1},"hash":"\u0001\u0002",`+
+		`"friend":{"id":1,"name":"Ann","email":"ann@example.com","score":0,`+
+		`"kind":"ADMIN","tags":[],"attrs":{},"hash":"zz","friend":null}}`)
+}
+
+// JSON documents that do not match the schema are rejected.
+func (s *AvroSuite) TestEncodeInvalid(c *C) {
+	schema, err := Parse(userSchema)
+	c.Assert(err, IsNil)
+	for i, tc := range []struct {
+		json string
+		err  string
+	}{{
+		json: `{"id": 1`,
+		err:  "invalid JSON: unexpected EOF",
+	}, {
+		json: `[]`,
+		err:  "record com.example.User expected, got []",
+	}, {
+		json: `{"id": 1}`,
+		err:  "field com.example.User.name is missing",
+	}, {
+		json: `{"id": 1.5, "name": "Bob"}`,
+		err:  "field com.example.User.id: long expected, got 1.5",
+	}, {
+		json: `{"id": 1, "name": "Bob", "email": 5}`,
+		err:  "field com.example.User.email: no union branch matches 5",
+	}, {
+		json: `{"id": 1, "name": "Bob", "kind": "ROOT"}`,
+		err:  "field com.example.User.kind: unknown symbol of enum com.example.Kind, ROOT",
+	}} {
+		// When
+		_, err := EncodeJSON(schema, []byte(tc.json))
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+// Data that was not written with the schema is rejected.
+func (s *AvroSuite) TestDecodeInvalid(c *C) {
+	schema, err := Parse(`{"type": "record", "name": "R", "fields": [
+	  {"name": "s", "type": "string"}, {"name": "u", "type": ["null", "int"]}]}`)
+	c.Assert(err, IsNil)
+	for i, tc := range []struct {
+		data []byte
+		err  string
+	}{{
+		data: []byte{0x06, 'f', 'o'},
+		err:  "field R.s: unexpected end of data",
+	}, {
+		data: []byte{0x02, 'f', 0x04},
+		err:  "field R.u: invalid union branch index, 2",
+	}, {
+		data: []byte{0x02, 'f', 0x00, 0x00},
+		err:  "1 trailing bytes",
+	}} {
+		// When
+		_, err := DecodeJSON(schema, tc.data)
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *AvroSuite) TestParseInvalid(c *C) {
+	for i, tc := range []struct {
+		schema string
+		err    string
+	}{{
+		schema: `"foo"`,
+		err:    "unknown type foo",
+	}, {
+		schema: `{"type": "record", "name": "R"}`,
+		err:    "record R must have fields",
+	}, {
+		schema: `{"type": "enum", "name": "E", "symbols": []}`,
+		err:    "enum E must have symbols",
+	}, {
+		schema: `["null", ["int"]]`,
+		err:    "union must not contain a union",
+	}} {
+		// When
+		_, err := Parse(tc.schema)
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
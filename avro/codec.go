@@ -0,0 +1,494 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeJSON encodes a JSON document to Avro binary format in accordance
+// with the schema.
+//
+// Values of bytes and fixed types are expected as strings where every
+// character represents one byte, as defined by the Avro JSON encoding. A
+// union value can be given either as is, then the first matching union
+// branch is used, or wrapped into an object with the branch type name as the
+// only key, e.g. {"string": "foo"}. Missing record fields are set to their
+// defaults.
+func EncodeJSON(s *Schema, data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid JSON: trailing data")
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, s, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeJSON decodes data in Avro binary format written with the schema and
+// returns it as a JSON document. Union values are returned as is, that is
+// not wrapped into an object.
+func DecodeJSON(s *Schema, data []byte) ([]byte, error) {
+	d := decoder{data: data}
+	v, err := d.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) != 0 {
+		return nil, errors.Errorf("%d trailing bytes", len(d.data))
+	}
+	return json.Marshal(v)
+}
+
+func encode(buf *bytes.Buffer, s *Schema, v interface{}) error {
+	switch s.Type {
+	case TypeNull:
+		if v != nil {
+			return errors.Errorf("null expected, got %v", v)
+		}
+		return nil
+
+	case TypeBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return errors.Errorf("boolean expected, got %v", v)
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return nil
+
+	case TypeInt, TypeLong:
+		n, ok := v.(json.Number)
+		if !ok {
+			return errors.Errorf("%s expected, got %v", s.Type, v)
+		}
+		i, err := n.Int64()
+		if err != nil || (s.Type == TypeInt && (i < math.MinInt32 || i > math.MaxInt32)) {
+			return errors.Errorf("%s expected, got %v", s.Type, n)
+		}
+		writeLong(buf, i)
+		return nil
+
+	case TypeFloat, TypeDouble:
+		n, ok := v.(json.Number)
+		if !ok {
+			return errors.Errorf("%s expected, got %v", s.Type, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return errors.Errorf("%s expected, got %v", s.Type, n)
+		}
+		if s.Type == TypeFloat {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+			buf.Write(b[:])
+			return nil
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		buf.Write(b[:])
+		return nil
+
+	case TypeString:
+		str, ok := v.(string)
+		if !ok {
+			return errors.Errorf("string expected, got %v", v)
+		}
+		writeLong(buf, int64(len(str)))
+		buf.WriteString(str)
+		return nil
+
+	case TypeBytes, TypeFixed:
+		str, ok := v.(string)
+		if !ok {
+			return errors.Errorf("%s expected, got %v", s.Type, v)
+		}
+		b, err := stringToBytes(str)
+		if err != nil {
+			return err
+		}
+		if s.Type == TypeBytes {
+			writeLong(buf, int64(len(b)))
+		} else if len(b) != s.Size {
+			return errors.Errorf("fixed %s of size %d expected, got %d bytes", s.Name, s.Size, len(b))
+		}
+		buf.Write(b)
+		return nil
+
+	case TypeRecord:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("record %s expected, got %v", s.Name, v)
+		}
+		for _, f := range s.Fields {
+			fv, ok := m[f.Name]
+			if !ok {
+				if f.Default == nil {
+					return errors.Errorf("field %s.%s is missing", s.Name, f.Name)
+				}
+				decoder := json.NewDecoder(bytes.NewReader(f.Default))
+				decoder.UseNumber()
+				if err := decoder.Decode(&fv); err != nil {
+					return errors.Wrapf(err, "invalid default of field %s.%s", s.Name, f.Name)
+				}
+				// The default of a union field corresponds to its first branch.
+				if f.Type.Type == TypeUnion {
+					writeLong(buf, 0)
+					if err := encode(buf, f.Type.Branches[0], fv); err != nil {
+						return errors.Wrapf(err, "invalid default of field %s.%s", s.Name, f.Name)
+					}
+					continue
+				}
+			}
+			if err := encode(buf, f.Type, fv); err != nil {
+				return errors.Wrapf(err, "field %s.%s", s.Name, f.Name)
+			}
+		}
+		return nil
+
+	case TypeEnum:
+		str, ok := v.(string)
+		if !ok {
+			return errors.Errorf("enum %s expected, got %v", s.Name, v)
+		}
+		for i, symbol := range s.Symbols {
+			if symbol == str {
+				writeLong(buf, int64(i))
+				return nil
+			}
+		}
+		return errors.Errorf("unknown symbol of enum %s, %s", s.Name, str)
+
+	case TypeArray:
+		items, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("array expected, got %v", v)
+		}
+		if len(items) > 0 {
+			writeLong(buf, int64(len(items)))
+			for i, item := range items {
+				if err := encode(buf, s.Items, item); err != nil {
+					return errors.Wrapf(err, "item #%d", i)
+				}
+			}
+		}
+		writeLong(buf, 0)
+		return nil
+
+	case TypeMap:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("map expected, got %v", v)
+		}
+		if len(m) > 0 {
+			keys := make([]string, 0, len(m))
+			for key := range m {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			writeLong(buf, int64(len(keys)))
+			for _, key := range keys {
+				writeLong(buf, int64(len(key)))
+				buf.WriteString(key)
+				if err := encode(buf, s.Values, m[key]); err != nil {
+					return errors.Wrapf(err, "key %s", key)
+				}
+			}
+		}
+		writeLong(buf, 0)
+		return nil
+
+	case TypeUnion:
+		return encodeUnion(buf, s, v)
+	}
+	return errors.Errorf("unsupported type %s", s.Type)
+}
+
+func encodeUnion(buf *bytes.Buffer, s *Schema, v interface{}) error {
+	// A value wrapped into an object with the branch name as the only key.
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for name, bv := range m {
+			for i, branch := range s.Branches {
+				if branchName(branch) != name && (branch.Name == "" || shortName(branch.Name) != name) {
+					continue
+				}
+				writeLong(buf, int64(i))
+				return encode(buf, branch, bv)
+			}
+		}
+	}
+	for i, branch := range s.Branches {
+		var branchBuf bytes.Buffer
+		if err := encode(&branchBuf, branch, v); err != nil {
+			continue
+		}
+		writeLong(buf, int64(i))
+		buf.Write(branchBuf.Bytes())
+		return nil
+	}
+	return errors.Errorf("no union branch matches %v", v)
+}
+
+func branchName(s *Schema) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return string(s.Type)
+}
+
+// stringToBytes converts a string where every character represents a byte
+// to a byte slice.
+func stringToBytes(str string) ([]byte, error) {
+	b := make([]byte, 0, len(str))
+	for _, r := range str {
+		if r > 0xFF {
+			return nil, errors.Errorf("bytes expected, got character %q", r)
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// bytesToString is the reverse of stringToBytes.
+func bytesToString(b []byte) string {
+	buf := make([]byte, 0, len(b))
+	for _, c := range b {
+		buf = append(buf, string(rune(c))...)
+	}
+	return string(buf)
+}
+
+func writeLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+type decoder struct {
+	data []byte
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+func (d *decoder) decode(s *Schema) (interface{}, error) {
+	switch s.Type {
+	case TypeNull:
+		return nil, nil
+
+	case TypeBoolean:
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+
+	case TypeInt, TypeLong:
+		return d.readLong()
+
+	case TypeFloat:
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+
+	case TypeDouble:
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+
+	case TypeString:
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(b) {
+			return nil, errors.New("invalid UTF-8 string")
+		}
+		return string(b), nil
+
+	case TypeBytes:
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return bytesToString(b), nil
+
+	case TypeFixed:
+		b, err := d.read(s.Size)
+		if err != nil {
+			return nil, err
+		}
+		return bytesToString(b), nil
+
+	case TypeRecord:
+		r := &record{fields: make([]recordField, len(s.Fields))}
+		for i, f := range s.Fields {
+			fv, err := d.decode(f.Type)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s.%s", s.Name, f.Name)
+			}
+			r.fields[i] = recordField{f.Name, fv}
+		}
+		return r, nil
+
+	case TypeEnum:
+		i, err := d.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.Symbols)) {
+			return nil, errors.Errorf("invalid symbol index of enum %s, %d", s.Name, i)
+		}
+		return s.Symbols[i], nil
+
+	case TypeArray:
+		items := []interface{}{}
+		err := d.readBlocks(func() error {
+			item, err := d.decode(s.Items)
+			if err != nil {
+				return errors.Wrapf(err, "item #%d", len(items))
+			}
+			items = append(items, item)
+			return nil
+		})
+		return items, err
+
+	case TypeMap:
+		m := make(map[string]interface{})
+		err := d.readBlocks(func() error {
+			key, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			value, err := d.decode(s.Values)
+			if err != nil {
+				return errors.Wrapf(err, "key %s", key)
+			}
+			m[string(key)] = value
+			return nil
+		})
+		return m, err
+
+	case TypeUnion:
+		i, err := d.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.Branches)) {
+			return nil, errors.Errorf("invalid union branch index, %d", i)
+		}
+		return d.decode(s.Branches[i])
+	}
+	return nil, errors.Errorf("unsupported type %s", s.Type)
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data) {
+		return nil, errUnexpectedEnd
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) readLong() (int64, error) {
+	n, size := binary.Varint(d.data)
+	if size <= 0 {
+		return 0, errors.New("invalid varint")
+	}
+	d.data = d.data[size:]
+	return n, nil
+}
+
+func (d *decoder) readBytes() ([]byte, error) {
+	n, err := d.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(len(d.data)) {
+		return nil, errUnexpectedEnd
+	}
+	return d.read(int(n))
+}
+
+// readBlocks reads items of an array or a map that are encoded as a series
+// of blocks terminated by an empty block.
+func (d *decoder) readBlocks(readItem func() error) error {
+	for {
+		count, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		// A negative count is followed by the block size in bytes.
+		if count < 0 {
+			count = -count
+			if _, err := d.readLong(); err != nil {
+				return err
+			}
+		}
+		// Every item but null takes at least one byte, so a bogus count is
+		// detected before the items are read.
+		if count > int64(len(d.data)) {
+			return errUnexpectedEnd
+		}
+		for ; count > 0; count-- {
+			if err := readItem(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// record is a decoded record that is marshaled to JSON with fields in the
+// order they are defined in the schema.
+type record struct {
+	fields []recordField
+}
+
+type recordField struct {
+	name  string
+	value interface{}
+}
+
+func (r *record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range r.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,248 @@
+package avro
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Type is an Avro schema type.
+type Type string
+
+const (
+	TypeNull    Type = "null"
+	TypeBoolean Type = "boolean"
+	TypeInt     Type = "int"
+	TypeLong    Type = "long"
+	TypeFloat   Type = "float"
+	TypeDouble  Type = "double"
+	TypeBytes   Type = "bytes"
+	TypeString  Type = "string"
+	TypeRecord  Type = "record"
+	TypeEnum    Type = "enum"
+	TypeArray   Type = "array"
+	TypeMap     Type = "map"
+	TypeUnion   Type = "union"
+	TypeFixed   Type = "fixed"
+)
+
+var primitiveTypes = map[Type]bool{
+	TypeNull:    true,
+	TypeBoolean: true,
+	TypeInt:     true,
+	TypeLong:    true,
+	TypeFloat:   true,
+	TypeDouble:  true,
+	TypeBytes:   true,
+	TypeString:  true,
+}
+
+// Schema is a parsed Avro schema. Only fields relevant to the schema type
+// are set. Logical types are treated as their underlying types.
+type Schema struct {
+	Type Type
+
+	// Full name of a record, enum or fixed type.
+	Name string
+
+	// Fields of a record.
+	Fields []*Field
+
+	// Symbols of an enum.
+	Symbols []string
+
+	// Schema of array items.
+	Items *Schema
+
+	// Schema of map values.
+	Values *Schema
+
+	// Schemas of union branches.
+	Branches []*Schema
+
+	// Size of a fixed value in bytes.
+	Size int
+}
+
+// Field is a field of an Avro record.
+type Field struct {
+	Name string
+	Type *Schema
+
+	// Value that is used if the field is missing, nil if the field does not
+	// have a default.
+	Default json.RawMessage
+}
+
+// Parse parses an Avro schema from its JSON representation.
+func Parse(schemaJSON string) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &v); err != nil {
+		return nil, errors.Wrap(err, "invalid schema JSON")
+	}
+	return parse(v, "", make(map[string]*Schema))
+}
+
+func parse(v interface{}, namespace string, names map[string]*Schema) (*Schema, error) {
+	switch v := v.(type) {
+	case string:
+		if primitiveTypes[Type(v)] {
+			return &Schema{Type: Type(v)}, nil
+		}
+		if s, ok := names[fullName(v, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := names[v]; ok {
+			return s, nil
+		}
+		return nil, errors.Errorf("unknown type %s", v)
+
+	case []interface{}:
+		s := &Schema{Type: TypeUnion}
+		for _, branch := range v {
+			bs, err := parse(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			if bs.Type == TypeUnion {
+				return nil, errors.New("union must not contain a union")
+			}
+			s.Branches = append(s.Branches, bs)
+		}
+		return s, nil
+
+	case map[string]interface{}:
+		return parseComplex(v, namespace, names)
+	}
+	return nil, errors.Errorf("invalid schema %v", v)
+}
+
+func parseComplex(v map[string]interface{}, namespace string, names map[string]*Schema) (*Schema, error) {
+	typeName, ok := v["type"].(string)
+	if !ok {
+		// The type is itself a schema, e.g. {"type": {"type": "array", ...}}.
+		return parse(v["type"], namespace, names)
+	}
+	switch t := Type(typeName); t {
+	case TypeRecord, "error":
+		s, ns, err := registerNamed(TypeRecord, v, namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := v["fields"].([]interface{})
+		if !ok {
+			return nil, errors.Errorf("record %s must have fields", s.Name)
+		}
+		for _, fv := range fields {
+			fm, ok := fv.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("invalid field of record %s", s.Name)
+			}
+			name, _ := fm["name"].(string)
+			if name == "" {
+				return nil, errors.Errorf("field of record %s must have a name", s.Name)
+			}
+			ft, err := parse(fm["type"], ns, names)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid type of field %s.%s", s.Name, name)
+			}
+			f := &Field{Name: name, Type: ft}
+			if dv, ok := fm["default"]; ok {
+				if f.Default, err = json.Marshal(dv); err != nil {
+					return nil, errors.Wrapf(err, "invalid default of field %s.%s", s.Name, name)
+				}
+			}
+			s.Fields = append(s.Fields, f)
+		}
+		return s, nil
+
+	case TypeEnum:
+		s, _, err := registerNamed(TypeEnum, v, namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		symbols, ok := v["symbols"].([]interface{})
+		if !ok || len(symbols) == 0 {
+			return nil, errors.Errorf("enum %s must have symbols", s.Name)
+		}
+		for _, sv := range symbols {
+			symbol, ok := sv.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid symbol of enum %s", s.Name)
+			}
+			s.Symbols = append(s.Symbols, symbol)
+		}
+		return s, nil
+
+	case TypeFixed:
+		s, _, err := registerNamed(TypeFixed, v, namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 || size != float64(int(size)) {
+			return nil, errors.Errorf("fixed %s must have a valid size", s.Name)
+		}
+		s.Size = int(size)
+		return s, nil
+
+	case TypeArray:
+		items, err := parse(v["items"], namespace, names)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid array items")
+		}
+		return &Schema{Type: TypeArray, Items: items}, nil
+
+	case TypeMap:
+		values, err := parse(v["values"], namespace, names)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid map values")
+		}
+		return &Schema{Type: TypeMap, Values: values}, nil
+
+	default:
+		// A primitive type, possibly annotated with a logical type, or a
+		// reference to a named type.
+		return parse(typeName, namespace, names)
+	}
+}
+
+// registerNamed creates a named schema and registers it under its full name,
+// so that it can be referenced including by itself. The namespace that
+// nested definitions inherit is returned along with the schema.
+func registerNamed(t Type, v map[string]interface{}, namespace string, names map[string]*Schema) (*Schema, string, error) {
+	name, _ := v["name"].(string)
+	if name == "" {
+		return nil, "", errors.Errorf("%s must have a name", t)
+	}
+	if ns, ok := v["namespace"].(string); ok {
+		namespace = ns
+	}
+	name = fullName(name, namespace)
+	if _, ok := names[name]; ok {
+		return nil, "", errors.Errorf("duplicate type %s", name)
+	}
+	s := &Schema{Type: t, Name: name}
+	names[name] = s
+	ns := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		ns = name[:i]
+	}
+	return s, ns, nil
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// shortName returns the name of a named type without its namespace.
+func shortName(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
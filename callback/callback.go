@@ -0,0 +1,185 @@
+// Package callback implements posting results of asynchronous produce
+// requests to HTTP endpoints specified by clients.
+package callback
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+)
+
+// Maximum number of bytes of an error response body to include in an error
+// message.
+const maxErrorBodySize = 1024
+
+// ErrNotAllowed is returned by Notifier if the callback URL does not start
+// with any of the prefixes configured in `Webhook.ProduceCallbackURLs`.
+var ErrNotAllowed = errors.New("callback url is not allowed")
+
+// T posts produce results to callback URLs. Results are queued and posted by
+// a pool of workers, failed requests are retried up to
+// `Webhook.ProduceCallbackRetryMax` times.
+type T struct {
+	actorID  *actor.ID
+	cfg      *config.Proxy
+	httpClt  *http.Client
+	queueMu  sync.Mutex
+	queue    chan delivery
+	stopped  bool
+	stopCh   chan none.T
+	wg       sync.WaitGroup
+	cluster  string
+	prefixes []string
+}
+
+type delivery struct {
+	url string
+	rq  resultRq
+}
+
+// resultRq is a body of a callback request. Partition and offset are only
+// included if the message was written to Kafka, otherwise an error is.
+type resultRq struct {
+	ID        string `json:"id,omitempty"`
+	Topic     string `json:"topic"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Spawn creates a callback poster and starts its workers.
+func Spawn(namespace *actor.ID, cfg *config.Proxy) *T {
+	t := &T{
+		actorID:  namespace.NewChild("callback"),
+		cfg:      cfg,
+		httpClt:  &http.Client{Timeout: cfg.Webhook.Timeout},
+		queue:    make(chan delivery, cfg.Webhook.ProduceCallbackQueueSize),
+		stopCh:   make(chan none.T),
+		cluster:  cfg.Cluster,
+		prefixes: cfg.Webhook.ProduceCallbackURLs,
+	}
+	for i := 0; i < cfg.Webhook.ProduceCallbackConcurrency; i++ {
+		actor.Spawn(t.actorID.NewChild("w", i), &t.wg, t.run)
+	}
+	return t
+}
+
+// Stop waits for queued results to be posted, each with at most one
+// attempt, and terminates the workers. Results reported after that are
+// dropped.
+func (t *T) Stop() {
+	t.queueMu.Lock()
+	t.stopped = true
+	close(t.queue)
+	t.queueMu.Unlock()
+	close(t.stopCh)
+	t.wg.Wait()
+}
+
+// Notifier returns a function that queues a produce result to be posted to
+// `url`, along with the client provided `id`. The returned function never
+// blocks, if the queue is full the result is dropped. ErrNotAllowed is
+// returned if the URL is not allowed by config.
+func (t *T) Notifier(url, id string) (func(*sarama.ProducerMessage, error), error) {
+	if !t.allowed(url) {
+		return nil, ErrNotAllowed
+	}
+	return func(msg *sarama.ProducerMessage, err error) {
+		rq := resultRq{ID: id, Topic: msg.Topic}
+		if err != nil {
+			rq.Error = err.Error()
+		} else {
+			partition, offset := msg.Partition, msg.Offset
+			rq.Partition, rq.Offset = &partition, &offset
+		}
+		t.enqueue(delivery{url: url, rq: rq})
+	}, nil
+}
+
+func (t *T) allowed(url string) bool {
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *T) enqueue(d delivery) {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	if !t.stopped {
+		select {
+		case t.queue <- d:
+			return
+		default:
+		}
+	}
+	metrics.Counter("produce_callback_dropped", "cluster", t.cluster, "topic", d.rq.Topic).Inc(1)
+	log.Errorf("<%s> produce callback dropped: url=%s, id=%s", t.actorID, d.url, d.rq.ID)
+}
+
+func (t *T) run() {
+	for d := range t.queue {
+		for attempt := 0; ; attempt++ {
+			err := t.post(d)
+			if err == nil {
+				metrics.Counter("produce_callback_delivered", "cluster", t.cluster, "topic", d.rq.Topic).Inc(1)
+				break
+			}
+			if attempt >= t.cfg.Webhook.ProduceCallbackRetryMax || !t.backoff() {
+				metrics.Counter("produce_callback_failed", "cluster", t.cluster, "topic", d.rq.Topic).Inc(1)
+				log.Errorf("<%s> produce callback failed: url=%s, id=%s, err=(%s)", t.actorID, d.url, d.rq.ID, err)
+				break
+			}
+		}
+	}
+}
+
+// post makes a callback request.
+func (t *T) post(d delivery) error {
+	body, err := json.Marshal(d.rq)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+	httpRq, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	httpRq.Header.Set("Content-Type", "application/json")
+	rs, err := t.httpClt.Do(httpRq)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer rs.Body.Close()
+	if rs.StatusCode < 200 || rs.StatusCode > 299 {
+		rsBody, _ := ioutil.ReadAll(io.LimitReader(rs.Body, maxErrorBodySize))
+		return errors.Errorf("bad response: status=%d, body=%s", rs.StatusCode, rsBody)
+	}
+	io.Copy(ioutil.Discard, rs.Body)
+	return nil
+}
+
+// backoff waits for `Webhook.RetryBackoff`. It returns false if the poster
+// was stopped in the meantime.
+func (t *T) backoff() bool {
+	select {
+	case <-time.After(t.cfg.Webhook.RetryBackoff):
+		return true
+	case <-t.stopCh:
+		return false
+	}
+}
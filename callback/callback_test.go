@@ -0,0 +1,131 @@
+package callback
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type CallbackSuite struct {
+	cfg      *config.Proxy
+	srv      *httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	failures int
+}
+
+var _ = Suite(&CallbackSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *CallbackSuite) SetUpTest(c *C) {
+	s.bodies = nil
+	s.failures = 0
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, string(body))
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	s.cfg = config.DefaultProxy()
+	s.cfg.Webhook.RetryBackoff = 10 * time.Millisecond
+	s.cfg.Webhook.ProduceCallbackURLs = []string{s.srv.URL + "/produced"}
+	s.cfg.Webhook.ProduceCallbackConcurrency = 1
+}
+
+func (s *CallbackSuite) TearDownTest(c *C) {
+	s.srv.Close()
+}
+
+// Results are posted to the callback URL along with the client provided id.
+func (s *CallbackSuite) TestNotify(c *C) {
+	cb := Spawn(actor.RootID, s.cfg)
+	notify, err := cb.Notifier(s.srv.URL+"/produced?src=foo", "req-1")
+	c.Assert(err, IsNil)
+
+	// When
+	notify(&sarama.ProducerMessage{Topic: "t", Partition: 2, Offset: 1003}, nil)
+	notify(&sarama.ProducerMessage{Topic: "t"}, errors.New("kaboom"))
+	cb.Stop()
+
+	// Then
+	c.Assert(s.bodies, DeepEquals, []string{
+		`{"id":"req-1","topic":"t","partition":2,"offset":1003}`,
+		`{"id":"req-1","topic":"t","error":"kaboom"}`,
+	})
+}
+
+// Failed requests are retried up to the configured number of times.
+func (s *CallbackSuite) TestRetry(c *C) {
+	s.cfg.Webhook.ProduceCallbackRetryMax = 2
+	for i, tc := range []struct {
+		failures int
+		attempts int
+	}{
+		{failures: 2, attempts: 3},
+		{failures: 5, attempts: 3},
+	} {
+		s.bodies = nil
+		s.failures = tc.failures
+		cb := Spawn(actor.RootID, s.cfg)
+		notify, err := cb.Notifier(s.srv.URL+"/produced", "")
+		c.Assert(err, IsNil)
+
+		// When
+		notify(&sarama.ProducerMessage{Topic: "t", Partition: 0, Offset: 0}, nil)
+		time.Sleep(100 * time.Millisecond)
+		cb.Stop()
+
+		// Then
+		c.Assert(s.bodies, HasLen, tc.attempts, Commentf("case #%d", i))
+	}
+}
+
+// Only URLs that start with one of configured prefixes are allowed.
+func (s *CallbackSuite) TestNotAllowed(c *C) {
+	cb := Spawn(actor.RootID, s.cfg)
+	defer cb.Stop()
+
+	for i, url := range []string{
+		s.srv.URL + "/other",
+		"http://169.254.169.254/produced",
+		"",
+	} {
+		// When
+		_, err := cb.Notifier(url, "")
+
+		// Then
+		c.Assert(err, Equals, ErrNotAllowed, Commentf("case #%d", i))
+	}
+}
+
+// Results reported after the poster is stopped are dropped.
+func (s *CallbackSuite) TestNotifyAfterStop(c *C) {
+	cb := Spawn(actor.RootID, s.cfg)
+	notify, err := cb.Notifier(s.srv.URL+"/produced", "")
+	c.Assert(err, IsNil)
+	cb.Stop()
+
+	// When
+	notify(&sarama.ProducerMessage{Topic: "t"}, nil)
+
+	// Then
+	c.Assert(s.bodies, IsNil)
+}
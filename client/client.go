@@ -0,0 +1,500 @@
+// Package client implements a Go client of the Kafka-Pixy HTTP API.
+//
+//	clt, err := client.New("http://localhost:19092", client.Options{})
+//	...
+//	err = clt.ConsumeLoop(ctx, "my-group", "my-topic", func(msg client.Message) error {
+//		return handle(msg)
+//	})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryBackoff = 500 * time.Millisecond
+	unixSocketHost      = "kafka-pixy"
+)
+
+var (
+	// ErrRequestTimeout is returned by consume requests if no message became
+	// available within the long polling timeout.
+	ErrRequestTimeout = errors.New("long polling timeout")
+
+	// ErrBufferOverflow is returned if Kafka-Pixy rejected a request either
+	// with `429 Too Many Requests`, because a rate limit is exceeded, or with
+	// `503 Service Unavailable`, because too many consume requests are
+	// queued. The request should be retried after a back off.
+	ErrBufferOverflow = errors.New("too many requests")
+)
+
+// APIError is returned when Kafka-Pixy responds with an error status other
+// than those that ErrRequestTimeout and ErrBufferOverflow correspond to.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kafka-pixy error: status=%d, message=%s", e.StatusCode, e.Message)
+}
+
+// Options defines optional parameters of a client.
+type Options struct {
+	// HTTP client to make requests with. If nil, then a client without a
+	// timeout is used, for consume requests can take as long as the long
+	// polling timeout configured in Kafka-Pixy.
+	HTTPClient *http.Client
+
+	// If not empty, then it is sent in the `Authorization: Bearer` header
+	// of all requests.
+	Token string
+
+	// Name of a cluster to make requests to. If empty, then requests are
+	// made to the default cluster of Kafka-Pixy.
+	Cluster string
+
+	// The number of times a request is retried if it fails with a network
+	// error, a server error, or ErrBufferOverflow. Zero means no retries.
+	// Note that retried produce requests can result in duplicate messages.
+	MaxRetries int
+
+	// How long to wait before retrying a request, unless the server asks to
+	// wait longer with a `Retry-After` header. Defaults to 500ms.
+	RetryBackoff time.Duration
+}
+
+// T is a Kafka-Pixy HTTP API client. It is safe for concurrent use.
+type T struct {
+	baseURL *url.URL
+	opts    Options
+}
+
+// Message is a message consumed from Kafka.
+type Message struct {
+	Key, Value []byte
+	Topic      string
+	Partition  int32
+	Offset     int64
+	Timestamp  time.Time // only set if Kafka is version 0.10+
+	// The number of times the message has been offered to the consumer
+	// group, including this one. It is greater than 1 if the message was
+	// not acknowledged in time, or was rejected, on previous attempts.
+	DeliveryAttempt int
+	// High water mark of the partition and the number of messages after
+	// this one, as of when the message was fetched. A client can use the lag
+	// to decide whether to keep polling or to back off.
+	HighWaterMark int64
+	Lag           int64
+}
+
+// PartitionOffset defines the offset committed by a consumer group for a
+// partition, along with the partition offset range.
+type PartitionOffset struct {
+	Partition int32  `json:"partition"`
+	Begin     int64  `json:"begin"`
+	End       int64  `json:"end"`
+	Count     int64  `json:"count"`
+	Offset    int64  `json:"offset"`
+	Lag       int64  `json:"lag"`
+	Metadata  string `json:"metadata,omitempty"`
+}
+
+// GroupLag defines how far behind a consumer group is on the topics it
+// consumes, in number of messages.
+type GroupLag struct {
+	Lag    int64               `json:"lag"`
+	Topics map[string]TopicLag `json:"topics"`
+}
+
+// TopicLag defines the lag of a consumer group on a topic.
+type TopicLag struct {
+	Lag        int64          `json:"lag"`
+	Partitions []PartitionLag `json:"partitions"`
+}
+
+// PartitionLag defines the lag of a consumer group on a partition.
+type PartitionLag struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+	End       int64 `json:"end"`
+	Lag       int64 `json:"lag"`
+}
+
+// Seek defines where SeekOffsets should move offsets of a consumer group to.
+// Exactly one of Position, Timestamp and Offsets must be given.
+type Seek struct {
+	// Either `earliest` or `latest`.
+	Position string
+
+	// Offsets are moved to the first messages produced at or after it.
+	Timestamp time.Time
+
+	// Offsets to move to, only `Partition` and `Offset` are used.
+	Offsets []PartitionOffset
+
+	// If true, then offsets are moved even if the group has active members.
+	Force bool
+}
+
+type seekRq struct {
+	Offsets   []seekOffsetView `json:"offsets,omitempty"`
+	Timestamp *int64           `json:"timestamp,omitempty"`
+	Position  string           `json:"position,omitempty"`
+	Force     bool             `json:"force,omitempty"`
+}
+
+type seekOffsetView struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+// New creates a client of a Kafka-Pixy listening at `addr`, that is either a
+// base URL, e.g. `http://localhost:19092`, or a Unix domain socket path, e.g.
+// `/var/run/kafka-pixy.sock`.
+func New(addr string, opts Options) (*T, error) {
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	if strings.HasPrefix(addr, "/") {
+		sockPath := addr
+		if opts.HTTPClient == nil {
+			opts.HTTPClient = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sockPath)
+				},
+			}}
+		}
+		addr = "http://" + unixSocketHost
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{}
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(addr, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad address, %s", addr)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, errors.Errorf("bad address, %s", addr)
+	}
+	return &T{baseURL: baseURL, opts: opts}, nil
+}
+
+// Produce writes a message to a topic and waits until Kafka confirms the
+// write. If `key` is nil, then the message is written to a random partition.
+// It returns the partition and the offset that the message was written to.
+func (c *T) Produce(ctx context.Context, topic string, key, message []byte) (int32, int64, error) {
+	var rs struct {
+		Partition int32 `json:"partition"`
+		Offset    int64 `json:"offset"`
+	}
+	query := produceQuery(key)
+	query.Set("sync", "true")
+	if err := c.call(ctx, http.MethodPost, c.topicPath(topic, "messages"), query, message, &rs); err != nil {
+		return 0, 0, err
+	}
+	return rs.Partition, rs.Offset, nil
+}
+
+// AsyncProduce is like Produce, but Kafka-Pixy responds as soon as it gets
+// the message, without waiting for Kafka to confirm the write.
+func (c *T) AsyncProduce(ctx context.Context, topic string, key, message []byte) error {
+	return c.call(ctx, http.MethodPost, c.topicPath(topic, "messages"), produceQuery(key), message, nil)
+}
+
+// Consume consumes a message from a topic on behalf of a consumer group. If
+// there are no new messages, then Kafka-Pixy waits for `timeout`, or for the
+// configured long polling timeout if `timeout` is zero, and ErrRequestTimeout
+// is returned if none is produced in the meantime.
+//
+// The message must be acknowledged with Ack, or rejected with Nack,
+// otherwise it is consumed again after the configured ack timeout.
+func (c *T) Consume(ctx context.Context, group, topic string, timeout time.Duration) (Message, error) {
+	var rs struct {
+		Key       []byte `json:"key"`
+		Value     []byte `json:"value"`
+		Partition int32  `json:"partition"`
+		Offset    int64  `json:"offset"`
+		Timestamp int64  `json:"timestamp"`
+
+		DeliveryAttempt int   `json:"delivery_attempt"`
+		HighWaterMark   int64 `json:"high_watermark"`
+		Lag             int64 `json:"lag"`
+	}
+	query := url.Values{"group": {group}, "noAck": {""}}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	if err := c.call(ctx, http.MethodGet, c.topicPath(topic, "messages"), query, nil, &rs); err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		Key:       rs.Key,
+		Value:     rs.Value,
+		Topic:     topic,
+		Partition: rs.Partition,
+		Offset:    rs.Offset,
+
+		DeliveryAttempt: rs.DeliveryAttempt,
+		HighWaterMark:   rs.HighWaterMark,
+		Lag:             rs.Lag,
+	}
+	if rs.Timestamp != 0 {
+		msg.Timestamp = time.Unix(0, rs.Timestamp*int64(time.Millisecond)).UTC()
+	}
+	return msg, nil
+}
+
+// Ack acknowledges a message consumed by a consumer group from a topic, so
+// that it is never consumed by the group again.
+func (c *T) Ack(ctx context.Context, group, topic string, partition int32, offset int64) error {
+	query := ackQuery(group, partition, offset)
+	return c.call(ctx, http.MethodPost, c.topicPath(topic, "acks"), query, nil, nil)
+}
+
+// Nack rejects a message consumed by a consumer group from a topic, so that
+// it is offered again, or dead lettered if it has been offered too many
+// times already.
+func (c *T) Nack(ctx context.Context, group, topic string, partition int32, offset int64, reason string) error {
+	query := ackQuery(group, partition, offset)
+	query.Set("reason", reason)
+	return c.call(ctx, http.MethodPost, c.topicPath(topic, "nacks"), query, nil, nil)
+}
+
+// ConsumeLoop consumes messages from a topic on behalf of a consumer group
+// and calls `handler` for each of them, until `ctx` is done. Messages that
+// the handler returns nil for are acknowledged, the others are rejected with
+// the error text as the reason. Long polling timeouts are retried right
+// away, and ErrBufferOverflow after a back off. Any other error stops the
+// loop and is returned.
+func (c *T) ConsumeLoop(ctx context.Context, group, topic string, handler func(Message) error) error {
+	for {
+		msg, err := c.Consume(ctx, group, topic, 0)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err == ErrRequestTimeout:
+			continue
+		case err == ErrBufferOverflow:
+			if !sleep(ctx, c.opts.RetryBackoff) {
+				return nil
+			}
+			continue
+		case err != nil:
+			return err
+		}
+		if handlerErr := handler(msg); handlerErr != nil {
+			err = c.Nack(ctx, group, topic, msg.Partition, msg.Offset, handlerErr.Error())
+		} else {
+			err = c.Ack(ctx, group, topic, msg.Partition, msg.Offset)
+		}
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+// GetOffsets returns offsets committed by a consumer group for all partitions
+// of a topic.
+func (c *T) GetOffsets(ctx context.Context, group, topic string) ([]PartitionOffset, error) {
+	var rs []PartitionOffset
+	query := url.Values{"group": {group}}
+	if err := c.call(ctx, http.MethodGet, c.topicPath(topic, "offsets"), query, nil, &rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// SetOffsets commits offsets of a consumer group for partitions of a topic.
+// Only `Partition`, `Offset` and `Metadata` of the given offsets are used.
+func (c *T) SetOffsets(ctx context.Context, group, topic string, offsets []PartitionOffset) error {
+	body, err := json.Marshal(offsets)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal offsets")
+	}
+	query := url.Values{"group": {group}}
+	return c.call(ctx, http.MethodPost, c.topicPath(topic, "offsets"), query, body, nil)
+}
+
+// GetGroupLag returns the lag of a consumer group on all topics it has
+// committed offsets for.
+func (c *T) GetGroupLag(ctx context.Context, group string) (GroupLag, error) {
+	var rs GroupLag
+	if err := c.call(ctx, http.MethodGet, c.clusterPath("/groups/"+url.PathEscape(group)+"/lag"), nil, nil, &rs); err != nil {
+		return GroupLag{}, err
+	}
+	return rs, nil
+}
+
+// SeekOffsets moves offsets of a consumer group for all partitions of a topic
+// as defined by `seek`. It returns the offsets that were committed, only
+// `Partition` and `Offset` of which are set.
+func (c *T) SeekOffsets(ctx context.Context, group, topic string, seek Seek) ([]PartitionOffset, error) {
+	rq := seekRq{Position: seek.Position, Force: seek.Force}
+	if !seek.Timestamp.IsZero() {
+		ts := seek.Timestamp.UnixNano() / int64(time.Millisecond)
+		rq.Timestamp = &ts
+	}
+	for _, po := range seek.Offsets {
+		rq.Offsets = append(rq.Offsets, seekOffsetView{Partition: po.Partition, Offset: po.Offset})
+	}
+	body, err := json.Marshal(rq)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal seek request")
+	}
+	path := c.clusterPath("/groups/" + url.PathEscape(group) + "/topics/" + url.PathEscape(topic) + "/offsets")
+	var rs []PartitionOffset
+	if err := c.call(ctx, http.MethodPost, path, nil, body, &rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (c *T) topicPath(topic, resource string) string {
+	return c.clusterPath("/topics/" + url.PathEscape(topic) + "/" + resource)
+}
+
+func (c *T) clusterPath(path string) string {
+	if c.opts.Cluster != "" {
+		path = "/clusters/" + url.PathEscape(c.opts.Cluster) + path
+	}
+	return path
+}
+
+// call makes an API request and decodes a JSON response into `rs`, unless it
+// is nil. Failed requests are retried as configured.
+func (c *T) call(ctx context.Context, method, path string, query url.Values, body []byte, rs interface{}) error {
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.callOnce(ctx, method, path, query, body, rs)
+		if err == nil || attempt >= c.opts.MaxRetries || !isRetriable(ctx, err) {
+			return err
+		}
+		backoff := c.opts.RetryBackoff
+		if retryAfter > backoff {
+			backoff = retryAfter
+		}
+		if !sleep(ctx, backoff) {
+			return err
+		}
+	}
+}
+
+// callOnce makes an API request. Along with an error it returns how long the
+// server asked to wait before retrying, if it did.
+func (c *T) callOnce(ctx context.Context, method, path string, query url.Values, body []byte, rs interface{}) (time.Duration, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	res, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "request failed")
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read response")
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		if rs == nil {
+			return 0, nil
+		}
+		if err := json.Unmarshal(resBody, rs); err != nil {
+			return 0, errors.Wrap(err, "failed to parse response")
+		}
+		return 0, nil
+	case http.StatusRequestTimeout:
+		return 0, ErrRequestTimeout
+	case http.StatusTooManyRequests:
+		return parseRetryAfter(res.Header.Get("Retry-After")), ErrBufferOverflow
+	}
+	var errorRs struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(resBody, &errorRs); err != nil || errorRs.Error == "" {
+		errorRs.Error = strings.TrimSpace(string(resBody))
+	}
+	// Consume requests rejected because Kafka-Pixy cannot keep up come with
+	// a reason.
+	if res.StatusCode == http.StatusServiceUnavailable && errorRs.Reason != "" {
+		return parseRetryAfter(res.Header.Get("Retry-After")), ErrBufferOverflow
+	}
+	return parseRetryAfter(res.Header.Get("Retry-After")), &APIError{StatusCode: res.StatusCode, Message: errorRs.Error}
+}
+
+// isRetriable tells whether a failed request can be retried.
+func isRetriable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err == ErrBufferOverflow {
+		return true
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	// Errors returned by `http.Client.Do` are retried, but failures to read or
+	// parse responses are not.
+	_, isTransportErr := errors.Cause(err).(*url.Error)
+	return isTransportErr
+}
+
+func produceQuery(key []byte) url.Values {
+	query := url.Values{}
+	if key != nil {
+		query.Set("key", string(key))
+	}
+	return query
+}
+
+func ackQuery(group string, partition int32, offset int64) url.Values {
+	return url.Values{
+		"group":     {group},
+		"partition": {strconv.FormatInt(int64(partition), 10)},
+		"offset":    {strconv.FormatInt(offset, 10)},
+	}
+}
+
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sleep waits for `d`, and returns false if `ctx` is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
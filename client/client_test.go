@@ -0,0 +1,344 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ClientSuite struct {
+	srv       *httptest.Server
+	mu        sync.Mutex
+	requests  []*http.Request
+	bodies    []string
+	responses []mockResponse
+}
+
+type mockResponse struct {
+	status     int
+	body       string
+	retryAfter string
+
+	// If true, then the response is not sent until the request is canceled.
+	hang bool
+}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	s.requests = nil
+	s.bodies = nil
+	s.responses = nil
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.ParseForm()
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		rs := mockResponse{status: http.StatusOK, body: "{}"}
+		if len(s.responses) > 0 {
+			rs = s.responses[0]
+			s.responses = s.responses[1:]
+		}
+		s.mu.Unlock()
+		if rs.hang {
+			<-r.Context().Done()
+			return
+		}
+		if rs.retryAfter != "" {
+			w.Header().Set("Retry-After", rs.retryAfter)
+		}
+		w.WriteHeader(rs.status)
+		w.Write([]byte(rs.body))
+	}))
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	s.srv.Close()
+}
+
+func (s *ClientSuite) respond(responses ...mockResponse) {
+	s.mu.Lock()
+	s.responses = append(s.responses, responses...)
+	s.mu.Unlock()
+}
+
+func (s *ClientSuite) newClient(c *C, opts Options) *T {
+	opts.RetryBackoff = 10 * time.Millisecond
+	clt, err := New(s.srv.URL, opts)
+	c.Assert(err, IsNil)
+	return clt
+}
+
+func (s *ClientSuite) TestProduce(c *C) {
+	clt := s.newClient(c, Options{Token: "secret"})
+	s.respond(mockResponse{status: http.StatusOK, body: `{"partition": 2, "offset": 1003}`})
+
+	// When
+	partition, offset, err := clt.Produce(context.Background(), "foo", []byte("bar"), []byte("bazz"))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(2))
+	c.Assert(offset, Equals, int64(1003))
+	c.Assert(s.requests, HasLen, 1)
+	c.Assert(s.requests[0].Method, Equals, "POST")
+	c.Assert(s.requests[0].URL.Path, Equals, "/topics/foo/messages")
+	c.Assert(s.requests[0].Form.Get("key"), Equals, "bar")
+	c.Assert(s.requests[0].Form["sync"], NotNil)
+	c.Assert(s.requests[0].Header.Get("Authorization"), Equals, "Bearer secret")
+	c.Assert(s.bodies[0], Equals, "bazz")
+}
+
+// If a cluster is specified, then it is included in request paths.
+func (s *ClientSuite) TestCluster(c *C) {
+	clt := s.newClient(c, Options{Cluster: "qux"})
+
+	// When
+	err := clt.AsyncProduce(context.Background(), "foo", nil, []byte("bazz"))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(s.requests[0].URL.Path, Equals, "/clusters/qux/topics/foo/messages")
+	c.Assert(s.requests[0].Form["key"], IsNil)
+	c.Assert(s.requests[0].Form["sync"], IsNil)
+}
+
+func (s *ClientSuite) TestConsume(c *C) {
+	clt := s.newClient(c, Options{})
+	s.respond(mockResponse{status: http.StatusOK,
+		body: `{"key": "YmFy", "value": "YmF6eg==", "partition": 1, "offset": 7, "timestamp": 1500000000000, "delivery_attempt": 2, "high_watermark": 10, "lag": 2}`})
+
+	// When
+	msg, err := clt.Consume(context.Background(), "g1", "foo", 5*time.Second)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(msg, DeepEquals, Message{
+		Key:       []byte("bar"),
+		Value:     []byte("bazz"),
+		Topic:     "foo",
+		Partition: 1,
+		Offset:    7,
+		Timestamp: time.Unix(1500000000, 0).UTC(),
+
+		DeliveryAttempt: 2,
+		HighWaterMark:   10,
+		Lag:             2,
+	})
+	c.Assert(s.requests[0].Method, Equals, "GET")
+	c.Assert(s.requests[0].URL.Path, Equals, "/topics/foo/messages")
+	c.Assert(s.requests[0].Form.Get("group"), Equals, "g1")
+	c.Assert(s.requests[0].Form["noAck"], NotNil)
+	c.Assert(s.requests[0].Form.Get("timeout"), Equals, "5s")
+}
+
+// Error statuses are converted to typed errors.
+func (s *ClientSuite) TestErrors(c *C) {
+	clt := s.newClient(c, Options{})
+	for i, tc := range []struct {
+		rs  mockResponse
+		err error
+	}{{
+		rs:  mockResponse{status: http.StatusRequestTimeout, body: `{"error": "long polling timeout"}`},
+		err: ErrRequestTimeout,
+	}, {
+		rs:  mockResponse{status: http.StatusTooManyRequests, body: `{"error": "Too many requests"}`},
+		err: ErrBufferOverflow,
+	}, {
+		rs:  mockResponse{status: http.StatusServiceUnavailable, body: `{"error": "Too many requests", "reason": "buffer_overflow", "retry_after_ms": 250}`},
+		err: ErrBufferOverflow,
+	}, {
+		rs:  mockResponse{status: http.StatusServiceUnavailable, body: `{"error": "Service unavailable"}`},
+		err: &APIError{StatusCode: 503, Message: "Service unavailable"},
+	}, {
+		rs:  mockResponse{status: http.StatusBadRequest, body: `{"error": "one consumer group is expected, but 0 provided"}`},
+		err: &APIError{StatusCode: 400, Message: "one consumer group is expected, but 0 provided"},
+	}, {
+		rs:  mockResponse{status: http.StatusBadGateway, body: "bad gateway\n"},
+		err: &APIError{StatusCode: 502, Message: "bad gateway"},
+	}} {
+		s.respond(tc.rs)
+
+		// When
+		_, err := clt.Consume(context.Background(), "g1", "foo", 0)
+
+		// Then
+		c.Assert(err, DeepEquals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+// Server errors and overflows are retried, respecting `Retry-After`.
+func (s *ClientSuite) TestRetries(c *C) {
+	clt := s.newClient(c, Options{MaxRetries: 2})
+	s.respond(
+		mockResponse{status: http.StatusServiceUnavailable, body: `{"error": "Overloaded"}`},
+		mockResponse{status: http.StatusTooManyRequests, body: `{"error": "rate limit exceeded"}`, retryAfter: "1"},
+		mockResponse{status: http.StatusOK, body: `{}`})
+	begin := time.Now()
+
+	// When
+	err := clt.Ack(context.Background(), "g1", "foo", 1, 7)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(begin) >= time.Second, Equals, true)
+	c.Assert(s.requests, HasLen, 3)
+	for i, r := range s.requests {
+		c.Assert(r.URL.Path, Equals, "/topics/foo/acks", Commentf("#%d", i))
+		c.Assert(r.Form.Get("group"), Equals, "g1", Commentf("#%d", i))
+		c.Assert(r.Form.Get("partition"), Equals, "1", Commentf("#%d", i))
+		c.Assert(r.Form.Get("offset"), Equals, "7", Commentf("#%d", i))
+	}
+}
+
+// Client errors and long polling timeouts are not retried.
+func (s *ClientSuite) TestRetriesNotRetriable(c *C) {
+	clt := s.newClient(c, Options{MaxRetries: 2})
+	s.respond(mockResponse{status: http.StatusRequestTimeout, body: `{}`})
+	s.respond(mockResponse{status: http.StatusNotFound, body: `{"error": "Unknown topic"}`})
+
+	_, err := clt.Consume(context.Background(), "g1", "foo", 0)
+	c.Assert(err, Equals, ErrRequestTimeout)
+	_, err = clt.GetOffsets(context.Background(), "g1", "foo")
+	c.Assert(err, DeepEquals, &APIError{StatusCode: 404, Message: "Unknown topic"})
+	c.Assert(s.requests, HasLen, 2)
+}
+
+// Messages that are handled successfully are acked, others are nacked, and
+// long polling timeouts are ignored.
+func (s *ClientSuite) TestConsumeLoop(c *C) {
+	clt := s.newClient(c, Options{})
+	s.respond(
+		mockResponse{status: http.StatusOK, body: `{"value": "MQ==", "partition": 0, "offset": 1}`},
+		mockResponse{status: http.StatusOK, body: `{}`},
+		mockResponse{status: http.StatusRequestTimeout, body: `{}`},
+		mockResponse{status: http.StatusOK, body: `{"value": "Mg==", "partition": 0, "offset": 2}`},
+		mockResponse{status: http.StatusOK, body: `{}`},
+		mockResponse{status: http.StatusForbidden, body: `{"error": "access denied"}`})
+
+	// When
+	var handled []string
+	err := clt.ConsumeLoop(context.Background(), "g1", "foo", func(msg Message) error {
+		handled = append(handled, string(msg.Value))
+		if string(msg.Value) == "2" {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+
+	// Then
+	c.Assert(err, DeepEquals, &APIError{StatusCode: 403, Message: "access denied"})
+	c.Assert(handled, DeepEquals, []string{"1", "2"})
+	var paths []string
+	for _, r := range s.requests {
+		paths = append(paths, r.URL.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{
+		"/topics/foo/messages",
+		"/topics/foo/acks",
+		"/topics/foo/messages",
+		"/topics/foo/messages",
+		"/topics/foo/nacks",
+		"/topics/foo/messages",
+	})
+	c.Assert(s.requests[4].Form.Get("reason"), Equals, "kaboom")
+}
+
+// The loop stops without an error when the context is done.
+func (s *ClientSuite) TestConsumeLoopCanceled(c *C) {
+	clt := s.newClient(c, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.respond(mockResponse{status: http.StatusRequestTimeout, body: `{}`}, mockResponse{hang: true})
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	// When
+	err := clt.ConsumeLoop(ctx, "g1", "foo", func(msg Message) error { return nil })
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(s.requests, HasLen, 2)
+}
+
+func (s *ClientSuite) TestSetOffsets(c *C) {
+	clt := s.newClient(c, Options{})
+
+	// When
+	err := clt.SetOffsets(context.Background(), "g1", "foo", []PartitionOffset{
+		{Partition: 0, Offset: 10},
+		{Partition: 1, Offset: 20, Metadata: "bar"},
+	})
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(s.requests[0].Method, Equals, "POST")
+	c.Assert(s.requests[0].URL.Path, Equals, "/topics/foo/offsets")
+	c.Assert(s.requests[0].Form.Get("group"), Equals, "g1")
+	c.Assert(s.bodies[0], Equals, `[{"partition":0,"begin":0,"end":0,"count":0,"offset":10,"lag":0},`+
+		`{"partition":1,"begin":0,"end":0,"count":0,"offset":20,"lag":0,"metadata":"bar"}]`)
+}
+
+func (s *ClientSuite) TestNewInvalid(c *C) {
+	_, err := New("localhost:19092", Options{})
+	c.Assert(err, ErrorMatches, "bad address, localhost:19092")
+}
+
+func (s *ClientSuite) TestGetGroupLag(c *C) {
+	clt := s.newClient(c, Options{Cluster: "qux"})
+	s.respond(mockResponse{status: http.StatusOK, body: `{"lag": 5, "topics": {"foo": {"lag": 5, ` +
+		`"partitions": [{"partition": 0, "offset": 10, "end": 12, "lag": 2}, {"partition": 1, "offset": 7, "end": 10, "lag": 3}]}}}`})
+
+	// When
+	groupLag, err := clt.GetGroupLag(context.Background(), "g1")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(groupLag, DeepEquals, GroupLag{Lag: 5, Topics: map[string]TopicLag{
+		"foo": {Lag: 5, Partitions: []PartitionLag{
+			{Partition: 0, Offset: 10, End: 12, Lag: 2},
+			{Partition: 1, Offset: 7, End: 10, Lag: 3},
+		}},
+	}})
+	c.Assert(s.requests[0].Method, Equals, "GET")
+	c.Assert(s.requests[0].URL.Path, Equals, "/clusters/qux/groups/g1/lag")
+}
+
+func (s *ClientSuite) TestSeekOffsets(c *C) {
+	clt := s.newClient(c, Options{})
+	for i, tc := range []struct {
+		seek Seek
+		body string
+	}{{
+		seek: Seek{Position: "earliest"},
+		body: `{"position":"earliest"}`,
+	}, {
+		seek: Seek{Timestamp: time.Unix(1500000000, 0), Force: true},
+		body: `{"timestamp":1500000000000,"force":true}`,
+	}, {
+		seek: Seek{Offsets: []PartitionOffset{{Partition: 1, Offset: 20}}},
+		body: `{"offsets":[{"partition":1,"offset":20}]}`,
+	}} {
+		s.respond(mockResponse{status: http.StatusOK, body: `[{"partition": 1, "offset": 20}]`})
+
+		// When
+		offsets, err := clt.SeekOffsets(context.Background(), "g1", "foo", tc.seek)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(offsets, DeepEquals, []PartitionOffset{{Partition: 1, Offset: 20}}, Commentf("case #%d", i))
+		c.Assert(s.requests[i].Method, Equals, "POST", Commentf("case #%d", i))
+		c.Assert(s.requests[i].URL.Path, Equals, "/groups/g1/topics/foo/offsets", Commentf("case #%d", i))
+		c.Assert(s.bodies[i], Equals, tc.body, Commentf("case #%d", i))
+	}
+}
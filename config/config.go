@@ -2,10 +2,16 @@ package config
 
 import (
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +21,8 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+var placeholderRx = regexp.MustCompile(`\{[^{}]*\}`)
+
 // App defines Kafka-Pixy application configuration. It mirrors the structure
 // of the JSON configuration file.
 type App struct {
@@ -24,13 +32,37 @@ type App struct {
 	// TCP address that HTTP API server should listen on.
 	TCPAddr string `yaml:"tcp_addr"`
 
+	// TLS parameters of the `TCPAddr` listener.
+	TLS ListenerTLS `yaml:"tls"`
+
 	// Unix domain socket address that HTTP API server should listen on.
 	// Listening on a unix domain socket is disabled by default.
 	UnixAddr string `yaml:"unix_addr"`
 
+	// Permissions of the `UnixAddr` socket file.
+	UnixSocket UnixSocket `yaml:"unix_socket"`
+
+	// TCP address that administrative HTTP API should listen on. If it is
+	// set, then listeners defined by `TCPAddr` and `UnixAddr` serve data API
+	// only. Administrative API is not separated by default.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// Additional HTTP API listeners. Each of them can be configured with its
+	// own TLS and authentication parameters.
+	Listeners []Listener `yaml:"listeners"`
+
+	// Parameters of the HTTP API servers listening on both TCP and Unix
+	// domain socket addresses.
+	HTTP HTTPServer `yaml:"http"`
+
+	// Parameters of periodic reporting of metrics to a StatsD server.
+	StatsD StatsD `yaml:"statsd"`
+
 	// An arbitrary number of proxies to different Kafka/ZooKeeper clusters can
 	// be configured. Each proxy configuration is identified by a cluster name.
-	Proxies map[string]*Proxy `yaml:"proxies"`
+	// It is populated from the `proxies` section by `FromYAML` explicitly to
+	// preserve default values of proxy parameters.
+	Proxies map[string]*Proxy `yaml:"-"`
 
 	// Default cluster is the one to be used in API calls that do not start with
 	// prefix `/clusters/<cluster>`. If it is not explicitly provided, then the
@@ -38,6 +70,469 @@ type App struct {
 	DefaultCluster string `yaml:"default_cluster"`
 }
 
+// Listener defines an HTTP API listener.
+type Listener struct {
+	// Either a TCP address (if it contains a colon), or a Unix domain socket
+	// path to listen on.
+	Addr string `yaml:"addr"`
+
+	// Defines which API endpoints are served by the listener.
+	API ListenerAPI `yaml:"api"`
+
+	TLS ListenerTLS `yaml:"tls"`
+
+	Auth ListenerAuth `yaml:"auth"`
+
+	// Permissions of the socket file, if the listener is on a Unix domain
+	// socket.
+	Socket UnixSocket `yaml:"socket"`
+}
+
+// UnixSocket defines permissions of a Unix domain socket file, that are set
+// every time the socket is created.
+type UnixSocket struct {
+	// File mode in octal notation, e.g. "0660". If not set, then everyone
+	// can connect to the socket, i.e. "0777".
+	Mode string `yaml:"mode"`
+
+	// Name or numeric ID of the user and the group to own the socket. The
+	// ownership is not changed if they are not set.
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+// FileMode returns the socket file mode. It must only be called on a
+// validated config.
+func (us *UnixSocket) FileMode() os.FileMode {
+	if us.Mode == "" {
+		return 0777
+	}
+	mode, _ := strconv.ParseUint(us.Mode, 8, 32)
+	return os.FileMode(mode)
+}
+
+func (us *UnixSocket) validate() error {
+	if us.Mode == "" {
+		return nil
+	}
+	if mode, err := strconv.ParseUint(us.Mode, 8, 32); err != nil || mode > 0777 {
+		return errors.Errorf("bad socket mode, %s", us.Mode)
+	}
+	return nil
+}
+
+// ListenerAuth defines how requests to an HTTP API listener are
+// authenticated. If any of tokens, keys or JWT validation is configured, then
+// requests must provide a valid token in an `Authorization: Bearer <token>`
+// header.
+type ListenerAuth struct {
+
+	// Tokens that grant access to all topics and consumer groups.
+	Tokens []string `yaml:"tokens"`
+
+	// API keys that grant access to particular topics and consumer groups.
+	Keys []APIKey `yaml:"keys"`
+
+	// Local users whose processes are granted access to particular topics
+	// and consumer groups without a token, if the listener is on a Unix
+	// domain socket. Users are identified by peer credentials of socket
+	// connections, that is only supported on Linux. A request with a token
+	// is authenticated by the token.
+	Peers []UnixPeer `yaml:"peers"`
+
+	// JSON Web Token validation parameters. Topics and consumer groups that
+	// a token grants access to are given by its `topics` and `groups` claims,
+	// or by its `tenant` claim that names a tenant defined in `http.tenants`.
+	JWT struct {
+
+		// Secret that tokens signed with HS256 are verified with.
+		HS256Secret string `yaml:"hs256_secret"`
+
+		// Path to a PEM encoded RSA public key that tokens signed with RS256
+		// are verified with.
+		RS256PublicKeyFile string `yaml:"rs256_public_key_file"`
+
+		// If not empty, then the `iss` claim of tokens must be equal to it.
+		Issuer string `yaml:"issuer"`
+
+		// If not empty, then the `aud` claim of tokens must contain it.
+		Audience string `yaml:"audience"`
+	} `yaml:"jwt"`
+
+	// Access control rules. If any are configured, then an authenticated
+	// request is allowed only if a rule grants its client the requested
+	// operation on all topics and consumer groups named in the request.
+	ACL []ACLRule `yaml:"acl"`
+
+	// Path to a file that authorization decisions are appended to, one JSON
+	// object per line. Decisions are not recorded if it is not set.
+	AuditLog string `yaml:"audit_log"`
+}
+
+// ACLRule grants clients operations on topics and consumer groups. Clients,
+// topics and groups are given by glob patterns. A client is identified by
+// the name of its API key, by `token#<n>` or `key#<n>` where `n` is the index
+// of its static token or unnamed API key, or by `jwt:<subject>`. An empty
+// list of topics or groups matches all of them, and only a rule that matches
+// all topics and groups grants access to requests that name neither, e.g.
+// `GET /topics`.
+type ACLRule struct {
+	Principals []string       `yaml:"principals"`
+	Operations []ACLOperation `yaml:"operations"`
+	Topics     []string       `yaml:"topics"`
+	Groups     []string       `yaml:"groups"`
+}
+
+// ACLOperation defines a class of API requests that access can be granted
+// to.
+type ACLOperation string
+
+const (
+	// Produce requests.
+	ACLProduce ACLOperation = "produce"
+
+	// Consume, ack and nack requests, and streams of messages.
+	ACLConsume ACLOperation = "consume"
+
+	// All other requests, e.g. offsets, topics and groups management.
+	ACLAdmin ACLOperation = "admin"
+)
+
+func (op *ACLOperation) UnmarshalText(text []byte) error {
+	v := ACLOperation(text)
+	switch v {
+	case ACLProduce, ACLConsume, ACLAdmin:
+	default:
+		return errors.Errorf("bad acl operation, %s", v)
+	}
+	*op = v
+	return nil
+}
+
+// APIKey defines an API key and topics and consumer groups it grants access
+// to. Topics and groups are given by glob patterns, e.g. `orders.*`. An empty
+// list grants access to all topics or groups respectively.
+type APIKey struct {
+	Key string `yaml:"key"`
+
+	// Name that identifies the key in ACL rules, the audit log and rate
+	// limiting. If not set, then the key is identified as `key#<n>`, where
+	// `n` is its index.
+	Name string `yaml:"name"`
+
+	Topics []string `yaml:"topics"`
+	Groups []string `yaml:"groups"`
+
+	// Overrides `http.rate_limit.per_client` for the key if not zero.
+	RateLimit RateLimit `yaml:"rate_limit"`
+
+	// Name of a tenant defined in `http.tenants` that the key is assigned
+	// to. The key then grants access to topics and groups of the tenant, and
+	// cannot have topics and groups of its own.
+	Tenant string `yaml:"tenant"`
+}
+
+// UnixPeer grants a local user access to particular topics and consumer
+// groups. The user is identified as `unix:<user>` in ACL rules and the audit
+// log.
+type UnixPeer struct {
+	// Name or numeric ID of the user.
+	User string `yaml:"user"`
+
+	Topics []string `yaml:"topics"`
+	Groups []string `yaml:"groups"`
+
+	// Name of a tenant defined in `http.tenants` that the user is assigned
+	// to, the same way as it is done for API keys.
+	Tenant string `yaml:"tenant"`
+}
+
+// Enabled tells whether requests have to be authenticated.
+func (la *ListenerAuth) Enabled() bool {
+	return len(la.Tokens) > 0 || len(la.Keys) > 0 || len(la.Peers) > 0 ||
+		la.JWT.HS256Secret != "" || la.JWT.RS256PublicKeyFile != ""
+}
+
+// ListenerTLS defines TLS parameters of an HTTP API listener.
+type ListenerTLS struct {
+
+	// Paths to PEM encoded certificate and private key files. If both are
+	// set then the listener accepts only TLS connections.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Path to a PEM encoded CA certificate bundle. If set then clients are
+	// required to present a certificate signed by one of the CAs.
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// ListenerAPI defines a set of API endpoints served by a listener. Health
+// check and metrics endpoints are served by all listeners.
+type ListenerAPI string
+
+const (
+	// Both data and administrative endpoints are served.
+	ListenerAPIAll ListenerAPI = "all"
+
+	// Only data endpoints (produce, consume, ack) are served.
+	ListenerAPIData ListenerAPI = "data"
+
+	// Only administrative endpoints (offsets and consumers) are served.
+	ListenerAPIAdmin ListenerAPI = "admin"
+
+	// Only health check and metrics endpoints are served.
+	ListenerAPIMetrics ListenerAPI = "metrics"
+)
+
+func (la *ListenerAPI) UnmarshalText(text []byte) error {
+	v := ListenerAPI(text)
+	switch v {
+	case ListenerAPIAll, ListenerAPIData, ListenerAPIAdmin, ListenerAPIMetrics:
+	default:
+		return errors.Errorf("bad listener api, %s", v)
+	}
+	*la = v
+	return nil
+}
+
+// HTTPServer defines parameters of an HTTP API server.
+type HTTPServer struct {
+	// Maximum duration for reading an entire request, including the body.
+	// Zero means no timeout.
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+
+	// Maximum duration before timing out writes of a response. It must be
+	// greater than `consumer.max_long_polling_timeout` of all proxies,
+	// otherwise long polling consume requests are going to be aborted. Zero
+	// means no timeout.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// Maximum amount of time to wait for the next request on a keep-alive
+	// connection. Zero means that `read_timeout` is used.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Maximum duration for reading request headers. Zero means that
+	// `read_timeout` is used.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+
+	// Maximum amount of time to wait on shutdown for requests in progress
+	// to complete. Long polling consume requests are interrupted right away
+	// with `503 Service Unavailable`, and connections that are still busy
+	// when the timeout expires are closed. Zero means no timeout.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Maximum number of bytes the server reads parsing request headers,
+	// including the request line.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+
+	// HTTP/2 parameters of listeners that serve TLS.
+	HTTP2 HTTP2 `yaml:"http2"`
+
+	// Maximum size of a produce request body. Requests with bigger bodies
+	// are rejected before the body is read into memory. Zero means no limit.
+	MaxProduceBodyBytes int64 `yaml:"max_produce_body_bytes"`
+
+	// Maximum number of records in a batch produce request. Requests with
+	// more records are rejected with `413 Request Entity Too Large`.
+	MaxBatchRecords int `yaml:"max_batch_records"`
+
+	// Maximum number of records of a batch produce request that are produced
+	// concurrently.
+	BatchProduceWorkers int `yaml:"batch_produce_workers"`
+
+	// Rate limits of requests to all listeners. Requests that exceed any of
+	// them are rejected with `429 Too Many Requests`.
+	RateLimit HTTPRateLimit `yaml:"rate_limit"`
+
+	// Caps of produce and consume requests that all listeners serve at a
+	// time. Requests beyond them are rejected right away with `503 Service
+	// Unavailable`, rather than queued.
+	Concurrency HTTPConcurrency `yaml:"concurrency"`
+
+	// Deduplication of produce requests retried with the same
+	// `Idempotency-Key` header.
+	Idempotency HTTPIdempotency `yaml:"idempotency"`
+
+	// Tenants that API keys, peers and JSON Web Tokens can be assigned to, by
+	// name. A tenant owns topics and consumer groups with particular name
+	// prefixes, and all its clients share its quotas. Requests of clients
+	// that are not assigned to a tenant, including all gRPC requests, count
+	// against quotas of the tenant that owns the consumer group, or the topic
+	// if there is no group.
+	Tenants map[string]Tenant `yaml:"tenants"`
+
+	// Where records of administrative requests that change state, e.g.
+	// offsets, topics or the log level, are written to.
+	Audit HTTPAudit `yaml:"audit"`
+
+	// If true, then runtime profiling data is served by listeners that serve
+	// the administrative API, at `/debug/pprof/` in the format expected by
+	// the pprof visualization tool.
+	Pprof bool `yaml:"pprof"`
+}
+
+// HTTPRateLimit defines token bucket rate limits of HTTP API requests.
+type HTTPRateLimit struct {
+	// Limit of all requests served by the process.
+	Global RateLimit `yaml:"global"`
+
+	// Limit of requests of each client. A client is identified by its auth
+	// token, or by its IP address if a listener does not require
+	// authentication. It can be overridden for particular API keys.
+	PerClient RateLimit `yaml:"per_client"`
+
+	// Limit of requests that name a topic, per topic.
+	PerTopic RateLimit `yaml:"per_topic"`
+
+	// Limits of requests to particular topics that override `PerTopic`.
+	Topics map[string]RateLimit `yaml:"topics"`
+}
+
+// Enabled tells whether any rate limit is configured.
+func (rl *HTTPRateLimit) Enabled() bool {
+	if rl.Global.Rate != 0 || rl.PerClient.Rate != 0 || rl.PerTopic.Rate != 0 {
+		return true
+	}
+	for _, limit := range rl.Topics {
+		if limit.Rate != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPConcurrency defines caps of requests that are served at a time.
+// Consume requests are counted separately, because long polling ones can
+// wait for messages for a long time.
+type HTTPConcurrency struct {
+	// Maximum number of produce and produce batch requests served at a time.
+	// Zero means no limit.
+	MaxProduce int `yaml:"max_produce"`
+
+	// Maximum number of consume requests, including long polling ones,
+	// served at a time. Zero means no limit.
+	MaxConsume int `yaml:"max_consume"`
+}
+
+// HTTP2 defines parameters of HTTP/2 served by TLS listeners. Clients that
+// negotiate HTTP/2 multiplex requests over a single connection, so that long
+// polling requests do not take a connection each.
+type HTTP2 struct {
+	// If true, then TLS listeners serve HTTP/2 to clients that support it.
+	// SSE, tail and WebSocket streams are only served over HTTP/1.1.
+	Enabled bool `yaml:"enabled"`
+
+	// Maximum number of requests that a client can have in progress on an
+	// HTTP/2 connection at a time.
+	MaxConcurrentStreams uint32 `yaml:"max_concurrent_streams"`
+}
+
+// HTTPIdempotency defines parameters of produce request deduplication.
+type HTTPIdempotency struct {
+	// Maximum number of idempotency keys to remember. When it is reached the
+	// oldest keys are forgotten. Zero disables deduplication.
+	MaxKeys int `yaml:"max_keys"`
+
+	// How long an idempotency key is remembered after the request that
+	// first used it.
+	TTL time.Duration `yaml:"ttl"`
+
+	// File that remembered keys are saved to on shutdown and loaded from on
+	// startup. Keys are kept in memory only if it is not set.
+	StateFile string `yaml:"state_file"`
+}
+
+// HTTPAudit defines sinks of records of administrative requests that change
+// state. Records are not written if no sink is configured.
+type HTTPAudit struct {
+	// File that records are appended to, one JSON object per line.
+	File string `yaml:"file"`
+
+	// Topic that records are produced to as JSON messages.
+	Topic string `yaml:"topic"`
+
+	// Cluster of `topic`. The default cluster is used if it is not set.
+	Cluster string `yaml:"cluster"`
+}
+
+// Tenant defines a namespace of topics and consumer groups that clients
+// assigned to it are granted access to, and quotas shared by all clients of
+// the tenant.
+type Tenant struct {
+	// Prefixes of names of topics that the tenant owns. An empty list means
+	// all topics.
+	TopicPrefixes []string `yaml:"topic_prefixes"`
+
+	// Prefixes of names of consumer groups that the tenant owns. An empty
+	// list means all groups.
+	GroupPrefixes []string `yaml:"group_prefixes"`
+
+	// Number of bytes of message keys and values per second that clients of
+	// the tenant can produce and consume in total. Requests are rejected with
+	// `429 Too Many Requests` once the quota is used up. Zero means no limit.
+	BytesPerSecond int64 `yaml:"bytes_per_second"`
+
+	// Maximum number of consume requests, including those of WebSocket and
+	// SSE streams, that clients of the tenant can have waiting for messages
+	// at once. Zero means no limit.
+	MaxLongPolls int `yaml:"max_long_polls"`
+}
+
+// RateLimit defines a token bucket.
+type RateLimit struct {
+	// Number of requests per second. Zero means no limit.
+	Rate float64 `yaml:"rate"`
+
+	// Maximum number of requests that can be made at once. Zero means the
+	// rate rounded up.
+	Burst int `yaml:"burst"`
+}
+
+func (t Tenant) validate() error {
+	for _, prefix := range append(append([]string(nil), t.TopicPrefixes...), t.GroupPrefixes...) {
+		if prefix == "" || strings.ContainsAny(prefix, `*?[\`) {
+			return errors.Errorf("bad prefix: %q", prefix)
+		}
+	}
+	switch {
+	case t.BytesPerSecond < 0:
+		return errors.New("bytes_per_second must be >= 0")
+	case t.MaxLongPolls < 0:
+		return errors.New("max_long_polls must be >= 0")
+	}
+	return nil
+}
+
+func (rl RateLimit) validate() error {
+	switch {
+	case rl.Rate < 0:
+		return errors.New("rate must be >= 0")
+	case rl.Burst < 0:
+		return errors.New("burst must be >= 0")
+	}
+	return nil
+}
+
+// StatsD defines parameters of periodic reporting of metrics to a StatsD
+// server.
+type StatsD struct {
+	// UDP address of a StatsD server. Metrics are not reported if it is not
+	// set.
+	Addr string `yaml:"addr"`
+
+	// String that all metric names are prefixed with, e.g. `kafka_pixy.`.
+	Prefix string `yaml:"prefix"`
+
+	// Tags that are attached to all reported metrics, e.g. `env:prod`.
+	Tags []string `yaml:"tags"`
+
+	// Defines how metric labels and tags are reported.
+	Format StatsDFormat `yaml:"format"`
+
+	// How often metrics are reported.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
 // Proxy defines configuration of a proxy to a particular Kafka/ZooKeeper
 // cluster.
 type Proxy struct {
@@ -46,6 +541,10 @@ type Proxy struct {
 	// leave it like that.
 	ClientID string `yaml:"client_id"`
 
+	// Name of the cluster the proxy is configured for. It is populated from
+	// the key of the `proxies` section and is used to label metrics.
+	Cluster string `yaml:"-"`
+
 	Kafka struct {
 
 		// List of seed Kafka peers that Kafka-Pixy should access to resolve
@@ -54,6 +553,51 @@ type Proxy struct {
 
 		// Version of the Kafka cluster. Supported versions are 0.8.2.2 - 0.10.1.0
 		Version KafkaVersion
+
+		// How long to wait for a connection to a Kafka broker to be
+		// established.
+		DialTimeout time.Duration `yaml:"dial_timeout"`
+
+		// How long to wait for a response from a Kafka broker.
+		ReadTimeout time.Duration `yaml:"read_timeout"`
+
+		// How long to wait for a request to be transmitted to a Kafka broker.
+		WriteTimeout time.Duration `yaml:"write_timeout"`
+
+		// Period of TCP keep-alive probes sent over connections to Kafka
+		// brokers. Zero disables keep-alive.
+		KeepAlive time.Duration `yaml:"keep_alive"`
+
+		// TLS parameters of connections to Kafka brokers.
+		TLS struct {
+
+			// Whether to connect to Kafka brokers over TLS.
+			Enable bool `yaml:"enable"`
+
+			// PEM encoded CA certificate bundle to verify broker
+			// certificates with. If not set, then the system CAs are used.
+			CAFile string `yaml:"ca_file"`
+
+			// PEM encoded client certificate and private key files, if
+			// brokers require clients to authenticate with a certificate.
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+
+			// Disables verification of broker certificates. It should never
+			// be used in production.
+			InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+		} `yaml:"tls"`
+
+		// SASL/PLAIN authentication with Kafka brokers.
+		SASL struct {
+
+			// Whether to authenticate with Kafka brokers.
+			Enable bool `yaml:"enable"`
+
+			// Credentials to authenticate with.
+			User     string `yaml:"user"`
+			Password string `yaml:"password"`
+		} `yaml:"sasl"`
 	} `yaml:"kafka"`
 
 	ZooKeeper struct {
@@ -80,12 +624,34 @@ type Proxy struct {
 		// The best-effort frequency of flushes.
 		FlushFrequency time.Duration `yaml:"flush_frequency"`
 
+		// How messages with a key are assigned to partitions. Allowed values
+		// are: hash, and murmur2 that is compatible with the Java Kafka client.
+		Partitioner Partitioner `yaml:"partitioner"`
+
 		// How long to wait for the cluster to settle between retries.
 		RetryBackoff time.Duration `yaml:"retry_backoff"`
 
 		// The total number of times to retry sending a message.
 		RetryMax int `yaml:"retry_max"`
 
+		// What to do with a message when all attempts to submit it to Kafka
+		// have failed. Allowed values are: drop, dead_letter_file, block, and
+		// spool.
+		RetryExhaustedPolicy RetryExhaustedPolicy `yaml:"retry_exhausted_policy"`
+
+		// Path to a file that messages that could not be submitted to Kafka
+		// are appended to if `RetryExhaustedPolicy` is `dead_letter_file`.
+		DeadLetterFile string `yaml:"dead_letter_file"`
+
+		// Directory where messages that could not be submitted to Kafka are
+		// spooled to if `RetryExhaustedPolicy` is `spool`. Every cluster
+		// gets a subdirectory named after it.
+		SpoolDir string `yaml:"spool_dir"`
+
+		// The maximum size of the spool of a cluster in bytes. Messages that
+		// do not fit are dropped.
+		SpoolMaxSize int64 `yaml:"spool_max_size"`
+
 		// The level of acknowledgement reliability needed from the broker.
 		RequiredAcks RequiredAcks `yaml:"required_acks"`
 
@@ -93,6 +659,15 @@ type Proxy struct {
 		// messages to Kafka. It is recommended to make it large enough to survive
 		// a ZooKeeper leader election in your setup.
 		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+		// Period of time that Kafka-Pixy should wait for messages buffered
+		// by the Kafka client to be flushed after `ShutdownTimeout` has
+		// elapsed. Messages that have not been confirmed by Kafka by then are
+		// reported as dropped.
+		ShutdownFlushTimeout time.Duration `yaml:"shutdown_flush_timeout"`
+
+		// Overrides of producer parameters for particular topics.
+		Topics map[string]ProducerParams `yaml:"topics"`
 	} `yaml:"producer"`
 
 	Consumer struct {
@@ -101,6 +676,16 @@ type Proxy struct {
 		// before retrying. It must be less then RegistrationTimeout.
 		AckTimeout time.Duration `yaml:"ack_timeout"`
 
+		// How partitions of a topic are divided among members of a consumer
+		// group. All Kafka-Pixy instances of a group must use the same
+		// strategy, for otherwise they can disagree on partition ownership.
+		AssignmentStrategy AssignmentStrategy `yaml:"assignment_strategy"`
+
+		// When a batch consume request gets its first message, it waits at
+		// most this long for each next message to become available, before
+		// the batch is returned to the client.
+		BatchLinger time.Duration `yaml:"batch_linger"`
+
 		// Size of all buffered channels created by the consumer module.
 		ChannelBufferSize int `yaml:"channel_buffer_size"`
 
@@ -116,25 +701,118 @@ type Proxy struct {
 		// the fetch request if there isn't data immediately available.
 		FetchMaxWait time.Duration `yaml:"fetch_max_wait"`
 
+		// When a partition consumer stops, e.g. on shutdown or rebalancing,
+		// it waits at most this long for the last submitted offset to be
+		// committed to Kafka. If the timeout elapses the offset is abandoned,
+		// and the messages consumed since the last successful commit will be
+		// consumed again. Zero means wait indefinitely.
+		FinalOffsetCommitTimeout time.Duration `yaml:"final_offset_commit_timeout"`
+
+		// Where a consumer group starts consuming a partition that it has not
+		// committed an offset for yet: either from the newest or the oldest
+		// available message.
+		InitialOffset InitialOffset `yaml:"initial_offset"`
+
+		// Initial offset policies of particular consumer groups, that take
+		// precedence over `InitialOffset`.
+		GroupInitialOffsets map[string]InitialOffset `yaml:"group_initial_offsets"`
+
 		// Consume request will wait at most this long until a message from the
 		// specified group-topic becomes available.
 		LongPollingTimeout time.Duration `yaml:"long_polling_timeout"`
 
+		// The maximum long polling timeout that an individual consume request
+		// can ask for, overriding `LongPollingTimeout`. Longer timeouts are
+		// reduced to it.
+		MaxLongPollingTimeout time.Duration `yaml:"max_long_polling_timeout"`
+
 		// The maximum number of unacknowledged messages allowed for a
 		// particular group-topic-partition at a time. When this number is
 		// reached subsequent consume requests will return long polling timeout
 		// errors, until some of the pending messages are acknowledged.
 		MaxPendingMessages int `yaml:"max_pending_messages"`
 
+		// The maximum distance between the first message of a
+		// group-topic-partition that has not been acknowledged yet and the
+		// next message to be offered. When it is reached no more messages
+		// are offered until the former is acknowledged. It bounds the number
+		// of messages that can be acknowledged out of order, and therefore
+		// the size of sparse acks committed in offset metadata. Zero means
+		// no limit.
+		MaxAckWindow int `yaml:"max_ack_window"`
+
+		// The maximum total number of consume requests queued across consumer
+		// groups, and across topics within a consumer group, before the
+		// requests are fairly split among them. When the limit is reached a
+		// group (or topic) that has more requests queued than an even share
+		// of the limit gets its requests rejected, so that it cannot
+		// monopolize the consumer. Zero disables fair sharing.
+		MaxQueuedRequests int `yaml:"max_queued_requests"`
+
+		// Load shedding rejects consume requests right away with an
+		// overloaded error when a queue they would be placed into is deeper
+		// than a threshold. Under overload that makes clients back off
+		// instead of piling up requests that are doomed to time out.
+		LoadShedding struct {
+
+			// Maximum number of requests queued for a consumer group. Zero
+			// disables the check.
+			MaxGroupQueueDepth int `yaml:"max_group_queue_depth"`
+
+			// Maximum number of requests queued for a topic within a
+			// consumer group. Zero disables the check.
+			MaxTopicQueueDepth int `yaml:"max_topic_queue_depth"`
+		} `yaml:"load_shedding"`
+
 		// The maximum number of times a message can be offered to a consumer.
 		// If a message was offered that many times and no acknowledgment has
 		// been received, then it is considered to be acknowledged and will
 		// never be offered again.
 		MaxRetries int `yaml:"max_retries"`
 
+		// Topic that messages are produced to when they have been offered
+		// `MaxRetries` times without being acknowledged. It is a template
+		// that can include the following placeholders: `{topic}` (the topic
+		// the message was consumed from) and `{group}` (the consumer group
+		// name), e.g. "{topic}.dlq". If empty then such messages are dropped.
+		DeadLetterTopic string `yaml:"dead_letter_topic"`
+
+		// ID that Kafka-Pixy registers with in consumer groups. It is a
+		// template that can include the following placeholders: `{client_id}`,
+		// `{hostname}`, `{group}` (the consumer group name), and `{env.NAME}`
+		// (the value of the NAME environment variable). If empty then
+		// `ClientID` is used.
+		MemberID string `yaml:"member_id"`
+
+		// If a member leaves a consumer group, then other members keep
+		// treating it as a member of the group for this long. If the member
+		// rejoins the group with the same ID in time, e.g. when it is
+		// restarted during a deploy, then rebalancing does not happen at all.
+		// Partitions assigned to the member are not consumed while it is away.
+		// It makes sense only if members have stable IDs, see `MemberID`.
+		// Zero disables the feature.
+		MemberSessionTimeout time.Duration `yaml:"member_session_timeout"`
+
+		// How long a message rejected by a consumer should be held back
+		// before it is offered again. Zero means that it is offered again
+		// right away. Backoff expiration is checked once a second, so
+		// shorter values are not precise.
+		NackBackoff time.Duration `yaml:"nack_backoff"`
+
+		// How messages fetched from partitions of a topic are scheduled to
+		// be consumed by a group.
+		MuxPolicy MuxPolicy `yaml:"mux_policy"`
+
 		// How frequently to commit offsets to Kafka.
 		OffsetsCommitInterval time.Duration `yaml:"offsets_commit_interval"`
 
+		// The maximum number of messages fetched from a topic-partition that
+		// are held in memory until they are consumed. Messages fetched in
+		// excess of it are dropped and fetched again later. Zero means that
+		// there is no limit other than ChannelBufferSize plus whatever a
+		// fetch request returns.
+		PrefetchMaxMessages int `yaml:"prefetch_max_messages"`
+
 		// Kafka-Pixy should wait this long after it gets notification that a
 		// consumer joined/left a consumer group it is a member of before
 		// rebalancing.
@@ -145,10 +823,217 @@ type Proxy struct {
 		// requests to the consumer group or topic.
 		RegistrationTimeout time.Duration `yaml:"registration_timeout"`
 
+		// If a partition consumer fails, e.g. due to a transient broker
+		// error, then it is restarted after this long.
+		RestartBackoff time.Duration `yaml:"restart_backoff"`
+
 		// If a request to a Kafka-Pixy fails for any reason, then it should
 		// wait this long before retrying.
 		RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+		// How often the list of topics is refreshed from Kafka metadata, so
+		// that consume requests with a topic pattern pick up new topics.
+		TopicsRefreshInterval time.Duration `yaml:"topics_refresh_interval"`
+
+		// Overrides of consumer parameters for particular topics.
+		Topics map[string]ConsumerParams `yaml:"topics"`
+
+		// Overrides of consumer parameters for particular consumer groups,
+		// that take precedence over those for topics.
+		Groups map[string]ConsumerParams `yaml:"groups"`
 	} `yaml:"consumer"`
+
+	SchemaRegistry struct {
+
+		// URL of a Confluent Schema Registry that schemas of topics with
+		// Avro serialization are retrieved from.
+		URL string `yaml:"url"`
+
+		// Timeout of a request to the schema registry.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// Serialization of message values by topic. Allowed values are: raw,
+		// and avro that makes produced JSON messages be Avro encoded with the
+		// latest schema registered for the `<topic>-value` subject, and
+		// consumed messages be decoded back to JSON. Topics that are not
+		// mentioned are raw.
+		Topics map[string]Serialization `yaml:"topics"`
+	} `yaml:"schema_registry"`
+
+	Protobuf struct {
+
+		// Protocol buffers message types by topic. Produced JSON messages
+		// of these topics are encoded to the binary format of the message
+		// type, and consumed messages are decoded back to JSON.
+		Topics map[string]ProtobufTopic `yaml:"topics"`
+	} `yaml:"protobuf"`
+
+	Transform struct {
+
+		// Transformation pipelines by topic. Stages of a produce pipeline
+		// are applied to messages before they are serialized and produced,
+		// and stages of a consume pipeline are applied to messages after
+		// they are consumed and deserialized.
+		Topics map[string]TopicTransform `yaml:"topics"`
+	} `yaml:"transform"`
+
+	Webhook struct {
+
+		// If a webhook request fails, then a worker that made it waits this
+		// long before consuming the next message.
+		RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+		// Timeout of a webhook request. It must be less than
+		// `Consumer.AckTimeout`, for otherwise a message can be offered
+		// again while it is still being delivered.
+		Timeout time.Duration `yaml:"timeout"`
+
+		// Group/topic pairs that consumed messages are pushed to HTTP
+		// endpoints for.
+		Subscriptions []WebhookSubscription `yaml:"subscriptions"`
+
+		// URL prefixes that results of asynchronous produce requests can be
+		// posted to. A request can ask for a callback only to a URL that
+		// starts with one of them. If empty, then callbacks are disabled.
+		ProduceCallbackURLs []string `yaml:"produce_callback_urls"`
+
+		// The number of times a failed produce callback is retried.
+		ProduceCallbackRetryMax int `yaml:"produce_callback_retry_max"`
+
+		// The maximum number of produce callbacks waiting to be posted.
+		// Callbacks that do not fit are dropped.
+		ProduceCallbackQueueSize int `yaml:"produce_callback_queue_size"`
+
+		// The number of produce callbacks that are posted concurrently.
+		ProduceCallbackConcurrency int `yaml:"produce_callback_concurrency"`
+	} `yaml:"webhook"`
+
+	Mirror struct {
+
+		// If producing a message to a target cluster fails, then a worker
+		// that consumed it waits this long before consuming the next one.
+		RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+		// Topics of this cluster that are replicated to other clusters.
+		Topics []MirrorTopic `yaml:"topics"`
+	} `yaml:"mirror"`
+
+	// Redaction of message contents before they are logged, or returned by
+	// the peek, partition read and tail endpoints.
+	Redaction struct {
+
+		// Paths of JSON fields whose values are replaced with `[REDACTED]`,
+		// given as field names separated by dots, e.g. `user.email`. `*`
+		// matches any field. Arrays are traversed transparently, so
+		// `items.ssn` applies to all elements of an `items` array.
+		Fields []string `yaml:"fields"`
+
+		// If true, then values that are not valid JSON are replaced with
+		// `[REDACTED]` entirely, otherwise they are left as they are.
+		RedactNonJSON bool `yaml:"redact_non_json"`
+	} `yaml:"redaction"`
+}
+
+// ConsumerParams defines consumer parameters that can be overridden for
+// particular topics and consumer groups. Zero values mean that a parameter is
+// not overridden. Refer to the respective `Proxy.Consumer` parameters for
+// descriptions.
+type ConsumerParams struct {
+	ChannelBufferSize int `yaml:"channel_buffer_size"`
+
+	// Cannot be overridden for a consumer group, for messages of a topic
+	// partition are fetched once for all groups that consume it.
+	FetchMaxBytes int `yaml:"fetch_max_bytes"`
+
+	InitialOffset      InitialOffset `yaml:"initial_offset"`
+	LongPollingTimeout time.Duration `yaml:"long_polling_timeout"`
+
+	// Cannot be overridden for a consumer group, for the same reason as
+	// FetchMaxBytes.
+	PrefetchMaxMessages int `yaml:"prefetch_max_messages"`
+
+	RegistrationTimeout time.Duration `yaml:"registration_timeout"`
+}
+
+// ProducerParams defines producer parameters that can be overridden for
+// particular topics. Nil values mean that a parameter is not overridden.
+// Refer to the respective `Proxy.Producer` parameters for descriptions.
+type ProducerParams struct {
+	Compression *Compression `yaml:"compression"`
+}
+
+// WebhookSubscription defines an HTTP endpoint that messages consumed by a
+// group from a topic are posted to.
+type WebhookSubscription struct {
+	Group string `yaml:"group"`
+	Topic string `yaml:"topic"`
+	URL   string `yaml:"url"`
+
+	// The maximum number of concurrent requests to the endpoint. If zero,
+	// then messages are delivered one at a time.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// MirrorTopic defines a topic that is consumed by a group and replicated to
+// another cluster. Offsets committed by the group checkpoint the progress.
+type MirrorTopic struct {
+	Group string `yaml:"group"`
+	Topic string `yaml:"topic"`
+
+	// The name of a cluster to produce messages to. It must be one of the
+	// configured proxies.
+	Cluster string `yaml:"cluster"`
+
+	// The name of a topic in the target cluster. If empty, then it is the
+	// same as Topic.
+	TargetTopic string `yaml:"target_topic"`
+
+	// The maximum number of messages replicated concurrently. If zero, then
+	// messages are replicated one at a time.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// TopicTransform defines transformation pipelines of a topic.
+type TopicTransform struct {
+	Produce []TransformStage `yaml:"produce"`
+	Consume []TransformStage `yaml:"consume"`
+}
+
+// TransformStage defines a stage of a transformation pipeline. Parameters
+// that a stage uses depend on its type.
+type TransformStage struct {
+
+	// Type of the stage. Allowed values are: redact, rename, set and plugin.
+	Type TransformType `yaml:"type"`
+
+	// Fields removed from a JSON message by a redact stage. Nested fields
+	// are referred to by dot separated paths, e.g. `card.number`.
+	Fields []string `yaml:"fields"`
+
+	// Fields of a JSON message renamed by a rename stage, old to new.
+	Rename map[string]string `yaml:"rename"`
+
+	// Fields set to string values in a JSON message by a set stage.
+	Set map[string]string `yaml:"set"`
+
+	// Path to a Go plugin that implements a plugin stage.
+	Plugin string `yaml:"plugin"`
+
+	// Parameters passed to a plugin stage constructor.
+	Params map[string]string `yaml:"params"`
+}
+
+// ProtobufTopic defines a protocol buffers message type that message values
+// of a topic are serialized with.
+type ProtobufTopic struct {
+
+	// Path to a file with a serialized `google.protobuf.FileDescriptorSet`
+	// that defines the message type, as produced by
+	// `protoc --include_imports --descriptor_set_out`.
+	DescriptorSetFile string `yaml:"descriptor_set_file"`
+
+	// Fully qualified name of the message type, e.g. `foo.bar.Baz`.
+	MessageType string `yaml:"message_type"`
 }
 
 type KafkaVersion struct {
@@ -191,6 +1076,9 @@ func (c *Compression) UnmarshalText(text []byte) error {
 		"lz4":    sarama.CompressionLZ4,
 	}[str]
 	if !ok {
+		if str == "zstd" {
+			return errors.Errorf("unsupported compression, %s", str)
+		}
 		return errors.Errorf("bad compression, %s", str)
 	}
 	*c = Compression(v)
@@ -213,6 +1101,218 @@ func (ra *RequiredAcks) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// RetryExhaustedPolicy defines what producer does with a message when it
+// failed to submit it to Kafka after `Producer.RetryMax` attempts.
+type RetryExhaustedPolicy string
+
+const (
+	// The message is logged and dropped.
+	RetryExhaustedDrop RetryExhaustedPolicy = "drop"
+
+	// The message is appended to `Producer.DeadLetterFile`.
+	RetryExhaustedDeadLetterFile RetryExhaustedPolicy = "dead_letter_file"
+
+	// The message is resubmitted again after `Producer.RetryBackoff` until
+	// it is either successfully submitted or the producer is stopped.
+	RetryExhaustedBlock RetryExhaustedPolicy = "block"
+
+	// The message is persisted to `Producer.SpoolDir` and replayed in order
+	// with other spooled messages when Kafka becomes available.
+	RetryExhaustedSpool RetryExhaustedPolicy = "spool"
+)
+
+func (rep *RetryExhaustedPolicy) UnmarshalText(text []byte) error {
+	v := RetryExhaustedPolicy(text)
+	switch v {
+	case RetryExhaustedDrop, RetryExhaustedDeadLetterFile, RetryExhaustedBlock, RetryExhaustedSpool:
+	default:
+		return errors.Errorf("bad retry exhausted policy, %s", v)
+	}
+	*rep = v
+	return nil
+}
+
+// Partitioner defines how producer assigns messages with a key to
+// partitions. Messages with a nil key are always assigned to a random
+// partition.
+type Partitioner string
+
+const (
+	// A partition is selected by an FNV-1a hash of the key. That is the
+	// default partitioner of sarama.
+	PartitionerHash Partitioner = "hash"
+
+	// A partition is selected by a murmur2 hash of the key, the same way
+	// as the default partitioner of the Java Kafka client does.
+	PartitionerMurmur2 Partitioner = "murmur2"
+)
+
+func (pt *Partitioner) UnmarshalText(text []byte) error {
+	v := Partitioner(text)
+	switch v {
+	case PartitionerHash, PartitionerMurmur2:
+	default:
+		return errors.Errorf("bad partitioner, %s", v)
+	}
+	*pt = v
+	return nil
+}
+
+// Serialization defines how message values of a topic are serialized.
+type Serialization string
+
+const (
+	// Message values are passed through as is.
+	SerializationRaw Serialization = "raw"
+
+	// Message values are Avro encoded in the Confluent Schema Registry wire
+	// format when produced, and decoded to JSON when consumed.
+	SerializationAvro Serialization = "avro"
+)
+
+func (s *Serialization) UnmarshalText(text []byte) error {
+	v := Serialization(text)
+	switch v {
+	case SerializationRaw, SerializationAvro:
+	default:
+		return errors.Errorf("bad serialization, %s", v)
+	}
+	*s = v
+	return nil
+}
+
+// StatsDFormat defines how metric labels and tags are reported to StatsD.
+type StatsDFormat string
+
+const (
+	// Labels and tags are reported as DogStatsD tags, e.g.
+	// `consumer_messages:5|c|#cluster:default,topic:foo`.
+	StatsDFormatDatadog StatsDFormat = "datadog"
+
+	// Label values are appended to metric names, and tags are not reported,
+	// e.g. `consumer_messages.default.foo:5|c`.
+	StatsDFormatPlain StatsDFormat = "plain"
+)
+
+func (sf *StatsDFormat) UnmarshalText(text []byte) error {
+	v := StatsDFormat(text)
+	switch v {
+	case StatsDFormatDatadog, StatsDFormatPlain:
+	default:
+		return errors.Errorf("bad statsd format, %s", v)
+	}
+	*sf = v
+	return nil
+}
+
+// TransformType defines what a transformation stage does to a message.
+type TransformType string
+
+const (
+	// Fields are removed from a JSON message.
+	TransformRedact TransformType = "redact"
+
+	// Fields of a JSON message are renamed.
+	TransformRename TransformType = "rename"
+
+	// Fields of a JSON message are set to constant values.
+	TransformSet TransformType = "set"
+
+	// A message is transformed by a Go plugin.
+	TransformPlugin TransformType = "plugin"
+)
+
+func (tt *TransformType) UnmarshalText(text []byte) error {
+	v := TransformType(text)
+	switch v {
+	case TransformRedact, TransformRename, TransformSet, TransformPlugin:
+	default:
+		return errors.Errorf("bad transform type, %s", v)
+	}
+	*tt = v
+	return nil
+}
+
+// AssignmentStrategy defines how partitions of a topic are divided among
+// members of a consumer group.
+type AssignmentStrategy string
+
+const (
+	// Sorted partitions are split into ranges of equal size that are
+	// assigned to members in the order of their IDs. A change in the group
+	// membership can move most of the partitions.
+	AssignmentRange AssignmentStrategy = "range"
+
+	// Partitions are divided as evenly as with the range strategy, but a
+	// change in the group membership moves a lot less of them.
+	AssignmentSticky AssignmentStrategy = "sticky"
+)
+
+func (as *AssignmentStrategy) UnmarshalText(text []byte) error {
+	v := AssignmentStrategy(text)
+	switch v {
+	case AssignmentRange, AssignmentSticky:
+	default:
+		return errors.Errorf("bad assignment strategy, %s", v)
+	}
+	*as = v
+	return nil
+}
+
+// MuxPolicy defines in what order messages fetched from partitions of a
+// topic are consumed.
+type MuxPolicy string
+
+const (
+	// A message from the partition with the largest lag is consumed first,
+	// partitions with the same lag take turns. A partition that keeps the
+	// largest lag can starve the others.
+	MuxLag MuxPolicy = "lag"
+
+	// Partitions that have messages fetched take turns regardless of lag.
+	MuxRoundRobin MuxPolicy = "round_robin"
+
+	// Partitions that have messages fetched take turns, but each gets a
+	// share of turns proportional to its lag. Partitions with a larger lag
+	// are consumed faster, but none is starved.
+	MuxWeighted MuxPolicy = "weighted"
+)
+
+func (mp *MuxPolicy) UnmarshalText(text []byte) error {
+	v := MuxPolicy(text)
+	switch v {
+	case MuxLag, MuxRoundRobin, MuxWeighted:
+	default:
+		return errors.Errorf("bad mux policy, %s", v)
+	}
+	*mp = v
+	return nil
+}
+
+// InitialOffset defines where a consumer group starts consuming a partition
+// that it has not committed an offset for yet.
+type InitialOffset string
+
+const (
+	// Consumption starts from the newest message, that is only messages
+	// produced after the group started consuming are consumed.
+	InitialOffsetLatest InitialOffset = "latest"
+
+	// Consumption starts from the oldest message available in the partition.
+	InitialOffsetEarliest InitialOffset = "earliest"
+)
+
+func (io *InitialOffset) UnmarshalText(text []byte) error {
+	v := InitialOffset(text)
+	switch v {
+	case InitialOffsetLatest, InitialOffsetEarliest:
+	default:
+		return errors.Errorf("bad initial offset, %s", v)
+	}
+	*io = v
+	return nil
+}
+
 func (p *Proxy) KazooCfg() *kazoo.Config {
 	kazooCfg := kazoo.NewConfig()
 	kazooCfg.Chroot = p.ZooKeeper.Chroot
@@ -231,6 +1331,7 @@ func (p *Proxy) SaramaProducerCfg() *sarama.Config {
 	saramaCfg.ChannelBufferSize = p.Producer.ChannelBufferSize
 	saramaCfg.ClientID = p.ClientID
 	saramaCfg.Version = p.Kafka.Version.v
+	p.setSaramaNetCfg(saramaCfg)
 
 	saramaCfg.Producer.Compression = sarama.CompressionCodec(p.Producer.Compression)
 	saramaCfg.Producer.Flush.Frequency = p.Producer.FlushFrequency
@@ -246,14 +1347,57 @@ func (p *Proxy) SaramaClientCfg() *sarama.Config {
 	saramaCfg.ChannelBufferSize = p.Consumer.ChannelBufferSize
 	saramaCfg.ClientID = p.ClientID
 	saramaCfg.Version = p.Kafka.Version.v
+	p.setSaramaNetCfg(saramaCfg)
 	return saramaCfg
 }
 
+func (p *Proxy) setSaramaNetCfg(saramaCfg *sarama.Config) {
+	saramaCfg.Net.DialTimeout = p.Kafka.DialTimeout
+	saramaCfg.Net.ReadTimeout = p.Kafka.ReadTimeout
+	saramaCfg.Net.WriteTimeout = p.Kafka.WriteTimeout
+	saramaCfg.Net.KeepAlive = p.Kafka.KeepAlive
+	if p.Kafka.TLS.Enable {
+		saramaCfg.Net.TLS.Enable = true
+		// The TLS parameters are checked on validation, so an error is not
+		// expected here.
+		saramaCfg.Net.TLS.Config, _ = p.kafkaTLSConfig()
+	}
+	if p.Kafka.SASL.Enable {
+		saramaCfg.Net.SASL.Enable = true
+		saramaCfg.Net.SASL.User = p.Kafka.SASL.User
+		saramaCfg.Net.SASL.Password = p.Kafka.SASL.Password
+	}
+}
+
+// kafkaTLSConfig creates a TLS configuration of connections to Kafka brokers.
+func (p *Proxy) kafkaTLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: p.Kafka.TLS.InsecureSkipVerify}
+	if p.Kafka.TLS.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(p.Kafka.TLS.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA file")
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in %s", p.Kafka.TLS.CAFile)
+		}
+	}
+	if p.Kafka.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.Kafka.TLS.CertFile, p.Kafka.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
 // DefaultApp returns default application configuration where default proxy has
 // the specified cluster.
 func DefaultApp(cluster string) *App {
 	appCfg := newApp()
 	proxyCfg := DefaultProxy()
+	proxyCfg.Cluster = cluster
 	appCfg.Proxies[cluster] = proxyCfg
 	appCfg.DefaultCluster = cluster
 	return appCfg
@@ -291,8 +1435,14 @@ func FromYAML(data []byte) (*App, error) {
 	if err := yaml.Unmarshal(data, &prob); err != nil {
 		return nil, errors.Wrap(err, "failed to parse config")
 	}
+	if err := checkParamsStrict(data); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
 
 	appCfg := newApp()
+	if err := yaml.Unmarshal(data, appCfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
 	clientID := newClientID()
 
 	for _, proxyItem := range prob.Proxies {
@@ -311,6 +1461,7 @@ func FromYAML(data []byte) (*App, error) {
 		if err := yaml.Unmarshal(encodedProxyCfg, proxyCfg); err != nil {
 			return nil, errors.Wrapf(err, "failed to parse proxy config, cluster=%s", cluster)
 		}
+		proxyCfg.Cluster = cluster
 		appCfg.Proxies[cluster] = proxyCfg
 		if appCfg.DefaultCluster == "" {
 			appCfg.DefaultCluster = cluster
@@ -323,19 +1474,269 @@ func FromYAML(data []byte) (*App, error) {
 	return appCfg, nil
 }
 
+// HTTPListeners returns all configured HTTP API listeners, including those
+// defined by `TCPAddr`, `UnixAddr`, and `AdminAddr`.
+func (a *App) HTTPListeners() []Listener {
+	var listeners []Listener
+	api := ListenerAPIAll
+	if a.AdminAddr != "" {
+		api = ListenerAPIData
+		listeners = append(listeners, Listener{Addr: a.AdminAddr, API: ListenerAPIAdmin})
+	}
+	if a.TCPAddr != "" {
+		listeners = append(listeners, Listener{Addr: a.TCPAddr, API: api, TLS: a.TLS})
+	}
+	if a.UnixAddr != "" {
+		listeners = append(listeners, Listener{Addr: a.UnixAddr, API: api, Socket: a.UnixSocket})
+	}
+	for _, lsn := range a.Listeners {
+		if lsn.API == "" {
+			lsn.API = ListenerAPIAll
+		}
+		listeners = append(listeners, lsn)
+	}
+	return listeners
+}
+
 func (a *App) validate() error {
 	if len(a.Proxies) == 0 {
 		return errors.New("at least on proxy must be configured")
 	}
+	if _, ok := a.Proxies[a.DefaultCluster]; !ok {
+		return errors.Errorf("default cluster is not configured, %s", a.DefaultCluster)
+	}
+	// Validate the HTTP parameters.
+	switch {
+	case a.HTTP.ReadTimeout < 0:
+		return errors.New("http.read_timeout must be >= 0")
+	case a.HTTP.WriteTimeout < 0:
+		return errors.New("http.write_timeout must be >= 0")
+	case a.HTTP.IdleTimeout < 0:
+		return errors.New("http.idle_timeout must be >= 0")
+	case a.HTTP.ReadHeaderTimeout < 0:
+		return errors.New("http.read_header_timeout must be >= 0")
+	case a.HTTP.ShutdownTimeout < 0:
+		return errors.New("http.shutdown_timeout must be >= 0")
+	case a.HTTP.MaxHeaderBytes <= 0:
+		return errors.New("http.max_header_bytes must be > 0")
+	case a.HTTP.MaxProduceBodyBytes < 0:
+		return errors.New("http.max_produce_body_bytes must be >= 0")
+	case a.HTTP.MaxBatchRecords <= 0:
+		return errors.New("http.max_batch_records must be > 0")
+	case a.HTTP.BatchProduceWorkers <= 0:
+		return errors.New("http.batch_produce_workers must be > 0")
+	case a.HTTP.HTTP2.Enabled && a.HTTP.HTTP2.MaxConcurrentStreams == 0:
+		return errors.New("http.http2.max_concurrent_streams must be > 0")
+	}
+	rateLimits := map[string]RateLimit{
+		"global":     a.HTTP.RateLimit.Global,
+		"per_client": a.HTTP.RateLimit.PerClient,
+		"per_topic":  a.HTTP.RateLimit.PerTopic,
+	}
+	for topic, limit := range a.HTTP.RateLimit.Topics {
+		rateLimits["topics."+topic] = limit
+	}
+	for name, limit := range rateLimits {
+		if err := limit.validate(); err != nil {
+			return errors.Wrapf(err, "invalid http.rate_limit.%s", name)
+		}
+	}
+	switch {
+	case a.HTTP.Concurrency.MaxProduce < 0:
+		return errors.New("http.concurrency.max_produce must be >= 0")
+	case a.HTTP.Concurrency.MaxConsume < 0:
+		return errors.New("http.concurrency.max_consume must be >= 0")
+	case a.HTTP.Idempotency.MaxKeys < 0:
+		return errors.New("http.idempotency.max_keys must be >= 0")
+	case a.HTTP.Idempotency.TTL <= 0:
+		return errors.New("http.idempotency.ttl must be > 0")
+	}
+	if a.HTTP.Audit.Cluster != "" {
+		if a.HTTP.Audit.Topic == "" {
+			return errors.New("http.audit.cluster requires http.audit.topic")
+		}
+		if _, ok := a.Proxies[a.HTTP.Audit.Cluster]; !ok {
+			return errors.Errorf("http.audit.cluster is not configured, %s", a.HTTP.Audit.Cluster)
+		}
+	}
+	for name, tenant := range a.HTTP.Tenants {
+		if err := tenant.validate(); err != nil {
+			return errors.Wrapf(err, "invalid http.tenants.%s", name)
+		}
+	}
+	if a.StatsD.Addr != "" && a.StatsD.FlushInterval <= 0 {
+		return errors.New("statsd.flush_interval must be > 0")
+	}
+	if a.TLS != (ListenerTLS{}) {
+		tcpLsn := Listener{Addr: a.TCPAddr, TLS: a.TLS}
+		if err := tcpLsn.validate(); err != nil {
+			return errors.Wrap(err, "invalid tcp_addr listener config")
+		}
+	}
+	if err := a.UnixSocket.validate(); err != nil {
+		return errors.Wrap(err, "invalid unix_socket config")
+	}
+	for i, lsn := range a.Listeners {
+		if err := lsn.validate(); err != nil {
+			return errors.Wrapf(err, "invalid listener config, #%d", i)
+		}
+		// Tenants can only be checked against the whole config.
+		for j, key := range lsn.Auth.Keys {
+			if key.Tenant == "" {
+				continue
+			}
+			if _, ok := a.HTTP.Tenants[key.Tenant]; !ok {
+				return errors.Errorf("invalid listener config, #%d: auth.keys[%d] refers to unknown tenant, %s", i, j, key.Tenant)
+			}
+			if len(key.Topics) > 0 || len(key.Groups) > 0 {
+				return errors.Errorf("invalid listener config, #%d: auth.keys[%d] cannot have topics or groups along with a tenant", i, j)
+			}
+		}
+		for j, peer := range lsn.Auth.Peers {
+			if peer.Tenant == "" {
+				continue
+			}
+			if _, ok := a.HTTP.Tenants[peer.Tenant]; !ok {
+				return errors.Errorf("invalid listener config, #%d: auth.peers[%d] refers to unknown tenant, %s", i, j, peer.Tenant)
+			}
+			if len(peer.Topics) > 0 || len(peer.Groups) > 0 {
+				return errors.Errorf("invalid listener config, #%d: auth.peers[%d] cannot have topics or groups along with a tenant", i, j)
+			}
+		}
+	}
+	listenerAddrs := make(map[string]bool)
+	for _, lsn := range a.HTTPListeners() {
+		if listenerAddrs[lsn.Addr] {
+			return errors.Errorf("listener address is used more than once, %s", lsn.Addr)
+		}
+		listenerAddrs[lsn.Addr] = true
+	}
 	for cluster, proxyCfg := range a.Proxies {
 		if err := proxyCfg.validate(); err != nil {
 			return errors.Wrapf(err, "invalid config, cluster=%s", cluster)
 		}
+		if a.HTTP.WriteTimeout != 0 && a.HTTP.WriteTimeout <= proxyCfg.Consumer.LongPollingTimeout {
+			return errors.Errorf("http.write_timeout must be > consumer.long_polling_timeout, cluster=%s", cluster)
+		}
+		if a.HTTP.WriteTimeout != 0 && a.HTTP.WriteTimeout <= proxyCfg.Consumer.MaxLongPollingTimeout {
+			return errors.Errorf("http.write_timeout must be > consumer.max_long_polling_timeout, cluster=%s", cluster)
+		}
+		// Target clusters can only be checked against the whole config.
+		for i, mt := range proxyCfg.Mirror.Topics {
+			targetTopic := mt.TargetTopic
+			if targetTopic == "" {
+				targetTopic = mt.Topic
+			}
+			switch {
+			case a.Proxies[mt.Cluster] == nil:
+				return errors.Errorf("invalid config, cluster=%s: invalid mirror.topics, topic=%d: unknown cluster, %s", cluster, i, mt.Cluster)
+			case mt.Cluster == cluster && targetTopic == mt.Topic:
+				return errors.Errorf("invalid config, cluster=%s: invalid mirror.topics, topic=%d: cannot mirror a topic to itself", cluster, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Listener) validate() error {
+	switch {
+	case l.Addr == "":
+		return errors.New("addr must be set")
+	case (l.TLS.CertFile == "") != (l.TLS.KeyFile == ""):
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	case l.TLS.ClientCAFile != "" && l.TLS.CertFile == "":
+		return errors.New("tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	for _, token := range l.Auth.Tokens {
+		if token == "" {
+			return errors.New("auth.tokens must not be empty")
+		}
+	}
+	for i, key := range l.Auth.Keys {
+		if key.Key == "" {
+			return errors.Errorf("auth.keys[%d].key must be set", i)
+		}
+		for _, pattern := range append(append([]string(nil), key.Topics...), key.Groups...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("auth.keys[%d] has bad pattern: %s", i, pattern)
+			}
+		}
+		if err := key.RateLimit.validate(); err != nil {
+			return errors.Wrapf(err, "invalid auth.keys[%d].rate_limit", i)
+		}
+	}
+	for i, peer := range l.Auth.Peers {
+		if peer.User == "" {
+			return errors.Errorf("auth.peers[%d].user must be set", i)
+		}
+		for _, pattern := range append(append([]string(nil), peer.Topics...), peer.Groups...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("auth.peers[%d] has bad pattern: %s", i, pattern)
+			}
+		}
+	}
+	if isTCPAddr(l.Addr) && (len(l.Auth.Peers) > 0 || l.Socket != (UnixSocket{})) {
+		return errors.New("auth.peers and socket require a unix domain socket address")
+	}
+	if err := l.Socket.validate(); err != nil {
+		return err
+	}
+	if (len(l.Auth.ACL) > 0 || l.Auth.AuditLog != "") && !l.Auth.Enabled() {
+		return errors.New("auth.acl and auth.audit_log require tokens, keys or JWT validation")
+	}
+	for i, rule := range l.Auth.ACL {
+		if len(rule.Principals) == 0 {
+			return errors.Errorf("auth.acl[%d].principals must be set", i)
+		}
+		if len(rule.Operations) == 0 {
+			return errors.Errorf("auth.acl[%d].operations must be set", i)
+		}
+		patterns := append(append(append([]string(nil), rule.Principals...), rule.Topics...), rule.Groups...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("auth.acl[%d] has bad pattern: %s", i, pattern)
+			}
+		}
+	}
+	jwtCfg := l.Auth.JWT
+	switch {
+	case jwtCfg.HS256Secret != "" && jwtCfg.RS256PublicKeyFile != "":
+		return errors.New("auth.jwt.hs256_secret and auth.jwt.rs256_public_key_file cannot be used together")
+	case (jwtCfg.Issuer != "" || jwtCfg.Audience != "") && jwtCfg.HS256Secret == "" && jwtCfg.RS256PublicKeyFile == "":
+		return errors.New("auth.jwt.issuer and auth.jwt.audience require a JWT signature key")
 	}
 	return nil
 }
 
+// isTCPAddr tells whether a listener address is a TCP address rather than a
+// Unix domain socket path.
+func isTCPAddr(addr string) bool {
+	return strings.Contains(addr, ":")
+}
+
 func (p *Proxy) validate() error {
+	// Validate the Kafka parameters.
+	switch {
+	case p.Kafka.DialTimeout <= 0:
+		return errors.New("kafka.dial_timeout must be > 0")
+	case p.Kafka.ReadTimeout <= 0:
+		return errors.New("kafka.read_timeout must be > 0")
+	case p.Kafka.WriteTimeout <= 0:
+		return errors.New("kafka.write_timeout must be > 0")
+	case p.Kafka.KeepAlive < 0:
+		return errors.New("kafka.keep_alive must be >= 0")
+	case p.Kafka.ReadTimeout <= p.Consumer.FetchMaxWait:
+		return errors.New("kafka.read_timeout must be > consumer.fetch_max_wait")
+	case (p.Kafka.TLS.CertFile == "") != (p.Kafka.TLS.KeyFile == ""):
+		return errors.New("kafka.tls.cert_file and kafka.tls.key_file must be set together")
+	case p.Kafka.SASL.Enable && p.Kafka.SASL.User == "":
+		return errors.New("kafka.sasl.user must be set if kafka.sasl.enable is true")
+	}
+	if p.Kafka.TLS.Enable {
+		if _, err := p.kafkaTLSConfig(); err != nil {
+			return errors.Wrap(err, "invalid kafka.tls")
+		}
+	}
 	// Validate the Producer parameters.
 	switch {
 	case p.Producer.ChannelBufferSize <= 0:
@@ -350,37 +1751,425 @@ func (p *Proxy) validate() error {
 		return errors.New("producer.retry_max must be > 0")
 	case p.Producer.ShutdownTimeout < 0:
 		return errors.New("producer.shutdown_timeout must be >= 0")
+	case p.Producer.ShutdownFlushTimeout < 0:
+		return errors.New("producer.shutdown_flush_timeout must be >= 0")
+	case p.Producer.RetryExhaustedPolicy == RetryExhaustedDeadLetterFile && p.Producer.DeadLetterFile == "":
+		return errors.New("producer.dead_letter_file must be set if producer.retry_exhausted_policy is dead_letter_file")
+	case p.Producer.RetryExhaustedPolicy == RetryExhaustedSpool && p.Producer.SpoolDir == "":
+		return errors.New("producer.spool_dir must be set if producer.retry_exhausted_policy is spool")
+	case p.Producer.SpoolMaxSize <= 0:
+		return errors.New("producer.spool_max_size must be > 0")
 	}
 	// Validate the Consumer parameters.
 	switch {
 	case p.Consumer.AckTimeout >= p.Consumer.RegistrationTimeout:
 		return errors.New("consumer.ack_timeout must be < consumer.registration_timeout")
+	case p.Consumer.BatchLinger < 0:
+		return errors.New("consumer.batch_linger must be >= 0")
 	case p.Consumer.ChannelBufferSize <= 0:
 		return errors.New("consumer.channel_buffer_size must be > 0")
 	case p.Consumer.FetchMaxBytes <= 0:
 		return errors.New("consumer.fetch_bytes must be > 0")
+	case p.Consumer.FinalOffsetCommitTimeout < 0:
+		return errors.New("consumer.final_offset_commit_timeout must be >= 0")
 	case p.Consumer.LongPollingTimeout <= 0:
 		return errors.New("consumer.long_polling_timeout must be > 0")
+	case p.Consumer.MaxLongPollingTimeout < p.Consumer.LongPollingTimeout:
+		return errors.New("consumer.max_long_polling_timeout must be >= consumer.long_polling_timeout")
 	case p.Consumer.MaxPendingMessages <= 0:
 		return errors.New("consumer.max_pending_messages must be > 0")
+	case p.Consumer.MaxAckWindow < 0:
+		return errors.New("consumer.max_ack_window must be >= 0")
+	case p.Consumer.PrefetchMaxMessages < 0:
+		return errors.New("consumer.prefetch_max_messages must be >= 0")
+	case p.Consumer.MaxQueuedRequests < 0:
+		return errors.New("consumer.max_queued_requests must be >= 0")
+	case p.Consumer.LoadShedding.MaxGroupQueueDepth < 0:
+		return errors.New("consumer.load_shedding.max_group_queue_depth must be >= 0")
+	case p.Consumer.LoadShedding.MaxTopicQueueDepth < 0:
+		return errors.New("consumer.load_shedding.max_topic_queue_depth must be >= 0")
 	case p.Consumer.MaxRetries <= 0:
 		return errors.New("consumer.max_retries must be > 0")
+	case p.Consumer.MemberSessionTimeout < 0:
+		return errors.New("consumer.member_session_timeout must be >= 0")
+	case p.Consumer.NackBackoff < 0:
+		return errors.New("consumer.nack_backoff must be >= 0")
 	case p.Consumer.OffsetsCommitInterval <= 0:
 		return errors.New("consumer.offsets_commit_interval must be > 0")
 	case p.Consumer.RebalanceDelay <= 0:
 		return errors.New("consumer.rebalance_delay must be > 0")
 	case p.Consumer.RegistrationTimeout <= 0:
 		return errors.New("consumer.registration_timeout must be > 0")
+	case p.Consumer.RestartBackoff <= 0:
+		return errors.New("consumer.restart_backoff must be > 0")
 	case p.Consumer.RetryBackoff <= 0:
 		return errors.New("consumer.retry_backoff must be > 0")
+	case p.Consumer.TopicsRefreshInterval <= 0:
+		return errors.New("consumer.topics_refresh_interval must be > 0")
+	}
+	for topic, params := range p.Consumer.Topics {
+		if err := params.validate(p.Consumer.MaxLongPollingTimeout, p.Consumer.AckTimeout); err != nil {
+			return errors.Wrapf(err, "invalid consumer.topics.%s", topic)
+		}
+	}
+	for group, params := range p.Consumer.Groups {
+		if params.FetchMaxBytes != 0 {
+			return errors.Errorf("invalid consumer.groups.%s: fetch_max_bytes cannot be overridden for a group", group)
+		}
+		if params.PrefetchMaxMessages != 0 {
+			return errors.Errorf("invalid consumer.groups.%s: prefetch_max_messages cannot be overridden for a group", group)
+		}
+		if err := params.validate(p.Consumer.MaxLongPollingTimeout, p.Consumer.AckTimeout); err != nil {
+			return errors.Wrapf(err, "invalid consumer.groups.%s", group)
+		}
+	}
+	if p.Consumer.MemberID != "" {
+		memberID, err := expandMemberID(p.Consumer.MemberID, p.ClientID, "group")
+		switch {
+		case err != nil:
+			return errors.Wrap(err, "invalid consumer.member_id")
+		case memberID == "":
+			return errors.New("consumer.member_id must not be empty")
+		case strings.Contains(memberID, "/"):
+			return errors.Errorf("consumer.member_id must not contain '/', %s", memberID)
+		}
+	}
+	if p.Consumer.DeadLetterTopic != "" {
+		dlTopic, err := expandDeadLetterTopic(p.Consumer.DeadLetterTopic, "group", "topic")
+		switch {
+		case err != nil:
+			return errors.Wrap(err, "invalid consumer.dead_letter_topic")
+		case dlTopic == "topic":
+			return errors.New("consumer.dead_letter_topic must differ from the consumed topic")
+		}
+	}
+	// Validate the SchemaRegistry parameters.
+	if p.SchemaRegistry.Timeout <= 0 {
+		return errors.New("schema_registry.timeout must be > 0")
+	}
+	for topic, serialization := range p.SchemaRegistry.Topics {
+		if serialization == SerializationAvro && p.SchemaRegistry.URL == "" {
+			return errors.Errorf("schema_registry.url must be set if avro serialization is used, topic=%s", topic)
+		}
+	}
+	// Validate the Protobuf parameters.
+	for topic, protobufTopic := range p.Protobuf.Topics {
+		if protobufTopic.DescriptorSetFile == "" {
+			return errors.Errorf("protobuf.topics.descriptor_set_file must be set, topic=%s", topic)
+		}
+		if protobufTopic.MessageType == "" {
+			return errors.Errorf("protobuf.topics.message_type must be set, topic=%s", topic)
+		}
+		if p.TopicSerialization(topic) == SerializationAvro {
+			return errors.Errorf("topic cannot have both avro and protobuf serialization, topic=%s", topic)
+		}
+	}
+	// Validate the Transform parameters.
+	for topic, topicTransform := range p.Transform.Topics {
+		for _, path := range []struct {
+			name   string
+			stages []TransformStage
+		}{
+			{"produce", topicTransform.Produce},
+			{"consume", topicTransform.Consume},
+		} {
+			for i, stage := range path.stages {
+				if err := stage.validate(); err != nil {
+					return errors.Wrapf(err, "invalid transform.topics.%s stage, topic=%s, stage=%d", path.name, topic, i)
+				}
+			}
+		}
+	}
+	// Validate the Webhook parameters.
+	switch {
+	case p.Webhook.RetryBackoff <= 0:
+		return errors.New("webhook.retry_backoff must be > 0")
+	case p.Webhook.Timeout <= 0:
+		return errors.New("webhook.timeout must be > 0")
+	case p.Webhook.Timeout >= p.Consumer.AckTimeout:
+		return errors.New("webhook.timeout must be < consumer.ack_timeout")
+	case p.Webhook.ProduceCallbackRetryMax < 0:
+		return errors.New("webhook.produce_callback_retry_max must be >= 0")
+	case p.Webhook.ProduceCallbackQueueSize <= 0:
+		return errors.New("webhook.produce_callback_queue_size must be > 0")
+	case p.Webhook.ProduceCallbackConcurrency <= 0:
+		return errors.New("webhook.produce_callback_concurrency must be > 0")
+	}
+	for i, sub := range p.Webhook.Subscriptions {
+		if err := sub.validate(); err != nil {
+			return errors.Wrapf(err, "invalid webhook.subscriptions, subscription=%d", i)
+		}
+	}
+	for _, callbackURL := range p.Webhook.ProduceCallbackURLs {
+		if err := validateHTTPURL(callbackURL); err != nil {
+			return errors.Wrap(err, "invalid webhook.produce_callback_urls")
+		}
+	}
+	// Validate the Mirror parameters.
+	if p.Mirror.RetryBackoff <= 0 {
+		return errors.New("mirror.retry_backoff must be > 0")
+	}
+	for i, mt := range p.Mirror.Topics {
+		if err := mt.validate(); err != nil {
+			return errors.Wrapf(err, "invalid mirror.topics, topic=%d", i)
+		}
+	}
+	// Validate the Redaction parameters.
+	for _, field := range p.Redaction.Fields {
+		for _, name := range strings.Split(field, ".") {
+			if name == "" {
+				return errors.Errorf("redaction.fields has bad path: %q", field)
+			}
+		}
+	}
+	return nil
+}
+
+func (mt *MirrorTopic) validate() error {
+	switch {
+	case mt.Group == "":
+		return errors.New("group must be set")
+	case mt.Topic == "":
+		return errors.New("topic must be set")
+	case mt.Cluster == "":
+		return errors.New("cluster must be set")
+	case mt.Concurrency < 0:
+		return errors.New("concurrency must be >= 0")
+	}
+	return nil
+}
+
+func (ws *WebhookSubscription) validate() error {
+	switch {
+	case ws.Group == "":
+		return errors.New("group must be set")
+	case ws.Topic == "":
+		return errors.New("topic must be set")
+	case ws.Concurrency < 0:
+		return errors.New("concurrency must be >= 0")
+	}
+	return validateHTTPURL(ws.URL)
+}
+
+func validateHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrap(err, "bad url")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("url must be an absolute http(s) URL, %s", rawURL)
+	}
+	return nil
+}
+
+func (ts *TransformStage) validate() error {
+	switch ts.Type {
+	case TransformRedact:
+		if len(ts.Fields) == 0 {
+			return errors.New("fields must be set")
+		}
+	case TransformRename:
+		if len(ts.Rename) == 0 {
+			return errors.New("rename must be set")
+		}
+	case TransformSet:
+		if len(ts.Set) == 0 {
+			return errors.New("set must be set")
+		}
+	case TransformPlugin:
+		if ts.Plugin == "" {
+			return errors.New("plugin must be set")
+		}
+	default:
+		return errors.New("type must be set")
+	}
+	return nil
+}
+
+// TopicSerialization returns the serialization of message values of the
+// specified topic.
+func (p *Proxy) TopicSerialization(topic string) Serialization {
+	if serialization, ok := p.SchemaRegistry.Topics[topic]; ok {
+		return serialization
+	}
+	return SerializationRaw
+}
+
+// TopicCompression returns the type of compression to use on messages
+// produced to the specified topic.
+func (p *Proxy) TopicCompression(topic string) Compression {
+	if params, ok := p.Producer.Topics[topic]; ok && params.Compression != nil {
+		return *params.Compression
+	}
+	return p.Producer.Compression
+}
+
+// GroupInitialOffset returns the initial offset policy of the specified
+// consumer group.
+func (p *Proxy) GroupInitialOffset(group string) InitialOffset {
+	return p.ConsumerParams(group, "").InitialOffset
+}
+
+// ConsumerParams returns consumer parameters of the specified consumer group
+// and topic, with the overrides configured for them applied. Overrides of the
+// group take precedence over overrides of the topic. Either the group or the
+// topic can be empty, in which case only overrides of the other one apply.
+func (p *Proxy) ConsumerParams(group, topic string) ConsumerParams {
+	params := ConsumerParams{
+		ChannelBufferSize:   p.Consumer.ChannelBufferSize,
+		FetchMaxBytes:       p.Consumer.FetchMaxBytes,
+		InitialOffset:       p.Consumer.InitialOffset,
+		LongPollingTimeout:  p.Consumer.LongPollingTimeout,
+		PrefetchMaxMessages: p.Consumer.PrefetchMaxMessages,
+		RegistrationTimeout: p.Consumer.RegistrationTimeout,
+	}
+	if topic != "" {
+		params.override(p.Consumer.Topics[topic])
+	}
+	if group != "" {
+		if initialOffset, ok := p.Consumer.GroupInitialOffsets[group]; ok {
+			params.InitialOffset = initialOffset
+		}
+		params.override(p.Consumer.Groups[group])
+	}
+	return params
+}
+
+func (cp *ConsumerParams) override(overrides ConsumerParams) {
+	if overrides.ChannelBufferSize != 0 {
+		cp.ChannelBufferSize = overrides.ChannelBufferSize
+	}
+	if overrides.FetchMaxBytes != 0 {
+		cp.FetchMaxBytes = overrides.FetchMaxBytes
+	}
+	if overrides.InitialOffset != "" {
+		cp.InitialOffset = overrides.InitialOffset
+	}
+	if overrides.LongPollingTimeout != 0 {
+		cp.LongPollingTimeout = overrides.LongPollingTimeout
+	}
+	if overrides.PrefetchMaxMessages != 0 {
+		cp.PrefetchMaxMessages = overrides.PrefetchMaxMessages
+	}
+	if overrides.RegistrationTimeout != 0 {
+		cp.RegistrationTimeout = overrides.RegistrationTimeout
+	}
+}
+
+func (cp *ConsumerParams) validate(maxLongPollingTimeout, ackTimeout time.Duration) error {
+	switch {
+	case cp.ChannelBufferSize < 0:
+		return errors.New("channel_buffer_size must be >= 0")
+	case cp.FetchMaxBytes < 0:
+		return errors.New("fetch_max_bytes must be >= 0")
+	case cp.LongPollingTimeout < 0:
+		return errors.New("long_polling_timeout must be >= 0")
+	case cp.LongPollingTimeout > maxLongPollingTimeout:
+		return errors.New("long_polling_timeout must be <= consumer.max_long_polling_timeout")
+	case cp.PrefetchMaxMessages < 0:
+		return errors.New("prefetch_max_messages must be >= 0")
+	case cp.RegistrationTimeout < 0:
+		return errors.New("registration_timeout must be >= 0")
+	case cp.RegistrationTimeout != 0 && cp.RegistrationTimeout <= ackTimeout:
+		return errors.New("registration_timeout must be > consumer.ack_timeout")
 	}
 	return nil
 }
 
+// DeadLetterTopic returns a topic that messages of the specified topic that
+// a consumer group failed to process should be produced to. An empty string
+// is returned if dead lettering is disabled.
+func (p *Proxy) DeadLetterTopic(group, topic string) string {
+	// The template is checked on validation, so an error is not possible.
+	dlTopic, _ := expandDeadLetterTopic(p.Consumer.DeadLetterTopic, group, topic)
+	return dlTopic
+}
+
+// DeadLetterOrigin returns a topic that messages of the specified dead letter
+// topic were consumed from, if it can be derived from the dead letter topic
+// template. That is only possible if the template includes `{topic}` once
+// and does not include `{group}`. Otherwise an empty string is returned.
+func (p *Proxy) DeadLetterOrigin(dlTopic string) string {
+	parts := strings.Split(p.Consumer.DeadLetterTopic, "{topic}")
+	if len(parts) != 2 || strings.Contains(p.Consumer.DeadLetterTopic, "{group}") {
+		return ""
+	}
+	prefix, suffix := parts[0], parts[1]
+	if len(dlTopic) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(dlTopic, prefix) || !strings.HasSuffix(dlTopic, suffix) {
+		return ""
+	}
+	return dlTopic[len(prefix) : len(dlTopic)-len(suffix)]
+}
+
+// expandDeadLetterTopic substitutes placeholders in a dead letter topic
+// template with actual values.
+func expandDeadLetterTopic(template, group, topic string) (string, error) {
+	var err error
+	dlTopic := placeholderRx.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{group}":
+			return group
+		case "{topic}":
+			return topic
+		}
+		err = errors.Errorf("unknown placeholder %s", placeholder)
+		return placeholder
+	})
+	return dlTopic, err
+}
+
+// GroupMemberID returns an ID that the proxy should register with in the
+// specified consumer group.
+func (p *Proxy) GroupMemberID(group string) string {
+	if p.Consumer.MemberID == "" {
+		return p.ClientID
+	}
+	// The template is checked on validation, so an error is not possible.
+	memberID, _ := expandMemberID(p.Consumer.MemberID, p.ClientID, group)
+	return memberID
+}
+
+// expandMemberID substitutes placeholders in a consumer group member ID
+// template with actual values.
+func expandMemberID(template, clientID, group string) (string, error) {
+	var err error
+	memberID := placeholderRx.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch {
+		case name == "client_id":
+			return clientID
+		case name == "group":
+			return group
+		case name == "hostname":
+			hostname, _ := os.Hostname()
+			return hostname
+		case strings.HasPrefix(name, "env."):
+			return os.Getenv(strings.TrimPrefix(name, "env."))
+		}
+		err = errors.Errorf("unknown placeholder %s", placeholder)
+		return placeholder
+	})
+	return memberID, err
+}
+
 func newApp() *App {
 	appCfg := &App{}
 	appCfg.GRPCAddr = "0.0.0.0:19091"
 	appCfg.TCPAddr = "0.0.0.0:19092"
+	appCfg.HTTP.ReadTimeout = 60 * time.Second
+	appCfg.HTTP.WriteTimeout = 60 * time.Second
+	appCfg.HTTP.IdleTimeout = 120 * time.Second
+	appCfg.HTTP.ShutdownTimeout = 30 * time.Second
+	appCfg.HTTP.MaxHeaderBytes = 1 << 20
+	appCfg.HTTP.HTTP2.MaxConcurrentStreams = 250
+	appCfg.HTTP.MaxProduceBodyBytes = 1 << 20
+	appCfg.HTTP.MaxBatchRecords = 1000
+	appCfg.HTTP.BatchProduceWorkers = 32
+	appCfg.HTTP.Idempotency.TTL = time.Hour
+	appCfg.StatsD.Prefix = "kafka_pixy."
+	appCfg.StatsD.Format = StatsDFormatDatadog
+	appCfg.StatsD.FlushInterval = 10 * time.Second
 	appCfg.Proxies = make(map[string]*Proxy)
 	return appCfg
 }
@@ -391,6 +2180,9 @@ func defaultProxyWithClientID(clientID string) *Proxy {
 	c.ZooKeeper.SeedPeers = []string{"localhost:2181"}
 
 	c.Kafka.SeedPeers = []string{"localhost:9092"}
+	c.Kafka.DialTimeout = 30 * time.Second
+	c.Kafka.ReadTimeout = 30 * time.Second
+	c.Kafka.WriteTimeout = 30 * time.Second
 
 	c.Kafka.Version.v = sarama.V0_8_2_2
 	// If a valid Kafka version provided in an environment variable then use it
@@ -405,22 +2197,43 @@ func defaultProxyWithClientID(clientID string) *Proxy {
 	c.Producer.Compression = Compression(sarama.CompressionSnappy)
 	c.Producer.FlushFrequency = 500 * time.Millisecond
 	c.Producer.FlushBytes = 1024 * 1024
+	c.Producer.Partitioner = PartitionerHash
 	c.Producer.RequiredAcks = RequiredAcks(sarama.WaitForAll)
 	c.Producer.RetryBackoff = 10 * time.Second
 	c.Producer.RetryMax = 6
+	c.Producer.RetryExhaustedPolicy = RetryExhaustedDrop
 	c.Producer.ShutdownTimeout = 30 * time.Second
+	c.Producer.ShutdownFlushTimeout = 10 * time.Second
+	c.Producer.SpoolMaxSize = 1024 * 1024 * 1024
 
 	c.Consumer.AckTimeout = 15 * time.Second
+	c.Consumer.AssignmentStrategy = AssignmentRange
+	c.Consumer.BatchLinger = 10 * time.Millisecond
 	c.Consumer.ChannelBufferSize = 64
 	c.Consumer.FetchMaxBytes = 1024 * 1024
 	c.Consumer.FetchMaxWait = 250 * time.Millisecond
+	c.Consumer.FinalOffsetCommitTimeout = 10 * time.Second
+	c.Consumer.InitialOffset = InitialOffsetLatest
 	c.Consumer.LongPollingTimeout = 3 * time.Second
+	c.Consumer.MaxLongPollingTimeout = 30 * time.Second
 	c.Consumer.MaxPendingMessages = 300
+	c.Consumer.MaxQueuedRequests = 256
 	c.Consumer.MaxRetries = 3
+	c.Consumer.MuxPolicy = MuxLag
 	c.Consumer.OffsetsCommitInterval = 500 * time.Millisecond
 	c.Consumer.RebalanceDelay = 250 * time.Millisecond
 	c.Consumer.RegistrationTimeout = 20 * time.Second
+	c.Consumer.RestartBackoff = 3 * time.Second
 	c.Consumer.RetryBackoff = 500 * time.Millisecond
+	c.Consumer.TopicsRefreshInterval = 30 * time.Second
+
+	c.SchemaRegistry.Timeout = 5 * time.Second
+	c.Webhook.RetryBackoff = time.Second
+	c.Webhook.Timeout = 10 * time.Second
+	c.Webhook.ProduceCallbackRetryMax = 3
+	c.Webhook.ProduceCallbackQueueSize = 4096
+	c.Webhook.ProduceCallbackConcurrency = 4
+	c.Mirror.RetryBackoff = time.Second
 	return c
 }
 
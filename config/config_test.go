@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 	"time"
 
@@ -76,9 +77,8 @@ func (s *ConfigSuite) TestFromYAMLInvalid(c *C) {
 	_, err := FromYAML(data)
 
 	// Then
-	c.Assert(err.Error(), Equals, "failed to parse proxy config, cluster=default: "+
-		"yaml: unmarshal errors:\n"+
-		"  line 7: cannot unmarshal !!str `Kaboom!` into time.Duration")
+	c.Assert(err.Error(), Equals, "failed to parse config: "+
+		"bad duration, proxies.default.consumer.long_polling_timeout: Kaboom!")
 }
 
 // The first proxy mentioned is returned as default.
@@ -116,3 +116,2042 @@ func (s *ConfigSuite) TestFromYAMLFile(c *C) {
 	appCfg.Proxies["default"].ClientID = "ID"
 	c.Assert(appCfg, DeepEquals, expected)
 }
+
+func (s *ConfigSuite) TestRetryExhaustedPolicy(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    producer:\n" +
+		"      retry_exhausted_policy: dead_letter_file\n" +
+		"      dead_letter_file: /tmp/dead-letters.log\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Producer.RetryExhaustedPolicy, Equals, RetryExhaustedDeadLetterFile)
+	c.Assert(appCfg.Proxies["foo"].Producer.DeadLetterFile, Equals, "/tmp/dead-letters.log")
+}
+
+func (s *ConfigSuite) TestRetryExhaustedPolicyInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      retry_exhausted_policy: bogus\n",
+		err: "failed to parse proxy config, cluster=foo: " +
+			"bad retry exhausted policy, bogus",
+	}, {
+		yaml: "      retry_exhausted_policy: dead_letter_file\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"producer.dead_letter_file must be set if producer.retry_exhausted_policy is dead_letter_file",
+	}, {
+		yaml: "      retry_exhausted_policy: spool\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"producer.spool_dir must be set if producer.retry_exhausted_policy is spool",
+	}, {
+		yaml: "      spool_max_size: 0\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"producer.spool_max_size must be > 0",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    producer:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestPartitioner(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    producer:\n" +
+		"      partitioner: murmur2\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Producer.Partitioner, Equals, PartitionerMurmur2)
+}
+
+func (s *ConfigSuite) TestPartitionerInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    producer:\n" +
+		"      partitioner: bogus\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "failed to parse proxy config, cluster=foo: bad partitioner, bogus")
+}
+
+func (s *ConfigSuite) TestSchemaRegistry(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    schema_registry:\n" +
+		"      url: http://localhost:8081\n" +
+		"      topics:\n" +
+		"        bar: avro\n" +
+		"        bazz: raw\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+	c.Assert(proxyCfg.SchemaRegistry.URL, Equals, "http://localhost:8081")
+	c.Assert(proxyCfg.TopicSerialization("bar"), Equals, SerializationAvro)
+	c.Assert(proxyCfg.TopicSerialization("bazz"), Equals, SerializationRaw)
+	c.Assert(proxyCfg.TopicSerialization("blah"), Equals, SerializationRaw)
+}
+
+func (s *ConfigSuite) TestSchemaRegistryInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      topics:\n" +
+			"        bar: json\n",
+		err: "failed to parse proxy config, cluster=foo: " +
+			"bad serialization, json",
+	}, {
+		yaml: "      topics:\n" +
+			"        bar: avro\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"schema_registry.url must be set if avro serialization is used, topic=bar",
+	}, {
+		yaml: "      timeout: 0s\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"schema_registry.timeout must be > 0",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    schema_registry:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestProtobuf(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    protobuf:\n" +
+		"      topics:\n" +
+		"        bar:\n" +
+		"          descriptor_set_file: /tmp/bar.desc\n" +
+		"          message_type: acme.Bar\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Protobuf.Topics, DeepEquals, map[string]ProtobufTopic{
+		"bar": {DescriptorSetFile: "/tmp/bar.desc", MessageType: "acme.Bar"},
+	})
+}
+
+func (s *ConfigSuite) TestProtobufInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "    protobuf:\n" +
+			"      topics:\n" +
+			"        bar:\n" +
+			"          message_type: acme.Bar\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"protobuf.topics.descriptor_set_file must be set, topic=bar",
+	}, {
+		yaml: "    protobuf:\n" +
+			"      topics:\n" +
+			"        bar:\n" +
+			"          descriptor_set_file: /tmp/bar.desc\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"protobuf.topics.message_type must be set, topic=bar",
+	}, {
+		yaml: "    schema_registry:\n" +
+			"      url: http://localhost:8081\n" +
+			"      topics:\n" +
+			"        bar: avro\n" +
+			"    protobuf:\n" +
+			"      topics:\n" +
+			"        bar:\n" +
+			"          descriptor_set_file: /tmp/bar.desc\n" +
+			"          message_type: acme.Bar\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"topic cannot have both avro and protobuf serialization, topic=bar",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestTransform(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    transform:\n" +
+		"      topics:\n" +
+		"        bar:\n" +
+		"          produce:\n" +
+		"            - type: redact\n" +
+		"              fields: [a, b.c]\n" +
+		"            - type: set\n" +
+		"              set:\n" +
+		"                d: e\n" +
+		"          consume:\n" +
+		"            - type: plugin\n" +
+		"              plugin: /tmp/bar.so\n" +
+		"              params:\n" +
+		"                f: g\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Transform.Topics, DeepEquals, map[string]TopicTransform{
+		"bar": {
+			Produce: []TransformStage{
+				{Type: TransformRedact, Fields: []string{"a", "b.c"}},
+				{Type: TransformSet, Set: map[string]string{"d": "e"}},
+			},
+			Consume: []TransformStage{
+				{Type: TransformPlugin, Plugin: "/tmp/bar.so", Params: map[string]string{"f": "g"}},
+			},
+		},
+	})
+}
+
+func (s *ConfigSuite) TestTransformInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "          produce:\n" +
+			"            - type: uppercase\n",
+		err: "failed to parse proxy config, cluster=foo: " +
+			"bad transform type, uppercase",
+	}, {
+		yaml: "          produce:\n" +
+			"            - fields: [a]\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid transform.topics.produce stage, topic=bar, stage=0: type must be set",
+	}, {
+		yaml: "          produce:\n" +
+			"            - type: redact\n" +
+			"              fields: [a]\n" +
+			"            - type: redact\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid transform.topics.produce stage, topic=bar, stage=1: fields must be set",
+	}, {
+		yaml: "          consume:\n" +
+			"            - type: rename\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid transform.topics.consume stage, topic=bar, stage=0: rename must be set",
+	}, {
+		yaml: "          consume:\n" +
+			"            - type: set\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid transform.topics.consume stage, topic=bar, stage=0: set must be set",
+	}, {
+		yaml: "          consume:\n" +
+			"            - type: plugin\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid transform.topics.consume stage, topic=bar, stage=0: plugin must be set",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    transform:\n" +
+			"      topics:\n" +
+			"        bar:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestWebhook(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    webhook:\n" +
+		"      timeout: 5s\n" +
+		"      subscriptions:\n" +
+		"        - group: bar\n" +
+		"          topic: bazz\n" +
+		"          url: http://localhost:8080/events\n" +
+		"          concurrency: 4\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+	c.Assert(proxyCfg.Webhook.RetryBackoff, Equals, time.Second)
+	c.Assert(proxyCfg.Webhook.Timeout, Equals, 5*time.Second)
+	c.Assert(proxyCfg.Webhook.Subscriptions, DeepEquals, []WebhookSubscription{
+		{Group: "bar", Topic: "bazz", URL: "http://localhost:8080/events", Concurrency: 4},
+	})
+}
+
+func (s *ConfigSuite) TestWebhookInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      retry_backoff: 0s\n",
+		err:  "webhook.retry_backoff must be > 0",
+	}, {
+		yaml: "      timeout: 0s\n",
+		err:  "webhook.timeout must be > 0",
+	}, {
+		yaml: "      timeout: 15s\n",
+		err:  "webhook.timeout must be < consumer.ack_timeout",
+	}, {
+		yaml: "      subscriptions:\n" +
+			"        - topic: bazz\n" +
+			"          url: http://localhost/events\n",
+		err: "invalid webhook.subscriptions, subscription=0: group must be set",
+	}, {
+		yaml: "      subscriptions:\n" +
+			"        - group: bar\n" +
+			"          url: http://localhost/events\n",
+		err: "invalid webhook.subscriptions, subscription=0: topic must be set",
+	}, {
+		yaml: "      subscriptions:\n" +
+			"        - group: bar\n" +
+			"          topic: bazz\n" +
+			"          url: http://localhost/events\n" +
+			"          concurrency: -1\n",
+		err: "invalid webhook.subscriptions, subscription=0: concurrency must be >= 0",
+	}, {
+		yaml: "      subscriptions:\n" +
+			"        - group: bar\n" +
+			"          topic: bazz\n" +
+			"          url: http://localhost/events\n" +
+			"        - group: bar\n" +
+			"          topic: bazz\n" +
+			"          url: localhost/events\n",
+		err: "invalid webhook.subscriptions, subscription=1: url must be an absolute http(s) URL, localhost/events",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    webhook:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: "+tc.err,
+			Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestMirror(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    mirror:\n" +
+		"      topics:\n" +
+		"        - group: mirror\n" +
+		"          topic: bazz\n" +
+		"          cluster: bar\n" +
+		"          target_topic: blah\n" +
+		"          concurrency: 4\n" +
+		"  bar:\n" +
+		"    kafka:\n" +
+		"      seed_peers:\n" +
+		"        - localhost:9093\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+	c.Assert(proxyCfg.Mirror.RetryBackoff, Equals, time.Second)
+	c.Assert(proxyCfg.Mirror.Topics, DeepEquals, []MirrorTopic{
+		{Group: "mirror", Topic: "bazz", Cluster: "bar", TargetTopic: "blah", Concurrency: 4},
+	})
+}
+
+func (s *ConfigSuite) TestRedaction(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    redaction:\n" +
+		"      fields: [user.email, \"items.*.ssn\"]\n" +
+		"      redact_non_json: true\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+	c.Assert(proxyCfg.Redaction.Fields, DeepEquals, []string{"user.email", "items.*.ssn"})
+	c.Assert(proxyCfg.Redaction.RedactNonJSON, Equals, true)
+
+	// When
+	_, err = FromYAML([]byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    redaction:\n" +
+		"      fields: [user..email]\n"))
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: redaction.fields has bad path: \"user..email\"")
+}
+
+func (s *ConfigSuite) TestMirrorInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      retry_backoff: 0s\n",
+		err:  "mirror.retry_backoff must be > 0",
+	}, {
+		yaml: "      topics:\n" +
+			"        - topic: bazz\n" +
+			"          cluster: foo\n",
+		err: "invalid mirror.topics, topic=0: group must be set",
+	}, {
+		yaml: "      topics:\n" +
+			"        - group: mirror\n" +
+			"          cluster: foo\n",
+		err: "invalid mirror.topics, topic=0: topic must be set",
+	}, {
+		yaml: "      topics:\n" +
+			"        - group: mirror\n" +
+			"          topic: bazz\n",
+		err: "invalid mirror.topics, topic=0: cluster must be set",
+	}, {
+		yaml: "      topics:\n" +
+			"        - group: mirror\n" +
+			"          topic: bazz\n" +
+			"          cluster: bar\n" +
+			"          concurrency: -1\n",
+		err: "invalid mirror.topics, topic=0: concurrency must be >= 0",
+	}, {
+		yaml: "      topics:\n" +
+			"        - group: mirror\n" +
+			"          topic: bazz\n" +
+			"          cluster: bar\n",
+		err: "invalid mirror.topics, topic=0: unknown cluster, bar",
+	}, {
+		yaml: "      topics:\n" +
+			"        - group: mirror\n" +
+			"          topic: bazz\n" +
+			"          cluster: foo\n" +
+			"          target_topic: bazz\n",
+		err: "invalid mirror.topics, topic=0: cannot mirror a topic to itself",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    mirror:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: "+tc.err,
+			Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestHTTPServer(c *C) {
+	data := []byte("" +
+		"tcp_addr: 127.0.0.1:8080\n" +
+		"http:\n" +
+		"  read_timeout: 5s\n" +
+		"  max_header_bytes: 4096\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.TCPAddr, Equals, "127.0.0.1:8080")
+	c.Assert(appCfg.HTTP.ReadTimeout, Equals, 5*time.Second)
+	c.Assert(appCfg.HTTP.WriteTimeout, Equals, 60*time.Second)
+	c.Assert(appCfg.HTTP.IdleTimeout, Equals, 120*time.Second)
+	c.Assert(appCfg.HTTP.ShutdownTimeout, Equals, 30*time.Second)
+	c.Assert(appCfg.HTTP.MaxHeaderBytes, Equals, 4096)
+}
+
+func (s *ConfigSuite) TestHTTP2(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  read_header_timeout: 3s\n" +
+		"  http2:\n" +
+		"    enabled: true\n" +
+		"    max_concurrent_streams: 1000\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.HTTP.ReadHeaderTimeout, Equals, 3*time.Second)
+	c.Assert(appCfg.HTTP.HTTP2, DeepEquals, HTTP2{Enabled: true, MaxConcurrentStreams: 1000})
+}
+
+func (s *ConfigSuite) TestHTTP2Invalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "  read_header_timeout: -1s\n",
+		err:  "http.read_header_timeout must be >= 0",
+	}, {
+		yaml: "  shutdown_timeout: -1s\n",
+		err:  "http.shutdown_timeout must be >= 0",
+	}, {
+		yaml: "  http2:\n    enabled: true\n    max_concurrent_streams: 0\n",
+		err:  "http.http2.max_concurrent_streams must be > 0",
+	}} {
+		data := []byte("" +
+			"http:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestHTTPRateLimit(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  rate_limit:\n" +
+		"    global: {rate: 1000, burst: 2000}\n" +
+		"    per_client: {rate: 10}\n" +
+		"    topics:\n" +
+		"      foo: {rate: 0.5, burst: 1}\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.HTTP.RateLimit, DeepEquals, HTTPRateLimit{
+		Global:    RateLimit{Rate: 1000, Burst: 2000},
+		PerClient: RateLimit{Rate: 10},
+		Topics:    map[string]RateLimit{"foo": {Rate: 0.5, Burst: 1}},
+	})
+	c.Assert(appCfg.HTTP.RateLimit.Enabled(), Equals, true)
+}
+
+func (s *ConfigSuite) TestHTTPRateLimitInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "    global: {rate: -1}\n",
+		err:  "invalid http.rate_limit.global: rate must be >= 0",
+	}, {
+		yaml: "    per_topic: {rate: 1, burst: -1}\n",
+		err:  "invalid http.rate_limit.per_topic: burst must be >= 0",
+	}, {
+		yaml: "    topics:\n" +
+			"      foo: {rate: -2}\n",
+		err: "invalid http.rate_limit.topics.foo: rate must be >= 0",
+	}} {
+		data := []byte("" +
+			"http:\n" +
+			"  rate_limit:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestHTTPConcurrency(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  concurrency:\n" +
+		"    max_produce: 100\n" +
+		"    max_consume: 500\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.HTTP.Concurrency, DeepEquals, HTTPConcurrency{MaxProduce: 100, MaxConsume: 500})
+}
+
+func (s *ConfigSuite) TestHTTPConcurrencyInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "    max_produce: -1\n",
+		err:  "http.concurrency.max_produce must be >= 0",
+	}, {
+		yaml: "    max_consume: -1\n",
+		err:  "http.concurrency.max_consume must be >= 0",
+	}} {
+		data := []byte("" +
+			"http:\n" +
+			"  concurrency:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestHTTPIdempotencyInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "    max_keys: -1\n",
+		err:  "http.idempotency.max_keys must be >= 0",
+	}, {
+		yaml: "    ttl: 0s\n",
+		err:  "http.idempotency.ttl must be > 0",
+	}} {
+		data := []byte("" +
+			"http:\n" +
+			"  idempotency:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestStatsD(c *C) {
+	data := []byte("" +
+		"statsd:\n" +
+		"  addr: 127.0.0.1:8125\n" +
+		"  tags: [\"env:prod\", \"dc:east\"]\n" +
+		"  format: plain\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.StatsD, DeepEquals, StatsD{
+		Addr:          "127.0.0.1:8125",
+		Prefix:        "kafka_pixy.",
+		Tags:          []string{"env:prod", "dc:east"},
+		Format:        StatsDFormatPlain,
+		FlushInterval: 10 * time.Second,
+	})
+}
+
+func (s *ConfigSuite) TestStatsDInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "  format: graphite\n",
+		err:  "failed to parse config: bad statsd format, graphite",
+	}, {
+		yaml: "  addr: 127.0.0.1:8125\n" +
+			"  flush_interval: 0s\n",
+		err: "invalid config parameter: statsd.flush_interval must be > 0",
+	}} {
+		data := []byte("" +
+			"statsd:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+// Parameters that do not correspond to any config field are rejected, and
+// the error names the offending parameter by its full path.
+func (s *ConfigSuite) TestUnknownParams(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "tcp_adr: 127.0.0.1:19092\n",
+		err:  "failed to parse config: unknown parameter, tcp_adr",
+	}, {
+		yaml: "http:\n" +
+			"  rate_limit:\n" +
+			"    topics:\n" +
+			"      foo:\n" +
+			"        rps: 10\n",
+		err: "failed to parse config: unknown parameter, http.rate_limit.topics.foo.rps",
+	}, {
+		yaml: "listeners:\n" +
+			"  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      jwt:\n" +
+			"        secret: bar\n",
+		err: "failed to parse config: unknown parameter, listeners[0].auth.jwt.secret",
+	}, {
+		yaml: "proxies:\n" +
+			"  foo:\n" +
+			"    kafka:\n" +
+			"      seed_peerz: [\"localhost:9092\"]\n",
+		err: "failed to parse config: unknown parameter, proxies.foo.kafka.seed_peerz",
+	}} {
+		// When
+		_, err := FromYAML([]byte(tc.yaml))
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+// Durations that cannot be parsed are rejected, and the error names the
+// offending parameter by its full path.
+func (s *ConfigSuite) TestBadDuration(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      long_polling_timeout: 5x\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "failed to parse config: "+
+		"bad duration, proxies.foo.consumer.long_polling_timeout: 5x")
+}
+
+// Environment variables override parameters of the config file.
+func (s *ConfigSuite) TestOverrideFromEnv(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  write_timeout: 40s\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    kafka:\n" +
+		"      seed_peers: [\"kafka1:9092\"]\n" +
+		"  bar-baz:\n" +
+		"    producer:\n" +
+		"      retry_max: 3\n")
+	appCfg, err := FromYAML(data)
+	c.Assert(err, IsNil)
+
+	// When
+	err = appCfg.OverrideFromEnv([]string{
+		"PATH=/usr/bin",
+		"KAFKA_PIXY_TCP_ADDR=0.0.0.0:29092",
+		"KAFKA_PIXY_HTTP_WRITE_TIMEOUT=50s",
+		"KAFKA_PIXY_HTTP_RATE_LIMIT_GLOBAL_RATE=100.5",
+		"KAFKA_PIXY_HTTP_PPROF=true",
+		"KAFKA_PIXY_PROXY_KAFKA_SEED_PEERS=kafka2:9092, kafka3:9092",
+		"KAFKA_PIXY_PROXY_PRODUCER_RETRY_MAX=5",
+		"KAFKA_PIXY_PROXIES_FOO_PRODUCER_RETRY_MAX=7",
+		"KAFKA_PIXY_PROXIES_BAR_BAZ_PRODUCER_PARTITIONER=murmur2",
+		"KAFKA_PIXY_PROXIES_BAR_BAZ_ZOO_KEEPER_SEED_PEERS=[\"zk1:2181\"]",
+	})
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.TCPAddr, Equals, "0.0.0.0:29092")
+	c.Assert(appCfg.HTTP.WriteTimeout, Equals, 50*time.Second)
+	c.Assert(appCfg.HTTP.RateLimit.Global.Rate, Equals, 100.5)
+	c.Assert(appCfg.HTTP.Pprof, Equals, true)
+	c.Assert(appCfg.Proxies["foo"].Kafka.SeedPeers, DeepEquals, []string{"kafka2:9092", "kafka3:9092"})
+	c.Assert(appCfg.Proxies["foo"].Producer.RetryMax, Equals, 7)
+	c.Assert(appCfg.Proxies["bar-baz"].Producer.RetryMax, Equals, 3)
+	c.Assert(appCfg.Proxies["bar-baz"].Producer.Partitioner, Equals, PartitionerMurmur2)
+	c.Assert(appCfg.Proxies["bar-baz"].ZooKeeper.SeedPeers, DeepEquals, []string{"zk1:2181"})
+}
+
+func (s *ConfigSuite) TestOverrideFromEnvInvalid(c *C) {
+	for i, tc := range []struct {
+		env string
+		err string
+	}{{
+		env: "KAFKA_PIXY_TCP_ADR=0.0.0.0:29092",
+		err: "unknown environment variable, KAFKA_PIXY_TCP_ADR",
+	}, {
+		env: "KAFKA_PIXY_PROXIES_BAR_KAFKA_SEED_PEERS=kafka1:9092",
+		err: "unknown environment variable, KAFKA_PIXY_PROXIES_BAR_KAFKA_SEED_PEERS",
+	}, {
+		env: "KAFKA_PIXY_HTTP_WRITE_TIMEOUT=5x",
+		err: "bad environment variable, KAFKA_PIXY_HTTP_WRITE_TIMEOUT: " +
+			"yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `5x` into time.Duration",
+	}, {
+		env: "KAFKA_PIXY_PROXY_PRODUCER_PARTITIONER=foo",
+		err: "bad environment variable, KAFKA_PIXY_PROXY_PRODUCER_PARTITIONER: bad partitioner, foo",
+	}, {
+		env: "KAFKA_PIXY_HTTP_READ_TIMEOUT=-1s",
+		err: "invalid config parameter: http.read_timeout must be >= 0",
+	}} {
+		appCfg := DefaultApp("foo")
+
+		// When
+		err := appCfg.OverrideFromEnv([]string{tc.env})
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+// Write timeout must be long enough for long polling requests to complete.
+func (s *ConfigSuite) TestHTTPWriteTimeoutInvalid(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  write_timeout: 5s\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      long_polling_timeout: 5s\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: "+
+		"http.write_timeout must be > consumer.long_polling_timeout, cluster=foo")
+}
+
+func (s *ConfigSuite) TestMaxLongPollingTimeoutInvalid(c *C) {
+	for i, tc := range []struct {
+		cfg string
+		err string
+	}{{
+		cfg: "" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" +
+			"      long_polling_timeout: 5s\n" +
+			"      max_long_polling_timeout: 4s\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"consumer.max_long_polling_timeout must be >= consumer.long_polling_timeout",
+	}, {
+		cfg: "" +
+			"http:\n" +
+			"  write_timeout: 20s\n" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" +
+			"      max_long_polling_timeout: 20s\n",
+		err: "invalid config parameter: " +
+			"http.write_timeout must be > consumer.max_long_polling_timeout, cluster=foo",
+	}} {
+		// When
+		_, err := FromYAML([]byte(tc.cfg))
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestListeners(c *C) {
+	data := []byte("" +
+		"unix_addr: /tmp/kafka-pixy.sock\n" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    tls:\n" +
+		"      cert_file: server.crt\n" +
+		"      key_file: server.key\n" +
+		"    auth:\n" +
+		"      tokens: [foo, bar]\n" +
+		"      keys:\n" +
+		"        - key: bazz\n" +
+		"          topics: [\"orders.*\"]\n" +
+		"          groups: [billing]\n" +
+		"      jwt:\n" +
+		"        hs256_secret: s3cr3t\n" +
+		"        issuer: issuer\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	listeners := appCfg.HTTPListeners()
+	c.Assert(len(listeners), Equals, 3)
+	c.Assert(listeners[0].Addr, Equals, "0.0.0.0:19092")
+	c.Assert(listeners[0].API, Equals, ListenerAPIAll)
+	c.Assert(listeners[1].Addr, Equals, "/tmp/kafka-pixy.sock")
+	c.Assert(listeners[1].API, Equals, ListenerAPIAll)
+	c.Assert(listeners[2].Addr, Equals, "127.0.0.1:19093")
+	c.Assert(listeners[2].API, Equals, ListenerAPIAll)
+	c.Assert(listeners[2].TLS.CertFile, Equals, "server.crt")
+	c.Assert(listeners[2].TLS.KeyFile, Equals, "server.key")
+	c.Assert(listeners[2].Auth.Tokens, DeepEquals, []string{"foo", "bar"})
+	c.Assert(listeners[2].Auth.Keys, DeepEquals, []APIKey{
+		{Key: "bazz", Topics: []string{"orders.*"}, Groups: []string{"billing"}},
+	})
+	c.Assert(listeners[2].Auth.JWT.HS256Secret, Equals, "s3cr3t")
+	c.Assert(listeners[2].Auth.JWT.Issuer, Equals, "issuer")
+	c.Assert(listeners[2].Auth.Enabled(), Equals, true)
+	c.Assert(listeners[0].Auth.Enabled(), Equals, false)
+}
+
+func (s *ConfigSuite) TestListenerACL(c *C) {
+	data := []byte("" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    auth:\n" +
+		"      keys:\n" +
+		"        - key: bazz\n" +
+		"          name: billing\n" +
+		"      acl:\n" +
+		"        - principals: [billing]\n" +
+		"          operations: [produce, consume]\n" +
+		"          topics: [\"billing.*\"]\n" +
+		"      audit_log: /var/log/kafka-pixy/audit.log\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	auth := appCfg.Listeners[0].Auth
+	c.Assert(auth.Keys, DeepEquals, []APIKey{{Key: "bazz", Name: "billing"}})
+	c.Assert(auth.ACL, DeepEquals, []ACLRule{{
+		Principals: []string{"billing"},
+		Operations: []ACLOperation{ACLProduce, ACLConsume},
+		Topics:     []string{"billing.*"},
+	}})
+	c.Assert(auth.AuditLog, Equals, "/var/log/kafka-pixy/audit.log")
+
+	// An unknown operation is rejected.
+	_, err = FromYAML([]byte("" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    auth:\n" +
+		"      tokens: [foo]\n" +
+		"      acl:\n" +
+		"        - principals: [\"*\"]\n" +
+		"          operations: [delete]\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n"))
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "failed to parse config: bad acl operation, delete")
+}
+
+func (s *ConfigSuite) TestListenersInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "  - tls:\n" +
+			"      cert_file: server.crt\n",
+		err: "addr must be set",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    tls:\n" +
+			"      cert_file: server.crt\n",
+		err: "tls.cert_file and tls.key_file must be set together",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    tls:\n" +
+			"      client_ca_file: ca.crt\n",
+		err: "tls.client_ca_file requires tls.cert_file and tls.key_file",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      keys:\n" +
+			"        - topics: [foo]\n",
+		err: "auth.keys[0].key must be set",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      keys:\n" +
+			"        - key: bar\n" +
+			"          groups: [\"foo[\"]\n",
+		err: "auth.keys[0] has bad pattern: foo[",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      jwt:\n" +
+			"        hs256_secret: foo\n" +
+			"        rs256_public_key_file: jwt.pem\n",
+		err: "auth.jwt.hs256_secret and auth.jwt.rs256_public_key_file cannot be used together",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      jwt:\n" +
+			"        issuer: foo\n",
+		err: "auth.jwt.issuer and auth.jwt.audience require a JWT signature key",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      audit_log: audit.log\n",
+		err: "auth.acl and auth.audit_log require tokens, keys or JWT validation",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      tokens: [foo]\n" +
+			"      acl:\n" +
+			"        - operations: [admin]\n",
+		err: "auth.acl[0].principals must be set",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      tokens: [foo]\n" +
+			"      acl:\n" +
+			"        - principals: [\"*\"]\n",
+		err: "auth.acl[0].operations must be set",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      tokens: [foo]\n" +
+			"      acl:\n" +
+			"        - principals: [\"*\"]\n" +
+			"          operations: [admin]\n" +
+			"          topics: [\"foo[\"]\n",
+		err: "auth.acl[0] has bad pattern: foo[",
+	}, {
+		yaml: "  - addr: /tmp/kafka-pixy.sock\n" +
+			"    auth:\n" +
+			"      peers:\n" +
+			"        - topics: [foo]\n",
+		err: "auth.peers[0].user must be set",
+	}, {
+		yaml: "  - addr: /tmp/kafka-pixy.sock\n" +
+			"    auth:\n" +
+			"      peers:\n" +
+			"        - user: app\n" +
+			"          groups: [\"foo[\"]\n",
+		err: "auth.peers[0] has bad pattern: foo[",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      peers:\n" +
+			"        - user: app\n",
+		err: "auth.peers and socket require a unix domain socket address",
+	}, {
+		yaml: "  - addr: 127.0.0.1:19093\n" +
+			"    socket:\n" +
+			"      mode: \"0660\"\n",
+		err: "auth.peers and socket require a unix domain socket address",
+	}, {
+		yaml: "  - addr: /tmp/kafka-pixy.sock\n" +
+			"    socket:\n" +
+			"      mode: \"0999\"\n",
+		err: "bad socket mode, 0999",
+	}} {
+		data := []byte("" +
+			"listeners:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: invalid listener config, #0: "+tc.err,
+			Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestHTTPAudit(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  audit:\n" +
+		"    file: /var/log/kafka-pixy/admin.log\n" +
+		"    topic: __audit\n" +
+		"    cluster: bar\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n" +
+		"  bar:\n" +
+		"    client_id: bar_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.HTTP.Audit, DeepEquals, HTTPAudit{
+		File:    "/var/log/kafka-pixy/admin.log",
+		Topic:   "__audit",
+		Cluster: "bar",
+	})
+}
+
+func (s *ConfigSuite) TestHTTPAuditInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "    cluster: foo\n",
+		err:  "http.audit.cluster requires http.audit.topic",
+	}, {
+		yaml: "    topic: __audit\n" +
+			"    cluster: bar\n",
+		err: "http.audit.cluster is not configured, bar",
+	}} {
+		data := []byte("" +
+			"http:\n" +
+			"  audit:\n" + tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestTenants(c *C) {
+	data := []byte("" +
+		"http:\n" +
+		"  tenants:\n" +
+		"    billing:\n" +
+		"      topic_prefixes: [billing., invoices.]\n" +
+		"      group_prefixes: [billing.]\n" +
+		"      bytes_per_second: 1048576\n" +
+		"      max_long_polls: 10\n" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    auth:\n" +
+		"      keys:\n" +
+		"        - key: bazz\n" +
+		"          tenant: billing\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.HTTP.Tenants, DeepEquals, map[string]Tenant{
+		"billing": {
+			TopicPrefixes:  []string{"billing.", "invoices."},
+			GroupPrefixes:  []string{"billing."},
+			BytesPerSecond: 1048576,
+			MaxLongPolls:   10,
+		},
+	})
+	c.Assert(appCfg.Listeners[0].Auth.Keys, DeepEquals, []APIKey{{Key: "bazz", Tenant: "billing"}})
+}
+
+func (s *ConfigSuite) TestTenantsInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing:\n" +
+			"      topic_prefixes: [\"billing.*\"]\n",
+		err: "invalid http.tenants.billing: bad prefix: \"billing.*\"",
+	}, {
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing:\n" +
+			"      group_prefixes: [\"\"]\n",
+		err: "invalid http.tenants.billing: bad prefix: \"\"",
+	}, {
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing:\n" +
+			"      bytes_per_second: -1\n",
+		err: "invalid http.tenants.billing: bytes_per_second must be >= 0",
+	}, {
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing:\n" +
+			"      max_long_polls: -1\n",
+		err: "invalid http.tenants.billing: max_long_polls must be >= 0",
+	}, {
+		yaml: "listeners:\n" +
+			"  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      keys:\n" +
+			"        - key: bazz\n" +
+			"          tenant: billing\n",
+		err: "invalid listener config, #0: auth.keys[0] refers to unknown tenant, billing",
+	}, {
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing: {}\n" +
+			"listeners:\n" +
+			"  - addr: 127.0.0.1:19093\n" +
+			"    auth:\n" +
+			"      keys:\n" +
+			"        - key: bazz\n" +
+			"          topics: [foo]\n" +
+			"          tenant: billing\n",
+		err: "invalid listener config, #0: auth.keys[0] cannot have topics or groups along with a tenant",
+	}, {
+		yaml: "listeners:\n" +
+			"  - addr: /tmp/kafka-pixy.sock\n" +
+			"    auth:\n" +
+			"      peers:\n" +
+			"        - user: root\n" +
+			"          tenant: billing\n",
+		err: "invalid listener config, #0: auth.peers[0] refers to unknown tenant, billing",
+	}, {
+		yaml: "http:\n" +
+			"  tenants:\n" +
+			"    billing: {}\n" +
+			"listeners:\n" +
+			"  - addr: /tmp/kafka-pixy.sock\n" +
+			"    auth:\n" +
+			"      peers:\n" +
+			"        - user: root\n" +
+			"          groups: [foo]\n" +
+			"          tenant: billing\n",
+		err: "invalid listener config, #0: auth.peers[0] cannot have topics or groups along with a tenant",
+	}} {
+		data := []byte(tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: "+tc.err, Commentf("case #%d", i))
+	}
+}
+
+// The TCP listener can be configured with TLS.
+func (s *ConfigSuite) TestTCPListenerTLS(c *C) {
+	data := []byte("" +
+		"tls:\n" +
+		"  cert_file: server.crt\n" +
+		"  key_file: server.key\n" +
+		"  client_ca_file: ca.crt\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	listeners := appCfg.HTTPListeners()
+	c.Assert(len(listeners), Equals, 1)
+	c.Assert(listeners[0].Addr, Equals, "0.0.0.0:19092")
+	c.Assert(listeners[0].TLS, DeepEquals, ListenerTLS{
+		CertFile:     "server.crt",
+		KeyFile:      "server.key",
+		ClientCAFile: "ca.crt",
+	})
+}
+
+func (s *ConfigSuite) TestTCPListenerTLSInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "tls:\n" +
+			"  key_file: server.key\n",
+		err: "tls.cert_file and tls.key_file must be set together",
+	}, {
+		yaml: "tls:\n" +
+			"  client_ca_file: ca.crt\n",
+		err: "tls.client_ca_file requires tls.cert_file and tls.key_file",
+	}, {
+		yaml: "tcp_addr: \"\"\n" +
+			"tls:\n" +
+			"  cert_file: server.crt\n" +
+			"  key_file: server.key\n",
+		err: "addr must be set",
+	}} {
+		data := []byte(tc.yaml +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    client_id: foo_id\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, "invalid config parameter: invalid tcp_addr listener config: "+tc.err,
+			Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestUnixSocket(c *C) {
+	data := []byte("" +
+		"unix_addr: /tmp/kafka-pixy.sock\n" +
+		"unix_socket:\n" +
+		"  mode: \"0660\"\n" +
+		"  group: kafka-pixy\n" +
+		"listeners:\n" +
+		"  - addr: /tmp/kafka-pixy-local.sock\n" +
+		"    socket:\n" +
+		"      mode: 0600\n" +
+		"      user: \"1000\"\n" +
+		"    auth:\n" +
+		"      peers:\n" +
+		"        - user: app\n" +
+		"          topics: [\"orders.*\"]\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	listeners := appCfg.HTTPListeners()
+	c.Assert(len(listeners), Equals, 3)
+	c.Assert(listeners[1].Addr, Equals, "/tmp/kafka-pixy.sock")
+	c.Assert(listeners[1].Socket, DeepEquals, UnixSocket{Mode: "0660", Group: "kafka-pixy"})
+	c.Assert(listeners[1].Socket.FileMode(), Equals, os.FileMode(0660))
+	c.Assert(listeners[2].Socket, DeepEquals, UnixSocket{Mode: "0600", User: "1000"})
+	c.Assert(listeners[2].Socket.FileMode(), Equals, os.FileMode(0600))
+	c.Assert(listeners[2].Auth.Peers, DeepEquals, []UnixPeer{{User: "app", Topics: []string{"orders.*"}}})
+	c.Assert(listeners[2].Auth.Enabled(), Equals, true)
+	c.Assert(listeners[0].Socket.FileMode(), Equals, os.FileMode(0777))
+}
+
+func (s *ConfigSuite) TestUnixSocketInvalid(c *C) {
+	data := []byte("" +
+		"unix_addr: /tmp/kafka-pixy.sock\n" +
+		"unix_socket:\n" +
+		"  mode: rw\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: invalid unix_socket config: bad socket mode, rw")
+}
+
+// If an admin address is configured, then other shorthand listeners serve
+// data API only.
+func (s *ConfigSuite) TestAdminAddr(c *C) {
+	data := []byte("" +
+		"admin_addr: 127.0.0.1:19094\n" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    api: admin\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	listeners := appCfg.HTTPListeners()
+	c.Assert(len(listeners), Equals, 3)
+	c.Assert(listeners[0].Addr, Equals, "127.0.0.1:19094")
+	c.Assert(listeners[0].API, Equals, ListenerAPIAdmin)
+	c.Assert(listeners[1].Addr, Equals, "0.0.0.0:19092")
+	c.Assert(listeners[1].API, Equals, ListenerAPIData)
+	c.Assert(listeners[2].Addr, Equals, "127.0.0.1:19093")
+	c.Assert(listeners[2].API, Equals, ListenerAPIAdmin)
+}
+
+// A listener can serve health check and metrics endpoints only, along with
+// listeners on TCP and Unix addresses and an admin listener.
+func (s *ConfigSuite) TestMetricsListener(c *C) {
+	data := []byte("" +
+		"unix_addr: /tmp/kafka-pixy.sock\n" +
+		"admin_addr: 127.0.0.1:19094\n" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19095\n" +
+		"    api: metrics\n" +
+		"    auth:\n" +
+		"      tokens: [foo]\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	listeners := appCfg.HTTPListeners()
+	c.Assert(len(listeners), Equals, 4)
+	c.Assert(listeners[0].API, Equals, ListenerAPIAdmin)
+	c.Assert(listeners[1].API, Equals, ListenerAPIData)
+	c.Assert(listeners[2].API, Equals, ListenerAPIData)
+	c.Assert(listeners[3].Addr, Equals, "127.0.0.1:19095")
+	c.Assert(listeners[3].API, Equals, ListenerAPIMetrics)
+	c.Assert(listeners[3].Auth.Tokens, DeepEquals, []string{"foo"})
+}
+
+func (s *ConfigSuite) TestListenerAddrDuplicate(c *C) {
+	data := []byte("" +
+		"tcp_addr: 127.0.0.1:19093\n" +
+		"listeners:\n" +
+		"  - addr: 127.0.0.1:19093\n" +
+		"    api: metrics\n" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: foo_id\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: listener address is used more than once, 127.0.0.1:19093")
+}
+
+func (s *ConfigSuite) TestKafkaNetTimeouts(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    kafka:\n" +
+		"      dial_timeout: 5s\n" +
+		"      read_timeout: 6s\n" +
+		"      write_timeout: 7s\n" +
+		"      keep_alive: 8s\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	for _, saramaCfg := range []*sarama.Config{
+		appCfg.Proxies["foo"].SaramaClientCfg(),
+		appCfg.Proxies["foo"].SaramaProducerCfg(),
+	} {
+		c.Assert(saramaCfg.Net.DialTimeout, Equals, 5*time.Second)
+		c.Assert(saramaCfg.Net.ReadTimeout, Equals, 6*time.Second)
+		c.Assert(saramaCfg.Net.WriteTimeout, Equals, 7*time.Second)
+		c.Assert(saramaCfg.Net.KeepAlive, Equals, 8*time.Second)
+	}
+}
+
+func (s *ConfigSuite) TestMemberIDDefault(c *C) {
+	proxyCfg := DefaultProxy()
+
+	// When
+	memberID := proxyCfg.GroupMemberID("foo")
+
+	// Then
+	c.Assert(memberID, Equals, proxyCfg.ClientID)
+}
+
+func (s *ConfigSuite) TestMemberID(c *C) {
+	os.Setenv("KAFKA_PIXY_TEST_POD", "pod-1")
+	defer os.Unsetenv("KAFKA_PIXY_TEST_POD")
+	hostname, _ := os.Hostname()
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    client_id: bar\n" +
+		"    consumer:\n" +
+		"      member_id: \"{client_id}_{hostname}_{env.KAFKA_PIXY_TEST_POD}_{group}\"\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].GroupMemberID("g1"), Equals, "bar_"+hostname+"_pod-1_g1")
+}
+
+func (s *ConfigSuite) TestMemberIDInvalid(c *C) {
+	for i, tc := range []struct {
+		memberID string
+		error    string
+	}{{
+		memberID: "{foo}",
+		error:    "invalid config parameter: invalid config, cluster=foo: invalid consumer.member_id: unknown placeholder {foo}",
+	}, {
+		memberID: "{env.KAFKA_PIXY_TEST_UNDEFINED}",
+		error:    "invalid config parameter: invalid config, cluster=foo: consumer.member_id must not be empty",
+	}, {
+		memberID: "a/{group}",
+		error:    "invalid config parameter: invalid config, cluster=foo: consumer.member_id must not contain '/', a/group",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" +
+			"      member_id: \"" + tc.memberID + "\"\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.error, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestKafkaTLSAndSASL(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    kafka:\n" +
+		"      tls:\n" +
+		"        enable: true\n" +
+		"        insecure_skip_verify: true\n" +
+		"      sasl:\n" +
+		"        enable: true\n" +
+		"        user: bar\n" +
+		"        password: bazz\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	for _, saramaCfg := range []*sarama.Config{
+		appCfg.Proxies["foo"].SaramaClientCfg(),
+		appCfg.Proxies["foo"].SaramaProducerCfg(),
+	} {
+		c.Assert(saramaCfg.Net.TLS.Enable, Equals, true)
+		c.Assert(saramaCfg.Net.TLS.Config.InsecureSkipVerify, Equals, true)
+		c.Assert(saramaCfg.Net.SASL.Enable, Equals, true)
+		c.Assert(saramaCfg.Net.SASL.User, Equals, "bar")
+		c.Assert(saramaCfg.Net.SASL.Password, Equals, "bazz")
+	}
+}
+
+// By default neither TLS nor SASL are used to connect to Kafka brokers.
+func (s *ConfigSuite) TestKafkaTLSAndSASLDefault(c *C) {
+	saramaCfg := DefaultProxy().SaramaClientCfg()
+	c.Assert(saramaCfg.Net.TLS.Enable, Equals, false)
+	c.Assert(saramaCfg.Net.TLS.Config, IsNil)
+	c.Assert(saramaCfg.Net.SASL.Enable, Equals, false)
+}
+
+func (s *ConfigSuite) TestKafkaTLSAndSASLInvalid(c *C) {
+	for i, tc := range []struct {
+		kafka string
+		error string
+	}{{
+		kafka: "" +
+			"      tls:\n" +
+			"        cert_file: /foo.crt\n",
+		error: "invalid config parameter: invalid config, cluster=foo: kafka.tls.cert_file and kafka.tls.key_file must be set together",
+	}, {
+		kafka: "" +
+			"      tls:\n" +
+			"        enable: true\n" +
+			"        ca_file: /no/such/file.crt\n",
+		error: "invalid config parameter: invalid config, cluster=foo: invalid kafka.tls: failed to read CA file: open /no/such/file.crt: no such file or directory",
+	}, {
+		kafka: "" +
+			"      sasl:\n" +
+			"        enable: true\n",
+		error: "invalid config parameter: invalid config, cluster=foo: kafka.sasl.user must be set if kafka.sasl.enable is true",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    kafka:\n" + tc.kafka)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.error, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestDeadLetterTopic(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      dead_letter_topic: \"{topic}.{group}.dlq\"\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].DeadLetterTopic("g1", "t1"), Equals, "t1.g1.dlq")
+	c.Assert(DefaultProxy().DeadLetterTopic("g1", "t1"), Equals, "")
+}
+
+func (s *ConfigSuite) TestDeadLetterOrigin(c *C) {
+	for i, tc := range []struct {
+		template string
+		dlTopic  string
+		origin   string
+	}{
+		{template: "{topic}.dlq", dlTopic: "foo.dlq", origin: "foo"},
+		{template: "dlq.{topic}", dlTopic: "dlq.foo", origin: "foo"},
+		{template: "dlq.{topic}.x", dlTopic: "dlq.foo.x", origin: "foo"},
+		{template: "{topic}.dlq", dlTopic: "foo.bar", origin: ""},
+		{template: "{topic}.dlq", dlTopic: ".dlq", origin: ""},
+		{template: "{topic}.{group}.dlq", dlTopic: "foo.bar.dlq", origin: ""},
+		{template: "dlq", dlTopic: "dlq", origin: ""},
+		{template: "", dlTopic: "foo.dlq", origin: ""},
+	} {
+		cfg := DefaultProxy()
+		cfg.Consumer.DeadLetterTopic = tc.template
+
+		// When
+		origin := cfg.DeadLetterOrigin(tc.dlTopic)
+
+		// Then
+		c.Assert(origin, Equals, tc.origin, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestDeadLetterTopicInvalid(c *C) {
+	for i, tc := range []struct {
+		dlTopic string
+		error   string
+	}{{
+		dlTopic: "{foo}.dlq",
+		error:   "invalid config parameter: invalid config, cluster=foo: invalid consumer.dead_letter_topic: unknown placeholder {foo}",
+	}, {
+		dlTopic: "{topic}",
+		error:   "invalid config parameter: invalid config, cluster=foo: consumer.dead_letter_topic must differ from the consumed topic",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" +
+			"      dead_letter_topic: \"" + tc.dlTopic + "\"\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.error, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestNackBackoff(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      nack_backoff: 2s\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Consumer.NackBackoff, Equals, 2*time.Second)
+	c.Assert(DefaultProxy().Consumer.NackBackoff, Equals, time.Duration(0))
+}
+
+func (s *ConfigSuite) TestNackBackoffInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      nack_backoff: -1s\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: consumer.nack_backoff must be >= 0")
+}
+
+func (s *ConfigSuite) TestInitialOffset(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      initial_offset: earliest\n" +
+		"      group_initial_offsets:\n" +
+		"        g2: latest\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].GroupInitialOffset("g1"), Equals, InitialOffsetEarliest)
+	c.Assert(appCfg.Proxies["foo"].GroupInitialOffset("g2"), Equals, InitialOffsetLatest)
+	c.Assert(DefaultProxy().GroupInitialOffset("g1"), Equals, InitialOffsetLatest)
+}
+
+// Overrides of a group take precedence over overrides of a topic, that take
+// precedence over the consumer parameters.
+func (s *ConfigSuite) TestConsumerParams(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      group_initial_offsets:\n" +
+		"        g2: earliest\n" +
+		"      topics:\n" +
+		"        t1:\n" +
+		"          channel_buffer_size: 1000\n" +
+		"          fetch_max_bytes: 4194304\n" +
+		"          initial_offset: earliest\n" +
+		"          long_polling_timeout: 1s\n" +
+		"      groups:\n" +
+		"        g1:\n" +
+		"          initial_offset: latest\n" +
+		"          long_polling_timeout: 10s\n" +
+		"          registration_timeout: 60s\n")
+	appCfg, err := FromYAML(data)
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+
+	for i, tc := range []struct {
+		group  string
+		topic  string
+		params ConsumerParams
+	}{{
+		group: "g0", topic: "t0",
+		params: ConsumerParams{
+			ChannelBufferSize:   64,
+			FetchMaxBytes:       1048576,
+			InitialOffset:       InitialOffsetLatest,
+			LongPollingTimeout:  3 * time.Second,
+			RegistrationTimeout: 20 * time.Second,
+		},
+	}, {
+		group: "g0", topic: "t1",
+		params: ConsumerParams{
+			ChannelBufferSize:   1000,
+			FetchMaxBytes:       4194304,
+			InitialOffset:       InitialOffsetEarliest,
+			LongPollingTimeout:  1 * time.Second,
+			RegistrationTimeout: 20 * time.Second,
+		},
+	}, {
+		group: "g1", topic: "t1",
+		params: ConsumerParams{
+			ChannelBufferSize:   1000,
+			FetchMaxBytes:       4194304,
+			InitialOffset:       InitialOffsetLatest,
+			LongPollingTimeout:  10 * time.Second,
+			RegistrationTimeout: 60 * time.Second,
+		},
+	}, {
+		group: "g2", topic: "t0",
+		params: ConsumerParams{
+			ChannelBufferSize:   64,
+			FetchMaxBytes:       1048576,
+			InitialOffset:       InitialOffsetEarliest,
+			LongPollingTimeout:  3 * time.Second,
+			RegistrationTimeout: 20 * time.Second,
+		},
+	}, {
+		group: "", topic: "t1",
+		params: ConsumerParams{
+			ChannelBufferSize:   1000,
+			FetchMaxBytes:       4194304,
+			InitialOffset:       InitialOffsetEarliest,
+			LongPollingTimeout:  1 * time.Second,
+			RegistrationTimeout: 20 * time.Second,
+		},
+	}} {
+		// When
+		params := proxyCfg.ConsumerParams(tc.group, tc.topic)
+
+		// Then
+		c.Assert(params, DeepEquals, tc.params, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestTopicCompression(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    producer:\n" +
+		"      compression: gzip\n" +
+		"      topics:\n" +
+		"        t1:\n" +
+		"          compression: none\n" +
+		"        t2:\n" +
+		"          compression: lz4\n" +
+		"        t3: {}\n")
+	appCfg, err := FromYAML(data)
+	c.Assert(err, IsNil)
+	proxyCfg := appCfg.Proxies["foo"]
+
+	for i, tc := range []struct {
+		topic       string
+		compression sarama.CompressionCodec
+	}{
+		{topic: "t0", compression: sarama.CompressionGZIP},
+		{topic: "t1", compression: sarama.CompressionNone},
+		{topic: "t2", compression: sarama.CompressionLZ4},
+		{topic: "t3", compression: sarama.CompressionGZIP},
+	} {
+		// When
+		compression := proxyCfg.TopicCompression(tc.topic)
+
+		// Then
+		c.Assert(sarama.CompressionCodec(compression), Equals, tc.compression, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestTopicCompressionInvalid(c *C) {
+	for i, tc := range []struct {
+		compression string
+		err         string
+	}{{
+		compression: "zstd",
+		err:         "failed to parse proxy config, cluster=foo: unsupported compression, zstd",
+	}, {
+		compression: "lzma",
+		err:         "failed to parse proxy config, cluster=foo: bad compression, lzma",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    producer:\n" +
+			"      topics:\n" +
+			"        t1:\n" +
+			"          compression: " + tc.compression + "\n")
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestConsumerParamsInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      topics:\n        t1:\n          channel_buffer_size: -1\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.topics.t1: channel_buffer_size must be >= 0",
+	}, {
+		yaml: "      topics:\n        t1:\n          long_polling_timeout: 1m\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.topics.t1: long_polling_timeout must be <= consumer.max_long_polling_timeout",
+	}, {
+		yaml: "      groups:\n        g1:\n          registration_timeout: 10s\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.groups.g1: registration_timeout must be > consumer.ack_timeout",
+	}, {
+		yaml: "      groups:\n        g1:\n          fetch_max_bytes: 1024\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.groups.g1: fetch_max_bytes cannot be overridden for a group",
+	}, {
+		yaml: "      topics:\n        t1:\n          prefetch_max_messages: -1\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.topics.t1: prefetch_max_messages must be >= 0",
+	}, {
+		yaml: "      groups:\n        g1:\n          prefetch_max_messages: 10\n",
+		err: "invalid config parameter: invalid config, cluster=foo: " +
+			"invalid consumer.groups.g1: prefetch_max_messages cannot be overridden for a group",
+	}, {
+		yaml: "      groups:\n        g1:\n          ack_timeout: 10s\n",
+		err:  "failed to parse config: unknown parameter, proxies.foo.consumer.groups.g1.ack_timeout",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestInitialOffsetInvalid(c *C) {
+	for i, tc := range []struct {
+		yaml string
+		err  string
+	}{{
+		yaml: "      initial_offset: bogus\n",
+		err:  "failed to parse proxy config, cluster=foo: bad initial offset, bogus",
+	}, {
+		yaml: "      group_initial_offsets:\n        g1: bogus\n",
+		err:  "failed to parse proxy config, cluster=foo: bad initial offset, bogus",
+	}} {
+		data := []byte("" +
+			"proxies:\n" +
+			"  foo:\n" +
+			"    consumer:\n" + tc.yaml)
+
+		// When
+		_, err := FromYAML(data)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ConfigSuite) TestAssignmentStrategy(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      assignment_strategy: sticky\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Consumer.AssignmentStrategy, Equals, AssignmentSticky)
+}
+
+func (s *ConfigSuite) TestAssignmentStrategyInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      assignment_strategy: bogus\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "failed to parse proxy config, cluster=foo: bad assignment strategy, bogus")
+}
+
+func (s *ConfigSuite) TestMemberSessionTimeoutInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      member_session_timeout: -1s\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: consumer.member_session_timeout must be >= 0")
+}
+
+func (s *ConfigSuite) TestMaxAckWindowInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      max_ack_window: -1\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "invalid config parameter: invalid config, cluster=foo: consumer.max_ack_window must be >= 0")
+}
+
+func (s *ConfigSuite) TestMuxPolicy(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      mux_policy: weighted\n")
+
+	// When
+	appCfg, err := FromYAML(data)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(appCfg.Proxies["foo"].Consumer.MuxPolicy, Equals, MuxWeighted)
+}
+
+func (s *ConfigSuite) TestMuxPolicyInvalid(c *C) {
+	data := []byte("" +
+		"proxies:\n" +
+		"  foo:\n" +
+		"    consumer:\n" +
+		"      mux_policy: bogus\n")
+
+	// When
+	_, err := FromYAML(data)
+
+	// Then
+	c.Assert(err.Error(), Equals, "failed to parse proxy config, cluster=foo: bad mux policy, bogus")
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of environment variables that override config
+// parameters.
+const EnvPrefix = "KAFKA_PIXY_"
+
+var nonAlnumRx = regexp.MustCompile(`[^A-Z0-9]`)
+
+// OverrideFromEnv overrides config parameters with values of environment
+// variables given in the `key=value` form, as returned by `os.Environ`.
+//
+// The name of a variable is the path of a parameter in the YAML config,
+// upper cased, with path components joined by underscores and prefixed with
+// `KAFKA_PIXY_`, e.g. `KAFKA_PIXY_HTTP_WRITE_TIMEOUT`. Parameters of a proxy
+// are addressed by the cluster name, upper cased with all characters other
+// than letters and digits replaced with underscores, e.g.
+// `KAFKA_PIXY_PROXIES_DEFAULT_KAFKA_SEED_PEERS`. Parameters of the default
+// cluster proxy can also be addressed without the cluster name, e.g.
+// `KAFKA_PIXY_PROXY_KAFKA_SEED_PEERS`, but variables that name the cluster
+// take precedence.
+//
+// Values are parsed as YAML, except that lists of strings can also be given
+// as comma separated values. An error is returned if a variable with the
+// `KAFKA_PIXY_` prefix does not correspond to any parameter, or if the
+// resulting config is invalid.
+func (a *App) OverrideFromEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		kvParts := strings.SplitN(kv, "=", 2)
+		if len(kvParts) != 2 {
+			continue
+		}
+		env[kvParts[0]] = kvParts[1]
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	if err := overrideFromEnv(env, EnvPrefix[:len(EnvPrefix)-1], reflect.ValueOf(a).Elem()); err != nil {
+		return err
+	}
+	if proxyCfg := a.Proxies[a.DefaultCluster]; proxyCfg != nil {
+		if err := overrideFromEnv(env, EnvPrefix+"PROXY", reflect.ValueOf(proxyCfg).Elem()); err != nil {
+			return err
+		}
+	}
+	for cluster, proxyCfg := range a.Proxies {
+		prefix := EnvPrefix + "PROXIES_" + envName(cluster)
+		if err := overrideFromEnv(env, prefix, reflect.ValueOf(proxyCfg).Elem()); err != nil {
+			return err
+		}
+	}
+	if len(env) > 0 {
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errors.Errorf("unknown environment variable, %s", names[0])
+	}
+
+	if err := a.validate(); err != nil {
+		return errors.Wrap(err, "invalid config parameter")
+	}
+	return nil
+}
+
+// overrideFromEnv sets fields of struct `v` to values of respective
+// environment variables, and removes the variables that were used from `env`.
+func overrideFromEnv(env map[string]string, prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		envVar := prefix + "_" + envName(name)
+		fieldValue := v.Field(i)
+		if field.Type.Kind() == reflect.Struct && !selfUnmarshaled(field.Type) {
+			if err := overrideFromEnv(env, envVar, fieldValue); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := env[envVar]
+		if !ok {
+			continue
+		}
+		delete(env, envVar)
+		if err := parseEnvValue(value, fieldValue); err != nil {
+			return errors.Wrapf(err, "bad environment variable, %s", envVar)
+		}
+	}
+	return nil
+}
+
+func parseEnvValue(value string, v reflect.Value) error {
+	switch {
+	case v.Kind() == reflect.String && !selfUnmarshaled(v.Type()):
+		v.SetString(value)
+		return nil
+	case v.Type() == reflect.TypeOf([]string(nil)) && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+		return nil
+	}
+	// Unmarshal into a fresh value so that a list or a map given by the
+	// variable replaces the configured one rather than being merged into it.
+	parsed := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+		return err
+	}
+	v.Set(parsed.Elem())
+	return nil
+}
+
+// envName converts a YAML parameter or a cluster name to the form used in
+// environment variable names.
+func envName(name string) string {
+	return nonAlnumRx.ReplaceAllString(strings.ToUpper(name), "_")
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	appType             = reflect.TypeOf(App{})
+	proxiesType         = reflect.TypeOf(map[string]*Proxy{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// checkParamsStrict returns an error that names the first parameter in the
+// YAML config that does not correspond to any config field, or that is a
+// malformed duration. yaml.v2 silently ignores unknown parameters, so a
+// misspelled one would otherwise go unnoticed and its default value would be
+// used. And errors reported by yaml.v2 for proxy parameters refer to lines of
+// a re-encoded proxy config rather than of the original one.
+func checkParamsStrict(data []byte) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc == nil {
+		return nil
+	}
+	return checkParams("", doc, appType)
+}
+
+// checkParams checks that `value` parsed from the YAML config at `path` can
+// be unmarshaled into a value of type `t` without losing any parameters, and
+// that durations in it are well-formed.
+func checkParams(path string, value interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == durationType {
+		if s, ok := value.(string); ok {
+			if _, err := time.ParseDuration(s); err != nil {
+				return errors.Errorf("bad duration, %s: %s", path, s)
+			}
+		}
+		return nil
+	}
+	// Values of types that unmarshal themselves are opaque.
+	if selfUnmarshaled(t) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			fieldType, ok := yamlFieldType(t, key)
+			if !ok {
+				return errors.Errorf("unknown parameter, %s", joinPath(path, key))
+			}
+			if err := checkParams(joinPath(path, key), v, fieldType); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		for k, v := range m {
+			if err := checkParams(joinPath(path, fmt.Sprint(k)), v, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			if err := checkParams(fmt.Sprintf("%s[%d]", path, i), item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlFieldType returns the type of a struct field that the specified YAML
+// key is unmarshaled into.
+func yamlFieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	// Proxies are parsed by FromYAML explicitly.
+	if t == appType && key == "proxies" {
+		return proxiesType, true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if yamlName(field) == key {
+			return field.Type, true
+		}
+	}
+	return nil, false
+}
+
+// yamlName returns the key that a struct field is unmarshaled from, or an
+// empty string if the field is not unmarshaled from YAML.
+func yamlName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// selfUnmarshaled tells whether values of type `t` are unmarshaled by their
+// own methods rather than field by field.
+func selfUnmarshaled(t reflect.Type) bool {
+	ptrType := reflect.PtrTo(t)
+	return ptrType.Implements(textUnmarshalerType) || ptrType.Implements(yamlUnmarshalerType)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
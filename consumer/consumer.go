@@ -1,8 +1,13 @@
 package consumer
 
 import (
+	"context"
+	"fmt"
+	"regexp"
 	"time"
 
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/none"
 	"github.com/pkg/errors"
 )
 
@@ -14,26 +19,119 @@ const (
 	// An event of this type should be sent to the message events channel
 	// when the message is acknowledged by a client.
 	EvAcked
+
+	// An event of this type should be sent to the message events channel
+	// when the message is rejected by a client and should be retried.
+	EvNacked
+
+	// An event of this type should be sent to the message events channel
+	// to make the partition consumer drop all pending messages and restart
+	// consumption from the event offset.
+	EvSeek
 )
 
 var (
 	ErrRequestTimeout  = errors.New("long polling timeout")
+	ErrRequestCanceled = errors.New("request canceled")
 	ErrTooManyRequests = errors.New("Too many requests. Consider increasing `consumer.channel_buffer_size` (https://github.com/mailgun/kafka-pixy/blob/master/default.yaml#L43)")
 )
 
+// OverloadedError is returned when a consume request is rejected by load
+// shedding because the queue it would be placed into is too deep.
+type OverloadedError struct {
+	// Key of the queue: a consumer group or a topic name.
+	Key string
+
+	// Number of requests in the queue at the time of rejection.
+	QueueLen int
+
+	// Load shedding threshold that has been exceeded.
+	Threshold int
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("Overloaded, back off and retry later: key=%s, queued=%d, threshold=%d",
+		e.Key, e.QueueLen, e.Threshold)
+}
+
+// IsOverloaded returns true if `err` is a load shedding rejection.
+func IsOverloaded(err error) bool {
+	_, ok := errors.Cause(err).(*OverloadedError)
+	return ok
+}
+
+// RejectedError wraps either ErrTooManyRequests or OverloadedError that a
+// consume request is rejected with, along with an estimate of how long it
+// takes for the consumer to catch up with the requests that are already
+// queued. Use `errors.Cause` to get the wrapped error.
+type RejectedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Cause() error {
+	return e.Err
+}
+
+// RetryAfter returns how long a client should back off before repeating a
+// consume request that failed with `err`, or zero if there is no estimate.
+func RetryAfter(err error) time.Duration {
+	if re, ok := err.(*RejectedError); ok {
+		return re.RetryAfter
+	}
+	return 0
+}
+
 type T interface {
 	// Consume consumes a message from the specified topic on behalf of the
 	// specified consumer group. If there are no more new messages in the topic
-	// at the time of the request then it will block for
-	// `Config.Consumer.LongPollingTimeout`. If no new message is produced during
-	// that time, then `ErrRequestTimeout` is returned.
+	// at the time of the request then it will block for `timeout`, or for
+	// `Config.Consumer.LongPollingTimeout` if `timeout` is zero, but no longer
+	// than `Config.Consumer.MaxLongPollingTimeout`. If no new message is
+	// produced during that time, then `ErrRequestTimeout` is returned.
 	//
 	// Note that during state transitions topic subscribe<->unsubscribe and
 	// consumer group register<->deregister the method may return either
 	// `ErrBufferOverflow` or `ErrRequestTimeout` even when there are messages
 	// available for consumption. In that case the user should back off a bit
 	// and then repeat the request.
-	Consume(group, topic string) (Message, error)
+	//
+	// If `ctx` is done before a message is assigned to the request, e.g.
+	// because the client disconnected, then the request is dropped and
+	// `ErrRequestCanceled` is returned.
+	Consume(ctx context.Context, group, topic string, timeout time.Duration) (Message, error)
+
+	// ConsumeBatch is like Consume, but returns up to `maxMessages` messages
+	// that are available for consumption right away. If `maxBytes` is
+	// positive, then no more messages are added to the batch after the total
+	// size of their keys and values reaches it.
+	ConsumeBatch(ctx context.Context, group, topic string, maxMessages, maxBytes int, timeout time.Duration) ([]Message, error)
+
+	// ConsumeAny is like Consume, but waits for a message from any of the
+	// specified topics and returns the first one available. A message that
+	// another topic offers after that is rejected, so that it is offered
+	// again right away.
+	ConsumeAny(ctx context.Context, group string, topics []string, timeout time.Duration) (Message, error)
+
+	// ConsumeMatching is like ConsumeAny, but consumes from all topics that
+	// `pattern` matches. The list of topics is refreshed every
+	// `Config.Consumer.TopicsRefreshInterval`, so new topics are picked up
+	// with a delay.
+	ConsumeMatching(ctx context.Context, group string, pattern *regexp.Regexp, timeout time.Duration) (Message, error)
+
+	// SetGroupInitialOffset overrides the initial offset policy that the
+	// config defines for the specified consumer group. It takes effect when
+	// the group starts being consumed, e.g. on the first consume request, so
+	// it should be called before that.
+	SetGroupInitialOffset(group string, initialOffset config.InitialOffset)
+
+	// State returns a snapshot of the internal state of the consumer. It is
+	// meant for debugging.
+	State() State
 
 	// Stop sends a shutdown signal to all internal goroutines and blocks until
 	// they are stopped. It is guaranteed that all last consumed offsets of all
@@ -49,16 +147,134 @@ type Message struct {
 	Offset        int64
 	Timestamp     time.Time // only set if Kafka is version 0.10+
 	HighWaterMark int64
-	EventsCh      chan<- Event
+	// The number of times the message has been offered to the consumer
+	// group, including this one. It is greater than 1 if the message is
+	// offered again, because it was not acknowledged within
+	// `Config.Consumer.AckTimeout` or it was rejected.
+	DeliveryAttempt int
+	EventsCh        chan<- Event
+	// Closed when the partition consumer drops the message after pushing it
+	// to its messages channel, e.g. because it seeks to another offset. A
+	// dropped message must not be offered to clients.
+	DroppedCh <-chan none.T
+}
+
+// Offer reports a message to its partition consumer as offered to a client.
+// It returns false if the partition consumer has dropped the message, in
+// which case it must not be given to the client.
+func Offer(msg Message) bool {
+	select {
+	case <-msg.DroppedCh:
+		return false
+	default:
+	}
+	msg.EventsCh <- Event{T: EvOffered, Offset: msg.Offset}
+	// The message could have been dropped while the offer was in flight, then
+	// the partition consumer either ignores the offer, or forgets about it
+	// along with all other offered messages.
+	select {
+	case <-msg.DroppedCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// State is a snapshot of the internal state of a consumer: consumer groups
+// that it is a member of, topics that are being consumed by them, and
+// partitions that are assigned to this group member.
+type State struct {
+	// Total number of consume requests queued in the consumer.
+	QueueLen int
+	Groups   []GroupState
+}
+
+// GroupState is a snapshot of the internal state of a group consumer.
+type GroupState struct {
+	Group string
+
+	// Number of consume requests queued for the group and all its topics.
+	QueueLen int
+
+	// Topic subscriptions of all group members, as last seen in ZooKeeper.
+	Subscriptions map[string][]string
+	Topics        []TopicState
+}
+
+// TopicState is a snapshot of the internal state of a topic consumer.
+type TopicState struct {
+	Topic string
+
+	// Number of consume requests waiting for messages from the topic.
+	QueueLen   int
+	Partitions []PartitionState
+}
+
+// PartitionState is a snapshot of the internal state of a partition
+// consumer.
+type PartitionState struct {
+	Partition int32
+
+	// Whether the partition has been claimed in ZooKeeper. A partition
+	// consumer waits for the previous owner to release a partition before
+	// it starts fetching messages.
+	Claimed bool
+
+	// Whether the committed offset has been retrieved from Kafka.
+	Initialized bool
+
+	// The last offset committed to Kafka, and the last offset submitted to
+	// be committed.
+	CommittedOffset int64
+	SubmittedOffset int64
+
+	// Number of messages offered to clients but not acknowledged yet.
+	Offered int
+
+	// Number of messages in the partition that are yet to be consumed, as of
+	// the last fetched message.
+	Lag int64
+}
+
+// DeadLetterer accepts messages that a consumer group has given up on after
+// `Config.Consumer.MaxRetries` retries. DeadLetter returns once the message
+// is written to the dead letter topic, and an error if it cannot be, in
+// which case the offset of the message must not be committed. `reason` is
+// given with the last nack of the message, if any.
+type DeadLetterer interface {
+	DeadLetter(group string, msg Message, retryNo int, reason string) error
 }
 
 func Ack(offset int64) Event {
-	return Event{EvAcked, offset}
+	return Event{T: EvAcked, Offset: offset}
+}
+
+// AckWithMeta returns an ack event that also carries metadata to be stored
+// with the committed offset.
+func AckWithMeta(offset int64, meta string) Event {
+	return Event{T: EvAcked, Offset: offset, Meta: meta}
+}
+
+func Nack(offset int64) Event {
+	return Event{T: EvNacked, Offset: offset}
+}
+
+// NackWithReason returns a nack event that also carries the reason why the
+// message was rejected.
+func NackWithReason(offset int64, reason string) Event {
+	return Event{T: EvNacked, Offset: offset, Meta: reason}
+}
+
+func Seek(offset int64) Event {
+	return Event{T: EvSeek, Offset: offset}
 }
 
 type Event struct {
 	T      eventType
 	Offset int64
+	// Metadata to be stored with the committed offset for acks, or the
+	// reason of a rejection for nacks.
+	Meta string
 }
 
 type eventType int
@@ -1,6 +1,10 @@
 package consumerimpl
 
 import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -9,8 +13,12 @@ import (
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/dispatcher"
 	"github.com/mailgun/kafka-pixy/consumer/groupcsm"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/kafka-pixy/offsetmgr"
+	"github.com/mailgun/log"
 	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/wvanbergen/kazoo-go"
 )
 
@@ -27,17 +35,35 @@ import (
 // implements `consumer.T`.
 // implements `dispatcher.Factory`.
 type t struct {
-	namespace  *actor.ID
-	cfg        *config.Proxy
-	dispatcher *dispatcher.T
-	kafkaClt   sarama.Client
-	kazooClt   *kazoo.Kazoo
-	offsetMgrF offsetmgr.Factory
+	namespace    *actor.ID
+	cfg          *config.Proxy
+	dispatcher   *dispatcher.T
+	kafkaClt     sarama.Client
+	kazooClt     *kazoo.Kazoo
+	offsetMgrF   offsetmgr.Factory
+	deadLetterer consumer.DeadLetterer
+
+	initialOffsetsMu sync.Mutex
+	initialOffsets   map[string]config.InitialOffset
+
+	topicsMu sync.RWMutex
+	topics   []string
+
+	// Rates at which consume requests of groups to topics leave queues,
+	// keyed by group and topic.
+	drainRatesMu sync.Mutex
+	drainRates   map[string]gometrics.Meter
+
+	stopCh chan none.T
+	wg     sync.WaitGroup
 }
 
 // Spawn creates a consumer instance with the specified configuration and
-// starts all its goroutines.
-func Spawn(namespace *actor.ID, cfg *config.Proxy, offsetMgrF offsetmgr.Factory) (*t, error) {
+// starts all its goroutines. Messages that consumer groups give up on are
+// passed to `deadLetterer`, unless it is nil.
+func Spawn(namespace *actor.ID, cfg *config.Proxy, offsetMgrF offsetmgr.Factory,
+	deadLetterer consumer.DeadLetterer,
+) (*t, error) {
 	namespace = namespace.NewChild("cons")
 
 	kafkaClt, err := sarama.NewClient(cfg.Kafka.SeedPeers, cfg.SaramaClientCfg())
@@ -51,27 +77,217 @@ func Spawn(namespace *actor.ID, cfg *config.Proxy, offsetMgrF offsetmgr.Factory)
 	}
 
 	c := &t{
-		namespace:  namespace,
-		cfg:        cfg,
-		kafkaClt:   kafkaClt,
-		offsetMgrF: offsetMgrF,
-		kazooClt:   kazooClt,
+		namespace:    namespace,
+		cfg:          cfg,
+		kafkaClt:     kafkaClt,
+		offsetMgrF:   offsetMgrF,
+		kazooClt:     kazooClt,
+		deadLetterer: deadLetterer,
+
+		initialOffsets: make(map[string]config.InitialOffset),
+		drainRates:     make(map[string]gometrics.Meter),
+		stopCh:         make(chan none.T),
 	}
-	c.dispatcher = dispatcher.New(c.namespace, c, c.cfg)
+	c.dispatcher = dispatcher.New(c.namespace, c, c.cfg, c.cfg.Consumer.LoadShedding.MaxGroupQueueDepth)
 	c.dispatcher.Start()
+	c.loadTopics()
+	actor.Spawn(c.namespace.NewChild("topics"), &c.wg, c.runTopicsRefresher)
 	return c, nil
 }
 
 // implements `consumer.T`
-func (c *t) Consume(group, topic string) (consumer.Message, error) {
+func (c *t) Consume(ctx context.Context, group, topic string, timeout time.Duration) (consumer.Message, error) {
+	result := c.dispatch(ctx, dispatcher.Request{Group: group, Topic: topic, Timeout: timeout})
+	return result.Msg, result.Err
+}
+
+// implements `consumer.T`
+func (c *t) ConsumeBatch(ctx context.Context, group, topic string, maxMessages, maxBytes int, timeout time.Duration) ([]consumer.Message, error) {
+	if maxMessages <= 0 {
+		return nil, errors.Errorf("bad max messages: %d", maxMessages)
+	}
+	result := c.dispatch(ctx, dispatcher.Request{Group: group, Topic: topic, Timeout: timeout, MaxMessages: maxMessages, MaxBytes: maxBytes})
+	return result.Msgs, result.Err
+}
+
+// implements `consumer.T`
+func (c *t) ConsumeAny(ctx context.Context, group string, topics []string, timeout time.Duration) (consumer.Message, error) {
+	if len(topics) == 0 {
+		return consumer.Message{}, errors.New("no topics")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resultCh := make(chan dispatcher.Response, len(topics))
+	for _, topic := range topics {
+		req := dispatcher.Request{Group: group, Topic: topic, Timeout: timeout}
+		go func() {
+			resultCh <- c.dispatch(ctx, req)
+		}()
+	}
+	var err error
+	for range topics {
+		result := <-resultCh
+		if result.Err == nil {
+			return result.Msg, nil
+		}
+		if err == nil || err == consumer.ErrRequestTimeout {
+			err = result.Err
+		}
+	}
+	return consumer.Message{}, err
+}
+
+// implements `consumer.T`
+func (c *t) ConsumeMatching(ctx context.Context, group string, pattern *regexp.Regexp, timeout time.Duration) (consumer.Message, error) {
+	topics := c.matchTopics(pattern)
+	if len(topics) != 0 {
+		return c.ConsumeAny(ctx, group, topics, timeout)
+	}
+	if timeout <= 0 {
+		timeout = c.cfg.ConsumerParams(group, "").LongPollingTimeout
+	}
+	if timeout > c.cfg.Consumer.MaxLongPollingTimeout {
+		timeout = c.cfg.Consumer.MaxLongPollingTimeout
+	}
+	select {
+	case <-time.After(timeout):
+		return consumer.Message{}, consumer.ErrRequestTimeout
+	case <-ctx.Done():
+		return consumer.Message{}, consumer.ErrRequestCanceled
+	}
+}
+
+// implements `consumer.T`
+func (c *t) SetGroupInitialOffset(group string, initialOffset config.InitialOffset) {
+	c.initialOffsetsMu.Lock()
+	c.initialOffsets[group] = initialOffset
+	c.initialOffsetsMu.Unlock()
+}
+
+// groupInitialOffset returns the initial offset policy of a consumer group
+// set by SetGroupInitialOffset, or an empty string if there is none, in which
+// case the group uses the policies configured for the topics it consumes.
+func (c *t) groupInitialOffset(group string) config.InitialOffset {
+	c.initialOffsetsMu.Lock()
+	defer c.initialOffsetsMu.Unlock()
+	return c.initialOffsets[group]
+}
+
+// dispatch submits a consume request to the dispatcher and waits for a
+// response. If `ctx` is done first, then it returns right away, and the
+// request is dropped when it reaches the head of its queue. Messages that are
+// assigned to the request in the meantime are rejected, so that they are
+// offered again.
+func (c *t) dispatch(ctx context.Context, req dispatcher.Request) dispatcher.Response {
+	if req.Timeout > c.cfg.Consumer.MaxLongPollingTimeout {
+		req.Timeout = c.cfg.Consumer.MaxLongPollingTimeout
+	}
 	replyCh := make(chan dispatcher.Response, 1)
-	c.dispatcher.Requests() <- dispatcher.Request{time.Now().UTC(), group, topic, replyCh}
+	req.Timestamp = time.Now().UTC()
+	req.ResponseCh = replyCh
+	req.DoneCh = ctx.Done()
+	metrics.Gauge("consumer_queue_depth", "cluster", c.cfg.Cluster).Update(int64(c.dispatcher.QueueLen()))
+	c.dispatcher.Requests() <- req
+	var result dispatcher.Response
+	select {
+	case result = <-replyCh:
+	case <-ctx.Done():
+		result = dispatcher.Response{Err: consumer.ErrRequestCanceled}
+		go c.rejectAbandoned(replyCh)
+	}
+	c.countOutcome(req.Group, req.Topic, result.Err)
+	if result.Err == consumer.ErrTooManyRequests || consumer.IsOverloaded(result.Err) {
+		result.Err = &consumer.RejectedError{Err: result.Err, RetryAfter: c.retryAfter(req, result.Err)}
+	} else {
+		c.drainRate(req.Group, req.Topic).Mark(1)
+	}
+	if result.Err == nil {
+		msgCount := len(result.Msgs)
+		if req.MaxMessages == 0 {
+			msgCount = 1
+		}
+		metrics.Counter("consumer_messages", "cluster", c.cfg.Cluster, "group", req.Group, "topic", req.Topic).Inc(int64(msgCount))
+	}
+	return result
+}
+
+// rejectAbandoned waits for a response to a canceled consume request and
+// rejects messages it brings, if any.
+func (c *t) rejectAbandoned(replyCh <-chan dispatcher.Response) {
 	result := <-replyCh
-	return result.Msg, result.Err
+	msgs := result.Msgs
+	if result.Msg.EventsCh != nil {
+		msgs = append(msgs, result.Msg)
+	}
+	for _, msg := range msgs {
+		select {
+		case msg.EventsCh <- consumer.Nack(msg.Offset):
+		case <-time.After(c.cfg.Consumer.LongPollingTimeout):
+			log.Errorf("<%s> nack timeout: topic=%s, partition=%d, offset=%d",
+				c.namespace, msg.Topic, msg.Partition, msg.Offset)
+		}
+	}
+}
+
+// matchTopics returns known topics that `pattern` matches. Internal Kafka
+// topics, those starting with `__`, are never matched.
+func (c *t) matchTopics(pattern *regexp.Regexp) []string {
+	c.topicsMu.RLock()
+	defer c.topicsMu.RUnlock()
+	var matched []string
+	for _, topic := range c.topics {
+		if !strings.HasPrefix(topic, "__") && pattern.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	return matched
+}
+
+// runTopicsRefresher refreshes Kafka metadata every
+// `Config.Consumer.TopicsRefreshInterval` to learn about created and deleted
+// topics.
+func (c *t) runTopicsRefresher() {
+	ticker := time.NewTicker(c.cfg.Consumer.TopicsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.kafkaClt.RefreshMetadata(); err != nil {
+				log.Errorf("<%s> failed to refresh metadata: err=(%s)", c.namespace, err)
+				continue
+			}
+			c.loadTopics()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// loadTopics updates the list of known topics from the Kafka client metadata.
+func (c *t) loadTopics() {
+	topics, err := c.kafkaClt.Topics()
+	if err != nil {
+		log.Errorf("<%s> failed to get topics: err=(%s)", c.namespace, err)
+		return
+	}
+	c.topicsMu.Lock()
+	c.topics = topics
+	c.topicsMu.Unlock()
+}
+
+// implements `consumer.T`
+func (c *t) State() consumer.State {
+	state := consumer.State{QueueLen: c.dispatcher.QueueLen()}
+	for _, tier := range c.dispatcher.Tiers() {
+		state.Groups = append(state.Groups, tier.(*groupcsm.T).State())
+	}
+	return state
 }
 
 // implements `consumer.T`
 func (c *t) Stop() {
+	close(c.stopCh)
+	c.wg.Wait()
 	c.dispatcher.Stop()
 	c.kazooClt.Close()
 	c.kafkaClt.Close()
@@ -84,7 +300,71 @@ func (c *t) KeyOf(req dispatcher.Request) string {
 
 // implements `dispatcher.Factory`.
 func (c *t) NewTier(key string) dispatcher.Tier {
-	return groupcsm.New(c.namespace, key, c.cfg, c.kafkaClt, c.kazooClt, c.offsetMgrF)
+	return groupcsm.New(c.namespace, key, c.cfg, c.kafkaClt, c.kazooClt, c.offsetMgrF, c.deadLetterer,
+		c.groupInitialOffset(key))
+}
+
+// implements `dispatcher.Factory`.
+func (c *t) RegistrationTimeout(key string) time.Duration {
+	return c.cfg.ConsumerParams(key, "").RegistrationTimeout
+}
+
+// drainRate returns a meter of the rate at which consume requests of a group
+// to a topic leave their queue, whether they get messages or not.
+func (c *t) drainRate(group, topic string) gometrics.Meter {
+	key := group + "\x00" + topic
+	c.drainRatesMu.Lock()
+	defer c.drainRatesMu.Unlock()
+	meter := c.drainRates[key]
+	if meter == nil {
+		meter = gometrics.NewMeter()
+		c.drainRates[key] = meter
+	}
+	return meter
+}
+
+// retryAfter estimates how long it takes for the queue that a rejected
+// consume request was meant for to drain, given the rate that requests of
+// the group to the topic have recently been leaving it at. If there is no
+// rate to go by, then it is the long polling timeout, for no queued request
+// can wait longer than that.
+func (c *t) retryAfter(req dispatcher.Request, err error) time.Duration {
+	params := c.cfg.ConsumerParams(req.Group, req.Topic)
+	queued := params.ChannelBufferSize
+	if overloadedErr, ok := errors.Cause(err).(*consumer.OverloadedError); ok {
+		queued = overloadedErr.QueueLen
+	}
+	rate := c.drainRate(req.Group, req.Topic).Rate1()
+	if rate <= 0 {
+		return params.LongPollingTimeout
+	}
+	retryAfter := time.Duration(float64(queued) / rate * float64(time.Second))
+	if retryAfter > c.cfg.Consumer.MaxLongPollingTimeout {
+		retryAfter = c.cfg.Consumer.MaxLongPollingTimeout
+	}
+	return retryAfter
+}
+
+// countOutcome increments a metric counter that corresponds to the outcome of
+// a consume request. It allows to tell apart topics that have no traffic from
+// topics whose consumers are rejected.
+func (c *t) countOutcome(group, topic string, err error) {
+	var name string
+	switch {
+	case err == nil:
+		name = "consumer_delivered"
+	case err == consumer.ErrRequestTimeout:
+		name = "consumer_timeout"
+	case err == consumer.ErrTooManyRequests:
+		name = "consumer_overflow"
+	case err == consumer.ErrRequestCanceled:
+		name = "consumer_canceled"
+	case consumer.IsOverloaded(err):
+		name = "consumer_shed"
+	default:
+		name = "consumer_error"
+	}
+	metrics.Counter(name, "cluster", c.cfg.Cluster, "group", group, "topic", topic).Inc(1)
 }
 
 // String returns a string ID of this instance to be used in logs.
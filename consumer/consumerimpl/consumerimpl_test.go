@@ -1,7 +1,9 @@
 package consumerimpl
 
 import (
+	"context"
 	"fmt"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -16,6 +18,7 @@ import (
 	"github.com/mailgun/kafka-pixy/testhelpers"
 	"github.com/mailgun/kafka-pixy/testhelpers/kafkahelper"
 	"github.com/mailgun/log"
+	"github.com/pkg/errors"
 	. "gopkg.in/check.v1"
 )
 
@@ -68,12 +71,12 @@ func (s *ConsumerSuite) TestInitialOffsetTooLarge(c *C) {
 	om.SubmitOffset(offsetmgr.Offset{newestOffsets[0] + 3, ""})
 	om.Stop()
 
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
 	// When
-	_, err = sc.Consume("g1", "test.1")
+	_, err = sc.Consume(context.Background(), "g1", "test.1", 0)
 
 	// Then
 	c.Assert(err, Equals, consumer.ErrRequestTimeout)
@@ -91,7 +94,7 @@ func (s *ConsumerSuite) TestSinglePartitionTopic(c *C) {
 	s.kh.ResetOffsets("g1", "test.1")
 	produced := s.kh.PutMessages("single", "test.1", map[string]int{"": 3})
 
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
@@ -107,7 +110,7 @@ func (s *ConsumerSuite) TestSequentialConsume(c *C) {
 	s.kh.ResetOffsets("g1", "test.1")
 	produced := s.kh.PutMessages("sequencial", "test.1", map[string]int{"": 3})
 
-	sc1, err := Spawn(s.ns, s.cfg, s.omf)
+	sc1, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	log.Infof("*** GIVEN 1")
 	consumed := s.consume(c, sc1, "g1", "test.1", 2)
@@ -117,7 +120,7 @@ func (s *ConsumerSuite) TestSequentialConsume(c *C) {
 	// When: one consumer stopped and another one takes its place.
 	log.Infof("*** WHEN")
 	sc1.Stop()
-	sc2, err := Spawn(s.ns, s.cfg, s.omf)
+	sc2, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc2.Stop()
 
@@ -135,7 +138,7 @@ func (s *ConsumerSuite) TestMultiplePartitions(c *C) {
 	s.kh.PutMessages("multiple.partitions", "test.4", map[string]int{"A": 100, "B": 100})
 
 	log.Infof("*** GIVEN 1")
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
@@ -163,7 +166,7 @@ func (s *ConsumerSuite) TestMultipleTopics(c *C) {
 	produced4 := s.kh.PutMessages("multiple.topics", "test.4", map[string]int{"B": 1, "C": 1})
 
 	log.Infof("*** GIVEN 1")
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
@@ -189,7 +192,7 @@ func (s *ConsumerSuite) TestMultipleGroups(c *C) {
 	s.kh.PutMessages("multi", "test.4", map[string]int{"A": 10, "B": 10, "C": 10})
 
 	log.Infof("*** GIVEN 1")
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
@@ -212,7 +215,7 @@ func (s *ConsumerSuite) TestTooFewPartitions(c *C) {
 	s.kh.ResetOffsets("g1", "test.1")
 	produced := s.kh.PutMessages("few", "test.1", map[string]int{"": 3})
 
-	sc1, err := Spawn(s.ns, s.cfg, s.omf)
+	sc1, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc1.Stop()
 	log.Infof("*** GIVEN 1")
@@ -222,10 +225,10 @@ func (s *ConsumerSuite) TestTooFewPartitions(c *C) {
 
 	// When:
 	log.Infof("*** WHEN")
-	sc2, err := Spawn(s.ns, testhelpers.NewTestProxyCfg("c2"), s.omf)
+	sc2, err := Spawn(s.ns, testhelpers.NewTestProxyCfg("c2"), s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc2.Stop()
-	_, err = sc2.Consume("g1", "test.1")
+	_, err = sc2.Consume(context.Background(), "g1", "test.1", 0)
 
 	// Then: `consumer-2` request times out, when `consumer-1` requests keep
 	// return messages.
@@ -242,7 +245,7 @@ func (s *ConsumerSuite) TestRebalanceOnJoin(c *C) {
 	s.kh.ResetOffsets("g1", "test.4")
 	s.kh.PutMessages("join", "test.4", map[string]int{"A": 10, "B": 10})
 
-	sc1, err := Spawn(s.ns, s.cfg, s.omf)
+	sc1, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc1.Stop()
 
@@ -263,7 +266,7 @@ func (s *ConsumerSuite) TestRebalanceOnJoin(c *C) {
 
 	// When: another consumer joins the group rebalancing occurs.
 	log.Infof("*** WHEN")
-	sc2, err := Spawn(s.ns, testhelpers.NewTestProxyCfg("c2"), s.omf)
+	sc2, err := Spawn(s.ns, testhelpers.NewTestProxyCfg("c2"), s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc2.Stop()
 
@@ -293,7 +296,7 @@ func (s *ConsumerSuite) TestRebalanceOnLeave(c *C) {
 	var err error
 	consumers := make([]*t, 3)
 	for i := 0; i < 3; i++ {
-		consumers[i], err = Spawn(s.ns, testhelpers.NewTestProxyCfg(fmt.Sprintf("c%d", i)), s.omf)
+		consumers[i], err = Spawn(s.ns, testhelpers.NewTestProxyCfg(fmt.Sprintf("c%d", i)), s.omf, nil)
 		c.Assert(err, IsNil)
 	}
 	defer consumers[0].Stop()
@@ -369,13 +372,13 @@ func (s *ConsumerSuite) TestRebalanceOnTimeout(c *C) {
 	s.kh.ResetOffsets("g1", "test.4")
 	s.kh.PutMessages("timeout", "test.4", map[string]int{"A": 10, "B": 10})
 
-	sc0, err := Spawn(s.ns, s.cfg, s.omf)
+	sc0, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc0.Stop()
 
 	cfg2 := testhelpers.NewTestProxyCfg("c2")
 	cfg2.Consumer.RegistrationTimeout = 500 * time.Millisecond
-	sc1, err := Spawn(s.ns, cfg2, s.omf)
+	sc1, err := Spawn(s.ns, cfg2, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc1.Stop()
 
@@ -437,7 +440,7 @@ func (s *ConsumerSuite) TestTooManyRequestsError(c *C) {
 	s.kh.PutMessages("join", "test.1", map[string]int{"A": 30})
 
 	s.cfg.Consumer.ChannelBufferSize = 1
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
@@ -449,8 +452,8 @@ func (s *ConsumerSuite) TestTooManyRequestsError(c *C) {
 		go func() {
 			defer wg.Done()
 			for i := 0; i < 10; i++ {
-				_, err := sc.Consume("g1", "test.1")
-				if err == consumer.ErrTooManyRequests {
+				_, err := sc.Consume(context.Background(), "g1", "test.1", 0)
+				if errors.Cause(err) == consumer.ErrTooManyRequests {
 					atomic.AddInt32(&tooManyRequestsCount, 1)
 				}
 			}
@@ -468,28 +471,125 @@ func (s *ConsumerSuite) TestTooManyRequestsError(c *C) {
 func (s *ConsumerSuite) TestInvalidTopic(c *C) {
 	// Given
 	s.cfg.Consumer.LongPollingTimeout = 1 * time.Second
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
 	// When
-	_, err = sc.Consume("g1", "no-such-topic")
+	_, err = sc.Consume(context.Background(), "g1", "no-such-topic", 0)
 
 	// Then
 	c.Assert(err, Equals, consumer.ErrRequestTimeout)
 }
 
+// A consume request can override the long polling timeout, but it cannot wait
+// longer than `Config.Consumer.MaxLongPollingTimeout`.
+func (s *ConsumerSuite) TestRequestTimeout(c *C) {
+	// Given
+	s.cfg.Consumer.LongPollingTimeout = 3 * time.Second
+	s.cfg.Consumer.MaxLongPollingTimeout = 1500 * time.Millisecond
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
+	c.Assert(err, IsNil)
+	defer sc.Stop()
+
+	for i, tc := range []struct {
+		timeout time.Duration
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{timeout: 500 * time.Millisecond, minWait: 500 * time.Millisecond, maxWait: 1000 * time.Millisecond},
+		{timeout: 10 * time.Second, minWait: 1500 * time.Millisecond, maxWait: 2000 * time.Millisecond},
+	} {
+		begin := time.Now()
+
+		// When
+		_, err = sc.Consume(context.Background(), "g1", "no-such-topic", tc.timeout)
+
+		// Then
+		c.Assert(err, Equals, consumer.ErrRequestTimeout, Commentf("case #%d", i))
+		waited := time.Since(begin)
+		c.Assert(waited >= tc.minWait, Equals, true, Commentf("case #%d: waited=%v", i, waited))
+		c.Assert(waited < tc.maxWait, Equals, true, Commentf("case #%d: waited=%v", i, waited))
+	}
+}
+
+// A message is returned from whichever of the requested topics has one, and
+// the request times out if none of them do.
+func (s *ConsumerSuite) TestConsumeAny(c *C) {
+	// Given
+	s.kh.ResetOffsets("g1", "test.1")
+	s.kh.ResetOffsets("g1", "test.4")
+	produced := s.kh.PutMessages("any", "test.4", map[string]int{"A": 1})
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
+	c.Assert(err, IsNil)
+	defer sc.Stop()
+
+	// When
+	msg, err := sc.ConsumeAny(context.Background(), "g1", []string{"test.1", "test.4"}, 0)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(msg.Topic, Equals, "test.4")
+	assertMsg(c, msg, produced["A"][0])
+	msg.EventsCh <- consumer.Ack(msg.Offset)
+
+	// When
+	_, err = sc.ConsumeAny(context.Background(), "g1", []string{"test.1", "test.4"}, 500*time.Millisecond)
+
+	// Then
+	c.Assert(err, Equals, consumer.ErrRequestTimeout)
+}
+
+// A message is returned from whichever of the topics matching a pattern has
+// one, and the request times out if no topic matches.
+func (s *ConsumerSuite) TestConsumeMatching(c *C) {
+	// Given
+	s.kh.ResetOffsets("g1", "test.1")
+	s.kh.ResetOffsets("g1", "test.4")
+	s.kh.ResetOffsets("g1", "test.64")
+	produced := s.kh.PutMessages("matching", "test.4", map[string]int{"A": 1})
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
+	c.Assert(err, IsNil)
+	defer sc.Stop()
+
+	// When
+	msg, err := sc.ConsumeMatching(context.Background(), "g1", regexp.MustCompile(`^test\.\d$`), 0)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(msg.Topic, Equals, "test.4")
+	assertMsg(c, msg, produced["A"][0])
+	msg.EventsCh <- consumer.Ack(msg.Offset)
+
+	// When
+	_, err = sc.ConsumeMatching(context.Background(), "g1", regexp.MustCompile(`^no-such-topic-.*$`), 500*time.Millisecond)
+
+	// Then
+	c.Assert(err, Equals, consumer.ErrRequestTimeout)
+}
+
+// Internal Kafka topics are never matched.
+func (s *ConsumerSuite) TestMatchTopics(c *C) {
+	sc := &t{topics: []string{"__consumer_offsets", "foo.1", "foo.2", "bar.1"}}
+
+	// When
+	matched := sc.matchTopics(regexp.MustCompile(`^(?:.*\.1)$`))
+
+	// Then
+	c.Assert(matched, DeepEquals, []string{"foo.1", "bar.1"})
+}
+
 // A topic that has a lot of partitions can be consumed.
 func (s *ConsumerSuite) TestLotsOfPartitions(c *C) {
 	// Given
 	s.kh.ResetOffsets("g1", "test.64")
 
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
 
 	// Consume should stop by timeout and nothing should be consumed.
-	msg, err := sc.Consume("g1", "test.64")
+	msg, err := sc.Consume(context.Background(), "g1", "test.64", 0)
 	c.Assert(err, Equals, consumer.ErrRequestTimeout, Commentf("Unexpected message consumed, %v", msg))
 	s.kh.PutMessages("lots", "test.64", map[string]int{"A": 7, "B": 13, "C": 169})
 
@@ -512,12 +612,12 @@ func (s *ConsumerSuite) TestNewGroup(c *C) {
 	s.kh.PutMessages("rand", "test.1", map[string]int{"A1": 1})
 
 	group := fmt.Sprintf("g%d", time.Now().Unix())
-	sc, err := Spawn(s.ns, s.cfg, s.omf)
+	sc, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 
 	// The very first consumption of a group is terminated by timeout because
 	// the default offset is the topic head.
-	msg, err := sc.Consume(group, "test.1")
+	msg, err := sc.Consume(context.Background(), group, "test.1", 0)
 	c.Assert(err, Equals, consumer.ErrRequestTimeout, Commentf("Unexpected message consumed, %v", msg))
 
 	// When: consumer is stopped, the concrete head offset is committed.
@@ -526,10 +626,10 @@ func (s *ConsumerSuite) TestNewGroup(c *C) {
 	// Then: message produced after that will be consumed by the new consumer
 	// instance from the same group.
 	produced := s.kh.PutMessages("rand", "test.1", map[string]int{"A2": 1})
-	sc, err = Spawn(s.ns, s.cfg, s.omf)
+	sc, err = Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer sc.Stop()
-	msg, err = sc.Consume(group, "test.1")
+	msg, err = sc.Consume(context.Background(), group, "test.1", 0)
 	c.Assert(err, IsNil)
 	assertMsg(c, msg, produced["A2"][0])
 }
@@ -546,14 +646,14 @@ func (s *ConsumerSuite) TestTopicTimeout(c *C) {
 
 	s.cfg.Consumer.LongPollingTimeout = 3000 * time.Millisecond
 	s.cfg.Consumer.RegistrationTimeout = 10000 * time.Millisecond
-	cons1, err := Spawn(s.ns, s.cfg, s.omf)
+	cons1, err := Spawn(s.ns, s.cfg, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer cons1.Stop()
 
 	cfg2 := testhelpers.NewTestProxyCfg("c2")
 	cfg2.Consumer.LongPollingTimeout = 3000 * time.Millisecond
 	cfg2.Consumer.RegistrationTimeout = 10000 * time.Millisecond
-	cons2, err := Spawn(s.ns, cfg2, s.omf)
+	cons2, err := Spawn(s.ns, cfg2, s.omf, nil)
 	c.Assert(err, IsNil)
 	defer cons2.Stop()
 
@@ -565,7 +665,7 @@ func (s *ConsumerSuite) TestTopicTimeout(c *C) {
 	c.Assert(len(consumedTest1ByCons1["A"]), Equals, 1)
 	consumedTest4ByCons1 := s.consume(c, cons1, "g1", "test.4", 1)
 	c.Assert(len(consumedTest4ByCons1["B"]), Equals, 1)
-	_, err = cons2.Consume("g1", "test.1")
+	_, err = cons2.Consume(context.Background(), "g1", "test.1", 0)
 	c.Assert(err, Equals, consumer.ErrRequestTimeout)
 
 	delay := (5000 * time.Millisecond) - time.Now().Sub(start)
@@ -575,7 +675,7 @@ func (s *ConsumerSuite) TestTopicTimeout(c *C) {
 	log.Infof("*** GIVEN 2:")
 	consumedTest4ByCons1 = s.consume(c, cons1, "g1", "test.4", 1, consumedTest4ByCons1)
 	c.Assert(len(consumedTest4ByCons1["B"]), Equals, 2)
-	_, err = cons2.Consume("g1", "test.1")
+	_, err = cons2.Consume(context.Background(), "g1", "test.1", 0)
 	c.Assert(err, Equals, consumer.ErrRequestTimeout)
 
 	// When: wait for the cons1 subscription to test.1 topic to expire.
@@ -613,7 +713,7 @@ func (s *ConsumerSuite) consume(c *C, sc *t, group, topic string, count int,
 		consumed = extend[0]
 	}
 	for i := 0; i != count; i++ {
-		msg, err := sc.Consume(group, topic)
+		msg, err := sc.Consume(context.Background(), group, topic, 0)
 		if err == consumer.ErrRequestTimeout {
 			if count == consumeAll {
 				return consumed
@@ -1,6 +1,7 @@
 package dispatcher
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -21,10 +22,12 @@ type T struct {
 	cfg               *config.Proxy
 	factory           Factory
 	requestsCh        chan Request
+	childrenMu        sync.Mutex
 	children          map[string]*expiringTier
 	expiredChildrenCh chan Tier
 	stoppedChildrenCh chan Tier
-	wg                sync.WaitGroup
+	maxTierQueueLen   int
+	sup               *actor.Supervisor
 }
 
 type Request struct {
@@ -32,11 +35,27 @@ type Request struct {
 	Group      string
 	Topic      string
 	ResponseCh chan<- Response
+
+	// DoneCh is closed when the requester is no longer waiting for a
+	// response. Messages are never assigned to such requests. If nil, then
+	// the request is never canceled.
+	DoneCh <-chan struct{}
+
+	// Timeout is how long the request waits for a message. If zero, then
+	// `Config.Consumer.LongPollingTimeout` is used.
+	Timeout time.Duration
+
+	// If MaxMessages is positive then up to that many messages are returned
+	// in `Response.Msgs`, but no more after their total size reaches
+	// MaxBytes, if it is positive.
+	MaxMessages int
+	MaxBytes    int
 }
 
 type Response struct {
-	Msg consumer.Message
-	Err error
+	Msg  consumer.Message
+	Msgs []consumer.Message
+	Err  error
 }
 
 // Factory defines an interface to create Tiers.
@@ -48,6 +67,10 @@ type Factory interface {
 	// NewTier creates a new dispatch tier to handle requests with the
 	// specified dispatch key.
 	NewTier(key string) Tier
+
+	// RegistrationTimeout returns how long a tier with the specified dispatch
+	// key lives in the absence of requests to it.
+	RegistrationTimeout(key string) time.Duration
 }
 
 // Tier defines a consume request handling tier interface.
@@ -58,6 +81,11 @@ type Tier interface {
 	// Requests returns a channel to send requests dispatched to the tier to.
 	Requests() chan<- Request
 
+	// QueueLen returns the number of requests queued in the tier and all its
+	// downstream tiers waiting to be handled. It can be called from any
+	// goroutine.
+	QueueLen() int
+
 	// Start spins up the tier's goroutine(s).
 	Start(stoppedCh chan<- Tier)
 
@@ -79,7 +107,10 @@ type expiringTier struct {
 	expired   bool
 }
 
-func New(namespace *actor.ID, factory Factory, cfg *config.Proxy) *T {
+// New creates a dispatcher. If `maxTierQueueLen` is positive then requests
+// to a downstream tier that has that many requests queued are rejected with
+// `consumer.OverloadedError`.
+func New(namespace *actor.ID, factory Factory, cfg *config.Proxy, maxTierQueueLen int) *T {
 	d := &T{
 		actorID:           namespace.NewChild("dispatcher"),
 		cfg:               cfg,
@@ -88,26 +119,53 @@ func New(namespace *actor.ID, factory Factory, cfg *config.Proxy) *T {
 		children:          make(map[string]*expiringTier),
 		expiredChildrenCh: make(chan Tier, cfg.Consumer.ChannelBufferSize),
 		stoppedChildrenCh: make(chan Tier, cfg.Consumer.ChannelBufferSize),
+		maxTierQueueLen:   maxTierQueueLen,
 	}
+	d.sup = actor.NewSupervisor(d.actorID, actor.RestartPolicy{}, nil)
 	return d
 }
 
 func (d *T) Start() {
-	actor.Spawn(d.actorID, &d.wg, d.run)
+	d.sup.Spawn(d.actorID, d.run)
 }
 
 func (d *T) Stop() {
 	close(d.requestsCh)
-	d.wg.Wait()
+	d.sup.Wait()
 }
 
 func (d *T) Requests() chan<- Request {
 	return d.requestsCh
 }
 
+// QueueLen returns the number of requests queued in the dispatcher and all
+// downstream tiers.
+func (d *T) QueueLen() int {
+	d.childrenMu.Lock()
+	defer d.childrenMu.Unlock()
+	queueLen := len(d.requestsCh)
+	for _, et := range d.children {
+		queueLen += et.queueLen()
+	}
+	return queueLen
+}
+
+// Tiers returns downstream tiers that are currently running, sorted by their
+// dispatch keys. It can be called from any goroutine.
+func (d *T) Tiers() []Tier {
+	d.childrenMu.Lock()
+	tiers := make([]Tier, 0, len(d.children))
+	for _, et := range d.children {
+		tiers = append(tiers, et.instance)
+	}
+	d.childrenMu.Unlock()
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Key() < tiers[j].Key() })
+	return tiers
+}
+
 // run receives consume requests from the `Requests()` channel and dispatches
 // them to downstream tiers based on request dispatch key.
-func (d *T) run() {
+func (d *T) run() error {
 	for {
 		select {
 		case req, ok := <-d.requestsCh:
@@ -115,6 +173,17 @@ func (d *T) run() {
 				goto done
 			}
 			dt := d.resolveTier(req)
+			if err := d.shedLoad(dt); err != nil {
+				req.ResponseCh <- Response{Err: err}
+				continue
+			}
+			// A tier that has more requests queued than its fair share is
+			// not allowed to take more, otherwise it could monopolize the
+			// downstream capacity.
+			if d.exceedsFairShare(dt) {
+				req.ResponseCh <- Response{Err: consumer.ErrTooManyRequests}
+				continue
+			}
 			// If the requests buffer is full then either the callers are
 			// pulling too aggressively or the Kafka is experiencing issues.
 			// Either way we reject requests right away and callers are
@@ -148,12 +217,53 @@ done:
 			go successor.Stop()
 		}
 	}
+	return nil
+}
+
+// shedLoad returns an overloaded error if a downstream tier has more requests
+// queued than allowed by `maxTierQueueLen`. Such requests are likely to time
+// out anyway, so it is better to let the client know right away.
+func (d *T) shedLoad(dt Tier) error {
+	if d.maxTierQueueLen <= 0 {
+		return nil
+	}
+	queueLen := dt.QueueLen()
+	if queueLen < d.maxTierQueueLen {
+		return nil
+	}
+	return &consumer.OverloadedError{Key: dt.Key(), QueueLen: queueLen, Threshold: d.maxTierQueueLen}
+}
+
+// exceedsFairShare checks if a downstream tier has used up its fair share of
+// `Consumer.MaxQueuedRequests`. As long as the total number of queued requests
+// is below the limit any tier can take more requests. When the limit is
+// reached the limit is split evenly between tiers that have queued requests.
+func (d *T) exceedsFairShare(dt Tier) bool {
+	maxQueued := d.cfg.Consumer.MaxQueuedRequests
+	if maxQueued <= 0 {
+		return false
+	}
+	totalQueued, activeCount := 0, 0
+	for _, et := range d.children {
+		if queueLen := et.queueLen(); queueLen > 0 {
+			totalQueued += queueLen
+			activeCount += 1
+		}
+	}
+	if totalQueued < maxQueued {
+		return false
+	}
+	queueLen := dt.QueueLen()
+	if queueLen == 0 {
+		activeCount += 1
+	}
+	return queueLen >= maxQueued/activeCount
 }
 
 func (d *T) newExpiringTier(parent Factory, key string) *expiringTier {
 	dt := parent.NewTier(key)
 	dt.Start(d.stoppedChildrenCh)
-	timeout := d.cfg.Consumer.RegistrationTimeout
+	timeout := parent.RegistrationTimeout(key)
 	et := &expiringTier{
 		d:        d,
 		factory:  parent,
@@ -173,13 +283,18 @@ func (d *T) resolveTier(req Request) Tier {
 	et := d.children[childKey]
 	if et == nil {
 		et = d.newExpiringTier(d.factory, childKey)
+		d.childrenMu.Lock()
 		d.children[childKey] = et
+		d.childrenMu.Unlock()
 	}
-	if !et.expired && et.timer.Reset(et.d.cfg.Consumer.RegistrationTimeout) {
+	if !et.expired && et.timer.Reset(et.factory.RegistrationTimeout(childKey)) {
 		return et.instance
 	}
 	if et.successor == nil {
-		et.successor = et.factory.NewTier(et.instance.Key())
+		successor := et.factory.NewTier(et.instance.Key())
+		d.childrenMu.Lock()
+		et.successor = successor
+		d.childrenMu.Unlock()
 	}
 	return et.successor
 }
@@ -206,6 +321,8 @@ func (d *T) handleStopped(dt Tier) Tier {
 	if et == nil {
 		return nil
 	}
+	d.childrenMu.Lock()
+	defer d.childrenMu.Unlock()
 	successor := et.successor
 	if successor == nil {
 		delete(d.children, dt.Key())
@@ -216,7 +333,17 @@ func (d *T) handleStopped(dt Tier) Tier {
 	et.instance = successor
 	et.successor = nil
 	successor.Start(et.d.stoppedChildrenCh)
-	timeout := et.d.cfg.Consumer.RegistrationTimeout
+	timeout := et.factory.RegistrationTimeout(successor.Key())
 	et.timer = time.AfterFunc(timeout, func() { et.d.expiredChildrenCh <- successor })
 	return et.instance
 }
+
+// queueLen returns the number of requests queued in the tier instance and its
+// successor if there is one.
+func (et *expiringTier) queueLen() int {
+	queueLen := et.instance.QueueLen()
+	if et.successor != nil {
+		queueLen += et.successor.QueueLen()
+	}
+	return queueLen
+}
@@ -0,0 +1,224 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/testhelpers"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type DispatcherSuite struct {
+	ns  *actor.ID
+	cfg *config.Proxy
+}
+
+var _ = Suite(&DispatcherSuite{})
+
+func (s *DispatcherSuite) SetUpSuite(c *C) {
+	testhelpers.InitLogging(c)
+}
+
+func (s *DispatcherSuite) SetUpTest(c *C) {
+	s.ns = actor.RootID.NewChild("T")
+	s.cfg = config.DefaultProxy()
+	s.cfg.Consumer.ChannelBufferSize = 10
+	s.cfg.Consumer.MaxQueuedRequests = 8
+}
+
+// When the total number of queued requests reaches the limit, then it is
+// split evenly between tiers that have requests queued.
+func (s *DispatcherSuite) TestFairShare(c *C) {
+	f := newMockFactory()
+	d := New(s.ns, f, s.cfg, 0)
+	d.Start()
+	defer d.Stop()
+
+	// The first tier can take up the entire limit while it is alone.
+	for i := 0; i < 8; i++ {
+		c.Assert(s.dispatch(d, "A"), IsNil, Commentf("#%d", i))
+	}
+	c.Assert(s.dispatch(d, "A"), Equals, consumer.ErrTooManyRequests)
+
+	// But as soon as another tier gets requests, the limit is shared.
+	for i := 0; i < 4; i++ {
+		c.Assert(s.dispatch(d, "B"), IsNil, Commentf("#%d", i))
+	}
+	c.Assert(s.dispatch(d, "B"), Equals, consumer.ErrTooManyRequests)
+	c.Assert(s.dispatch(d, "A"), Equals, consumer.ErrTooManyRequests)
+
+	// When some of the requests are handled, then the tier can take more.
+	f.tier("A").drain(6)
+	c.Assert(s.dispatch(d, "A"), IsNil)
+	c.Assert(d.QueueLen(), Equals, 7)
+}
+
+// If fair sharing is disabled, then requests are only limited by tier queue
+// capacity.
+func (s *DispatcherSuite) TestFairShareDisabled(c *C) {
+	s.cfg.Consumer.MaxQueuedRequests = 0
+	f := newMockFactory()
+	d := New(s.ns, f, s.cfg, 0)
+	d.Start()
+	defer d.Stop()
+
+	for i := 0; i < 10; i++ {
+		c.Assert(s.dispatch(d, "A"), IsNil, Commentf("#%d", i))
+	}
+	c.Assert(s.dispatch(d, "A"), Equals, consumer.ErrTooManyRequests)
+	c.Assert(s.dispatch(d, "B"), IsNil)
+	c.Assert(d.QueueLen(), Equals, 11)
+}
+
+// Requests to a tier that has `maxTierQueueLen` requests queued are rejected
+// with an overloaded error.
+func (s *DispatcherSuite) TestLoadShedding(c *C) {
+	s.cfg.Consumer.MaxQueuedRequests = 0
+	f := newMockFactory()
+	d := New(s.ns, f, s.cfg, 3)
+	d.Start()
+	defer d.Stop()
+
+	for i := 0; i < 3; i++ {
+		c.Assert(s.dispatch(d, "A"), IsNil, Commentf("#%d", i))
+	}
+
+	// When
+	err := s.dispatch(d, "A")
+
+	// Then
+	c.Assert(consumer.IsOverloaded(err), Equals, true)
+	c.Assert(err.Error(), Equals, "Overloaded, back off and retry later: key=A, queued=3, threshold=3")
+	// Other tiers are not affected.
+	c.Assert(s.dispatch(d, "B"), IsNil)
+	// Shedding stops as soon as the queue is shorter than the threshold.
+	f.tier("A").drain(1)
+	c.Assert(s.dispatch(d, "A"), IsNil)
+}
+
+// Running tiers are listed in the order of their keys.
+func (s *DispatcherSuite) TestTiers(c *C) {
+	f := newMockFactory()
+	d := New(s.ns, f, s.cfg, 0)
+	d.Start()
+	defer d.Stop()
+	c.Assert(d.Tiers(), HasLen, 0)
+
+	// When
+	for _, group := range []string{"C", "A", "B", "A"} {
+		c.Assert(s.dispatch(d, group), IsNil)
+	}
+
+	// Then
+	var keys []string
+	var queueLens []int
+	for _, tier := range d.Tiers() {
+		keys = append(keys, tier.Key())
+		queueLens = append(queueLens, tier.QueueLen())
+	}
+	c.Assert(keys, DeepEquals, []string{"A", "B", "C"})
+	c.Assert(queueLens, DeepEquals, []int{2, 1, 1})
+}
+
+// Tiers expire after the registration timeout that the factory returns for
+// their keys.
+func (s *DispatcherSuite) TestRegistrationTimeout(c *C) {
+	f := newMockFactory()
+	f.timeouts["A"] = 100 * time.Millisecond
+	d := New(s.ns, f, s.cfg, 0)
+	d.Start()
+	defer d.Stop()
+	c.Assert(s.dispatch(d, "A"), IsNil)
+	c.Assert(s.dispatch(d, "B"), IsNil)
+
+	// When
+	time.Sleep(300 * time.Millisecond)
+
+	// Then
+	var keys []string
+	for _, tier := range d.Tiers() {
+		keys = append(keys, tier.Key())
+	}
+	c.Assert(keys, DeepEquals, []string{"B"})
+}
+
+// dispatch sends a request to the dispatcher and returns an error if the
+// request has been rejected, or nil if it was queued to a tier.
+func (s *DispatcherSuite) dispatch(d *T, group string) error {
+	responseCh := make(chan Response, 1)
+	d.Requests() <- Request{Timestamp: time.Now(), Group: group, Topic: "foo", ResponseCh: responseCh}
+	select {
+	case rs := <-responseCh:
+		return rs.Err
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+type mockFactory struct {
+	tiers    chan *mockTier
+	byKey    map[string]*mockTier
+	timeouts map[string]time.Duration
+}
+
+func newMockFactory() *mockFactory {
+	return &mockFactory{
+		tiers:    make(chan *mockTier, 100),
+		byKey:    make(map[string]*mockTier),
+		timeouts: make(map[string]time.Duration),
+	}
+}
+
+func (f *mockFactory) KeyOf(req Request) string {
+	return req.Group
+}
+
+func (f *mockFactory) NewTier(key string) Tier {
+	mt := &mockTier{key: key, requestsCh: make(chan Request, 10)}
+	f.tiers <- mt
+	return mt
+}
+
+func (f *mockFactory) RegistrationTimeout(key string) time.Duration {
+	if timeout, ok := f.timeouts[key]; ok {
+		return timeout
+	}
+	return time.Minute
+}
+
+func (f *mockFactory) tier(key string) *mockTier {
+	for {
+		select {
+		case mt := <-f.tiers:
+			f.byKey[mt.key] = mt
+		default:
+			return f.byKey[key]
+		}
+	}
+}
+
+// mockTier just queues requests until explicitly drained.
+type mockTier struct {
+	key        string
+	requestsCh chan Request
+	stoppedCh  chan<- Tier
+}
+
+func (mt *mockTier) Key() string                 { return mt.key }
+func (mt *mockTier) Requests() chan<- Request    { return mt.requestsCh }
+func (mt *mockTier) QueueLen() int               { return len(mt.requestsCh) }
+func (mt *mockTier) Start(stoppedCh chan<- Tier) { mt.stoppedCh = stoppedCh }
+func (mt *mockTier) Stop()                       { mt.stoppedCh <- mt }
+
+func (mt *mockTier) drain(n int) {
+	for i := 0; i < n; i++ {
+		<-mt.requestsCh
+	}
+}
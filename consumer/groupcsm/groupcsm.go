@@ -2,6 +2,7 @@ package groupcsm
 
 import (
 	"fmt"
+	"hash/fnv"
 	"sort"
 	"sync"
 	"time"
@@ -9,13 +10,14 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/dispatcher"
 	"github.com/mailgun/kafka-pixy/consumer/groupmember"
 	"github.com/mailgun/kafka-pixy/consumer/msgfetcher"
 	"github.com/mailgun/kafka-pixy/consumer/multiplexer"
 	"github.com/mailgun/kafka-pixy/consumer/partitioncsm"
 	"github.com/mailgun/kafka-pixy/consumer/topiccsm"
-	"github.com/mailgun/kafka-pixy/none"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/kafka-pixy/offsetmgr"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
@@ -37,18 +39,28 @@ type T struct {
 	kazooClt           *kazoo.Kazoo
 	msgFetcherF        msgfetcher.Factory
 	offsetMgrF         offsetmgr.Factory
+	deadLetterer       consumer.DeadLetterer
+	initialOffset      config.InitialOffset
 	groupMember        *groupmember.T
 	multiplexers       map[string]*multiplexer.T
 	topicCsmLifespanCh chan *topiccsm.T
-	stopCh             chan none.T
-	wg                 sync.WaitGroup
+	sup                *actor.Supervisor
+
+	// Reported by State.
+	stateMu       sync.Mutex
+	subscriptions map[string][]string
+	partitionCsms map[string]map[int32]*partitioncsm.T
 
 	// Exist just to be overridden in tests with mocks.
 	fetchTopicPartitionsFn func(topic string) ([]int32, error)
 }
 
+// New creates a group consumer. If `initialOffset` is empty, then partitions
+// of each topic are consumed with the initial offset policy configured for
+// the group and the topic.
 func New(namespace *actor.ID, group string, cfg *config.Proxy, kafkaClt sarama.Client,
-	kazooClt *kazoo.Kazoo, offsetMgrF offsetmgr.Factory,
+	kazooClt *kazoo.Kazoo, offsetMgrF offsetmgr.Factory, deadLetterer consumer.DeadLetterer,
+	initialOffset config.InitialOffset,
 ) *T {
 	supervisorActorID := namespace.NewChild(fmt.Sprintf("G:%s", group))
 	gc := &T{
@@ -59,13 +71,16 @@ func New(namespace *actor.ID, group string, cfg *config.Proxy, kafkaClt sarama.C
 		kafkaClt:           kafkaClt,
 		kazooClt:           kazooClt,
 		offsetMgrF:         offsetMgrF,
+		deadLetterer:       deadLetterer,
+		initialOffset:      initialOffset,
 		multiplexers:       make(map[string]*multiplexer.T),
 		topicCsmLifespanCh: make(chan *topiccsm.T),
-		stopCh:             make(chan none.T),
+		partitionCsms:      make(map[string]map[int32]*partitioncsm.T),
+		sup:                actor.NewSupervisor(supervisorActorID, actor.RestartPolicy{}, nil),
 
 		fetchTopicPartitionsFn: kafkaClt.Partitions,
 	}
-	gc.dispatcher = dispatcher.New(gc.supActorID, gc, cfg)
+	gc.dispatcher = dispatcher.New(gc.supActorID, gc, cfg, cfg.Consumer.LoadShedding.MaxTopicQueueDepth)
 	return gc
 }
 
@@ -80,6 +95,20 @@ func (gc *T) NewTier(key string) dispatcher.Tier {
 	return tc
 }
 
+// topicInitialOffset returns the initial offset policy to consume partitions
+// of the specified topic with.
+func (gc *T) topicInitialOffset(topic string) config.InitialOffset {
+	if gc.initialOffset != "" {
+		return gc.initialOffset
+	}
+	return gc.cfg.ConsumerParams(gc.group, topic).InitialOffset
+}
+
+// implements `dispatcher.Factory`.
+func (gc *T) RegistrationTimeout(key string) time.Duration {
+	return gc.cfg.ConsumerParams(gc.group, key).RegistrationTimeout
+}
+
 // implements `dispatcher.Tier`.
 func (gc *T) Key() string {
 	return gc.group
@@ -90,33 +119,70 @@ func (gc *T) Requests() chan<- dispatcher.Request {
 	return gc.dispatcher.Requests()
 }
 
+// implements `dispatcher.Tier`.
+func (gc *T) QueueLen() int {
+	return gc.dispatcher.QueueLen()
+}
+
 // implements `dispatcher.Tier`.
 func (gc *T) Start(stoppedCh chan<- dispatcher.Tier) {
-	actor.Spawn(gc.supActorID, &gc.wg, func() {
+	gc.sup.Spawn(gc.supActorID, func() error {
 		defer func() { stoppedCh <- gc }()
 		var err error
 		gc.msgFetcherF, err = msgfetcher.SpawnFactory(gc.supActorID, gc.cfg, gc.kafkaClt)
 		if err != nil {
 			// Must never happen.
-			panic(errors.Wrap(err, "failed to create sarama.Consumer"))
+			return errors.Wrap(err, "failed to create sarama.Consumer")
 		}
-		gc.groupMember = groupmember.Spawn(gc.supActorID, gc.group, gc.cfg.ClientID, gc.cfg, gc.kazooClt)
+		gc.groupMember = groupmember.Spawn(gc.supActorID, gc.group, gc.cfg.GroupMemberID(gc.group), gc.cfg, gc.kazooClt)
 		var manageWg sync.WaitGroup
 		actor.Spawn(gc.mgrActorID, &manageWg, gc.runManager)
 		gc.dispatcher.Start()
 		// Wait for a stop signal and shutdown gracefully when one is received.
-		<-gc.stopCh
+		<-gc.sup.StopCh()
 		gc.dispatcher.Stop()
 		gc.groupMember.Stop()
 		manageWg.Wait()
 		gc.msgFetcherF.Stop()
+		return nil
 	})
 }
 
 // implements `dispatcher.Tier`.
 func (gc *T) Stop() {
-	close(gc.stopCh)
-	gc.wg.Wait()
+	gc.sup.Stop()
+}
+
+// State returns a snapshot of the group consumer state. It can be called from
+// any goroutine.
+func (gc *T) State() consumer.GroupState {
+	state := consumer.GroupState{Group: gc.group, QueueLen: gc.dispatcher.QueueLen()}
+	topicStates := make(map[string]*consumer.TopicState)
+	for _, tier := range gc.dispatcher.Tiers() {
+		topicStates[tier.Key()] = &consumer.TopicState{Topic: tier.Key(), QueueLen: tier.QueueLen()}
+	}
+	gc.stateMu.Lock()
+	state.Subscriptions = gc.subscriptions
+	for topic, pcs := range gc.partitionCsms {
+		ts := topicStates[topic]
+		if ts == nil {
+			ts = &consumer.TopicState{Topic: topic}
+			topicStates[topic] = ts
+		}
+		for _, pc := range pcs {
+			ts.Partitions = append(ts.Partitions, pc.State())
+		}
+	}
+	gc.stateMu.Unlock()
+
+	for _, ts := range topicStates {
+		sort.Slice(ts.Partitions, func(i, j int) bool {
+			return ts.Partitions[i].Partition < ts.Partitions[j].Partition
+		})
+		state.Topics = append(state.Topics, *ts)
+	}
+	sort.Slice(state.Topics, func(i, j int) bool { return state.Topics[i].Topic < state.Topics[j].Topic })
+	return state
 }
 
 // String return string ID of this group consumer to be posted in logs.
@@ -163,6 +229,9 @@ func (gc *T) runManager() {
 				stopped = true
 				continue
 			}
+			gc.stateMu.Lock()
+			gc.subscriptions = subscriptions
+			gc.stateMu.Unlock()
 			rebalancingRequired = true
 		case err := <-rebalanceResultCh:
 			rebalancingInProgress = false
@@ -208,13 +277,18 @@ done:
 		}(mux)
 	}
 	wg.Wait()
+	gc.stateMu.Lock()
+	gc.partitionCsms = make(map[string]map[int32]*partitioncsm.T)
+	gc.stateMu.Unlock()
 }
 
 func (gc *T) runRebalancing(actorID *actor.ID, topicConsumers map[string]*topiccsm.T,
 	subscriptions map[string][]string, rebalanceResultCh chan<- error,
 ) {
+	begin := time.Now()
 	assignedPartitions, err := gc.resolvePartitions(subscriptions)
 	if err != nil {
+		metrics.Counter("consumer_rebalance_failed", "cluster", gc.cfg.Cluster, "group", gc.group).Inc(1)
 		rebalanceResultCh <- err
 		return
 	}
@@ -235,25 +309,59 @@ func (gc *T) runRebalancing(actorID *actor.ID, topicConsumers map[string]*topicc
 		}
 		topic := topic
 		spawnInFn := func(partition int32) multiplexer.In {
-			return partitioncsm.Spawn(gc.supActorID, gc.group, topic, partition,
-				gc.cfg, gc.groupMember, gc.msgFetcherF, gc.offsetMgrF)
+			pc := partitioncsm.Spawn(gc.supActorID, gc.group, topic, partition,
+				gc.cfg, gc.groupMember, gc.msgFetcherF, gc.offsetMgrF, gc.deadLetterer, gc.topicInitialOffset(topic))
+			gc.stateMu.Lock()
+			if gc.partitionCsms[topic] == nil {
+				gc.partitionCsms[topic] = make(map[int32]*partitioncsm.T)
+			}
+			gc.partitionCsms[topic][partition] = pc
+			gc.stateMu.Unlock()
+			return pc
 		}
-		mux = multiplexer.New(gc.supActorID, spawnInFn)
+		mux = multiplexer.New(gc.supActorID, gc.cfg.Consumer.MuxPolicy, spawnInFn)
 		gc.rewireMuxAsync(topic, &wg, mux, tc, assignedTopicPartitions)
 		gc.multiplexers[topic] = mux
 	}
 	wg.Wait()
+	gc.forgetStoppedPartitions(topicConsumers, assignedPartitions)
 	// Clean up gears for topics that do not have assigned partitions anymore.
 	for topic, mux := range gc.multiplexers {
 		if !mux.IsRunning() {
 			delete(gc.multiplexers, topic)
 		}
 	}
+	metrics.Counter("consumer_rebalance", "cluster", gc.cfg.Cluster, "group", gc.group).Inc(1)
+	metrics.Histogram("consumer_rebalance_ms", "cluster", gc.cfg.Cluster, "group", gc.group).Update(int64(time.Since(begin) / time.Millisecond))
 	// Notify the caller that rebalancing has completed successfully.
 	rebalanceResultCh <- nil
 	return
 }
 
+// forgetStoppedPartitions drops partition consumers that have been stopped by
+// rebalancing from the ones reported by State, that is those of partitions
+// that are no longer assigned, or of topics that are no longer consumed.
+func (gc *T) forgetStoppedPartitions(topicConsumers map[string]*topiccsm.T, assignedPartitions map[string][]int32) {
+	gc.stateMu.Lock()
+	defer gc.stateMu.Unlock()
+	for topic, pcs := range gc.partitionCsms {
+		assigned := make(map[int32]bool, len(assignedPartitions[topic]))
+		if topicConsumers[topic] != nil {
+			for _, partition := range assignedPartitions[topic] {
+				assigned[partition] = true
+			}
+		}
+		for partition := range pcs {
+			if !assigned[partition] {
+				delete(pcs, partition)
+			}
+		}
+		if len(pcs) == 0 {
+			delete(gc.partitionCsms, topic)
+		}
+	}
+}
+
 // rewireMuxAsync calls muxInputs in another goroutine.
 func (gc *T) rewireMuxAsync(topic string, wg *sync.WaitGroup, mux *multiplexer.T, tc *topiccsm.T, assigned []int32) {
 	actor.Spawn(gc.supActorID.NewChild("rewire", topic), wg, func() {
@@ -280,8 +388,9 @@ func (gc *T) resolvePartitions(subscriptions map[string][]string) (
 		}
 	}
 	// Create a set of topics this consumer group member subscribed to.
+	memberID := gc.cfg.GroupMemberID(gc.group)
 	subscribedTopics := make(map[string]bool)
-	for _, topic := range subscriptions[gc.cfg.ClientID] {
+	for _, topic := range subscriptions[memberID] {
 		subscribedTopics[topic] = true
 	}
 	// Resolve new partition assignments for all subscribed topics.
@@ -291,8 +400,13 @@ func (gc *T) resolvePartitions(subscriptions map[string][]string) (
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to get partition list, topic=%s", topic)
 		}
-		subscribersToPartitions := assignTopicPartitions(topicPartitions, topicsToMembers[topic])
-		assignedTopicPartitions := subscribersToPartitions[gc.cfg.ClientID]
+		var subscribersToPartitions map[string][]int32
+		if gc.cfg.Consumer.AssignmentStrategy == config.AssignmentSticky {
+			subscribersToPartitions = assignTopicPartitionsSticky(topic, topicPartitions, topicsToMembers[topic])
+		} else {
+			subscribersToPartitions = assignTopicPartitions(topicPartitions, topicsToMembers[topic])
+		}
+		assignedTopicPartitions := subscribersToPartitions[memberID]
 		if len(assignedTopicPartitions) > 0 {
 			assignedPartitions[topic] = assignedTopicPartitions
 		}
@@ -335,6 +449,88 @@ func assignTopicPartitions(partitions []int32, subscribers []string) map[string]
 	return subscribersToPartitions
 }
 
+// assignTopicPartitionsSticky divides topic partitions among all consumer
+// group members subscribed to the topic as evenly as assignTopicPartitions
+// does, but so that a change in the subscriber list moves a lot less
+// partitions between members. Every member gets a pseudo random weight for
+// every partition by rendezvous hashing, and member-partition pairs are
+// considered in the descending order of their weights. A partition goes to
+// the member of the first pair that has not got its share of partitions yet.
+// Since the result depends on the subscriber list only, all members come up
+// with the same assignment on their own, without sharing any state.
+func assignTopicPartitionsSticky(topic string, partitions []int32, subscribers []string) map[string][]int32 {
+	partitionCount := len(partitions)
+	subscriberCount := len(subscribers)
+	if partitionCount == 0 || subscriberCount == 0 {
+		return nil
+	}
+	sort.Sort(Int32Slice(partitions))
+	sort.Sort(sort.StringSlice(subscribers))
+
+	candidates := make([]assignmentCandidate, 0, partitionCount*subscriberCount)
+	for _, groupMemberID := range subscribers {
+		for _, partition := range partitions {
+			weight := rendezvousWeight(groupMemberID, topic, partition)
+			candidates = append(candidates, assignmentCandidate{groupMemberID, partition, weight})
+		}
+	}
+	sort.Sort(assignmentCandidatesByWeight(candidates))
+
+	subscribersToPartitions := make(map[string][]int32, subscriberCount)
+	assigned := make(map[int32]bool, partitionCount)
+	partitionsPerSubscriber := partitionCount / subscriberCount
+	// First every subscriber gets partitionsPerSubscriber partitions, and
+	// then the remaining partitions are given one per subscriber.
+	for _, capacity := range []int{partitionsPerSubscriber, partitionsPerSubscriber + 1} {
+		for _, ac := range candidates {
+			if assigned[ac.partition] || len(subscribersToPartitions[ac.groupMemberID]) >= capacity {
+				continue
+			}
+			subscribersToPartitions[ac.groupMemberID] = append(subscribersToPartitions[ac.groupMemberID], ac.partition)
+			assigned[ac.partition] = true
+		}
+	}
+	for _, memberPartitions := range subscribersToPartitions {
+		sort.Sort(Int32Slice(memberPartitions))
+	}
+	return subscribersToPartitions
+}
+
+type assignmentCandidate struct {
+	groupMemberID string
+	partition     int32
+	weight        uint64
+}
+
+type assignmentCandidatesByWeight []assignmentCandidate
+
+func (p assignmentCandidatesByWeight) Len() int      { return len(p) }
+func (p assignmentCandidatesByWeight) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p assignmentCandidatesByWeight) Less(i, j int) bool {
+	if p[i].weight != p[j].weight {
+		return p[i].weight > p[j].weight
+	}
+	// Weights are practically never equal, but the order must be
+	// deterministic even then.
+	if p[i].groupMemberID != p[j].groupMemberID {
+		return p[i].groupMemberID < p[j].groupMemberID
+	}
+	return p[i].partition < p[j].partition
+}
+
+// rendezvousWeight returns a pseudo random weight of a group member for a
+// topic partition.
+func rendezvousWeight(groupMemberID, topic string, partition int32) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", groupMemberID, topic, partition)
+	// FNV hashes of strings that differ in the last characters only are
+	// poorly distributed, so the hash is scrambled with splitmix64 finalizer.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
 func listTopics(topicConsumers map[string]*topiccsm.T) []string {
 	topics := make([]string, 0, len(topicConsumers))
 	for topic := range topicConsumers {
@@ -2,6 +2,8 @@ package groupcsm
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/mailgun/kafka-pixy/actor"
@@ -90,6 +92,76 @@ func (s *GroupConsumerSuite) TestAssignTopicPartitions(c *C) {
 		})
 }
 
+func (s *GroupConsumerSuite) TestAssignTopicPartitionsSticky(c *C) {
+	c.Assert(assignTopicPartitionsSticky("t", nil, nil), IsNil)
+	c.Assert(assignTopicPartitionsSticky("t", nil, []string{"a"}), IsNil)
+	c.Assert(assignTopicPartitionsSticky("t", []int32{1}, nil), IsNil)
+	c.Assert(assignTopicPartitionsSticky("t", []int32{1}, []string{}), IsNil)
+
+	c.Assert(assignTopicPartitionsSticky("t", []int32{1, 2, 0}, []string{"a"}),
+		DeepEquals, map[string][]int32{
+			"a": {0, 1, 2},
+		})
+	for _, partitionCount := range []int{1, 2, 5, 12, 31} {
+		for subscriberCount := 1; subscriberCount <= 7; subscriberCount++ {
+			comment := Commentf("partitions=%d, subscribers=%d", partitionCount, subscriberCount)
+			partitions, subscribers := makePartitions(partitionCount), makeSubscribers(subscriberCount)
+
+			// When
+			assigned := assignTopicPartitionsSticky("t", partitions, subscribers)
+
+			// Then: partitions are divided as evenly as possible...
+			minCount, maxCount := partitionCount/subscriberCount, (partitionCount+subscriberCount-1)/subscriberCount
+			owners := make(map[int32]string)
+			for _, subscriber := range subscribers {
+				memberPartitions := assigned[subscriber]
+				c.Assert(len(memberPartitions) >= minCount && len(memberPartitions) <= maxCount, Equals, true, comment)
+				for _, partition := range memberPartitions {
+					_, ok := owners[partition]
+					c.Assert(ok, Equals, false, comment)
+					owners[partition] = subscriber
+				}
+			}
+			c.Assert(len(owners), Equals, partitionCount, comment)
+			// ...and the result does not depend on the input order.
+			reverseInt32s(partitions)
+			reverseStrings(subscribers)
+			c.Assert(assignTopicPartitionsSticky("t", partitions, subscribers), DeepEquals, assigned, comment)
+		}
+	}
+}
+
+// When members join or leave a group, the sticky strategy moves less
+// partitions between members than the range strategy does.
+func (s *GroupConsumerSuite) TestAssignTopicPartitionsStickyMoves(c *C) {
+	rng := rand.New(rand.NewSource(1))
+	var stickyMoves, rangeMoves int
+	for i := 0; i < 100; i++ {
+		partitions := makePartitions(1 + rng.Intn(64))
+		subscribers := make([]string, 2+rng.Intn(6))
+		for j := range subscribers {
+			subscribers[j] = fmt.Sprintf("pixy_%d", rng.Intn(100000))
+		}
+		// A member joins on even iterations and leaves on odd ones.
+		before, after := subscribers[1:], subscribers
+		if i%2 == 1 {
+			before, after = after, before
+		}
+
+		// When
+		stickyMoves += countMoves(
+			assignTopicPartitionsSticky("t", partitions, copyStrings(before)),
+			assignTopicPartitionsSticky("t", partitions, copyStrings(after)))
+		rangeMoves += countMoves(
+			assignTopicPartitions(partitions, copyStrings(before)),
+			assignTopicPartitions(partitions, copyStrings(after)))
+	}
+
+	// Then
+	c.Assert(stickyMoves < rangeMoves, Equals, true,
+		Commentf("sticky=%d, range=%d", stickyMoves, rangeMoves))
+}
+
 func (s *GroupConsumerSuite) TestResolvePartitions(c *C) {
 	cfg := config.DefaultProxy()
 	cfg.ClientID = "c"
@@ -126,6 +198,32 @@ func (s *GroupConsumerSuite) TestResolvePartitions(c *C) {
 	})
 }
 
+func (s *GroupConsumerSuite) TestResolvePartitionsSticky(c *C) {
+	cfg := config.DefaultProxy()
+	cfg.ClientID = "c"
+	cfg.Consumer.AssignmentStrategy = config.AssignmentSticky
+	gc := T{
+		cfg: cfg,
+		fetchTopicPartitionsFn: func(topic string) ([]int32, error) {
+			return []int32{1, 2, 3, 4, 5}, nil
+		},
+	}
+	subscriptions := map[string][]string{
+		"a": {"t1"},
+		"b": {"t1"},
+		"c": {"t1"},
+	}
+
+	// When
+	topicsToPartitions, err := gc.resolvePartitions(subscriptions)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(topicsToPartitions, DeepEquals, map[string][]int32{
+		"t1": assignTopicPartitionsSticky("t1", []int32{1, 2, 3, 4, 5}, []string{"a", "b", "c"})["c"],
+	})
+}
+
 func (s *GroupConsumerSuite) TestResolvePartitionsEmpty(c *C) {
 	cfg := config.DefaultProxy()
 	cfg.ClientID = "c"
@@ -161,3 +259,55 @@ func (s *GroupConsumerSuite) TestResolvePartitionsError(c *C) {
 	c.Assert(err.Error(), Equals, "failed to get partition list, topic=t1: Kaboom!")
 	c.Assert(topicsToPartitions, IsNil)
 }
+
+func makePartitions(count int) []int32 {
+	partitions := make([]int32, count)
+	for i := range partitions {
+		partitions[i] = int32(i)
+	}
+	return partitions
+}
+
+func makeSubscribers(count int) []string {
+	subscribers := make([]string, count)
+	for i := range subscribers {
+		subscribers[i] = fmt.Sprintf("pixy_%d", i)
+	}
+	return subscribers
+}
+
+func copyStrings(s []string) []string {
+	return append([]string(nil), s...)
+}
+
+func reverseInt32s(s []int32) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+func reverseStrings(s []string) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// countMoves returns the number of partitions that are assigned to different
+// members in two assignments.
+func countMoves(before, after map[string][]int32) int {
+	owners := make(map[int32]string)
+	for groupMemberID, partitions := range before {
+		for _, partition := range partitions {
+			owners[partition] = groupMemberID
+		}
+	}
+	moves := 0
+	for groupMemberID, partitions := range after {
+		for _, partition := range partitions {
+			if owners[partition] != groupMemberID {
+				moves++
+			}
+		}
+	}
+	return moves
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
@@ -34,6 +35,14 @@ type T struct {
 	subscriptionsCh  chan map[string][]string
 	stopCh           chan none.T
 	wg               sync.WaitGroup
+
+	claimsMu sync.Mutex
+	claims   map[topicPartition]none.T
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
 }
 
 // Spawn creates a consumer group member instance and starts its background
@@ -50,6 +59,7 @@ func Spawn(namespace *actor.ID, group, memberID string, cfg *config.Proxy, kazoo
 		topicsCh:         make(chan []string),
 		subscriptionsCh:  make(chan map[string][]string),
 		stopCh:           make(chan none.T),
+		claims:           make(map[topicPartition]none.T),
 	}
 	actor.Spawn(gm.actorID, &gm.wg, gm.run)
 	return gm
@@ -76,6 +86,7 @@ func (gm *T) ClaimPartition(claimerActorID *actor.ID, topic string, partition in
 	beginAt := time.Now()
 	retries := 0
 	logFailureFn := log.Infof
+	gm.releaseStaleClaim(claimerActorID, topic, partition)
 	err := gm.groupMemberZNode.ClaimPartition(topic, partition)
 	for err != nil {
 		if retries++; retries > safeClaimRetriesCount {
@@ -92,7 +103,14 @@ func (gm *T) ClaimPartition(claimerActorID *actor.ID, topic string, partition in
 	}
 	log.Infof("<%s> partition claimed: via=%s, retries=%d, took=%s",
 		claimerActorID, gm.actorID, retries, millisSince(beginAt))
+	tp := topicPartition{topic, partition}
+	gm.claimsMu.Lock()
+	gm.claims[tp] = none.V
+	gm.claimsMu.Unlock()
 	return func() {
+		gm.claimsMu.Lock()
+		delete(gm.claims, tp)
+		gm.claimsMu.Unlock()
 		beginAt := time.Now()
 		retries := 0
 		logFailureFn := log.Infof
@@ -111,6 +129,24 @@ func (gm *T) ClaimPartition(claimerActorID *actor.ID, topic string, partition in
 	}
 }
 
+// releaseStaleClaim releases a partition claim made with the ID of this member
+// by its previous incarnation, e.g. the one that crashed right before the
+// service was restarted. Such claim is going to disappear as soon as the
+// ZooKeeper session of the previous incarnation expires, therefore it is
+// recreated with the current session.
+func (gm *T) releaseStaleClaim(claimerActorID *actor.ID, topic string, partition int32) {
+	owner, err := gm.groupZNode.PartitionOwner(topic, partition)
+	if err != nil || owner == nil || owner.ID != gm.groupMemberZNode.ID {
+		return
+	}
+	err = gm.groupMemberZNode.ReleasePartition(topic, partition)
+	if err != nil && err != kazoo.ErrPartitionNotClaimed {
+		log.Infof("<%s> failed to release stale claim: via=%s, err=(%s)", claimerActorID, gm.actorID, err)
+		return
+	}
+	log.Infof("<%s> stale claim released: via=%s", claimerActorID, gm.actorID)
+}
+
 // Stop signals the consumer group member to stop and blocks until its
 // goroutines are over.
 func (gm *T) Stop() {
@@ -148,13 +184,30 @@ func (gm *T) run() {
 		nilOrSubscriptionsCh     chan<- map[string][]string
 		nilOrGroupUpdatedCh      <-chan zk.Event
 		nilOrTimeoutCh           <-chan time.Time
+		nilOrSessionTimeoutCh    <-chan time.Time
 		pendingTopics            []string
 		pendingSubscriptions     map[string][]string
 		shouldSubmitTopics       = false
 		shouldFetchMembers       = false
 		shouldFetchSubscriptions = false
-		members                  []*kazoo.ConsumergroupInstance
+		shouldReclaimPartitions  = false
+		members                  kazoo.ConsumergroupInstanceList
+		departedAt               = make(map[string]time.Time)
 	)
+	// recoverSession makes the member register again, reclaim partitions and
+	// deliver subscriptions even if they have not changed, so that the group
+	// consumer rebalances. It is needed when the registration and partition
+	// claims are gone, that is what happens to ephemeral nodes when the
+	// ZooKeeper session expires.
+	recoverSession := func() {
+		metrics.Counter("consumer_zk_session_lost", "cluster", gm.cfg.Cluster, "group", gm.group).Inc(1)
+		if !shouldSubmitTopics && gm.topics != nil {
+			pendingTopics = gm.topics
+			shouldSubmitTopics = true
+		}
+		shouldReclaimPartitions = true
+		gm.subscriptions = nil
+	}
 	for {
 		select {
 		case topics := <-gm.topicsCh:
@@ -163,10 +216,17 @@ func (gm *T) run() {
 		case nilOrSubscriptionsCh <- pendingSubscriptions:
 			nilOrSubscriptionsCh = nil
 			gm.subscriptions = pendingSubscriptions
-		case <-nilOrGroupUpdatedCh:
+		case event := <-nilOrGroupUpdatedCh:
 			nilOrGroupUpdatedCh = nil
 			shouldFetchMembers = true
+			if event.Err == zk.ErrSessionExpired {
+				log.Errorf("<%s> ZooKeeper session expired", gm.actorID)
+				recoverSession()
+			}
 		case <-nilOrTimeoutCh:
+		case <-nilOrSessionTimeoutCh:
+			nilOrSessionTimeoutCh = nil
+			shouldFetchSubscriptions = true
 		case <-gm.stopCh:
 			return
 		}
@@ -182,6 +242,15 @@ func (gm *T) run() {
 			shouldFetchMembers = true
 		}
 
+		if shouldReclaimPartitions {
+			if err = gm.reclaimPartitions(); err != nil {
+				log.Errorf("<%s> failed to reclaim partitions: err=(%s)", gm.actorID, err)
+				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
+				continue
+			}
+			shouldReclaimPartitions = false
+		}
+
 		if shouldFetchMembers {
 			members, nilOrGroupUpdatedCh, err = gm.groupZNode.WatchInstances()
 			if err != nil {
@@ -190,6 +259,15 @@ func (gm *T) run() {
 				continue
 			}
 			shouldFetchMembers = false
+			// The registration can be gone without this member noticing
+			// session expiration, e.g. if it happened while the member was
+			// not watching the group.
+			if gm.topics != nil && members.Find(gm.groupMemberZNode.ID) == nil {
+				log.Errorf("<%s> registration is gone", gm.actorID)
+				recoverSession()
+				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
+				continue
+			}
 			shouldFetchSubscriptions = true
 			// To avoid unnecessary rebalancing in case of a deregister/register
 			// sequences that happen when a member updates its topic subscriptions,
@@ -207,6 +285,15 @@ func (gm *T) run() {
 			}
 			shouldFetchSubscriptions = false
 			log.Infof("<%s> fetched subscriptions: %v", gm.actorID, pendingSubscriptions)
+			nilOrSessionTimeoutCh = nil
+			if gm.cfg.Consumer.MemberSessionTimeout > 0 {
+				retainFor := retainDepartedMembers(pendingSubscriptions, gm.subscriptions,
+					departedAt, gm.cfg.Consumer.MemberSessionTimeout, time.Now())
+				if retainFor > 0 {
+					log.Infof("<%s> departed members retained: %v", gm.actorID, departedAt)
+					nilOrSessionTimeoutCh = time.After(retainFor)
+				}
+			}
 			if subscriptionsEqual(pendingSubscriptions, gm.subscriptions) {
 				nilOrSubscriptionsCh = nil
 				pendingSubscriptions = nil
@@ -218,6 +305,28 @@ func (gm *T) run() {
 	}
 }
 
+// reclaimPartitions claims again all partitions that are currently claimed by
+// this member. It is needed after the ZooKeeper session is reestablished,
+// because partition claims of the expired session are gone. If a partition
+// has been claimed by another member in the meantime, then it is left alone,
+// it is up to the following rebalancing to sort it out.
+func (gm *T) reclaimPartitions() error {
+	gm.claimsMu.Lock()
+	defer gm.claimsMu.Unlock()
+	for tp := range gm.claims {
+		err := gm.groupMemberZNode.ClaimPartition(tp.topic, tp.partition)
+		if err == kazoo.ErrPartitionClaimedByOther {
+			log.Errorf("<%s> partition claimed by other: topic=%s, partition=%d", gm.actorID, tp.topic, tp.partition)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to reclaim, topic=%s, partition=%d", tp.topic, tp.partition)
+		}
+		log.Infof("<%s> partition reclaimed: topic=%s, partition=%d", gm.actorID, tp.topic, tp.partition)
+	}
+	return nil
+}
+
 // fetchSubscriptions retrieves registration records for the specified members
 // from ZooKeeper.
 //
@@ -242,15 +351,52 @@ func (gm *T) fetchSubscriptions(members []*kazoo.ConsumergroupInstance) (map[str
 	return subscriptions, nil
 }
 
-func (gm *T) submitTopics(topics []string) error {
-	if gm.topics != nil {
-		err := gm.groupMemberZNode.Deregister()
-		if err != nil && err != kazoo.ErrInstanceNotRegistered {
-			return errors.Wrap(err, "failed to deregister")
+// retainDepartedMembers adds members that are present in `prevSubscriptions`
+// but not in `subscriptions` back to `subscriptions`, unless they have been
+// away for longer than `sessionTimeout`. Departure times are tracked in
+// `departedAt`. It returns how long till the earliest of retained members
+// should be dropped, or zero if no members were retained.
+func retainDepartedMembers(subscriptions, prevSubscriptions map[string][]string,
+	departedAt map[string]time.Time, sessionTimeout time.Duration, now time.Time,
+) time.Duration {
+	for member := range departedAt {
+		if _, ok := subscriptions[member]; ok {
+			delete(departedAt, member)
+		}
+	}
+	var retainFor time.Duration
+	for member, topics := range prevSubscriptions {
+		if _, ok := subscriptions[member]; ok {
+			continue
+		}
+		at, ok := departedAt[member]
+		if !ok {
+			at = now
+			departedAt[member] = at
+		}
+		left := sessionTimeout - now.Sub(at)
+		if left <= 0 {
+			delete(departedAt, member)
+			continue
 		}
+		subscriptions[member] = topics
+		if retainFor == 0 || left < retainFor {
+			retainFor = left
+		}
+	}
+	return retainFor
+}
+
+func (gm *T) submitTopics(topics []string) error {
+	// Registration is removed even if this member has not registered yet,
+	// because it can be left over by the previous incarnation of the member
+	// that has not been stopped properly.
+	err := gm.groupMemberZNode.Deregister()
+	if err != nil && err != kazoo.ErrInstanceNotRegistered {
+		return errors.Wrap(err, "failed to deregister")
 	}
 	gm.topics = nil
-	err := gm.groupMemberZNode.Register(topics)
+	err = gm.groupMemberZNode.Register(topics)
 	for err != nil {
 		return errors.Wrap(err, "failed to register")
 	}
@@ -71,6 +71,37 @@ func (s *GroupMemberSuite) TestSubscriptionsEqual(c *C) {
 		}), Equals, true)
 }
 
+func (s *GroupMemberSuite) TestRetainDepartedMembers(c *C) {
+	now := time.Now()
+	prev := map[string][]string{
+		"m1": {"foo"},
+		"m2": {"bar", "foo"},
+		"m3": {"foo"},
+	}
+	departedAt := map[string]time.Time{"m3": now.Add(-4 * time.Second)}
+	subscriptions := map[string][]string{"m1": {"foo"}}
+
+	// When
+	retainFor := retainDepartedMembers(subscriptions, prev, departedAt, 5*time.Second, now)
+
+	// Then
+	c.Assert(retainFor, Equals, time.Second)
+	c.Assert(subscriptions, DeepEquals, prev)
+	c.Assert(departedAt, DeepEquals, map[string]time.Time{
+		"m2": now,
+		"m3": now.Add(-4 * time.Second),
+	})
+
+	// When: m2 rejoins and m3 is away for too long.
+	subscriptions = map[string][]string{"m1": {"foo"}, "m2": {"bar", "foo"}}
+	retainFor = retainDepartedMembers(subscriptions, prev, departedAt, 5*time.Second, now.Add(time.Second))
+
+	// Then
+	c.Assert(retainFor, Equals, time.Duration(0))
+	c.Assert(subscriptions, DeepEquals, map[string][]string{"m1": {"foo"}, "m2": {"bar", "foo"}})
+	c.Assert(departedAt, DeepEquals, map[string]time.Time{})
+}
+
 // When a list of topics is sent to the `topics()` channel, a membership change
 // is received with the same list of topics for the registrator name.
 func (s *GroupMemberSuite) TestSimpleSubscribe(c *C) {
@@ -256,6 +287,119 @@ func (s *GroupMemberSuite) TestRedundantUpdateIgnored(c *C) {
 	}
 }
 
+// If a member leaves the group and rejoins it within the member session
+// timeout, then other members are not notified of that.
+func (s *GroupMemberSuite) TestRejoinWithinSessionTimeout(c *C) {
+	// Given
+	cfg := config.DefaultProxy()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.MemberSessionTimeout = 1 * time.Second
+	gm1 := Spawn(s.ns.NewChild("m1"), "g1", "m1", cfg, s.kazooClt)
+	defer gm1.Stop()
+	gm2 := Spawn(s.ns.NewChild("m2"), "g1", "m2", cfg, s.kazooClt)
+
+	gm1.Topics() <- []string{"foo"}
+	gm2.Topics() <- []string{"foo"}
+	membership := map[string][]string{
+		"m1": {"foo"},
+		"m2": {"foo"}}
+	c.Assert(<-gm1.Subscriptions(), DeepEquals, membership)
+
+	// When
+	gm2.Stop()
+	time.Sleep(300 * time.Millisecond)
+	gm2 = Spawn(s.ns.NewChild("m2"), "g1", "m2", cfg, s.kazooClt)
+	defer gm2.Stop()
+	gm2.Topics() <- []string{"foo"}
+
+	// Then
+	select {
+	case update := <-gm1.Subscriptions():
+		c.Errorf("Unexpected update: %v", update)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+// If a member leaves the group and does not come back within the member
+// session timeout, then other members are notified of that.
+func (s *GroupMemberSuite) TestLeaveAfterSessionTimeout(c *C) {
+	// Given
+	cfg := config.DefaultProxy()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.MemberSessionTimeout = 500 * time.Millisecond
+	gm1 := Spawn(s.ns.NewChild("m1"), "g1", "m1", cfg, s.kazooClt)
+	defer gm1.Stop()
+	gm2 := Spawn(s.ns.NewChild("m2"), "g1", "m2", cfg, s.kazooClt)
+
+	gm1.Topics() <- []string{"foo"}
+	gm2.Topics() <- []string{"foo"}
+	c.Assert(<-gm1.Subscriptions(), DeepEquals, map[string][]string{
+		"m1": {"foo"},
+		"m2": {"foo"}})
+	begin := time.Now()
+
+	// When
+	gm2.Stop()
+
+	// Then
+	c.Assert(<-gm1.Subscriptions(), DeepEquals, map[string][]string{
+		"m1": {"foo"}})
+	c.Assert(time.Since(begin) >= cfg.Consumer.MemberSessionTimeout, Equals, true)
+}
+
+// A partition claim left by a previous incarnation of a member is taken over.
+func (s *GroupMemberSuite) TestClaimPartitionStale(c *C) {
+	// Given
+	cfg := config.DefaultProxy()
+	gm := Spawn(s.ns.NewChild("m1"), "g1", "m1", cfg, s.kazooClt)
+	defer gm.Stop()
+	cancelCh := make(chan none.T)
+	kazooClt2, err := kazoo.NewKazoo(testhelpers.ZookeeperPeers, kazoo.NewConfig())
+	c.Assert(err, IsNil)
+	c.Assert(kazooClt2.Consumergroup("g1").Instance("m1").ClaimPartition("foo", 1), IsNil)
+
+	// When
+	claim := gm.ClaimPartition(s.ns, "foo", 1, cancelCh)
+	defer claim()
+	kazooClt2.Close()
+
+	// Then: the claim survives the previous incarnation session.
+	owner, err := partitionOwner(gm, "foo", 1)
+	c.Assert(err, IsNil)
+	c.Assert(owner, Equals, "m1")
+}
+
+// If the member registration and partition claims are gone, e.g. due to
+// ZooKeeper session expiration, then the member registers again, reclaims
+// partitions, and delivers subscriptions to trigger rebalancing.
+func (s *GroupMemberSuite) TestRegistrationRecovered(c *C) {
+	// Given
+	cfg := config.DefaultProxy()
+	cfg.Consumer.RebalanceDelay = 100 * time.Millisecond
+	cfg.Consumer.RetryBackoff = 100 * time.Millisecond
+	gm := Spawn(s.ns.NewChild("m1"), "g1", "m1", cfg, s.kazooClt)
+	defer gm.Stop()
+	gm.Topics() <- []string{"foo"}
+	membership := map[string][]string{"m1": {"foo"}}
+	c.Assert(<-gm.Subscriptions(), DeepEquals, membership)
+	claim := gm.ClaimPartition(s.ns, "foo", 1, make(chan none.T))
+	defer claim()
+
+	// When
+	instance := s.kazooClt.Consumergroup("g1").Instance("m1")
+	c.Assert(instance.ReleasePartition("foo", 1), IsNil)
+	c.Assert(instance.Deregister(), IsNil)
+
+	// Then
+	c.Assert(<-gm.Subscriptions(), DeepEquals, membership)
+	registered, err := instance.Registered()
+	c.Assert(err, IsNil)
+	c.Assert(registered, Equals, true)
+	owner, err := partitionOwner(gm, "foo", 1)
+	c.Assert(err, IsNil)
+	c.Assert(owner, Equals, "m1")
+}
+
 // When a group registrator claims a topic partitions it becomes its owner.
 func (s *GroupMemberSuite) TestClaimPartition(c *C) {
 	// Given
@@ -1,6 +1,7 @@
 package msgfetcher
 
 import (
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,9 +10,11 @@ import (
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/mapper"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
 )
 
 // Factory provides API to spawn message fetcher that read messages from
@@ -102,14 +105,23 @@ func (f *factory) Spawn(namespace *actor.ID, topic string, partition int32, offs
 	if _, ok := f.children[id]; ok {
 		return nil, sarama.OffsetNewest, sarama.ConfigurationError("That topic/partition is already being consumed")
 	}
+	params := f.cfg.ConsumerParams("", topic)
+	bufferSize := params.ChannelBufferSize
+	// One message is held outside of the channel while it is being pushed.
+	if params.PrefetchMaxMessages > 0 && params.PrefetchMaxMessages-1 < bufferSize {
+		bufferSize = params.PrefetchMaxMessages - 1
+	}
 	mf := &msgFetcher{
 		actorID:      namespace.NewChild("msg_stream"),
 		f:            f,
 		id:           id,
 		assignmentCh: make(chan mapper.Executor, 1),
-		messagesCh:   make(chan consumer.Message, f.cfg.Consumer.ChannelBufferSize),
+		messagesCh:   make(chan consumer.Message, bufferSize),
 		closingCh:    make(chan none.T, 1),
 		offset:       realOffset,
+		prefetchMax:  params.PrefetchMaxMessages,
+		prefetched: metrics.Gauge("consumer_prefetched", "cluster", f.cfg.Cluster, "topic", topic,
+			"partition", strconv.Itoa(int(partition))),
 	}
 	if testReportErrors {
 		mf.errorsCh = make(chan error, f.cfg.Consumer.ChannelBufferSize)
@@ -202,6 +214,8 @@ type msgFetcher struct {
 	errorsCh     chan error
 	closingCh    chan none.T
 	wg           sync.WaitGroup
+	prefetchMax  int
+	prefetched   gometrics.Gauge
 
 	assignedBrokerRequestCh   chan<- fetchReq
 	nilOrBrokerRequestsCh     chan<- fetchReq
@@ -288,6 +302,8 @@ func (mf *msgFetcher) run() {
 				mf.nilOrBrokerRequestsCh = mf.assignedBrokerRequestCh
 				continue
 			}
+			fetchedMessages = mf.limitPrefetched(fetchedMessages)
+			mf.prefetched.Update(int64(len(mf.messagesCh) + len(fetchedMessages)))
 			// Some messages have been fetched, start pushing them to the user.
 			currMessageIdx = 0
 			currMessage = fetchedMessages[currMessageIdx]
@@ -296,6 +312,7 @@ func (mf *msgFetcher) run() {
 		case nilOrMessagesCh <- currMessage:
 			mf.offset = currMessage.Offset + 1
 			currMessageIdx++
+			mf.prefetched.Update(int64(len(mf.messagesCh) + len(fetchedMessages) - currMessageIdx))
 			if currMessageIdx < len(fetchedMessages) {
 				currMessage = fetchedMessages[currMessageIdx]
 				continue
@@ -315,6 +332,23 @@ func (mf *msgFetcher) run() {
 	}
 }
 
+// limitPrefetched drops fetched messages that would make the number of
+// messages held by the fetcher exceed `prefetch_max_messages`. They are
+// fetched again after the retained ones are consumed. The channel buffer is
+// smaller than the limit, so at least one message is always retained.
+func (mf *msgFetcher) limitPrefetched(fetchedMessages []consumer.Message) []consumer.Message {
+	if mf.prefetchMax <= 0 {
+		return fetchedMessages
+	}
+	// The channel can only be drained concurrently, so its length is an
+	// upper bound.
+	room := mf.prefetchMax - len(mf.messagesCh)
+	if len(fetchedMessages) > room {
+		fetchedMessages = fetchedMessages[:room]
+	}
+	return fetchedMessages
+}
+
 func (mf *msgFetcher) triggerOrScheduleReassign(reason string) {
 	mf.assignedBrokerRequestCh = nil
 	now := time.Now().UTC()
@@ -349,7 +383,7 @@ func (mf *msgFetcher) parseFetchResult(cid *actor.ID, fetchResult fetchRes) ([]c
 	}
 
 	// We got no messages. If we got a trailing one, it means there is a
-	// producer that writes messages larger then Consumer.FetchMaxBytes in size.
+	// producer that writes messages larger then the fetch size of the topic.
 	if len(block.MsgSet.Messages) == 0 && block.MsgSet.PartialTrailingMessage {
 		log.Errorf("<%s> oversized message skipped: offset=%d", cid, mf.offset)
 		mf.reportError(errMessageTooLarge)
@@ -490,7 +524,8 @@ func (be *brokerExecutor) runExecutor() {
 		}
 
 		for _, fr := range fetchRequests {
-			req.AddBlock(fr.Topic, fr.Partition, fr.Offset, int32(be.cfg.Consumer.FetchMaxBytes))
+			fetchMaxBytes := be.cfg.ConsumerParams("", fr.Topic).FetchMaxBytes
+			req.AddBlock(fr.Topic, fr.Partition, fr.Offset, int32(fetchMaxBytes))
 		}
 		var res *sarama.FetchResponse
 		res, lastErr = be.conn.Fetch(req)
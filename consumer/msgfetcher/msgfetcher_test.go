@@ -157,6 +157,50 @@ func (s *MsgFetcherSuite) TestRecreate(c *C) {
 	c.Assert((<-mf.Messages()).Offset, Equals, int64(10))
 }
 
+// If prefetch_max_messages is set, then no more than that many messages are
+// held by a fetcher, and messages dropped over the limit are fetched again.
+func (s *MsgFetcherSuite) TestPrefetchMaxMessages(c *C) {
+	mockFetchResponse := sarama.NewMockFetchResponse(c, 1)
+	for i := 0; i < 10; i++ {
+		mockFetchResponse.SetMessage("my_topic", 0, int64(i+1234), testMsg)
+	}
+	s.broker0.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(c).
+			SetBroker(s.broker0.Addr(), s.broker0.BrokerID()).
+			SetLeader("my_topic", 0, s.broker0.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(c).
+			SetOffset("my_topic", 0, sarama.OffsetOldest, 0).
+			SetOffset("my_topic", 0, sarama.OffsetNewest, 2000),
+		"FetchRequest": mockFetchResponse,
+	})
+
+	kafkaClt, _ := sarama.NewClient([]string{s.broker0.Addr()}, s.cfg.SaramaClientCfg())
+	defer kafkaClt.Close()
+
+	s.cfg.Consumer.PrefetchMaxMessages = 3
+	f, err := SpawnFactory(s.ns, s.cfg, kafkaClt)
+	c.Assert(err, IsNil)
+	defer f.Stop()
+
+	// When
+	mf, _, err := f.Spawn(s.ns.NewChild("my_topic", 0), "my_topic", 0, 1234)
+	c.Assert(err, IsNil)
+	defer mf.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Then
+	c.Assert(cap(mf.(*msgFetcher).messagesCh), Equals, 2)
+	c.Assert(mf.(*msgFetcher).prefetched.Value(), Equals, int64(3))
+	for i := 0; i < 10; i++ {
+		select {
+		case message := <-mf.Messages():
+			c.Assert(message.Offset, Equals, int64(i+1234))
+		case err := <-mf.(*msgFetcher).errorsCh:
+			c.Error(err)
+		}
+	}
+}
+
 // An attempt to consume the same partition twice should fail.
 func (s *MsgFetcherSuite) TestDuplicate(c *C) {
 	s.broker0.SetHandlerByMap(map[string]sarama.MockResponse{
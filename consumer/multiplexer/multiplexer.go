@@ -6,21 +6,24 @@ import (
 	"sync"
 
 	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/log"
 )
 
-// T fetches messages from inputs and multiplexes them to the output, giving
-// preferences to inputs with higher lag. Multiplexes assumes ownership over
-// inputs in the sense that it decides when an new input instance needs to
-// started, or the old one stopped.
+// T fetches messages from inputs and multiplexes them to the output, in the
+// order defined by a policy, by default giving preferences to inputs with
+// higher lag. Multiplexes assumes ownership over inputs in the sense that it
+// decides when an new input instance needs to started, or the old one stopped.
 type T struct {
 	actorID   *actor.ID
+	policy    config.MuxPolicy
 	spawnInFn SpawnInFn
 	inputs    map[int32]*input
 	output    Out
 	isRunning bool
+	rewireCh  chan []*input
 	stopCh    chan none.T
 	wg        sync.WaitGroup
 }
@@ -46,23 +49,30 @@ type Out interface {
 // assigned partitions during rewiring.
 type SpawnInFn func(partition int32) In
 
-// New creates a new multiplexer instance.
-func New(namespace *actor.ID, spawnInFn SpawnInFn) *T {
+// New creates a new multiplexer instance that orders messages according to
+// the specified policy.
+func New(namespace *actor.ID, policy config.MuxPolicy, spawnInFn SpawnInFn) *T {
 	return &T{
 		actorID:   namespace.NewChild("mux"),
+		policy:    policy,
 		inputs:    make(map[int32]*input),
 		spawnInFn: spawnInFn,
+		rewireCh:  make(chan []*input),
 		stopCh:    make(chan none.T),
 	}
 }
 
 // input represents a multiplexer input along with a message to be fetched from
-// that input next.
+// that input next. All fields but `In` and `partition` are only accessed by
+// the multiplexer goroutine.
 type input struct {
 	In
 	partition int32
 	msg       consumer.Message
 	msgOk     bool
+	closed    bool
+	// Accumulated weight used by the weighted policy.
+	credit int64
 }
 
 // IsRunning returns `true` if multiplexer is running pumping events from the
@@ -73,10 +83,12 @@ func (m *T) IsRunning() bool {
 
 // WireUp ensures that assigned inputs are spawned and multiplexed to the
 // specified output. It stops inputs for partitions that are no longer
-// assigned, spawns inputs for newly assigned partitions, and restarts the
-// multiplexer, if either output or any of inputs has changed.
+// assigned and spawns inputs for newly assigned partitions. Changes to the
+// input set are applied to the running multiplexer on the fly, so inputs that
+// remain assigned are not interrupted. The multiplexer is restarted only if
+// the output has changed.
 //
-// The multiplexer may be stopped if either output or all inputs are removed.
+// The multiplexer is stopped if either output or all inputs are removed.
 //
 // WARNING: do not ever pass (*T)(nil) in output, that will cause panic.
 func (m *T) WireUp(output Out, assigned []int32) {
@@ -99,30 +111,41 @@ func (m *T) WireUp(output Out, assigned []int32) {
 		wg.Wait()
 		return
 	}
-	// Stop inputs that are not assigned anymore.
+	changed := false
+	// Forget inputs that are not assigned anymore. They are stopped after
+	// the multiplexer is done reading from them.
+	var removed []*input
 	for p, in := range m.inputs {
 		if !hasPartition(p, assigned) {
-			m.stopIfRunning()
-			wg.Add(1)
-			go func(in *input) {
-				defer wg.Done()
-				in.Stop()
-			}(in)
+			removed = append(removed, in)
 			delete(m.inputs, p)
+			changed = true
 		}
 	}
-	// Spawn newly assigned inputs, but stop multiplexer before spawning the
-	// first input.
+	// Spawn newly assigned inputs.
 	for _, p := range assigned {
 		if _, ok := m.inputs[p]; !ok {
-			m.stopIfRunning()
 			m.inputs[p] = &input{In: m.spawnInFn(p), partition: p}
+			changed = true
 		}
 	}
-	if !m.IsRunning() && len(m.inputs) > 0 {
+	switch {
+	case len(m.inputs) == 0:
+		m.stopIfRunning()
+	case !m.isRunning:
 		m.start()
+	case changed:
+		m.rewireCh <- makeSortedIns(m.inputs)
+	}
+	// By now the multiplexer has either stopped or switched to the new input
+	// set, so removed inputs can be safely stopped.
+	for _, in := range removed {
+		wg.Add(1)
+		go func(in *input) {
+			defer wg.Done()
+			in.Stop()
+		}(in)
 	}
-	// Wait for stopping inputs to stop.
 	wg.Wait()
 }
 
@@ -132,7 +155,8 @@ func (m *T) Stop() {
 }
 
 func (m *T) start() {
-	actor.Spawn(m.actorID, &m.wg, m.run)
+	sortedIns := makeSortedIns(m.inputs)
+	actor.Spawn(m.actorID, &m.wg, func() { m.run(sortedIns) })
 	m.isRunning = true
 }
 
@@ -144,24 +168,25 @@ func (m *T) stopIfRunning() {
 	}
 }
 
-func (m *T) run() {
+func (m *T) run(sortedIns []*input) {
+	var selectCases []reflect.SelectCase
+	var inputIdx int
 reset:
-	inputCount := len(m.inputs)
-	if inputCount == 0 {
-		return
-	}
-	sortedIns := makeSortedIns(m.inputs)
+	sortedIns = openIns(sortedIns)
+	inputCount := len(sortedIns)
 	// Prepare a list of reflective select cases. It is used when none of the
 	// inputs has fetched messages and we need to wait on all of them. Yes,
 	// reflection is slow, but it is only used when there is nothing to
 	// consume anyway.
-	selectCases := make([]reflect.SelectCase, inputCount+1)
-	for i, in := range sortedIns {
-		selectCases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in.Messages())}
+	selectCases = selectCases[:0]
+	for _, in := range sortedIns {
+		selectCases = append(selectCases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in.Messages())})
 	}
-	selectCases[inputCount] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.stopCh)}
+	selectCases = append(selectCases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.stopCh)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.rewireCh)})
+	inputIdx = -1
 
-	inputIdx := -1
 	for {
 		// Collect next messages from inputs that have them available.
 		isAtLeastOneAvailable := false
@@ -176,7 +201,7 @@ reset:
 				// removed from the list of multiplexed inputs.
 				if !ok {
 					log.Infof("<%s> input channel closed: partition=%d", m.actorID, in.partition)
-					delete(m.inputs, in.partition)
+					in.closed = true
 					goto reset
 				}
 				in.msg = msg
@@ -186,29 +211,47 @@ reset:
 			}
 		}
 		// If none of the inputs has a message available, then wait until
-		// a message is fetched on any of them or a stop signal is received.
+		// a message is fetched on any of them, the input set is changed, or a
+		// stop signal is received.
 		if !isAtLeastOneAvailable {
 			idx, value, _ := reflect.Select(selectCases)
-			// Check if it is a stop signal.
-			if idx == inputCount {
+			switch idx {
+			case inputCount:
 				return
+			case inputCount + 1:
+				sortedIns = value.Interface().([]*input)
+				goto reset
 			}
 			sortedIns[idx].msg = value.Interface().(consumer.Message)
 			sortedIns[idx].msgOk = true
 		}
 		// At this point there is at least one message available.
-		inputIdx = selectInput(inputIdx, sortedIns)
-		// Block until the output reads the next message of the selected input
-		// or a stop signal is received.
+		inputIdx = m.selectInput(inputIdx, sortedIns)
+		// Block until the output reads the next message of the selected input,
+		// the input set is changed, or a stop signal is received.
 		select {
 		case <-m.stopCh:
 			return
+		case sortedIns = <-m.rewireCh:
+			goto reset
 		case m.output.Messages() <- sortedIns[inputIdx].msg:
 			sortedIns[inputIdx].msgOk = false
 		}
 	}
 }
 
+// openIns returns inputs from the given list whose channels have not been
+// closed yet.
+func openIns(ins []*input) []*input {
+	openIns := make([]*input, 0, len(ins))
+	for _, in := range ins {
+		if !in.closed {
+			openIns = append(openIns, in)
+		}
+	}
+	return openIns
+}
+
 // makeSortedIns given a partition->input map returns a slice of all the inputs
 // from the map sorted in ascending order of partition ids.
 func makeSortedIns(inputs map[int32]*input) []*input {
@@ -225,11 +268,25 @@ func makeSortedIns(inputs map[int32]*input) []*input {
 }
 
 func hasPartition(partition int32, partitions []int32) bool {
-	count := len(partitions)
-	if count == 0 {
-		return false
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// selectInput picks an input that should be multiplexed next according to
+// the multiplexer policy.
+func (m *T) selectInput(prevSelectedIdx int, sortedIns []*input) int {
+	switch m.policy {
+	case config.MuxRoundRobin:
+		return selectInputRoundRobin(prevSelectedIdx, sortedIns)
+	case config.MuxWeighted:
+		return selectInputWeighted(sortedIns)
+	default:
+		return selectInput(prevSelectedIdx, sortedIns)
 	}
-	return partitions[0] <= partition && partition <= partitions[count-1]
 }
 
 // selectInput picks an input that should be multiplexed next. It prefers the
@@ -261,6 +318,52 @@ func selectInput(prevSelectedIdx int, sortedIns []*input) int {
 	return selectedIdx
 }
 
+// selectInputRoundRobin picks the first input that has a message available,
+// following prevSelectedIdx.
+func selectInputRoundRobin(prevSelectedIdx int, sortedIns []*input) int {
+	inputCount := len(sortedIns)
+	for i := 1; i <= inputCount; i++ {
+		idx := (prevSelectedIdx + i) % inputCount
+		if idx < 0 {
+			idx += inputCount
+		}
+		if sortedIns[idx].msgOk {
+			return idx
+		}
+	}
+	return -1
+}
+
+// selectInputWeighted picks an input using smooth weighted round robin, where
+// the weight of an input that has a message available is the lag of the
+// message. Every input with a message available gets its weight added to its
+// credit, and the one with the largest credit is selected and has its credit
+// reduced by the sum of the weights. That way inputs are selected in
+// proportion to their lag, but even an input with the smallest lag is
+// selected eventually.
+func selectInputWeighted(sortedIns []*input) int {
+	var totalWeight int64
+	selectedIdx := -1
+	for i, input := range sortedIns {
+		if !input.msgOk {
+			continue
+		}
+		weight := input.msg.HighWaterMark - input.msg.Offset
+		if weight < 1 {
+			weight = 1
+		}
+		input.credit += weight
+		totalWeight += weight
+		if selectedIdx < 0 || input.credit > sortedIns[selectedIdx].credit {
+			selectedIdx = i
+		}
+	}
+	if selectedIdx >= 0 {
+		sortedIns[selectedIdx].credit -= totalWeight
+	}
+	return selectedIdx
+}
+
 type Int32Slice []int32
 
 func (p Int32Slice) Len() int           { return len(p) }
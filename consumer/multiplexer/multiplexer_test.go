@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/testhelpers"
 	. "gopkg.in/check.v1"
@@ -93,6 +94,39 @@ func (s *MultiplexerSuite) TestSelectInputNone(c *C) {
 	c.Assert(selectInput(100, inputs), Equals, -1)
 }
 
+// Round robin policy picks the next input with a message regardless of lag.
+func (s *MultiplexerSuite) TestSelectInputRoundRobin(c *C) {
+	inputs := []*input{
+		{},
+		{msg: lag(11), msgOk: true},
+		{msg: lag(13), msgOk: true},
+		{},
+		{msg: lag(12), msgOk: true},
+	}
+	c.Assert(selectInputRoundRobin(-1, inputs), Equals, 1)
+	c.Assert(selectInputRoundRobin(1, inputs), Equals, 2)
+	c.Assert(selectInputRoundRobin(2, inputs), Equals, 4)
+	c.Assert(selectInputRoundRobin(4, inputs), Equals, 1)
+	c.Assert(selectInputRoundRobin(100, inputs), Equals, 1)
+	c.Assert(selectInputRoundRobin(0, []*input{{}, {}}), Equals, -1)
+}
+
+// Weighted policy picks inputs in proportion to their lag, but does not
+// starve inputs with a smaller lag.
+func (s *MultiplexerSuite) TestSelectInputWeighted(c *C) {
+	inputs := []*input{
+		{msg: lag(3), msgOk: true},
+		{},
+		{msg: lag(1), msgOk: true},
+	}
+	var selected []int
+	for i := 0; i < 8; i++ {
+		selected = append(selected, selectInputWeighted(inputs))
+	}
+	c.Assert(selected, DeepEquals, []int{0, 0, 2, 0, 0, 0, 2, 0})
+	c.Assert(selectInputWeighted([]*input{{}, {}}), Equals, -1)
+}
+
 // If there is just one input then it is forwarded to the output.
 func (s *MultiplexerSuite) TestOneInput(c *C) {
 	ins := map[int32]In{
@@ -103,7 +137,7 @@ func (s *MultiplexerSuite) TestOneInput(c *C) {
 		),
 	}
 	out := newMockOut(100)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 
 	// When
@@ -139,7 +173,7 @@ func (s *MultiplexerSuite) TestSameLag(c *C) {
 			msg(4001, 1),
 		)}
 	out := newMockOut(100)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 
 	// When
@@ -180,7 +214,7 @@ func (s *MultiplexerSuite) TestLargeLagPreferred(c *C) {
 		),
 	}
 	out := newMockOut(100)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	m.Stop()
 
 	// When
@@ -195,6 +229,32 @@ func (s *MultiplexerSuite) TestLargeLagPreferred(c *C) {
 	checkMsg(c, out.messagesCh, msg(2002, 1))
 }
 
+// With round robin policy inputs take turns regardless of lag.
+func (s *MultiplexerSuite) TestRoundRobinPolicy(c *C) {
+	ins := map[int32]In{
+		1: newMockIn(
+			msg(1001, 1),
+			msg(1002, 1),
+		),
+		2: newMockIn(
+			msg(2001, 5),
+			msg(2002, 4),
+		),
+	}
+	out := newMockOut(100)
+	m := New(s.ns, config.MuxRoundRobin, func(p int32) In { return ins[p] })
+	defer m.Stop()
+
+	// When
+	m.WireUp(out, []int32{1, 2})
+
+	// Then
+	checkMsg(c, out.messagesCh, msg(1001, 1))
+	checkMsg(c, out.messagesCh, msg(2001, 5))
+	checkMsg(c, out.messagesCh, msg(1002, 1))
+	checkMsg(c, out.messagesCh, msg(2002, 4))
+}
+
 // If there are no messages available on the inputs, multiplexer blocks waiting
 // for a message to appear in any of the inputs.
 func (s *MultiplexerSuite) TestNoMessages(c *C) {
@@ -205,7 +265,7 @@ func (s *MultiplexerSuite) TestNoMessages(c *C) {
 		3: newMockIn(),
 	}
 	out := newMockOut(100)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	m.WireUp(out, []int32{1, 2, 3})
 
@@ -233,7 +293,7 @@ func (s *MultiplexerSuite) TestWireUp(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(100)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 
@@ -260,7 +320,7 @@ func (s *MultiplexerSuite) TestWireUpAdd(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -289,7 +349,7 @@ func (s *MultiplexerSuite) TestWireUpRemove(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -316,7 +376,7 @@ func (s *MultiplexerSuite) TestWireUpAddRemove(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -335,6 +395,63 @@ func (s *MultiplexerSuite) TestWireUpAddRemove(c *C) {
 	}
 }
 
+// Assigned partitions do not have to make a contiguous range, e.g. when they
+// are assigned with the sticky strategy.
+func (s *MultiplexerSuite) TestWireUpRemoveInTheMiddle(c *C) {
+	ins := map[int32]In{
+		1: newMockIn(msg(1001, 1)),
+		2: newMockIn(msg(2001, 1)),
+		3: newMockIn(msg(3001, 1)),
+	}
+	out := newMockOut(0)
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
+	defer m.Stop()
+	m.WireUp(out, []int32{1, 2, 3})
+
+	// When
+	m.WireUp(out, []int32{1, 3})
+
+	// Then
+	c.Assert(m.IsRunning(), Equals, true)
+	c.Assert(ins[1].(*mockIn).stopped, Equals, false)
+	c.Assert(ins[2].(*mockIn).stopped, Equals, true)
+	c.Assert(ins[3].(*mockIn).stopped, Equals, false)
+	checkMsg(c, out.messagesCh, msg(1001, 1))
+	checkMsg(c, out.messagesCh, msg(3001, 1))
+	select {
+	case msg := <-out.messagesCh:
+		c.Errorf("Unexpected message: %v", msg)
+	default:
+	}
+}
+
+// Inputs with closed channels are not multiplexed after rewiring.
+func (s *MultiplexerSuite) TestWireUpInputChanClosed(c *C) {
+	ins := map[int32]In{
+		1: newMockIn(msg(1001, 1), msg(1002, 1)),
+		2: newMockIn(),
+		3: newMockIn(msg(3001, 1)),
+	}
+	out := newMockOut(0)
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
+	defer m.Stop()
+	m.WireUp(out, []int32{1, 2})
+	close(ins[2].(*mockIn).messagesCh)
+	checkMsg(c, out.messagesCh, msg(1001, 1))
+
+	// When
+	m.WireUp(out, []int32{1, 2, 3})
+
+	// Then
+	checkMsg(c, out.messagesCh, msg(1002, 1))
+	checkMsg(c, out.messagesCh, msg(3001, 1))
+	select {
+	case msg := <-out.messagesCh:
+		c.Errorf("Unexpected message: %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func (s *MultiplexerSuite) TestWireUpSame(c *C) {
 	ins := map[int32]In{
 		1: newMockIn(msg(1001, 1)),
@@ -344,7 +461,7 @@ func (s *MultiplexerSuite) TestWireUpSame(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -372,7 +489,7 @@ func (s *MultiplexerSuite) TestWireUpEmpty(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -398,7 +515,7 @@ func (s *MultiplexerSuite) TestWireUpNil(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out, []int32{2, 4})
@@ -425,7 +542,7 @@ func (s *MultiplexerSuite) TestWireUpOutChanged(c *C) {
 	}
 	out1 := newMockOut(0)
 	out2 := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out1, []int32{2, 4})
@@ -458,7 +575,7 @@ func (s *MultiplexerSuite) TestWireUpOutNil(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out1 := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	c.Assert(m.IsRunning(), Equals, false)
 	m.WireUp(out1, []int32{2, 4})
@@ -484,7 +601,7 @@ func (s *MultiplexerSuite) TestStop(c *C) {
 		5: newMockIn(msg(5001, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	m.WireUp(out, []int32{2, 4})
 	c.Assert(m.IsRunning(), Equals, true)
 
@@ -515,7 +632,7 @@ func (s *MultiplexerSuite) TestInputChanClose(c *C) {
 			msg(3003, 1)),
 	}
 	out := newMockOut(0)
-	m := New(s.ns, func(p int32) In { return ins[p] })
+	m := New(s.ns, config.MuxLag, func(p int32) In { return ins[p] })
 	defer m.Stop()
 	m.WireUp(out, []int32{1, 2, 3})
 	c.Assert(m.IsRunning(), Equals, true)
@@ -535,6 +652,7 @@ func (s *MultiplexerSuite) TestInputChanClose(c *C) {
 
 type mockIn struct {
 	messagesCh chan consumer.Message
+	stopped    bool
 }
 
 func newMockIn(messages ...consumer.Message) *mockIn {
@@ -554,6 +672,7 @@ func (mi *mockIn) Messages() <-chan consumer.Message {
 
 // implements `In`
 func (mi *mockIn) Stop() {
+	mi.stopped = true
 }
 
 type mockOut struct {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mailgun/kafka-pixy/actor"
@@ -15,6 +16,17 @@ import (
 
 const (
 	base64EncodeMap = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	// handoffMarker is appended to the metadata of an offset committed by a
+	// partition consumer that released the partition gracefully. It is not
+	// a part of the sparse acks encoding alphabet.
+	handoffMarker = "."
+
+	// ackMetaSeparator separates metadata given with acks from sparse acks
+	// in offset metadata, that is laid out as `[<ack meta>~]<sparse acks>[.]`.
+	// It is not a part of the sparse acks encoding alphabet either, so the
+	// ack metadata itself can contain it.
+	ackMetaSeparator = "~"
 )
 
 var (
@@ -40,8 +52,10 @@ type T struct {
 	actorID      *actor.ID
 	offerTimeout time.Duration
 	offset       offsetmgr.Offset
+	ackMeta      string
 	ackedRanges  []offsetRange
 	offers       []offer
+	nackedCount  int
 }
 
 // SparseAcks2Str returns human readable representation of sparsely committed
@@ -60,6 +74,32 @@ func SparseAcks2Str(offset offsetmgr.Offset) string {
 	return buf.String()
 }
 
+// AckMeta returns metadata given with acks that is stored in the specified
+// offset metadata.
+func AckMeta(offset offsetmgr.Offset) string {
+	ackMeta, _ := splitMeta(offset.Meta)
+	return ackMeta
+}
+
+// MarkHandoff returns the specified offset with metadata marked to tell the
+// next owner of the partition that it has been released gracefully.
+func MarkHandoff(offset offsetmgr.Offset) offsetmgr.Offset {
+	if !strings.HasSuffix(offset.Meta, handoffMarker) {
+		offset.Meta += handoffMarker
+	}
+	return offset
+}
+
+// UnmarkHandoff removes a handoff marker from the specified offset metadata.
+// It also returns whether the marker was there.
+func UnmarkHandoff(offset offsetmgr.Offset) (offsetmgr.Offset, bool) {
+	if !strings.HasSuffix(offset.Meta, handoffMarker) {
+		return offset, false
+	}
+	offset.Meta = strings.TrimSuffix(offset.Meta, handoffMarker)
+	return offset, true
+}
+
 // New creates a new offset tracker instance.
 func New(actorID *actor.ID, offset offsetmgr.Offset, offerTimeout time.Duration) *T {
 	ot := T{
@@ -67,8 +107,9 @@ func New(actorID *actor.ID, offset offsetmgr.Offset, offerTimeout time.Duration)
 		offerTimeout: offerTimeout,
 		offset:       offset,
 	}
+	ot.ackMeta, ot.offset.Meta = splitMeta(offset.Meta)
 	var err error
-	ot.ackedRanges, err = decodeAckedRanges(offset.Val, offset.Meta)
+	ot.ackedRanges, err = decodeAckedRanges(offset.Val, ot.offset.Meta)
 	if err != nil {
 		ot.ackedRanges = nil
 		ot.offset.Meta = ""
@@ -81,11 +122,11 @@ func New(actorID *actor.ID, offset offsetmgr.Offset, offerTimeout time.Duration)
 // offset value are dropped.
 func (ot *T) Adjust(offset int64) offsetmgr.Offset {
 	if offset < ot.offset.Val {
-		return ot.offset
+		return ot.submittable()
 	}
 	ot.dropOffers(offset)
 	ot.correctOffset(offset)
-	return ot.offset
+	return ot.submittable()
 }
 
 // OnOffered should be called when a message has been offered to a consumer. It
@@ -134,7 +175,49 @@ func (ot *T) OnAcked(offset int64) (offsetmgr.Offset, int) {
 	if ackedRangesUpdated {
 		ot.offset.Meta = encodeAckedRanges(ot.offset.Val, ot.ackedRanges)
 	}
-	return ot.offset, len(ot.offers)
+	return ot.submittable(), len(ot.offers)
+}
+
+// SetAckMeta sets metadata to be stored with offsets returned by the
+// tracker from now on, e.g. the name of the host that acknowledged messages.
+// It replaces metadata set before.
+func (ot *T) SetAckMeta(ackMeta string) {
+	ot.ackMeta = ackMeta
+}
+
+// OnNacked should be called when a message has been rejected by a consumer.
+// The message becomes due for retry after the specified backoff. It returns
+// false if the message has not been offered.
+func (ot *T) OnNacked(offset int64, backoff time.Duration, reason string) bool {
+	return ot.onNacked(offset, time.Now().Add(backoff), reason)
+}
+func (ot *T) onNacked(offset int64, deadline time.Time, reason string) bool {
+	i := sort.Search(len(ot.offers), func(i int) bool {
+		return ot.offers[i].msg.Offset >= offset
+	})
+	if i >= len(ot.offers) || ot.offers[i].msg.Offset != offset {
+		return false
+	}
+	o := &ot.offers[i]
+	o.deadline = deadline
+	o.reason = reason
+	if !o.nacked {
+		o.nacked = true
+		ot.nackedCount += 1
+	}
+	return true
+}
+
+// NackReason returns the reason given with the last nack of an offered
+// message, or an empty string if there is none.
+func (ot *T) NackReason(offset int64) string {
+	i := sort.Search(len(ot.offers), func(i int) bool {
+		return ot.offers[i].msg.Offset >= offset
+	})
+	if i >= len(ot.offers) || ot.offers[i].msg.Offset != offset {
+		return ""
+	}
+	return ot.offers[i].reason
 }
 
 // IsAcked checks if an offset has already been acknowledged. The second
@@ -166,18 +249,29 @@ func (ot *T) NextRetry() (consumer.Message, int, bool) {
 func (ot *T) nextRetry(now time.Time) (consumer.Message, int, bool) {
 	for i := range ot.offers {
 		o := &ot.offers[i]
-		if o.deadline.Before(now) {
+		// A nacked offer is due for retry at its deadline, whereas a timed
+		// out one only after it.
+		due := o.deadline.Before(now)
+		if o.nacked {
+			due = !o.deadline.After(now)
+		}
+		if due {
 			o.deadline = now.Add(ot.offerTimeout)
 			o.retryNo += 1
+			if o.nacked {
+				o.nacked = false
+				ot.nackedCount -= 1
+			}
 			return o.msg, o.retryNo, true
 		}
 		// When we reach the first never retried offer with a deadline set in
 		// the future it is guaranteed that all further offers in the list have
 		// not expired yet. BUT it is only true if messages are offered in the
-		// order of their offsets. Which is indeed how partition consumer is
-		// doing it. However the offset tracker API allows any order. So the
-		// following logic is not valid in general case.
-		if o.retryNo == 0 {
+		// order of their offsets and none of them have been nacked. Which is
+		// indeed how partition consumer is doing it. However the offset
+		// tracker API allows any order. So the following logic is not valid
+		// in general case.
+		if o.retryNo == 0 && ot.nackedCount == 0 {
 			return consumer.Message{}, -1, false
 		}
 	}
@@ -191,7 +285,8 @@ func (ot *T) ShouldWait4Ack() (bool, time.Duration) {
 }
 func (ot *T) shouldWait4Ack(now time.Time) (bool, time.Duration) {
 	for _, o := range ot.offers {
-		if o.deadline.After(now) {
+		// There is no point to wait for a nacked message to be acked.
+		if !o.nacked && o.deadline.After(now) {
 			timeout := o.deadline.Sub(now)
 			log.Infof("<%s> waiting for acks: count=%d, offset=%d, timeout=%v",
 				ot.actorID, len(ot.offers), o.offset, timeout)
@@ -205,8 +300,18 @@ func (ot *T) shouldWait4Ack(now time.Time) (bool, time.Duration) {
 	return false, 0
 }
 
+// submittable returns the tracked offset with ack metadata added to its
+// metadata.
+func (ot *T) submittable() offsetmgr.Offset {
+	offset := ot.offset
+	if ot.ackMeta != "" {
+		offset.Meta = ot.ackMeta + ackMetaSeparator + offset.Meta
+	}
+	return offset
+}
+
 func (ot *T) newOffer(msg consumer.Message) offer {
-	return offer{msg, msg.Offset, 0, time.Now().Add(ot.offerTimeout)}
+	return offer{msg: msg, offset: msg.Offset, deadline: time.Now().Add(ot.offerTimeout)}
 }
 
 func (ot *T) removeOffer(offset int64) bool {
@@ -217,6 +322,9 @@ func (ot *T) removeOffer(offset int64) bool {
 	if i >= offersCount || ot.offers[i].msg.Offset != offset {
 		return false
 	}
+	if ot.offers[i].nacked {
+		ot.nackedCount -= 1
+	}
 	offersCount -= 1
 	copy(ot.offers[i:offersCount], ot.offers[i+1:])
 	ot.offers[offersCount] = offer{} // Makes it subject for garbage collection.
@@ -231,6 +339,9 @@ func (ot *T) dropOffers(offset int64) {
 			break
 		}
 		drop = i + 1
+		if offer.nacked {
+			ot.nackedCount -= 1
+		}
 		log.Errorf("<%v> offer dropped: offset=%d", ot.actorID, offer.offset)
 	}
 	if drop > 0 {
@@ -325,7 +436,19 @@ func encodeAckedRanges(base int64, ackedRanges []offsetRange) string {
 	return string(buf)
 }
 
+// splitMeta splits offset metadata into ack metadata and the rest, that is
+// sparse acks possibly followed by a handoff marker.
+func splitMeta(meta string) (string, string) {
+	i := strings.LastIndex(meta, ackMetaSeparator)
+	if i < 0 {
+		return "", meta
+	}
+	return meta[:i], meta[i+1:]
+}
+
 func decodeAckedRanges(base int64, encoded string) ([]offsetRange, error) {
+	_, encoded = splitMeta(encoded)
+	encoded = strings.TrimSuffix(encoded, handoffMarker)
 	if encoded == "" {
 		return nil, nil
 	}
@@ -405,4 +528,7 @@ type offer struct {
 	offset   int64
 	retryNo  int
 	deadline time.Time
+	nacked   bool
+	// The reason given with the last nack of the message.
+	reason string
 }
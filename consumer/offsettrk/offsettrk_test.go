@@ -203,6 +203,43 @@ func (s *OffsetTrkSuite) TestNew(c *C) {
 	}
 }
 
+func (s *OffsetTrkSuite) TestHandoffMarker(c *C) {
+	offset := offsetmgr.Offset{Val: 1000, Meta: "abra"}
+
+	// When
+	marked := MarkHandoff(offset)
+
+	// Then
+	c.Assert(marked, Equals, offsetmgr.Offset{Val: 1000, Meta: "abra."})
+	c.Assert(MarkHandoff(marked), Equals, marked)
+	c.Assert(SparseAcks2Str(marked), Equals, SparseAcks2Str(offset))
+	unmarked, ok := UnmarkHandoff(marked)
+	c.Assert(unmarked, Equals, offset)
+	c.Assert(ok, Equals, true)
+	unmarked, ok = UnmarkHandoff(offset)
+	c.Assert(unmarked, Equals, offset)
+	c.Assert(ok, Equals, false)
+}
+
+// Ack metadata is kept apart from sparse acks, and is added to the metadata
+// of returned offsets.
+func (s *OffsetTrkSuite) TestAckMeta(c *C) {
+	ot := New(s.ns, offsetmgr.Offset{Val: 1000, Meta: "host~1~abra1234+/P"}, -1)
+	c.Assert(ot.offset, Equals, offsetmgr.Offset{Val: 1000, Meta: "abra1234+/P"})
+	c.Assert(ot.ackMeta, Equals, "host~1")
+
+	// When
+	ot.SetAckMeta("host2")
+	offset, _ := ot.OnAcked(1000)
+
+	// Then
+	c.Assert(offset.Meta, Equals, "host2~"+ot.offset.Meta)
+	c.Assert(AckMeta(offset), Equals, "host2")
+	c.Assert(SparseAcks2Str(offset), Equals, SparseAcks2Str(ot.offset))
+	c.Assert(AckMeta(MarkHandoff(offset)), Equals, "host2")
+	c.Assert(AckMeta(offsetmgr.Offset{Val: 1000, Meta: "abra."}), Equals, "")
+}
+
 func (s *OffsetTrkSuite) TestIsAcked(c *C) {
 	meta := encodeAckedRanges(301, []offsetRange{
 		{302, 305}, {307, 309}, {310, 313}})
@@ -394,3 +431,94 @@ func (s *OffsetTrkSuite) TestShouldWait4Ack(c *C) {
 		c.Assert(timeout, Equals, time.Duration(tc.timeout)*time.Millisecond, Commentf("case #%d", i))
 	}
 }
+
+// A nacked message is retried right away, even if it is preceded by offers
+// that have not expired yet.
+func (s *OffsetTrkSuite) TestNackedRetry(c *C) {
+	ot := New(s.ns, offsetmgr.Offset{Val: 300}, 5*time.Second)
+	begin := time.Now()
+	for _, msg := range []consumer.Message{{Offset: 300}, {Offset: 301}, {Offset: 302}} {
+		ot.OnOffered(msg)
+	}
+	ot.offers[0].deadline = begin.Add(5 * time.Second)
+	ot.offers[1].deadline = begin.Add(5 * time.Second)
+	ot.offers[2].deadline = begin.Add(5 * time.Second)
+
+	// When
+	now := begin.Add(time.Second)
+	c.Assert(ot.onNacked(301, now, "kaboom"), Equals, true)
+	c.Assert(ot.onNacked(303, now, ""), Equals, false)
+
+	// Then
+	msg, retryNo, ok := ot.nextRetry(now)
+	c.Assert(ok, Equals, true)
+	c.Assert(msg.Offset, Equals, int64(301))
+	c.Assert(retryNo, Equals, 1)
+	c.Assert(ot.nackedCount, Equals, 0)
+	// The nack reason outlives the retry.
+	c.Assert(ot.NackReason(301), Equals, "kaboom")
+	c.Assert(ot.NackReason(300), Equals, "")
+	// The retried message is given the regular offer timeout.
+	_, _, ok = ot.nextRetry(now.Add(time.Second))
+	c.Assert(ok, Equals, false)
+	msg, retryNo, ok = ot.nextRetry(begin.Add(5*time.Second + time.Millisecond))
+	c.Assert(ok, Equals, true)
+	c.Assert(msg.Offset, Equals, int64(300))
+	c.Assert(retryNo, Equals, 1)
+}
+
+// Nacked count is maintained when nacked offers are acked or dropped.
+func (s *OffsetTrkSuite) TestNackedAckedAndDropped(c *C) {
+	ot := New(s.ns, offsetmgr.Offset{Val: 300}, 5*time.Second)
+	for _, msg := range []consumer.Message{{Offset: 300}, {Offset: 301}, {Offset: 302}} {
+		ot.OnOffered(msg)
+	}
+	ot.OnNacked(300, 0, "")
+	ot.OnNacked(300, 0, "")
+	ot.OnNacked(302, 0, "")
+	c.Assert(ot.nackedCount, Equals, 2)
+
+	// When
+	ot.OnAcked(302)
+	ot.Adjust(301)
+
+	// Then
+	c.Assert(ot.nackedCount, Equals, 0)
+	c.Assert(len(ot.offers), Equals, 1)
+}
+
+// A nacked message is not retried until its backoff expires.
+func (s *OffsetTrkSuite) TestNackedBackoff(c *C) {
+	ot := New(s.ns, offsetmgr.Offset{Val: 300}, 5*time.Second)
+	begin := time.Now()
+	for _, msg := range []consumer.Message{{Offset: 300}, {Offset: 301}} {
+		ot.OnOffered(msg)
+	}
+	ot.offers[0].deadline = begin.Add(5 * time.Second)
+	ot.offers[1].deadline = begin.Add(5 * time.Second)
+
+	// When
+	c.Assert(ot.onNacked(300, begin.Add(2*time.Second), ""), Equals, true)
+
+	// Then
+	_, _, ok := ot.nextRetry(begin.Add(time.Second))
+	c.Assert(ok, Equals, false)
+	msg, retryNo, ok := ot.nextRetry(begin.Add(2 * time.Second))
+	c.Assert(ok, Equals, true)
+	c.Assert(msg.Offset, Equals, int64(300))
+	c.Assert(retryNo, Equals, 1)
+}
+
+// Acks are not waited for nacked messages.
+func (s *OffsetTrkSuite) TestShouldWait4AckNacked(c *C) {
+	ot := New(s.ns, offsetmgr.Offset{Val: 300}, 5*time.Second)
+	begin := time.Now()
+	ot.OnOffered(consumer.Message{Offset: 300})
+	ot.onNacked(300, begin.Add(2*time.Second), "")
+
+	// When
+	ok, _ := ot.shouldWait4Ack(begin)
+
+	// Then
+	c.Assert(ok, Equals, false)
+}
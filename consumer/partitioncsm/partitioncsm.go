@@ -3,19 +3,24 @@ package partitioncsm
 import (
 	"encoding/base64"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/groupmember"
 	"github.com/mailgun/kafka-pixy/consumer/msgfetcher"
 	"github.com/mailgun/kafka-pixy/consumer/offsettrk"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/kafka-pixy/offsetmgr"
+	"github.com/mailgun/kafka-pixy/redact"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
 )
 
 var (
@@ -35,24 +40,41 @@ var (
 // message is pulled from the `messages()` channel, it is considered to be
 // consumed and its offset is committed.
 type T struct {
-	actorID     *actor.ID
-	cfg         *config.Proxy
-	group       string
-	topic       string
-	partition   int32
-	groupMember *groupmember.T
-	msgFetcherF msgfetcher.Factory
-	offsetMgrF  offsetmgr.Factory
-	messagesCh  chan consumer.Message
-	eventsCh    chan consumer.Event
-	stopCh      chan none.T
-	wg          sync.WaitGroup
+	actorID       *actor.ID
+	cfg           *config.Proxy
+	group         string
+	topic         string
+	partition     int32
+	groupMember   *groupmember.T
+	msgFetcherF   msgfetcher.Factory
+	offsetMgrF    offsetmgr.Factory
+	deadLetterer  consumer.DeadLetterer
+	initialOffset config.InitialOffset
+	messagesCh    chan consumer.Message
+	eventsCh      chan consumer.Event
+	sup           *actor.Supervisor
+	lag           gometrics.Gauge
+	redactor      *redact.T
 
 	offsetMgr       offsetmgr.T
 	committedOffset offsetmgr.Offset
 	submittedOffset offsetmgr.Offset
 	offsetsOk       bool
 	offsetTrk       *offsettrk.T
+	claimed         bool
+	offeredCount    int
+	// Offset of the last message received from the message fetcher.
+	fetchedOffset int64
+	// Closed on seek to drop messages pushed to the messages channel by the
+	// current fetch loop.
+	droppedCh chan none.T
+	// Offset of a message dropped by the last seek after it had been pushed
+	// to the messages channel, or -1 if there was none. Its offer is ignored
+	// if it comes after the seek.
+	droppedOffset int64
+
+	stateMu sync.Mutex
+	state   consumer.PartitionState
 
 	// For tests only!
 	firstMsgFetched bool
@@ -61,21 +83,35 @@ type T struct {
 // Spawn creates a partition consumer instance and starts its goroutines.
 func Spawn(namespace *actor.ID, group, topic string, partition int32, cfg *config.Proxy,
 	groupMember *groupmember.T, msgFetcherF msgfetcher.Factory, offsetMgrF offsetmgr.Factory,
+	deadLetterer consumer.DeadLetterer, initialOffset config.InitialOffset,
 ) *T {
+	actorID := namespace.NewChild(fmt.Sprintf("P:%s_%d", topic, partition))
 	pc := &T{
-		actorID:     namespace.NewChild(fmt.Sprintf("P:%s_%d", topic, partition)),
-		cfg:         cfg,
-		group:       group,
-		topic:       topic,
-		partition:   partition,
-		groupMember: groupMember,
-		msgFetcherF: msgFetcherF,
-		offsetMgrF:  offsetMgrF,
-		messagesCh:  make(chan consumer.Message, 1),
-		eventsCh:    make(chan consumer.Event, 1),
-		stopCh:      make(chan none.T),
+		actorID:       actorID,
+		cfg:           cfg,
+		group:         group,
+		topic:         topic,
+		partition:     partition,
+		groupMember:   groupMember,
+		msgFetcherF:   msgFetcherF,
+		offsetMgrF:    offsetMgrF,
+		deadLetterer:  deadLetterer,
+		initialOffset: initialOffset,
+		messagesCh:    make(chan consumer.Message, 1),
+		eventsCh:      make(chan consumer.Event, 1),
+		state:         consumer.PartitionState{Partition: partition},
+		lag: metrics.Gauge("consumer_lag", "cluster", cfg.Cluster, "group", group, "topic", topic,
+			"partition", strconv.Itoa(int(partition))),
+		redactor: redact.New(cfg),
 	}
-	actor.Spawn(pc.actorID, &pc.wg, pc.run)
+	// A partition consumer can fail due to a transient broker error, so it is
+	// restarted for as long as it takes. Failures are reported in logs,
+	// metrics and the actor tree.
+	pc.sup = actor.NewSupervisor(actorID, actor.RestartPolicy{
+		MaxRestarts: -1,
+		Backoff:     cfg.Consumer.RestartBackoff,
+	}, nil)
+	pc.sup.Spawn(pc.actorID, pc.run)
 	return pc
 }
 
@@ -84,64 +120,121 @@ func (pc *T) Partition() int32 {
 	return pc.partition
 }
 
+// State returns a snapshot of the partition consumer state. It can be called
+// from any goroutine.
+func (pc *T) State() consumer.PartitionState {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.state
+}
+
+// publishState makes the current state available to State.
+func (pc *T) publishState() {
+	pc.stateMu.Lock()
+	pc.state = consumer.PartitionState{
+		Partition:       pc.partition,
+		Claimed:         pc.claimed,
+		Initialized:     pc.offsetsOk,
+		CommittedOffset: pc.committedOffset.Val,
+		SubmittedOffset: pc.submittedOffset.Val,
+		Offered:         pc.offeredCount,
+		Lag:             pc.lag.Value(),
+	}
+	pc.stateMu.Unlock()
+}
+
 // implements `multiplexer.In`
 func (pc *T) Messages() <-chan consumer.Message {
 	return pc.messagesCh
 }
 
-func (pc *T) run() {
-	defer close(pc.messagesCh)
-	defer pc.groupMember.ClaimPartition(pc.actorID, pc.topic, pc.partition, pc.stopCh)()
+func (pc *T) run() (err error) {
+	defer func() {
+		if err != nil {
+			metrics.Counter("consumer_partition_failed", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
+		}
+	}()
+	// If this is a restart after a failure, then a message fetched by the
+	// previous run might have been left in the messages channel.
+	select {
+	case <-pc.messagesCh:
+	default:
+	}
+	pc.offsetsOk = false
+	pc.offeredCount = 0
+	pc.droppedOffset = -1
+	pc.publishState()
+	defer pc.groupMember.ClaimPartition(pc.actorID, pc.topic, pc.partition, pc.sup.StopCh())()
+	pc.claimed = true
+	pc.publishState()
+	defer func() {
+		pc.claimed = false
+		pc.publishState()
+	}()
 
-	var err error
 	if pc.offsetMgr, err = pc.offsetMgrF.Spawn(pc.actorID, pc.group, pc.topic, pc.partition); err != nil {
-		panic(errors.Wrapf(err, "<%s> must never happen", pc.actorID))
+		// Must never happen.
+		return errors.Wrap(err, "failed to spawn offset manager")
 	}
 	defer pc.stopOffsetMgr()
 
 	// Wait for the initial offset to be retrieved or a stop signal.
 	select {
 	case pc.committedOffset = <-pc.offsetMgr.CommittedOffsets():
-	case <-pc.stopCh:
-		return
+	case <-pc.sup.StopCh():
+		return nil
 	}
-	log.Infof("<%s> initial offset: %d, sparseAcks=%s",
-		pc.actorID, pc.committedOffset.Val, offsettrk.SparseAcks2Str(pc.committedOffset))
+	// If the group has not committed an offset for the partition yet, then
+	// sarama.OffsetNewest is returned, that is where consumption starts unless
+	// the group is configured to start from the oldest message.
+	if pc.committedOffset.Val == sarama.OffsetNewest && pc.initialOffset == config.InitialOffsetEarliest {
+		pc.committedOffset.Val = sarama.OffsetOldest
+	}
+	var handedOff bool
+	pc.committedOffset, handedOff = offsettrk.UnmarkHandoff(pc.committedOffset)
+	if !handedOff && pc.committedOffset.Val >= 0 {
+		metrics.Counter("consumer_unclean_handoff", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
+	}
+	log.Infof("<%s> initial offset: %d, sparseAcks=%s, handedOff=%t",
+		pc.actorID, pc.committedOffset.Val, offsettrk.SparseAcks2Str(pc.committedOffset), handedOff)
 	pc.offsetTrk = offsettrk.New(pc.actorID, pc.committedOffset, pc.cfg.Consumer.AckTimeout)
 	pc.submittedOffset = pc.committedOffset
 	pc.offsetsOk = true
+	pc.publishState()
 	pc.notifyTestInitialized(pc.committedOffset)
 
-	for pc.runFetchLoop() {
-	}
-
-	for ok, timeout := pc.offsetTrk.ShouldWait4Ack(); ok; ok, timeout = pc.offsetTrk.ShouldWait4Ack() {
-		select {
-		case event := <-pc.eventsCh:
-			if event.T == consumer.EvAcked {
-				pc.submittedOffset, _ = pc.offsetTrk.OnAcked(event.Offset)
-				pc.offsetMgr.SubmitOffset(pc.submittedOffset)
-			}
-		case <-time.After(timeout):
-			continue
+	for {
+		var seek bool
+		if seek, err = pc.runFetchLoop(); err != nil {
+			return err
+		}
+		if !seek {
+			break
 		}
 	}
+	pc.drain()
+	return nil
 }
 
 func (pc *T) Stop() {
-	close(pc.stopCh)
-	pc.wg.Wait()
+	pc.sup.Stop()
+	close(pc.messagesCh)
 }
 
-func (pc *T) runFetchLoop() bool {
+// runFetchLoop fetches messages and pushes them to the messages channel until
+// the partition consumer is ordered to stop, or a seek event is received, in
+// which case it returns true to be called again.
+func (pc *T) runFetchLoop() (bool, error) {
 	// Initialize a message fetcher to read from the initial offset.
 	mf, realOffsetVal, err := pc.msgFetcherF.Spawn(pc.actorID, pc.topic, pc.partition, pc.committedOffset.Val)
 	if err != nil {
-		panic(errors.Wrapf(err, "<%s> must never happen", pc.actorID))
+		return false, errors.Wrap(err, "failed to spawn message fetcher")
 	}
 	defer mf.Stop()
+	pc.droppedCh = make(chan none.T)
 
 	pc.submittedOffset = pc.offsetTrk.Adjust(realOffsetVal)
+	pc.fetchedOffset = pc.submittedOffset.Val - 1
 	// If the real offset is different from the committed one then submit it
 	// and report in the logs.
 	if pc.submittedOffset != pc.committedOffset {
@@ -158,13 +251,18 @@ func (pc *T) runFetchLoop() bool {
 	)
 	defer retryTicker.Stop()
 	for {
+		pc.publishState()
 		select {
 		case msg = <-nilOrMsgFetcherCh:
 			if ok, _ := pc.offsetTrk.IsAcked(msg.Offset); ok {
 				continue
 			}
 			msg.EventsCh = pc.eventsCh
+			msg.DroppedCh = pc.droppedCh
+			msg.DeliveryAttempt = 1
 			msgOk = true
+			pc.fetchedOffset = msg.Offset
+			pc.lag.Update(msg.HighWaterMark - msg.Offset)
 			pc.notifyTestFetched()
 			nilOrMsgFetcherCh = nil
 			nilOrMessagesCh = pc.messagesCh
@@ -175,64 +273,204 @@ func (pc *T) runFetchLoop() bool {
 			if msg, msgOk = pc.nextRetry(); msgOk {
 				nilOrMsgFetcherCh = nil
 				nilOrMessagesCh = pc.messagesCh
+				continue
+			}
+			// Messages that ran out of retries are acknowledged by
+			// nextRetry, that may let fetching resume.
+			if nilOrMsgFetcherCh == nil && pc.canFetch() {
+				nilOrMsgFetcherCh = mf.Messages()
 			}
 		case nilOrMessagesCh <- msg:
 			nilOrMessagesCh = nil
 		case event := <-pc.eventsCh:
 			switch event.T {
 			case consumer.EvOffered:
-				if event.Offset != msg.Offset {
+				// Only the message pushed to the messages channel last can
+				// be offered.
+				if !msgOk || nilOrMessagesCh != nil || event.Offset != msg.Offset {
+					if event.Offset == pc.droppedOffset {
+						log.Infof("<%s> dropped message offer ignored: offset=%d", pc.actorID, event.Offset)
+						continue
+					}
 					log.Errorf("<%s> invalid offer offset %d, want=%d", pc.actorID, event.Offset, msg.Offset)
 					continue
 				}
-				offeredCount := pc.offsetTrk.OnOffered(msg)
+				pc.offeredCount = pc.offsetTrk.OnOffered(msg)
 				if msg, msgOk = pc.nextRetry(); msgOk {
 					nilOrMessagesCh = pc.messagesCh
 					continue
 				}
-				if offeredCount > pc.cfg.Consumer.MaxPendingMessages {
-					log.Warningf("<%s> offered count above HWM: %d", pc.actorID, offeredCount)
+				if pc.offeredCount > pc.cfg.Consumer.MaxPendingMessages {
+					log.Warningf("<%s> offered count above HWM: %d", pc.actorID, pc.offeredCount)
+					nilOrMsgFetcherCh = nil
+					continue
+				}
+				if pc.ackWindowFull() {
+					log.Warningf("<%s> ack window is full: submitted=%d, fetched=%d",
+						pc.actorID, pc.submittedOffset.Val, pc.fetchedOffset)
 					nilOrMsgFetcherCh = nil
 					continue
 				}
 				nilOrMsgFetcherCh = mf.Messages()
 			case consumer.EvAcked:
-				var offeredCount int
-				pc.submittedOffset, offeredCount = pc.offsetTrk.OnAcked(event.Offset)
+				if event.Meta != "" {
+					pc.offsetTrk.SetAckMeta(event.Meta)
+				}
+				pc.submittedOffset, pc.offeredCount = pc.offsetTrk.OnAcked(event.Offset)
 				pc.offsetMgr.SubmitOffset(pc.submittedOffset)
-				if !msgOk && offeredCount <= pc.cfg.Consumer.MaxPendingMessages {
+				if !msgOk && pc.canFetch() {
 					nilOrMsgFetcherCh = mf.Messages()
 				}
+			case consumer.EvNacked:
+				if !pc.offsetTrk.OnNacked(event.Offset, pc.cfg.Consumer.NackBackoff, event.Meta) {
+					log.Errorf("<%s> bad nack: offset=%d", pc.actorID, event.Offset)
+					continue
+				}
+				if msgOk {
+					continue
+				}
+				if msg, msgOk = pc.nextRetry(); msgOk {
+					nilOrMsgFetcherCh = nil
+					nilOrMessagesCh = pc.messagesCh
+				}
+			case consumer.EvSeek:
+				pc.droppedOffset = -1
+				if msgOk && nilOrMessagesCh == nil {
+					pc.droppedOffset = msg.Offset
+				}
+				pc.seek(event.Offset)
+				return true, nil
 			}
 		case pc.committedOffset = <-pc.offsetMgr.CommittedOffsets():
-		case <-pc.stopCh:
-			return false
+		case <-pc.sup.StopCh():
+			return false, nil
+		}
+	}
+}
+
+// drain is called when the partition consumer is stopping and is not fetching
+// messages anymore. It waits for offered messages to be acknowledged, but no
+// longer than `Config.Consumer.AckTimeout` since they were offered. Messages
+// offered while the partition consumer is stopping, e.g. by a long polling
+// request that has just received one, are waited for too. Finally the offset
+// is submitted with a handoff marker, so that the next owner of the partition
+// knows that it has been released gracefully.
+func (pc *T) drain() {
+	for {
+		// Handle events that are already pending before deciding whether
+		// there is anything to wait for.
+		select {
+		case event := <-pc.eventsCh:
+			pc.onDrainEvent(event)
+			continue
+		default:
+		}
+		pc.publishState()
+		ok, timeout := pc.offsetTrk.ShouldWait4Ack()
+		if !ok {
+			break
+		}
+		select {
+		case event := <-pc.eventsCh:
+			pc.onDrainEvent(event)
+		case <-time.After(timeout):
 		}
 	}
+	pc.submittedOffset = offsettrk.MarkHandoff(pc.submittedOffset)
+	pc.offsetMgr.SubmitOffset(pc.submittedOffset)
+}
+
+func (pc *T) onDrainEvent(event consumer.Event) {
+	switch event.T {
+	case consumer.EvOffered:
+		pc.offeredCount = pc.offsetTrk.OnOffered(consumer.Message{Offset: event.Offset})
+	case consumer.EvAcked:
+		if event.Meta != "" {
+			pc.offsetTrk.SetAckMeta(event.Meta)
+		}
+		pc.submittedOffset, pc.offeredCount = pc.offsetTrk.OnAcked(event.Offset)
+		pc.offsetMgr.SubmitOffset(pc.submittedOffset)
+	case consumer.EvNacked:
+		// A nacked message is not going to be offered again by this
+		// partition consumer, so there is no point to wait for its ack.
+		pc.offsetTrk.OnNacked(event.Offset, 0, event.Meta)
+	default:
+		log.Infof("<%s> event ignored while stopping: %v", pc.actorID, event)
+	}
+}
+
+// canFetch tells whether more messages can be offered, that is neither the
+// maximum number of pending messages is reached, nor the ack window is full.
+func (pc *T) canFetch() bool {
+	return pc.offeredCount <= pc.cfg.Consumer.MaxPendingMessages && !pc.ackWindowFull()
+}
+
+// ackWindowFull tells whether the next fetched message would be
+// `Config.Consumer.MaxAckWindow` or more messages ahead of the first one that
+// has not been acknowledged yet.
+func (pc *T) ackWindowFull() bool {
+	window := pc.cfg.Consumer.MaxAckWindow
+	return window > 0 && pc.fetchedOffset+1-pc.submittedOffset.Val >= int64(window)
 }
 
 // nextRetry checks with the offset tracker if there is a message ready to be
 // retried. If it gets a message that has already been retried maxRetries times,
-// then it acks the message and asks the offset tracker for another one. It
-// continues doing that until either a message with less then maxRetries is
-// returned or there are no more messages to be retried.
+// then it hands the message over to the dead letterer if there is one, acks
+// it, and asks the offset tracker for another one. It continues doing that
+// until either a message with less then maxRetries is returned or there are
+// no more messages to be retried.
+//
+// A message that fails to be dead lettered is not acked, so it is given up
+// on again, and dead lettered again, after `Consumer.AckTimeout`.
 func (pc *T) nextRetry() (consumer.Message, bool) {
 	msg, retryNo, ok := pc.offsetTrk.NextRetry()
 	for ok && retryNo > pc.cfg.Consumer.MaxRetries {
-		log.Errorf("<%s> too many retries: retryNo=%d, offset=%d, key=%s, msg=%s",
-			pc.actorID, retryNo, msg.Offset, string(msg.Key), base64.StdEncoding.EncodeToString(msg.Value))
-		pc.submittedOffset, _ = pc.offsetTrk.OnAcked(msg.Offset)
+		reason := pc.offsetTrk.NackReason(msg.Offset)
+		log.Errorf("<%s> too many retries: retryNo=%d, offset=%d, reason=%s, key=%s, msg=%s",
+			pc.actorID, retryNo, msg.Offset, reason, string(msg.Key), base64.StdEncoding.EncodeToString(pc.redactor.Value(msg.Value)))
+		if pc.deadLetterer != nil {
+			if err := pc.deadLetterer.DeadLetter(pc.group, msg, retryNo, reason); err != nil {
+				log.Errorf("<%s> failed to dead letter: offset=%d, err=(%s)", pc.actorID, msg.Offset, err)
+				metrics.Counter("consumer_dead_letter_failed", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
+				msg, retryNo, ok = pc.offsetTrk.NextRetry()
+				continue
+			}
+			metrics.Counter("consumer_dead_lettered", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
+		}
+		pc.submittedOffset, pc.offeredCount = pc.offsetTrk.OnAcked(msg.Offset)
 		pc.offsetMgr.SubmitOffset(pc.submittedOffset)
-		// TODO: Dump expired messages to a long term storage?
+		metrics.Counter("consumer_retries_exhausted", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
 		msg, retryNo, ok = pc.offsetTrk.NextRetry()
 	}
 	if ok {
+		msg.DroppedCh = pc.droppedCh
+		msg.DeliveryAttempt = retryNo + 1
 		log.Warningf("<%s> retrying: retryNo=%d, offset=%d, key=%s",
 			pc.actorID, retryNo, msg.Offset, string(msg.Key))
+		metrics.Counter("consumer_retry", "cluster", pc.cfg.Cluster, "group", pc.group, "topic", pc.topic).Inc(1)
 	}
 	return msg, ok
 }
 
+// seek forgets about all offered messages and submits the specified offset
+// as if it has been committed, so that the next fetch loop starts from it. A
+// message that has been pushed to the messages channel but has not been
+// picked up yet is taken back, and if it has been picked up, e.g. by the
+// multiplexer, but not offered yet, then it is dropped, so that clients never
+// get messages from before the seek.
+func (pc *T) seek(offset int64) {
+	log.Infof("<%s> seek: offset=%d, was=%d", pc.actorID, offset, pc.submittedOffset.Val)
+	select {
+	case <-pc.messagesCh:
+	default:
+	}
+	close(pc.droppedCh)
+	pc.committedOffset = offsetmgr.Offset{Val: offset}
+	pc.offsetTrk = offsettrk.New(pc.actorID, pc.committedOffset, pc.cfg.Consumer.AckTimeout)
+	pc.submittedOffset = pc.committedOffset
+	pc.offsetMgr.SubmitOffset(pc.submittedOffset)
+}
+
 func (pc *T) stopOffsetMgr() {
 	pc.offsetMgr.Stop()
 	if !pc.offsetsOk {
@@ -1,6 +1,7 @@
 package partitioncsm
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/mailgun/kafka-pixy/testhelpers"
 	"github.com/mailgun/kafka-pixy/testhelpers/kafkahelper"
 	"github.com/mailgun/log"
+	"github.com/pkg/errors"
 	. "gopkg.in/check.v1"
 )
 
@@ -77,7 +79,7 @@ func (s *PartitionCsmSuite) TestOldestOffset(c *C) {
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{sarama.OffsetOldest, ""}})
 	offsets := s.kh.GetCommittedOffsets(group, topic)
 	c.Assert(offsets[partition], Equals, offsetmgr.Offset{sarama.OffsetOldest, ""})
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 
 	// When
 	<-pc.Messages()
@@ -88,6 +90,22 @@ func (s *PartitionCsmSuite) TestOldestOffset(c *C) {
 	c.Assert(offsets[partition].Val, Equals, oldestOffsets[partition])
 }
 
+// If there is no committed offset, that is sarama.OffsetNewest is returned,
+// and the group initial offset policy is earliest, then consumption starts
+// from the oldest message.
+func (s *PartitionCsmSuite) TestInitialOffsetEarliest(c *C) {
+	oldestOffsets := s.kh.GetOldestOffsets(topic)
+	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetNewest}})
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetEarliest)
+	defer pc.Stop()
+
+	// When
+	msg := <-pc.Messages()
+
+	// Then
+	c.Assert(msg.Offset, Equals, oldestOffsets[partition])
+}
+
 // If initial offset stored in Kafka is greater then the newest offset for a
 // partition, then partition consumer will wait for the given offset to be
 // reached by produced messages and the first message returned will the one
@@ -97,7 +115,7 @@ func (s *PartitionCsmSuite) TestInitialOffsetTooLarge(c *C) {
 	newestOffsets := s.kh.GetNewestOffsets(topic)
 	log.Infof("*** test.1 offsets: oldest=%v, newest=%v", oldestOffsets, newestOffsets)
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{newestOffsets[partition] + 3, ""}})
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 	// Wait for the partition consumer to initialize.
 	initialOffset := <-s.initOffsetCh
@@ -119,7 +137,7 @@ func (s *PartitionCsmSuite) TestInitialOffsetTooLarge(c *C) {
 // previous one is reported as offered.
 func (s *PartitionCsmSuite) TestMustBeOfferedToProceed(c *C) {
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{sarama.OffsetOldest, ""}})
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 
 	// When
@@ -162,7 +180,7 @@ func (s *PartitionCsmSuite) TestSparseAckedNotRead(c *C) {
 	c.Assert(offsettrk.SparseAcks2Str(initOffset), Equals, "1-4,6-7")
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{initOffset})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 
 	// When/Then: only messages that has not been acked previously are returned.
@@ -184,18 +202,18 @@ func (s *PartitionCsmSuite) TestSparseAckedNotRead(c *C) {
 // Messages() channel is ignored.
 func (s *PartitionCsmSuite) TestOfferInvalid(c *C) {
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{sarama.OffsetOldest, ""}})
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 
 	msg, ok := <-pc.Messages()
 	c.Assert(ok, Equals, true)
 
 	// When
-	msg.EventsCh <- consumer.Event{consumer.EvOffered, msg.Offset + 1}
-	msg.EventsCh <- consumer.Event{consumer.EvOffered, msg.Offset - 1}
+	msg.EventsCh <- consumer.Event{T: consumer.EvOffered, Offset: msg.Offset + 1}
+	msg.EventsCh <- consumer.Event{T: consumer.EvOffered, Offset: msg.Offset - 1}
 
 	// Then
-	msg.EventsCh <- consumer.Event{consumer.EvOffered, msg.Offset}
+	msg.EventsCh <- consumer.Event{T: consumer.EvOffered, Offset: msg.Offset}
 	msg2, ok := <-pc.Messages()
 	c.Assert(msg2.Offset, Equals, msg.Offset+1)
 	c.Assert(ok, Equals, true)
@@ -208,7 +226,7 @@ func (s *PartitionCsmSuite) TestOfferedTooMany(c *C) {
 	s.cfg.Consumer.AckTimeout = 500 * time.Millisecond
 	s.cfg.Consumer.MaxPendingMessages = 3
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{sarama.OffsetOldest, ""}})
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 	var msg consumer.Message
 
@@ -263,7 +281,7 @@ func (s *PartitionCsmSuite) TestSparseAckedCommitted(c *C) {
 	}
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 
 	// When
 	for _, shouldAck := range acks {
@@ -289,7 +307,7 @@ func (s *PartitionCsmSuite) TestSparseAckedAfterStop(c *C) {
 	s.cfg.Consumer.AckTimeout = 300 * time.Millisecond
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 
 	var messages []consumer.Message
 	for i := 0; i < 10; i++ {
@@ -337,7 +355,7 @@ func (s *PartitionCsmSuite) TestMaxRetriesReached(c *C) {
 	s.cfg.Consumer.MaxRetries = 3
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 
 	var messages []consumer.Message
 	for i := 0; i < 3; i++ {
@@ -360,6 +378,8 @@ func (s *PartitionCsmSuite) TestMaxRetriesReached(c *C) {
 		sendEvOffered(msgI)
 		sendEvAcked(msgI)
 		// ...but retried messages are not.
+		messages[0].DeliveryAttempt = i + 2
+		messages[2].DeliveryAttempt = i + 2
 		msg0_i := <-pc.Messages()
 		c.Assert(msg0_i, DeepEquals, messages[0], Commentf(
 			"got: %d, want: %d", msg0_i.Offset, messages[0].Offset))
@@ -387,6 +407,37 @@ func (s *PartitionCsmSuite) TestMaxRetriesReached(c *C) {
 	c.Assert(offsettrk.SparseAcks2Str(offsetsAfter[partition]), Equals, "")
 }
 
+// A message given up on is only acked once it is dead lettered, and the
+// reason of its last nack is passed to the dead letterer.
+func (s *PartitionCsmSuite) TestDeadLetterFailed(c *C) {
+	offsetsBefore := s.kh.GetOldestOffsets(topic)
+	s.cfg.Consumer.AckTimeout = 100 * time.Millisecond
+	s.cfg.Consumer.MaxRetries = 0
+	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
+	dl := &fakeDeadLetterer{failures: 1}
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, dl, config.InitialOffsetLatest)
+
+	msg0 := <-pc.Messages()
+	sendEvOffered(msg0)
+	msg0.EventsCh <- consumer.NackWithReason(msg0.Offset, "kaboom")
+	msg1 := <-pc.Messages()
+	sendEvOffered(msg1)
+	sendEvAcked(msg1)
+
+	// When: the first attempt to dead letter fails, and the second one
+	// succeeds after the ack timeout.
+	time.Sleep(300 * time.Millisecond)
+	pc.Stop()
+
+	// Then
+	c.Assert(dl.calls(), DeepEquals, []deadLetterCall{
+		{offset: msg0.Offset, retryNo: 1, reason: "kaboom"},
+		{offset: msg0.Offset, retryNo: 2, reason: "kaboom"},
+	})
+	offsetsAfter := s.kh.GetCommittedOffsets(group, topic)
+	c.Assert(offsetsAfter[partition].Val, Equals, offsetsBefore[partition]+2)
+}
+
 // When several offers are expired they are retried in the same order they
 // had been offered.
 func (s *PartitionCsmSuite) TestSeveralMessageReties(c *C) {
@@ -394,7 +445,7 @@ func (s *PartitionCsmSuite) TestSeveralMessageReties(c *C) {
 	s.cfg.Consumer.AckTimeout = 100 * time.Millisecond
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 	defer pc.Stop()
 
 	// Read and confirm offered several messages, but do not ack them.
@@ -425,7 +476,7 @@ func (s *PartitionCsmSuite) TestRetryNoMoreMessages(c *C) {
 	s.cfg.Consumer.MaxRetries = 3
 	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: offsetBefore}})
 
-	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF)
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
 
 	// Read and confirm offer of 4 messages
 	var messages []consumer.Message
@@ -441,6 +492,8 @@ func (s *PartitionCsmSuite) TestRetryNoMoreMessages(c *C) {
 	// Then: Since there are no more messages in the partition, then the next
 	// message returned is a retry.
 	msg0_i := <-pc.Messages()
+	c.Assert(messages[0].DeliveryAttempt, Equals, 1)
+	messages[0].DeliveryAttempt = 2
 	c.Assert(msg0_i, DeepEquals, messages[0], Commentf(
 		"got: %d, want: %d", msg0_i.Offset, messages[0].Offset))
 
@@ -450,10 +503,99 @@ func (s *PartitionCsmSuite) TestRetryNoMoreMessages(c *C) {
 	c.Assert(offsettrk.SparseAcks2Str(offsetsAfter[partition]), Equals, "")
 }
 
+// A stopping partition consumer waits for offered messages to be acked, and
+// commits the final offset with a handoff marker.
+func (s *PartitionCsmSuite) TestStopDrain(c *C) {
+	offsetsBefore := s.kh.GetOldestOffsets(topic)
+	s.cfg.Consumer.AckTimeout = 500 * time.Millisecond
+	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
+	msg := <-pc.Messages()
+	sendEvOffered(msg)
+
+	// When
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		sendEvAcked(msg)
+	}()
+	pc.Stop()
+	wg.Wait()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets(group, topic)
+	c.Assert(offsetsAfter[partition].Val, Equals, offsetsBefore[partition]+1)
+	_, handedOff := offsettrk.UnmarkHandoff(offsetsAfter[partition])
+	c.Assert(handedOff, Equals, true)
+}
+
+// A message that has been picked up from the messages channel before a seek,
+// e.g. by the multiplexer, is dropped, and an offer of it that was in flight
+// is ignored, so that the next offered message is the one the seek is to.
+func (s *PartitionCsmSuite) TestSeekDropsPickedUp(c *C) {
+	oldestOffsets := s.kh.GetOldestOffsets(topic)
+	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, s.msgIStreamF, s.offsetMgrF, nil, config.InitialOffsetLatest)
+	defer pc.Stop()
+	msg := <-pc.Messages()
+	seekOffset := oldestOffsets[partition] + 5
+
+	// When
+	msg.EventsCh <- consumer.Seek(seekOffset)
+	msg2 := <-pc.Messages()
+	msg.EventsCh <- consumer.Event{T: consumer.EvOffered, Offset: msg.Offset}
+
+	// Then
+	c.Assert(consumer.Offer(msg), Equals, false)
+	c.Assert(msg2.Offset, Equals, seekOffset)
+	c.Assert(consumer.Offer(msg2), Equals, true)
+	msg3 := <-pc.Messages()
+	c.Assert(msg3.Offset, Equals, seekOffset+1)
+}
+
+// If a message fetcher cannot be spawned, then the partition consumer is
+// restarted after a backoff until it succeeds.
+func (s *PartitionCsmSuite) TestRestartOnFailure(c *C) {
+	oldestOffsets := s.kh.GetOldestOffsets(topic)
+	s.cfg.Consumer.RestartBackoff = 50 * time.Millisecond
+	s.kh.SetOffsets(group, topic, []offsetmgr.Offset{{Val: sarama.OffsetOldest}})
+	msgFetcherF := &failingMsgFetcherF{Factory: s.msgIStreamF, failures: 3}
+
+	// When
+	pc := Spawn(s.ns, group, topic, partition, s.cfg, s.groupMember, msgFetcherF, s.offsetMgrF, nil, config.InitialOffsetLatest)
+	defer pc.Stop()
+
+	// Then
+	select {
+	case msg := <-pc.Messages():
+		c.Assert(msg.Offset, Equals, oldestOffsets[partition])
+	case <-time.After(3 * time.Second):
+		c.Fatal("Message is not consumed")
+	}
+	c.Assert(msgFetcherF.failures, Equals, 0)
+}
+
+// failingMsgFetcherF fails to spawn message fetchers the specified number of
+// times, and then delegates to the wrapped factory.
+type failingMsgFetcherF struct {
+	msgfetcher.Factory
+	failures int
+}
+
+func (f *failingMsgFetcherF) Spawn(namespace *actor.ID, topic string, partition int32, offset int64) (msgfetcher.T, int64, error) {
+	if f.failures > 0 {
+		f.failures -= 1
+		return nil, 0, errors.New("Kaboom!")
+	}
+	return f.Factory.Spawn(namespace, topic, partition, offset)
+}
+
 func sendEvOffered(msg consumer.Message) {
 	log.Infof("*** sending EvOffered: offset=%d", msg.Offset)
 	select {
-	case msg.EventsCh <- consumer.Event{consumer.EvOffered, msg.Offset}:
+	case msg.EventsCh <- consumer.Event{T: consumer.EvOffered, Offset: msg.Offset}:
 	case <-time.After(500 * time.Millisecond):
 		log.Infof("*** timeout sending `offered`: offset=%d", msg.Offset)
 	}
@@ -462,8 +604,40 @@ func sendEvOffered(msg consumer.Message) {
 func sendEvAcked(msg consumer.Message) {
 	log.Infof("*** sending EvAcked: offset=%d", msg.Offset)
 	select {
-	case msg.EventsCh <- consumer.Event{consumer.EvAcked, msg.Offset}:
+	case msg.EventsCh <- consumer.Event{T: consumer.EvAcked, Offset: msg.Offset}:
 	case <-time.After(500 * time.Millisecond):
 		log.Infof("*** timeout sending `acked`: offset=%d", msg.Offset)
 	}
 }
+
+type deadLetterCall struct {
+	offset  int64
+	retryNo int
+	reason  string
+}
+
+// fakeDeadLetterer records messages it is given, and fails the first
+// `failures` of them.
+type fakeDeadLetterer struct {
+	mu       sync.Mutex
+	failures int
+	recorded []deadLetterCall
+}
+
+// implements `consumer.DeadLetterer`.
+func (dl *fakeDeadLetterer) DeadLetter(group string, msg consumer.Message, retryNo int, reason string) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.recorded = append(dl.recorded, deadLetterCall{msg.Offset, retryNo, reason})
+	if dl.failures > 0 {
+		dl.failures -= 1
+		return errors.New("Kaboom!")
+	}
+	return nil
+}
+
+func (dl *fakeDeadLetterer) calls() []deadLetterCall {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.recorded
+}
@@ -2,20 +2,22 @@ package topiccsm
 
 import (
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/dispatcher"
+	"github.com/mailgun/kafka-pixy/metrics"
+	gometrics "github.com/rcrowley/go-metrics"
 )
 
 // T implements a consumer request dispatch tier responsible for a particular
 // topic. It receives requests on the `Requests()` channel and replies with
 // messages received on `Messages()` channel. If there has been no message
-// received for `Config.Consumer.LongPollingTimeout` then a timeout error is
-// sent to the requests' reply channel.
+// received for the request timeout, that is the long polling timeout
+// configured for the group and topic unless the request defines its own, then
+// a timeout error is sent to the requests' reply channel.
 //
 // implements `dispatcher.Tier`.
 // implements `multiplexer.Out`.
@@ -27,24 +29,28 @@ type T struct {
 	lifespanCh chan<- *T
 	requestsCh chan dispatcher.Request
 	messagesCh chan consumer.Message
-	wg         sync.WaitGroup
+	queueDepth gometrics.Gauge
+	sup        *actor.Supervisor
 }
 
 // Creates a topic consumer instance. It should be explicitly started in
 // accordance with the `dispatcher.Tier` contract.
 func New(namespace *actor.ID, group, topic string, cfg *config.Proxy, lifespanCh chan<- *T) *T {
+	actorID := namespace.NewChild(fmt.Sprintf("T:%s", topic))
 	return &T{
-		actorID:    namespace.NewChild(fmt.Sprintf("T:%s", topic)),
+		actorID:    actorID,
 		cfg:        cfg,
 		group:      group,
 		topic:      topic,
 		lifespanCh: lifespanCh,
-		requestsCh: make(chan dispatcher.Request, cfg.Consumer.ChannelBufferSize),
+		requestsCh: make(chan dispatcher.Request, cfg.ConsumerParams(group, topic).ChannelBufferSize),
 
 		// Messages channel must be non-buffered. Otherwise we might end up
 		// buffering a message from a partition that no longer belongs to this
 		// consumer group member.
 		messagesCh: make(chan consumer.Message),
+		queueDepth: metrics.Gauge("consumer_topic_queue_depth", "cluster", cfg.Cluster, "group", group, "topic", topic),
+		sup:        actor.NewSupervisor(actorID, actor.RestartPolicy{}, nil),
 	}
 }
 
@@ -68,30 +74,47 @@ func (tc *T) Requests() chan<- dispatcher.Request {
 	return tc.requestsCh
 }
 
+// implements `dispatcher.Tier`.
+func (tc *T) QueueLen() int {
+	return len(tc.requestsCh)
+}
+
 // implements `dispatcher.Tier`.
 func (tc *T) Start(stoppedCh chan<- dispatcher.Tier) {
-	actor.Spawn(tc.actorID, &tc.wg, func() {
+	tc.sup.Spawn(tc.actorID, func() error {
 		defer func() { stoppedCh <- tc }()
 		tc.run()
+		return nil
 	})
 }
 
 // implements `dispatcher.Tier`.
 func (tc *T) Stop() {
 	close(tc.requestsCh)
-	tc.wg.Wait()
+	tc.sup.Wait()
 }
 
 func (tc *T) run() {
 	tc.lifespanCh <- tc
 	defer func() {
+		tc.queueDepth.Update(0)
 		tc.lifespanCh <- tc
 	}()
 
 	timeoutResult := dispatcher.Response{Err: consumer.ErrRequestTimeout}
+	canceledResult := dispatcher.Response{Err: consumer.ErrRequestCanceled}
 	for consumeReq := range tc.requestsCh {
+		tc.queueDepth.Update(int64(len(tc.requestsCh)))
+		// The requester is gone, so a message assigned to the request would
+		// never be delivered.
+		select {
+		case <-consumeReq.DoneCh:
+			consumeReq.ResponseCh <- canceledResult
+			continue
+		default:
+		}
 		requestAge := time.Now().UTC().Sub(consumeReq.Timestamp)
-		ttl := tc.cfg.Consumer.LongPollingTimeout - requestAge
+		ttl := tc.requestTimeout(consumeReq) - requestAge
 		// The request has been waiting in the buffer for too long. If we
 		// reply with a fetched message, then there is a good chance that the
 		// client won't receive it due to the client HTTP timeout. Therefore
@@ -101,16 +124,82 @@ func (tc *T) run() {
 			continue
 		}
 
+		msg, err := tc.nextMessage(consumeReq, ttl)
+		if err != nil {
+			consumeReq.ResponseCh <- dispatcher.Response{Err: err}
+			continue
+		}
+		if consumeReq.MaxMessages > 0 {
+			consumeReq.ResponseCh <- dispatcher.Response{Msgs: tc.collectBatch(consumeReq, msg)}
+			continue
+		}
+		consumeReq.ResponseCh <- dispatcher.Response{Msg: msg}
+	}
+}
+
+// nextMessage waits for a message for the request for up to `ttl`, and
+// reports it as offered. Messages dropped by their partition consumers, e.g.
+// on seek, after they were pushed to the messages channel are skipped.
+func (tc *T) nextMessage(consumeReq dispatcher.Request, ttl time.Duration) (consumer.Message, error) {
+	timeoutCh := time.After(ttl)
+	for {
 		select {
 		case msg := <-tc.messagesCh:
-			msg.EventsCh <- consumer.Event{consumer.EvOffered, msg.Offset}
-			consumeReq.ResponseCh <- dispatcher.Response{Msg: msg}
-		case <-time.After(ttl):
-			consumeReq.ResponseCh <- timeoutResult
+			if consumer.Offer(msg) {
+				return msg, nil
+			}
+		case <-consumeReq.DoneCh:
+			return consumer.Message{}, consumer.ErrRequestCanceled
+		case <-timeoutCh:
+			return consumer.Message{}, consumer.ErrRequestTimeout
 		}
 	}
 }
 
+// collectBatch given the first message of a batch, collects more messages up
+// to the limits of the batch consume request. Messages are added to the batch
+// for as long as they keep coming within `Config.Consumer.BatchLinger` from
+// the previous one, but not past the request long polling timeout.
+func (tc *T) collectBatch(consumeReq dispatcher.Request, msg consumer.Message) []consumer.Message {
+	msgs := []consumer.Message{msg}
+	size := len(msg.Key) + len(msg.Value)
+	ttl := tc.requestTimeout(consumeReq) - time.Now().UTC().Sub(consumeReq.Timestamp)
+	deadline := time.NewTimer(ttl)
+	defer deadline.Stop()
+	linger := time.NewTimer(tc.cfg.Consumer.BatchLinger)
+	defer linger.Stop()
+	for len(msgs) < consumeReq.MaxMessages && (consumeReq.MaxBytes <= 0 || size < consumeReq.MaxBytes) {
+		select {
+		case msg := <-tc.messagesCh:
+			if !consumer.Offer(msg) {
+				continue
+			}
+			msgs = append(msgs, msg)
+			size += len(msg.Key) + len(msg.Value)
+			if !linger.Stop() {
+				<-linger.C
+			}
+			linger.Reset(tc.cfg.Consumer.BatchLinger)
+		case <-linger.C:
+			return msgs
+		case <-deadline.C:
+			return msgs
+		case <-consumeReq.DoneCh:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// requestTimeout returns how long the specified request can wait for a
+// message since it was submitted.
+func (tc *T) requestTimeout(consumeReq dispatcher.Request) time.Duration {
+	if consumeReq.Timeout > 0 {
+		return consumeReq.Timeout
+	}
+	return tc.cfg.ConsumerParams(tc.group, tc.topic).LongPollingTimeout
+}
+
 func (tc *T) String() string {
 	return tc.actorID.String()
 }
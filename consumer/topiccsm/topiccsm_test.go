@@ -0,0 +1,138 @@
+package topiccsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/consumer/dispatcher"
+	"github.com/mailgun/kafka-pixy/none"
+	. "gopkg.in/check.v1"
+)
+
+type TopicCsmSuite struct {
+	cfg        *config.Proxy
+	lifespanCh chan *T
+	stoppedCh  chan dispatcher.Tier
+}
+
+var _ = Suite(&TopicCsmSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *TopicCsmSuite) SetUpTest(c *C) {
+	s.cfg = config.DefaultProxy()
+	s.cfg.Consumer.LongPollingTimeout = 3 * time.Second
+	s.lifespanCh = make(chan *T, 2)
+	s.stoppedCh = make(chan dispatcher.Tier, 1)
+}
+
+// A request that was canceled while queued is dropped, and a message goes to
+// the next request.
+func (s *TopicCsmSuite) TestCanceledWhileQueued(c *C) {
+	tc := New(actor.RootID, "g", "t", s.cfg, s.lifespanCh)
+	tc.Start(s.stoppedCh)
+	defer tc.Stop()
+	doneCh := make(chan struct{})
+	close(doneCh)
+	canceledRsCh := make(chan dispatcher.Response, 1)
+	rsCh := make(chan dispatcher.Response, 1)
+	eventsCh := make(chan consumer.Event, 1)
+
+	// When
+	tc.Requests() <- dispatcher.Request{Timestamp: time.Now().UTC(), ResponseCh: canceledRsCh, DoneCh: doneCh}
+	tc.Requests() <- dispatcher.Request{Timestamp: time.Now().UTC(), ResponseCh: rsCh}
+	tc.Messages() <- consumer.Message{Offset: 7, EventsCh: eventsCh}
+
+	// Then
+	c.Assert((<-canceledRsCh).Err, Equals, consumer.ErrRequestCanceled)
+	rs := <-rsCh
+	c.Assert(rs.Err, IsNil)
+	c.Assert(rs.Msg.Offset, Equals, int64(7))
+	c.Assert(<-eventsCh, Equals, consumer.Event{T: consumer.EvOffered, Offset: 7})
+}
+
+// A request that is canceled while waiting for a message gets a response
+// right away, and a message goes to the next request.
+func (s *TopicCsmSuite) TestCanceledWhileWaiting(c *C) {
+	tc := New(actor.RootID, "g", "t", s.cfg, s.lifespanCh)
+	tc.Start(s.stoppedCh)
+	defer tc.Stop()
+	doneCh := make(chan struct{})
+	canceledRsCh := make(chan dispatcher.Response, 1)
+	rsCh := make(chan dispatcher.Response, 1)
+	eventsCh := make(chan consumer.Event, 1)
+	tc.Requests() <- dispatcher.Request{Timestamp: time.Now().UTC(), ResponseCh: canceledRsCh, DoneCh: doneCh}
+	tc.Requests() <- dispatcher.Request{Timestamp: time.Now().UTC(), ResponseCh: rsCh}
+
+	// When
+	begin := time.Now()
+	close(doneCh)
+
+	// Then
+	c.Assert((<-canceledRsCh).Err, Equals, consumer.ErrRequestCanceled)
+	c.Assert(time.Since(begin) < 100*time.Millisecond, Equals, true)
+
+	tc.Messages() <- consumer.Message{Offset: 7, EventsCh: eventsCh}
+	rs := <-rsCh
+	c.Assert(rs.Err, IsNil)
+	c.Assert(rs.Msg.Offset, Equals, int64(7))
+}
+
+// A request times out after its own timeout if it has one, or after the
+// configured long polling timeout otherwise.
+func (s *TopicCsmSuite) TestRequestTimeout(c *C) {
+	s.cfg.Consumer.LongPollingTimeout = 300 * time.Millisecond
+	tc := New(actor.RootID, "g", "t", s.cfg, s.lifespanCh)
+	tc.Start(s.stoppedCh)
+	defer tc.Stop()
+
+	for i, rtc := range []struct {
+		timeout time.Duration
+		waited  time.Duration
+	}{
+		{timeout: 0, waited: 300 * time.Millisecond},
+		{timeout: 100 * time.Millisecond, waited: 100 * time.Millisecond},
+		{timeout: 500 * time.Millisecond, waited: 500 * time.Millisecond},
+	} {
+		rsCh := make(chan dispatcher.Response, 1)
+		begin := time.Now()
+
+		// When
+		tc.Requests() <- dispatcher.Request{Timestamp: begin.UTC(), ResponseCh: rsCh, Timeout: rtc.timeout}
+
+		// Then
+		c.Assert((<-rsCh).Err, Equals, consumer.ErrRequestTimeout, Commentf("case #%d", i))
+		waited := time.Since(begin)
+		c.Assert(waited >= rtc.waited && waited < rtc.waited+100*time.Millisecond, Equals, true,
+			Commentf("case #%d: waited=%v", i, waited))
+	}
+}
+
+// A message dropped by its partition consumer, e.g. on seek, is neither
+// offered nor given to a request, that gets the next message instead.
+func (s *TopicCsmSuite) TestDroppedSkipped(c *C) {
+	tc := New(actor.RootID, "g", "t", s.cfg, s.lifespanCh)
+	tc.Start(s.stoppedCh)
+	defer tc.Stop()
+	rsCh := make(chan dispatcher.Response, 1)
+	eventsCh := make(chan consumer.Event, 2)
+	droppedCh := make(chan none.T)
+	close(droppedCh)
+
+	// When
+	tc.Requests() <- dispatcher.Request{Timestamp: time.Now().UTC(), ResponseCh: rsCh}
+	tc.Messages() <- consumer.Message{Offset: 7, EventsCh: eventsCh, DroppedCh: droppedCh}
+	tc.Messages() <- consumer.Message{Offset: 3, EventsCh: eventsCh}
+
+	// Then
+	rs := <-rsCh
+	c.Assert(rs.Err, IsNil)
+	c.Assert(rs.Msg.Offset, Equals, int64(3))
+	c.Assert(<-eventsCh, Equals, consumer.Event{T: consumer.EvOffered, Offset: 3})
+	c.Assert(len(eventsCh), Equals, 0)
+}
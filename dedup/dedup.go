@@ -0,0 +1,198 @@
+// Package dedup implements a bounded cache of responses to requests made
+// with an idempotency key, that is used to make sure that a retried produce
+// request does not produce a message twice.
+package dedup
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+// Response is a response remembered for an idempotency key.
+type Response struct {
+	Status int
+	Body   []byte
+}
+
+// T remembers responses to requests by their idempotency keys, for
+// `HTTPIdempotency.TTL` after a key was first used. When there are more than
+// `HTTPIdempotency.MaxKeys` keys, the oldest ones are forgotten.
+//
+// A key has to be reserved before a request is executed, so that concurrent
+// requests with the same key are detected. The reservation is then either
+// completed with a response, or released if the request failed, to let the
+// client retry it.
+type T struct {
+	cfg   *config.HTTPIdempotency
+	clock func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// Entries in the order keys were reserved, which is also the order they
+	// expire in, since all of them have the same TTL.
+	order *list.List
+}
+
+type entry struct {
+	key      string
+	expires  time.Time
+	complete bool
+	rs       Response
+}
+
+// savedEntry is a JSON representation of a remembered response in the state
+// file.
+type savedEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Status  int       `json:"status"`
+	Body    []byte    `json:"body"`
+}
+
+// New creates a deduplication cache with the specified configuration, and
+// loads responses saved by a previous run if a state file is configured. It
+// returns nil if deduplication is disabled.
+func New(cfg *config.HTTPIdempotency) (*T, error) {
+	if cfg.MaxKeys == 0 {
+		return nil, nil
+	}
+	t := &T{
+		cfg:     cfg,
+		clock:   time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if cfg.StateFile != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Reserve looks up a key. If the key is unknown, then it is reserved and
+// true is returned, in which case the caller must either `Complete` or
+// `Release` it. Otherwise false is returned along with the remembered
+// response, or nil if a request with the key is still in progress.
+func (t *T) Reserve(key string) (*Response, bool) {
+	now := t.clock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+	if el, ok := t.entries[key]; ok {
+		e := el.Value.(*entry)
+		if !e.complete {
+			return nil, false
+		}
+		rs := e.rs
+		return &rs, false
+	}
+	t.add(&entry{key: key, expires: now.Add(t.cfg.TTL)})
+	return nil, true
+}
+
+// Complete remembers a response for a reserved key.
+func (t *T) Complete(key string, rs Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.complete = true
+		e.rs = rs
+	}
+}
+
+// Release forgets a reserved key, so that a request with it can be retried.
+func (t *T) Release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[key]; ok && !el.Value.(*entry).complete {
+		t.remove(el)
+	}
+}
+
+// Save writes remembered responses to the state file, if one is configured.
+// The file is replaced atomically, so that a crash never leaves it half
+// written.
+func (t *T) Save() error {
+	if t.cfg.StateFile == "" {
+		return nil
+	}
+	now := t.clock()
+	t.mu.Lock()
+	t.expire(now)
+	saved := make([]savedEntry, 0, t.order.Len())
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		if e.complete {
+			saved = append(saved, savedEntry{Key: e.key, Expires: e.expires, Status: e.rs.Status, Body: e.rs.Body})
+		}
+	}
+	t.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal state")
+	}
+	tmpPath := t.cfg.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	if err := os.Rename(tmpPath, t.cfg.StateFile); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	return nil
+}
+
+func (t *T) load() error {
+	data, err := ioutil.ReadFile(t.cfg.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read state file")
+	}
+	var saved []savedEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.Wrap(err, "bad state file")
+	}
+	now := t.clock()
+	for _, se := range saved {
+		if se.Expires.After(now) {
+			t.add(&entry{key: se.Key, expires: se.Expires, complete: true,
+				rs: Response{Status: se.Status, Body: se.Body}})
+		}
+	}
+	return nil
+}
+
+// add appends an entry, forgetting the oldest ones if there are too many.
+func (t *T) add(e *entry) {
+	t.entries[e.key] = t.order.PushBack(e)
+	for t.order.Len() > t.cfg.MaxKeys {
+		t.remove(t.order.Front())
+	}
+}
+
+func (t *T) remove(el *list.Element) {
+	delete(t.entries, el.Value.(*entry).key)
+	t.order.Remove(el)
+}
+
+// expire forgets keys that have been remembered longer than the TTL.
+func (t *T) expire(now time.Time) {
+	for el := t.order.Front(); el != nil; el = t.order.Front() {
+		if el.Value.(*entry).expires.After(now) {
+			return
+		}
+		t.remove(el)
+	}
+}
@@ -0,0 +1,132 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type DedupSuite struct {
+	now time.Time
+	dir string
+}
+
+var _ = Suite(&DedupSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *DedupSuite) SetUpTest(c *C) {
+	s.now = time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	var err error
+	s.dir, err = ioutil.TempDir("", "dedup")
+	c.Assert(err, IsNil)
+}
+
+func (s *DedupSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *DedupSuite) newDedup(c *C, cfg *config.HTTPIdempotency) *T {
+	t, err := New(cfg)
+	c.Assert(err, IsNil)
+	t.clock = func() time.Time { return s.now }
+	return t
+}
+
+// If max keys is zero, then no cache is created.
+func (s *DedupSuite) TestDisabled(c *C) {
+	t, err := New(&config.HTTPIdempotency{TTL: time.Hour})
+	c.Assert(err, IsNil)
+	c.Assert(t, IsNil)
+}
+
+// A completed key gets the remembered response, and a key that is still in
+// progress gets none.
+func (s *DedupSuite) TestReserve(c *C) {
+	t := s.newDedup(c, &config.HTTPIdempotency{MaxKeys: 10, TTL: time.Hour})
+	_, ok := t.Reserve("a")
+	c.Assert(ok, Equals, true)
+	t.Complete("a", Response{Status: 200, Body: []byte("{}")})
+	_, ok = t.Reserve("b")
+	c.Assert(ok, Equals, true)
+
+	// When
+	rsA, okA := t.Reserve("a")
+	rsB, okB := t.Reserve("b")
+
+	// Then
+	c.Assert(okA, Equals, false)
+	c.Assert(rsA, DeepEquals, &Response{Status: 200, Body: []byte("{}")})
+	c.Assert(okB, Equals, false)
+	c.Assert(rsB, IsNil)
+}
+
+// A released key can be reserved again.
+func (s *DedupSuite) TestRelease(c *C) {
+	t := s.newDedup(c, &config.HTTPIdempotency{MaxKeys: 10, TTL: time.Hour})
+	t.Reserve("a")
+
+	// When
+	t.Release("a")
+
+	// Then
+	_, ok := t.Reserve("a")
+	c.Assert(ok, Equals, true)
+}
+
+// Keys are forgotten when they expire, or when there are too many of them.
+func (s *DedupSuite) TestForget(c *C) {
+	t := s.newDedup(c, &config.HTTPIdempotency{MaxKeys: 2, TTL: time.Hour})
+	for i, key := range []string{"a", "b", "c"} {
+		_, ok := t.Reserve(key)
+		c.Assert(ok, Equals, true, Commentf("key #%d", i))
+		t.Complete(key, Response{Status: 200})
+		s.now = s.now.Add(20 * time.Minute)
+	}
+
+	// When
+	s.now = s.now.Add(25 * time.Minute)
+
+	// Then
+	for i, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{key: "c", ok: false},
+		{key: "a", ok: true}, // evicted
+		{key: "b", ok: true}, // expired
+	} {
+		_, ok := t.Reserve(tc.key)
+		c.Assert(ok, Equals, tc.ok, Commentf("case #%d", i))
+	}
+}
+
+// Completed keys survive a restart if a state file is configured, while keys
+// in progress do not.
+func (s *DedupSuite) TestSaveLoad(c *C) {
+	// The state file is loaded before the clock can be mocked.
+	s.now = time.Now()
+	cfg := &config.HTTPIdempotency{MaxKeys: 10, TTL: time.Hour, StateFile: filepath.Join(s.dir, "state.json")}
+	t := s.newDedup(c, cfg)
+	t.Reserve("a")
+	t.Complete("a", Response{Status: 200, Body: []byte(`{"partition":1}`)})
+	t.Reserve("b")
+	c.Assert(t.Save(), IsNil)
+
+	// When
+	t = s.newDedup(c, cfg)
+
+	// Then
+	rs, ok := t.Reserve("a")
+	c.Assert(ok, Equals, false)
+	c.Assert(rs, DeepEquals, &Response{Status: 200, Body: []byte(`{"partition":1}`)})
+	_, ok = t.Reserve("b")
+	c.Assert(ok, Equals, true)
+}
@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/log"
+)
+
+var (
+	// Messages logged by actors start with an actor ID enclosed in angle
+	// brackets, e.g. `<cons[0]/G:foo[0]/T:bar[0]/P:bar_1[0]> started`.
+	cidRegexp = regexp.MustCompile(`^<([^>]*)>\s*`)
+
+	offsetRegexp = regexp.MustCompile(`\boffset=(-?\d+)`)
+
+	// Actor ID components that identify a consumer group, a topic, and a
+	// topic partition respectively.
+	groupCIDRegexp     = regexp.MustCompile(`^G:(.+)\[\d+\]$`)
+	topicCIDRegexp     = regexp.MustCompile(`^T:(.+)\[\d+\]$`)
+	partitionCIDRegexp = regexp.MustCompile(`^P:(.+)_(\d+)\[\d+\]$`)
+)
+
+// jsonLogger writes log messages as JSON objects, one per line. Besides the
+// message itself an object contains the ID of an actor that logged it, as
+// `cid`, and the consumer group, topic, partition and offset that the message
+// relates to, if they are known.
+type jsonLogger struct {
+	sev log.Severity
+	w   io.Writer
+}
+
+type jsonEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Caller    string `json:"caller"`
+	CID       string `json:"cid,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+// NewJSONLogger creates a logger that writes JSON objects to the standard
+// output.
+func NewJSONLogger(conf log.Config) (log.Logger, error) {
+	sev, err := log.SeverityFromString(conf.Severity)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLogger{sev: sev, w: os.Stdout}, nil
+}
+
+// Writer implements log.Logger.
+func (l *jsonLogger) Writer(sev log.Severity) io.Writer {
+	if sev >= l.sev {
+		return l.w
+	}
+	return nil
+}
+
+// SetSeverity implements log.Logger.
+func (l *jsonLogger) SetSeverity(sev log.Severity) {
+	l.sev = sev
+}
+
+// GetSeverity implements log.Logger.
+func (l *jsonLogger) GetSeverity() log.Severity {
+	return l.sev
+}
+
+// FormatMessage implements log.Logger.
+func (l *jsonLogger) FormatMessage(sev log.Severity, caller *log.CallerInfo, format string, args ...interface{}) string {
+	entry := jsonEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:  strings.ToLower(sev.String()),
+		Caller: fmt.Sprintf("%s:%d", caller.FileName, caller.LineNo),
+		Msg:    fmt.Sprintf(format, args...),
+	}
+	if m := cidRegexp.FindStringSubmatch(entry.Msg); m != nil {
+		entry.CID = m[1]
+		entry.Msg = entry.Msg[len(m[0]):]
+		parseCID(&entry)
+	}
+	if m := offsetRegexp.FindStringSubmatch(entry.Msg); m != nil {
+		if offset, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			entry.Offset = &offset
+		}
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		// Must never happen, since all entry fields are strings and numbers.
+		return fmt.Sprintf(`{"level":"error","msg":%q}`+"\n", err.Error())
+	}
+	return string(encoded) + "\n"
+}
+
+// parseCID populates the group, topic and partition fields of an entry from
+// components of its actor ID.
+func parseCID(entry *jsonEntry) {
+	for _, component := range strings.Split(entry.CID, "/") {
+		if m := groupCIDRegexp.FindStringSubmatch(component); m != nil {
+			entry.Group = m[1]
+			continue
+		}
+		if m := topicCIDRegexp.FindStringSubmatch(component); m != nil {
+			entry.Topic = m[1]
+			continue
+		}
+		if m := partitionCIDRegexp.FindStringSubmatch(component); m != nil {
+			entry.Topic = m[1]
+			if partition, err := strconv.ParseInt(m[2], 10, 32); err == nil {
+				partition := int32(partition)
+				entry.Partition = &partition
+			}
+		}
+	}
+}
@@ -2,12 +2,98 @@ package logging
 
 import (
 	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/log"
 	"github.com/samuel/go-zookeeper/zk"
 )
 
+// JSON is the name of a logger type that writes log messages as JSON objects
+// to the standard output. It can be used along with logger types supported
+// by `mailgun/log`.
+const JSON = "json"
+
+var (
+	loggersMu sync.Mutex
+	loggers   []*leveledLogger
+	severity  = log.SeverityInfo
+)
+
+// InitWithConfig instantiates loggers based on the provided configs and
+// initializes `mailgun/log` with them. The severity of the loggers can be
+// changed at runtime with SetSeverity.
+func InitWithConfig(configs ...log.Config) error {
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	for _, cfg := range configs {
+		var l log.Logger
+		var err error
+		if cfg.Name == JSON {
+			l, err = NewJSONLogger(cfg)
+		} else {
+			l, err = log.NewLogger(cfg)
+		}
+		if err != nil {
+			return err
+		}
+		ll := &leveledLogger{Logger: l, sev: int32(l.GetSeverity())}
+		// The wrapped logger is left to write messages of any severity, for
+		// filtering is done by the wrapper.
+		l.SetSeverity(log.SeverityDebug)
+		if len(loggers) == 0 || ll.GetSeverity() < severity {
+			severity = ll.GetSeverity()
+		}
+		loggers = append(loggers, ll)
+		log.Init(ll)
+	}
+	return nil
+}
+
+// Severity returns the lowest severity that messages are logged at, that is
+// either the lowest one configured by InitWithConfig, or the one last set by
+// SetSeverity.
+func Severity() log.Severity {
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	return severity
+}
+
+// SetSeverity changes the severity of all loggers initialized by
+// InitWithConfig. It is safe to call while messages are being logged.
+func SetSeverity(sev log.Severity) {
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	for _, l := range loggers {
+		l.SetSeverity(sev)
+	}
+	severity = sev
+}
+
+// leveledLogger wraps a logger to make its severity safe to change while
+// messages are being logged.
+type leveledLogger struct {
+	log.Logger
+	sev int32
+}
+
+func (ll *leveledLogger) Writer(sev log.Severity) io.Writer {
+	if sev < ll.GetSeverity() {
+		return nil
+	}
+	return ll.Logger.Writer(sev)
+}
+
+func (ll *leveledLogger) SetSeverity(sev log.Severity) {
+	atomic.StoreInt32(&ll.sev, int32(sev))
+}
+
+func (ll *leveledLogger) GetSeverity() log.Severity {
+	return log.Severity(atomic.LoadInt32(&ll.sev))
+}
+
 // Init3rdParty makes the internal loggers of various 3rd-party libraries
 // used by `kafka-pixy` forward their output to `mailgun/log` facility.
 func Init3rdParty() {
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/mailgun/log"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type LoggingSuite struct{}
+
+var _ = Suite(&LoggingSuite{})
+
+// Fields are extracted from the actor ID and the message.
+func (s *LoggingSuite) TestJSONFormat(c *C) {
+	l := &jsonLogger{sev: log.SeverityDebug}
+	caller := &log.CallerInfo{FileName: "foo.go", LineNo: 42}
+	for i, tc := range []struct {
+		format string
+		args   []interface{}
+		want   map[string]interface{}
+	}{{
+		format: "plain %s",
+		args:   []interface{}{"text"},
+		want:   map[string]interface{}{"msg": "plain text"},
+	}, {
+		format: "<%s> offer: offset=%d, retry=%d",
+		args:   []interface{}{"/cons[0]/G:foo[0]/T:bar.baz[0]/P:bar.baz_12[0]", 1003, 2},
+		want: map[string]interface{}{
+			"cid":       "/cons[0]/G:foo[0]/T:bar.baz[0]/P:bar.baz_12[0]",
+			"group":     "foo",
+			"topic":     "bar.baz",
+			"partition": float64(12),
+			"offset":    float64(1003),
+			"msg":       "offer: offset=1003, retry=2",
+		},
+	}, {
+		format: "<%s> started",
+		args:   []interface{}{"/cons[0]/G:foo_1[0]"},
+		want: map[string]interface{}{
+			"cid":   "/cons[0]/G:foo_1[0]",
+			"group": "foo_1",
+			"msg":   "started",
+		},
+	}} {
+		// When
+		out := l.FormatMessage(log.SeverityWarning, caller, tc.format, tc.args...)
+
+		// Then
+		c.Assert(out[len(out)-1], Equals, byte('\n'), Commentf("case #%d", i))
+		var entry map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(out), &entry), IsNil, Commentf("case #%d", i))
+		c.Assert(entry["time"], NotNil, Commentf("case #%d", i))
+		delete(entry, "time")
+		tc.want["level"] = "warn"
+		tc.want["caller"] = "foo.go:42"
+		c.Assert(entry, DeepEquals, tc.want, Commentf("case #%d", i))
+	}
+}
+
+// The severity of a wrapped logger can be changed at runtime.
+func (s *LoggingSuite) TestLeveledLogger(c *C) {
+	var buf bytes.Buffer
+	ll := &leveledLogger{Logger: &jsonLogger{sev: log.SeverityDebug, w: &buf}, sev: int32(log.SeverityInfo)}
+	c.Assert(ll.Writer(log.SeverityDebug), IsNil)
+	c.Assert(ll.Writer(log.SeverityInfo), Equals, &buf)
+
+	// When
+	ll.SetSeverity(log.SeverityError)
+
+	// Then
+	c.Assert(ll.GetSeverity(), Equals, log.SeverityError)
+	c.Assert(ll.Writer(log.SeverityWarning), IsNil)
+	c.Assert(ll.Writer(log.SeverityError), Equals, &buf)
+}
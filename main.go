@@ -26,6 +26,7 @@ var (
 	cmdConfig         string
 	cmdTCPAddr        string
 	cmdUnixAddr       string
+	cmdAdminAddr      string
 	cmdKafkaPeers     string
 	cmdZookeeperPeers string
 	cmdPIDFile        string
@@ -37,6 +38,7 @@ func init() {
 	flag.StringVar(&cmdGRPCAddr, "grpcAddr", "", "TCP address that the gRPC API should listen on")
 	flag.StringVar(&cmdTCPAddr, "tcpAddr", "", "TCP address that the HTTP API should listen on")
 	flag.StringVar(&cmdUnixAddr, "unixAddr", "", "Unix domain socket address that the HTTP API should listen on")
+	flag.StringVar(&cmdAdminAddr, "adminAddr", "", "TCP address that the administrative HTTP API should listen on")
 	flag.StringVar(&cmdKafkaPeers, "kafkaPeers", "", "Comma separated list of brokers")
 	flag.StringVar(&cmdZookeeperPeers, "zookeeperPeers", "", "Comma separated list of ZooKeeper nodes followed by optional chroot")
 	flag.StringVar(&cmdPIDFile, "pidFile", "", "Path to the PID file")
@@ -66,9 +68,12 @@ func main() {
 	// Clean up the unix domain socket file in case we failed to clean up on
 	// shutdown the last time. Otherwise the service won't be able to listen
 	// on this address and as a result will fail to start up.
-	if cfg.UnixAddr != "" {
-		if err := os.Remove(cfg.UnixAddr); err != nil && !os.IsNotExist(err) {
-			log.Errorf("Cannot remove %s: err=(%s)", cfg.UnixAddr, err)
+	for _, lsnCfg := range cfg.HTTPListeners() {
+		if strings.Contains(lsnCfg.Addr, ":") {
+			continue
+		}
+		if err := os.Remove(lsnCfg.Addr); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Cannot remove %s: err=(%s)", lsnCfg.Addr, err)
 		}
 	}
 
@@ -91,16 +96,23 @@ func main() {
 func makeConfig() (*config.App, error) {
 	var cfg *config.App
 	// If a YAML configuration file is provided, then load it and ignore all
-	// parameters provided on the command line.
+	// parameters provided on the command line. Environment variables override
+	// parameters of the file in either case.
 	if cmdConfig != "" {
 		var err error
 		if cfg, err = config.FromYAMLFile(cmdConfig); err != nil {
 			return nil, err
 		}
+		if err := cfg.OverrideFromEnv(os.Environ()); err != nil {
+			return nil, err
+		}
 		return cfg, nil
 	}
 
 	cfg = config.DefaultApp(defaultCluster)
+	if err := cfg.OverrideFromEnv(os.Environ()); err != nil {
+		return nil, err
+	}
 	if cmdGRPCAddr != "" {
 		cfg.GRPCAddr = cmdGRPCAddr
 	}
@@ -110,6 +122,9 @@ func makeConfig() (*config.App, error) {
 	if cmdUnixAddr != "" {
 		cfg.UnixAddr = cmdUnixAddr
 	}
+	if cmdAdminAddr != "" {
+		cfg.AdminAddr = cmdAdminAddr
+	}
 	if cmdKafkaPeers != "" {
 		cfg.Proxies[defaultCluster].Kafka.SeedPeers = strings.Split(cmdKafkaPeers, ",")
 	}
@@ -130,7 +145,7 @@ func initLogging() error {
 	if err := json.Unmarshal([]byte(cmdLoggingJSONCfg), &loggingCfg); err != nil {
 		return fmt.Errorf("failed to parse logger config: err=(%s)", err)
 	}
-	if err := log.InitWithConfig(loggingCfg...); err != nil {
+	if err := logging.InitWithConfig(loggingCfg...); err != nil {
 		return err
 	}
 	logging.Init3rdParty()
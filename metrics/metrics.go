@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// Parameters of the exponentially decaying sample used by histograms.
+	// They are the same as used by sarama for its own histograms and bias
+	// the sample toward the last 5 minutes.
+	histogramReservoirSize = 1028
+	histogramAlpha         = 0.015
+)
+
+// DefaultRegistry is a registry that all Kafka-Pixy metrics are registered
+// with unless explicitly specified otherwise.
+var DefaultRegistry = NewRegistry()
+
+// Label is a name/value pair that along with a metric name identifies a
+// particular metric instance, e.g. a counter of messages produced to a
+// particular topic.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Registry holds metrics identified by a name and a set of labels. Metric
+// values are implemented by `github.com/rcrowley/go-metrics` types.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	name   string
+	labels []Label
+	metric interface{}
+}
+
+// NewRegistry creates an empty metric registry.
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[string]*entry)}
+}
+
+// Counter returns a counter with the specified name and labels from the
+// default registry. Labels are given as a list of name/value pairs. If the
+// counter does not exist yet then it is created.
+func Counter(name string, labels ...string) gometrics.Counter {
+	return DefaultRegistry.Counter(name, labels...)
+}
+
+// Gauge returns a gauge with the specified name and labels from the default
+// registry. Labels are given as a list of name/value pairs. If the gauge does
+// not exist yet then it is created.
+func Gauge(name string, labels ...string) gometrics.Gauge {
+	return DefaultRegistry.Gauge(name, labels...)
+}
+
+// Histogram returns a histogram with the specified name and labels from the
+// default registry. Labels are given as a list of name/value pairs. If the
+// histogram does not exist yet then it is created.
+func Histogram(name string, labels ...string) gometrics.Histogram {
+	return DefaultRegistry.Histogram(name, labels...)
+}
+
+// Counter returns a counter with the specified name and labels. If the
+// counter does not exist yet then it is created.
+func (r *Registry) Counter(name string, labels ...string) gometrics.Counter {
+	return r.getOrRegister(name, labels, func() interface{} {
+		return gometrics.NewCounter()
+	}).(gometrics.Counter)
+}
+
+// Gauge returns a gauge with the specified name and labels. If the gauge does
+// not exist yet then it is created.
+func (r *Registry) Gauge(name string, labels ...string) gometrics.Gauge {
+	return r.getOrRegister(name, labels, func() interface{} {
+		return gometrics.NewGauge()
+	}).(gometrics.Gauge)
+}
+
+// Histogram returns a histogram with the specified name and labels. If the
+// histogram does not exist yet then it is created.
+func (r *Registry) Histogram(name string, labels ...string) gometrics.Histogram {
+	return r.getOrRegister(name, labels, func() interface{} {
+		sample := gometrics.NewExpDecaySample(histogramReservoirSize, histogramAlpha)
+		return gometrics.NewHistogram(sample)
+	}).(gometrics.Histogram)
+}
+
+// Each calls `fn` for every registered metric in the lexicographical order of
+// metric names. Metrics with the same name are ordered by their labels.
+func (r *Registry) Each(fn func(name string, labels []Label, metric interface{})) {
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.entries))
+	for key := range r.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ei, ej := r.entries[keys[i]], r.entries[keys[j]]
+		if ei.name != ej.name {
+			return ei.name < ej.name
+		}
+		return keys[i] < keys[j]
+	})
+	entries := make([]*entry, len(keys))
+	for i, key := range keys {
+		entries[i] = r.entries[key]
+	}
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.name, e.labels, e.metric)
+	}
+}
+
+func (r *Registry) getOrRegister(name string, labels []string, newFn func() interface{}) interface{} {
+	if len(labels)%2 != 0 {
+		panic("labels must be given as name/value pairs")
+	}
+	key := makeKey(name, labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.entries[key]; e != nil {
+		return e.metric
+	}
+	e := &entry{name: name, metric: newFn()}
+	for i := 0; i < len(labels); i += 2 {
+		e.labels = append(e.labels, Label{labels[i], labels[i+1]})
+	}
+	r.entries[key] = e
+	return e.metric
+}
+
+// makeKey returns a string that uniquely identifies a metric instance in
+// a registry, e.g. `produce_success{cluster="foo",topic="bar"}`.
+func makeKey(name string, labels []string) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteString("{")
+	for i := 0; i < len(labels); i += 2 {
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(labels[i])
+		buf.WriteString(`="`)
+		buf.WriteString(labels[i+1])
+		buf.WriteString(`"`)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct {
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// The same metric instance is returned for the same name and labels.
+func (s *MetricsSuite) TestSameLabels(c *C) {
+	r := NewRegistry()
+
+	// When
+	r.Counter("foo", "topic", "bar").Inc(1)
+	r.Counter("foo", "topic", "bar").Inc(2)
+	r.Counter("foo", "topic", "baz").Inc(5)
+
+	// Then
+	c.Assert(r.Counter("foo", "topic", "bar").Count(), Equals, int64(3))
+	c.Assert(r.Counter("foo", "topic", "baz").Count(), Equals, int64(5))
+}
+
+// Metrics are iterated in the order of names, and then labels.
+func (s *MetricsSuite) TestEach(c *C) {
+	r := NewRegistry()
+	r.Histogram("foo_b", "topic", "a").Update(1)
+	r.Counter("foo", "topic", "b").Inc(1)
+	r.Gauge("foo", "topic", "a").Update(1)
+
+	// When
+	var names []string
+	var labels [][]Label
+	r.Each(func(name string, l []Label, metric interface{}) {
+		names = append(names, name)
+		labels = append(labels, l)
+	})
+
+	// Then
+	c.Assert(names, DeepEquals, []string{"foo", "foo", "foo_b"})
+	c.Assert(labels, DeepEquals, [][]Label{
+		{{"topic", "a"}}, {{"topic", "b"}}, {{"topic", "a"}}})
+}
+
+func (s *MetricsSuite) TestOddLabels(c *C) {
+	r := NewRegistry()
+	c.Assert(func() { r.Counter("foo", "topic") }, PanicMatches, "labels must be given as name/value pairs")
+}
+
+func (s *MetricsSuite) TestWritePrometheus(c *C) {
+	r := NewRegistry()
+	r.Counter("foo", "topic", "b").Inc(3)
+	r.Counter("foo", "topic", `a"\`).Inc(1)
+	r.Gauge("bar").Update(7)
+	h := r.Histogram("baz_ms", "topic", "a")
+	for i := 1; i <= 4; i++ {
+		h.Update(int64(i))
+	}
+
+	// When
+	var buf bytes.Buffer
+	err := r.WritePrometheus(&buf)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, ""+
+		"# TYPE bar gauge\n"+
+		"bar 7\n"+
+		"# TYPE baz_ms summary\n"+
+		"baz_ms{topic=\"a\",quantile=\"0.5\"} 2.5\n"+
+		"baz_ms{topic=\"a\",quantile=\"0.95\"} 4\n"+
+		"baz_ms{topic=\"a\",quantile=\"0.99\"} 4\n"+
+		"baz_ms_sum{topic=\"a\"} 10\n"+
+		"baz_ms_count{topic=\"a\"} 4\n"+
+		"# TYPE foo counter\n"+
+		"foo{topic=\"a\\\"\\\\\"} 1\n"+
+		"foo{topic=\"b\"} 3\n")
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition
+// format produced by `WritePrometheus`.
+const PrometheusContentType = "text/plain; version=0.0.4"
+
+// Quantiles reported for histograms that are exposed as Prometheus summaries.
+var prometheusQuantiles = []float64{0.5, 0.95, 0.99}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes all metrics of the registry to `w` in the Prometheus
+// text exposition format. Counters and gauges are exposed as such, and
+// histograms are exposed as summaries with 0.5, 0.95 and 0.99 quantiles.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var lastName string
+	r.Each(func(name string, labels []Label, metric interface{}) {
+		var metricType string
+		switch metric.(type) {
+		case gometrics.Counter:
+			metricType = "counter"
+		case gometrics.Gauge:
+			metricType = "gauge"
+		case gometrics.Histogram:
+			metricType = "summary"
+		default:
+			return
+		}
+		if name != lastName {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, metricType)
+			lastName = name
+		}
+		switch m := metric.(type) {
+		case gometrics.Counter:
+			writeSample(bw, name, labels, nil, float64(m.Count()))
+		case gometrics.Gauge:
+			writeSample(bw, name, labels, nil, float64(m.Value()))
+		case gometrics.Histogram:
+			h := m.Snapshot()
+			ps := h.Percentiles(prometheusQuantiles)
+			for i, q := range prometheusQuantiles {
+				writeSample(bw, name, labels, &Label{"quantile", formatFloat(q)}, ps[i])
+			}
+			writeSample(bw, name+"_sum", labels, nil, float64(h.Sum()))
+			writeSample(bw, name+"_count", labels, nil, float64(h.Count()))
+		}
+	})
+	return bw.Flush()
+}
+
+// writeSample writes a single sample line. If `extra` is not nil, then it is
+// appended to the list of labels.
+func writeSample(bw *bufio.Writer, name string, labels []Label, extra *Label, value float64) {
+	bw.WriteString(name)
+	if len(labels) > 0 || extra != nil {
+		bw.WriteString("{")
+		for i, l := range labels {
+			if i != 0 {
+				bw.WriteString(",")
+			}
+			writeLabel(bw, l)
+		}
+		if extra != nil {
+			if len(labels) > 0 {
+				bw.WriteString(",")
+			}
+			writeLabel(bw, *extra)
+		}
+		bw.WriteString("}")
+	}
+	bw.WriteString(" ")
+	bw.WriteString(formatFloat(value))
+	bw.WriteString("\n")
+}
+
+func writeLabel(bw *bufio.Writer, l Label) {
+	bw.WriteString(l.Name)
+	bw.WriteString(`="`)
+	labelValueEscaper.WriteString(bw, l.Value)
+	bw.WriteString(`"`)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
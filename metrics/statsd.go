@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Maximum size of a UDP packet sent to StatsD. It is chosen to fit into an
+// Ethernet frame along with IP and UDP headers.
+const statsDMaxPacketSize = 1432
+
+// Quantiles reported for histograms, and the respective metric name suffixes.
+var (
+	statsDQuantiles        = []float64{0.5, 0.95, 0.99}
+	statsDQuantileSuffixes = []string{".p50", ".p95", ".p99"}
+)
+
+// Characters that have special meaning in the StatsD protocol are replaced in
+// label values. When label values are appended to a metric name, dots are
+// replaced too, since they separate name components.
+var (
+	statsDTagEscaper = strings.NewReplacer(
+		":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	statsDNameEscaper = strings.NewReplacer(
+		".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+// StatsD periodically reports metrics of a registry to a StatsD server over
+// UDP. Counters are reported as increments since the previous report, gauges
+// as they are, and histograms as p50, p95 and p99 gauges along with a counter
+// of observed values.
+//
+// It implements `server.T`, so that it is started and stopped along with API
+// servers.
+type StatsD struct {
+	actorID    *actor.ID
+	cfg        *config.StatsD
+	registry   *Registry
+	conn       net.Conn
+	stopCh     chan struct{}
+	errorCh    chan error
+	wg         sync.WaitGroup
+	lastCounts map[interface{}]int64
+	buf        bytes.Buffer
+}
+
+// NewStatsD creates a StatsD reporter of metrics of the specified registry.
+// It does nothing until started.
+func NewStatsD(namespace *actor.ID, cfg *config.StatsD, registry *Registry) (*StatsD, error) {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial StatsD, addr=%s", cfg.Addr)
+	}
+	return &StatsD{
+		actorID:    namespace.NewChild("statsd"),
+		cfg:        cfg,
+		registry:   registry,
+		conn:       conn,
+		stopCh:     make(chan struct{}),
+		errorCh:    make(chan error),
+		lastCounts: make(map[interface{}]int64),
+	}, nil
+}
+
+// Start implements server.T.
+func (s *StatsD) Start() {
+	actor.Spawn(s.actorID, &s.wg, s.run)
+}
+
+// Stop implements server.T. Metrics are reported one last time before it
+// returns.
+func (s *StatsD) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+	s.conn.Close()
+}
+
+// ErrorCh implements server.T. The reporter never fails, errors sending
+// metrics are logged.
+func (s *StatsD) ErrorCh() <-chan error {
+	return s.errorCh
+}
+
+func (s *StatsD) run() {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stopCh:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends all metrics of the registry to StatsD, packing as many of them
+// into a packet as fits.
+func (s *StatsD) flush() {
+	s.registry.Each(func(name string, labels []Label, metric interface{}) {
+		switch m := metric.(type) {
+		case gometrics.Counter:
+			if delta := s.countDelta(m, m.Count()); delta != 0 {
+				s.write(name, "", labels, formatFloat(float64(delta)), "c")
+			}
+		case gometrics.Gauge:
+			s.write(name, "", labels, formatFloat(float64(m.Value())), "g")
+		case gometrics.Histogram:
+			h := m.Snapshot()
+			if delta := s.countDelta(m, h.Count()); delta != 0 {
+				s.write(name, ".count", labels, formatFloat(float64(delta)), "c")
+			}
+			if h.Count() == 0 {
+				return
+			}
+			ps := h.Percentiles(statsDQuantiles)
+			for i, suffix := range statsDQuantileSuffixes {
+				s.write(name, suffix, labels, formatFloat(ps[i]), "g")
+			}
+		}
+	})
+	s.send()
+}
+
+// countDelta returns by how much a count has changed since the previous
+// report of the metric.
+func (s *StatsD) countDelta(metric interface{}, count int64) int64 {
+	delta := count - s.lastCounts[metric]
+	s.lastCounts[metric] = count
+	return delta
+}
+
+// write appends a metric line to the pending packet, sending the packet
+// first if the line does not fit into it.
+func (s *StatsD) write(name, suffix string, labels []Label, value, metricType string) {
+	var line bytes.Buffer
+	line.WriteString(s.cfg.Prefix)
+	line.WriteString(name)
+	if s.cfg.Format == config.StatsDFormatPlain {
+		for _, l := range labels {
+			line.WriteString(".")
+			statsDNameEscaper.WriteString(&line, l.Value)
+		}
+	}
+	line.WriteString(suffix)
+	line.WriteString(":")
+	line.WriteString(value)
+	line.WriteString("|")
+	line.WriteString(metricType)
+	if s.cfg.Format != config.StatsDFormatPlain && (len(labels) > 0 || len(s.cfg.Tags) > 0) {
+		line.WriteString("|#")
+		for i, tag := range s.cfg.Tags {
+			if i != 0 {
+				line.WriteString(",")
+			}
+			line.WriteString(tag)
+		}
+		for i, l := range labels {
+			if i != 0 || len(s.cfg.Tags) > 0 {
+				line.WriteString(",")
+			}
+			line.WriteString(l.Name)
+			line.WriteString(":")
+			statsDTagEscaper.WriteString(&line, l.Value)
+		}
+	}
+	if s.buf.Len() > 0 && s.buf.Len()+1+line.Len() > statsDMaxPacketSize {
+		s.send()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteString("\n")
+	}
+	s.buf.Write(line.Bytes())
+}
+
+// send sends the pending packet to StatsD.
+func (s *StatsD) send() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		log.Errorf("<%s> failed to send metrics: err=(%s)", s.actorID, err)
+	}
+	s.buf.Reset()
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type StatsDSuite struct {
+	conn *net.UDPConn
+}
+
+var _ = Suite(&StatsDSuite{})
+
+func (s *StatsDSuite) SetUpTest(c *C) {
+	var err error
+	s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+}
+
+func (s *StatsDSuite) TearDownTest(c *C) {
+	s.conn.Close()
+}
+
+func (s *StatsDSuite) newStatsD(c *C, r *Registry, format config.StatsDFormat, tags ...string) *StatsD {
+	cfg := &config.StatsD{
+		Addr:          s.conn.LocalAddr().String(),
+		Prefix:        "pixy.",
+		Tags:          tags,
+		Format:        format,
+		FlushInterval: time.Hour,
+	}
+	sd, err := NewStatsD(actor.RootID, cfg, r)
+	c.Assert(err, IsNil)
+	return sd
+}
+
+// readLines returns lines of all packets received until there are none for
+// a while.
+func (s *StatsDSuite) readLines(c *C) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return lines
+		}
+		c.Assert(n <= statsDMaxPacketSize, Equals, true)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+// Labels and configured tags are reported as DogStatsD tags.
+func (s *StatsDSuite) TestFlushDatadog(c *C) {
+	r := NewRegistry()
+	r.Counter("foo", "cluster", "default", "topic", "a.b").Inc(3)
+	r.Gauge("bar").Update(-7)
+	r.Histogram("bazz", "topic", "c|d").Update(5)
+	sd := s.newStatsD(c, r, config.StatsDFormatDatadog, "env:prod")
+
+	// When
+	sd.flush()
+
+	// Then
+	c.Assert(s.readLines(c), DeepEquals, []string{
+		"pixy.bar:-7|g|#env:prod",
+		"pixy.bazz.count:1|c|#env:prod,topic:c_d",
+		"pixy.bazz.p50:5|g|#env:prod,topic:c_d",
+		"pixy.bazz.p95:5|g|#env:prod,topic:c_d",
+		"pixy.bazz.p99:5|g|#env:prod,topic:c_d",
+		"pixy.foo:3|c|#env:prod,cluster:default,topic:a.b",
+	})
+}
+
+// Label values are appended to metric names, and tags are not reported.
+func (s *StatsDSuite) TestFlushPlain(c *C) {
+	r := NewRegistry()
+	r.Counter("foo", "cluster", "default", "topic", "a.b").Inc(3)
+	r.Histogram("bazz", "topic", "c").Update(5)
+	sd := s.newStatsD(c, r, config.StatsDFormatPlain, "env:prod")
+
+	// When
+	sd.flush()
+
+	// Then
+	c.Assert(s.readLines(c), DeepEquals, []string{
+		"pixy.bazz.c.count:1|c",
+		"pixy.bazz.c.p50:5|g",
+		"pixy.bazz.c.p95:5|g",
+		"pixy.bazz.c.p99:5|g",
+		"pixy.foo.default.a_b:3|c",
+	})
+}
+
+// Counters are reported as increments since the previous flush, and are not
+// reported at all if they have not changed.
+func (s *StatsDSuite) TestFlushCounterDelta(c *C) {
+	r := NewRegistry()
+	r.Counter("foo").Inc(3)
+	r.Counter("bar").Inc(1)
+	sd := s.newStatsD(c, r, config.StatsDFormatDatadog)
+	sd.flush()
+	c.Assert(s.readLines(c), DeepEquals, []string{"pixy.bar:1|c", "pixy.foo:3|c"})
+
+	// When
+	r.Counter("foo").Inc(2)
+	sd.flush()
+
+	// Then
+	c.Assert(s.readLines(c), DeepEquals, []string{"pixy.foo:2|c"})
+}
+
+// Metrics that do not fit into one packet are sent in several.
+func (s *StatsDSuite) TestFlushSplit(c *C) {
+	r := NewRegistry()
+	for i := 0; i < 200; i++ {
+		r.Gauge("foo", "n", strings.Repeat("x", i%10)+string(rune('a'+i%26))).Update(int64(i))
+	}
+	sd := s.newStatsD(c, r, config.StatsDFormatDatadog)
+
+	// When
+	sd.flush()
+
+	// Then
+	var count int
+	r.Each(func(string, []Label, interface{}) { count++ })
+	c.Assert(len(s.readLines(c)), Equals, count)
+}
+
+// Metrics are reported one last time on stop.
+func (s *StatsDSuite) TestStop(c *C) {
+	r := NewRegistry()
+	sd := s.newStatsD(c, r, config.StatsDFormatDatadog)
+	sd.Start()
+	r.Counter("foo").Inc(1)
+
+	// When
+	sd.Stop()
+
+	// Then
+	c.Assert(s.readLines(c), DeepEquals, []string{"pixy.foo:1|c"})
+}
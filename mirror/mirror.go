@@ -0,0 +1,166 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Source is the subset of `proxy.T` methods that a mirror needs to consume
+// from a source cluster.
+type Source interface {
+	Consume(ctx context.Context, group, topic string, ack proxy.Ack, timeout time.Duration) (consumer.Message, error)
+	Ack(group, topic string, ack proxy.Ack) error
+	Nack(group, topic string, ack proxy.Ack, reason string) error
+}
+
+// Target is the subset of `proxy.T` methods that a mirror needs to produce
+// to a target cluster.
+type Target interface {
+	Produce(ctx context.Context, topic string, key, message sarama.Encoder) (*sarama.ProducerMessage, error)
+}
+
+// T replicates messages consumed by a group from a topic to a topic of
+// another cluster. A message is acknowledged only after it has been produced
+// to the target cluster, otherwise it is rejected, so that the consumer
+// offers it again. Offsets committed by the group therefore checkpoint the
+// replication progress.
+//
+// It implements `server.T`, so that it is started and stopped along with API
+// servers, before proxies are stopped.
+type T struct {
+	actorID     *actor.ID
+	cfg         *config.Proxy
+	mt          config.MirrorTopic
+	targetTopic string
+	src         Source
+	dst         Target
+	ctx         context.Context
+	cancel      context.CancelFunc
+	errorCh     chan error
+	wg          sync.WaitGroup
+	replicated  gometrics.Counter
+	failed      gometrics.Counter
+}
+
+// New creates a mirror of the specified topic. It does nothing until
+// started.
+func New(namespace *actor.ID, cfg *config.Proxy, mt config.MirrorTopic, src Source, dst Target) *T {
+	targetTopic := mt.TargetTopic
+	if targetTopic == "" {
+		targetTopic = mt.Topic
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	labels := []string{"cluster", cfg.Cluster, "target_cluster", mt.Cluster, "topic", mt.Topic}
+	return &T{
+		actorID:     namespace.NewChild("mirror", mt.Group, mt.Topic),
+		cfg:         cfg,
+		mt:          mt,
+		targetTopic: targetTopic,
+		src:         src,
+		dst:         dst,
+		ctx:         ctx,
+		cancel:      cancel,
+		errorCh:     make(chan error),
+		replicated:  metrics.Counter("mirror_replicated", labels...),
+		failed:      metrics.Counter("mirror_failed", labels...),
+	}
+}
+
+// Start implements server.T.
+func (t *T) Start() {
+	concurrency := t.mt.Concurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		actor.Spawn(t.actorID.NewChild("w", i), &t.wg, t.run)
+	}
+}
+
+// Stop implements server.T. Pending consume requests are canceled, and
+// messages that are being produced are acknowledged or rejected once the
+// produce completes.
+func (t *T) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// ErrorCh implements server.T. Mirrors never fail, replication errors are
+// logged and counted.
+func (t *T) ErrorCh() <-chan error {
+	return t.errorCh
+}
+
+func (t *T) run() {
+	for {
+		msg, err := t.src.Consume(t.ctx, t.mt.Group, t.mt.Topic, proxy.NoAck(), 0)
+		if err != nil {
+			if err == consumer.ErrRequestCanceled {
+				return
+			}
+			if err == consumer.ErrRequestTimeout {
+				continue
+			}
+			if errors.Cause(err) != consumer.ErrTooManyRequests && !consumer.IsOverloaded(err) && !proxy.IsQuotaExceeded(err) {
+				log.Errorf("<%s> failed to consume: err=(%s)", t.actorID, err)
+			}
+			if !t.backoff() {
+				return
+			}
+			continue
+		}
+		ack, err := proxy.NewAck(msg.Partition, msg.Offset)
+		if err != nil {
+			log.Errorf("<%s> bad message: err=(%s)", t.actorID, err)
+			continue
+		}
+		if _, err := t.dst.Produce(t.ctx, t.targetTopic, toEncoderPreservingNil(msg.Key), toEncoderPreservingNil(msg.Value)); err != nil {
+			t.failed.Inc(1)
+			if err := t.src.Nack(t.mt.Group, t.mt.Topic, ack, err.Error()); err != nil {
+				log.Errorf("<%s> failed to nack: partition=%d, offset=%d, err=(%s)",
+					t.actorID, msg.Partition, msg.Offset, err)
+			}
+			if !t.backoff() {
+				return
+			}
+			continue
+		}
+		t.replicated.Inc(1)
+		if err := t.src.Ack(t.mt.Group, t.mt.Topic, ack); err != nil {
+			log.Errorf("<%s> failed to ack: partition=%d, offset=%d, err=(%s)",
+				t.actorID, msg.Partition, msg.Offset, err)
+		}
+	}
+}
+
+// backoff waits for `Mirror.RetryBackoff`. It returns false if the mirror
+// was stopped in the meantime.
+func (t *T) backoff() bool {
+	select {
+	case <-time.After(t.cfg.Mirror.RetryBackoff):
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// toEncoderPreservingNil converts a slice of bytes to `sarama.Encoder` but
+// returns `nil` if the passed slice is `nil`, so that messages without a key
+// are replicated without a key.
+func toEncoderPreservingNil(b []byte) sarama.Encoder {
+	if b != nil {
+		return sarama.ByteEncoder(b)
+	}
+	return nil
+}
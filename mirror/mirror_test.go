@@ -0,0 +1,172 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type MirrorSuite struct {
+	cfg *config.Proxy
+}
+
+var _ = Suite(&MirrorSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *MirrorSuite) SetUpTest(c *C) {
+	s.cfg = config.DefaultProxy()
+	s.cfg.Mirror.RetryBackoff = 10 * time.Millisecond
+}
+
+// Messages are produced to the target topic with the same keys and values,
+// and acknowledged after that.
+func (s *MirrorSuite) TestReplicate(c *C) {
+	src := newFakeSource(3)
+	dst := &fakeTarget{}
+	mt := config.MirrorTopic{Group: "g", Topic: "t", Cluster: "dr", TargetTopic: "t2"}
+	m := New(actor.RootID, s.cfg, mt, src, dst)
+
+	// When
+	m.Start()
+	src.waitDone(c, 3)
+	m.Stop()
+
+	// Then
+	c.Assert(src.acks, DeepEquals, []string{"{0 0 }", "{0 1 }", "{0 2 }"})
+	c.Assert(src.nacks, IsNil)
+	c.Assert(dst.produced, DeepEquals, []string{"t2/k0=v0", "t2/<nil>=v1", "t2/k2=v2"})
+}
+
+// If a target topic is not specified, then messages are produced to the
+// topic with the same name.
+func (s *MirrorSuite) TestReplicateSameTopic(c *C) {
+	src := newFakeSource(1)
+	dst := &fakeTarget{}
+	m := New(actor.RootID, s.cfg, config.MirrorTopic{Group: "g", Topic: "t", Cluster: "dr"}, src, dst)
+
+	// When
+	m.Start()
+	src.waitDone(c, 1)
+	m.Stop()
+
+	// Then
+	c.Assert(dst.produced, DeepEquals, []string{"t/k0=v0"})
+}
+
+// Messages that fail to be produced are rejected.
+func (s *MirrorSuite) TestProduceFailed(c *C) {
+	src := newFakeSource(1)
+	dst := &fakeTarget{err: errors.New("kaboom")}
+	m := New(actor.RootID, s.cfg, config.MirrorTopic{Group: "g", Topic: "t", Cluster: "dr"}, src, dst)
+
+	// When
+	m.Start()
+	src.waitDone(c, 1)
+	m.Stop()
+
+	// Then
+	c.Assert(src.acks, IsNil)
+	c.Assert(src.nacks, DeepEquals, []string{"{0 0 }: kaboom"})
+}
+
+// fakeSource serves a fixed number of messages and records acks and nacks
+// as `{partition offset}` strings. Every second message has no key.
+type fakeSource struct {
+	mu     sync.Mutex
+	next   int64
+	count  int64
+	acks   []string
+	nacks  []string
+	doneCh chan struct{}
+}
+
+func newFakeSource(count int64) *fakeSource {
+	return &fakeSource{count: count, doneCh: make(chan struct{}, count)}
+}
+
+func (p *fakeSource) Consume(ctx context.Context, group, topic string, ack proxy.Ack, timeout time.Duration) (consumer.Message, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next >= p.count {
+		select {
+		case <-ctx.Done():
+			return consumer.Message{}, consumer.ErrRequestCanceled
+		case <-time.After(10 * time.Millisecond):
+		}
+		return consumer.Message{}, consumer.ErrRequestTimeout
+	}
+	offset := p.next
+	p.next++
+	msg := consumer.Message{
+		Topic:  topic,
+		Value:  []byte(fmt.Sprintf("v%d", offset)),
+		Offset: offset,
+	}
+	if offset%2 == 0 {
+		msg.Key = []byte(fmt.Sprintf("k%d", offset))
+	}
+	return msg, nil
+}
+
+func (p *fakeSource) Ack(group, topic string, ack proxy.Ack) error {
+	p.mu.Lock()
+	p.acks = append(p.acks, fmt.Sprint(ack))
+	p.mu.Unlock()
+	p.doneCh <- struct{}{}
+	return nil
+}
+
+func (p *fakeSource) Nack(group, topic string, ack proxy.Ack, reason string) error {
+	p.mu.Lock()
+	p.nacks = append(p.nacks, fmt.Sprintf("%v: %s", ack, reason))
+	p.mu.Unlock()
+	p.doneCh <- struct{}{}
+	return nil
+}
+
+func (p *fakeSource) waitDone(c *C, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-p.doneCh:
+		case <-time.After(3 * time.Second):
+			c.Fatalf("timeout waiting for message #%d", i)
+		}
+	}
+}
+
+// fakeTarget records produced messages as `topic/key=value` strings, or
+// fails every produce with `err` if it is set.
+type fakeTarget struct {
+	mu       sync.Mutex
+	err      error
+	produced []string
+}
+
+func (p *fakeTarget) Produce(ctx context.Context, topic string, key, message sarama.Encoder) (*sarama.ProducerMessage, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keyStr := "<nil>"
+	if key != nil {
+		encoded, _ := key.Encode()
+		keyStr = string(encoded)
+	}
+	value, _ := message.Encode()
+	p.produced = append(p.produced, fmt.Sprintf("%s/%s=%s", topic, keyStr, value))
+	return &sarama.ProducerMessage{Topic: topic, Key: key, Value: message}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/mapper"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
 )
@@ -60,7 +61,8 @@ type T interface {
 	// managers before their parent factory can be stopped.
 	//
 	// It is guaranteed that the most recent offset is committed before `Stop`
-	// returns.
+	// returns, unless it could not be committed within
+	// `Config.Consumer.FinalOffsetCommitTimeout`.
 	Stop()
 }
 
@@ -244,6 +246,7 @@ func (om *offsetMgr) run() {
 		submitResponseCh      = make(chan submitRes, 1)
 		initialOffsetFetched  = false
 		stopped               = false
+		nilOrStopTimeoutCh    <-chan time.Time
 		commitTicker          = time.NewTicker(om.f.cfg.Consumer.OffsetsCommitInterval)
 		offsetCommitTimeout   = om.f.cfg.Consumer.OffsetsCommitInterval * 3
 		lastSubmitTime        time.Time
@@ -280,6 +283,9 @@ func (om *offsetMgr) run() {
 					return
 				}
 				stopped, nilOrSubmitRequestsCh = true, nil
+				if timeout := om.f.cfg.Consumer.FinalOffsetCommitTimeout; timeout > 0 {
+					nilOrStopTimeoutCh = time.After(timeout)
+				}
 				continue
 			}
 			lastSubmitRequest = submitReq
@@ -305,6 +311,12 @@ func (om *offsetMgr) run() {
 			if isRequestTimeout && lastSubmitRequest.offset != lastCommittedOffset {
 				om.triggerOrScheduleReassign(errRequestTimeout, "offset commit failed")
 			}
+		case <-nilOrStopTimeoutCh:
+			log.Errorf("<%s> gave up committing final offset: offset=%d, committed=%d",
+				om.actorID, lastSubmitRequest.offset.Val, lastCommittedOffset.Val)
+			metrics.Counter("consumer_final_commit_abandoned", "cluster", om.f.cfg.Cluster,
+				"group", om.id.group, "topic", om.id.topic).Inc(1)
+			return
 		case <-om.nilOrReassignRetryTimerCh:
 			om.f.mapper.TriggerReassign(om)
 			log.Infof("<%s> reassign triggered by timeout", om.actorID)
@@ -470,13 +482,16 @@ offsetCommitLoop:
 					kafkaReq.AddBlock(req.id.topic, req.id.partition, req.offset.Val, sarama.ReceiveTime, req.offset.Meta)
 				}
 				var kafkaRes *sarama.OffsetCommitResponse
+				begin := time.Now()
 				kafkaRes, lastErr = be.conn.CommitOffset(kafkaReq)
 				if lastErr != nil {
 					lastErrTime = time.Now().UTC()
 					be.conn.Close()
 					log.Infof("<%s> connection reset: err=(%v)", be.execActorID, lastErr)
+					metrics.Counter("consumer_offset_commit_failed", "cluster", be.cfg.Cluster, "group", group).Inc(1)
 					continue offsetCommitLoop
 				}
+				metrics.Histogram("consumer_offset_commit_latency_ms", "cluster", be.cfg.Cluster, "group", group).Update(int64(time.Since(begin) / time.Millisecond))
 				// Fan the response out to the partition offset managers.
 				for _, req := range groupRequests {
 					req.resultCh <- submitRes{req, kafkaRes}
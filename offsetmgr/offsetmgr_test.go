@@ -9,6 +9,7 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/metrics"
 	"github.com/mailgun/kafka-pixy/testhelpers"
 	"github.com/mailgun/log"
 	. "gopkg.in/check.v1"
@@ -186,6 +187,53 @@ func (s *OffsetMgrSuite) TestCommitError(c *C) {
 	c.Assert(committedOffset, DeepEquals, Offset{1000, "foo"})
 }
 
+// If the last submitted offset cannot be committed within
+// `Consumer.FinalOffsetCommitTimeout` on stop, then it is abandoned.
+func (s *OffsetMgrSuite) TestFinalCommitTimeout(c *C) {
+	// Given
+	broker1 := sarama.NewMockBroker(c, 101)
+	defer broker1.Close()
+
+	broker1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(c).
+			SetBroker(broker1.Addr(), broker1.BrokerID()),
+		"ConsumerMetadataRequest": sarama.NewMockConsumerMetadataResponse(c).
+			SetCoordinator("g1", broker1),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(c).
+			SetOffset("g1", "t1", 7, 1234, "foo", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(c).
+			SetError("g1", "t1", 7, sarama.ErrNotLeaderForPartition),
+	})
+
+	cfg := testhelpers.NewTestProxyCfg("c1")
+	cfg.Consumer.RetryBackoff = 50 * time.Millisecond
+	cfg.Consumer.OffsetsCommitInterval = 50 * time.Millisecond
+	cfg.Consumer.FinalOffsetCommitTimeout = 300 * time.Millisecond
+	client, err := sarama.NewClient([]string{broker1.Addr()}, nil)
+	c.Assert(err, IsNil)
+
+	f := SpawnFactory(s.ns.NewChild(), cfg, client)
+	defer f.Stop()
+
+	om, err := f.Spawn(s.ns.NewChild("g1", "t1", 7), "g1", "t1", 7)
+	c.Assert(err, IsNil)
+	c.Assert(<-om.CommittedOffsets(), DeepEquals, Offset{1234, "foo"})
+	abandoned := metrics.Counter("consumer_final_commit_abandoned",
+		"cluster", cfg.Cluster, "group", "g1", "topic", "t1")
+	abandonedBefore := abandoned.Count()
+
+	// When
+	om.SubmitOffset(Offset{1000, "foo"})
+	begin := time.Now()
+	om.Stop()
+
+	// Then
+	elapsed := time.Now().Sub(begin)
+	c.Assert(elapsed >= cfg.Consumer.FinalOffsetCommitTimeout, Equals, true, Commentf("elapsed=%v", elapsed))
+	c.Assert(elapsed < time.Second, Equals, true, Commentf("elapsed=%v", elapsed))
+	c.Assert(abandoned.Count(), Equals, abandonedBefore+1)
+}
+
 // If offset a response received from Kafka for an offset commit request does
 // not contain information for a submitted offset, then offset manager keeps,
 // retrying until it succeeds.
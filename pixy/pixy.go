@@ -0,0 +1,180 @@
+// Package pixy allows Go programs to embed Kafka-Pixy, that is to produce and
+// consume Kafka messages with the same semantics that the Kafka-Pixy daemon
+// provides, in-process and without running any API servers.
+//
+//	px, err := pixy.New(cfg)
+//	...
+//	defer px.Stop()
+//	msg, err := px.Consume(ctx, "", "my-group", "my-topic", 0)
+//	...
+//	err = px.Ack("", "my-group", "my-topic", msg.Partition, msg.Offset)
+package pixy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/mailgun/kafka-pixy/ratelimit"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrRequestTimeout is returned by Consume if no message became
+	// available within the long polling timeout.
+	ErrRequestTimeout = consumer.ErrRequestTimeout
+
+	// ErrRequestCanceled is returned by Consume if its context is done
+	// before a message is consumed.
+	ErrRequestCanceled = consumer.ErrRequestCanceled
+)
+
+// T is an embedded Kafka-Pixy instance. It runs a proxy for every cluster in
+// the config. Methods that take a cluster name operate on the default cluster
+// if the name is empty.
+type T struct {
+	actorID  *actor.ID
+	proxies  map[string]*proxy.T
+	proxySet *proxy.Set
+}
+
+// Message is a message consumed from Kafka.
+type Message struct {
+	Key, Value    []byte
+	Topic         string
+	Partition     int32
+	Offset        int64
+	Timestamp     time.Time // only set if Kafka is version 0.10+
+	HighWaterMark int64
+	// The number of times the message has been offered to the consumer
+	// group, including this one.
+	DeliveryAttempt int
+}
+
+// New spawns proxies to all clusters defined by the config. The config is
+// expected to be valid, e.g. returned by `config.FromYAML` or
+// `config.DefaultApp`. API server parameters of the config are ignored,
+// except for `http.tenants` whose quotas apply to topics and groups owned by
+// the tenants.
+func New(cfg *config.App) (*T, error) {
+	t := &T{
+		actorID: actor.RootID.NewChild("pixy"),
+		proxies: make(map[string]*proxy.T, len(cfg.Proxies)),
+	}
+	quotas := ratelimit.NewQuotas(cfg.HTTP.Tenants)
+	for cluster, pxyCfg := range cfg.Proxies {
+		pxy, err := proxy.Spawn(actor.RootID, cluster, pxyCfg, quotas)
+		if err != nil {
+			t.Stop()
+			return nil, errors.Wrapf(err, "failed to spawn proxy, name=%s", cluster)
+		}
+		t.proxies[cluster] = pxy
+	}
+	defaultPxy := t.proxies[cfg.DefaultCluster]
+	if defaultPxy == nil {
+		t.Stop()
+		return nil, errors.Errorf("default cluster is not configured, %s", cfg.DefaultCluster)
+	}
+	t.proxySet = proxy.NewSet(t.proxies, defaultPxy)
+	return t, nil
+}
+
+// Proxies returns a set of proxies to all configured clusters, that provides
+// access to the complete proxy API including administrative functions.
+func (t *T) Proxies() *proxy.Set {
+	return t.proxySet
+}
+
+// Stop terminates all proxies synchronously. Messages that have been consumed
+// but not acknowledged yet will be consumed again.
+func (t *T) Stop() {
+	var wg sync.WaitGroup
+	for cluster, pxy := range t.proxies {
+		actor.Spawn(t.actorID.NewChild(fmt.Sprintf("%s_stop", cluster)), &wg, pxy.Stop)
+	}
+	wg.Wait()
+}
+
+// Produce writes a message to a topic and waits until Kafka confirms the
+// write as required by `producer.required_acks` of the cluster config. If
+// `key` is nil, then the message is written to a random partition, otherwise
+// the partition is selected by the key hash. It returns the partition and the
+// offset that the message was written to.
+func (t *T) Produce(cluster, topic string, key, message []byte) (int32, int64, error) {
+	pxy, err := t.proxySet.Get(cluster)
+	if err != nil {
+		return 0, 0, err
+	}
+	prodMsg, err := pxy.Produce(context.Background(), topic, toEncoder(key), sarama.ByteEncoder(message))
+	if err != nil {
+		return 0, 0, err
+	}
+	return prodMsg.Partition, prodMsg.Offset, nil
+}
+
+// AsyncProduce is like Produce, but it returns as soon as the message is
+// queued for writing. Errors that occur while writing it to Kafka are only
+// logged.
+func (t *T) AsyncProduce(cluster, topic string, key, message []byte) error {
+	pxy, err := t.proxySet.Get(cluster)
+	if err != nil {
+		return err
+	}
+	return pxy.AsyncProduce(context.Background(), topic, toEncoder(key), sarama.ByteEncoder(message))
+}
+
+// Consume consumes a message from a topic on behalf of a consumer group. If
+// there are no new messages it waits for `timeout`, or for
+// `consumer.long_polling_timeout` if `timeout` is zero, and returns
+// ErrRequestTimeout if none is produced in the meantime.
+//
+// The message must be acknowledged with Ack, otherwise it is consumed again
+// after `consumer.ack_timeout`.
+func (t *T) Consume(ctx context.Context, cluster, group, topic string, timeout time.Duration) (Message, error) {
+	pxy, err := t.proxySet.Get(cluster)
+	if err != nil {
+		return Message{}, err
+	}
+	consMsg, err := pxy.Consume(ctx, group, topic, proxy.NoAck(), timeout)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Key:           consMsg.Key,
+		Value:         consMsg.Value,
+		Topic:         consMsg.Topic,
+		Partition:     consMsg.Partition,
+		Offset:        consMsg.Offset,
+		Timestamp:     consMsg.Timestamp,
+		HighWaterMark: consMsg.HighWaterMark,
+
+		DeliveryAttempt: consMsg.DeliveryAttempt,
+	}, nil
+}
+
+// Ack acknowledges a message consumed by a consumer group from a topic, so
+// that it is never consumed by the group again.
+func (t *T) Ack(cluster, group, topic string, partition int32, offset int64) error {
+	pxy, err := t.proxySet.Get(cluster)
+	if err != nil {
+		return err
+	}
+	ack, err := proxy.NewAck(partition, offset)
+	if err != nil {
+		return err
+	}
+	return pxy.Ack(group, topic, ack)
+}
+
+func toEncoder(key []byte) sarama.Encoder {
+	if key == nil {
+		return nil
+	}
+	return sarama.ByteEncoder(key)
+}
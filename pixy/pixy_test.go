@@ -0,0 +1,72 @@
+package pixy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/testhelpers"
+	"github.com/mailgun/kafka-pixy/testhelpers/kafkahelper"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PixySuite struct {
+	cfg *config.App
+	kh  *kafkahelper.T
+}
+
+var _ = Suite(&PixySuite{})
+
+func (s *PixySuite) SetUpSuite(c *C) {
+	testhelpers.InitLogging(c)
+}
+
+func (s *PixySuite) SetUpTest(c *C) {
+	s.cfg = &config.App{Proxies: make(map[string]*config.Proxy)}
+	s.cfg.Proxies["pxyE"] = testhelpers.NewTestProxyCfg("test_pixy")
+	s.cfg.DefaultCluster = "pxyE"
+	s.kh = kafkahelper.New(c)
+}
+
+func (s *PixySuite) TearDownTest(c *C) {
+	s.kh.Close()
+}
+
+// A produced message can be consumed and acknowledged.
+func (s *PixySuite) TestProduceConsumeAck(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	px, err := New(s.cfg)
+	c.Assert(err, IsNil)
+	defer px.Stop()
+
+	// When
+	partition, offset, err := px.Produce("", "test.1", []byte("bar"), []byte("bazz"))
+	c.Assert(err, IsNil)
+	msg, err := px.Consume(context.Background(), "", "foo", "test.1", 0)
+	c.Assert(err, IsNil)
+	err = px.Ack("", "foo", "test.1", msg.Partition, msg.Offset)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(msg.Partition, Equals, partition)
+	c.Assert(msg.Offset, Equals, offset)
+	c.Assert(string(msg.Key), Equals, "bar")
+	c.Assert(string(msg.Value), Equals, "bazz")
+}
+
+// Operations on a cluster that is not configured fail.
+func (s *PixySuite) TestUnknownCluster(c *C) {
+	px, err := New(s.cfg)
+	c.Assert(err, IsNil)
+	defer px.Stop()
+
+	// When
+	_, _, err = px.Produce("pxyX", "test.1", nil, []byte("bazz"))
+
+	// Then
+	c.Assert(err.Error(), Equals, "proxy `pxyX` does not exist")
+}
@@ -0,0 +1,77 @@
+package producer
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// murmur2Partitioner assigns messages to partitions the same way the default
+// partitioner of the Java Kafka client does, so that messages with the same
+// key produced by Kafka-Pixy and by Java producers end up in the same
+// partition. Messages with a nil key are assigned to a random partition.
+type murmur2Partitioner struct {
+	random sarama.Partitioner
+}
+
+// NewMurmur2Partitioner returns a partitioner that is compatible with the
+// default partitioner of the Java Kafka client.
+func NewMurmur2Partitioner(topic string) sarama.Partitioner {
+	return &murmur2Partitioner{random: sarama.NewRandomPartitioner(topic)}
+}
+
+// Partition implements sarama.Partitioner.
+func (p *murmur2Partitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if msg.Key == nil {
+		return p.random.Partition(msg, numPartitions)
+	}
+	key, err := msg.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	return toPositive(murmur2(key)) % numPartitions, nil
+}
+
+// RequiresConsistency implements sarama.Partitioner.
+func (p *murmur2Partitioner) RequiresConsistency() bool {
+	return true
+}
+
+// murmur2 is a port of `org.apache.kafka.common.utils.Utils.murmur2`.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// toPositive is a port of `org.apache.kafka.common.utils.Utils.toPositive`.
+// Note that it is not the same as taking an absolute value.
+func toPositive(n int32) int32 {
+	return n & 0x7fffffff
+}
@@ -0,0 +1,62 @@
+package producer
+
+import (
+	"github.com/Shopify/sarama"
+	. "gopkg.in/check.v1"
+)
+
+type PartitionerSuite struct{}
+
+var _ = Suite(&PartitionerSuite{})
+
+// Hashes are the same as calculated by the Java Kafka client.
+func (s *PartitionerSuite) TestMurmur2(c *C) {
+	for i, tc := range []struct {
+		key  string
+		hash int32
+	}{
+		{key: "21", hash: -973932308},
+		{key: "foobar", hash: -790332482},
+		{key: "a-little-bit-long-string", hash: -985981536},
+		{key: "a-little-bit-longer-string", hash: -1486304829},
+		{key: "lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", hash: -58897971},
+		{key: "abc", hash: 479470107},
+	} {
+		c.Assert(murmur2([]byte(tc.key)), Equals, tc.hash, Commentf("case #%d", i))
+	}
+}
+
+// Messages with the same key are assigned to the same partition as by the
+// Java Kafka client.
+func (s *PartitionerSuite) TestMurmur2Partitioner(c *C) {
+	p := NewMurmur2Partitioner("foo")
+	for i, tc := range []struct {
+		key       string
+		partition int32
+	}{
+		{key: "21", partition: 0},
+		{key: "foobar", partition: 6},
+		{key: "abc", partition: 7},
+	} {
+		// When
+		partition, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(tc.key)}, 10)
+
+		// Then
+		c.Assert(err, IsNil)
+		c.Assert(partition, Equals, tc.partition, Commentf("case #%d", i))
+	}
+	c.Assert(p.RequiresConsistency(), Equals, true)
+}
+
+// Messages with a nil key are assigned to a random partition.
+func (s *PartitionerSuite) TestMurmur2PartitionerNilKey(c *C) {
+	p := NewMurmur2Partitioner("foo")
+	for i := 0; i < 100; i++ {
+		// When
+		partition, err := p.Partition(&sarama.ProducerMessage{}, 10)
+
+		// Then
+		c.Assert(err, IsNil)
+		c.Assert(partition >= 0 && partition < 10, Equals, true)
+	}
+}
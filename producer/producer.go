@@ -1,13 +1,19 @@
 package producer
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/none"
+	"github.com/mailgun/kafka-pixy/redact"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
 )
@@ -16,6 +22,8 @@ const (
 	maxEncoderReprLength = 4096
 )
 
+var errRetryAborted = errors.New("producer stopped before message could be resubmitted")
+
 // T builds on top of `sarama.AsyncProducer` to improve the shutdown handling.
 // The problem it solves is that `sarama.AsyncProducer` drops all buffered
 // messages as soon as it is ordered to shutdown. On the contrary, when `T` is
@@ -23,60 +31,186 @@ const (
 // committed to the Kafka cluster, and only when that time has elapsed it drops
 // uncommitted messages.
 //
-// TODO Consider implementing some sort of dead message processing.
+// Messages that could not be submitted to Kafka are handled in accordance
+// with `Producer.RetryExhaustedPolicy`.
+//
+// Sarama applies the same compression to all messages that a producer
+// submits, therefore a separate `sarama.AsyncProducer` is created for every
+// compression that is configured for some topic via `Producer.Topics`.
 type T struct {
-	mergerActorID     *actor.ID
-	dispatcherActorID *actor.ID
-	saramaClient      sarama.Client
-	saramaProducer    sarama.AsyncProducer
-	shutdownTimeout   time.Duration
-	dispatcherCh      chan *sarama.ProducerMessage
-	resultCh          chan produceResult
-	wg                sync.WaitGroup
+	cluster              string
+	mergerActorID        *actor.ID
+	dispatcherActorID    *actor.ID
+	replayerActorID      *actor.ID
+	saramaClients        []sarama.Client
+	saramaProducers      []sarama.AsyncProducer
+	topicProducers       map[string]sarama.AsyncProducer
+	shutdownTimeout      time.Duration
+	shutdownFlushTimeout time.Duration
+	retryBackoff         time.Duration
+	exhaustedPolicy      config.RetryExhaustedPolicy
+	deadLetterFile       *os.File
+	spool                *spool
+	dispatcherCh         chan *sarama.ProducerMessage
+	resultCh             chan produceResult
+	droppedCount         int
+	wg                   sync.WaitGroup
+	replayerStopCh       chan none.T
+	replayerWG           sync.WaitGroup
+	redactor             *redact.T
 
 	// To be used in tests only
 	testDroppedMsgCh chan<- *sarama.ProducerMessage
 }
 
+// msgMeta is attached to every message submitted to `sarama.AsyncProducer`
+// as metadata.
+type msgMeta struct {
+	// A channel to send the production result to. It is nil for messages
+	// produced asynchronously.
+	replyCh chan produceResult
+	// The time when the message was last submitted to `sarama.AsyncProducer`,
+	// it is used to measure the broker acknowledgement latency.
+	sentAt time.Time
+	// Whether the message is replayed from the spool. Failures of such
+	// messages are handled by the replayer goroutine.
+	replayed bool
+	// A function to call with the production result of a message produced
+	// asynchronously, if the caller wants to know it.
+	notify func(*sarama.ProducerMessage, error)
+}
+
 type produceResult struct {
 	Msg *sarama.ProducerMessage
 	Err error
 }
 
-// Spawn creates a producer instance and starts its internal goroutines.
-func Spawn(namespace *actor.ID, cfg *config.Proxy) (*T, error) {
-	saramaCfg := cfg.SaramaProducerCfg()
-	saramaCfg.Producer.Return.Successes = true
-	saramaCfg.Producer.Return.Errors = true
+// retry represents a message that failed to be submitted to Kafka and is
+// scheduled to be resubmitted at `dueAt`.
+type retry struct {
+	msg   *sarama.ProducerMessage
+	dueAt time.Time
+}
 
-	saramaClient, err := sarama.NewClient(cfg.Kafka.SeedPeers, saramaCfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create sarama.Client")
-	}
-	saramaProducer, err := sarama.NewAsyncProducerFromClient(saramaClient)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create sarama.Producer")
-	}
+// deadLetter is a JSON representation of a message written to the dead letter
+// file.
+type deadLetter struct {
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	Key       []byte    `json:"key"`
+	Value     []byte    `json:"value"`
+	Error     string    `json:"error"`
+}
 
+// Spawn creates a producer instance and starts its internal goroutines.
+func Spawn(namespace *actor.ID, cfg *config.Proxy) (*T, error) {
 	prodNamespace := namespace.NewChild("prod")
 	p := &T{
-		mergerActorID:     prodNamespace.NewChild("merger"),
-		dispatcherActorID: prodNamespace.NewChild("dispatcher"),
-		saramaClient:      saramaClient,
-		saramaProducer:    saramaProducer,
-		shutdownTimeout:   cfg.Producer.ShutdownTimeout,
-		dispatcherCh:      make(chan *sarama.ProducerMessage, cfg.Producer.ChannelBufferSize),
-		resultCh:          make(chan produceResult, cfg.Producer.ChannelBufferSize),
+		cluster:              cfg.Cluster,
+		mergerActorID:        prodNamespace.NewChild("merger"),
+		dispatcherActorID:    prodNamespace.NewChild("dispatcher"),
+		replayerActorID:      prodNamespace.NewChild("replayer"),
+		topicProducers:       make(map[string]sarama.AsyncProducer),
+		shutdownTimeout:      cfg.Producer.ShutdownTimeout,
+		shutdownFlushTimeout: cfg.Producer.ShutdownFlushTimeout,
+		retryBackoff:         cfg.Producer.RetryBackoff,
+		exhaustedPolicy:      cfg.Producer.RetryExhaustedPolicy,
+		dispatcherCh:         make(chan *sarama.ProducerMessage, cfg.Producer.ChannelBufferSize),
+		resultCh:             make(chan produceResult, cfg.Producer.ChannelBufferSize),
+		replayerStopCh:       make(chan none.T),
+		redactor:             redact.New(cfg),
+	}
+	var err error
+	switch cfg.Producer.RetryExhaustedPolicy {
+	case config.RetryExhaustedDeadLetterFile:
+		p.deadLetterFile, err = os.OpenFile(cfg.Producer.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open dead letter file")
+		}
+	case config.RetryExhaustedSpool:
+		p.spool, err = openSpool(filepath.Join(cfg.Producer.SpoolDir, cfg.Cluster), cfg.Producer.SpoolMaxSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open spool")
+		}
+	}
+	if err := p.spawnSaramaProducers(cfg); err != nil {
+		for _, saramaProducer := range p.saramaProducers {
+			saramaProducer.Close()
+		}
+		p.closeSaramaClients()
+		p.closeFiles()
+		return nil, err
 	}
 	actor.Spawn(p.mergerActorID, &p.wg, p.runMerger)
 	actor.Spawn(p.dispatcherActorID, &p.wg, p.runDispatcher)
+	if p.spool != nil {
+		p.updateSpoolMetrics()
+		actor.Spawn(p.replayerActorID, &p.replayerWG, p.runReplayer)
+	}
 	return p, nil
 }
 
-// Stop shuts down all producer goroutines and releases all resources.
+// spawnSaramaProducers creates a `sarama.AsyncProducer` with the default
+// compression, and one more for every other compression configured for some
+// topic. Each of them gets a dedicated `sarama.Client`, for sarama takes the
+// producer config from the client.
+func (p *T) spawnSaramaProducers(cfg *config.Proxy) error {
+	byCompression := make(map[config.Compression]sarama.AsyncProducer)
+	spawn := func(compression config.Compression) (sarama.AsyncProducer, error) {
+		if saramaProducer, ok := byCompression[compression]; ok {
+			return saramaProducer, nil
+		}
+		saramaCfg := cfg.SaramaProducerCfg()
+		saramaCfg.Producer.Compression = sarama.CompressionCodec(compression)
+		saramaCfg.Producer.Return.Successes = true
+		saramaCfg.Producer.Return.Errors = true
+		if cfg.Producer.Partitioner == config.PartitionerMurmur2 {
+			saramaCfg.Producer.Partitioner = NewMurmur2Partitioner
+		}
+		saramaClient, err := sarama.NewClient(cfg.Kafka.SeedPeers, saramaCfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create sarama.Client")
+		}
+		p.saramaClients = append(p.saramaClients, saramaClient)
+		saramaProducer, err := sarama.NewAsyncProducerFromClient(saramaClient)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create sarama.Producer")
+		}
+		p.saramaProducers = append(p.saramaProducers, saramaProducer)
+		byCompression[compression] = saramaProducer
+		return saramaProducer, nil
+	}
+	if _, err := spawn(cfg.Producer.Compression); err != nil {
+		return err
+	}
+	for topic := range cfg.Producer.Topics {
+		saramaProducer, err := spawn(cfg.TopicCompression(topic))
+		if err != nil {
+			return errors.Wrapf(err, "topic=%s", topic)
+		}
+		p.topicProducers[topic] = saramaProducer
+	}
+	return nil
+}
+
+// Stop shuts down all producer goroutines and releases all resources. It
+// blocks for at most `Producer.ShutdownTimeout` + `Producer.ShutdownFlushTimeout`.
+// Messages that were not confirmed by Kafka by then are reported as dropped.
 func (p *T) Stop() {
+	close(p.replayerStopCh)
+	p.replayerWG.Wait()
 	close(p.dispatcherCh)
 	p.wg.Wait()
+	p.closeFiles()
+}
+
+func (p *T) closeFiles() {
+	if p.deadLetterFile != nil {
+		p.deadLetterFile.Close()
+	}
+	if p.spool != nil {
+		p.spool.close()
+	}
 }
 
 // Produce submits a message to the specified `topic` of the Kafka cluster
@@ -93,7 +227,7 @@ func (p *T) Produce(topic string, key, message sarama.Encoder) (*sarama.Producer
 		Topic:    topic,
 		Key:      key,
 		Value:    message,
-		Metadata: replyCh,
+		Metadata: &msgMeta{replyCh: replyCh},
 	}
 	p.dispatcherCh <- prodMsg
 	result := <-replyCh
@@ -104,24 +238,57 @@ func (p *T) Produce(topic string, key, message sarama.Encoder) (*sarama.Producer
 // Errors are silently ignored.
 func (p *T) AsyncProduce(topic string, key, message sarama.Encoder) {
 	prodMsg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   key,
-		Value: message,
+		Topic:    topic,
+		Key:      key,
+		Value:    message,
+		Metadata: &msgMeta{},
+	}
+	p.dispatcherCh <- prodMsg
+}
+
+// AsyncProduceNotify is like AsyncProduce, but `notify` is called with the
+// production result once it is known, that is when the message is either
+// written to Kafka or handled in accordance with the retry exhausted policy.
+// Messages produced this way are never spooled. The function is called from
+// an internal goroutine, therefore it must not block.
+func (p *T) AsyncProduceNotify(topic string, key, message sarama.Encoder, notify func(*sarama.ProducerMessage, error)) {
+	prodMsg := &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      key,
+		Value:    message,
+		Metadata: &msgMeta{notify: notify},
 	}
 	p.dispatcherCh <- prodMsg
 }
 
 // merge receives both message acknowledgements and producer errors from the
-// respective `sarama.AsyncProducer` channels, constructs `ProducerResult`s out
-// of them and sends the constructed `ProducerResult` instances to `resultCh`
-// to be further inspected by the `dispatcher` goroutine.
+// respective channels of all `sarama.AsyncProducer`s, constructs
+// `ProducerResult`s out of them and sends the constructed `ProducerResult`
+// instances to `resultCh` to be further inspected by the `dispatcher`
+// goroutine.
 //
-// It keeps running until both `sarama.AsyncProducer` output channels are
+// It keeps running until output channels of all `sarama.AsyncProducer`s are
 // closed. Then it closes the `resultCh` to notify the `dispatcher` goroutine
 // that all pending messages have been processed and exits.
 func (p *T) runMerger() {
-	nilOrProdSuccessesCh := p.saramaProducer.Successes()
-	nilOrProdErrorsCh := p.saramaProducer.Errors()
+	var wg sync.WaitGroup
+	for i, saramaProducer := range p.saramaProducers {
+		saramaProducer := saramaProducer
+		actor.Spawn(p.mergerActorID.NewChild(i), &wg, func() {
+			p.mergeResults(saramaProducer)
+		})
+	}
+	wg.Wait()
+	// Close the result channel to notify the `dispatcher` goroutine that all
+	// pending messages have been processed.
+	close(p.resultCh)
+}
+
+// mergeResults forwards results of a `sarama.AsyncProducer` to `resultCh`
+// until both its output channels are closed.
+func (p *T) mergeResults(saramaProducer sarama.AsyncProducer) {
+	nilOrProdSuccessesCh := saramaProducer.Successes()
+	nilOrProdErrorsCh := saramaProducer.Errors()
 mergeLoop:
 	for channelsOpened := 2; channelsOpened > 0; {
 		select {
@@ -141,9 +308,6 @@ mergeLoop:
 			p.resultCh <- produceResult{Msg: prodErr.Msg, Err: prodErr.Err}
 		}
 	}
-	// Close the result channel to notify the `dispatcher` goroutine that all
-	// pending messages have been processed.
-	close(p.resultCh)
 }
 
 // dispatch implements message processing and graceful shutdown. It receives
@@ -152,72 +316,384 @@ mergeLoop:
 // purpose is to prevent loss of messages during shutdown. It achieves that by
 // allowing some graceful period after it stops receiving messages and stopping
 // the embedded `sarama.AsyncProducer`.
+//
+// If `Producer.RetryExhaustedPolicy` is `block` then messages that failed to
+// be submitted are put to a retry queue and resubmitted after
+// `Producer.RetryBackoff`. Messages waiting in the retry queue are considered
+// pending, so they are given a chance to be submitted during shutdown too.
 func (p *T) runDispatcher() {
-	nilOrDispatcherCh := p.dispatcherCh
-	var nilOrProdInputCh chan<- *sarama.ProducerMessage
-	pendingMsgCount := 0
+	var (
+		nilOrDispatcherCh  = p.dispatcherCh
+		nilOrProdInputCh   chan<- *sarama.ProducerMessage
+		nilOrRetryInputCh  chan<- *sarama.ProducerMessage
+		nilOrRetryTimerCh  <-chan time.Time
+		nilOrShutdownCh    <-chan time.Time
+		pendingMsgCount    = 0
+		prodMsg            *sarama.ProducerMessage
+		retryQueue         []retry
+		channelOpened      = true
+		shuttingDown       = false
+		shutdownTimeoutHit = false
+	)
+	// scheduleRetry makes the retry queue head to be resubmitted when it is
+	// due, or does nothing if the queue is empty.
+	scheduleRetry := func() {
+		nilOrRetryInputCh, nilOrRetryTimerCh = nil, nil
+		if len(retryQueue) == 0 {
+			return
+		}
+		if delay := retryQueue[0].dueAt.Sub(time.Now()); delay > 0 {
+			nilOrRetryTimerCh = time.After(delay)
+			return
+		}
+		nilOrRetryInputCh = p.saramaInput(retryQueue[0].msg.Topic)
+	}
 	// The normal operation loop is implemented as two-stroke machine. On the
 	// first stroke a message is received from `dispatchCh`, and on the second
-	// it is sent to `prodInputCh`. Note that producer results can be received
-	// at any time.
-	prodMsg := (*sarama.ProducerMessage)(nil)
-	channelOpened := true
-	for {
+	// it is sent to `prodInputCh`. Note that producer results and retries can
+	// be handled at any time.
+	for !shuttingDown || pendingMsgCount > 0 {
+		var retryMsg *sarama.ProducerMessage
+		if nilOrRetryInputCh != nil {
+			retryMsg = retryQueue[0].msg
+		}
 		select {
 		case prodMsg, channelOpened = <-nilOrDispatcherCh:
 			if !channelOpened {
-				goto gracefulShutdown
+				// Give the `sarama.AsyncProducer` some time to commit
+				// buffered messages.
+				log.Infof("<%v> About to stop producer: pendingMsgCount=%d", p.dispatcherActorID, pendingMsgCount)
+				shuttingDown = true
+				nilOrDispatcherCh = nil
+				nilOrShutdownCh = time.After(p.shutdownTimeout)
+				continue
 			}
 			pendingMsgCount += 1
 			nilOrDispatcherCh = nil
-			nilOrProdInputCh = p.saramaProducer.Input()
+			nilOrProdInputCh = p.saramaInput(prodMsg.Topic)
 		case nilOrProdInputCh <- prodMsg:
+			prodMsg.Metadata.(*msgMeta).sentAt = time.Now()
 			nilOrDispatcherCh = p.dispatcherCh
 			nilOrProdInputCh = nil
+		case nilOrRetryInputCh <- retryMsg:
+			retryMsg.Metadata.(*msgMeta).sentAt = time.Now()
+			retryQueue = retryQueue[1:]
+			scheduleRetry()
+		case <-nilOrRetryTimerCh:
+			scheduleRetry()
 		case prodResult := <-p.resultCh:
+			if prodResult.Err != nil && p.exhaustedPolicy == config.RetryExhaustedBlock {
+				log.Errorf("<%v> Failed to submit message, retrying: msg=%v, err=(%s)",
+					p.dispatcherActorID, p.msgRepr(prodResult.Msg), prodResult.Err)
+				metrics.Counter("producer_retry", "cluster", p.cluster, "topic", prodResult.Msg.Topic).Inc(1)
+				retryQueue = append(retryQueue, retry{
+					msg:   cloneForRetry(prodResult.Msg),
+					dueAt: time.Now().Add(p.retryBackoff),
+				})
+				if len(retryQueue) == 1 {
+					scheduleRetry()
+				}
+				continue
+			}
 			pendingMsgCount -= 1
 			p.handleProduceResult(prodResult)
+		case <-nilOrShutdownCh:
+			shutdownTimeoutHit = true
+			goto shutdownNow
 		}
 	}
-gracefulShutdown:
-	// Give the `sarama.AsyncProducer` some time to commit buffered messages.
-	log.Infof("<%v> About to stop producer: pendingMsgCount=%d", p.dispatcherActorID, pendingMsgCount)
-	shutdownTimeoutCh := time.After(p.shutdownTimeout)
-	for pendingMsgCount > 0 {
+shutdownNow:
+	log.Infof("<%v> Stopping producer: pendingMsgCount=%d", p.dispatcherActorID, pendingMsgCount)
+	// Messages that are still in the retry queue have never made it to Kafka.
+	for _, r := range retryQueue {
+		pendingMsgCount -= 1
+		p.handleProduceResult(produceResult{Msg: r.msg, Err: errRetryAborted})
+	}
+	// Let `sarama.AsyncProducer` flush messages that it has buffered, but
+	// give up if that takes longer than `Producer.ShutdownFlushTimeout`.
+	for _, saramaProducer := range p.saramaProducers {
+		saramaProducer.AsyncClose()
+	}
+	flushTimeoutCh := time.After(p.shutdownFlushTimeout)
+	for {
 		select {
-		case <-shutdownTimeoutCh:
-			goto shutdownNow
-		case prodResult := <-p.resultCh:
+		case prodResult, ok := <-p.resultCh:
+			if !ok {
+				p.closeSaramaClients()
+				if shutdownTimeoutHit || p.droppedCount > 0 {
+					log.Warningf("<%v> Producer stopped: droppedCount=%d", p.dispatcherActorID, p.droppedCount)
+				}
+				return
+			}
 			pendingMsgCount -= 1
 			p.handleProduceResult(prodResult)
+		case <-flushTimeoutCh:
+			// Whatever is still buffered by `sarama.AsyncProducer` is
+			// considered lost, even though some of it may still make it to
+			// Kafka eventually.
+			p.droppedCount += pendingMsgCount
+			metrics.Counter("producer_dropped", "cluster", p.cluster).Inc(int64(pendingMsgCount))
+			log.Errorf("<%v> Producer stopped, flush timeout: droppedCount=%d, abandonedCount=%d",
+				p.dispatcherActorID, p.droppedCount, pendingMsgCount)
+			go p.drainAbandoned()
+			return
 		}
 	}
-shutdownNow:
-	log.Infof("<%v> Stopping producer: pendingMsgCount=%d", p.dispatcherActorID, pendingMsgCount)
-	p.saramaProducer.AsyncClose()
+}
+
+// drainAbandoned keeps reading results of messages abandoned on shutdown
+// until `sarama.AsyncProducer` is fully stopped, and then closes the Kafka
+// client. Results are neither logged nor written to the dead letter file,
+// since the messages have already been reported as dropped.
+func (p *T) drainAbandoned() {
 	for prodResult := range p.resultCh {
-		p.handleProduceResult(prodResult)
+		meta := prodResult.Msg.Metadata.(*msgMeta)
+		if meta.replyCh != nil {
+			meta.replyCh <- prodResult
+		}
+		if meta.notify != nil {
+			meta.notify(prodResult.Msg, prodResult.Err)
+		}
+	}
+	p.closeSaramaClients()
+}
+
+// saramaInput returns the input channel of the `sarama.AsyncProducer` that
+// messages of the specified topic should be submitted to.
+func (p *T) saramaInput(topic string) chan<- *sarama.ProducerMessage {
+	if saramaProducer, ok := p.topicProducers[topic]; ok {
+		return saramaProducer.Input()
+	}
+	return p.saramaProducers[0].Input()
+}
+
+func (p *T) closeSaramaClients() {
+	for _, saramaClient := range p.saramaClients {
+		saramaClient.Close()
 	}
 }
 
 // handleProduceResult inspects a production results and if it is an error
-// then logs it.
+// then handles it in accordance with the configured retry exhausted policy.
 func (p *T) handleProduceResult(result produceResult) {
-	if replyCh, ok := result.Msg.Metadata.(chan produceResult); ok {
-		replyCh <- result
+	meta := result.Msg.Metadata.(*msgMeta)
+	if meta.replyCh != nil {
+		meta.replyCh <- result
+	}
+	if meta.notify != nil {
+		meta.notify(result.Msg, result.Err)
 	}
+	topic := result.Msg.Topic
 	if result.Err == nil {
+		metrics.Counter("producer_success", "cluster", p.cluster, "topic", topic).Inc(1)
+		latency := time.Now().Sub(meta.sentAt)
+		metrics.Histogram("producer_ack_latency_ms", "cluster", p.cluster, "topic", topic).Update(int64(latency / time.Millisecond))
+		return
+	}
+	metrics.Counter("producer_failure", "cluster", p.cluster, "topic", topic).Inc(1)
+	if meta.replayed {
 		return
 	}
-	prodMsgRepr := fmt.Sprintf(`{Topic: "%s", Key: "%s", Value: "%s"}`,
-		result.Msg.Topic, encoderRepr(result.Msg.Key), encoderRepr(result.Msg.Value))
+	// Synchronous producers and those that asked to be notified are told
+	// about the failure, so they can decide for themselves whether to retry.
+	// Spooling their messages would result in duplicates if they do.
+	if p.exhaustedPolicy == config.RetryExhaustedSpool && meta.replyCh == nil && meta.notify == nil {
+		err := p.writeSpool(result)
+		if err == nil {
+			metrics.Counter("producer_spooled", "cluster", p.cluster, "topic", topic).Inc(1)
+			p.updateSpoolMetrics()
+			log.Warningf("<%v> Failed to submit message, spooled: msg=%v, err=(%s)",
+				p.dispatcherActorID, p.msgRepr(result.Msg), result.Err)
+			return
+		}
+		log.Errorf("<%v> Failed to spool message: err=(%s)", p.dispatcherActorID, err)
+	}
+	if p.exhaustedPolicy == config.RetryExhaustedDeadLetterFile {
+		err := p.writeDeadLetter(result)
+		if err == nil {
+			log.Errorf("<%v> Failed to submit message, written to dead letter file: msg=%v, err=(%s)",
+				p.dispatcherActorID, p.msgRepr(result.Msg), result.Err)
+			return
+		}
+		log.Errorf("<%v> Failed to write dead letter: err=(%s)", p.dispatcherActorID, err)
+	}
+	p.droppedCount += 1
+	metrics.Counter("producer_dropped", "cluster", p.cluster).Inc(1)
 	log.Errorf("<%v> Failed to submit message: msg=%v, err=(%s)",
-		p.dispatcherActorID, prodMsgRepr, result.Err)
+		p.dispatcherActorID, p.msgRepr(result.Msg), result.Err)
 	if p.testDroppedMsgCh != nil {
 		p.testDroppedMsgCh <- result.Msg
 	}
 }
 
+// writeDeadLetter appends a message that failed to be submitted to Kafka to
+// the dead letter file as a JSON object on a separate line.
+func (p *T) writeDeadLetter(result produceResult) error {
+	dl := deadLetter{
+		Timestamp: time.Now().UTC(),
+		Topic:     result.Msg.Topic,
+		Error:     result.Err.Error(),
+	}
+	var err error
+	if dl.Key, dl.Value, err = encodeMsg(result.Msg); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(dl)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal")
+	}
+	_, err = p.deadLetterFile.Write(append(encoded, '\n'))
+	return err
+}
+
+// writeSpool appends a message that failed to be submitted to Kafka to the
+// spool, to be replayed by the replayer goroutine.
+func (p *T) writeSpool(result produceResult) error {
+	entry := spoolEntry{Topic: result.Msg.Topic}
+	var err error
+	if entry.Key, entry.Value, err = encodeMsg(result.Msg); err != nil {
+		return err
+	}
+	return p.spool.append(entry)
+}
+
+// runReplayer resubmits spooled messages to Kafka one at a time, in the order
+// they were spooled. If a message fails to be submitted, then it is retried
+// after `Producer.RetryBackoff`, unless the failure is permanent, e.g. the
+// topic does not exist, in which case the message is dropped.
+func (p *T) runReplayer() {
+	for {
+		entry, nextPos, ok, err := p.spool.next()
+		if err != nil {
+			log.Errorf("<%v> Skipping bad spool entry: err=(%s)", p.replayerActorID, err)
+			if err = p.spool.skip(); err != nil {
+				log.Errorf("<%v> Failed to skip spool entry: err=(%s)", p.replayerActorID, err)
+				if !p.replayerSleep(p.retryBackoff) {
+					return
+				}
+			}
+			continue
+		}
+		if !ok {
+			select {
+			case <-p.spool.appendedCh:
+				continue
+			case <-p.replayerStopCh:
+				return
+			}
+		}
+
+		replyCh := make(chan produceResult, 1)
+		prodMsg := &sarama.ProducerMessage{
+			Topic:    entry.Topic,
+			Value:    sarama.ByteEncoder(entry.Value),
+			Metadata: &msgMeta{replyCh: replyCh, replayed: true},
+		}
+		if entry.Key != nil {
+			prodMsg.Key = sarama.ByteEncoder(entry.Key)
+		}
+		// If the producer is stopped while a message is being replayed, then
+		// it is not committed and will be replayed again after restart, even
+		// if it makes it to Kafka during shutdown.
+		var result produceResult
+		select {
+		case p.dispatcherCh <- prodMsg:
+		case <-p.replayerStopCh:
+			return
+		}
+		select {
+		case result = <-replyCh:
+		case <-p.replayerStopCh:
+			return
+		}
+
+		switch result.Err {
+		case nil:
+			metrics.Counter("producer_spool_replayed", "cluster", p.cluster, "topic", entry.Topic).Inc(1)
+		case sarama.ErrUnknownTopicOrPartition, sarama.ErrMessageSizeTooLarge:
+			metrics.Counter("producer_dropped", "cluster", p.cluster).Inc(1)
+			log.Errorf("<%v> Failed to replay spooled message, dropped: msg=%v, err=(%s)",
+				p.replayerActorID, p.msgRepr(prodMsg), result.Err)
+		default:
+			log.Warningf("<%v> Failed to replay spooled message, retrying: msg=%v, err=(%s)",
+				p.replayerActorID, p.msgRepr(prodMsg), result.Err)
+			if !p.replayerSleep(p.retryBackoff) {
+				return
+			}
+			continue
+		}
+		if err := p.spool.commit(nextPos); err != nil {
+			log.Errorf("<%v> Failed to commit spool position: err=(%s)", p.replayerActorID, err)
+		}
+		p.updateSpoolMetrics()
+	}
+}
+
+// replayerSleep waits for the specified duration. It returns false if the
+// producer was stopped in the meantime.
+func (p *T) replayerSleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-p.replayerStopCh:
+		return false
+	}
+}
+
+func (p *T) updateSpoolMetrics() {
+	size, pending := p.spool.sizes()
+	metrics.Gauge("producer_spool_size_bytes", "cluster", p.cluster).Update(size)
+	metrics.Gauge("producer_spool_pending_bytes", "cluster", p.cluster).Update(pending)
+}
+
+// encodeMsg returns encoded key and value of a message. A nil key or value
+// is returned as nil.
+func encodeMsg(msg *sarama.ProducerMessage) ([]byte, []byte, error) {
+	var key, value []byte
+	var err error
+	if msg.Key != nil {
+		if key, err = msg.Key.Encode(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to encode key")
+		}
+	}
+	if msg.Value != nil {
+		if value, err = msg.Value.Encode(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to encode value")
+		}
+	}
+	return key, value, nil
+}
+
+// cloneForRetry creates a copy of a failed message that can be submitted to
+// `sarama.AsyncProducer` again. The original message instance cannot be
+// reused because sarama tracks the number of retries internally.
+func cloneForRetry(msg *sarama.ProducerMessage) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic:    msg.Topic,
+		Key:      msg.Key,
+		Value:    msg.Value,
+		Metadata: msg.Metadata,
+	}
+}
+
+// msgRepr returns a string representation of a message to be used in logs.
+// The message value is redacted as configured by `Proxy.Redaction`.
+func (p *T) msgRepr(msg *sarama.ProducerMessage) string {
+	value := msg.Value
+	if p.redactor != nil && value != nil {
+		if encoded, err := value.Encode(); err == nil {
+			switch value.(type) {
+			case sarama.StringEncoder:
+				value = sarama.StringEncoder(p.redactor.Value(encoded))
+			default:
+				value = sarama.ByteEncoder(p.redactor.Value(encoded))
+			}
+		}
+	}
+	return fmt.Sprintf(`{Topic: "%s", Key: "%s", Value: "%s"}`,
+		msg.Topic, encoderRepr(msg.Key), encoderRepr(value))
+}
+
 // encoderRepr returns the string representation of an encoder value. The value
 // is truncated to `maxEncoderReprLength`.
 func encoderRepr(e sarama.Encoder) string {
@@ -1,8 +1,13 @@
 package producer
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
@@ -68,6 +73,31 @@ func (s *ProducerSuite) TestProduce(c *C) {
 	p.Stop()
 }
 
+// Messages of topics with compression overridden are produced by separate
+// sarama producers, but results of all of them are reported.
+func (s *ProducerSuite) TestProduceTopicCompression(c *C) {
+	gzip := config.Compression(sarama.CompressionGZIP)
+	s.cfg.Producer.Topics = map[string]config.ProducerParams{"test.1": {Compression: &gzip}}
+	p, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(p.saramaProducers, HasLen, 2)
+	offsetsBefore1 := s.kh.GetNewestOffsets("test.1")
+	offsetsBefore4 := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	_, err1 := p.Produce("test.1", sarama.StringEncoder("1"), sarama.StringEncoder("Foo"))
+	_, err4 := p.Produce("test.4", sarama.StringEncoder("1"), sarama.StringEncoder("Bar"))
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(err4, IsNil)
+	c.Assert(s.kh.GetNewestOffsets("test.1")[0], Equals, offsetsBefore1[0]+1)
+	c.Assert(s.kh.GetNewestOffsets("test.4")[0], Equals, offsetsBefore4[0]+1)
+
+	// Cleanup
+	p.Stop()
+}
+
 func (s *ProducerSuite) TestProduceInvalidTopic(c *C) {
 	p, _ := Spawn(s.ns, s.cfg)
 
@@ -179,6 +209,72 @@ func (s *ProducerSuite) TestAsyncProduceEmptyKey(c *C) {
 	c.Assert(offsetsAfter[3], Equals, offsetsBefore[3]+10)
 }
 
+// If retry exhausted policy is `dead_letter_file` then messages that failed
+// to be submitted are appended to the dead letter file.
+func (s *ProducerSuite) TestDeadLetterFile(c *C) {
+	deadLetterFile, err := ioutil.TempFile("", "kafka-pixy-dead-letters")
+	c.Assert(err, IsNil)
+	defer os.Remove(deadLetterFile.Name())
+	deadLetterFile.Close()
+	s.cfg.Producer.RetryExhaustedPolicy = config.RetryExhaustedDeadLetterFile
+	s.cfg.Producer.DeadLetterFile = deadLetterFile.Name()
+	p, _ := Spawn(s.ns, s.cfg)
+	p.testDroppedMsgCh = s.droppedMsgCh
+
+	// When
+	_, err = p.Produce("no-such-topic", sarama.StringEncoder("1"), sarama.StringEncoder("Foo"))
+	p.Stop()
+
+	// Then
+	c.Assert(err, Equals, sarama.ErrUnknownTopicOrPartition)
+	c.Assert(s.failedMessages(), DeepEquals, []string{})
+	data, err := ioutil.ReadFile(deadLetterFile.Name())
+	c.Assert(err, IsNil)
+	var dl deadLetter
+	c.Assert(json.Unmarshal(data, &dl), IsNil)
+	c.Assert(dl.Topic, Equals, "no-such-topic")
+	c.Assert(string(dl.Key), Equals, "1")
+	c.Assert(string(dl.Value), Equals, "Foo")
+	c.Assert(dl.Error, Equals, sarama.ErrUnknownTopicOrPartition.Error())
+}
+
+// If retry exhausted policy is `spool` then messages found in the spool on
+// start are replayed in order.
+func (s *ProducerSuite) TestSpoolReplay(c *C) {
+	spoolDir, err := ioutil.TempDir("", "kafka-pixy-spool")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(spoolDir)
+	s.cfg.Producer.RetryExhaustedPolicy = config.RetryExhaustedSpool
+	s.cfg.Producer.SpoolDir = spoolDir
+	sp, err := openSpool(filepath.Join(spoolDir, s.cfg.Cluster), s.cfg.Producer.SpoolMaxSize)
+	c.Assert(err, IsNil)
+	c.Assert(sp.append(spoolEntry{Topic: "test.4", Key: []byte("1"), Value: []byte("Foo")}), IsNil)
+	c.Assert(sp.append(spoolEntry{Topic: "test.4", Key: []byte("1"), Value: []byte("Bar")}), IsNil)
+	sp.close()
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	p, err := Spawn(s.ns, s.cfg)
+	c.Assert(err, IsNil)
+	for i := 0; i < 100 && p.spoolPending() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	p.Stop()
+
+	// Then
+	c.Assert(p.spoolPending(), Equals, int64(0))
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+2)
+	c.Assert(s.kh.GetMessages("test.4", offsetsBefore, offsetsAfter)[0], DeepEquals, []string{"Foo", "Bar"})
+}
+
+// spoolPending returns the number of bytes in the spool that have not been
+// replayed yet.
+func (p *T) spoolPending() int64 {
+	_, pending := p.spool.sizes()
+	return pending
+}
+
 func (s *ProducerSuite) failedMessages() []string {
 	b := []string{}
 	for {
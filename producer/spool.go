@@ -0,0 +1,225 @@
+package producer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	spoolLogFile = "spool.log"
+	spoolPosFile = "spool.pos"
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// spool is a write-ahead log of messages that could not be submitted to
+// Kafka. Messages are appended to a log file as JSON objects on separate
+// lines, and the position of the first message that has not been replayed
+// yet is kept in a separate file, so that replay resumes where it stopped
+// after a restart. When all messages are replayed the log is truncated.
+//
+// It is safe to append to a spool and replay it concurrently.
+type spool struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	logFile *os.File
+	size    int64
+	pos     int64
+
+	// A notification is sent to it every time a message is appended.
+	appendedCh chan struct{}
+}
+
+// spoolEntry is a JSON representation of a spooled message.
+type spoolEntry struct {
+	Topic string `json:"topic"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// openSpool opens a spool in the specified directory, creating it if it does
+// not exist yet.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create spool directory")
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, spoolLogFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open spool log")
+	}
+	fileInfo, err := logFile.Stat()
+	if err != nil {
+		logFile.Close()
+		return nil, errors.Wrap(err, "failed to stat spool log")
+	}
+	s := &spool{
+		dir:        dir,
+		maxSize:    maxSize,
+		logFile:    logFile,
+		size:       fileInfo.Size(),
+		appendedCh: make(chan struct{}, 1),
+	}
+	if err := s.terminateLastEntry(); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	if s.pos, err = s.readPos(); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	// The log may have been truncated after the position was last saved.
+	if s.pos > s.size {
+		s.pos = 0
+	}
+	return s, nil
+}
+
+// append writes a message to the end of the spool. It returns errSpoolFull
+// if the spool would exceed its maximum size.
+func (s *spool) append(entry spoolEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal")
+	}
+	encoded = append(encoded, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+int64(len(encoded)) > s.maxSize {
+		return errSpoolFull
+	}
+	n, err := s.logFile.Write(encoded)
+	s.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to write spool log")
+	}
+	select {
+	case s.appendedCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the first message that has not been replayed yet, along with
+// the position of the message that follows it, to be passed to `commit`
+// after the message is replayed. If the spool is empty, then false is
+// returned.
+func (s *spool) next() (spoolEntry, int64, bool, error) {
+	s.mu.Lock()
+	pos, size := s.pos, s.size
+	s.mu.Unlock()
+	if pos >= size {
+		return spoolEntry{}, 0, false, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(s.logFile, pos, size-pos))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return spoolEntry{}, 0, false, errors.Wrapf(err, "failed to read spool log, pos=%d", pos)
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return spoolEntry{}, 0, false, errors.Wrapf(err, "bad spool entry, pos=%d", pos)
+	}
+	return entry, pos + int64(len(line)), true, nil
+}
+
+// commit marks messages before `pos` as replayed. If all messages have been
+// replayed, then the log is truncated.
+func (s *spool) commit(pos int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pos = pos
+	if s.pos >= s.size {
+		if err := s.logFile.Truncate(0); err != nil {
+			return errors.Wrap(err, "failed to truncate spool log")
+		}
+		s.pos, s.size = 0, 0
+	}
+	return s.writePos()
+}
+
+// skip marks the message at the current position as replayed. It is used to
+// get past an entry that cannot be parsed.
+func (s *spool) skip() error {
+	s.mu.Lock()
+	pos, size := s.pos, s.size
+	s.mu.Unlock()
+	reader := bufio.NewReader(io.NewSectionReader(s.logFile, pos, size-pos))
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to read spool log, pos=%d", pos)
+	}
+	return s.commit(pos + int64(len(line)))
+}
+
+// sizes returns the size of the spool log, and the number of bytes in it
+// that have not been replayed yet.
+func (s *spool) sizes() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, s.size - s.pos
+}
+
+func (s *spool) close() error {
+	return s.logFile.Close()
+}
+
+// terminateLastEntry appends a line break to the log if the last entry was
+// only partially written, e.g. due to a crash. Otherwise the next appended
+// entry would be glued to it and become unparsable too.
+func (s *spool) terminateLastEntry() error {
+	if s.size == 0 {
+		return nil
+	}
+	lastByte := make([]byte, 1)
+	if _, err := s.logFile.ReadAt(lastByte, s.size-1); err != nil {
+		return errors.Wrap(err, "failed to read spool log")
+	}
+	if lastByte[0] == '\n' {
+		return nil
+	}
+	n, err := s.logFile.Write([]byte{'\n'})
+	s.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to write spool log")
+	}
+	return nil
+}
+
+func (s *spool) readPos() (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolPosFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "failed to read spool position")
+	}
+	pos, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "bad spool position")
+	}
+	return pos, nil
+}
+
+// writePos saves the replay position. The file is replaced atomically, so
+// that a crash never leaves it half written.
+func (s *spool) writePos() error {
+	tmpPath := filepath.Join(s.dir, spoolPosFile+".tmp")
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatInt(s.pos, 10)), 0644); err != nil {
+		return errors.Wrap(err, "failed to write spool position")
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, spoolPosFile)); err != nil {
+		return errors.Wrap(err, "failed to write spool position")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package producer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type SpoolSuite struct {
+	dir string
+}
+
+var _ = Suite(&SpoolSuite{})
+
+func (s *SpoolSuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "spool")
+	c.Assert(err, IsNil)
+}
+
+func (s *SpoolSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+// Messages are returned in the order they were appended, and the log is
+// truncated when all of them are committed.
+func (s *SpoolSuite) TestAppendNextCommit(c *C) {
+	sp, err := openSpool(s.dir, 1024)
+	c.Assert(err, IsNil)
+	defer sp.close()
+	c.Assert(sp.append(spoolEntry{Topic: "foo", Key: []byte("k1"), Value: []byte("v1")}), IsNil)
+	c.Assert(sp.append(spoolEntry{Topic: "bar", Value: []byte("v2")}), IsNil)
+
+	// When
+	entry1, pos1, ok1, err1 := sp.next()
+	c.Assert(sp.commit(pos1), IsNil)
+	entry2, pos2, ok2, err2 := sp.next()
+	c.Assert(sp.commit(pos2), IsNil)
+	_, _, ok3, err3 := sp.next()
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(ok1, Equals, true)
+	c.Assert(entry1, DeepEquals, spoolEntry{Topic: "foo", Key: []byte("k1"), Value: []byte("v1")})
+	c.Assert(err2, IsNil)
+	c.Assert(ok2, Equals, true)
+	c.Assert(entry2, DeepEquals, spoolEntry{Topic: "bar", Value: []byte("v2")})
+	c.Assert(err3, IsNil)
+	c.Assert(ok3, Equals, false)
+	size, pending := sp.sizes()
+	c.Assert(size, Equals, int64(0))
+	c.Assert(pending, Equals, int64(0))
+}
+
+// Replay resumes from the committed position after a spool is reopened.
+func (s *SpoolSuite) TestReopen(c *C) {
+	sp, err := openSpool(s.dir, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(sp.append(spoolEntry{Topic: "foo", Value: []byte("v1")}), IsNil)
+	c.Assert(sp.append(spoolEntry{Topic: "foo", Value: []byte("v2")}), IsNil)
+	_, pos, _, _ := sp.next()
+	c.Assert(sp.commit(pos), IsNil)
+	sp.close()
+
+	// When
+	sp, err = openSpool(s.dir, 1024)
+	c.Assert(err, IsNil)
+	defer sp.close()
+	entry, _, ok, err := sp.next()
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(entry.Value), Equals, "v2")
+}
+
+// Messages that would make a spool exceed its maximum size are rejected.
+func (s *SpoolSuite) TestFull(c *C) {
+	sp, err := openSpool(s.dir, 100)
+	c.Assert(err, IsNil)
+	defer sp.close()
+	c.Assert(sp.append(spoolEntry{Topic: "foo", Value: make([]byte, 30)}), IsNil)
+
+	// When
+	err = sp.append(spoolEntry{Topic: "foo", Value: make([]byte, 30)})
+
+	// Then
+	c.Assert(err, Equals, errSpoolFull)
+	_, pending := sp.sizes()
+	c.Assert(pending < 100, Equals, true)
+}
+
+// A partially written entry is skipped, and does not corrupt entries that
+// are appended after it.
+func (s *SpoolSuite) TestPartialEntry(c *C) {
+	logPath := filepath.Join(s.dir, spoolLogFile)
+	c.Assert(ioutil.WriteFile(logPath, []byte(`{"topic":"foo","val`), 0644), IsNil)
+	sp, err := openSpool(s.dir, 1024)
+	c.Assert(err, IsNil)
+	defer sp.close()
+	c.Assert(sp.append(spoolEntry{Topic: "bar", Value: []byte("v1")}), IsNil)
+
+	// When
+	_, _, _, err1 := sp.next()
+	c.Assert(sp.skip(), IsNil)
+	entry, _, ok, err2 := sp.next()
+
+	// Then
+	c.Assert(err1, NotNil)
+	c.Assert(err2, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(entry, DeepEquals, spoolEntry{Topic: "bar", Value: []byte("v1")})
+}
@@ -0,0 +1,548 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Codec converts messages of a particular protocol buffers type between JSON
+// and binary format. JSON is mapped to messages as defined by the proto3
+// JSON mapping, except that well-known types, e.g. `google.protobuf.Timestamp`,
+// are treated as regular messages.
+type Codec struct {
+	msg *message
+}
+
+// NewCodec creates a codec for the specified message type defined in a
+// serialized `google.protobuf.FileDescriptorSet`, as produced by
+// `protoc --include_imports --descriptor_set_out`.
+func NewCodec(descriptorSet []byte, messageType string) (*Codec, error) {
+	reg, err := parseDescriptorSet(descriptorSet)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid descriptor set")
+	}
+	msg := reg.messages[strings.TrimPrefix(messageType, ".")]
+	if msg == nil {
+		return nil, errors.Errorf("unknown message type %s", messageType)
+	}
+	return &Codec{msg: msg}, nil
+}
+
+// LoadCodec is like NewCodec, but reads the descriptor set from a file.
+func LoadCodec(descriptorSetFile, messageType string) (*Codec, error) {
+	descriptorSet, err := ioutil.ReadFile(descriptorSetFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read descriptor set")
+	}
+	return NewCodec(descriptorSet, messageType)
+}
+
+// EncodeJSON converts a JSON document to a message in binary format. Fields
+// can be referred to either by their JSON names or by their original names.
+func (c *Codec) EncodeJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid JSON: trailing data")
+	}
+	return encodeMessage(nil, c.msg, v)
+}
+
+// DecodeJSON converts a message in binary format to a JSON document. Fields
+// are named by their JSON names and go in the order they are defined in.
+// Unknown fields are dropped.
+func (c *Codec) DecodeJSON(data []byte) ([]byte, error) {
+	obj, err := decodeMessage(c.msg, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+func encodeMessage(b []byte, msg *message, v interface{}) ([]byte, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("message %s expected, got %v", msg.name, v)
+	}
+	for key := range obj {
+		if msg.byName[key] == nil {
+			return nil, errors.Errorf("unknown field %s.%s", msg.name, key)
+		}
+	}
+	var err error
+	for _, f := range msg.fields {
+		fv, ok := obj[f.jsonName]
+		if !ok {
+			fv = obj[f.name]
+		}
+		if fv == nil {
+			continue
+		}
+		if b, err = encodeField(b, f, fv); err != nil {
+			return nil, errors.Wrapf(err, "field %s.%s", msg.name, f.name)
+		}
+	}
+	return b, nil
+}
+
+func encodeField(b []byte, f *field, v interface{}) ([]byte, error) {
+	if f.message != nil && f.message.mapEntry {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("object expected, got %v", v)
+		}
+		keyField, valueField := f.message.byNumber[1], f.message.byNumber[2]
+		if keyField == nil || valueField == nil {
+			return nil, errors.Errorf("invalid map entry %s", f.message.name)
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry, err := encodeSingle(nil, keyField, mapKeyValue(keyField, key))
+			if err != nil {
+				return nil, errors.Wrapf(err, "key %s", key)
+			}
+			if entry, err = encodeSingle(entry, valueField, obj[key]); err != nil {
+				return nil, errors.Wrapf(err, "key %s", key)
+			}
+			b = appendTag(b, f.number, wireBytes)
+			b = appendBytes(b, entry)
+		}
+		return b, nil
+	}
+	if !f.repeated {
+		return encodeSingle(b, f, v)
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("array expected, got %v", v)
+	}
+	if f.packed {
+		if len(items) == 0 {
+			return b, nil
+		}
+		var payload []byte
+		var err error
+		for i, item := range items {
+			if payload, err = appendValue(payload, f, item); err != nil {
+				return nil, errors.Wrapf(err, "item #%d", i)
+			}
+		}
+		b = appendTag(b, f.number, wireBytes)
+		return appendBytes(b, payload), nil
+	}
+	var err error
+	for i, item := range items {
+		if b, err = encodeSingle(b, f, item); err != nil {
+			return nil, errors.Wrapf(err, "item #%d", i)
+		}
+	}
+	return b, nil
+}
+
+// mapKeyValue converts a JSON object key to a value of a map key field.
+// Integer keys are left as strings, for integers can be given as strings.
+func mapKeyValue(keyField *field, key string) interface{} {
+	if keyField.typ == typeBool {
+		if x, err := strconv.ParseBool(key); err == nil {
+			return x
+		}
+	}
+	return key
+}
+
+func encodeSingle(b []byte, f *field, v interface{}) ([]byte, error) {
+	b = appendTag(b, f.number, wireTypeOf(f.typ))
+	return appendValue(b, f, v)
+}
+
+// appendValue appends a value of a field without a tag.
+func appendValue(b []byte, f *field, v interface{}) ([]byte, error) {
+	switch f.typ {
+	case typeInt32, typeInt64, typeUint32, typeUint64, typeSint32, typeSint64,
+		typeFixed32, typeFixed64, typeSfixed32, typeSfixed64:
+		return appendInteger(b, f.typ, v)
+
+	case typeFloat, typeDouble:
+		x, err := parseFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if f.typ == typeFloat {
+			return appendFixed32(b, math.Float32bits(float32(x))), nil
+		}
+		return appendFixed64(b, math.Float64bits(x)), nil
+
+	case typeBool:
+		x, ok := v.(bool)
+		if !ok {
+			return nil, errors.Errorf("bool expected, got %v", v)
+		}
+		if x {
+			return appendVarint(b, 1), nil
+		}
+		return appendVarint(b, 0), nil
+
+	case typeString:
+		x, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("string expected, got %v", v)
+		}
+		return appendBytes(b, []byte(x)), nil
+
+	case typeBytes:
+		x, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("base64 string expected, got %v", v)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(x)
+		if err != nil {
+			if decoded, err = base64.URLEncoding.DecodeString(x); err != nil {
+				return nil, errors.Errorf("base64 string expected, got %v", v)
+			}
+		}
+		return appendBytes(b, decoded), nil
+
+	case typeEnum:
+		if name, ok := v.(string); ok {
+			number, ok := f.enum.byName[name]
+			if !ok {
+				return nil, errors.Errorf("unknown value of enum %s, %s", f.enum.name, name)
+			}
+			return appendVarint(b, uint64(int64(number))), nil
+		}
+		return appendInteger(b, typeInt32, v)
+
+	case typeMessage:
+		payload, err := encodeMessage(nil, f.message, v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, payload), nil
+	}
+	return nil, errors.Errorf("unsupported field type %d", f.typ)
+}
+
+// appendInteger appends a value of an integer field. Integers can be given
+// either as JSON numbers or as strings.
+func appendInteger(b []byte, typ int32, v interface{}) ([]byte, error) {
+	var str string
+	switch x := v.(type) {
+	case json.Number:
+		str = string(x)
+	case string:
+		str = x
+	default:
+		return nil, errors.Errorf("integer expected, got %v", v)
+	}
+	switch typ {
+	case typeUint32, typeFixed32, typeUint64, typeFixed64:
+		bitSize := 64
+		if typ == typeUint32 || typ == typeFixed32 {
+			bitSize = 32
+		}
+		x, err := strconv.ParseUint(str, 10, bitSize)
+		if err != nil {
+			return nil, errors.Errorf("uint%d expected, got %v", bitSize, str)
+		}
+		switch typ {
+		case typeFixed32:
+			return appendFixed32(b, uint32(x)), nil
+		case typeFixed64:
+			return appendFixed64(b, x), nil
+		}
+		return appendVarint(b, x), nil
+	}
+	bitSize := 64
+	if typ == typeInt32 || typ == typeSint32 || typ == typeSfixed32 {
+		bitSize = 32
+	}
+	x, err := strconv.ParseInt(str, 10, bitSize)
+	if err != nil {
+		return nil, errors.Errorf("int%d expected, got %v", bitSize, str)
+	}
+	switch typ {
+	case typeSint32:
+		return appendVarint(b, uint64(uint32(int32(x)<<1^int32(x)>>31))), nil
+	case typeSint64:
+		return appendVarint(b, uint64(x<<1^x>>63)), nil
+	case typeSfixed32:
+		return appendFixed32(b, uint32(x)), nil
+	case typeSfixed64:
+		return appendFixed64(b, uint64(x)), nil
+	}
+	return appendVarint(b, uint64(x)), nil
+}
+
+func parseFloat(v interface{}) (float64, error) {
+	switch x := v.(type) {
+	case json.Number:
+		return x.Float64()
+	case string:
+		switch x {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		f, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return 0, errors.Errorf("number expected, got %v", v)
+		}
+		return f, nil
+	}
+	return 0, errors.Errorf("number expected, got %v", v)
+}
+
+func wireTypeOf(typ int32) int {
+	switch typ {
+	case typeDouble, typeFixed64, typeSfixed64:
+		return wireFixed64
+	case typeFloat, typeFixed32, typeSfixed32:
+		return wireFixed32
+	case typeString, typeBytes, typeMessage:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+func decodeMessage(msg *message, data []byte) (*object, error) {
+	values := make(map[int32][]interface{})
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		f := msg.byNumber[num]
+		if f == nil {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Repeated scalar fields are accepted both packed and not.
+		if f.repeated && isPackable(f.typ) && wireType == wireBytes {
+			payload, err := r.bytes()
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s.%s", msg.name, f.name)
+			}
+			pr := wireReader{payload}
+			for !pr.done() {
+				v, err := decodeValue(&pr, f)
+				if err != nil {
+					return nil, errors.Wrapf(err, "field %s.%s", msg.name, f.name)
+				}
+				values[num] = append(values[num], v)
+			}
+			continue
+		}
+		if wireType != wireTypeOf(f.typ) {
+			return nil, errors.Errorf("field %s.%s: bad wire type %d", msg.name, f.name, wireType)
+		}
+		v, err := decodeValue(&r, f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s.%s", msg.name, f.name)
+		}
+		values[num] = append(values[num], v)
+	}
+	obj := &object{}
+	for _, f := range msg.fields {
+		fvs, ok := values[f.number]
+		if !ok {
+			continue
+		}
+		var v interface{}
+		switch {
+		case f.message != nil && f.message.mapEntry:
+			m := make(map[string]interface{}, len(fvs))
+			for _, fv := range fvs {
+				entry := fv.(*object)
+				// Fields with default values may be omitted from entries.
+				key := mapKeyString(defaultMapKey(f.message.byNumber[1]))
+				var value interface{}
+				for _, ef := range entry.fields {
+					switch ef.number {
+					case 1:
+						key = mapKeyString(ef.value)
+					case 2:
+						value = ef.value
+					}
+				}
+				m[key] = value
+			}
+			v = m
+		case f.repeated:
+			v = fvs
+		default:
+			v = fvs[len(fvs)-1]
+		}
+		obj.fields = append(obj.fields, objectField{f.jsonName, f.number, v})
+	}
+	return obj, nil
+}
+
+// decodeValue reads a value of a field and converts it to a value that is
+// marshaled to JSON as defined by the proto3 JSON mapping.
+func decodeValue(r *wireReader, f *field) (interface{}, error) {
+	switch f.typ {
+	case typeInt32, typeInt64, typeUint32, typeUint64, typeSint32, typeSint64, typeBool, typeEnum:
+		x, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case typeInt32:
+			return int32(x), nil
+		case typeInt64:
+			return strconv.FormatInt(int64(x), 10), nil
+		case typeUint32:
+			return uint32(x), nil
+		case typeUint64:
+			return strconv.FormatUint(x, 10), nil
+		case typeSint32:
+			return int32(uint32(x)>>1) ^ -int32(x&1), nil
+		case typeSint64:
+			return strconv.FormatInt(int64(x>>1)^-int64(x&1), 10), nil
+		case typeBool:
+			return x != 0, nil
+		}
+		if name, ok := f.enum.byNumber[int32(x)]; ok {
+			return name, nil
+		}
+		return int32(x), nil
+
+	case typeFixed32, typeSfixed32, typeFloat:
+		x, err := r.fixed32()
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case typeFixed32:
+			return x, nil
+		case typeSfixed32:
+			return int32(x), nil
+		}
+		return jsonFloat(float64(math.Float32frombits(x))), nil
+
+	case typeFixed64, typeSfixed64, typeDouble:
+		x, err := r.fixed64()
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case typeFixed64:
+			return strconv.FormatUint(x, 10), nil
+		case typeSfixed64:
+			return strconv.FormatInt(int64(x), 10), nil
+		}
+		return jsonFloat(math.Float64frombits(x)), nil
+
+	case typeString, typeBytes, typeMessage:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case typeString:
+			return string(b), nil
+		case typeBytes:
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return decodeMessage(f.message, b)
+	}
+	return nil, errors.Errorf("unsupported field type %d", f.typ)
+}
+
+// jsonFloat returns special float values as strings, for they cannot be
+// represented by JSON numbers.
+func jsonFloat(x float64) interface{} {
+	switch {
+	case math.IsNaN(x):
+		return "NaN"
+	case math.IsInf(x, 1):
+		return "Infinity"
+	case math.IsInf(x, -1):
+		return "-Infinity"
+	}
+	return x
+}
+
+func defaultMapKey(keyField *field) interface{} {
+	if keyField == nil {
+		return ""
+	}
+	switch keyField.typ {
+	case typeString:
+		return ""
+	case typeBool:
+		return false
+	}
+	return "0"
+}
+
+func mapKeyString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case int32:
+		return strconv.FormatInt(int64(x), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(x), 10)
+	}
+	return ""
+}
+
+// object is a decoded message that is marshaled to JSON with fields in the
+// order they are defined in the message type.
+type object struct {
+	fields []objectField
+}
+
+type objectField struct {
+	name   string
+	number int32
+	value  interface{}
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
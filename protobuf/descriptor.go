@@ -0,0 +1,400 @@
+package protobuf
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Field types as defined by `google.protobuf.FieldDescriptorProto.Type`.
+const (
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+
+	labelRepeated = 3
+)
+
+// message describes a protocol buffers message type.
+type message struct {
+	name     string
+	fields   []*field
+	byNumber map[int32]*field
+	byName   map[string]*field
+	mapEntry bool
+}
+
+// field describes a field of a message type.
+type field struct {
+	name     string
+	jsonName string
+	number   int32
+	typ      int32
+	repeated bool
+	packed   bool
+	typeName string
+	message  *message
+	enum     *enum
+}
+
+// enum describes a protocol buffers enum type.
+type enum struct {
+	name     string
+	byName   map[string]int32
+	byNumber map[int32]string
+}
+
+// registry contains all message and enum types defined in a descriptor set
+// by their fully qualified names.
+type registry struct {
+	messages map[string]*message
+	enums    map[string]*enum
+}
+
+// parseDescriptorSet parses a serialized `google.protobuf.FileDescriptorSet`,
+// as produced by `protoc --descriptor_set_out`.
+func parseDescriptorSet(data []byte) (*registry, error) {
+	reg := &registry{
+		messages: make(map[string]*message),
+		enums:    make(map[string]*enum),
+	}
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if num != 1 {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fileData, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := reg.parseFile(fileData); err != nil {
+			return nil, err
+		}
+	}
+	// Resolve references to message and enum types.
+	for _, msg := range reg.messages {
+		for _, f := range msg.fields {
+			typeName := strings.TrimPrefix(f.typeName, ".")
+			switch f.typ {
+			case typeMessage:
+				if f.message = reg.messages[typeName]; f.message == nil {
+					return nil, errors.Errorf("unknown type %s of field %s.%s", f.typeName, msg.name, f.name)
+				}
+			case typeEnum:
+				if f.enum = reg.enums[typeName]; f.enum == nil {
+					return nil, errors.Errorf("unknown type %s of field %s.%s", f.typeName, msg.name, f.name)
+				}
+			case typeGroup:
+				return nil, errors.Errorf("groups are not supported, field %s.%s", msg.name, f.name)
+			}
+		}
+	}
+	return reg, nil
+}
+
+func (reg *registry) parseFile(data []byte) error {
+	var pkg, syntax string
+	var msgsData, enumsData [][]byte
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 2:
+			pkg, err = r.readString(wireType)
+		case 4:
+			var b []byte
+			b, err = r.readBytes(wireType)
+			msgsData = append(msgsData, b)
+		case 5:
+			var b []byte
+			b, err = r.readBytes(wireType)
+			enumsData = append(enumsData, b)
+		case 12:
+			syntax, err = r.readString(wireType)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid file descriptor")
+		}
+	}
+	for _, msgData := range msgsData {
+		if err := reg.parseMessage(msgData, pkg, syntax == "proto3"); err != nil {
+			return err
+		}
+	}
+	for _, enumData := range enumsData {
+		if err := reg.parseEnum(enumData, pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (reg *registry) parseMessage(data []byte, scope string, proto3 bool) error {
+	msg := &message{
+		byNumber: make(map[int32]*field),
+		byName:   make(map[string]*field),
+	}
+	var nestedData, enumsData [][]byte
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			msg.name, err = r.readString(wireType)
+		case 2:
+			var b []byte
+			if b, err = r.readBytes(wireType); err == nil {
+				var f *field
+				if f, err = parseField(b, proto3); err == nil {
+					msg.fields = append(msg.fields, f)
+				}
+			}
+		case 3:
+			var b []byte
+			b, err = r.readBytes(wireType)
+			nestedData = append(nestedData, b)
+		case 4:
+			var b []byte
+			b, err = r.readBytes(wireType)
+			enumsData = append(enumsData, b)
+		case 7:
+			var b []byte
+			if b, err = r.readBytes(wireType); err == nil {
+				msg.mapEntry, _, err = parseBoolOption(b, 7)
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid message descriptor")
+		}
+	}
+	msg.name = qualify(scope, msg.name)
+	for _, f := range msg.fields {
+		msg.byNumber[f.number] = f
+		msg.byName[f.name] = f
+		msg.byName[f.jsonName] = f
+	}
+	reg.messages[msg.name] = msg
+	for _, nested := range nestedData {
+		if err := reg.parseMessage(nested, msg.name, proto3); err != nil {
+			return err
+		}
+	}
+	for _, enumData := range enumsData {
+		if err := reg.parseEnum(enumData, msg.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseField(data []byte, proto3 bool) (*field, error) {
+	f := &field{}
+	var packed *bool
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		switch num {
+		case 1:
+			f.name, err = r.readString(wireType)
+		case 3:
+			v, err = r.readVarint(wireType)
+			f.number = int32(v)
+		case 4:
+			v, err = r.readVarint(wireType)
+			f.repeated = v == labelRepeated
+		case 5:
+			v, err = r.readVarint(wireType)
+			f.typ = int32(v)
+		case 6:
+			f.typeName, err = r.readString(wireType)
+		case 8:
+			var b []byte
+			if b, err = r.readBytes(wireType); err == nil {
+				var p, ok bool
+				if p, ok, err = parseBoolOption(b, 2); ok {
+					packed = &p
+				}
+			}
+		case 10:
+			f.jsonName, err = r.readString(wireType)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid field descriptor")
+		}
+	}
+	if f.jsonName == "" {
+		f.jsonName = lowerCamelCase(f.name)
+	}
+	// Repeated scalar numeric fields are packed by default in proto3.
+	if f.repeated && isPackable(f.typ) {
+		if packed != nil {
+			f.packed = *packed
+		} else {
+			f.packed = proto3
+		}
+	}
+	return f, nil
+}
+
+func (reg *registry) parseEnum(data []byte, scope string) error {
+	e := &enum{
+		byName:   make(map[string]int32),
+		byNumber: make(map[int32]string),
+	}
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			e.name, err = r.readString(wireType)
+		case 2:
+			var b []byte
+			if b, err = r.readBytes(wireType); err == nil {
+				var name string
+				var number int32
+				if name, number, err = parseEnumValue(b); err == nil {
+					e.byName[name] = number
+					// The first name wins if there are aliases.
+					if _, ok := e.byNumber[number]; !ok {
+						e.byNumber[number] = name
+					}
+				}
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid enum descriptor")
+		}
+	}
+	e.name = qualify(scope, e.name)
+	reg.enums[e.name] = e
+	return nil
+}
+
+func parseEnumValue(data []byte) (string, int32, error) {
+	var name string
+	var number int32
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return "", 0, err
+		}
+		switch num {
+		case 1:
+			name, err = r.readString(wireType)
+		case 2:
+			var v uint64
+			v, err = r.readVarint(wireType)
+			number = int32(v)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return name, number, nil
+}
+
+// parseBoolOption returns the value of a bool field of an options message,
+// and whether the field is set at all.
+func parseBoolOption(data []byte, optNum int32) (bool, bool, error) {
+	var value, ok bool
+	r := wireReader{data}
+	for !r.done() {
+		num, wireType, err := r.next()
+		if err != nil {
+			return false, false, err
+		}
+		if num != optNum {
+			if err := r.skip(wireType); err != nil {
+				return false, false, err
+			}
+			continue
+		}
+		v, err := r.readVarint(wireType)
+		if err != nil {
+			return false, false, err
+		}
+		value, ok = v != 0, true
+	}
+	return value, ok, nil
+}
+
+func isPackable(typ int32) bool {
+	switch typ {
+	case typeString, typeBytes, typeMessage, typeGroup:
+		return false
+	}
+	return true
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// lowerCamelCase converts a field name to its JSON name the same way protoc
+// does it.
+func lowerCamelCase(name string) string {
+	var b []byte
+	upperNext := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' {
+			upperNext = true
+			continue
+		}
+		if upperNext && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upperNext = false
+		b = append(b, c)
+	}
+	return string(b)
+}
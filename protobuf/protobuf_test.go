@@ -0,0 +1,255 @@
+package protobuf
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProtobufSuite struct{}
+
+var _ = Suite(&ProtobufSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// testDescriptorSet returns a descriptor set equivalent to what protoc
+// generates for the following file:
+//
+//	syntax = "proto3";
+//	package test;
+//	message Event {
+//	  message Inner { bool ok = 1; }
+//	  enum Kind { UNKNOWN = 0; CLICK = 1; }
+//	  int32 id = 1;
+//	  string user_name = 2;
+//	  repeated int64 counts = 3;
+//	  map<string, int32> attrs = 4;
+//	  Kind kind = 5;
+//	  Inner inner = 6;
+//	  bytes data = 7;
+//	  double score = 8;
+//	  sint32 delta = 9;
+//	}
+func testDescriptorSet() []byte {
+	event := msgDesc("Event", false,
+		[][]byte{
+			fieldDesc("id", 1, 1, typeInt32, ""),
+			fieldDesc("user_name", 2, 1, typeString, ""),
+			fieldDesc("counts", 3, labelRepeated, typeInt64, ""),
+			fieldDesc("attrs", 4, labelRepeated, typeMessage, ".test.Event.AttrsEntry"),
+			fieldDesc("kind", 5, 1, typeEnum, ".test.Event.Kind"),
+			fieldDesc("inner", 6, 1, typeMessage, ".test.Event.Inner"),
+			fieldDesc("data", 7, 1, typeBytes, ""),
+			fieldDesc("score", 8, 1, typeDouble, ""),
+			fieldDesc("delta", 9, 1, typeSint32, ""),
+		},
+		[][]byte{
+			msgDesc("Inner", false, [][]byte{fieldDesc("ok", 1, 1, typeBool, "")}, nil, nil),
+			msgDesc("AttrsEntry", true, [][]byte{
+				fieldDesc("key", 1, 1, typeString, ""),
+				fieldDesc("value", 2, 1, typeInt32, ""),
+			}, nil, nil),
+		},
+		[][]byte{enumDesc("Kind", "UNKNOWN", "CLICK")})
+
+	var file []byte
+	file = appendTag(file, 1, wireBytes)
+	file = appendBytes(file, []byte("test.proto"))
+	file = appendTag(file, 2, wireBytes)
+	file = appendBytes(file, []byte("test"))
+	file = appendTag(file, 4, wireBytes)
+	file = appendBytes(file, event)
+	file = appendTag(file, 12, wireBytes)
+	file = appendBytes(file, []byte("proto3"))
+
+	var set []byte
+	set = appendTag(set, 1, wireBytes)
+	return appendBytes(set, file)
+}
+
+func fieldDesc(name string, number, label, typ int32, typeName string) []byte {
+	var b []byte
+	b = appendTag(b, 1, wireBytes)
+	b = appendBytes(b, []byte(name))
+	b = appendTag(b, 3, wireVarint)
+	b = appendVarint(b, uint64(number))
+	b = appendTag(b, 4, wireVarint)
+	b = appendVarint(b, uint64(label))
+	b = appendTag(b, 5, wireVarint)
+	b = appendVarint(b, uint64(typ))
+	if typeName != "" {
+		b = appendTag(b, 6, wireBytes)
+		b = appendBytes(b, []byte(typeName))
+	}
+	return b
+}
+
+func msgDesc(name string, mapEntry bool, fields, nested, enums [][]byte) []byte {
+	var b []byte
+	b = appendTag(b, 1, wireBytes)
+	b = appendBytes(b, []byte(name))
+	for _, f := range fields {
+		b = appendTag(b, 2, wireBytes)
+		b = appendBytes(b, f)
+	}
+	for _, n := range nested {
+		b = appendTag(b, 3, wireBytes)
+		b = appendBytes(b, n)
+	}
+	for _, e := range enums {
+		b = appendTag(b, 4, wireBytes)
+		b = appendBytes(b, e)
+	}
+	if mapEntry {
+		b = appendTag(b, 7, wireBytes)
+		b = appendBytes(b, []byte{7 << 3, 1})
+	}
+	return b
+}
+
+func enumDesc(name string, values ...string) []byte {
+	var b []byte
+	b = appendTag(b, 1, wireBytes)
+	b = appendBytes(b, []byte(name))
+	for i, value := range values {
+		var v []byte
+		v = appendTag(v, 1, wireBytes)
+		v = appendBytes(v, []byte(value))
+		v = appendTag(v, 2, wireVarint)
+		v = appendVarint(v, uint64(i))
+		b = appendTag(b, 2, wireBytes)
+		b = appendBytes(b, v)
+	}
+	return b
+}
+
+// Encoding produces the protocol buffers binary format.
+func (s *ProtobufSuite) TestEncodeJSON(c *C) {
+	codec, err := NewCodec(testDescriptorSet(), "test.Event")
+	c.Assert(err, IsNil)
+	for i, tc := range []struct {
+		json    string
+		encoded []byte
+	}{
+		{json: `{"id": 150}`, encoded: []byte{0x08, 0x96, 0x01}},
+		{json: `{"id": -1}`, encoded: []byte{0x08, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+		{json: `{"userName": "ab"}`, encoded: []byte{0x12, 0x02, 'a', 'b'}},
+		{json: `{"user_name": "ab"}`, encoded: []byte{0x12, 0x02, 'a', 'b'}},
+		{json: `{"counts": [3, "270"]}`, encoded: []byte{0x1A, 0x03, 0x03, 0x8E, 0x02}},
+		{json: `{"attrs": {"a": 1}}`, encoded: []byte{0x22, 0x05, 0x0A, 0x01, 'a', 0x10, 0x01}},
+		{json: `{"kind": "CLICK"}`, encoded: []byte{0x28, 0x01}},
+		{json: `{"kind": 1}`, encoded: []byte{0x28, 0x01}},
+		{json: `{"inner": {"ok": true}}`, encoded: []byte{0x32, 0x02, 0x08, 0x01}},
+		{json: `{"data": "AQI="}`, encoded: []byte{0x3A, 0x02, 0x01, 0x02}},
+		{json: `{"score": 1}`, encoded: []byte{0x41, 0, 0, 0, 0, 0, 0, 0xF0, 0x3F}},
+		{json: `{"delta": -2}`, encoded: []byte{0x48, 0x03}},
+		{json: `{"id": null}`, encoded: nil},
+	} {
+		// When
+		encoded, err := codec.EncodeJSON([]byte(tc.json))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(encoded, DeepEquals, tc.encoded, Commentf("case #%d", i))
+	}
+}
+
+// A message decoded from its encoded form is rendered as JSON with fields
+// in the definition order.
+func (s *ProtobufSuite) TestRoundTrip(c *C) {
+	codec, err := NewCodec(testDescriptorSet(), ".test.Event")
+	c.Assert(err, IsNil)
+
+	// When
+	encoded, err := codec.EncodeJSON([]byte(`{
+	  "delta": -7, "score": 0.5, "data": "AQI=", "inner": {"ok": true},
+	  "kind": "CLICK", "attrs": {"b": 2, "a": 1}, "counts": [1, 2],
+	  "userName": "bob", "id": 42}`))
+	c.Assert(err, IsNil)
+	decoded, err := codec.DecodeJSON(encoded)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, `{"id":42,"userName":"bob","counts":["1","2"],`+
+		`"attrs":{"a":1,"b":2},"kind":"CLICK","inner":{"ok":true},"data":"AQI=",`+
+		`"score":0.5,"delta":-7}`)
+}
+
+// Unknown fields are skipped and repeated scalars are accepted unpacked.
+func (s *ProtobufSuite) TestDecodeUnknownAndUnpacked(c *C) {
+	codec, err := NewCodec(testDescriptorSet(), "test.Event")
+	c.Assert(err, IsNil)
+
+	// When
+	decoded, err := codec.DecodeJSON([]byte{0x18, 0x01, 0x78, 0x05, 0x18, 0x02})
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, `{"counts":["1","2"]}`)
+}
+
+func (s *ProtobufSuite) TestEncodeInvalid(c *C) {
+	codec, err := NewCodec(testDescriptorSet(), "test.Event")
+	c.Assert(err, IsNil)
+	for i, tc := range []struct {
+		json string
+		err  string
+	}{{
+		json: `{"id": 1`,
+		err:  "invalid JSON: unexpected EOF",
+	}, {
+		json: `[]`,
+		err:  "message test.Event expected, got []",
+	}, {
+		json: `{"foo": 1}`,
+		err:  "unknown field test.Event.foo",
+	}, {
+		json: `{"id": 3000000000}`,
+		err:  "field test.Event.id: int32 expected, got 3000000000",
+	}, {
+		json: `{"kind": "VIEW"}`,
+		err:  "field test.Event.kind: unknown value of enum test.Event.Kind, VIEW",
+	}, {
+		json: `{"inner": {"ok": 1}}`,
+		err:  "field test.Event.inner: field test.Event.Inner.ok: bool expected, got 1",
+	}} {
+		// When
+		_, err := codec.EncodeJSON([]byte(tc.json))
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ProtobufSuite) TestDecodeInvalid(c *C) {
+	codec, err := NewCodec(testDescriptorSet(), "test.Event")
+	c.Assert(err, IsNil)
+	for i, tc := range []struct {
+		data []byte
+		err  string
+	}{{
+		data: []byte{0x12, 0x05, 'a'},
+		err:  "field test.Event.user_name: unexpected end of data",
+	}, {
+		data: []byte{0x0A, 0x01, 0x01},
+		err:  "field test.Event.id: bad wire type 2",
+	}} {
+		// When
+		_, err := codec.DecodeJSON(tc.data)
+
+		// Then
+		c.Assert(err, NotNil, Commentf("case #%d", i))
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
+func (s *ProtobufSuite) TestUnknownMessageType(c *C) {
+	// When
+	_, err := NewCodec(testDescriptorSet(), "test.Bogus")
+
+	// Then
+	c.Assert(err.Error(), Equals, "unknown message type test.Bogus")
+}
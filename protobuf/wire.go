@@ -0,0 +1,147 @@
+package protobuf
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Protocol buffers wire types.
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+// wireReader reads protocol buffers binary data.
+type wireReader struct {
+	data []byte
+}
+
+func (r *wireReader) done() bool {
+	return len(r.data) == 0
+}
+
+// next reads a field tag and returns the field number and its wire type.
+func (r *wireReader) next() (int32, int, error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	num := tag >> 3
+	if num == 0 || num > 1<<29-1 {
+		return 0, 0, errors.Errorf("invalid field number %d", num)
+	}
+	return int32(num), int(tag & 7), nil
+}
+
+func (r *wireReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errors.New("invalid varint")
+	}
+	r.data = r.data[n:]
+	return v, nil
+}
+
+func (r *wireReader) fixed32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errUnexpectedEnd
+	}
+	v := binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *wireReader) fixed64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, errUnexpectedEnd
+	}
+	v := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *wireReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)) {
+		return nil, errUnexpectedEnd
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// skip skips a value of the specified wire type.
+func (r *wireReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed32()
+	default:
+		err = errors.Errorf("unsupported wire type %d", wireType)
+	}
+	return err
+}
+
+// readBytes reads a length delimited field value of the expected wire type.
+func (r *wireReader) readBytes(wireType int) ([]byte, error) {
+	if wireType != wireBytes {
+		return nil, errors.Errorf("bad wire type %d", wireType)
+	}
+	return r.bytes()
+}
+
+// readString reads a string field value of the expected wire type.
+func (r *wireReader) readString(wireType int) (string, error) {
+	b, err := r.readBytes(wireType)
+	return string(b), err
+}
+
+// readVarint reads a varint field value of the expected wire type.
+func (r *wireReader) readVarint(wireType int) (uint64, error) {
+	if wireType != wireVarint {
+		return 0, errors.Errorf("bad wire type %d", wireType)
+	}
+	return r.varint()
+}
+
+func appendTag(b []byte, num int32, wireType int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendFixed32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
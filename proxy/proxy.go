@@ -1,39 +1,131 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/admin"
+	"github.com/mailgun/kafka-pixy/callback"
 	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/consumerimpl"
 	"github.com/mailgun/kafka-pixy/offsetmgr"
 	"github.com/mailgun/kafka-pixy/producer"
+	"github.com/mailgun/kafka-pixy/protobuf"
+	"github.com/mailgun/kafka-pixy/ratelimit"
+	"github.com/mailgun/kafka-pixy/redact"
+	"github.com/mailgun/kafka-pixy/schemareg"
+	"github.com/mailgun/kafka-pixy/transform"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
 )
 
 const (
 	initEventsChMapCapacity = 256
+
+	// How long a health check can take before it is considered failed.
+	healthCheckTimeout = 3 * time.Second
+
+	// The number of dead letter messages read at a time by Reprocess.
+	reprocessBatchSize = 100
+
+	// Names of health checks reported by CheckHealth.
+	HealthCheckKafka     = "kafka"
+	HealthCheckZooKeeper = "zookeeper"
 )
 
 var (
 	noAck   = Ack{partition: -1}
 	autoAck = Ack{partition: -2}
+
+	// ErrGroupActive is returned by SeekGroupOffsets if a topic is consumed by
+	// group members that run in other Kafka-Pixy instances.
+	ErrGroupActive = errors.New("group is consuming the topic in other instances")
+
+	// ErrCallbackNotAllowed is returned by AsyncProduceWithCallback if the
+	// callback URL is not allowed by `Webhook.ProduceCallbackURLs`.
+	ErrCallbackNotAllowed = callback.ErrNotAllowed
+
+	// ErrTimeLookupNotSupported is returned by LookupTimeOffsets if the
+	// configured Kafka version is older than 0.10.1.0, that resolves offsets
+	// by timestamp with a log segment granularity only.
+	ErrTimeLookupNotSupported = errors.New("offsets lookup by timestamp requires kafka.version 0.10.1.0 or later")
+
+	// ErrTooManyLongPolls is returned by consume requests of a tenant that
+	// already has as many of them waiting for messages as its quota allows.
+	ErrTooManyLongPolls = errors.New("too many concurrent long polls")
 )
 
+type ctxKey int
+
+const tenantCtxKey ctxKey = iota
+
+// WithTenant returns a context that makes produce and consume requests made
+// with it count against quotas of the specified tenant. By default requests
+// count against quotas of the tenant that owns the consumer group, or the
+// topic if there is no group, as defined by `HTTP.Tenants`.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey, tenant)
+}
+
+// ByteQuotaError is returned by produce and consume requests of a tenant that
+// has used up its byte quota.
+type ByteQuotaError struct {
+	Tenant string
+
+	// How long it takes for the tenant to pay off its quota debt.
+	RetryAfter time.Duration
+}
+
+func (e *ByteQuotaError) Error() string {
+	return "tenant byte quota exceeded"
+}
+
+// IsQuotaExceeded returns true if `err` is either ErrTooManyLongPolls or a
+// ByteQuotaError.
+func IsQuotaExceeded(err error) bool {
+	err = errors.Cause(err)
+	if _, ok := err.(*ByteQuotaError); ok {
+		return true
+	}
+	return err == ErrTooManyLongPolls
+}
+
+// SeekTimeoutError is returned by SeekGroupOffsets if partition consumers of
+// the group that run in this proxy did not take a seek in time. Offsets of all
+// partitions are committed by then, and Applied partitions are consumed from
+// them, but consumers of TimedOut partitions carry on from where they were,
+// and may overwrite the committed offsets.
+type SeekTimeoutError struct {
+	Applied  []int32
+	TimedOut []int32
+}
+
+func (e *SeekTimeoutError) Error() string {
+	return fmt.Sprintf("seek timeout: applied=%v, timedOut=%v", e.Applied, e.TimedOut)
+}
+
 // T implements a proxy to a particular Kafka/ZooKeeper cluster.
 type T struct {
-	actorID    *actor.ID
-	cfg        *config.Proxy
-	producer   *producer.T
-	kafkaClt   sarama.Client
-	offsetMgrF offsetmgr.Factory
-	consumer   consumer.T
-	admin      *admin.T
+	actorID     *actor.ID
+	cfg         *config.Proxy
+	producer    *producer.T
+	callbacks   *callback.T
+	kafkaClt    sarama.Client
+	offsetMgrF  offsetmgr.Factory
+	consumer    consumer.T
+	admin       *admin.T
+	schemaReg   *schemareg.T
+	protoCodecs map[string]*protobuf.Codec
+	produceTfs  map[string]transform.Pipeline
+	consumeTfs  map[string]transform.Pipeline
+	redactor    *redact.T
+	quotas      *ratelimit.Quotas
 
 	// FIXME: We never remove stale elements from eventsChMap. It is sort of ok
 	// FIXME: since the number of group/topic/partition combinations is fairly
@@ -45,6 +137,7 @@ type T struct {
 type Ack struct {
 	partition int32
 	offset    int64
+	meta      string
 }
 
 // NewAck creates an acknowledgement instance from a partition and an offset.
@@ -57,7 +150,15 @@ func NewAck(partition int32, offset int64) (Ack, error) {
 	if offset < 0 {
 		return Ack{}, errors.Errorf("bad offset: %d", offset)
 	}
-	return Ack{partition, offset}, nil
+	return Ack{partition: partition, offset: offset}, nil
+}
+
+// WithMeta returns a copy of the ack that also carries metadata, e.g. the
+// name of the host that processed the message. The metadata is stored with
+// the offset committed after the ack, and is returned by GetGroupOffsets.
+func (a Ack) WithMeta(meta string) Ack {
+	a.meta = meta
+	return a
 }
 
 // NoAck returns an ack value that should be passed to proxy.Consume function
@@ -78,15 +179,37 @@ type eventsChID struct {
 	partition int32
 }
 
-// Spawn creates a proxy instance and starts its internal goroutines.
-func Spawn(namespace *actor.ID, name string, cfg *config.Proxy) (*T, error) {
+// Spawn creates a proxy instance and starts its internal goroutines. Produce
+// and consume requests are subject to tenant `quotas`, that can be shared by
+// several proxies, or nil if there are none.
+func Spawn(namespace *actor.ID, name string, cfg *config.Proxy, quotas *ratelimit.Quotas) (*T, error) {
 	p := T{
 		actorID:     namespace.NewChild(name),
 		cfg:         cfg,
+		redactor:    redact.New(cfg),
+		quotas:      quotas,
 		eventsChMap: make(map[eventsChID]chan<- consumer.Event, initEventsChMapCapacity),
 	}
 	var err error
 
+	p.protoCodecs = make(map[string]*protobuf.Codec, len(cfg.Protobuf.Topics))
+	for topic, protobufTopic := range cfg.Protobuf.Topics {
+		codec, err := protobuf.LoadCodec(protobufTopic.DescriptorSetFile, protobufTopic.MessageType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load protobuf codec, topic=%s", topic)
+		}
+		p.protoCodecs[topic] = codec
+	}
+	p.produceTfs = make(map[string]transform.Pipeline, len(cfg.Transform.Topics))
+	p.consumeTfs = make(map[string]transform.Pipeline, len(cfg.Transform.Topics))
+	for topic, topicTransform := range cfg.Transform.Topics {
+		if p.produceTfs[topic], err = transform.New(topicTransform.Produce); err != nil {
+			return nil, errors.Wrapf(err, "failed to create produce transform, topic=%s", topic)
+		}
+		if p.consumeTfs[topic], err = transform.New(topicTransform.Consume); err != nil {
+			return nil, errors.Wrapf(err, "failed to create consume transform, topic=%s", topic)
+		}
+	}
 	if p.kafkaClt, err = sarama.NewClient(cfg.Kafka.SeedPeers, cfg.SaramaClientCfg()); err != nil {
 		return nil, errors.Wrap(err, "failed to create Kafka client")
 	}
@@ -94,21 +217,28 @@ func Spawn(namespace *actor.ID, name string, cfg *config.Proxy) (*T, error) {
 	if p.producer, err = producer.Spawn(p.actorID, cfg); err != nil {
 		return nil, errors.Wrap(err, "failed to spawn producer")
 	}
-	if p.consumer, err = consumerimpl.Spawn(p.actorID, cfg, p.offsetMgrF); err != nil {
+	if len(cfg.Webhook.ProduceCallbackURLs) > 0 {
+		p.callbacks = callback.Spawn(p.actorID, cfg)
+	}
+	var dl consumer.DeadLetterer
+	if cfg.Consumer.DeadLetterTopic != "" {
+		dl = &deadLetterer{actorID: p.actorID, cfg: cfg, producer: p.producer}
+	}
+	if p.consumer, err = consumerimpl.Spawn(p.actorID, cfg, p.offsetMgrF, dl); err != nil {
 		return nil, errors.Wrap(err, "failed to spawn consumer")
 	}
 	if p.admin, err = admin.Spawn(p.actorID, cfg); err != nil {
 		return nil, errors.Wrap(err, "failed to spawn admin")
 	}
+	if cfg.SchemaRegistry.URL != "" {
+		p.schemaReg = schemareg.New(cfg)
+	}
 	return &p, nil
 }
 
 // Stop terminates the proxy instances synchronously.
 func (p *T) Stop() {
 	var wg sync.WaitGroup
-	if p.producer != nil {
-		actor.Spawn(p.actorID.NewChild("producer_stop"), &wg, p.producer.Stop)
-	}
 	if p.consumer != nil {
 		actor.Spawn(p.actorID.NewChild("consumer_stop"), &wg, p.consumer.Stop)
 	}
@@ -116,6 +246,16 @@ func (p *T) Stop() {
 		actor.Spawn(p.actorID.NewChild("admin_stop"), &wg, p.admin.Stop)
 	}
 	wg.Wait()
+	// The producer is stopped after the consumer, because the consumer may
+	// produce dead lettered messages till it is stopped.
+	if p.producer != nil {
+		p.producer.Stop()
+	}
+	// Callbacks are stopped after the producer, so that results of messages
+	// flushed on shutdown are posted too.
+	if p.callbacks != nil {
+		p.callbacks.Stop()
+	}
 	if p.offsetMgrF != nil {
 		p.offsetMgrF.Stop()
 	}
@@ -130,60 +270,360 @@ func (p *T) Stop() {
 // it returns consistent results. If `key` is `nil`, then the message is placed
 // into a random partition.
 //
+// If the topic has Avro or protobuf serialization, then the message must be a
+// JSON document that matches the schema of the topic, otherwise an error that
+// `IsInvalidMessage` is returned. The same kind of error is returned if a
+// produce transformation of the topic fails.
+//
+// If the tenant of the request has used up its byte quota, then
+// a ByteQuotaError is returned, see WithTenant.
+//
 // Errors usually indicate a catastrophic failure of the Kafka cluster, or
 // missing topic if there cluster is not configured to auto create topics.
-func (p *T) Produce(topic string, key, message sarama.Encoder) (*sarama.ProducerMessage, error) {
+func (p *T) Produce(ctx context.Context, topic string, key, message sarama.Encoder) (*sarama.ProducerMessage, error) {
+	key, message, err := p.prepareProduced(ctx, topic, key, message)
+	if err != nil {
+		return nil, err
+	}
 	return p.producer.Produce(topic, key, message)
 }
 
 // AsyncProduce is an asynchronously counterpart of the `Produce` function.
-// Errors are silently ignored.
-func (p *T) AsyncProduce(topic string, key, message sarama.Encoder) {
+// Only transformation, serialization and quota errors are returned, errors
+// that occur when the message is submitted to Kafka are silently ignored.
+func (p *T) AsyncProduce(ctx context.Context, topic string, key, message sarama.Encoder) error {
+	key, message, err := p.prepareProduced(ctx, topic, key, message)
+	if err != nil {
+		return err
+	}
 	p.producer.AsyncProduce(topic, key, message)
+	return nil
+}
+
+// AsyncProduceWithCallback is like AsyncProduce, but once the message is
+// either written to Kafka or fails to be, the result is posted to
+// `callbackURL` along with `callbackID`. ErrCallbackNotAllowed is returned if
+// the URL does not start with any of `Webhook.ProduceCallbackURLs`.
+func (p *T) AsyncProduceWithCallback(ctx context.Context, topic string, key, message sarama.Encoder, callbackURL, callbackID string) error {
+	if p.callbacks == nil {
+		return ErrCallbackNotAllowed
+	}
+	notify, err := p.callbacks.Notifier(callbackURL, callbackID)
+	if err != nil {
+		return err
+	}
+	key, message, err = p.prepareProduced(ctx, topic, key, message)
+	if err != nil {
+		return err
+	}
+	p.producer.AsyncProduceNotify(topic, key, message, notify)
+	return nil
+}
+
+// prepareProduced transforms and serializes a produced message, and charges
+// it against the byte quota of the request tenant.
+func (p *T) prepareProduced(ctx context.Context, topic string, key, message sarama.Encoder) (sarama.Encoder, sarama.Encoder, error) {
+	tenant := p.requestTenant(ctx, topic, "")
+	if err := p.allowBytes(tenant); err != nil {
+		return nil, nil, err
+	}
+	key, message, err := p.transformProduced(topic, key, message)
+	if err != nil {
+		return nil, nil, err
+	}
+	message, err = p.serialize(topic, message)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := 0
+	if key != nil {
+		size += key.Length()
+	}
+	if message != nil {
+		size += message.Length()
+	}
+	p.takeBytes(tenant, size)
+	return key, message, nil
+}
+
+// InvalidMessageError is returned when a produced message does not match the
+// protobuf message type of its topic, or a produce transformation of the
+// topic fails.
+type InvalidMessageError struct {
+	Err error
+}
+
+func (e *InvalidMessageError) Error() string {
+	return fmt.Sprintf("invalid message: %v", e.Err)
+}
+
+// IsInvalidMessage returns true if `err` is caused by a produced message
+// that cannot be serialized as configured for its topic.
+func IsInvalidMessage(err error) bool {
+	if _, ok := errors.Cause(err).(*InvalidMessageError); ok {
+		return true
+	}
+	return schemareg.IsInvalidValue(err)
+}
+
+// transformProduced passes a produced message through the produce
+// transformation pipeline of its topic, if there is one.
+func (p *T) transformProduced(topic string, key, message sarama.Encoder) (sarama.Encoder, sarama.Encoder, error) {
+	pipeline := p.produceTfs[topic]
+	if len(pipeline) == 0 {
+		return key, message, nil
+	}
+	msg := transform.Message{Topic: topic}
+	var err error
+	if key != nil {
+		if msg.Key, err = key.Encode(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to encode key")
+		}
+	}
+	if message != nil {
+		if msg.Value, err = message.Encode(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to encode message")
+		}
+	}
+	if err := pipeline.Apply(&msg); err != nil {
+		return nil, nil, &InvalidMessageError{err}
+	}
+	key, message = nil, nil
+	if msg.Key != nil {
+		key = sarama.ByteEncoder(msg.Key)
+	}
+	if msg.Value != nil {
+		message = sarama.ByteEncoder(msg.Value)
+	}
+	return key, message, nil
+}
+
+// serialize encodes a message in accordance with the serialization
+// configured for its topic.
+func (p *T) serialize(topic string, message sarama.Encoder) (sarama.Encoder, error) {
+	codec := p.protoCodecs[topic]
+	if message == nil || (codec == nil && p.cfg.TopicSerialization(topic) != config.SerializationAvro) {
+		return message, nil
+	}
+	value, err := message.Encode()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode message")
+	}
+	var encoded []byte
+	if codec != nil {
+		if encoded, err = codec.EncodeJSON(value); err != nil {
+			return nil, &InvalidMessageError{err}
+		}
+	} else if encoded, err = p.schemaReg.Encode(schemareg.ValueSubject(topic), value); err != nil {
+		return nil, err
+	}
+	return sarama.ByteEncoder(encoded), nil
+}
+
+// deserialize decodes a consumed message in accordance with the
+// serialization configured for its topic. If a message cannot be decoded,
+// then it is returned as is, for it has already been consumed anyway.
+func (p *T) deserialize(msg *consumer.Message) {
+	codec := p.protoCodecs[msg.Topic]
+	if msg.Value == nil || (codec == nil && p.cfg.TopicSerialization(msg.Topic) != config.SerializationAvro) {
+		return
+	}
+	var value []byte
+	var err error
+	if codec != nil {
+		value, err = codec.DecodeJSON(msg.Value)
+	} else {
+		value, err = p.schemaReg.Decode(msg.Value)
+	}
+	if err != nil {
+		log.Errorf("<%s> failed to deserialize message: topic=%s, partition=%d, offset=%d, err=%+v",
+			p.actorID, msg.Topic, msg.Partition, msg.Offset, err)
+		return
+	}
+	msg.Value = value
+}
+
+// transformConsumed passes a consumed message through the consume
+// transformation pipeline of its topic, if there is one. If the pipeline
+// fails, then the message is returned as it was before the transformation.
+func (p *T) transformConsumed(msg *consumer.Message) {
+	pipeline := p.consumeTfs[msg.Topic]
+	if len(pipeline) == 0 {
+		return
+	}
+	tfMsg := transform.Message{Topic: msg.Topic, Key: msg.Key, Value: msg.Value}
+	if err := pipeline.Apply(&tfMsg); err != nil {
+		log.Errorf("<%s> failed to transform message: topic=%s, partition=%d, offset=%d, err=%+v",
+			p.actorID, msg.Topic, msg.Partition, msg.Offset, err)
+		return
+	}
+	msg.Key, msg.Value = tfMsg.Key, tfMsg.Value
 }
 
 // Consume consumes a message from the specified topic on behalf of the
 // specified consumer group. If there are no more new messages in the topic
-// at the time of the request then it will block for
-// `Config.Consumer.LongPollingTimeout`. If no new message is produced during
-// that time, then `ErrRequestTimeout` is returned.
+// at the time of the request then it will block for `timeout`, or for
+// `Config.Consumer.LongPollingTimeout` if `timeout` is zero, but no longer
+// than `Config.Consumer.MaxLongPollingTimeout`. If no new message is produced
+// during that time, then `ErrRequestTimeout` is returned.
 //
 // Note that during state transitions topic subscribe<->unsubscribe and
 // consumer group register<->deregister the method may return either
 // `ErrBufferOverflow` or `ErrRequestTimeout` even when there are messages
 // available for consumption. In that case the user should back off a bit
 // and then repeat the request.
-func (p *T) Consume(group, topic string, ack Ack) (consumer.Message, error) {
-	if ack != noAck && ack != autoAck {
-		p.eventsChMapMu.RLock()
-		eventsChID := eventsChID{group, topic, ack.partition}
-		eventsCh, ok := p.eventsChMap[eventsChID]
-		p.eventsChMapMu.RUnlock()
-		if ok {
-			go func() {
-				select {
-				case eventsCh <- consumer.Ack(ack.offset):
-				case <-time.After(p.cfg.Consumer.LongPollingTimeout):
-					log.Errorf("<%s> ack timeout: partition=%d, offset=%d",
-						p.actorID, ack.partition, ack.offset)
-				}
-			}()
+//
+// If `ctx` is done before a message is consumed, then
+// `consumer.ErrRequestCanceled` is returned.
+func (p *T) Consume(ctx context.Context, group, topic string, ack Ack, timeout time.Duration) (consumer.Message, error) {
+	p.asyncAck(group, topic, ack)
+	tenant := p.requestTenant(ctx, topic, group)
+	release, err := p.acquireLongPoll(tenant)
+	if err != nil {
+		return consumer.Message{}, err
+	}
+	msg, err := p.consumer.Consume(ctx, group, topic, timeout)
+	release()
+	if err != nil {
+		return consumer.Message{}, err
+	}
+	p.takeBytes(tenant, len(msg.Key)+len(msg.Value))
+	p.registerEventsCh(group, topic, msg)
+	if ack == autoAck {
+		msg.EventsCh <- consumer.Ack(msg.Offset)
+	}
+	p.deserialize(&msg)
+	p.transformConsumed(&msg)
+	return msg, nil
+}
+
+// ConsumeBatch is like Consume, but returns up to `maxMessages` messages
+// available for consumption at once. If `maxBytes` is positive then no more
+// messages are added to the batch after the total size of their keys and
+// values reaches it. In the auto-ack mode all returned messages are
+// acknowledged.
+func (p *T) ConsumeBatch(ctx context.Context, group, topic string, ack Ack, maxMessages, maxBytes int, timeout time.Duration) ([]consumer.Message, error) {
+	p.asyncAck(group, topic, ack)
+	tenant := p.requestTenant(ctx, topic, group)
+	release, err := p.acquireLongPoll(tenant)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := p.consumer.ConsumeBatch(ctx, group, topic, maxMessages, maxBytes, timeout)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	p.takeBytes(tenant, messagesSize(msgs))
+	for i, msg := range msgs {
+		p.registerEventsCh(group, topic, msg)
+		if ack == autoAck {
+			msg.EventsCh <- consumer.Ack(msg.Offset)
 		}
+		p.deserialize(&msgs[i])
+		p.transformConsumed(&msgs[i])
+	}
+	return msgs, nil
+}
+
+// ConsumeAny is like Consume, but returns the first message available in any
+// of the specified topics. Messages can only be acknowledged automatically,
+// or later with separate ack requests, so `ack` must be either auto-ack or
+// no-ack.
+func (p *T) ConsumeAny(ctx context.Context, group string, topics []string, ack Ack, timeout time.Duration) (consumer.Message, error) {
+	if ack != noAck && ack != autoAck {
+		return consumer.Message{}, errors.New("explicit ack is not supported")
+	}
+	tenant := p.requestTenant(ctx, "", group)
+	release, err := p.acquireLongPoll(tenant)
+	if err != nil {
+		return consumer.Message{}, err
 	}
-	msg, err := p.consumer.Consume(group, topic)
+	msg, err := p.consumer.ConsumeAny(ctx, group, topics, timeout)
+	release()
 	if err != nil {
 		return consumer.Message{}, err
 	}
+	p.takeBytes(tenant, len(msg.Key)+len(msg.Value))
+	p.prepareConsumed(group, &msg, ack)
+	return msg, nil
+}
 
-	eventsChID := eventsChID{group, topic, msg.Partition}
-	p.eventsChMapMu.Lock()
-	p.eventsChMap[eventsChID] = msg.EventsCh
-	p.eventsChMapMu.Unlock()
+// ConsumeMatching is like ConsumeAny, but consumes from all topics that
+// `pattern` matches.
+func (p *T) ConsumeMatching(ctx context.Context, group string, pattern *regexp.Regexp, ack Ack, timeout time.Duration) (consumer.Message, error) {
+	if ack != noAck && ack != autoAck {
+		return consumer.Message{}, errors.New("explicit ack is not supported")
+	}
+	tenant := p.requestTenant(ctx, "", group)
+	release, err := p.acquireLongPoll(tenant)
+	if err != nil {
+		return consumer.Message{}, err
+	}
+	msg, err := p.consumer.ConsumeMatching(ctx, group, pattern, timeout)
+	release()
+	if err != nil {
+		return consumer.Message{}, err
+	}
+	p.takeBytes(tenant, len(msg.Key)+len(msg.Value))
+	p.prepareConsumed(group, &msg, ack)
+	return msg, nil
+}
 
+// prepareConsumed makes a message consumed from an arbitrary topic ready to
+// be returned to a client.
+func (p *T) prepareConsumed(group string, msg *consumer.Message, ack Ack) {
+	p.registerEventsCh(group, msg.Topic, *msg)
 	if ack == autoAck {
 		msg.EventsCh <- consumer.Ack(msg.Offset)
 	}
-	return msg, nil
+	p.deserialize(msg)
+	p.transformConsumed(msg)
+}
+
+// SetGroupInitialOffset overrides the initial offset policy that the config
+// defines for the specified consumer group. It takes effect when the group
+// starts being consumed, so it should be called before the first consume
+// request of the group.
+func (p *T) SetGroupInitialOffset(group string, initialOffset config.InitialOffset) {
+	p.consumer.SetGroupInitialOffset(group, initialOffset)
+}
+
+// ConsumerState returns a snapshot of the internal state of the consumer.
+func (p *T) ConsumerState() consumer.State {
+	return p.consumer.State()
+}
+
+// asyncAck acknowledges a message specified by an explicit `ack` passed along
+// with a consume request. It does nothing for no-ack and auto-ack values.
+func (p *T) asyncAck(group, topic string, ack Ack) {
+	if ack == noAck || ack == autoAck {
+		return
+	}
+	p.eventsChMapMu.RLock()
+	eventsChID := eventsChID{group, topic, ack.partition}
+	eventsCh, ok := p.eventsChMap[eventsChID]
+	p.eventsChMapMu.RUnlock()
+	if !ok {
+		return
+	}
+	go func() {
+		select {
+		case eventsCh <- consumer.AckWithMeta(ack.offset, ack.meta):
+		case <-time.After(p.cfg.Consumer.LongPollingTimeout):
+			log.Errorf("<%s> ack timeout: partition=%d, offset=%d",
+				p.actorID, ack.partition, ack.offset)
+		}
+	}()
+}
+
+// registerEventsCh remembers the events channel of a consumed message, so that
+// the message can be acknowledged later.
+func (p *T) registerEventsCh(group, topic string, msg consumer.Message) {
+	eventsChID := eventsChID{group, topic, msg.Partition}
+	p.eventsChMapMu.Lock()
+	p.eventsChMap[eventsChID] = msg.EventsCh
+	p.eventsChMapMu.Unlock()
 }
 
 func (p *T) Ack(group, topic string, ack Ack) error {
@@ -195,13 +635,35 @@ func (p *T) Ack(group, topic string, ack Ack) error {
 		return errors.New("acks channel missing")
 	}
 	select {
-	case eventsCh <- consumer.Ack(ack.offset):
+	case eventsCh <- consumer.AckWithMeta(ack.offset, ack.meta):
 	case <-time.After(p.cfg.Consumer.LongPollingTimeout):
 		return errors.New("ack timeout")
 	}
 	return nil
 }
 
+// Nack rejects a message consumed by the specified group from the specified
+// topic. The message is offered again right away, unless it has already been
+// offered `Config.Consumer.MaxRetries` times, in which case it is produced to
+// the dead letter topic if one is configured, or dropped otherwise.
+func (p *T) Nack(group, topic string, ack Ack, reason string) error {
+	eventsChID := eventsChID{group, topic, ack.partition}
+	p.eventsChMapMu.RLock()
+	eventsCh, ok := p.eventsChMap[eventsChID]
+	p.eventsChMapMu.RUnlock()
+	if !ok {
+		return errors.New("acks channel missing")
+	}
+	select {
+	case eventsCh <- consumer.NackWithReason(ack.offset, reason):
+	case <-time.After(p.cfg.Consumer.LongPollingTimeout):
+		return errors.New("nack timeout")
+	}
+	log.Warningf("<%s> nacked: group=%s, topic=%s, partition=%d, offset=%d, reason=%s",
+		p.actorID, group, topic, ack.partition, ack.offset, reason)
+	return nil
+}
+
 // GetGroupOffsets for every partition of the specified topic it returns the
 // current offset range along with the latest offset and metadata committed by
 // the specified consumer group.
@@ -209,10 +671,318 @@ func (p *T) GetGroupOffsets(group, topic string) ([]admin.PartitionOffset, error
 	return p.admin.GetGroupOffsets(group, topic)
 }
 
-// SetGroupOffsets commits specific offset values along with metadata for a list
-// of partitions of a particular topic on behalf of the specified group.
-func (p *T) SetGroupOffsets(group, topic string, offsets []admin.PartitionOffset) error {
-	return p.admin.SetGroupOffsets(group, topic, offsets)
+// GetTopicOffsets returns the oldest and newest offsets of all partitions of
+// the specified topic.
+func (p *T) GetTopicOffsets(topic string) ([]admin.PartitionOffset, error) {
+	return p.admin.GetTopicOffsets(topic)
+}
+
+// SeekGroupOffsets commits specific offset values for a list of partitions of
+// a particular topic on behalf of the specified group, and makes partition
+// consumers of the group that run in this proxy restart consumption from the
+// committed offsets. Partitions consumed by other Kafka-Pixy instances would
+// not be affected and would overwrite the committed offsets, therefore
+// ErrGroupActive is returned if there are any, unless `force` is true. If some
+// of the local partition consumers do not take the seek in time, then
+// SeekTimeoutError is returned telling which partitions it was applied to.
+func (p *T) SeekGroupOffsets(group, topic string, offsets []admin.PartitionOffset, force bool) error {
+	if !force {
+		if err := p.CheckGroupInactive(group, topic); err != nil {
+			return err
+		}
+	}
+	if err := p.admin.SetGroupOffsets(group, topic, offsets); err != nil {
+		return err
+	}
+	var applied, timedOut []int32
+	for _, po := range offsets {
+		eventsChID := eventsChID{group, topic, po.Partition}
+		p.eventsChMapMu.RLock()
+		eventsCh, ok := p.eventsChMap[eventsChID]
+		p.eventsChMapMu.RUnlock()
+		if !ok {
+			applied = append(applied, po.Partition)
+			continue
+		}
+		select {
+		case eventsCh <- consumer.Seek(po.Offset):
+			applied = append(applied, po.Partition)
+		case <-time.After(p.cfg.Consumer.LongPollingTimeout):
+			timedOut = append(timedOut, po.Partition)
+		}
+	}
+	if len(timedOut) > 0 {
+		return &SeekTimeoutError{Applied: applied, TimedOut: timedOut}
+	}
+	return nil
+}
+
+// requestTenant returns the tenant whose quotas a request counts against: the
+// one given by WithTenant, or else the owner of the group, or of the topic if
+// no group is given.
+func (p *T) requestTenant(ctx context.Context, topic, group string) string {
+	if p.quotas == nil {
+		return ""
+	}
+	if tenant, ok := ctx.Value(tenantCtxKey).(string); ok {
+		return tenant
+	}
+	if group != "" {
+		return p.quotas.GroupTenant(group)
+	}
+	return p.quotas.TopicTenant(topic)
+}
+
+// allowBytes returns a ByteQuotaError if the tenant has used up its byte
+// quota.
+func (p *T) allowBytes(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	if ok, retryAfter := p.quotas.AllowBytes(tenant); !ok {
+		return &ByteQuotaError{Tenant: tenant, RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// takeBytes charges bytes transferred by a request against the byte quota of
+// the tenant.
+func (p *T) takeBytes(tenant string, n int) {
+	if tenant == "" || n == 0 {
+		return
+	}
+	p.quotas.TakeBytes(tenant, int64(n))
+}
+
+// acquireLongPoll checks the byte quota of the tenant and takes one of its
+// long polling slots. The returned function releases the slot.
+func (p *T) acquireLongPoll(tenant string) (func(), error) {
+	if tenant == "" {
+		return func() {}, nil
+	}
+	if err := p.allowBytes(tenant); err != nil {
+		return nil, err
+	}
+	if !p.quotas.AcquireLongPoll(tenant) {
+		return nil, ErrTooManyLongPolls
+	}
+	return func() { p.quotas.ReleaseLongPoll(tenant) }, nil
+}
+
+// messagesSize returns the total size of keys and values of messages.
+func messagesSize(msgs []consumer.Message) int {
+	size := 0
+	for _, msg := range msgs {
+		size += len(msg.Key) + len(msg.Value)
+	}
+	return size
+}
+
+// CheckGroupInactive returns ErrGroupActive if the specified topic is consumed
+// by members of the group that run in other Kafka-Pixy instances.
+func (p *T) CheckGroupInactive(group, topic string) error {
+	remoteMembers, err := p.getRemoteTopicMembers(group, topic)
+	if err != nil {
+		return err
+	}
+	if len(remoteMembers) > 0 {
+		return errors.Wrapf(ErrGroupActive, "members=%v", remoteMembers)
+	}
+	return nil
+}
+
+// CheckHealth verifies that Kafka cluster metadata can be fetched and that a
+// ZooKeeper session is alive. It returns a check name to error mapping, where
+// errors of passed checks are nil. Checks run concurrently and each is
+// bounded by healthCheckTimeout.
+func (p *T) CheckHealth() map[string]error {
+	checks := map[string]func() error{
+		HealthCheckKafka:     func() error { return p.kafkaClt.RefreshMetadata() },
+		HealthCheckZooKeeper: p.admin.CheckZooKeeper,
+	}
+	type checkResult struct {
+		name string
+		err  error
+	}
+	resultCh := make(chan checkResult, len(checks))
+	for name, check := range checks {
+		go func(name string, check func() error) {
+			resultCh <- checkResult{name, check()}
+		}(name, check)
+	}
+	results := make(map[string]error, len(checks))
+	timeoutCh := time.After(healthCheckTimeout)
+	for len(results) < len(checks) {
+		select {
+		case result := <-resultCh:
+			results[result.name] = result.err
+		case <-timeoutCh:
+			for name := range checks {
+				if _, ok := results[name]; !ok {
+					results[name] = errors.Errorf("timeout after %v", healthCheckTimeout)
+				}
+			}
+		}
+	}
+	return results
+}
+
+// getRemoteTopicMembers returns IDs of group members other than this proxy
+// that are subscribed to, or own partitions of, the specified topic.
+func (p *T) getRemoteTopicMembers(group, topic string) ([]string, error) {
+	members, err := p.admin.GetGroupMembers(group)
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	localMemberID := p.cfg.GroupMemberID(group)
+	var remoteMembers []string
+	for _, member := range members {
+		if member.ID == localMemberID {
+			continue
+		}
+		_, owns := member.Partitions[topic]
+		subscribed := false
+		for _, subscription := range member.Subscriptions {
+			subscribed = subscribed || subscription == topic
+		}
+		if owns || subscribed {
+			remoteMembers = append(remoteMembers, member.ID)
+		}
+	}
+	return remoteMembers, nil
+}
+
+// GetTimeOffsets for every partition of the specified topic returns the
+// offset of the first message with a timestamp that is greater than or equal
+// to `ts`.
+func (p *T) GetTimeOffsets(topic string, ts time.Time) ([]admin.PartitionOffset, error) {
+	return p.admin.GetTimeOffsets(topic, ts)
+}
+
+// LookupTimeOffsets is like GetTimeOffsets, but it guarantees that returned
+// offsets are precise. ErrTimeLookupNotSupported is returned if the
+// configured Kafka version cannot provide that.
+func (p *T) LookupTimeOffsets(topic string, ts time.Time) ([]admin.PartitionOffset, error) {
+	if !p.cfg.Kafka.Version.IsAtLeast(sarama.V0_10_1_0) {
+		return nil, ErrTimeLookupNotSupported
+	}
+	return p.admin.GetTimeOffsets(topic, ts)
+}
+
+// Peek returns up to `count` messages that the specified consumer group
+// would be given next from the specified topic. Group offsets are not
+// affected, and the messages are not acknowledged or otherwise tracked.
+func (p *T) Peek(ctx context.Context, group, topic string, count int) ([]consumer.Message, error) {
+	tenant := p.requestTenant(ctx, topic, group)
+	if err := p.allowBytes(tenant); err != nil {
+		return nil, err
+	}
+	msgs, err := p.admin.PeekMessages(group, topic, count)
+	if err != nil {
+		return nil, err
+	}
+	p.takeBytes(tenant, messagesSize(msgs))
+	for i := range msgs {
+		p.deserialize(&msgs[i])
+		p.transformConsumed(&msgs[i])
+	}
+	return msgs, nil
+}
+
+// GetMessages returns up to `count` messages of a topic partition starting
+// from `offset`, bypassing consumer groups altogether.
+func (p *T) GetMessages(ctx context.Context, topic string, partition int32, offset int64, count int) ([]consumer.Message, error) {
+	tenant := p.requestTenant(ctx, topic, "")
+	if err := p.allowBytes(tenant); err != nil {
+		return nil, err
+	}
+	msgs, err := p.admin.GetMessages(topic, partition, offset, count)
+	if err != nil {
+		return nil, err
+	}
+	p.takeBytes(tenant, messagesSize(msgs))
+	for i := range msgs {
+		p.deserialize(&msgs[i])
+		p.transformConsumed(&msgs[i])
+	}
+	return msgs, nil
+}
+
+// Redact redacts values of messages in place as configured by
+// `Proxy.Redaction`. It is meant for messages returned by debug endpoints,
+// e.g. peek, rather than consumed by applications.
+func (p *T) Redact(msgs []consumer.Message) {
+	for i := range msgs {
+		msgs[i].Value = p.redactor.Value(msgs[i].Value)
+	}
+}
+
+// DeadLetterOrigin returns a topic that messages of the specified dead letter
+// topic were consumed from, or an empty string if it cannot be derived from
+// the dead letter topic template.
+func (p *T) DeadLetterOrigin(dlTopic string) string {
+	return p.cfg.DeadLetterOrigin(dlTopic)
+}
+
+// Reprocess produces up to `count` messages of a dead letter topic partition
+// starting from `offset` back to `topic`, at most `rate` messages per second
+// if it is positive. Messages are produced as is, the same way they were
+// dead lettered, bypassing serialization and transformation. It returns the
+// number of messages produced, that is less than `count` if the end of the
+// partition is reached, `ctx` is done, or an error occurs. Bytes reprocessed
+// count against the byte quota of the tenant of `topic`.
+func (p *T) Reprocess(ctx context.Context, dlTopic string, partition int32, offset int64, count int, topic string, rate float64) (int, error) {
+	tenant := p.requestTenant(ctx, topic, "")
+	var nilOrTickCh <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		nilOrTickCh = ticker.C
+	}
+	reprocessed := 0
+	for reprocessed < count {
+		batchSize := count - reprocessed
+		if batchSize > reprocessBatchSize {
+			batchSize = reprocessBatchSize
+		}
+		if err := p.allowBytes(tenant); err != nil {
+			return reprocessed, err
+		}
+		msgs, err := p.admin.GetMessages(dlTopic, partition, offset, batchSize)
+		if err != nil {
+			return reprocessed, err
+		}
+		if len(msgs) == 0 {
+			return reprocessed, nil
+		}
+		for _, msg := range msgs {
+			// The first message is produced right away.
+			if nilOrTickCh != nil && reprocessed > 0 {
+				select {
+				case <-nilOrTickCh:
+				case <-ctx.Done():
+					return reprocessed, ctx.Err()
+				}
+			}
+			var key sarama.Encoder
+			if msg.Key != nil {
+				key = sarama.ByteEncoder(msg.Key)
+			}
+			if err := p.allowBytes(tenant); err != nil {
+				return reprocessed, err
+			}
+			if _, err := p.producer.Produce(topic, key, sarama.ByteEncoder(msg.Value)); err != nil {
+				return reprocessed, errors.Wrapf(err, "failed to produce, offset=%d", msg.Offset)
+			}
+			p.takeBytes(tenant, len(msg.Key)+len(msg.Value))
+			reprocessed++
+			offset = msg.Offset + 1
+		}
+	}
+	return reprocessed, nil
 }
 
 // GetTopicConsumers returns client-id -> consumed-partitions-list mapping
@@ -221,9 +991,69 @@ func (p *T) GetTopicConsumers(group, topic string) (map[string][]int32, error) {
 	return p.admin.GetTopicConsumers(group, topic)
 }
 
+// GetGroupTopics returns a sorted list of topics that are or have been
+// consumed by the specified consumer group.
+func (p *T) GetGroupTopics(group string) ([]string, error) {
+	return p.admin.GetGroupTopics(group)
+}
+
+// GetGroups returns a sorted list of consumer groups.
+func (p *T) GetGroups() ([]string, error) {
+	return p.admin.GetGroups()
+}
+
+// GetGroupMembers returns members of a consumer group along with their
+// subscriptions and owned partitions.
+func (p *T) GetGroupMembers(group string) ([]admin.GroupMember, error) {
+	return p.admin.GetGroupMembers(group)
+}
+
+// GetTopicsMetadata returns partition metadata of the specified topics, or
+// of all topics if none is specified.
+func (p *T) GetTopicsMetadata(topics ...string) ([]admin.TopicMetadata, error) {
+	return p.admin.GetTopicsMetadata(topics...)
+}
+
+// CreateTopic creates a topic as specified by `spec`.
+func (p *T) CreateTopic(spec admin.TopicSpec) error {
+	return p.admin.CreateTopic(spec)
+}
+
+// DeleteTopic marks the specified topic for deletion.
+func (p *T) DeleteTopic(topic string) error {
+	return p.admin.DeleteTopic(topic)
+}
+
 // GetAllTopicConsumers returns group -> client-id -> consumed-partitions-list
 // mapping for a particular topic. Warning, the function performs scan of all
 // consumer groups registered in ZooKeeper and therefore can take a lot of time.
 func (p *T) GetAllTopicConsumers(topic string) (map[string]map[string][]int32, error) {
 	return p.admin.GetAllTopicConsumers(topic)
 }
+
+// deadLetterer produces messages that consumer groups have given up on to
+// the dead letter topic defined by `Config.Consumer.DeadLetterTopic`.
+//
+// implements `consumer.DeadLetterer`.
+type deadLetterer struct {
+	actorID  *actor.ID
+	cfg      *config.Proxy
+	producer *producer.T
+}
+
+// implements `consumer.DeadLetterer`.
+func (dl *deadLetterer) DeadLetter(group string, msg consumer.Message, retryNo int, reason string) error {
+	dlTopic := dl.cfg.DeadLetterTopic(group, msg.Topic)
+	var key sarama.Encoder
+	if msg.Key != nil {
+		key = sarama.ByteEncoder(msg.Key)
+	}
+	// The message is produced synchronously, for its offset must not be
+	// committed until it is safe in the dead letter topic.
+	if _, err := dl.producer.Produce(dlTopic, key, sarama.ByteEncoder(msg.Value)); err != nil {
+		return errors.Wrapf(err, "failed to produce to %s", dlTopic)
+	}
+	log.Warningf("<%s> dead lettered: group=%s, topic=%s, partition=%d, offset=%d, retryNo=%d, reason=%s, dlTopic=%s",
+		dl.actorID, group, msg.Topic, msg.Partition, msg.Offset, retryNo, reason, dlTopic)
+	return nil
+}
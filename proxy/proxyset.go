@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"sort"
+
 	"github.com/pkg/errors"
 )
 
@@ -32,3 +34,13 @@ func (s *Set) Get(cluster string) (*T, error) {
 	}
 	return nil, errors.Errorf("proxy `%s` does not exist", cluster)
 }
+
+// Clusters returns a sorted list of clusters that proxies are configured for.
+func (s *Set) Clusters() []string {
+	clusters := make([]string, 0, len(s.proxies))
+	for cluster := range s.proxies {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	return clusters
+}
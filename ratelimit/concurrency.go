@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"sync"
+
+	"github.com/mailgun/kafka-pixy/config"
+)
+
+// Kinds of requests that concurrency is capped for.
+const (
+	Produce = "produce"
+	Consume = "consume"
+)
+
+// Concurrency caps the number of produce and consume requests that are served
+// at a time. Requests beyond a cap are supposed to be rejected rather than
+// wait for a slot, so that a load spike is shed instead of piling up.
+type Concurrency struct {
+	mu    sync.Mutex
+	max   map[string]int
+	inUse map[string]int
+}
+
+// NewConcurrency creates concurrency caps with the specified configuration.
+// It returns nil if no cap is configured.
+func NewConcurrency(cfg *config.HTTPConcurrency) *Concurrency {
+	if cfg.MaxProduce == 0 && cfg.MaxConsume == 0 {
+		return nil
+	}
+	return &Concurrency{
+		max: map[string]int{
+			Produce: cfg.MaxProduce,
+			Consume: cfg.MaxConsume,
+		},
+		inUse: make(map[string]int),
+	}
+}
+
+// Acquire tells whether a request of the specified kind can be served. If it
+// can, then Release must be called when the request completes.
+func (cc *Concurrency) Acquire(kind string) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	max := cc.max[kind]
+	if max == 0 {
+		return true
+	}
+	if cc.inUse[kind] >= max {
+		return false
+	}
+	cc.inUse[kind]++
+	return true
+}
+
+// Release releases a slot acquired by Acquire.
+func (cc *Concurrency) Release(kind string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.max[kind] == 0 {
+		return
+	}
+	cc.inUse[kind]--
+}
+
+// InUse returns the number of requests of the specified kind that are being
+// served. Requests of a kind that is not capped are not counted.
+func (cc *Concurrency) InUse(kind string) int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.inUse[kind]
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+// If no cap is configured, then no caps are created.
+func (s *RateLimitSuite) TestConcurrencyDisabled(c *C) {
+	c.Assert(NewConcurrency(&config.HTTPConcurrency{}), IsNil)
+}
+
+// Requests of a kind are allowed until its cap is reached, and then again
+// when slots are released. Kinds are capped independently.
+func (s *RateLimitSuite) TestConcurrency(c *C) {
+	cc := NewConcurrency(&config.HTTPConcurrency{MaxProduce: 2, MaxConsume: 1})
+
+	c.Assert(cc.Acquire(Produce), Equals, true)
+	c.Assert(cc.Acquire(Produce), Equals, true)
+	c.Assert(cc.Acquire(Produce), Equals, false)
+	c.Assert(cc.Acquire(Consume), Equals, true)
+	c.Assert(cc.Acquire(Consume), Equals, false)
+	c.Assert(cc.InUse(Produce), Equals, 2)
+
+	// When
+	cc.Release(Produce)
+
+	// Then
+	c.Assert(cc.InUse(Produce), Equals, 1)
+	c.Assert(cc.Acquire(Produce), Equals, true)
+	c.Assert(cc.Acquire(Produce), Equals, false)
+	c.Assert(cc.Acquire(Consume), Equals, false)
+}
+
+// A kind with zero cap is not limited.
+func (s *RateLimitSuite) TestConcurrencyUncapped(c *C) {
+	cc := NewConcurrency(&config.HTTPConcurrency{MaxConsume: 1})
+
+	for i := 0; i < 100; i++ {
+		c.Assert(cc.Acquire(Produce), Equals, true, Commentf("case #%d", i))
+	}
+	c.Assert(cc.InUse(Produce), Equals, 0)
+	cc.Release(Produce)
+	c.Assert(cc.InUse(Produce), Equals, 0)
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+)
+
+// Quotas enforces quotas of tenants: a token bucket of bytes that clients of
+// a tenant produce and consume, and a limit of long polling requests they can
+// have at once. Tenants that are not configured have no quotas.
+type Quotas struct {
+	clock       func() time.Time
+	topicOwners []namespace
+	groupOwners []namespace
+
+	mu      sync.Mutex
+	tenants map[string]*tenantQuota
+}
+
+// namespace is a name prefix owned by a tenant.
+type namespace struct {
+	prefix string
+	tenant string
+}
+
+type tenantQuota struct {
+	bytes        *bucket
+	maxLongPolls int
+	longPolls    int
+}
+
+// NewQuotas creates quotas of the specified tenants. It returns nil if none
+// of the tenants has a quota configured.
+func NewQuotas(tenants map[string]config.Tenant) *Quotas {
+	q := &Quotas{
+		clock:   time.Now,
+		tenants: make(map[string]*tenantQuota),
+	}
+	now := q.clock()
+	for name, tenant := range tenants {
+		if tenant.BytesPerSecond == 0 && tenant.MaxLongPolls == 0 {
+			continue
+		}
+		q.tenants[name] = &tenantQuota{
+			bytes:        newBucket(config.RateLimit{Rate: float64(tenant.BytesPerSecond)}, now),
+			maxLongPolls: tenant.MaxLongPolls,
+		}
+	}
+	if len(q.tenants) == 0 {
+		return nil
+	}
+	for name, tenant := range tenants {
+		for _, prefix := range tenant.TopicPrefixes {
+			q.topicOwners = append(q.topicOwners, namespace{prefix, name})
+		}
+		for _, prefix := range tenant.GroupPrefixes {
+			q.groupOwners = append(q.groupOwners, namespace{prefix, name})
+		}
+	}
+	return q
+}
+
+// TopicTenant returns the name of the tenant that owns a topic, that is the
+// one with the longest topic prefix that the topic starts with. An empty
+// string is returned if no tenant owns the topic.
+func (q *Quotas) TopicTenant(topic string) string {
+	return owner(q.topicOwners, topic)
+}
+
+// GroupTenant returns the name of the tenant that owns a consumer group, the
+// same way TopicTenant does it for topics.
+func (q *Quotas) GroupTenant(group string) string {
+	return owner(q.groupOwners, group)
+}
+
+func owner(namespaces []namespace, name string) string {
+	var best namespace
+	for _, ns := range namespaces {
+		if !strings.HasPrefix(name, ns.prefix) || len(ns.prefix) < len(best.prefix) {
+			continue
+		}
+		// Prefixes of different tenants can be equal, in which case the
+		// tenant is picked by name, for the choice to be stable.
+		if len(ns.prefix) == len(best.prefix) && best.tenant != "" && ns.tenant > best.tenant {
+			continue
+		}
+		best = ns
+	}
+	return best.tenant
+}
+
+// AllowBytes tells whether a client of a tenant can make a request that
+// transfers messages. A request is allowed as long as the tenant has not
+// used up its byte quota, however many bytes it transfers. If it is not
+// allowed, then it also returns how long the client should wait before
+// retrying.
+func (q *Quotas) AllowBytes(tenant string) (bool, time.Duration) {
+	now := q.clock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.tenants[tenant]
+	if tq == nil || tq.bytes == nil {
+		return true, 0
+	}
+	tq.bytes.refill(now)
+	if wait := tq.bytes.waitFor(); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+// TakeBytes charges bytes transferred by a request of a client against the
+// quota of its tenant. The quota can go into debt, in which case requests of
+// the tenant are not allowed until it is paid off.
+func (q *Quotas) TakeBytes(tenant string, n int64) {
+	now := q.clock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.tenants[tenant]
+	if tq == nil || tq.bytes == nil {
+		return
+	}
+	tq.bytes.refill(now)
+	tq.bytes.tokens -= float64(n)
+}
+
+// AcquireLongPoll tells whether a client of a tenant can start a long polling
+// request. If it can, then ReleaseLongPoll must be called when the request
+// completes.
+func (q *Quotas) AcquireLongPoll(tenant string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.tenants[tenant]
+	if tq == nil || tq.maxLongPolls == 0 {
+		return true
+	}
+	if tq.longPolls >= tq.maxLongPolls {
+		return false
+	}
+	tq.longPolls++
+	return true
+}
+
+// ReleaseLongPoll releases a long polling request slot acquired by
+// AcquireLongPoll.
+func (q *Quotas) ReleaseLongPoll(tenant string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tq := q.tenants[tenant]
+	if tq == nil || tq.maxLongPolls == 0 {
+		return
+	}
+	tq.longPolls--
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+func (s *RateLimitSuite) newQuotas(tenants map[string]config.Tenant) *Quotas {
+	q := NewQuotas(tenants)
+	q.clock = func() time.Time { return s.now }
+	for _, tq := range q.tenants {
+		if tq.bytes != nil {
+			tq.bytes.last = s.now
+		}
+	}
+	return q
+}
+
+// If no tenant has quotas, then no quotas are created.
+func (s *RateLimitSuite) TestQuotasDisabled(c *C) {
+	c.Assert(NewQuotas(nil), IsNil)
+	c.Assert(NewQuotas(map[string]config.Tenant{"foo": {TopicPrefixes: []string{"foo."}}}), IsNil)
+}
+
+// Requests are allowed until the tenant goes into debt, and then until the
+// debt is paid off.
+func (s *RateLimitSuite) TestBytes(c *C) {
+	q := s.newQuotas(map[string]config.Tenant{"foo": {BytesPerSecond: 100}})
+
+	ok, _ := q.AllowBytes("foo")
+	c.Assert(ok, Equals, true)
+	q.TakeBytes("foo", 299)
+
+	// When
+	ok, retryAfter := q.AllowBytes("foo")
+
+	// Then
+	c.Assert(ok, Equals, false)
+	c.Assert(retryAfter, Equals, 2*time.Second)
+	// Other tenants are not affected.
+	ok, _ = q.AllowBytes("bar")
+	c.Assert(ok, Equals, true)
+
+	s.now = s.now.Add(2 * time.Second)
+	ok, _ = q.AllowBytes("foo")
+	c.Assert(ok, Equals, true)
+}
+
+// A tenant can have a limited number of long polling requests at once.
+func (s *RateLimitSuite) TestLongPolls(c *C) {
+	q := s.newQuotas(map[string]config.Tenant{"foo": {MaxLongPolls: 2}})
+
+	c.Assert(q.AcquireLongPoll("foo"), Equals, true)
+	c.Assert(q.AcquireLongPoll("foo"), Equals, true)
+	c.Assert(q.AcquireLongPoll("foo"), Equals, false)
+	c.Assert(q.AcquireLongPoll("bar"), Equals, true)
+
+	// When
+	q.ReleaseLongPoll("foo")
+
+	// Then
+	c.Assert(q.AcquireLongPoll("foo"), Equals, true)
+	c.Assert(q.AcquireLongPoll("foo"), Equals, false)
+	// Tenants without a byte quota can transfer any number of bytes.
+	q.TakeBytes("foo", 1000)
+	ok, _ := q.AllowBytes("foo")
+	c.Assert(ok, Equals, true)
+}
+
+// Topics and groups are owned by the tenant with the longest matching prefix.
+func (s *RateLimitSuite) TestQuotasOwners(c *C) {
+	q := s.newQuotas(map[string]config.Tenant{
+		"foo": {TopicPrefixes: []string{"orders."}, GroupPrefixes: []string{"foo"}, MaxLongPolls: 1},
+		"bar": {TopicPrefixes: []string{"orders.eu."}, GroupPrefixes: []string{"bar"}},
+		"baz": {},
+	})
+
+	c.Assert(q.TopicTenant("orders.us"), Equals, "foo")
+	c.Assert(q.TopicTenant("orders.eu.fr"), Equals, "bar")
+	c.Assert(q.TopicTenant("invoices"), Equals, "")
+	c.Assert(q.GroupTenant("foo.reports"), Equals, "foo")
+	c.Assert(q.GroupTenant("bar"), Equals, "bar")
+	c.Assert(q.GroupTenant("baz"), Equals, "")
+}
@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+)
+
+// How often buckets that have been idle long enough to refill are dropped.
+const sweepInterval = time.Minute
+
+// T limits the rate of requests with token buckets: a global one, one per
+// client and one per topic. A request is allowed only if all buckets that it
+// is subject to have a token, in which case a token is taken from each.
+type T struct {
+	cfg   *config.HTTPRateLimit
+	clock func() time.Time
+
+	mu        sync.Mutex
+	global    *bucket
+	clients   map[string]*bucket
+	topics    map[string]*bucket
+	lastSweep time.Time
+}
+
+// New creates a rate limiter with the specified configuration. It returns nil
+// if no limits are configured.
+func New(cfg *config.HTTPRateLimit) *T {
+	if !cfg.Enabled() {
+		return nil
+	}
+	l := &T{
+		cfg:     cfg,
+		clock:   time.Now,
+		clients: make(map[string]*bucket),
+		topics:  make(map[string]*bucket),
+	}
+	l.lastSweep = l.clock()
+	l.global = newBucket(cfg.Global, l.lastSweep)
+	return l
+}
+
+// Allow tells whether a request of a client to the specified topics can be
+// served. If it cannot, then it also returns how long the client should wait
+// before retrying. `clientLimit` overrides the configured per client limit if
+// its rate is not zero.
+func (l *T) Allow(client string, clientLimit config.RateLimit, topics []string) (bool, time.Duration) {
+	now := l.clock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		sweep(l.clients, now)
+		sweep(l.topics, now)
+		l.lastSweep = now
+	}
+	buckets := make([]*bucket, 0, len(topics)+2)
+	buckets = append(buckets, l.global)
+	if clientLimit.Rate == 0 {
+		clientLimit = l.cfg.PerClient
+	}
+	buckets = append(buckets, getBucket(l.clients, client, clientLimit, now))
+	for _, topic := range topics {
+		topicLimit, ok := l.cfg.Topics[topic]
+		if !ok {
+			topicLimit = l.cfg.PerTopic
+		}
+		buckets = append(buckets, getBucket(l.topics, topic, topicLimit, now))
+	}
+
+	var retryAfter time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.refill(now)
+		if wait := b.waitFor(); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true, 0
+}
+
+// bucket is a token bucket. It is not safe for concurrent use.
+type bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newBucket creates a full bucket, or returns nil if the limit rate is zero.
+func newBucket(limit config.RateLimit, now time.Time) *bucket {
+	if limit.Rate == 0 {
+		return nil
+	}
+	capacity := float64(limit.Burst)
+	if capacity == 0 {
+		capacity = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &bucket{rate: limit.Rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// waitFor returns how long it takes for a token to become available.
+func (b *bucket) waitFor() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func getBucket(buckets map[string]*bucket, key string, limit config.RateLimit, now time.Time) *bucket {
+	if b, ok := buckets[key]; ok {
+		return b
+	}
+	b := newBucket(limit, now)
+	if b != nil {
+		buckets[key] = b
+	}
+	return b
+}
+
+// sweep drops buckets that would be full by now, for they are no different
+// from new ones.
+func sweep(buckets map[string]*bucket, now time.Time) {
+	for key, b := range buckets {
+		b.refill(now)
+		if b.tokens >= b.capacity {
+			delete(buckets, key)
+		}
+	}
+}
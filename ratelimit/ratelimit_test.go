@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&RateLimitSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *RateLimitSuite) SetUpTest(c *C) {
+	s.now = time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *RateLimitSuite) newLimiter(cfg *config.HTTPRateLimit) *T {
+	l := New(cfg)
+	l.clock = func() time.Time { return s.now }
+	l.lastSweep = s.now
+	return l
+}
+
+// If no limits are configured, then no limiter is created.
+func (s *RateLimitSuite) TestDisabled(c *C) {
+	c.Assert(New(&config.HTTPRateLimit{}), IsNil)
+	c.Assert(New(&config.HTTPRateLimit{Topics: map[string]config.RateLimit{"foo": {}}}), IsNil)
+}
+
+// A client can make a burst of requests, after that it has to wait for
+// tokens to be refilled at the configured rate.
+func (s *RateLimitSuite) TestPerClient(c *C) {
+	l := s.newLimiter(&config.HTTPRateLimit{PerClient: config.RateLimit{Rate: 2, Burst: 3}})
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a", config.RateLimit{}, nil)
+		c.Assert(ok, Equals, true, Commentf("request #%d", i))
+	}
+
+	// When
+	ok, retryAfter := l.Allow("a", config.RateLimit{}, nil)
+
+	// Then
+	c.Assert(ok, Equals, false)
+	c.Assert(retryAfter, Equals, 500*time.Millisecond)
+	// Other clients are not affected.
+	ok, _ = l.Allow("b", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, true)
+	// A token is available after 1/rate.
+	s.now = s.now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, true)
+	ok, _ = l.Allow("a", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, false)
+}
+
+// A client limit, e.g. one of an API key, overrides the per client one.
+func (s *RateLimitSuite) TestClientLimitOverride(c *C) {
+	l := s.newLimiter(&config.HTTPRateLimit{PerClient: config.RateLimit{Rate: 1}})
+	keyLimit := config.RateLimit{Rate: 10, Burst: 5}
+
+	for i := 0; i < 5; i++ {
+		ok, _ := l.Allow("key#0", keyLimit, nil)
+		c.Assert(ok, Equals, true, Commentf("request #%d", i))
+	}
+	ok, retryAfter := l.Allow("key#0", keyLimit, nil)
+	c.Assert(ok, Equals, false)
+	c.Assert(retryAfter, Equals, 100*time.Millisecond)
+}
+
+// Topic limits apply to requests of all clients, and particular topics can
+// have their own limits.
+func (s *RateLimitSuite) TestPerTopic(c *C) {
+	l := s.newLimiter(&config.HTTPRateLimit{
+		PerTopic: config.RateLimit{Rate: 1},
+		Topics:   map[string]config.RateLimit{"bar": {Rate: 2, Burst: 2}},
+	})
+
+	ok, _ := l.Allow("a", config.RateLimit{}, []string{"foo"})
+	c.Assert(ok, Equals, true)
+	ok, _ = l.Allow("b", config.RateLimit{}, []string{"foo"})
+	c.Assert(ok, Equals, false)
+	ok, _ = l.Allow("b", config.RateLimit{}, []string{"bar"})
+	c.Assert(ok, Equals, true)
+	ok, _ = l.Allow("a", config.RateLimit{}, []string{"bar"})
+	c.Assert(ok, Equals, true)
+	// Requests that name no topic are not subject to topic limits.
+	ok, _ = l.Allow("a", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, true)
+}
+
+// A rejected request does not take tokens from any bucket.
+func (s *RateLimitSuite) TestRejectedTakesNothing(c *C) {
+	l := s.newLimiter(&config.HTTPRateLimit{
+		Global:   config.RateLimit{Rate: 1, Burst: 2},
+		PerTopic: config.RateLimit{Rate: 1},
+	})
+	ok, _ := l.Allow("a", config.RateLimit{}, []string{"foo"})
+	c.Assert(ok, Equals, true)
+
+	// When
+	ok, retryAfter := l.Allow("a", config.RateLimit{}, []string{"foo"})
+
+	// Then
+	c.Assert(ok, Equals, false)
+	c.Assert(retryAfter, Equals, time.Second)
+	// The global bucket still has a token.
+	ok, _ = l.Allow("a", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, true)
+	ok, _ = l.Allow("a", config.RateLimit{}, nil)
+	c.Assert(ok, Equals, false)
+}
+
+// Buckets that are full again are dropped.
+func (s *RateLimitSuite) TestSweep(c *C) {
+	l := s.newLimiter(&config.HTTPRateLimit{PerClient: config.RateLimit{Rate: 1}})
+	l.Allow("a", config.RateLimit{}, nil)
+	s.now = s.now.Add(30 * time.Second)
+	l.Allow("b", config.RateLimit{}, nil)
+	c.Assert(len(l.clients), Equals, 2)
+
+	// When
+	s.now = s.now.Add(sweepInterval)
+	l.Allow("c", config.RateLimit{}, nil)
+
+	// Then
+	c.Assert(len(l.clients), Equals, 1)
+	c.Assert(l.clients["c"], NotNil)
+}
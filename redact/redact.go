@@ -0,0 +1,100 @@
+// Package redact implements redaction of message contents before they are
+// logged or returned by debug endpoints, so that personal data does not leak
+// into operator tooling.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/mailgun/kafka-pixy/config"
+)
+
+// Placeholder is what redacted values are replaced with.
+const Placeholder = "[REDACTED]"
+
+// T redacts message values according to `Proxy.Redaction` rules. A nil
+// redactor leaves values as they are.
+type T struct {
+	paths         [][]string
+	redactNonJSON bool
+}
+
+// New creates a redactor with the specified configuration. It returns nil if
+// no redaction is configured.
+func New(cfg *config.Proxy) *T {
+	if len(cfg.Redaction.Fields) == 0 && !cfg.Redaction.RedactNonJSON {
+		return nil
+	}
+	t := &T{redactNonJSON: cfg.Redaction.RedactNonJSON}
+	for _, field := range cfg.Redaction.Fields {
+		t.paths = append(t.paths, strings.Split(field, "."))
+	}
+	return t
+}
+
+// Value returns a message value with configured JSON fields redacted. If the
+// value is not valid JSON, then it is either redacted entirely or returned as
+// is, depending on `Redaction.RedactNonJSON`. A value that has nothing to
+// redact is returned as is, otherwise it is re-encoded, so the order of
+// fields and formatting may change.
+func (t *T) Value(value []byte) []byte {
+	if t == nil || value == nil {
+		return value
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		if t.redactNonJSON {
+			return []byte(Placeholder)
+		}
+		return value
+	}
+	var redacted bool
+	for _, path := range t.paths {
+		if redactPath(doc, path) {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return value
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return []byte(Placeholder)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// redactPath replaces values of fields at `path` in a decoded JSON document
+// in place. It returns true if anything was replaced.
+func redactPath(node interface{}, path []string) bool {
+	var redacted bool
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for name, child := range node {
+			if path[0] != "*" && path[0] != name {
+				continue
+			}
+			if len(path) == 1 {
+				node[name] = Placeholder
+				redacted = true
+				continue
+			}
+			if redactPath(child, path[1:]) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, elem := range node {
+			if redactPath(elem, path) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,75 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type RedactSuite struct{}
+
+var _ = Suite(&RedactSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func newRedactor(fields []string, redactNonJSON bool) *T {
+	cfg := config.DefaultProxy()
+	cfg.Redaction.Fields = fields
+	cfg.Redaction.RedactNonJSON = redactNonJSON
+	return New(cfg)
+}
+
+// If no redaction is configured, then no redactor is created, and a nil one
+// leaves values as they are.
+func (s *RedactSuite) TestDisabled(c *C) {
+	t := New(config.DefaultProxy())
+	c.Assert(t, IsNil)
+	c.Assert(string(t.Value([]byte(`{"email":"a@b.c"}`))), Equals, `{"email":"a@b.c"}`)
+}
+
+func (s *RedactSuite) TestValue(c *C) {
+	t := newRedactor([]string{"email", "user.phone", "items.*.ssn"}, false)
+	for i, tc := range []struct {
+		value    string
+		redacted string
+	}{{
+		value:    `{"email": "a@b.c", "id": 1}`,
+		redacted: `{"email":"[REDACTED]","id":1}`,
+	}, {
+		value:    `{"user": {"phone": "555", "name": "<Bob>"}}`,
+		redacted: `{"user":{"name":"<Bob>","phone":"[REDACTED]"}}`,
+	}, {
+		// Objects of nested fields are redacted entirely.
+		value:    `{"email": {"home": "a@b.c"}}`,
+		redacted: `{"email":"[REDACTED]"}`,
+	}, {
+		// Arrays are traversed transparently.
+		value:    `[{"email": "a@b.c"}, {"items": [{"x": {"ssn": 1}}, {"y": {"ssn": 2, "z": 3}}]}]`,
+		redacted: `[{"email":"[REDACTED]"},{"items":[{"x":{"ssn":"[REDACTED]"}},{"y":{"ssn":"[REDACTED]","z":3}}]}]`,
+	}, {
+		// Values with nothing to redact are returned as is.
+		value:    `{"id":  12345678901234567890}`,
+		redacted: `{"id":  12345678901234567890}`,
+	}, {
+		value:    `not json`,
+		redacted: `not json`,
+	}} {
+		// When
+		redacted := t.Value([]byte(tc.value))
+
+		// Then
+		c.Assert(string(redacted), Equals, tc.redacted, Commentf("case #%d", i))
+	}
+}
+
+// Values that are not JSON can be redacted entirely.
+func (s *RedactSuite) TestRedactNonJSON(c *C) {
+	t := newRedactor(nil, true)
+	c.Assert(string(t.Value([]byte(`not json`))), Equals, Placeholder)
+	c.Assert(string(t.Value([]byte(`{"a": 1} trailing`))), Equals, Placeholder)
+	c.Assert(string(t.Value([]byte(`{"a": 1}`))), Equals, `{"a": 1}`)
+	c.Assert(t.Value(nil), IsNil)
+}
@@ -0,0 +1,189 @@
+package schemareg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/avro"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The first byte of a value in the Confluent wire format, followed by a
+	// 4 byte big-endian schema ID and Avro binary data.
+	magicByte  = 0
+	headerSize = 5
+
+	// How long the latest schema of a subject is cached before it is
+	// retrieved again, so that new schema versions are picked up.
+	latestSchemaTTL = time.Minute
+
+	// Maximum number of bytes of an error response body to include in an
+	// error message.
+	maxErrorBodySize = 1024
+)
+
+// InvalidValueError is returned when a value does not match a schema it is
+// supposed to be encoded or decoded with.
+type InvalidValueError struct {
+	Err error
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid value: %v", e.Err)
+}
+
+// IsInvalidValue returns true if `err` is caused by a value that does not
+// match its schema.
+func IsInvalidValue(err error) bool {
+	_, ok := errors.Cause(err).(*InvalidValueError)
+	return ok
+}
+
+// ValueSubject returns the subject that schemas of message values of the
+// specified topic are registered under, as defined by the default subject
+// name strategy of Confluent serializers.
+func ValueSubject(topic string) string {
+	return topic + "-value"
+}
+
+// T is a Confluent Schema Registry client. Schemas retrieved by ID are cached
+// forever, since they are immutable, and the latest schemas of subjects are
+// cached for a minute.
+type T struct {
+	baseURL string
+	httpClt *http.Client
+
+	mu      sync.Mutex
+	schemas map[int32]*avro.Schema
+	latest  map[string]latestSchema
+}
+
+type latestSchema struct {
+	id        int32
+	schema    *avro.Schema
+	fetchedAt time.Time
+}
+
+type schemaRs struct {
+	ID     int32  `json:"id"`
+	Schema string `json:"schema"`
+}
+
+// New creates a schema registry client for the `schema_registry` section of
+// the proxy config.
+func New(cfg *config.Proxy) *T {
+	return &T{
+		baseURL: strings.TrimSuffix(cfg.SchemaRegistry.URL, "/"),
+		httpClt: &http.Client{Timeout: cfg.SchemaRegistry.Timeout},
+		schemas: make(map[int32]*avro.Schema),
+		latest:  make(map[string]latestSchema),
+	}
+}
+
+// Encode encodes a JSON document with the latest schema registered for the
+// subject, and returns it in the Confluent wire format.
+func (t *T) Encode(subject string, value []byte) ([]byte, error) {
+	id, schema, err := t.latestSchema(subject)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := avro.EncodeJSON(schema, value)
+	if err != nil {
+		return nil, &InvalidValueError{err}
+	}
+	data := make([]byte, headerSize, headerSize+len(encoded))
+	data[0] = magicByte
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	return append(data, encoded...), nil
+}
+
+// Decode decodes a value in the Confluent wire format to a JSON document,
+// using the schema that the value refers to.
+func (t *T) Decode(data []byte) ([]byte, error) {
+	if len(data) < headerSize || data[0] != magicByte {
+		return nil, &InvalidValueError{errors.New("not in the schema registry wire format")}
+	}
+	schema, err := t.schemaByID(int32(binary.BigEndian.Uint32(data[1:])))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := avro.DecodeJSON(schema, data[headerSize:])
+	if err != nil {
+		return nil, &InvalidValueError{err}
+	}
+	return decoded, nil
+}
+
+func (t *T) latestSchema(subject string) (int32, *avro.Schema, error) {
+	t.mu.Lock()
+	ls, ok := t.latest[subject]
+	t.mu.Unlock()
+	if ok && time.Since(ls.fetchedAt) < latestSchemaTTL {
+		return ls.id, ls.schema, nil
+	}
+	var rs schemaRs
+	if err := t.get("/subjects/"+url.PathEscape(subject)+"/versions/latest", &rs); err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to get latest schema, subject=%s", subject)
+	}
+	schema, err := avro.Parse(rs.Schema)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to parse schema, subject=%s, id=%d", subject, rs.ID)
+	}
+	t.mu.Lock()
+	t.latest[subject] = latestSchema{id: rs.ID, schema: schema, fetchedAt: time.Now()}
+	t.schemas[rs.ID] = schema
+	t.mu.Unlock()
+	return rs.ID, schema, nil
+}
+
+func (t *T) schemaByID(id int32) (*avro.Schema, error) {
+	t.mu.Lock()
+	schema, ok := t.schemas[id]
+	t.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+	var rs schemaRs
+	if err := t.get(fmt.Sprintf("/schemas/ids/%d", id), &rs); err != nil {
+		return nil, errors.Wrapf(err, "failed to get schema, id=%d", id)
+	}
+	schema, err := avro.Parse(rs.Schema)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse schema, id=%d", id)
+	}
+	t.mu.Lock()
+	t.schemas[id] = schema
+	t.mu.Unlock()
+	return schema, nil
+}
+
+func (t *T) get(path string, rs interface{}) error {
+	req, err := http.NewRequest("GET", t.baseURL+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	res, err := t.httpClt.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		return errors.Errorf("bad response: status=%d, body=%s", res.StatusCode, body)
+	}
+	if err := json.NewDecoder(res.Body).Decode(rs); err != nil {
+		return errors.Wrap(err, "failed to parse response")
+	}
+	return nil
+}
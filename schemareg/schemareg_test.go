@@ -0,0 +1,117 @@
+package schemareg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mailgun/kafka-pixy/config"
+	. "gopkg.in/check.v1"
+)
+
+type SchemaRegSuite struct {
+	srv      *httptest.Server
+	requests int32
+	cfg      *config.Proxy
+}
+
+var _ = Suite(&SchemaRegSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+const testSchema = `{\"type\": \"record\", \"name\": \"R\", \"fields\": [{\"name\": \"a\", \"type\": \"int\"}]}`
+
+func (s *SchemaRegSuite) SetUpTest(c *C) {
+	s.requests = 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subjects/foo-value/versions/latest", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		fmt.Fprintf(w, `{"subject": "foo-value", "version": 3, "id": 7, "schema": "%s"}`, testSchema)
+	})
+	mux.HandleFunc("/schemas/ids/7", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		fmt.Fprintf(w, `{"schema": "%s"}`, testSchema)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error_code": 40401, "message": "Subject not found."}`)
+	})
+	s.srv = httptest.NewServer(mux)
+	s.cfg = config.DefaultProxy()
+	s.cfg.SchemaRegistry.URL = s.srv.URL
+}
+
+func (s *SchemaRegSuite) TearDownTest(c *C) {
+	s.srv.Close()
+}
+
+// A value is encoded in the Confluent wire format with the ID of the latest
+// schema of the subject.
+func (s *SchemaRegSuite) TestEncode(c *C) {
+	sr := New(s.cfg)
+
+	// When
+	data, err := sr.Encode(ValueSubject("foo"), []byte(`{"a": 1}`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte{0, 0, 0, 0, 7, 0x02})
+}
+
+// A value in the Confluent wire format is decoded to JSON with the schema it
+// refers to.
+func (s *SchemaRegSuite) TestDecode(c *C) {
+	sr := New(s.cfg)
+
+	// When
+	value, err := sr.Decode([]byte{0, 0, 0, 0, 7, 0x02})
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, `{"a":1}`)
+}
+
+// Schemas are retrieved from the registry once and cached.
+func (s *SchemaRegSuite) TestCache(c *C) {
+	sr := New(s.cfg)
+
+	// When
+	for i := 0; i < 3; i++ {
+		data, err := sr.Encode(ValueSubject("foo"), []byte(`{"a": 1}`))
+		c.Assert(err, IsNil)
+		_, err = sr.Decode(data)
+		c.Assert(err, IsNil)
+	}
+
+	// Then
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+}
+
+// Values that do not match a schema are reported as invalid, and registry
+// errors are not.
+func (s *SchemaRegSuite) TestErrors(c *C) {
+	sr := New(s.cfg)
+
+	// When/Then
+	_, err := sr.Encode(ValueSubject("foo"), []byte(`{"a": "x"}`))
+	c.Assert(err.Error(), Equals, "invalid value: field R.a: int expected, got x")
+	c.Assert(IsInvalidValue(err), Equals, true)
+
+	_, err = sr.Decode([]byte("plain text"))
+	c.Assert(err.Error(), Equals, "invalid value: not in the schema registry wire format")
+	c.Assert(IsInvalidValue(err), Equals, true)
+
+	_, err = sr.Encode(ValueSubject("bar"), []byte(`{"a": 1}`))
+	c.Assert(err.Error(), Equals, "failed to get latest schema, subject=bar-value: "+
+		`bad response: status=404, body={"error_code": 40401, "message": "Subject not found."}`)
+	c.Assert(IsInvalidValue(err), Equals, false)
+
+	_, err = sr.Decode([]byte{0, 0, 0, 0, 8, 0x02})
+	c.Assert(err.Error(), Equals, "failed to get schema, id=8: "+
+		`bad response: status=404, body={"error_code": 40401, "message": "Subject not found."}`)
+}
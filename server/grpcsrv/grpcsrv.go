@@ -81,31 +81,41 @@ func (s *T) Stop() {
 func (s *T) Produce(ctx context.Context, req *pb.ProdRq) (*pb.ProdRs, error) {
 	pxy, err := s.proxySet.Get(req.Cluster)
 	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
 	}
 
 	if req.AsyncMode {
-		pxy.AsyncProduce(req.Topic, keyEncoderFor(req), sarama.StringEncoder(req.Message))
+		if err := pxy.AsyncProduce(ctx, req.Topic, keyEncoderFor(req), sarama.StringEncoder(req.Message)); err != nil {
+			return nil, produceError(err)
+		}
 		return &pb.ProdRs{Partition: -1, Offset: -1}, nil
 	}
 
-	prodMsg, err := pxy.Produce(req.Topic, keyEncoderFor(req), sarama.StringEncoder(req.Message))
+	prodMsg, err := pxy.Produce(ctx, req.Topic, keyEncoderFor(req), sarama.StringEncoder(req.Message))
 	if err != nil {
-		switch err {
-		case sarama.ErrUnknownTopicOrPartition:
-			return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
-		default:
-			return nil, grpc.Errorf(codes.Internal, err.Error())
-		}
+		return nil, produceError(err)
 	}
 	return &pb.ProdRs{Partition: prodMsg.Partition, Offset: prodMsg.Offset}, nil
 }
 
+// produceError converts a produce error to a gRPC error with an appropriate
+// status code.
+func produceError(err error) error {
+	switch {
+	case err == sarama.ErrUnknownTopicOrPartition, proxy.IsInvalidMessage(err):
+		return grpc.Errorf(codes.InvalidArgument, "%s", err)
+	case proxy.IsQuotaExceeded(err):
+		return grpc.Errorf(codes.ResourceExhausted, "%s", err)
+	default:
+		return grpc.Errorf(codes.Internal, "%s", err)
+	}
+}
+
 // ConsumeNAck implements pb.KafkaPixyServer
 func (s *T) ConsumeNAck(ctx context.Context, req *pb.ConsNAckRq) (*pb.ConsRs, error) {
 	pxy, err := s.proxySet.Get(req.Cluster)
 	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
 	}
 
 	var ack proxy.Ack
@@ -115,19 +125,21 @@ func (s *T) ConsumeNAck(ctx context.Context, req *pb.ConsNAckRq) (*pb.ConsRs, er
 		ack = proxy.AutoAck()
 	} else {
 		if ack, err = proxy.NewAck(req.AckPartition, req.AckOffset); err != nil {
-			return nil, grpc.Errorf(codes.InvalidArgument, errors.Wrap(err, "invalid ack").Error())
+			return nil, grpc.Errorf(codes.InvalidArgument, "%s", errors.Wrap(err, "invalid ack"))
 		}
 	}
 
-	consMsg, err := pxy.Consume(req.Group, req.Topic, ack)
+	consMsg, err := pxy.Consume(ctx, req.Group, req.Topic, ack, 0)
 	if err != nil {
-		switch err {
-		case consumer.ErrRequestTimeout:
-			return nil, grpc.Errorf(codes.NotFound, err.Error())
-		case consumer.ErrTooManyRequests:
-			return nil, grpc.Errorf(codes.ResourceExhausted, err.Error())
+		switch {
+		case err == consumer.ErrRequestTimeout:
+			return nil, grpc.Errorf(codes.NotFound, "%s", err)
+		case errors.Cause(err) == consumer.ErrTooManyRequests, proxy.IsQuotaExceeded(err):
+			return nil, grpc.Errorf(codes.ResourceExhausted, "%s", err)
+		case consumer.IsOverloaded(err):
+			return nil, grpc.Errorf(codes.Unavailable, "%s", err)
 		default:
-			return nil, grpc.Errorf(codes.Internal, err.Error())
+			return nil, grpc.Errorf(codes.Internal, "%s", err)
 		}
 	}
 	res := pb.ConsRs{
@@ -146,15 +158,15 @@ func (s *T) ConsumeNAck(ctx context.Context, req *pb.ConsNAckRq) (*pb.ConsRs, er
 func (s *T) Ack(ctx context.Context, req *pb.AckRq) (*pb.AckRs, error) {
 	pxy, err := s.proxySet.Get(req.Cluster)
 	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
 	}
 
 	ack, err := proxy.NewAck(req.Partition, req.Offset)
 	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, errors.Wrap(err, "invalid ack").Error())
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", errors.Wrap(err, "invalid ack"))
 	}
 	if err = pxy.Ack(req.Group, req.Topic, ack); err != nil {
-		return nil, grpc.Errorf(codes.Code(http.StatusInternalServerError), err.Error())
+		return nil, grpc.Errorf(codes.Code(http.StatusInternalServerError), "%s", err)
 	}
 	return &pb.AckRs{}, nil
 }
@@ -162,14 +174,14 @@ func (s *T) Ack(ctx context.Context, req *pb.AckRq) (*pb.AckRs, error) {
 func (s *T) GetOffsets(ctx context.Context, req *pb.GetOffsetsRq) (*pb.GetOffsetsRs, error) {
 	pxy, err := s.proxySet.Get(req.Cluster)
 	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
 	}
 	partitionOffsets, err := pxy.GetGroupOffsets(req.Group, req.Topic)
 	if err != nil {
 		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
-			return nil, grpc.Errorf(codes.NotFound, err.Error())
+			return nil, grpc.Errorf(codes.NotFound, "%s", err)
 		}
-		return nil, grpc.Errorf(codes.Code(http.StatusInternalServerError), err.Error())
+		return nil, grpc.Errorf(codes.Code(http.StatusInternalServerError), "%s", err)
 	}
 
 	result := pb.GetOffsetsRs{}
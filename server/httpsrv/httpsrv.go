@@ -1,28 +1,54 @@
 package httpsrv
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/user"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/admin"
+	"github.com/mailgun/kafka-pixy/audit"
+	"github.com/mailgun/kafka-pixy/auth"
+	"github.com/mailgun/kafka-pixy/config"
 	"github.com/mailgun/kafka-pixy/consumer"
 	"github.com/mailgun/kafka-pixy/consumer/offsettrk"
+	"github.com/mailgun/kafka-pixy/dedup"
+	"github.com/mailgun/kafka-pixy/logging"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/none"
 	"github.com/mailgun/kafka-pixy/offsetmgr"
 	"github.com/mailgun/kafka-pixy/prettyfmt"
 	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/mailgun/kafka-pixy/ratelimit"
+	"github.com/mailgun/kafka-pixy/websocket"
 	"github.com/mailgun/log"
 	"github.com/mailgun/manners"
 	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -30,40 +56,180 @@ const (
 	networkUnix = "unix"
 
 	// HTTP headers used by the API.
-	hdrContentLength = "Content-Length"
-	hdrContentType   = "Content-Type"
+	hdrAccept          = "Accept"
+	hdrAcceptEncoding  = "Accept-Encoding"
+	hdrAuthorization   = "Authorization"
+	hdrContentEncoding = "Content-Encoding"
+	hdrContentLength   = "Content-Length"
+	hdrContentType     = "Content-Type"
+	hdrRetryAfter      = "Retry-After"
+	hdrVary            = "Vary"
+
+	// Header that a produce request can be given a unique key with, to make
+	// its retries safe, and header that marks a response to such a retry.
+	hdrIdempotencyKey     = "Idempotency-Key"
+	hdrIdempotentReplayed = "Idempotent-Replayed"
+
+	// Headers that describe a message consumed in the raw format, where the
+	// response body is the message value.
+	hdrKafkaTopic           = "Kafka-Topic"
+	hdrKafkaKey             = "Kafka-Key"
+	hdrKafkaPartition       = "Kafka-Partition"
+	hdrKafkaOffset          = "Kafka-Offset"
+	hdrKafkaTimestamp       = "Kafka-Timestamp"
+	hdrKafkaDeliveryAttempt = "Kafka-Delivery-Attempt"
+	hdrKafkaHighWaterMark   = "Kafka-High-Watermark"
+	hdrKafkaLag             = "Kafka-Lag"
 
 	// HTTP request parameters.
-	prmCluster      = "cluster"
-	prmTopic        = "topic"
-	prmKey          = "key"
-	prmSync         = "sync"
-	prmGroup        = "group"
-	prmNoAck        = "noAck"
-	prmAckPartition = "ackPartition"
-	prmPartition    = "partition"
-	prmAckOffset    = "ackOffset"
-	prmOffset       = "offset"
+	prmCluster       = "cluster"
+	prmTopic         = "topic"
+	prmKey           = "key"
+	prmSync          = "sync"
+	prmGroup         = "group"
+	prmNoAck         = "noAck"
+	prmAckPartition  = "ackPartition"
+	prmPartition     = "partition"
+	prmAckOffset     = "ackOffset"
+	prmAckMetadata   = "ackMetadata"
+	prmMetadata      = "metadata"
+	prmOffset        = "offset"
+	prmMaxMessages   = "maxMessages"
+	prmMaxBytes      = "maxBytes"
+	prmGroupByKey    = "groupByKey"
+	prmReason        = "reason"
+	prmInitialOffset = "initialOffset"
+	prmTimeout       = "timeout"
+	prmTopics        = "topics"
+	prmTopicPattern  = "topicPattern"
+	prmCallback      = "callback"
+	prmCallbackID    = "callbackId"
+	prmCount         = "count"
+	prmTimestamp     = "timestamp"
+	prmTargetTopic   = "targetTopic"
+	prmRate          = "rate"
+	prmForce         = "force"
+
+	// Overall and individual check statuses reported by health endpoints.
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+
+	// Positions that a seek request can reset offsets to.
+	seekEarliest = "earliest"
+	seekLatest   = "latest"
+
+	// Content type of a batch produce request body where records are
+	// separated by new lines.
+	contentTypeNDJSON = "application/x-ndjson"
+
+	// Content type of a Server-Sent Events stream.
+	contentTypeEventStream = "text/event-stream"
+
+	// Media types that a consume request can accept messages in: a JSON
+	// document with base64 encoded key and value, the raw message value, or
+	// a JSON document with key and value embedded as JSON.
+	contentTypeJSON        = "application/json"
+	contentTypeOctetStream = "application/octet-stream"
+	contentTypeDecodedJSON = "application/vnd.kafka-pixy.decoded+json"
+
+	// Responses shorter than that are not worth compressing with gzip.
+	gzipMinBytes = 1024
+
+	// Maximum length of an idempotency key.
+	maxIdempotencyKeyLen = 255
+
+	// Maximum number of messages that can be acknowledged by a batch ack
+	// request, including all messages of offset ranges.
+	maxBatchAcks = 10000
+
+	// Maximum length of metadata that can be given with an ack. It is
+	// stored in the offset metadata along with sparse acks, that Kafka
+	// limits to 4096 bytes by default.
+	maxAckMetadataLen = 256
+
+	// Default and maximum number of messages returned by peek and partition
+	// read requests.
+	defaultMessageCount = 1
+	maxMessageCount     = 100
+
+	// Maximum number of messages that a reprocess request can republish.
+	maxReprocessCount = 10000
+
+	// Reasons that a consume request can be rejected for because the
+	// consumer cannot keep up: either the request buffer of the topic is
+	// full, or load shedding is triggered.
+	rejectReasonOverflow     = "buffer_overflow"
+	rejectReasonOverloaded   = "overloaded"
+	rejectReasonShuttingDown = "shutting_down"
+
+	// Reason that a produce or consume request is rejected for if as many
+	// requests of the kind as allowed are already being served.
+	rejectReasonConcurrency = "concurrency_limit"
+
+	// Maximum size of an ack message that a WebSocket client can send.
+	wsMaxAckSize = 4096
+	// How long to wait before repeating a WebSocket or SSE consume request
+	// rejected because the proxy is overloaded.
+	streamRetryBackoff = 500 * time.Millisecond
+	// How long a tail stream waits before polling partitions again after
+	// they have all been read to the end.
+	tailPollInterval = 500 * time.Millisecond
+)
+
+// ctxKey is the type of request context keys defined by this package.
+type ctxKey int
+
+const (
+	// Request context key of an authenticated `*auth.Principal`.
+	principalCtxKey ctxKey = iota
+
+	// Request context key of the user ID of a client connected over a Unix
+	// domain socket, if the listener authenticates peers.
+	peerUIDCtxKey
 )
 
 var (
 	EmptyResponse = map[string]interface{}{}
+
+	errBodyTooLarge   = errors.New("request body is too large")
+	errTooManyRecords = errors.New("too many records")
 )
 
 type T struct {
-	actorID    *actor.ID
-	addr       string
-	listener   net.Listener
-	httpServer *manners.GracefulServer
-	proxySet   *proxy.Set
-	wg         sync.WaitGroup
-	errorCh    chan error
+	actorID     *actor.ID
+	addr        string
+	listener    net.Listener
+	httpServer  *manners.GracefulServer
+	proxySet    *proxy.Set
+	maxBodyLen  int64
+	maxRecords  int
+	prodWorkers int
+	deduper     *dedup.T
+	concurrency *ratelimit.Concurrency
+	authn       *auth.T
+	auditor     *audit.T
+	wg          sync.WaitGroup
+	errorCh     chan error
+
+	// Closed when the server starts shutting down, to interrupt long polling
+	// requests in progress. Requests still in progress when
+	// `shutdownTimeout` expires have their connections closed.
+	drainCh         chan none.T
+	shutdownTimeout time.Duration
+
+	// Hijacked WebSocket and SSE connections are not tracked by the graceful
+	// server, so they are stopped and waited for separately.
+	streamStopCh chan none.T
+	streamWg     sync.WaitGroup
 }
 
 // New creates an HTTP server instance that will accept API requests at the
-// specified `network`/`address` and execute them with the specified `producer`,
-// `consumer`, or `admin`, depending on the request type.
-func New(addr string, proxySet *proxy.Set) (*T, error) {
+// address specified by the listener config and execute them with a proxy from
+// `proxySet`, depending on the request type. Any of `limiter`, `deduper`,
+// `concurrency` and `auditor` can be nil if rate limiting, deduplication,
+// concurrency caps or auditing are disabled.
+func New(lsnCfg *config.Listener, cfg *config.HTTPServer, proxySet *proxy.Set, limiter *ratelimit.T, deduper *dedup.T, concurrency *ratelimit.Concurrency, auditor *audit.T) (*T, error) {
+	addr := lsnCfg.Addr
 	network := networkUnix
 	if strings.Contains(addr, ":") {
 		network = networkTCP
@@ -73,43 +239,190 @@ func New(addr string, proxySet *proxy.Set) (*T, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create listener")
 	}
-	// If the address is Unix Domain Socket then make it accessible for everyone.
+	// If the address is Unix Domain Socket then set its permissions, by
+	// default it is accessible for everyone.
 	if network == networkUnix {
-		if err := os.Chmod(addr, 0777); err != nil {
+		if err := setSocketPermissions(addr, &lsnCfg.Socket); err != nil {
+			listener.Close()
 			return nil, errors.Wrap(err, "failed to change socket permissions")
 		}
+		if len(lsnCfg.Auth.Peers) > 0 {
+			if !peerCredSupported {
+				listener.Close()
+				return nil, errors.New("auth.peers is not supported on this platform")
+			}
+			listener = &peerCredListener{Listener: listener}
+		}
+	}
+	var tlsCfg *tls.Config
+	if lsnCfg.TLS.CertFile != "" {
+		if tlsCfg, err = newTLSConfig(lsnCfg); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "failed to configure TLS")
+		}
+		listener = manners.NewTLSListener(listener, tlsCfg)
 	}
 	// Create a graceful HTTP server instance.
 	router := mux.NewRouter()
-	httpServer := manners.NewWithServer(&http.Server{Handler: router})
+	var handler http.Handler = router
+	if limiter != nil {
+		handler = &rateLimitHandler{router: router, limiter: limiter}
+	}
+	var authenticator *auth.T
+	if lsnCfg.Auth.Enabled() {
+		if authenticator, err = auth.New(&lsnCfg.Auth, cfg.Tenants); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "failed to configure auth")
+		}
+		handler = &authHandler{router: router, next: handler, authenticator: authenticator}
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if network == networkUnix && len(lsnCfg.Auth.Peers) > 0 {
+		server.ConnContext = peerCredContext
+	}
+	// HTTP/2 is negotiated with ALPN, so it is only served over TLS. The TLS
+	// config is shared with the listener, so it is updated to advertise h2.
+	if tlsCfg != nil && cfg.HTTP2.Enabled {
+		tlsCfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		server.TLSConfig = tlsCfg
+		if err := http2.ConfigureServer(server, &http2.Server{MaxConcurrentStreams: cfg.HTTP2.MaxConcurrentStreams}); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "failed to configure HTTP/2")
+		}
+	}
+	httpServer := manners.NewWithServer(server)
 	hs := &T{
-		actorID:    actor.RootID.NewChild(fmt.Sprintf("http://%s", addr)),
-		addr:       addr,
-		listener:   manners.NewListener(listener),
-		httpServer: httpServer,
-		proxySet:   proxySet,
-		errorCh:    make(chan error, 1),
+		actorID:         actor.RootID.NewChild(fmt.Sprintf("http://%s", addr)),
+		addr:            addr,
+		listener:        manners.NewListener(listener),
+		httpServer:      httpServer,
+		proxySet:        proxySet,
+		maxBodyLen:      cfg.MaxProduceBodyBytes,
+		maxRecords:      cfg.MaxBatchRecords,
+		prodWorkers:     cfg.BatchProduceWorkers,
+		deduper:         deduper,
+		concurrency:     concurrency,
+		authn:           authenticator,
+		auditor:         auditor,
+		errorCh:         make(chan error, 1),
+		drainCh:         make(chan none.T),
+		shutdownTimeout: cfg.ShutdownTimeout,
+		streamStopCh:    make(chan none.T),
 	}
 	// Configure the API request handlers.
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/messages", prmCluster, prmTopic), hs.handleProduce).Methods("POST")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/messages", prmTopic), hs.handleProduce).Methods("POST")
+	if lsnCfg.API == config.ListenerAPIAll || lsnCfg.API == config.ListenerAPIData {
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/messages", prmCluster, prmTopic), hs.timed("produce", hs.bounded(ratelimit.Produce, hs.idempotent(hs.handleProduce)))).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/messages", prmTopic), hs.timed("produce", hs.bounded(ratelimit.Produce, hs.idempotent(hs.handleProduce)))).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/batch", prmCluster, prmTopic), hs.timed("produce_batch", hs.bounded(ratelimit.Produce, hs.idempotent(hs.handleProduceBatch)))).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/batch", prmTopic), hs.timed("produce_batch", hs.bounded(ratelimit.Produce, hs.idempotent(hs.handleProduceBatch)))).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/messages", prmCluster, prmTopic), hs.timed("consume", hs.bounded(ratelimit.Consume, hs.compressed(hs.drained(hs.handleConsume))))).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/messages", prmTopic), hs.timed("consume", hs.bounded(ratelimit.Consume, hs.compressed(hs.drained(hs.handleConsume))))).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/messages", prmCluster), hs.timed("consume_any", hs.bounded(ratelimit.Consume, hs.compressed(hs.drained(hs.handleConsumeAny))))).Methods("GET")
+		router.HandleFunc("/messages", hs.timed("consume_any", hs.bounded(ratelimit.Consume, hs.compressed(hs.drained(hs.handleConsumeAny))))).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/peek", prmCluster, prmTopic), hs.timed("peek", hs.compressed(hs.handlePeek))).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/peek", prmTopic), hs.timed("peek", hs.compressed(hs.handlePeek))).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/partitions/{%s}/messages", prmCluster, prmTopic, prmPartition), hs.timed("read_partition", hs.compressed(hs.handleReadPartition))).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/partitions/{%s}/messages", prmTopic, prmPartition), hs.timed("read_partition", hs.compressed(hs.handleReadPartition))).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/tail", prmCluster, prmTopic), http1Only(hs.handleTail)).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/tail", prmTopic), http1Only(hs.handleTail)).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/reprocess", prmCluster, prmTopic), hs.timed("reprocess", hs.audited("reprocess", hs.handleReprocess))).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/reprocess", prmTopic), hs.timed("reprocess", hs.audited("reprocess", hs.handleReprocess))).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/acks", prmCluster, prmTopic), hs.timed("ack", hs.handleAck)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/acks", prmTopic), hs.timed("ack", hs.handleAck)).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/acks/batch", prmCluster, prmTopic), hs.timed("ack_batch", hs.handleAckBatch)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/acks/batch", prmTopic), hs.timed("ack_batch", hs.handleAckBatch)).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/nacks", prmCluster, prmTopic), hs.timed("nack", hs.handleNack)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/nacks", prmTopic), hs.timed("nack", hs.handleNack)).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/ws", prmCluster, prmTopic), http1Only(hs.handleConsumeWS)).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/ws", prmTopic), http1Only(hs.handleConsumeWS)).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/events", prmCluster, prmTopic), http1Only(hs.handleConsumeSSE)).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/events", prmTopic), http1Only(hs.handleConsumeSSE)).Methods("GET")
+	}
+	if lsnCfg.API == config.ListenerAPIAll || lsnCfg.API == config.ListenerAPIAdmin {
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/offsets", prmCluster, prmTopic), hs.handleGetOffsets).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/offsets", prmTopic), hs.handleGetOffsets).Methods("GET")
 
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/messages", prmCluster, prmTopic), hs.handleConsume).Methods("GET")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/messages", prmTopic), hs.handleConsume).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/offsets", prmCluster, prmTopic), hs.audited("set_offsets", hs.handleSetOffsets)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/offsets", prmTopic), hs.audited("set_offsets", hs.handleSetOffsets)).Methods("POST")
 
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/acks", prmCluster, prmTopic), hs.handleConsume).Methods("POST")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/acks", prmTopic), hs.handleConsume).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/offsets/lookup", prmCluster, prmTopic), hs.handleLookupOffsets).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/offsets/lookup", prmTopic), hs.handleLookupOffsets).Methods("GET")
 
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/offsets", prmCluster, prmTopic), hs.handleGetOffsets).Methods("GET")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/offsets", prmTopic), hs.handleGetOffsets).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}/topics/{%s}/offsets", prmCluster, prmGroup, prmTopic), hs.handleGetOffsets).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}/topics/{%s}/offsets", prmGroup, prmTopic), hs.handleGetOffsets).Methods("GET")
 
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/offsets", prmCluster, prmTopic), hs.handleSetOffsets).Methods("POST")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/offsets", prmTopic), hs.handleSetOffsets).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}/topics/{%s}/offsets", prmCluster, prmGroup, prmTopic), hs.audited("seek_offsets", hs.handleSeekOffsets)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}/topics/{%s}/offsets", prmGroup, prmTopic), hs.audited("seek_offsets", hs.handleSeekOffsets)).Methods("POST")
 
-	router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/consumers", prmCluster, prmTopic), hs.handleGetTopicConsumers).Methods("GET")
-	router.HandleFunc(fmt.Sprintf("/topics/{%s}/consumers", prmTopic), hs.handleGetTopicConsumers).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}/consumers", prmCluster, prmTopic), hs.handleGetTopicConsumers).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}/consumers", prmTopic), hs.handleGetTopicConsumers).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics", prmCluster), hs.handleGetTopics).Methods("GET")
+		router.HandleFunc("/topics", hs.handleGetTopics).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}", prmCluster, prmTopic), hs.handleGetTopic).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}", prmTopic), hs.handleGetTopic).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics", prmCluster), hs.audited("create_topic", hs.handleCreateTopic)).Methods("POST")
+		router.HandleFunc("/topics", hs.audited("create_topic", hs.handleCreateTopic)).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/topics/{%s}", prmCluster, prmTopic), hs.audited("delete_topic", hs.handleDeleteTopic)).Methods("DELETE")
+		router.HandleFunc(fmt.Sprintf("/topics/{%s}", prmTopic), hs.audited("delete_topic", hs.handleDeleteTopic)).Methods("DELETE")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups", prmCluster), hs.handleGetGroups).Methods("GET")
+		router.HandleFunc("/groups", hs.handleGetGroups).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}", prmCluster, prmGroup), hs.handleGetGroup).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}", prmGroup), hs.handleGetGroup).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}/offsets", prmCluster, prmGroup), hs.handleExportGroupOffsets).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}/offsets", prmGroup), hs.handleExportGroupOffsets).Methods("GET")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}/offsets", prmCluster, prmGroup), hs.audited("import_group_offsets", hs.handleImportGroupOffsets)).Methods("POST")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}/offsets", prmGroup), hs.audited("import_group_offsets", hs.handleImportGroupOffsets)).Methods("POST")
+
+		router.HandleFunc(fmt.Sprintf("/clusters/{%s}/groups/{%s}/lag", prmCluster, prmGroup), hs.handleGetGroupLag).Methods("GET")
+		router.HandleFunc(fmt.Sprintf("/groups/{%s}/lag", prmGroup), hs.handleGetGroupLag).Methods("GET")
+
+		router.HandleFunc("/_debug/actors", hs.handleGetActors).Methods("GET")
+		router.HandleFunc("/_debug/state", hs.handleGetState).Methods("GET")
+
+		router.HandleFunc("/_log/level", hs.handleGetLogLevel).Methods("GET")
+		router.HandleFunc("/_log/level", hs.audited("set_log_level", hs.handleSetLogLevel)).Methods("PUT")
+
+		if cfg.Pprof {
+			router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+		}
+	}
 
 	router.HandleFunc("/_ping", hs.handlePing).Methods("GET")
+	router.HandleFunc("/healthz", hs.handleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", hs.handleReadyz).Methods("GET")
+	router.HandleFunc("/_metrics", hs.handleGetMetrics).Methods("GET")
+	router.HandleFunc("/metrics", hs.handleGetPrometheusMetrics).Methods("GET")
 	return hs, nil
 }
 
@@ -131,232 +444,2694 @@ func (s *T) ErrorCh() <-chan error {
 }
 
 // Stop gracefully stops the HTTP API server. It stops listening on the socket
-// for incoming requests first, and then blocks waiting for pending requests to
-// complete.
+// for incoming requests first, interrupts long polling consume requests, and
+// then blocks waiting for pending requests to complete, but no longer than
+// the shutdown timeout, after which connections are closed. WebSocket and SSE
+// connections are closed after that.
 func (s *T) Stop() {
 	s.httpServer.Close()
-	s.wg.Wait()
+	close(s.drainCh)
+	doneCh := make(chan none.T)
+	go func() {
+		s.wg.Wait()
+		close(doneCh)
+	}()
+	var timeoutCh <-chan time.Time
+	if s.shutdownTimeout > 0 {
+		timeoutCh = time.After(s.shutdownTimeout)
+	}
+	select {
+	case <-doneCh:
+	case <-timeoutCh:
+		log.Warningf("<%s> shutdown timed out, closing connections", s.actorID)
+		s.httpServer.Server.Close()
+		<-doneCh
+	}
+	close(s.streamStopCh)
+	s.streamWg.Wait()
+	if s.authn != nil {
+		if err := s.authn.Close(); err != nil {
+			log.Errorf("<%s> failed to close authenticator: err=(%s)", s.actorID, err)
+		}
+	}
 	close(s.errorCh)
 }
 
-func (s *T) getProxy(r *http.Request) (*proxy.T, error) {
-	cluster := mux.Vars(r)[prmCluster]
-	return s.proxySet.Get(cluster)
+// timed wraps an HTTP request handler to record how long it takes to serve a
+// request in the `http_request_latency_ms` histogram labeled with `op`.
+func (s *T) timed(op string, handler http.HandlerFunc) http.HandlerFunc {
+	latency := metrics.Histogram("http_request_latency_ms", "op", op)
+	return func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		handler(w, r)
+		latency.Update(int64(time.Since(begin) / time.Millisecond))
+	}
 }
 
-// handleProduce is an HTTP request handler for `POST /topic/{topic}/messages`
-func (s *T) handleProduce(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+// idempotent makes a produce handler remember successful responses to
+// requests with an `Idempotency-Key` header, so that a retry of a request
+// gets the same response without messages being produced again. Keys are
+// scoped by the client and the request path.
+func (s *T) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	if s.deduper == nil {
+		return handler
 	}
-	topic := mux.Vars(r)[prmTopic]
-	key := getParamBytes(r, prmKey)
-	_, isSync := r.Form[prmSync]
-
-	// Get the message body from the HTTP request.
-	var msg sarama.Encoder
-	if msg, err = s.readMsg(r); err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(hdrIdempotencyKey)
+		if idempotencyKey == "" {
+			handler(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLen {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{
+				fmt.Sprintf("idempotency key is too long: limit=%d", maxIdempotencyKeyLen)})
+			return
+		}
+		key := r.URL.Path + "\x00" + idempotencyKey
+		if principal, ok := r.Context().Value(principalCtxKey).(*auth.Principal); ok {
+			key = principal.ID() + "\x00" + key
+		}
+		rs, ok := s.deduper.Reserve(key)
+		if !ok {
+			if rs == nil {
+				respondWithJSON(w, http.StatusConflict, errorRs{"request with the same idempotency key is in progress"})
+				return
+			}
+			w.Header().Set(hdrContentType, "application/json")
+			w.Header().Set(hdrIdempotentReplayed, "true")
+			w.WriteHeader(rs.Status)
+			w.Write(rs.Body)
+			return
+		}
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			s.deduper.Release(key)
+			return
+		}
+		s.deduper.Complete(key, dedup.Response{Status: rec.status, Body: rec.body.Bytes()})
 	}
+}
 
-	// Asynchronously submit the message to the Kafka cluster.
-	if !isSync {
-		pxy.AsyncProduce(topic, toEncoderPreservingNil(key), msg)
-		respondWithJSON(w, http.StatusOK, EmptyResponse)
-		return
+// bounded rejects produce or consume requests, depending on `kind`, with
+// `503 Service Unavailable` if as many of them as allowed by
+// `http.concurrency` are already being served by all listeners.
+func (s *T) bounded(kind string, handler http.HandlerFunc) http.HandlerFunc {
+	if s.concurrency == nil {
+		return handler
 	}
-
-	prodMsg, err := pxy.Produce(topic, toEncoderPreservingNil(key), msg)
-	if err != nil {
-		var status int
-		switch err {
-		case sarama.ErrUnknownTopicOrPartition:
-			status = http.StatusNotFound
-		default:
-			status = http.StatusInternalServerError
+	inFlight := metrics.Gauge("http_requests_in_flight", "kind", kind)
+	rejected := metrics.Counter("http_requests_shed", "kind", kind)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.concurrency.Acquire(kind) {
+			rejected.Inc(1)
+			w.Header().Set(hdrRetryAfter, "1")
+			respondWithJSON(w, http.StatusServiceUnavailable, rejectedRs{
+				Error:        fmt.Sprintf("too many concurrent %s requests", kind),
+				Reason:       rejectReasonConcurrency,
+				RetryAfterMs: int64(time.Second / time.Millisecond),
+			})
+			return
 		}
-		respondWithJSON(w, status, errorRs{err.Error()})
-		return
+		inFlight.Update(int64(s.concurrency.InUse(kind)))
+		defer func() {
+			s.concurrency.Release(kind)
+			inFlight.Update(int64(s.concurrency.InUse(kind)))
+		}()
+		handler(w, r)
 	}
+}
 
-	respondWithJSON(w, http.StatusOK, produceRs{
-		Partition: prodMsg.Partition,
-		Offset:    prodMsg.Offset,
-	})
+// drained makes a long polling request handler give up waiting for messages
+// as soon as the server starts shutting down, rather than keep the shutdown
+// waiting for as long as the long polling timeout.
+func (s *T) drained(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.drainCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		handler(w, r.WithContext(ctx))
+	}
 }
 
-// readMsg reads message from the HTTP request based on the Content-Type header.
-func (s *T) readMsg(r *http.Request) (sarama.Encoder, error) {
-	contentType := r.Header.Get(hdrContentType)
-	if contentType == "text/plain" || contentType == "application/json" {
-		if _, ok := r.Header[hdrContentLength]; !ok {
-			return nil, errors.Errorf("missing %s header", hdrContentLength)
+// http1Only rejects requests to a handler that hijacks the connection with
+// `505 HTTP Version Not Supported` if they come over HTTP/2, where
+// connections cannot be hijacked.
+func http1Only(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 {
+			respondWithJSON(w, http.StatusHTTPVersionNotSupported, errorRs{"streaming requires HTTP/1.1"})
+			return
 		}
-		messageSizeStr := r.Header.Get(hdrContentLength)
-		msgSize, err := strconv.Atoi(messageSizeStr)
-		if err != nil {
-			return nil, errors.Errorf("invalid %s header: %s", hdrContentLength, messageSizeStr)
+		handler(w, r)
+	}
+}
+
+// compressed makes a handler compress its response with gzip if the client
+// accepts it and the response is not too short to bother.
+func (s *T) compressed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(hdrVary, hdrAcceptEncoding)
+		if !acceptsGzip(r) {
+			handler(w, r)
+			return
 		}
-		msg, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to read message")
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		handler(gw, r)
+	}
+}
+
+// acceptsGzip returns true if the `Accept-Encoding` header of a request
+// allows gzip, either explicitly or with a wildcard.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(strings.Join(r.Header[hdrAcceptEncoding], ","), ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "x-gzip" && name != "*" {
+			continue
 		}
-		if len(msg) != msgSize {
-			return nil, errors.Errorf("message size does not match %s: expected=%v, actual=%v",
-				hdrContentLength, msgSize, len(msg))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
 		}
-		return sarama.ByteEncoder(msg), nil
+		return q > 0
 	}
-	if contentType == "application/x-www-form-urlencoded" {
-		msg := r.FormValue("msg")
-		if msg == "" {
-			return nil, errors.Errorf("empty message")
-		}
-		return sarama.StringEncoder(msg), nil
+	return false
+}
+
+// gzipWriter is an `http.ResponseWriter` that buffers a response body until
+// it is `gzipMinBytes` long, and then compresses it with gzip. A shorter
+// response is sent as is when the writer is closed.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+// implements `http.ResponseWriter`.
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
 	}
-	return nil, errors.Errorf("unsupported content type %s", contentType)
 }
 
-// handleConsume is an HTTP request handler for `GET /topic/{topic}/messages`
-func (s *T) handleConsume(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// implements `http.ResponseWriter`.
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) < gzipMinBytes {
+		return len(b), nil
+	}
+	hdr := gw.ResponseWriter.Header()
+	hdr.Del(hdrContentLength)
+	hdr.Set(hdrContentEncoding, "gzip")
+	gw.writeHeader()
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	if _, err := gw.gz.Write(gw.buf); err != nil {
+		return 0, err
+	}
+	gw.buf = nil
+	return len(b), nil
+}
 
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+func (gw *gzipWriter) writeHeader() {
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
 	}
-	topic := mux.Vars(r)[prmTopic]
-	group, err := getGroupParam(r, false)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+}
+
+// close either completes the gzip stream, or sends the buffered response
+// body as is if it turned out too short to compress.
+func (gw *gzipWriter) close() {
+	if gw.gz != nil {
+		if err := gw.gz.Close(); err != nil {
+			log.Errorf("Failed to send HTTP response: err=%+v", err)
+		}
 		return
 	}
-	ack, err := parseAck(r, true)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+	gw.writeHeader()
+	if len(gw.buf) == 0 {
 		return
 	}
+	if _, err := gw.ResponseWriter.Write(gw.buf); err != nil {
+		log.Errorf("Failed to send HTTP response: status=%d, err=%+v", gw.status, err)
+	}
+}
 
-	consMsg, err := pxy.Consume(group, topic, ack)
-	if err != nil {
-		var status int
-		switch err {
-		case consumer.ErrRequestTimeout:
-			status = http.StatusRequestTimeout
-		case consumer.ErrTooManyRequests:
-			status = http.StatusTooManyRequests
-		default:
-			status = http.StatusInternalServerError
+// audited makes a handler of an administrative request that changes state
+// record who made the request, what it was, and how it ended to the audit
+// sinks.
+func (s *T) audited(op string, handler http.HandlerFunc) http.HandlerFunc {
+	if s.auditor == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := &capturingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		begin := time.Now()
+		handler(rec, r)
+		auditRec := audit.Record{
+			Time:          begin,
+			RemoteAddr:    r.RemoteAddr,
+			Operation:     op,
+			Cluster:       mux.Vars(r)[prmCluster],
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Body:          body.buf.String(),
+			BodyTruncated: body.truncated,
+			Status:        rec.status,
 		}
-		respondWithJSON(w, status, errorRs{err.Error()})
-		return
+		if principal, ok := r.Context().Value(principalCtxKey).(*auth.Principal); ok {
+			auditRec.Principal = principal.ID()
+		}
+		s.auditor.Record(auditRec)
 	}
+}
 
-	respondWithJSON(w, http.StatusOK, consumeRs{
-		Key:       consMsg.Key,
-		Value:     consMsg.Value,
-		Partition: consMsg.Partition,
-		Offset:    consMsg.Offset,
-	})
+// capturingReader is an `io.ReadCloser` that keeps a copy of up to
+// `audit.MaxBodyLen` first bytes read.
+type capturingReader struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	truncated bool
 }
 
-// handleConsume is an HTTP request handler for `GET /topic/{topic}/messages`
-func (s *T) handleAck(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// implements `io.Reader`.
+func (cr *capturingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	if room := audit.MaxBodyLen - cr.buf.Len(); n > room {
+		cr.buf.Write(p[:room])
+		cr.truncated = true
+	} else {
+		cr.buf.Write(p[:n])
+	}
+	return n, err
+}
 
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+// recordingWriter is an `http.ResponseWriter` that keeps a copy of the
+// response status and body.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// implements `http.ResponseWriter`.
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// implements `http.ResponseWriter`.
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (s *T) getProxy(r *http.Request) (*proxy.T, error) {
+	cluster := mux.Vars(r)[prmCluster]
+	return s.proxySet.Get(cluster)
+}
+
+// setSocketPermissions sets the mode and the ownership of a Unix domain
+// socket file.
+func setSocketPermissions(addr string, socketCfg *config.UnixSocket) error {
+	if err := os.Chmod(addr, socketCfg.FileMode()); err != nil {
+		return err
 	}
-	topic := mux.Vars(r)[prmTopic]
-	group, err := getGroupParam(r, false)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+	if socketCfg.User == "" && socketCfg.Group == "" {
+		return nil
 	}
-	ack, err := parseAck(r, true)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+	uid, gid := -1, -1
+	if socketCfg.User != "" {
+		u, err := user.Lookup(socketCfg.User)
+		if err != nil {
+			if u, err = user.LookupId(socketCfg.User); err != nil {
+				return errors.Wrapf(err, "unknown user, %s", socketCfg.User)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return errors.Wrapf(err, "bad user id, %s", u.Uid)
+		}
+	}
+	if socketCfg.Group != "" {
+		g, err := user.LookupGroup(socketCfg.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(socketCfg.Group); err != nil {
+				return errors.Wrapf(err, "unknown group, %s", socketCfg.Group)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return errors.Wrapf(err, "bad group id, %s", g.Gid)
+		}
 	}
+	return os.Chown(addr, uid, gid)
+}
 
-	err = pxy.Ack(group, topic, ack)
+// newTLSConfig creates a TLS configuration from a listener config. If a client
+// CA file is specified then clients are required to present a certificate
+// signed by one of the CAs from the file.
+func newTLSConfig(lsnCfg *config.Listener) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(lsnCfg.TLS.CertFile, lsnCfg.TLS.KeyFile)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
-		return
+		return nil, errors.Wrap(err, "failed to load key pair")
 	}
-	respondWithJSON(w, http.StatusOK, EmptyResponse)
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if lsnCfg.TLS.ClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(lsnCfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client CA file")
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in %s", lsnCfg.TLS.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = clientCAs
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
 }
 
-// handleGetOffsets is an HTTP request handler for `GET /topic/{topic}/offsets`
-func (s *T) handleGetOffsets(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// authHandler rejects requests that do not provide a valid token in an
+// `Authorization: Bearer <token>` header, requests of clients with
+// restricted access that name topics or consumer groups they do not have
+// access to, and requests that ACL rules do not grant. Health checks are
+// authenticated but not authorized.
+type authHandler struct {
+	router        *mux.Router
+	next          http.Handler
+	authenticator *auth.T
+}
 
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+// implements `http.Handler`.
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const bearerPrefix = "Bearer "
+	var token string
+	if authorization := r.Header.Get(hdrAuthorization); strings.HasPrefix(authorization, bearerPrefix) {
+		token = authorization[len(bearerPrefix):]
+	}
+	var (
+		principal *auth.Principal
+		err       error
+	)
+	if uid, ok := r.Context().Value(peerUIDCtxKey).(uint32); ok && token == "" {
+		principal, err = h.authenticator.AuthenticatePeer(uid)
+	} else {
+		principal, err = h.authenticator.Authenticate(token)
 	}
-	topic := mux.Vars(r)[prmTopic]
-	group, err := getGroupParam(r, false)
 	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		respondWithJSON(w, http.StatusUnauthorized, errorRs{err.Error()})
 		return
 	}
-
-	partitionOffsets, err := pxy.GetGroupOffsets(group, topic)
-	if err != nil {
-		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
-			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
-			return
+	var match mux.RouteMatch
+	if !healthCheckPaths[r.URL.Path] && h.router.Match(r, &match) {
+		rq := auth.Request{
+			Operation: requestOperation(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Topics:    requestTopics(r, match.Vars),
+			Groups:    requestGroups(r, match.Vars),
 		}
-		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		var err error
+		if principal.Restricted() {
+			err = authorize(principal, r, match.Vars)
+		}
+		if err == nil {
+			err = h.authenticator.Authorize(principal, rq)
+		}
+		if auditErr := h.authenticator.Audit(principal, rq, err); auditErr != nil {
+			log.Errorf("Failed to audit request: err=(%s)", auditErr)
+		}
+		if err != nil {
+			respondWithJSON(w, http.StatusForbidden, errorRs{err.Error()})
+			return
+		}
+	}
+	ctx := context.WithValue(r.Context(), principalCtxKey, principal)
+	if tenant := principal.Tenant(); tenant != "" {
+		ctx = proxy.WithTenant(ctx, tenant)
+	}
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+var healthCheckPaths = map[string]bool{
+	"/_ping":   true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// requestOperation tells which ACL operation a request is. Produce and
+// consume are told apart from admin requests by the path that follows
+// `/topics/{topic}`, since topic names can coincide with path elements.
+func requestOperation(r *http.Request) config.ACLOperation {
+	elems := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(elems) >= 2 && elems[0] == "clusters" {
+		elems = elems[2:]
+	}
+	if len(elems) == 1 && elems[0] == "messages" {
+		return config.ACLConsume
+	}
+	if len(elems) < 3 || elems[0] != "topics" {
+		return config.ACLAdmin
+	}
+	switch strings.Join(elems[2:], "/") {
+	case "messages":
+		if r.Method == "POST" {
+			return config.ACLProduce
+		}
+		return config.ACLConsume
+	case "batch":
+		return config.ACLProduce
+	case "peek", "tail", "ws", "events", "acks", "acks/batch", "nacks":
+		return config.ACLConsume
+	}
+	if len(elems) == 5 && elems[2] == "partitions" && elems[4] == "messages" {
+		return config.ACLConsume
+	}
+	return config.ACLAdmin
+}
+
+// authorize checks that a principal has access to all topics and consumer
+// groups named in a request. A principal with restricted access is not
+// allowed to make requests that name neither, e.g. listing all topics.
+func authorize(principal *auth.Principal, r *http.Request, vars map[string]string) error {
+	topics := requestTopics(r, vars)
+	groups := requestGroups(r, vars)
+	if _, ok := r.URL.Query()[prmTopicPattern]; ok && !principal.AllTopics() {
+		return errors.Errorf("%s requires access to all topics", prmTopicPattern)
+	}
+	if len(topics) == 0 && len(groups) == 0 && !principal.AllTopics() {
+		return errors.New("access to cluster-wide endpoints is not allowed")
+	}
+	for _, topic := range topics {
+		if !principal.CanAccessTopic(topic) {
+			return errors.Errorf("access to topic %s is not allowed", topic)
+		}
+	}
+	for _, group := range groups {
+		if !principal.CanAccessGroup(group) {
+			return errors.Errorf("access to group %s is not allowed", group)
+		}
+	}
+	return nil
+}
+
+// authorizeTopics checks that the principal of a request is allowed to
+// perform an operation on topics that are not named by the route or the query
+// string, e.g. ones derived from other parameters or from the request body.
+// Access to them is checked and audited the same way as by `authHandler`.
+func (s *T) authorizeTopics(r *http.Request, op config.ACLOperation, topics []string) error {
+	principal, ok := r.Context().Value(principalCtxKey).(*auth.Principal)
+	if !ok || len(topics) == 0 {
+		return nil
+	}
+	rq := auth.Request{
+		Operation: op,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Topics:    topics,
+	}
+	var err error
+	if principal.Restricted() {
+		for _, topic := range topics {
+			if !principal.CanAccessTopic(topic) {
+				err = errors.Errorf("access to topic %s is not allowed", topic)
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = s.authn.Authorize(principal, rq)
+	}
+	if auditErr := s.authn.Audit(principal, rq, err); auditErr != nil {
+		log.Errorf("Failed to audit request: err=(%s)", auditErr)
+	}
+	return err
+}
+
+// filterTopics returns those of topics that the principal of a request is
+// allowed to perform an operation on, so that responses do not disclose
+// topics that the principal has no access to.
+func (s *T) filterTopics(r *http.Request, op config.ACLOperation, topics []string) []string {
+	principal, ok := r.Context().Value(principalCtxKey).(*auth.Principal)
+	if !ok {
+		return topics
+	}
+	var allowed []string
+	for _, topic := range topics {
+		if principal.Restricted() && !principal.CanAccessTopic(topic) {
+			continue
+		}
+		rq := auth.Request{
+			Operation: op,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Topics:    []string{topic},
+		}
+		if s.authn.Authorize(principal, rq) != nil {
+			continue
+		}
+		allowed = append(allowed, topic)
+	}
+	return allowed
+}
+
+// requestTopics returns topics named in a request either by the route
+// variables or by the `topics` parameter.
+func requestTopics(r *http.Request, vars map[string]string) []string {
+	var topics []string
+	if topic, ok := vars[prmTopic]; ok {
+		topics = append(topics, topic)
+	}
+	for _, topicsStr := range r.URL.Query()[prmTopics] {
+		topics = append(topics, strings.Split(topicsStr, ",")...)
+	}
+	return topics
+}
+
+// requestGroups returns consumer groups named in a request either by the
+// route variables or by the `group` parameter.
+func requestGroups(r *http.Request, vars map[string]string) []string {
+	var groups []string
+	if group, ok := vars[prmGroup]; ok {
+		groups = append(groups, group)
+	}
+	return append(groups, r.URL.Query()[prmGroup]...)
+}
+
+// rateLimitHandler rejects requests that exceed the global, per client or
+// per topic rate limits with `429 Too Many Requests`. Health check and
+// metrics requests are never limited, so that probes and monitoring keep
+// working when the proxy is overloaded.
+type rateLimitHandler struct {
+	router  *mux.Router
+	limiter *ratelimit.T
+}
+
+var rateLimitExemptPaths = map[string]bool{
+	"/_ping":    true,
+	"/healthz":  true,
+	"/readyz":   true,
+	"/_metrics": true,
+	"/metrics":  true,
+}
+
+// implements `http.Handler`.
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rateLimitExemptPaths[r.URL.Path] {
+		h.router.ServeHTTP(w, r)
+		return
+	}
+	var clientLimit config.RateLimit
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = host
+	}
+	if principal, ok := r.Context().Value(principalCtxKey).(*auth.Principal); ok {
+		client = principal.ID()
+		clientLimit = principal.RateLimit()
+	}
+	var topics []string
+	var match mux.RouteMatch
+	if h.router.Match(r, &match) {
+		topics = requestTopics(r, match.Vars)
+	}
+	if ok, retryAfter := h.limiter.Allow(client, clientLimit, topics); !ok {
+		w.Header().Set(hdrRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithJSON(w, http.StatusTooManyRequests, errorRs{"rate limit exceeded"})
+		return
+	}
+	h.router.ServeHTTP(w, r)
+}
+
+// handleProduce is an HTTP request handler for `POST /topic/{topic}/messages`
+func (s *T) handleProduce(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !s.prepareProduceBody(w, r) {
+		return
+	}
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	key := getParamBytes(r, prmKey)
+	_, isSync := r.Form[prmSync]
+
+	// Get the message body from the HTTP request.
+	var msg sarama.Encoder
+	if msg, err = s.readMsg(r); err != nil {
+		if errors.Cause(err) == errBodyTooLarge {
+			respondWithJSON(w, http.StatusRequestEntityTooLarge, errorRs{
+				fmt.Sprintf("%s: limit=%d", errBodyTooLarge, s.maxBodyLen)})
+			return
+		}
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	callbackURL := r.Form.Get(prmCallback)
+	if callbackURL != "" && isSync {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{"callback cannot be used with sync"})
+		return
+	}
+
+	// Asynchronously submit the message to the Kafka cluster.
+	if !isSync {
+		if callbackURL != "" {
+			err = pxy.AsyncProduceWithCallback(r.Context(), topic, toEncoderPreservingNil(key), msg, callbackURL, r.Form.Get(prmCallbackID))
+		} else {
+			err = pxy.AsyncProduce(r.Context(), topic, toEncoderPreservingNil(key), msg)
+		}
+		if err != nil {
+			respondWithProduceError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, EmptyResponse)
+		return
+	}
+
+	prodMsg, err := pxy.Produce(r.Context(), topic, toEncoderPreservingNil(key), msg)
+	if err != nil {
+		respondWithProduceError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, produceRs{
+		Partition: prodMsg.Partition,
+		Offset:    prodMsg.Offset,
+	})
+}
+
+// respondWithProduceError responds to a produce request that failed with
+// `err`.
+func respondWithProduceError(w http.ResponseWriter, err error) {
+	if proxy.IsQuotaExceeded(err) {
+		respondWithQuotaError(w, err)
+		return
+	}
+	respondWithJSON(w, produceErrorStatus(err), errorRs{err.Error()})
+}
+
+// respondWithQuotaError responds with `429 Too Many Requests` to a request of
+// a tenant that exceeded one of its quotas.
+func respondWithQuotaError(w http.ResponseWriter, err error) {
+	if bqErr, ok := errors.Cause(err).(*proxy.ByteQuotaError); ok {
+		w.Header().Set(hdrRetryAfter, strconv.Itoa(int(math.Ceil(bqErr.RetryAfter.Seconds()))))
+	}
+	respondWithJSON(w, http.StatusTooManyRequests, errorRs{err.Error()})
+}
+
+// produceErrorStatus returns an HTTP status code that corresponds to a
+// produce error.
+func produceErrorStatus(err error) int {
+	switch {
+	case err == sarama.ErrUnknownTopicOrPartition:
+		return http.StatusNotFound
+	case proxy.IsInvalidMessage(err), err == proxy.ErrCallbackNotAllowed:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleProduceBatch is an HTTP request handler for
+// `POST /topic/{topic}/batch`. Records are produced concurrently and
+// synchronously, and a result is returned for each of them in the order
+// they were given in the request.
+func (s *T) handleProduceBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !s.prepareProduceBody(w, r) {
+		return
+	}
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+
+	records, err := readBatchRecords(r, s.maxRecords)
+	if err != nil {
+		switch errors.Cause(err) {
+		case errBodyTooLarge:
+			respondWithJSON(w, http.StatusRequestEntityTooLarge, errorRs{
+				fmt.Sprintf("%s: limit=%d", errBodyTooLarge, s.maxBodyLen)})
+			return
+		case errTooManyRecords:
+			respondWithJSON(w, http.StatusRequestEntityTooLarge, errorRs{
+				fmt.Sprintf("%s: limit=%d", errTooManyRecords, s.maxRecords)})
+			return
+		}
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	// Records are produced concurrently, but by no more than
+	// `http.batch_produce_workers` goroutines at a time.
+	results := make([]batchProduceResult, len(records))
+	workerSem := make(chan none.T, s.prodWorkers)
+	var wg sync.WaitGroup
+	for i, rec := range records {
+		var key sarama.Encoder
+		if rec.Key != nil {
+			key = sarama.StringEncoder(*rec.Key)
+		}
+		msg := sarama.StringEncoder(*rec.Value)
+		workerSem <- none.V
+		wg.Add(1)
+		go func(result *batchProduceResult) {
+			defer func() {
+				<-workerSem
+				wg.Done()
+			}()
+			prodMsg, err := pxy.Produce(r.Context(), topic, key, msg)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Partition = &prodMsg.Partition
+			result.Offset = &prodMsg.Offset
+		}(&results[i])
+	}
+	wg.Wait()
+	respondWithJSON(w, http.StatusOK, batchProduceRs{Results: results})
+}
+
+// readBatchRecords reads records of a batch produce request. Depending on
+// the Content-Type header the body is either a JSON array of records or
+// records separated by new lines. If there are more than maxRecords records,
+// then errTooManyRecords is returned.
+func readBatchRecords(r *http.Request, maxRecords int) ([]batchProduceRecord, error) {
+	var records []batchProduceRecord
+	decoder := json.NewDecoder(r.Body)
+	switch contentType := r.Header.Get(hdrContentType); contentType {
+	case "application/json":
+		if err := decoder.Decode(&records); err != nil {
+			return nil, errors.Wrap(err, "failed to parse records")
+		}
+	case contentTypeNDJSON:
+		for {
+			var rec batchProduceRecord
+			if err := decoder.Decode(&rec); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, errors.Wrapf(err, "failed to parse record #%d", len(records))
+			}
+			if len(records) == maxRecords {
+				return nil, errTooManyRecords
+			}
+			records = append(records, rec)
+		}
+	default:
+		return nil, errors.Errorf("unsupported content type %s", contentType)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no records")
+	}
+	if len(records) > maxRecords {
+		return nil, errTooManyRecords
+	}
+	for i, rec := range records {
+		if rec.Value == nil {
+			return nil, errors.Errorf("record #%d has no value", i)
+		}
+	}
+	return records, nil
+}
+
+// prepareProduceBody makes the body of a produce request subject to
+// `http.max_produce_body_bytes` limit and decompresses it on the fly if it is
+// gzip encoded. If false is returned, then an error response has already
+// been sent.
+func (s *T) prepareProduceBody(w http.ResponseWriter, r *http.Request) bool {
+	// Reject oversized requests before anything is read from the body. Note
+	// that form parameters are parsed from the body on the first access.
+	if s.maxBodyLen > 0 {
+		if r.ContentLength > s.maxBodyLen {
+			respondWithJSON(w, http.StatusRequestEntityTooLarge, errorRs{
+				fmt.Sprintf("request body is too large: limit=%d, actual=%d", s.maxBodyLen, r.ContentLength)})
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyLen)
+	}
+	// A gzip encoded body is decompressed on the fly. The decompressed size is
+	// subject to the same limit, so that a small compressed body cannot blow
+	// up into a huge message.
+	switch contentEncoding := r.Header.Get(hdrContentEncoding); contentEncoding {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{
+				errors.Wrap(err, "invalid gzip body").Error()})
+			return false
+		}
+		var body io.Reader = gzipReader
+		if s.maxBodyLen > 0 {
+			body = &limitedReader{gzipReader, s.maxBodyLen}
+		}
+		r.Body = ioutil.NopCloser(body)
+	default:
+		respondWithJSON(w, http.StatusUnsupportedMediaType, errorRs{
+			fmt.Sprintf("unsupported content encoding %s", contentEncoding)})
+		return false
+	}
+	return true
+}
+
+// readMsg reads message from the HTTP request based on the Content-Type header.
+func (s *T) readMsg(r *http.Request) (sarama.Encoder, error) {
+	contentType := r.Header.Get(hdrContentType)
+	if contentType == "text/plain" || contentType == "application/json" {
+		// Content-Length of an encoded body is that of the encoded data,
+		// so it cannot be checked against the message size.
+		if r.Header.Get(hdrContentEncoding) == "gzip" {
+			msg, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read message")
+			}
+			return sarama.ByteEncoder(msg), nil
+		}
+		if _, ok := r.Header[hdrContentLength]; !ok {
+			return nil, errors.Errorf("missing %s header", hdrContentLength)
+		}
+		messageSizeStr := r.Header.Get(hdrContentLength)
+		msgSize, err := strconv.Atoi(messageSizeStr)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s header: %s", hdrContentLength, messageSizeStr)
+		}
+		msg, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read message")
+		}
+		if len(msg) != msgSize {
+			return nil, errors.Errorf("message size does not match %s: expected=%v, actual=%v",
+				hdrContentLength, msgSize, len(msg))
+		}
+		return sarama.ByteEncoder(msg), nil
+	}
+	if contentType == "application/x-www-form-urlencoded" {
+		msg := r.FormValue("msg")
+		if msg == "" {
+			return nil, errors.Errorf("empty message")
+		}
+		return sarama.StringEncoder(msg), nil
+	}
+	return nil, errors.Errorf("unsupported content type %s", contentType)
+}
+
+// limitedReader reads from the underlying reader until more than `n` bytes
+// are read, at which point it fails with `errBodyTooLarge`. Unlike
+// `io.LimitReader` it does not silently truncate the data.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// handleConsume is an HTTP request handler for `GET /topic/{topic}/messages`
+func (s *T) handleConsume(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	ack, err := parseAck(r, true)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	maxMessages, maxBytes, err := parseBatchLimits(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	groupByKey := getParamBytes(r, prmGroupByKey) != nil
+	if groupByKey && maxMessages == 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("%s can only be used with %s", prmGroupByKey, prmMaxMessages)})
+		return
+	}
+	timeout, err := parseTimeout(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	// The format is negotiated before a message is consumed, so that it is
+	// not lost to a request that cannot be responded to. A list of messages
+	// cannot be returned as raw values.
+	format, err := negotiateConsumeFormat(r, maxMessages == 0)
+	if err != nil {
+		respondWithJSON(w, http.StatusNotAcceptable, errorRs{err.Error()})
+		return
+	}
+	if err := setInitialOffset(r, pxy, group); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	// If a batch is requested, then respond with a list of messages.
+	if maxMessages > 0 {
+		consMsgs, err := pxy.ConsumeBatch(r.Context(), group, topic, ack, maxMessages, maxBytes, timeout)
+		if err != nil {
+			respondWithConsumeError(w, err)
+			return
+		}
+		batchRs := newBatchRs(consMsgs, format, groupByKey)
+		if format == consumeFormatDecoded {
+			respondWithJSONAs(w, http.StatusOK, contentTypeDecodedJSON, batchRs)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, batchRs)
+		return
+	}
+
+	consMsg, err := pxy.Consume(r.Context(), group, topic, ack, timeout)
+	if err != nil {
+		respondWithConsumeError(w, err)
+		return
+	}
+	respondWithMessage(w, format, consMsg, false)
+}
+
+// handlePeek is an HTTP request handler for `GET /topics/{topic}/peek`. It
+// returns up to `count` messages that the group would be given next, without
+// committing offsets or registering them as offered.
+func (s *T) handlePeek(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	count, err := parseCount(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	consMsgs, err := pxy.Peek(r.Context(), group, topic, count)
+	if err != nil {
+		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		if proxy.IsQuotaExceeded(err) {
+			respondWithQuotaError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	pxy.Redact(consMsgs)
+	peekRs := make([]consumeRs, len(consMsgs))
+	for i, consMsg := range consMsgs {
+		peekRs[i] = newConsumeRs(consMsg)
+	}
+	respondWithJSON(w, http.StatusOK, peekRs)
+}
+
+// handleReadPartition is an HTTP request handler for
+// `GET /topics/{topic}/partitions/{partition}/messages`. It returns up to
+// `count` messages of the partition starting from `offset` regardless of
+// consumer groups.
+func (s *T) handleReadPartition(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	partitionStr := mux.Vars(r)[prmPartition]
+	partition, err := strconv.ParseInt(partitionStr, 10, 32)
+	if err != nil || partition < 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmPartition, partitionStr)})
+		return
+	}
+	offsetStr := getParamBytes(r, prmOffset)
+	offset, err := strconv.ParseInt(string(offsetStr), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmOffset, offsetStr)})
+		return
+	}
+	count, err := parseCount(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	consMsgs, err := pxy.GetMessages(r.Context(), topic, int32(partition), offset, count)
+	if err != nil {
+		switch errors.Cause(err) {
+		case sarama.ErrUnknownTopicOrPartition:
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic or partition"})
+		case sarama.ErrOffsetOutOfRange:
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Offset out of range"})
+		default:
+			if proxy.IsQuotaExceeded(err) {
+				respondWithQuotaError(w, err)
+				return
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		}
+		return
+	}
+	pxy.Redact(consMsgs)
+	readRs := make([]consumeRs, len(consMsgs))
+	for i, consMsg := range consMsgs {
+		readRs[i] = newConsumeRs(consMsg)
+	}
+	respondWithJSON(w, http.StatusOK, readRs)
+}
+
+// handleConsumeAny is an HTTP request handler for `GET /messages`. It consumes
+// the first message available in any of the topics listed in the `topics`
+// parameter, or matching the `topicPattern` parameter.
+func (s *T) handleConsumeAny(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topics, pattern, err := parseTopics(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	ack, err := parseAck(r, true)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	if ack != proxy.NoAck() && ack != proxy.AutoAck() {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf(
+			"%s and %s cannot be used with %s or %s", prmAckPartition, prmAckOffset, prmTopics, prmTopicPattern)})
+		return
+	}
+	timeout, err := parseTimeout(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	format, err := negotiateConsumeFormat(r, true)
+	if err != nil {
+		respondWithJSON(w, http.StatusNotAcceptable, errorRs{err.Error()})
+		return
+	}
+	if err := setInitialOffset(r, pxy, group); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	var consMsg consumer.Message
+	if pattern != nil {
+		consMsg, err = pxy.ConsumeMatching(r.Context(), group, pattern, ack, timeout)
+	} else {
+		consMsg, err = pxy.ConsumeAny(r.Context(), group, topics, ack, timeout)
+	}
+	if err != nil {
+		respondWithConsumeError(w, err)
+		return
+	}
+	respondWithMessage(w, format, consMsg, true)
+}
+
+// consumeFormat is a format that a consumed message is returned in.
+type consumeFormat int
+
+const (
+	consumeFormatEnvelope consumeFormat = iota
+	consumeFormatRaw
+	consumeFormatDecoded
+)
+
+// negotiateConsumeFormat returns the format of a consume response that the
+// client accepts, according to the `Accept` header. Media types are
+// preferred by quality, and then by order. If the header is not given, then
+// a JSON document with base64 encoded key and value is returned, as it
+// always has been. The raw format is only available if `rawOK` is true.
+func negotiateConsumeFormat(r *http.Request, rawOK bool) (consumeFormat, error) {
+	accept := strings.Join(r.Header[hdrAccept], ",")
+	if strings.TrimSpace(accept) == "" {
+		return consumeFormatEnvelope, nil
+	}
+	var (
+		best  consumeFormat
+		bestQ float64
+	)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		switch mediaType {
+		case contentTypeJSON, "application/*", "*/*":
+			best, bestQ = consumeFormatEnvelope, q
+		case contentTypeOctetStream:
+			if rawOK {
+				best, bestQ = consumeFormatRaw, q
+			}
+		case contentTypeDecodedJSON:
+			best, bestQ = consumeFormatDecoded, q
+		}
+	}
+	if bestQ == 0 {
+		supported := []string{contentTypeJSON, contentTypeDecodedJSON}
+		if rawOK {
+			supported = append(supported, contentTypeOctetStream)
+		}
+		return 0, errors.Errorf("no acceptable media type in %q, supported: %s",
+			accept, strings.Join(supported, ", "))
+	}
+	return best, nil
+}
+
+// respondWithMessage responds to a consume request with a message in the
+// negotiated format. If `withTopic` is true, then the topic of the message
+// is included in the response.
+func respondWithMessage(w http.ResponseWriter, format consumeFormat, consMsg consumer.Message, withTopic bool) {
+	switch format {
+	case consumeFormatRaw:
+		hdr := w.Header()
+		if withTopic {
+			hdr.Set(hdrKafkaTopic, consMsg.Topic)
+		}
+		if consMsg.Key != nil {
+			hdr.Set(hdrKafkaKey, base64.StdEncoding.EncodeToString(consMsg.Key))
+		}
+		hdr.Set(hdrKafkaPartition, strconv.Itoa(int(consMsg.Partition)))
+		hdr.Set(hdrKafkaOffset, strconv.FormatInt(consMsg.Offset, 10))
+		if !consMsg.Timestamp.IsZero() {
+			hdr.Set(hdrKafkaTimestamp, strconv.FormatInt(consMsg.Timestamp.UnixNano()/int64(time.Millisecond), 10))
+		}
+		if consMsg.DeliveryAttempt > 0 {
+			hdr.Set(hdrKafkaDeliveryAttempt, strconv.Itoa(consMsg.DeliveryAttempt))
+		}
+		hdr.Set(hdrKafkaHighWaterMark, strconv.FormatInt(consMsg.HighWaterMark, 10))
+		hdr.Set(hdrKafkaLag, strconv.FormatInt(remainingLag(consMsg), 10))
+		hdr.Set(hdrContentType, contentTypeOctetStream)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(consMsg.Value); err != nil {
+			log.Errorf("Failed to send HTTP response: status=%d, err=%+v", http.StatusOK, err)
+		}
+	case consumeFormatDecoded:
+		consRs := newDecodedConsumeRs(consMsg)
+		if withTopic {
+			consRs.Topic = consMsg.Topic
+		}
+		respondWithJSONAs(w, http.StatusOK, contentTypeDecodedJSON, consRs)
+	default:
+		if withTopic {
+			respondWithJSON(w, http.StatusOK, consumeAnyRs{Topic: consMsg.Topic, consumeRs: newConsumeRs(consMsg)})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, newConsumeRs(consMsg))
+	}
+}
+
+// respondWithConsumeError responds to a consume request that failed with the
+// specified error. If the request was rejected because the consumer cannot
+// keep up, then the response is `503 Service Unavailable` with a reason and
+// an estimate of when to retry, both in the body and in `Retry-After`. If the
+// request was canceled, because the server is shutting down, then the client
+// is asked to retry right away. Keep-alives are disabled on shutdown, so the
+// retry goes over a new connection, possibly to another instance.
+func respondWithConsumeError(w http.ResponseWriter, err error) {
+	var reason string
+	switch {
+	case proxy.IsQuotaExceeded(err):
+		respondWithQuotaError(w, err)
+		return
+	case err == consumer.ErrRequestTimeout:
+		respondWithJSON(w, http.StatusRequestTimeout, errorRs{err.Error()})
+		return
+	case err == consumer.ErrRequestCanceled:
+		w.Header().Set(hdrRetryAfter, "0")
+		respondWithJSON(w, http.StatusServiceUnavailable, rejectedRs{
+			Error:  err.Error(),
+			Reason: rejectReasonShuttingDown,
+		})
+		return
+	case errors.Cause(err) == consumer.ErrTooManyRequests:
+		reason = rejectReasonOverflow
+	case consumer.IsOverloaded(err):
+		reason = rejectReasonOverloaded
+	default:
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	retryAfter := consumer.RetryAfter(err)
+	retryAfterSec := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSec < 1 {
+		retryAfterSec = 1
+	}
+	w.Header().Set(hdrRetryAfter, strconv.Itoa(retryAfterSec))
+	respondWithJSON(w, http.StatusServiceUnavailable, rejectedRs{
+		Error:        err.Error(),
+		Reason:       reason,
+		RetryAfterMs: int64(retryAfter / time.Millisecond),
+	})
+}
+
+// handleConsumeWS is an HTTP request handler for `GET /topic/{topic}/ws`. It
+// upgrades the connection to WebSocket and streams consumed messages to the
+// client until either the client closes the connection or the server stops.
+// Messages have to be acknowledged by sending acks over the same connection.
+func (s *T) handleConsumeWS(w http.ResponseWriter, r *http.Request) {
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	if err := setInitialOffset(r, pxy, group); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	// The connection has to be registered before it is hijacked, for
+	// otherwise Stop could miss it.
+	s.streamWg.Add(1)
+	defer s.streamWg.Done()
+	conn, err := websocket.Upgrade(w, r, wsMaxAckSize)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	closedCh := make(chan none.T)
+	go func() {
+		defer close(closedCh)
+		s.readWSAcks(conn, pxy, group, topic)
+	}()
+	ctx, cancel := s.streamContext(closedCh)
+	defer cancel()
+	for {
+		select {
+		case <-closedCh:
+			return
+		case <-s.streamStopCh:
+			return
+		default:
+		}
+		consMsg, err := pxy.Consume(ctx, group, topic, proxy.NoAck(), 0)
+		if err != nil {
+			switch {
+			case err == consumer.ErrRequestCanceled:
+				return
+			case err == consumer.ErrRequestTimeout:
+				continue
+			case errors.Cause(err) == consumer.ErrTooManyRequests || consumer.IsOverloaded(err) || proxy.IsQuotaExceeded(err):
+				select {
+				case <-time.After(streamRetryBackoff):
+					continue
+				case <-closedCh:
+				case <-s.streamStopCh:
+				}
+				return
+			default:
+				writeWSJSON(conn, errorRs{err.Error()})
+				return
+			}
+		}
+		if err := writeWSJSON(conn, newConsumeRs(consMsg)); err != nil {
+			log.Errorf("Failed to send WebSocket message: err=(%s)", err)
+			return
+		}
+	}
+}
+
+// handleConsumeSSE is an HTTP request handler for `GET /topic/{topic}/events`.
+// It streams consumed messages to the client as Server-Sent Events until
+// either the client closes the connection or the server stops. Messages have
+// to be acknowledged with separate `POST /topic/{topic}/acks` requests. If no
+// group is specified, then messages are streamed without a consumer group.
+//
+// The connection is hijacked, so that the stream is not cut off by the HTTP
+// server write timeout.
+func (s *T) handleConsumeSSE(w http.ResponseWriter, r *http.Request) {
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, true)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	if group == "" {
+		s.consumeGroupless(w, r, pxy, topic)
+		return
+	}
+	if err := setInitialOffset(r, pxy, group); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	// The connection has to be registered before it is hijacked, for
+	// otherwise Stop could miss it.
+	s.streamWg.Add(1)
+	defer s.streamWg.Done()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{"connection cannot be hijacked"})
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	rs := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + contentTypeEventStream + "\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(rs)); err != nil {
+		return
+	}
+
+	// Clients are not supposed to send anything, so reading from the
+	// connection only detects when it is closed.
+	closedCh := make(chan none.T)
+	go func() {
+		defer close(closedCh)
+		io.Copy(ioutil.Discard, conn)
+	}()
+	ctx, cancel := s.streamContext(closedCh)
+	defer cancel()
+	for {
+		select {
+		case <-closedCh:
+			return
+		case <-s.streamStopCh:
+			return
+		default:
+		}
+		consMsg, err := pxy.Consume(ctx, group, topic, proxy.NoAck(), 0)
+		if err != nil {
+			switch {
+			case err == consumer.ErrRequestCanceled:
+				return
+			case err == consumer.ErrRequestTimeout:
+				// A comment keeps the connection alive through proxies
+				// that close idle connections.
+				if _, err := conn.Write([]byte(":\n\n")); err != nil {
+					return
+				}
+				continue
+			case errors.Cause(err) == consumer.ErrTooManyRequests || consumer.IsOverloaded(err) || proxy.IsQuotaExceeded(err):
+				select {
+				case <-time.After(streamRetryBackoff):
+					continue
+				case <-closedCh:
+				case <-s.streamStopCh:
+				}
+				return
+			default:
+				writeSSEJSON(conn, errorRs{err.Error()})
+				return
+			}
+		}
+		if err := writeSSEJSON(conn, newConsumeRs(consMsg)); err != nil {
+			log.Errorf("Failed to send SSE message: err=(%s)", err)
+			return
+		}
+	}
+}
+
+// streamContext returns a context for consume requests of a WebSocket or SSE
+// stream, that is done when either the stream connection is closed or the
+// server stops.
+func (s *T) streamContext(closedCh <-chan none.T) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-closedCh:
+		case <-s.streamStopCh:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// readWSAcks reads acks sent by a WebSocket client and applies them until the
+// connection is closed. Malformed and failed acks are reported back to the
+// client as errors.
+func (s *T) readWSAcks(conn *websocket.Conn, pxy *proxy.T, group, topic string) {
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var ackRq wsAckRq
+		if err := json.Unmarshal(msg, &ackRq); err != nil {
+			writeWSJSON(conn, errorRs{fmt.Sprintf("bad ack: %s", err)})
+			continue
+		}
+		if ackRq.Partition == nil || ackRq.Offset == nil {
+			writeWSJSON(conn, errorRs{"partition and offset must be provided"})
+			continue
+		}
+		ack, err := proxy.NewAck(*ackRq.Partition, *ackRq.Offset)
+		if err != nil {
+			writeWSJSON(conn, errorRs{err.Error()})
+			continue
+		}
+		if err := pxy.Ack(group, topic, ack); err != nil {
+			writeWSJSON(conn, errorRs{err.Error()})
+		}
+	}
+}
+
+// consumeGroupless streams messages of a topic without a consumer group,
+// starting from either the newest or the oldest offsets as specified by the
+// `initialOffset` parameter. Nothing is registered in ZooKeeper and no
+// offsets are committed, which suits ephemeral consumers.
+func (s *T) consumeGroupless(w http.ResponseWriter, r *http.Request, pxy *proxy.T, topic string) {
+	initialOffset, err := parseInitialOffset(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	partitionOffsets, err := pxy.GetTopicOffsets(topic)
+	if err != nil {
+		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	offsets := make([]int64, len(partitionOffsets))
+	for i, po := range partitionOffsets {
+		offsets[i] = po.End
+		if initialOffset == config.InitialOffsetEarliest {
+			offsets[i] = po.Begin
+		}
+	}
+	s.streamPartitions(r.Context(), w, pxy, topic, partitionOffsets, offsets, false)
+}
+
+// handleTail is an HTTP request handler for `GET /topic/{topic}/tail`. It
+// streams the last `count` messages of every partition of the topic followed
+// by new messages as they are produced. No consumer group is involved, so no
+// offsets are committed.
+func (s *T) handleTail(w http.ResponseWriter, r *http.Request) {
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	count, err := parseCount(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	partitionOffsets, err := pxy.GetTopicOffsets(topic)
+	if err != nil {
+		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	offsets := make([]int64, len(partitionOffsets))
+	for i, po := range partitionOffsets {
+		offsets[i] = po.End - int64(count)
+		if offsets[i] < po.Begin {
+			offsets[i] = po.Begin
+		}
+	}
+	s.streamPartitions(r.Context(), w, pxy, topic, partitionOffsets, offsets, true)
+}
+
+// streamPartitions streams messages of topic partitions starting from
+// `offsets` to the client as Server-Sent Events, and then keeps streaming new
+// messages as they are produced until either the client closes the
+// connection or the server stops. Partitions are read directly, so no
+// consumer group is involved. If `redacted` is true, then message values are
+// redacted as configured for the cluster.
+//
+// The connection is hijacked, so that the stream is not cut off by the HTTP
+// server write timeout.
+func (s *T) streamPartitions(ctx context.Context, w http.ResponseWriter, pxy *proxy.T, topic string, partitionOffsets []admin.PartitionOffset, offsets []int64, redacted bool) {
+	// The connection has to be registered before it is hijacked, for
+	// otherwise Stop could miss it.
+	s.streamWg.Add(1)
+	defer s.streamWg.Done()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{"connection cannot be hijacked"})
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	rs := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + contentTypeEventStream + "\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(rs)); err != nil {
+		return
+	}
+
+	// Clients are not supposed to send anything, so reading from the
+	// connection only detects when it is closed.
+	closedCh := make(chan none.T)
+	go func() {
+		defer close(closedCh)
+		io.Copy(ioutil.Discard, conn)
+	}()
+	for {
+		select {
+		case <-closedCh:
+			return
+		case <-s.streamStopCh:
+			return
+		default:
+		}
+		tailed := 0
+		for i, po := range partitionOffsets {
+			consMsgs, err := pxy.GetMessages(ctx, topic, po.Partition, offsets[i], maxMessageCount)
+			if err != nil {
+				// The tenant quota is retried until it is replenished.
+				if proxy.IsQuotaExceeded(err) {
+					break
+				}
+				writeSSEJSON(conn, errorRs{err.Error()})
+				return
+			}
+			if redacted {
+				pxy.Redact(consMsgs)
+			}
+			for _, consMsg := range consMsgs {
+				if err := writeSSEJSON(conn, newConsumeRs(consMsg)); err != nil {
+					log.Errorf("Failed to send SSE message: err=(%s)", err)
+					return
+				}
+				offsets[i] = consMsg.Offset + 1
+			}
+			tailed += len(consMsgs)
+		}
+		if tailed > 0 {
+			continue
+		}
+		// A comment keeps the connection alive through proxies that close
+		// idle connections.
+		if _, err := conn.Write([]byte(":\n\n")); err != nil {
+			return
+		}
+		select {
+		case <-time.After(tailPollInterval):
+		case <-closedCh:
+			return
+		case <-s.streamStopCh:
+			return
+		}
+	}
+}
+
+// handleReprocess is an HTTP request handler for
+// `POST /topics/{topic}/reprocess`. It republishes a range of messages of a
+// dead letter topic partition to the topic they were dead lettered from.
+func (s *T) handleReprocess(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	dlTopic := mux.Vars(r)[prmTopic]
+	partitionStr := getParamBytes(r, prmPartition)
+	partition, err := strconv.ParseInt(string(partitionStr), 10, 32)
+	if err != nil || partition < 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmPartition, partitionStr)})
+		return
+	}
+	offsetStr := getParamBytes(r, prmOffset)
+	offset, err := strconv.ParseInt(string(offsetStr), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmOffset, offsetStr)})
+		return
+	}
+	countStr := getParamBytes(r, prmCount)
+	count, err := strconv.Atoi(string(countStr))
+	if err != nil || count <= 0 || count > maxReprocessCount {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmCount, countStr)})
+		return
+	}
+	var rate float64
+	if rateStr := getParamBytes(r, prmRate); rateStr != nil {
+		if rate, err = strconv.ParseFloat(string(rateStr), 64); err != nil || rate <= 0 {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmRate, rateStr)})
+			return
+		}
+	}
+	topic := string(getParamBytes(r, prmTargetTopic))
+	if topic == "" {
+		if topic = pxy.DeadLetterOrigin(dlTopic); topic == "" {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("%s must be provided, for it cannot be derived from consumer.dead_letter_topic", prmTargetTopic)})
+			return
+		}
+	}
+	if err := s.authorizeTopics(r, config.ACLProduce, []string{topic}); err != nil {
+		respondWithJSON(w, http.StatusForbidden, errorRs{err.Error()})
+		return
+	}
+
+	reprocessed, err := pxy.Reprocess(r.Context(), dlTopic, int32(partition), offset, count, topic, rate)
+	if err != nil {
+		if proxy.IsQuotaExceeded(err) {
+			respondWithQuotaError(w, err)
+			return
+		}
+		switch errors.Cause(err) {
+		case sarama.ErrUnknownTopicOrPartition:
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic or partition"})
+		case sarama.ErrOffsetOutOfRange:
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Offset out of range"})
+		default:
+			errorText := fmt.Sprintf("failed after %d messages: %s", reprocessed, err)
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{errorText})
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reprocessRs{Topic: topic, Reprocessed: reprocessed})
+}
+
+// handleAck is an HTTP request handler for `POST /topic/{topic}/acks`
+func (s *T) handleAck(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	ack, err := parseAck(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	err = pxy.Ack(group, topic, ack)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// handleAckBatch is an HTTP request handler for
+// `POST /topics/{topic}/acks/batch`. It acknowledges messages listed in the
+// request body, either one by one or by offset ranges. Messages are
+// acknowledged in the order they are listed.
+func (s *T) handleAckBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	metadata := string(getParamBytes(r, prmMetadata))
+	if len(metadata) > maxAckMetadataLen {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{
+			fmt.Sprintf("%s is too long: limit=%d", prmMetadata, maxAckMetadataLen)})
+		return
+	}
+	acks, err := readBatchAcks(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	for _, ack := range acks {
+		if err := pxy.Ack(group, topic, ack.WithMeta(metadata)); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// readBatchAcks parses a batch ack request body, expanding offset ranges
+// into acks of individual messages.
+func readBatchAcks(r *http.Request) ([]proxy.Ack, error) {
+	if contentType := r.Header.Get(hdrContentType); contentType != "application/json" {
+		return nil, errors.Errorf("unsupported content type %s", contentType)
+	}
+	var ackViews []batchAckView
+	if err := json.NewDecoder(r.Body).Decode(&ackViews); err != nil {
+		return nil, errors.Wrap(err, "failed to parse acks")
+	}
+	if len(ackViews) == 0 {
+		return nil, errors.New("no acks")
+	}
+	var acks []proxy.Ack
+	for i, av := range ackViews {
+		if av.Partition == nil {
+			return nil, errors.Errorf("ack #%d has no partition", i)
+		}
+		from, to := av.From, av.To
+		switch {
+		case av.Offset != nil && from == nil && to == nil:
+			from, to = av.Offset, av.Offset
+		case av.Offset == nil && from != nil && to != nil:
+			if *from < 0 || *to < *from {
+				return nil, errors.Errorf("ack #%d has bad range: from=%d, to=%d", i, *from, *to)
+			}
+		default:
+			return nil, errors.Errorf("ack #%d must have either offset, or from and to", i)
+		}
+		// Written so that neither side can overflow, for otherwise a huge
+		// range could pass the check.
+		if *to-*from >= maxBatchAcks-int64(len(acks)) {
+			return nil, errors.Errorf("too many acks: limit=%d", maxBatchAcks)
+		}
+		for offset := *from; offset <= *to; offset++ {
+			ack, err := proxy.NewAck(*av.Partition, offset)
+			if err != nil {
+				return nil, errors.Wrapf(err, "ack #%d is invalid", i)
+			}
+			acks = append(acks, ack)
+		}
+	}
+	return acks, nil
+}
+
+// handleNack is an HTTP request handler for `POST /topic/{topic}/nacks`
+func (s *T) handleNack(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	ack, err := parseAck(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	reason := string(getParamBytes(r, prmReason))
+
+	err = pxy.Nack(group, topic, ack, reason)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// handleGetOffsets is an HTTP request handler for `GET /topic/{topic}/offsets`
+func (s *T) handleGetOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, ok := mux.Vars(r)[prmGroup]
+	if !ok {
+		if group, err = getGroupParam(r, false); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+			return
+		}
+	}
+
+	partitionOffsets, err := pxy.GetGroupOffsets(group, topic)
+	if err != nil {
+		if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+
+	offsetViews := make([]partitionInfo, len(partitionOffsets))
+	for i, po := range partitionOffsets {
+		offsetViews[i].Partition = po.Partition
+		offsetViews[i].Begin = po.Begin
+		offsetViews[i].End = po.End
+		offsetViews[i].Count = po.End - po.Begin
+		offsetViews[i].Offset = po.Offset
+		offsetViews[i].Lag = partitionLag(po)
+		offsetViews[i].Metadata = po.Metadata
+		offset := offsetmgr.Offset{Val: po.Offset, Meta: po.Metadata}
+		offsetViews[i].SparseAcks = offsettrk.SparseAcks2Str(offset)
+		offsetViews[i].AckMetadata = offsettrk.AckMeta(offset)
+	}
+	respondWithJSON(w, http.StatusOK, offsetViews)
+}
+
+// handleGetGroups is an HTTP request handler for `GET /groups`. It returns
+// names of all consumer groups registered in the cluster.
+func (s *T) handleGetGroups(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	groups, err := pxy.GetGroups()
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+// handleGetGroup is an HTTP request handler for `GET /groups/{group}`. It
+// returns members of the group with their subscriptions and partitions.
+func (s *T) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group := mux.Vars(r)[prmGroup]
+
+	members, err := pxy.GetGroupMembers(group)
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown group"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	groupView := groupView{Members: make(map[string]memberView, len(members))}
+	for _, member := range members {
+		groupView.Members[member.ID] = memberView{
+			Registered:    member.Registered,
+			Subscriptions: member.Subscriptions,
+			Partitions:    member.Partitions,
+		}
+	}
+	respondWithJSON(w, http.StatusOK, groupView)
+}
+
+// handleGetGroupLag is an HTTP request handler for `GET /groups/{group}/lag`.
+// For every topic consumed by the group it returns the number of messages
+// that have not been consumed yet per partition and in total.
+func (s *T) handleGetGroupLag(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group := mux.Vars(r)[prmGroup]
+
+	topics, err := pxy.GetGroupTopics(group)
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown group"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+
+	groupLag := groupLagView{Topics: make(map[string]topicLagView, len(topics))}
+	for _, topic := range topics {
+		partitionOffsets, err := pxy.GetGroupOffsets(group, topic)
+		if err != nil {
+			// Partition owners of a deleted topic may still be registered.
+			if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+				continue
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+		topicLag := topicLagView{Partitions: make([]partitionLagView, len(partitionOffsets))}
+		for i, po := range partitionOffsets {
+			lag := partitionLag(po)
+			topicLag.Partitions[i] = partitionLagView{
+				Partition: po.Partition,
+				Offset:    po.Offset,
+				End:       po.End,
+				Lag:       lag,
+			}
+			topicLag.Lag += lag
+		}
+		groupLag.Topics[topic] = topicLag
+		groupLag.Lag += topicLag.Lag
+	}
+	respondWithJSON(w, http.StatusOK, groupLag)
+}
+
+// handleExportGroupOffsets is an HTTP request handler for
+// `GET /groups/{group}/offsets`. It returns offsets along with metadata
+// committed by the group for all topics that it consumes, in a form accepted
+// by `POST /groups/{group}/offsets`.
+func (s *T) handleExportGroupOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group := mux.Vars(r)[prmGroup]
+
+	topics, err := pxy.GetGroupTopics(group)
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown group"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	// Offsets of topics that the client has no access to are left out.
+	topics = s.filterTopics(r, config.ACLAdmin, topics)
+
+	groupOffsets := groupOffsetsView{Topics: make(map[string][]groupOffsetView, len(topics))}
+	for _, topic := range topics {
+		partitionOffsets, err := pxy.GetGroupOffsets(group, topic)
+		if err != nil {
+			// Partition owners of a deleted topic may still be registered.
+			if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+				continue
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+		topicOffsets := make([]groupOffsetView, 0, len(partitionOffsets))
+		for _, po := range partitionOffsets {
+			// Partitions that nothing has been committed for yet are
+			// left to the initial offset policy of the importing group.
+			if po.Offset < 0 {
+				continue
+			}
+			topicOffsets = append(topicOffsets, groupOffsetView{
+				Partition: po.Partition,
+				Offset:    po.Offset,
+				Metadata:  po.Metadata,
+			})
+		}
+		groupOffsets.Topics[topic] = topicOffsets
+	}
+	respondWithJSON(w, http.StatusOK, groupOffsets)
+}
+
+// handleImportGroupOffsets is an HTTP request handler for
+// `POST /groups/{group}/offsets`. It commits offsets along with metadata
+// exported from a group, possibly another one or in another cluster, on
+// behalf of the group. Like a seek, it is refused with 409 if the group
+// consumes any of the topics in other instances, unless `force` is true.
+func (s *T) handleImportGroupOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group := mux.Vars(r)[prmGroup]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorText := fmt.Sprintf("Failed to read the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+	var groupOffsets groupOffsetsView
+	if err := json.Unmarshal(body, &groupOffsets); err != nil {
+		errorText := fmt.Sprintf("Failed to parse the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+	if len(groupOffsets.Topics) == 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{"no topics to import offsets for"})
+		return
+	}
+
+	// Import topics in a stable order, so that if one fails the outcome of
+	// a retry is predictable.
+	topics := make([]string, 0, len(groupOffsets.Topics))
+	for topic := range groupOffsets.Topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	// Nothing is imported if the client has no access to any of the topics.
+	if err := s.authorizeTopics(r, config.ACLAdmin, topics); err != nil {
+		respondWithJSON(w, http.StatusForbidden, errorRs{err.Error()})
+		return
+	}
+	// Nothing is imported if any of the topics is being consumed by the
+	// group in other instances, unless forced.
+	if !groupOffsets.Force {
+		for _, topic := range topics {
+			if err := pxy.CheckGroupInactive(group, topic); err != nil {
+				err = errors.Wrapf(err, "topic=%s", topic)
+				if errors.Cause(err) == proxy.ErrGroupActive {
+					respondWithJSON(w, http.StatusConflict, errorRs{err.Error()})
+					return
+				}
+				respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+				return
+			}
+		}
+	}
+	for _, topic := range topics {
+		topicOffsets := groupOffsets.Topics[topic]
+		partitionOffsets := make([]admin.PartitionOffset, len(topicOffsets))
+		for i, gov := range topicOffsets {
+			partitionOffsets[i].Partition = gov.Partition
+			partitionOffsets[i].Offset = gov.Offset
+			partitionOffsets[i].Metadata = gov.Metadata
+		}
+		if err := pxy.SeekGroupOffsets(group, topic, partitionOffsets, true); err != nil {
+			if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+				respondWithJSON(w, http.StatusNotFound, errorRs{fmt.Sprintf("Unknown topic: %s", topic)})
+				return
+			}
+			err = errors.Wrapf(err, "topic=%s", topic)
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// partitionLag returns the number of messages in a partition that have not
+// been consumed by a group yet.
+func partitionLag(po admin.PartitionOffset) int64 {
+	switch po.Offset {
+	case sarama.OffsetNewest:
+		return 0
+	case sarama.OffsetOldest:
+		return po.End - po.Begin
+	default:
+		return po.End - po.Offset
+	}
+}
+
+// handleSetOffsets is an HTTP request handler for `POST /topic/{topic}/offsets`.
+// It is a seek that keeps metadata given with offsets, therefore it is refused
+// with 409 if the group consumes the topic in other instances, unless the
+// `force` parameter is given.
+func (s *T) handleSetOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	group, err := getGroupParam(r, false)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorText := fmt.Sprintf("Failed to read the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+
+	var partitionOffsetViews []partitionInfo
+	if err := json.Unmarshal(body, &partitionOffsetViews); err != nil {
+		errorText := fmt.Sprintf("Failed to parse the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+
+	partitionOffsets := make([]admin.PartitionOffset, len(partitionOffsetViews))
+	for i, pov := range partitionOffsetViews {
+		partitionOffsets[i].Partition = pov.Partition
+		partitionOffsets[i].Offset = pov.Offset
+		partitionOffsets[i].Metadata = pov.Metadata
+	}
+
+	force := getParamBytes(r, prmForce) != nil
+	err = pxy.SeekGroupOffsets(group, topic, partitionOffsets, force)
+	if err != nil {
+		if errors.Cause(err) == proxy.ErrGroupActive {
+			respondWithJSON(w, http.StatusConflict, errorRs{err.Error()})
+			return
+		}
+		if err = errors.Cause(err); err == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
 		return
 	}
 
-	offsetViews := make([]partitionInfo, len(partitionOffsets))
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// handleSeekOffsets is an HTTP request handler for
+// `POST /groups/{group}/topics/{topic}/offsets`
+func (s *T) handleSeekOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	group := mux.Vars(r)[prmGroup]
+	topic := mux.Vars(r)[prmTopic]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorText := fmt.Sprintf("Failed to read the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+	var rq seekRq
+	if err := json.Unmarshal(body, &rq); err != nil {
+		errorText := fmt.Sprintf("Failed to parse the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+	targets := 0
+	for _, given := range []bool{rq.Offsets != nil, rq.Timestamp != nil, rq.Position != ""} {
+		if given {
+			targets++
+		}
+	}
+	if targets != 1 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{"one of offsets, timestamp or position must be provided"})
+		return
+	}
+	if rq.Position != "" && rq.Position != seekEarliest && rq.Position != seekLatest {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad position: %s", rq.Position)})
+		return
+	}
+
+	var partitionOffsets []admin.PartitionOffset
+	if rq.Position != "" {
+		if partitionOffsets, err = pxy.GetGroupOffsets(group, topic); err != nil {
+			if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+				respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+				return
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+		for i, po := range partitionOffsets {
+			if rq.Position == seekEarliest {
+				partitionOffsets[i].Offset = po.Begin
+			} else {
+				partitionOffsets[i].Offset = po.End
+			}
+			partitionOffsets[i].Metadata = ""
+		}
+	} else if rq.Timestamp != nil {
+		ts := time.Unix(0, *rq.Timestamp*int64(time.Millisecond))
+		if partitionOffsets, err = pxy.GetTimeOffsets(topic, ts); err != nil {
+			if errors.Cause(err) == sarama.ErrUnknownTopicOrPartition {
+				respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+				return
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+	} else {
+		partitionOffsets = make([]admin.PartitionOffset, len(rq.Offsets))
+		for i, sov := range rq.Offsets {
+			partitionOffsets[i].Partition = sov.Partition
+			partitionOffsets[i].Offset = sov.Offset
+		}
+	}
+
+	err = pxy.SeekGroupOffsets(group, topic, partitionOffsets, rq.Force)
+	if err != nil {
+		if errors.Cause(err) == proxy.ErrGroupActive {
+			respondWithJSON(w, http.StatusConflict, errorRs{err.Error()})
+			return
+		}
+		if err = errors.Cause(err); err == sarama.ErrUnknownTopicOrPartition {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+
+	seekOffsetViews := make([]seekOffsetView, len(partitionOffsets))
+	for i, po := range partitionOffsets {
+		seekOffsetViews[i].Partition = po.Partition
+		seekOffsetViews[i].Offset = po.Offset
+	}
+	respondWithJSON(w, http.StatusOK, seekOffsetViews)
+}
+
+// handleLookupOffsets is an HTTP request handler for
+// `GET /topics/{topic}/offsets/lookup`. For every partition of the topic it
+// returns the offset of the first message with a timestamp that is greater
+// than or equal to the `timestamp` parameter. The response can be given as is
+// as `offsets` to a seek request. Kafka older than 0.10.1.0 cannot resolve
+// offsets that precisely, so with such `kafka.version` it fails with 501.
+func (s *T) handleLookupOffsets(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+	timestampStr := getParamBytes(r, prmTimestamp)
+	timestamp, err := strconv.ParseInt(string(timestampStr), 10, 64)
+	if err != nil || timestamp < 0 {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad %s: %s", prmTimestamp, timestampStr)})
+		return
+	}
+
+	ts := time.Unix(0, timestamp*int64(time.Millisecond))
+	partitionOffsets, err := pxy.LookupTimeOffsets(topic, ts)
+	if err != nil {
+		switch errors.Cause(err) {
+		case sarama.ErrUnknownTopicOrPartition:
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		case proxy.ErrTimeLookupNotSupported:
+			respondWithJSON(w, http.StatusNotImplemented, errorRs{err.Error()})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	offsetViews := make([]seekOffsetView, len(partitionOffsets))
 	for i, po := range partitionOffsets {
 		offsetViews[i].Partition = po.Partition
-		offsetViews[i].Begin = po.Begin
-		offsetViews[i].End = po.End
-		offsetViews[i].Count = po.End - po.Begin
 		offsetViews[i].Offset = po.Offset
-		if po.Offset == sarama.OffsetNewest {
-			offsetViews[i].Lag = 0
-		} else if po.Offset == sarama.OffsetOldest {
-			offsetViews[i].Lag = po.End - po.Begin
-		} else {
-			offsetViews[i].Lag = po.End - po.Offset
+	}
+	respondWithJSON(w, http.StatusOK, offsetViews)
+}
+
+// handleGetTopicConsumers is an HTTP request handler for `GET /topic/{topic}/consumers`
+func (s *T) handleGetTopicConsumers(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var err error
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+
+	group, err := getGroupParam(r, true)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	var consumers map[string]map[string][]int32
+	if group == "" {
+		consumers, err = pxy.GetAllTopicConsumers(topic)
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+	} else {
+		groupConsumers, err := pxy.GetTopicConsumers(group, topic)
+		if err != nil {
+			if _, ok := err.(admin.ErrInvalidParam); ok {
+				respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+				return
+			}
+			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+			return
+		}
+		consumers = make(map[string]map[string][]int32)
+		if len(groupConsumers) != 0 {
+			consumers[group] = groupConsumers
+		}
+	}
+
+	encodedRes, err := json.MarshalIndent(consumers, "", "  ")
+	if err != nil {
+		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", http.StatusOK, encodedRes, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encodedRes = prettyfmt.CollapseJSON(encodedRes)
+
+	w.Header().Add(hdrContentType, "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(encodedRes); err != nil {
+		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", http.StatusOK, encodedRes, err)
+	}
+}
+
+// handleGetTopics is an HTTP request handler for `GET /topics`. It returns
+// partition metadata of all topics in the cluster.
+func (s *T) handleGetTopics(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topicsMeta, err := pxy.GetTopicsMetadata()
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	topicViews := make(map[string]topicView, len(topicsMeta))
+	for _, topicMeta := range topicsMeta {
+		topicViews[topicMeta.Topic] = newTopicView(topicMeta)
+	}
+	respondWithJSON(w, http.StatusOK, topicViews)
+}
+
+// handleGetTopic is an HTTP request handler for `GET /topics/{topic}`. It
+// returns partition metadata of the topic.
+func (s *T) handleGetTopic(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+
+	topicsMeta, err := pxy.GetTopicsMetadata(topic)
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newTopicView(topicsMeta[0]))
+}
+
+// handleCreateTopic is an HTTP request handler for `POST /topics`.
+func (s *T) handleCreateTopic(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorText := fmt.Sprintf("Failed to read the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+	var createRq createTopicRq
+	if err := json.Unmarshal(body, &createRq); err != nil {
+		errorText := fmt.Sprintf("Failed to parse the request: err=(%s)", err)
+		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
+		return
+	}
+
+	err = pxy.CreateTopic(admin.TopicSpec{
+		Topic:             createRq.Topic,
+		Partitions:        createRq.Partitions,
+		ReplicationFactor: createRq.ReplicationFactor,
+		Config:            createRq.Config,
+	})
+	if err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+			return
+		}
+		if err == admin.ErrTopicExists {
+			respondWithJSON(w, http.StatusConflict, errorRs{err.Error()})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+// handleDeleteTopic is an HTTP request handler for `DELETE /topics/{topic}`.
+func (s *T) handleDeleteTopic(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	pxy, err := s.getProxy(r)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
+		return
+	}
+	topic := mux.Vars(r)[prmTopic]
+
+	if err := pxy.DeleteTopic(topic); err != nil {
+		if _, ok := err.(admin.ErrInvalidParam); ok {
+			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
+			return
+		}
+		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, EmptyResponse)
+}
+
+func (s *T) handlePing(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("pong"))
+}
+
+// handleHealthz is an HTTP request handler for `GET /healthz`. It is meant
+// to be used as a liveness probe, therefore it always responds with 200 as
+// long as the server is running, but the body reports the state of the Kafka
+// and ZooKeeper clusters. Restarting Kafka-Pixy would not fix them anyway.
+func (s *T) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	respondWithJSON(w, http.StatusOK, s.checkHealth())
+}
+
+// handleReadyz is an HTTP request handler for `GET /readyz`. It is meant to
+// be used as a readiness probe, it responds with 503 if any of the Kafka or
+// ZooKeeper clusters fails a health check.
+func (s *T) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	health := s.checkHealth()
+	status := http.StatusOK
+	if health.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, status, health)
+}
+
+// checkHealth runs health checks of all proxies concurrently.
+func (s *T) checkHealth() healthView {
+	clusters := s.proxySet.Clusters()
+	results := make([]map[string]error, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		pxy, _ := s.proxySet.Get(cluster)
+		wg.Add(1)
+		go func(i int, pxy *proxy.T) {
+			defer wg.Done()
+			results[i] = pxy.CheckHealth()
+		}(i, pxy)
+	}
+	wg.Wait()
+
+	health := healthView{Status: healthOK, Clusters: make(map[string]map[string]string, len(clusters))}
+	for i, cluster := range clusters {
+		checkViews := make(map[string]string, len(results[i]))
+		for name, err := range results[i] {
+			if err != nil {
+				checkViews[name] = err.Error()
+				health.Status = healthDegraded
+				continue
+			}
+			checkViews[name] = healthOK
 		}
-		offsetViews[i].Metadata = po.Metadata
-		offset := offsetmgr.Offset{Val: po.Offset, Meta: po.Metadata}
-		offsetViews[i].SparseAcks = offsettrk.SparseAcks2Str(offset)
+		health.Clusters[cluster] = checkViews
 	}
-	respondWithJSON(w, http.StatusOK, offsetViews)
+	return health
 }
 
-// handleGetOffsets is an HTTP request handler for `POST /topic/{topic}/offsets`
-func (s *T) handleSetOffsets(w http.ResponseWriter, r *http.Request) {
+// handleGetMetrics is an HTTP request handler for `GET /_metrics`. It returns
+// a snapshot of all metrics collected by Kafka-Pixy.
+func (s *T) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	metricViews := []metricView{}
+	metrics.DefaultRegistry.Each(func(name string, labels []metrics.Label, metric interface{}) {
+		mv := metricView{Name: name, Labels: make(map[string]string, len(labels))}
+		for _, l := range labels {
+			mv.Labels[l.Name] = l.Value
+		}
+		switch m := metric.(type) {
+		case gometrics.Counter:
+			mv.Count = m.Count()
+		case gometrics.Gauge:
+			mv.Value = m.Value()
+		case gometrics.Histogram:
+			h := m.Snapshot()
+			ps := h.Percentiles([]float64{0.5, 0.95, 0.99})
+			mv.Count = h.Count()
+			mv.Histogram = &histogramView{
+				Min: h.Min(), Max: h.Max(), Mean: h.Mean(),
+				P50: ps[0], P95: ps[1], P99: ps[2],
+			}
+		}
+		metricViews = append(metricViews, mv)
+	})
+	respondWithJSON(w, http.StatusOK, metricViews)
+}
 
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+// handleGetPrometheusMetrics is an HTTP request handler for `GET /metrics`.
+// It returns all metrics in the Prometheus text exposition format.
+func (s *T) handleGetPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Add(hdrContentType, metrics.PrometheusContentType)
+	if err := metrics.DefaultRegistry.WritePrometheus(w); err != nil {
+		log.Errorf("Failed to send metrics: err=(%s)", err)
 	}
-	topic := mux.Vars(r)[prmTopic]
-	group, err := getGroupParam(r, false)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+}
+
+// handleGetActors is an HTTP request handler for `GET /_debug/actors`. It
+// returns the tree of actors that are currently running.
+func (s *T) handleGetActors(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	respondWithJSON(w, http.StatusOK, actorsRs{
+		Goroutines: runtime.NumGoroutine(),
+		Actors:     newActorView(actor.Tree()),
+	})
+}
+
+func (s *T) handleGetState(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	clusters := s.proxySet.Clusters()
+	rs := stateRs{Clusters: make(map[string]consumerStateView, len(clusters))}
+	for _, cluster := range clusters {
+		pxy, _ := s.proxySet.Get(cluster)
+		rs.Clusters[cluster] = newConsumerStateView(pxy.ConsumerState())
 	}
+	respondWithJSON(w, http.StatusOK, rs)
+}
+
+func (s *T) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	respondWithJSON(w, http.StatusOK, logLevelRs{strings.ToLower(logging.Severity().String())})
+}
+
+func (s *T) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -364,123 +3139,322 @@ func (s *T) handleSetOffsets(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
 		return
 	}
-
-	var partitionOffsetViews []partitionInfo
-	if err := json.Unmarshal(body, &partitionOffsetViews); err != nil {
+	var rq logLevelRs
+	if err := json.Unmarshal(body, &rq); err != nil {
 		errorText := fmt.Sprintf("Failed to parse the request: err=(%s)", err)
 		respondWithJSON(w, http.StatusBadRequest, errorRs{errorText})
 		return
 	}
-
-	partitionOffsets := make([]admin.PartitionOffset, len(partitionOffsetViews))
-	for i, pov := range partitionOffsetViews {
-		partitionOffsets[i].Partition = pov.Partition
-		partitionOffsets[i].Offset = pov.Offset
-		partitionOffsets[i].Metadata = pov.Metadata
-	}
-
-	err = pxy.SetGroupOffsets(group, topic, partitionOffsets)
-	if err != nil {
-		if err = errors.Cause(err); err == sarama.ErrUnknownTopicOrPartition {
-			respondWithJSON(w, http.StatusNotFound, errorRs{"Unknown topic"})
-			return
-		}
-		respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
+	sev, err := log.SeverityFromString(rq.Level)
+	if err != nil || rq.Level == "" {
+		respondWithJSON(w, http.StatusBadRequest, errorRs{fmt.Sprintf("bad level: %s", rq.Level)})
 		return
 	}
+	logging.SetSeverity(sev)
+	log.Infof("Log level changed: level=%s", sev)
+	respondWithJSON(w, http.StatusOK, logLevelRs{strings.ToLower(sev.String())})
+}
 
-	respondWithJSON(w, http.StatusOK, EmptyResponse)
+type produceRs struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
 }
 
-// handleGetTopicConsumers is an HTTP request handler for `GET /topic/{topic}/consumers`
-func (s *T) handleGetTopicConsumers(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	var err error
+// batchAckView is an item of a batch ack request. It acknowledges either a
+// message with the specified offset, or all messages in the [from, to]
+// offset range.
+type batchAckView struct {
+	Partition *int32 `json:"partition"`
+	Offset    *int64 `json:"offset"`
+	From      *int64 `json:"from"`
+	To        *int64 `json:"to"`
+}
 
-	pxy, err := s.getProxy(r)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
-	}
-	topic := mux.Vars(r)[prmTopic]
+type batchProduceRecord struct {
+	Key   *string `json:"key"`
+	Value *string `json:"value"`
+}
 
-	group, err := getGroupParam(r, true)
-	if err != nil {
-		respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-		return
+type batchProduceRs struct {
+	Results []batchProduceResult `json:"results"`
+}
+
+type batchProduceResult struct {
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type consumeRs struct {
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	// Milliseconds since epoch, omitted if Kafka does not provide it.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// The number of times the message has been offered to the group.
+	DeliveryAttempt int `json:"delivery_attempt,omitempty"`
+	// High water mark of the partition and the number of messages after
+	// this one, as of when the message was fetched.
+	HighWaterMark int64 `json:"high_watermark"`
+	Lag           int64 `json:"lag"`
+	// Position of the message among messages of a batch with the same key,
+	// starting from 1. Only set in batch consume responses, and only for
+	// messages with a key.
+	KeySeq int `json:"key_seq,omitempty"`
+}
+
+// consumeAnyRs is a response to a consume request that names several topics.
+// It is the same as `consumeRs` plus the topic the message comes from.
+type consumeAnyRs struct {
+	Topic string `json:"topic"`
+	consumeRs
+}
+
+// decodedConsumeRs is a response to a consume request that accepts the
+// decoded JSON format. It is the same as `consumeRs`, but the key and the
+// value are embedded as JSON if they are valid JSON, and as strings
+// otherwise.
+type decodedConsumeRs struct {
+	Topic string          `json:"topic,omitempty"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+	consumeRs
+}
+
+func newConsumeRs(consMsg consumer.Message) consumeRs {
+	consRs := consumeRs{
+		Key:       consMsg.Key,
+		Value:     consMsg.Value,
+		Partition: consMsg.Partition,
+		Offset:    consMsg.Offset,
+
+		DeliveryAttempt: consMsg.DeliveryAttempt,
+		HighWaterMark:   consMsg.HighWaterMark,
+		Lag:             remainingLag(consMsg),
+	}
+	if !consMsg.Timestamp.IsZero() {
+		consRs.Timestamp = consMsg.Timestamp.UnixNano() / int64(time.Millisecond)
 	}
+	return consRs
+}
 
-	var consumers map[string]map[string][]int32
-	if group == "" {
-		consumers, err = pxy.GetAllTopicConsumers(topic)
-		if err != nil {
-			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
-			return
+// keyGroupRs is a group of messages with the same key in a batch consume
+// response grouped by key.
+type keyGroupRs struct {
+	Key      json.RawMessage `json:"key"`
+	Messages []interface{}   `json:"messages"`
+}
+
+// newBatchRs returns a response to a batch consume request. Every message
+// with a key is numbered among messages of the batch with the same key, so
+// that clients processing messages in parallel can still preserve the order
+// of messages with the same key. If `groupByKey` is true, then messages are
+// grouped by key, with groups ordered by their first message.
+func newBatchRs(consMsgs []consumer.Message, format consumeFormat, groupByKey bool) interface{} {
+	keySeqs := make(map[string]int)
+	batchRs := make([]interface{}, len(consMsgs))
+	for i, consMsg := range consMsgs {
+		keySeq := 0
+		if consMsg.Key != nil {
+			keySeqs[string(consMsg.Key)]++
+			keySeq = keySeqs[string(consMsg.Key)]
 		}
-	} else {
-		groupConsumers, err := pxy.GetTopicConsumers(group, topic)
-		if err != nil {
-			if _, ok := err.(admin.ErrInvalidParam); ok {
-				respondWithJSON(w, http.StatusBadRequest, errorRs{err.Error()})
-				return
-			}
-			respondWithJSON(w, http.StatusInternalServerError, errorRs{err.Error()})
-			return
+		if format == consumeFormatDecoded {
+			consRs := newDecodedConsumeRs(consMsg)
+			consRs.KeySeq = keySeq
+			batchRs[i] = consRs
+			continue
 		}
-		consumers = make(map[string]map[string][]int32)
-		if len(groupConsumers) != 0 {
-			consumers[group] = groupConsumers
+		consRs := newConsumeRs(consMsg)
+		consRs.KeySeq = keySeq
+		batchRs[i] = consRs
+	}
+	if !groupByKey {
+		return batchRs
+	}
+	// Messages without a key make a group of their own.
+	var groups []*keyGroupRs
+	keyGroups := make(map[string]*keyGroupRs)
+	var keylessGroup *keyGroupRs
+	for i, consMsg := range consMsgs {
+		group := keylessGroup
+		if consMsg.Key != nil {
+			group = keyGroups[string(consMsg.Key)]
+		}
+		if group == nil {
+			group = &keyGroupRs{}
+			if format == consumeFormatDecoded {
+				group.Key = decodedJSON(consMsg.Key)
+			} else {
+				group.Key, _ = json.Marshal(consMsg.Key)
+			}
+			if consMsg.Key == nil {
+				keylessGroup = group
+			} else {
+				keyGroups[string(consMsg.Key)] = group
+			}
+			groups = append(groups, group)
 		}
+		group.Messages = append(group.Messages, batchRs[i])
 	}
+	return groups
+}
 
-	encodedRes, err := json.MarshalIndent(consumers, "", "  ")
-	if err != nil {
-		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", http.StatusOK, encodedRes, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func newDecodedConsumeRs(consMsg consumer.Message) decodedConsumeRs {
+	return decodedConsumeRs{
+		Key:       decodedJSON(consMsg.Key),
+		Value:     decodedJSON(consMsg.Value),
+		consumeRs: newConsumeRs(consMsg),
 	}
-	encodedRes = prettyfmt.CollapseJSON(encodedRes)
+}
 
-	w.Header().Add(hdrContentType, "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(encodedRes); err != nil {
-		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", http.StatusOK, encodedRes, err)
+// decodedJSON returns `b` as is if it is valid JSON, or as a JSON string
+// otherwise. Nil is returned as JSON null.
+func decodedJSON(b []byte) json.RawMessage {
+	if b == nil || json.Valid(b) {
+		return b
 	}
+	encoded, _ := json.Marshal(string(b))
+	return encoded
 }
 
-func (s *T) handlePing(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("pong"))
+// remainingLag returns the number of messages in the partition after the
+// consumed one, as of when it was fetched.
+func remainingLag(consMsg consumer.Message) int64 {
+	lag := consMsg.HighWaterMark - consMsg.Offset - 1
+	if lag < 0 {
+		return 0
+	}
+	return lag
 }
 
-type produceRs struct {
+type partitionInfo struct {
+	Partition   int32  `json:"partition"`
+	Begin       int64  `json:"begin"`
+	End         int64  `json:"end"`
+	Count       int64  `json:"count"`
+	Offset      int64  `json:"offset"`
+	Lag         int64  `json:"lag"`
+	Metadata    string `json:"metadata,omitempty"`
+	SparseAcks  string `json:"sparse_acks,omitempty"`
+	AckMetadata string `json:"ack_metadata,omitempty"`
+}
+
+type seekRq struct {
+	Offsets   []seekOffsetView `json:"offsets"`
+	Timestamp *int64           `json:"timestamp"`
+	Position  string           `json:"position"`
+	Force     bool             `json:"force"`
+}
+
+type reprocessRs struct {
+	Topic       string `json:"topic"`
+	Reprocessed int    `json:"reprocessed"`
+}
+
+type seekOffsetView struct {
 	Partition int32 `json:"partition"`
 	Offset    int64 `json:"offset"`
 }
 
-type consumeRs struct {
-	Key       []byte `json:"key"`
-	Value     []byte `json:"value"`
+type createTopicRq struct {
+	Topic             string            `json:"topic"`
+	Partitions        int32             `json:"partitions"`
+	ReplicationFactor int32             `json:"replication_factor"`
+	Config            map[string]string `json:"config"`
+}
+
+type topicView struct {
+	PartitionCount int                 `json:"partition_count"`
+	Partitions     []partitionMetaView `json:"partitions"`
+}
+
+type partitionMetaView struct {
+	Partition int32   `json:"partition"`
+	Leader    int32   `json:"leader"`
+	Replicas  []int32 `json:"replicas"`
+	ISR       []int32 `json:"isr"`
+}
+
+func newTopicView(topicMeta admin.TopicMetadata) topicView {
+	view := topicView{
+		PartitionCount: len(topicMeta.Partitions),
+		Partitions:     make([]partitionMetaView, len(topicMeta.Partitions)),
+	}
+	for i, pm := range topicMeta.Partitions {
+		view.Partitions[i] = partitionMetaView{
+			Partition: pm.Partition,
+			Leader:    pm.Leader,
+			Replicas:  pm.Replicas,
+			ISR:       pm.ISR,
+		}
+	}
+	return view
+}
+
+type healthView struct {
+	Status   string                       `json:"status"`
+	Clusters map[string]map[string]string `json:"clusters"`
+}
+
+type groupView struct {
+	Members map[string]memberView `json:"members"`
+}
+
+type memberView struct {
+	Registered    bool               `json:"registered"`
+	Subscriptions []string           `json:"subscriptions"`
+	Partitions    map[string][]int32 `json:"partitions"`
+}
+
+type groupOffsetsView struct {
+	Topics map[string][]groupOffsetView `json:"topics"`
+	Force  bool                         `json:"force,omitempty"`
+}
+
+type groupOffsetView struct {
 	Partition int32  `json:"partition"`
 	Offset    int64  `json:"offset"`
+	Metadata  string `json:"metadata,omitempty"`
 }
 
-type partitionInfo struct {
-	Partition  int32  `json:"partition"`
-	Begin      int64  `json:"begin"`
-	End        int64  `json:"end"`
-	Count      int64  `json:"count"`
-	Offset     int64  `json:"offset"`
-	Lag        int64  `json:"lag"`
-	Metadata   string `json:"metadata,omitempty"`
-	SparseAcks string `json:"sparse_acks,omitempty"`
+type groupLagView struct {
+	Lag    int64                   `json:"lag"`
+	Topics map[string]topicLagView `json:"topics"`
+}
+
+type topicLagView struct {
+	Lag        int64              `json:"lag"`
+	Partitions []partitionLagView `json:"partitions"`
+}
+
+type partitionLagView struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+	End       int64 `json:"end"`
+	Lag       int64 `json:"lag"`
+}
+
+type logLevelRs struct {
+	Level string `json:"level"`
 }
 
 type errorRs struct {
 	Error string `json:"error"`
 }
 
+type rejectedRs struct {
+	Error        string `json:"error"`
+	Reason       string `json:"reason"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+type wsAckRq struct {
+	Partition *int32 `json:"partition"`
+	Offset    *int64 `json:"offset"`
+}
+
 // getParamBytes returns the request parameter s a slice of bytes. It works
 // pretty much the same way s `http.FormValue`, except it distinguishes empty
 // value (`[]byte{}`) from missing one (`nil`).
@@ -493,9 +3467,126 @@ func getParamBytes(r *http.Request, name string) []byte {
 	return []byte(values[0])
 }
 
+type metricView struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Count     int64             `json:"count,omitempty"`
+	Value     int64             `json:"value,omitempty"`
+	Histogram *histogramView    `json:"histogram,omitempty"`
+}
+
+type actorsRs struct {
+	Goroutines int        `json:"goroutines"`
+	Actors     *actorView `json:"actors"`
+}
+
+type actorView struct {
+	Name            string       `json:"name"`
+	StartedAt       *time.Time   `json:"started_at,omitempty"`
+	Goroutines      int          `json:"goroutines"`
+	TotalGoroutines int          `json:"total_goroutines"`
+	Failures        int          `json:"failures,omitempty"`
+	LastError       string       `json:"last_error,omitempty"`
+	LastFailedAt    *time.Time   `json:"last_failed_at,omitempty"`
+	Children        []*actorView `json:"children,omitempty"`
+}
+
+func newActorView(node *actor.Node) *actorView {
+	av := actorView{
+		Name:            node.Name,
+		Goroutines:      node.Goroutines,
+		TotalGoroutines: node.TotalGoroutines,
+		Failures:        node.Failures,
+		LastError:       node.LastError,
+	}
+	if !node.StartedAt.IsZero() {
+		startedAt := node.StartedAt
+		av.StartedAt = &startedAt
+	}
+	if !node.LastFailedAt.IsZero() {
+		lastFailedAt := node.LastFailedAt
+		av.LastFailedAt = &lastFailedAt
+	}
+	for _, child := range node.Children {
+		av.Children = append(av.Children, newActorView(child))
+	}
+	return &av
+}
+
+type stateRs struct {
+	Clusters map[string]consumerStateView `json:"clusters"`
+}
+
+type consumerStateView struct {
+	QueueLen int              `json:"queue_len"`
+	Groups   []groupStateView `json:"groups"`
+}
+
+type groupStateView struct {
+	Group         string              `json:"group"`
+	QueueLen      int                 `json:"queue_len"`
+	Subscriptions map[string][]string `json:"subscriptions"`
+	Topics        []topicStateView    `json:"topics"`
+}
+
+type topicStateView struct {
+	Topic      string               `json:"topic"`
+	QueueLen   int                  `json:"queue_len"`
+	Partitions []partitionStateView `json:"partitions"`
+}
+
+type partitionStateView struct {
+	Partition       int32 `json:"partition"`
+	Claimed         bool  `json:"claimed"`
+	Initialized     bool  `json:"initialized"`
+	CommittedOffset int64 `json:"committed_offset"`
+	SubmittedOffset int64 `json:"submitted_offset"`
+	Offered         int   `json:"offered"`
+	Lag             int64 `json:"lag"`
+}
+
+func newConsumerStateView(state consumer.State) consumerStateView {
+	csv := consumerStateView{QueueLen: state.QueueLen, Groups: []groupStateView{}}
+	for _, gs := range state.Groups {
+		gsv := groupStateView{
+			Group:         gs.Group,
+			QueueLen:      gs.QueueLen,
+			Subscriptions: gs.Subscriptions,
+			Topics:        []topicStateView{},
+		}
+		if gsv.Subscriptions == nil {
+			gsv.Subscriptions = map[string][]string{}
+		}
+		for _, ts := range gs.Topics {
+			tsv := topicStateView{Topic: ts.Topic, QueueLen: ts.QueueLen, Partitions: []partitionStateView{}}
+			for _, ps := range ts.Partitions {
+				tsv.Partitions = append(tsv.Partitions, partitionStateView(ps))
+			}
+			gsv.Topics = append(gsv.Topics, tsv)
+		}
+		csv.Groups = append(csv.Groups, gsv)
+	}
+	return csv
+}
+
+type histogramView struct {
+	Min  int64   `json:"min"`
+	Max  int64   `json:"max"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+}
+
 // respondWithJSON marshals `body` to a JSON string and sends it s an HTTP
 // response body along with the specified `status` code.
 func respondWithJSON(w http.ResponseWriter, status int, body interface{}) {
+	respondWithJSONAs(w, status, contentTypeJSON, body)
+}
+
+// respondWithJSONAs is the same as `respondWithJSON`, but the response is
+// sent with the specified content type.
+func respondWithJSONAs(w http.ResponseWriter, status int, contentType string, body interface{}) {
 	encodedRes, err := json.MarshalIndent(body, "", "  ")
 	if err != nil {
 		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", status, body, err)
@@ -503,13 +3594,35 @@ func respondWithJSON(w http.ResponseWriter, status int, body interface{}) {
 		return
 	}
 
-	w.Header().Add(hdrContentType, "application/json")
+	w.Header().Add(hdrContentType, contentType)
 	w.WriteHeader(status)
 	if _, err := w.Write(encodedRes); err != nil {
 		log.Errorf("Failed to send HTTP response: status=%d, body=%v, err=%+v", status, body, err)
 	}
 }
 
+// writeWSJSON marshals `body` to a JSON string and sends it as a WebSocket
+// message.
+func writeWSJSON(conn *websocket.Conn, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal")
+	}
+	return conn.WriteMessage(encoded)
+}
+
+// writeSSEJSON marshals `body` to a JSON string and sends it as the data of a
+// Server-Sent Event. Marshaled JSON never contains new lines, so it always
+// fits into a single data field.
+func writeSSEJSON(w io.Writer, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal")
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", encoded)
+	return err
+}
+
 func getGroupParam(r *http.Request, opt bool) (string, error) {
 	r.ParseForm()
 	groups := r.Form[prmGroup]
@@ -522,6 +3635,112 @@ func getGroupParam(r *http.Request, opt bool) (string, error) {
 	return groups[0], nil
 }
 
+// parseBatchLimits returns batch consume limits specified in the request. If
+// a batch is not requested then `maxMessages` is zero.
+func parseBatchLimits(r *http.Request) (maxMessages, maxBytes int, err error) {
+	maxMessagesStr := getParamBytes(r, prmMaxMessages)
+	if maxMessagesStr != nil {
+		maxMessages, err = strconv.Atoi(string(maxMessagesStr))
+		if err != nil || maxMessages <= 0 {
+			return 0, 0, errors.Errorf("bad %s: %s", prmMaxMessages, maxMessagesStr)
+		}
+	}
+	maxBytesStr := getParamBytes(r, prmMaxBytes)
+	if maxBytesStr != nil {
+		if maxMessagesStr == nil {
+			return 0, 0, errors.Errorf("%s can only be used with %s", prmMaxBytes, prmMaxMessages)
+		}
+		maxBytes, err = strconv.Atoi(string(maxBytesStr))
+		if err != nil || maxBytes <= 0 {
+			return 0, 0, errors.Errorf("bad %s: %s", prmMaxBytes, maxBytesStr)
+		}
+	}
+	return maxMessages, maxBytes, nil
+}
+
+// parseCount returns the number of messages requested by a peek or a
+// partition read request.
+func parseCount(r *http.Request) (int, error) {
+	countStr := getParamBytes(r, prmCount)
+	if countStr == nil {
+		return defaultMessageCount, nil
+	}
+	count, err := strconv.Atoi(string(countStr))
+	if err != nil || count <= 0 || count > maxMessageCount {
+		return 0, errors.Errorf("bad %s: %s", prmCount, countStr)
+	}
+	return count, nil
+}
+
+// parseTopics returns either a list of topics given in the `topics` parameter
+// as a comma separated list or as multiple parameter values, or a pattern
+// given in the `topicPattern` parameter that topic names must fully match.
+func parseTopics(r *http.Request) ([]string, *regexp.Regexp, error) {
+	r.ParseForm()
+	var topics []string
+	for _, topicsStr := range r.Form[prmTopics] {
+		for _, topic := range strings.Split(topicsStr, ",") {
+			if topic == "" {
+				return nil, nil, errors.Errorf("bad %s: %s", prmTopics, topicsStr)
+			}
+			topics = append(topics, topic)
+		}
+	}
+	patternStr := getParamBytes(r, prmTopicPattern)
+	switch {
+	case patternStr != nil && len(topics) != 0:
+		return nil, nil, errors.Errorf("%s and %s cannot be used together", prmTopics, prmTopicPattern)
+	case patternStr != nil:
+		pattern, err := regexp.Compile("^(?:" + string(patternStr) + ")$")
+		if err != nil {
+			return nil, nil, errors.Errorf("bad %s: %s", prmTopicPattern, patternStr)
+		}
+		return nil, pattern, nil
+	case len(topics) == 0:
+		return nil, nil, errors.Errorf("either %s or %s must be provided", prmTopics, prmTopicPattern)
+	}
+	return topics, nil, nil
+}
+
+// parseTimeout returns the long polling timeout specified in the request, or
+// zero if it is not specified.
+func parseTimeout(r *http.Request) (time.Duration, error) {
+	timeoutStr := getParamBytes(r, prmTimeout)
+	if timeoutStr == nil {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(string(timeoutStr))
+	if err != nil || timeout <= 0 {
+		return 0, errors.Errorf("bad %s: %s", prmTimeout, timeoutStr)
+	}
+	return timeout, nil
+}
+
+// setInitialOffset sets the initial offset policy of the consumer group if
+// one is specified in the request.
+func setInitialOffset(r *http.Request, pxy *proxy.T, group string) error {
+	initialOffset, err := parseInitialOffset(r)
+	if err != nil || initialOffset == "" {
+		return err
+	}
+	pxy.SetGroupInitialOffset(group, initialOffset)
+	return nil
+}
+
+// parseInitialOffset returns the initial offset policy specified in the
+// request, or an empty string if there is none.
+func parseInitialOffset(r *http.Request) (config.InitialOffset, error) {
+	initialOffsetStr := getParamBytes(r, prmInitialOffset)
+	if initialOffsetStr == nil {
+		return "", nil
+	}
+	var initialOffset config.InitialOffset
+	if err := initialOffset.UnmarshalText(initialOffsetStr); err != nil {
+		return "", errors.Errorf("bad %s: %s", prmInitialOffset, initialOffsetStr)
+	}
+	return initialOffset, nil
+}
+
 // toEncoderPreservingNil converts a slice of bytes to `sarama.Encoder` but
 // returns `nil` if the passed slice is `nil`.
 func toEncoderPreservingNil(b []byte) sarama.Encoder {
@@ -532,40 +3751,53 @@ func toEncoderPreservingNil(b []byte) sarama.Encoder {
 }
 
 func parseAck(r *http.Request, isConsReq bool) (proxy.Ack, error) {
-	var partitionPrmName, offsetPrmName string
+	var partitionPrmName, offsetPrmName, metadataPrmName string
 	if isConsReq {
 		partitionPrmName = prmAckPartition
 		offsetPrmName = prmAckOffset
+		metadataPrmName = prmAckMetadata
 	} else {
 		partitionPrmName = prmPartition
 		offsetPrmName = prmOffset
+		metadataPrmName = prmMetadata
 	}
 
-	_, noAck := mux.Vars(r)[prmNoAck]
-	if noAck {
+	if isConsReq && getParamBytes(r, prmNoAck) != nil {
 		return proxy.NoAck(), nil
 	}
 	var err error
 	var partition int64
-	partitionStr, partitionOk := mux.Vars(r)[partitionPrmName]
-	if partitionOk {
-		partition, err = strconv.ParseInt(partitionStr, 10, 32)
-		if err == nil || partition < 0 {
-			return proxy.NoAck(), errors.Wrapf(err, "bad %s: %s", partitionPrmName, partitionStr)
+	partitionStr := getParamBytes(r, partitionPrmName)
+	if partitionStr != nil {
+		partition, err = strconv.ParseInt(string(partitionStr), 10, 32)
+		if err != nil || partition < 0 {
+			return proxy.NoAck(), errors.Errorf("bad %s: %s", partitionPrmName, partitionStr)
 		}
 	}
 	var offset int64
-	offsetStr, offsetOk := mux.Vars(r)[offsetPrmName]
-	if offsetOk {
-		offset, err = strconv.ParseInt(offsetStr, 10, 64)
-		if err == nil || offset < 0 {
-			return proxy.NoAck(), errors.Wrapf(err, "bad %s: %s", offsetPrmName, offsetStr)
+	offsetStr := getParamBytes(r, offsetPrmName)
+	if offsetStr != nil {
+		offset, err = strconv.ParseInt(string(offsetStr), 10, 64)
+		if err != nil || offset < 0 {
+			return proxy.NoAck(), errors.Errorf("bad %s: %s", offsetPrmName, offsetStr)
 		}
 	}
-	if partitionOk && offsetOk {
-		return proxy.NewAck(int32(partition), offset)
+	metadata := string(getParamBytes(r, metadataPrmName))
+	if len(metadata) > maxAckMetadataLen {
+		return proxy.NoAck(), errors.Errorf("%s is too long: limit=%d", metadataPrmName, maxAckMetadataLen)
+	}
+	if partitionStr != nil && offsetStr != nil {
+		ack, err := proxy.NewAck(int32(partition), offset)
+		return ack.WithMeta(metadata), err
+	}
+	if metadata != "" {
+		return proxy.NoAck(), errors.Errorf("%s can only be used with %s and %s", metadataPrmName, partitionPrmName, offsetPrmName)
+	}
+	// An explicit ack request must specify a message to acknowledge.
+	if !isConsReq {
+		return proxy.NoAck(), errors.Errorf("%s and %s must be provided", partitionPrmName, offsetPrmName)
 	}
-	if !partitionOk && !offsetOk {
+	if partitionStr == nil && offsetStr == nil {
 		return proxy.AutoAck(), nil
 	}
 	return proxy.NoAck(), errors.Errorf("%s and %s either both should be provided or neither", partitionPrmName, offsetPrmName)
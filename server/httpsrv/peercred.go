@@ -0,0 +1,60 @@
+package httpsrv
+
+import (
+	"context"
+	"net"
+
+	"github.com/mailgun/log"
+)
+
+// peerCredListener is a Unix domain socket listener that attaches peer
+// credentials to accepted connections, so that requests can be authenticated
+// by the local user of the client process.
+type peerCredListener struct {
+	net.Listener
+}
+
+// implements `net.Listener`.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, nil
+	}
+	uid, err := peerUID(unixConn)
+	if err != nil {
+		log.Errorf("Failed to get peer credentials: err=(%s)", err)
+		return conn, nil
+	}
+	return &peerCredConn{Conn: conn, addr: &peerAddr{Addr: conn.RemoteAddr(), uid: uid}}, nil
+}
+
+// peerCredConn is a connection whose remote address carries the peer user
+// ID. The address is used to pass the ID along because the graceful server
+// wraps connections, but keeps their remote addresses.
+type peerCredConn struct {
+	net.Conn
+	addr *peerAddr
+}
+
+// implements `net.Conn`.
+func (c *peerCredConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type peerAddr struct {
+	net.Addr
+	uid uint32
+}
+
+// peerCredContext is used as `http.Server.ConnContext`, it adds the peer user
+// ID of a connection to the context of requests that come over it.
+func peerCredContext(ctx context.Context, conn net.Conn) context.Context {
+	if addr, ok := conn.RemoteAddr().(*peerAddr); ok {
+		return context.WithValue(ctx, peerUIDCtxKey, addr.uid)
+	}
+	return ctx
+}
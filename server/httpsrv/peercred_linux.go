@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package httpsrv
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// peerCredSupported tells whether peer credentials of Unix domain socket
+// connections can be obtained on this platform.
+const peerCredSupported = true
+
+// peerUID returns the user ID of the process on the other end of a Unix
+// domain socket connection.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get raw connection")
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, errors.Wrap(err, "failed to access socket")
+	}
+	if credErr != nil {
+		return 0, errors.Wrap(credErr, "failed to get SO_PEERCRED")
+	}
+	return cred.Uid, nil
+}
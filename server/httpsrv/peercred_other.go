@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package httpsrv
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// peerCredSupported tells whether peer credentials of Unix domain socket
+// connections can be obtained on this platform.
+const peerCredSupported = false
+
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -1,24 +1,32 @@
 package service
 
 import (
-	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/audit"
 	"github.com/mailgun/kafka-pixy/config"
-	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/mailgun/kafka-pixy/dedup"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/mirror"
+	"github.com/mailgun/kafka-pixy/pixy"
+	"github.com/mailgun/kafka-pixy/ratelimit"
 	"github.com/mailgun/kafka-pixy/server"
 	"github.com/mailgun/kafka-pixy/server/grpcsrv"
 	"github.com/mailgun/kafka-pixy/server/httpsrv"
+	"github.com/mailgun/kafka-pixy/webhook"
 	"github.com/mailgun/log"
 	"github.com/pkg/errors"
 )
 
 type T struct {
 	actorID *actor.ID
-	proxies map[string]*proxy.T
+	pixy    *pixy.T
 	servers []server.T
+	deduper *dedup.T
+	auditor *audit.T
 	stopCh  chan struct{}
 	wg      sync.WaitGroup
 }
@@ -26,49 +34,75 @@ type T struct {
 func Spawn(cfg *config.App) (*T, error) {
 	s := &T{
 		actorID: actor.RootID.NewChild("service"),
-		proxies: make(map[string]*proxy.T, len(cfg.Proxies)),
 		stopCh:  make(chan struct{}),
 	}
 
-	for cluster, pxyCfg := range cfg.Proxies {
-		pxy, err := proxy.Spawn(actor.RootID, cluster, pxyCfg)
-		if err != nil {
-			s.stopProxies()
-			return nil, errors.Wrapf(err, "failed to spawn proxy, name=%s", cluster)
-		}
-		s.proxies[cluster] = pxy
+	var err error
+	if s.pixy, err = pixy.New(cfg); err != nil {
+		return nil, err
 	}
-
-	proxySet := proxy.NewSet(s.proxies, s.proxies[cfg.DefaultCluster])
+	proxySet := s.pixy.Proxies()
 
 	if cfg.GRPCAddr != "" {
 		grpcSrv, err := grpcsrv.New(cfg.GRPCAddr, proxySet)
 		if err != nil {
-			s.stopProxies()
+			s.pixy.Stop()
 			return nil, errors.Wrap(err, "failed to start gRPC server")
 		}
 		s.servers = append(s.servers, grpcSrv)
 	}
-	if cfg.TCPAddr != "" {
-		tcpSrv, err := httpsrv.New(cfg.TCPAddr, proxySet)
-		if err != nil {
-			s.stopProxies()
-			return nil, errors.Wrap(err, "failed to start TCP socket based HTTP API server")
-		}
-		s.servers = append(s.servers, tcpSrv)
+	// Rate limits, concurrency caps and idempotency keys are shared by all
+	// listeners. Tenant quotas are enforced by proxies.
+	limiter := ratelimit.New(&cfg.HTTP.RateLimit)
+	concurrency := ratelimit.NewConcurrency(&cfg.HTTP.Concurrency)
+	if s.deduper, err = dedup.New(&cfg.HTTP.Idempotency); err != nil {
+		s.pixy.Stop()
+		return nil, errors.Wrap(err, "failed to load idempotency keys")
 	}
-	if cfg.UnixAddr != "" {
-		unixSrv, err := httpsrv.New(cfg.UnixAddr, proxySet)
+	auditPxy, _ := proxySet.Get(cfg.HTTP.Audit.Cluster)
+	if s.auditor, err = audit.New(&cfg.HTTP.Audit, auditPxy); err != nil {
+		s.pixy.Stop()
+		return nil, errors.Wrap(err, "failed to start auditing")
+	}
+	for _, lsnCfg := range cfg.HTTPListeners() {
+		lsnCfg := lsnCfg
+		httpSrv, err := httpsrv.New(&lsnCfg, &cfg.HTTP, proxySet, limiter, s.deduper, concurrency, s.auditor)
 		if err != nil {
-			s.stopProxies()
-			return nil, errors.Wrapf(err, "failed to start Unix socket based HTTP API server")
+			s.pixy.Stop()
+			if strings.Contains(lsnCfg.Addr, ":") {
+				return nil, errors.Wrap(err, "failed to start TCP socket based HTTP API server")
+			}
+			return nil, errors.Wrap(err, "failed to start Unix socket based HTTP API server")
 		}
-		s.servers = append(s.servers, unixSrv)
+		s.servers = append(s.servers, httpSrv)
 	}
 
 	if len(s.servers) == 0 {
+		s.pixy.Stop()
 		return nil, errors.Errorf("at least one API server should be configured")
 	}
+	// Webhook pushers and mirrors are run as servers, so that they are
+	// stopped before proxies they consume from and produce to.
+	for cluster, pxyCfg := range cfg.Proxies {
+		for _, sub := range pxyCfg.Webhook.Subscriptions {
+			pxy, _ := proxySet.Get(cluster)
+			s.servers = append(s.servers, webhook.New(s.actorID, pxyCfg, sub, pxy))
+		}
+		for _, mt := range pxyCfg.Mirror.Topics {
+			src, _ := proxySet.Get(cluster)
+			dst, _ := proxySet.Get(mt.Cluster)
+			s.servers = append(s.servers, mirror.New(s.actorID, pxyCfg, mt, src, dst))
+		}
+	}
+
+	if cfg.StatsD.Addr != "" {
+		statsD, err := metrics.NewStatsD(s.actorID, &cfg.StatsD, metrics.DefaultRegistry)
+		if err != nil {
+			s.pixy.Stop()
+			return nil, errors.Wrap(err, "failed to start StatsD reporter")
+		}
+		s.servers = append(s.servers, statsD)
+	}
 
 	actor.Spawn(s.actorID, &s.wg, s.run)
 	return s, nil
@@ -113,13 +147,16 @@ func (s *T) run() {
 
 	// There are no more requests in flight at this point so it is safe to stop
 	// all proxies.
-	s.stopProxies()
-}
+	s.pixy.Stop()
 
-func (s *T) stopProxies() {
-	var wg sync.WaitGroup
-	for pxyAlias, pxy := range s.proxies {
-		actor.Spawn(s.actorID.NewChild(fmt.Sprintf("%s_stop", pxyAlias)), &wg, pxy.Stop)
+	if s.deduper != nil {
+		if err := s.deduper.Save(); err != nil {
+			log.Errorf("Failed to save idempotency keys: %+v", err)
+		}
+	}
+	if s.auditor != nil {
+		if err := s.auditor.Close(); err != nil {
+			log.Errorf("Failed to close audit file: %+v", err)
+		}
 	}
-	wg.Wait()
 }
@@ -48,6 +48,29 @@ func (s *ServiceGRPCSuite) TearDownTest(c *C) {
 	s.kh.Close()
 }
 
+// gRPC requests count against quotas of the tenant that owns the topic.
+func (s *ServiceGRPCSuite) TestTenantQuotas(c *C) {
+	s.cfg.HTTP.Tenants = map[string]config.Tenant{
+		"t1": {TopicPrefixes: []string{"test.1"}, BytesPerSecond: 1},
+	}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = s.clt.Produce(ctx, &pb.ProdRq{Topic: "test.1", Message: []byte("msg")}, grpc.FailFast(false))
+	c.Assert(err, IsNil)
+
+	// When
+	_, err = s.clt.Produce(ctx, &pb.ProdRq{Topic: "test.1", Message: []byte("msg")}, grpc.FailFast(false))
+
+	// Then
+	c.Assert(grpc.Code(err), Equals, codes.ResourceExhausted)
+	// Topics that the tenant does not own are not affected.
+	_, err = s.clt.Produce(ctx, &pb.ProdRq{Topic: "test.4", Message: []byte("msg")}, grpc.FailFast(false))
+	c.Assert(grpc.Code(err), Not(Equals), codes.ResourceExhausted)
+}
+
 // If `key` is explicitly specified produced messages are deterministically
 // distributed between partitions.
 func (s *ServiceGRPCSuite) TestProduceWithKey(c *C) {
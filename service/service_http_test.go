@@ -1,7 +1,9 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strconv"
@@ -19,10 +22,15 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/mailgun/kafka-pixy/actor"
 	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer/offsettrk"
 	pb "github.com/mailgun/kafka-pixy/gen/golang"
+	"github.com/mailgun/kafka-pixy/logging"
+	"github.com/mailgun/kafka-pixy/offsetmgr"
 	"github.com/mailgun/kafka-pixy/server/httpsrv"
 	"github.com/mailgun/kafka-pixy/testhelpers"
 	"github.com/mailgun/kafka-pixy/testhelpers/kafkahelper"
+	"github.com/mailgun/kafka-pixy/websocket"
+	"github.com/mailgun/log"
 	"github.com/pkg/errors"
 	. "gopkg.in/check.v1"
 )
@@ -293,6 +301,92 @@ func (s *ServiceHTTPSuite) TestMessageTooLarge(c *C) {
 	c.Assert(offsetsAfter, DeepEquals, offsetsBefore)
 }
 
+// Produce requests with a body larger than `http.max_produce_body_bytes` are
+// rejected without reading the body.
+func (s *ServiceHTTPSuite) TestProduceBodyTooLarge(c *C) {
+	s.cfg.HTTP.MaxProduceBodyBytes = 100
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/messages?sync",
+		"text/plain", strings.NewReader(GenMessage(101)))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "request body is too large: limit=100, actual=101"})
+}
+
+// A gzip encoded body is decompressed before it is produced.
+func (s *ServiceHTTPSuite) TestProduceGzip(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	req, err := http.NewRequest("POST", "http://_/topics/test.4/messages?key=1&sync",
+		bytes.NewReader(gzipBytes(c, []byte("Foo"))))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+	r, err := s.unixClient.Do(req)
+	svc.Stop() // Have to stop before getOffsets
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+1)
+	msgs := s.kh.GetMessages("test.4", offsetsBefore, offsetsAfter)
+	c.Assert(msgs, DeepEquals,
+		[][]string{{"Foo"}, []string(nil), []string(nil), []string(nil)})
+}
+
+// The body size limit applies to a decompressed gzip body.
+func (s *ServiceHTTPSuite) TestProduceGzipTooLarge(c *C) {
+	s.cfg.HTTP.MaxProduceBodyBytes = 100
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	req, err := http.NewRequest("POST", "http://_/topics/test.4/messages?sync",
+		bytes.NewReader(gzipBytes(c, bytes.Repeat([]byte("a"), 101))))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+	r, err := s.unixClient.Do(req)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "request body is too large: limit=100"})
+}
+
+func (s *ServiceHTTPSuite) TestProduceUnsupportedEncoding(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	req, err := http.NewRequest("POST", "http://_/topics/test.4/messages?sync",
+		strings.NewReader("Foo"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "br")
+	r, err := s.unixClient.Do(req)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusUnsupportedMediaType)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "unsupported content encoding br"})
+}
+
 func (s *ServiceHTTPSuite) TestSyncProduce(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
@@ -313,6 +407,40 @@ func (s *ServiceHTTPSuite) TestSyncProduce(c *C) {
 	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+1)
 }
 
+// A retry of a produce request with the same idempotency key gets the
+// response to the original request, and the message is produced only once.
+func (s *ServiceHTTPSuite) TestSyncProduceIdempotent(c *C) {
+	s.cfg.HTTP.Idempotency = config.HTTPIdempotency{MaxKeys: 100, TTL: time.Minute}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	var rs []*http.Response
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "http://_/topics/test.4/messages?key=1&sync",
+			strings.NewReader("Foo"))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Idempotency-Key", "req-1")
+		r, err := s.unixClient.Do(req)
+		c.Assert(err, IsNil)
+		rs = append(rs, r)
+	}
+	svc.Stop() // Have to stop before getOffsets
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+
+	// Then
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+1)
+	c.Assert(rs[0].Header.Get("Idempotent-Replayed"), Equals, "")
+	c.Assert(rs[1].Header.Get("Idempotent-Replayed"), Equals, "true")
+	for i, r := range rs {
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("case #%d", i))
+		body := ParseJSONBody(c, r).(map[string]interface{})
+		c.Assert(int64(body["offset"].(float64)), Equals, offsetsBefore[0], Commentf("case #%d", i))
+	}
+}
+
 func (s *ServiceHTTPSuite) TestSyncProduceInvalidTopic(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
@@ -329,6 +457,280 @@ func (s *ServiceHTTPSuite) TestSyncProduceInvalidTopic(c *C) {
 	c.Assert(body["error"], Equals, sarama.ErrUnknownTopicOrPartition.Error())
 }
 
+// Records of a batch produce request in the NDJSON format are produced, and
+// a result is returned for each of them in the request order.
+func (s *ServiceHTTPSuite) TestProduceBatchNDJSON(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/batch", "application/x-ndjson",
+		strings.NewReader(`{"key": "1", "value": "Foo"}`+"\n"+`{"key": "1", "value": "Bar"}`+"\n"))
+	svc.Stop() // Have to stop before getOffsets
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	results := body["results"].([]interface{})
+	c.Assert(len(results), Equals, 2)
+	for _, result := range results {
+		c.Assert(result.(map[string]interface{})["partition"], Equals, float64(0))
+		c.Assert(result.(map[string]interface{})["error"], IsNil)
+	}
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+2)
+}
+
+// Records of a batch produce request can be passed as a JSON array.
+func (s *ServiceHTTPSuite) TestProduceBatchJSONArray(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/batch", "application/json",
+		strings.NewReader(`[{"key": "1", "value": "Foo"}, {"key": "1", "value": "Bar"}, {"key": "1", "value": "Bazz"}]`))
+	svc.Stop() // Have to stop before getOffsets
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(len(body["results"].([]interface{})), Equals, 3)
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0]+3)
+	msgs := s.kh.GetMessages("test.4", offsetsBefore, offsetsAfter)
+	c.Assert(len(msgs[0]), Equals, 3)
+}
+
+// A failure to produce a record is reported in its result.
+func (s *ServiceHTTPSuite) TestProduceBatchInvalidTopic(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/no-such-topic/batch", "application/json",
+		strings.NewReader(`[{"value": "Foo"}]`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	result := body["results"].([]interface{})[0].(map[string]interface{})
+	c.Assert(result["error"], Equals, sarama.ErrUnknownTopicOrPartition.Error())
+}
+
+// A batch produce request with more than `http.max_batch_records` records is
+// rejected as a whole.
+func (s *ServiceHTTPSuite) TestProduceBatchTooManyRecords(c *C) {
+	s.cfg.HTTP.MaxBatchRecords = 2
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	offsetsBefore := s.kh.GetNewestOffsets("test.4")
+
+	for i, tc := range []struct {
+		contentType string
+		body        string
+	}{{
+		contentType: "application/json",
+		body:        `[{"value": "Foo"}, {"value": "Bar"}, {"value": "Bazz"}]`,
+	}, {
+		contentType: "application/x-ndjson",
+		body:        `{"value": "Foo"}` + "\n" + `{"value": "Bar"}` + "\n" + `{"value": "Bazz"}` + "\n",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/topics/test.4/batch", tc.contentType, strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusRequestEntityTooLarge, Commentf("case #%d", i))
+		body := ParseJSONBody(c, r).(map[string]interface{})
+		c.Assert(body["error"], Equals, "too many records: limit=2", Commentf("case #%d", i))
+	}
+	svc.Stop() // Have to stop before getOffsets
+	offsetsAfter := s.kh.GetNewestOffsets("test.4")
+	c.Assert(offsetsAfter[0], Equals, offsetsBefore[0])
+}
+
+// A batch produce request with an invalid body is rejected as a whole.
+func (s *ServiceHTTPSuite) TestProduceBatchInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		contentType string
+		body        string
+		error       string
+	}{{
+		contentType: "application/json",
+		body:        `[]`,
+		error:       "no records",
+	}, {
+		contentType: "application/json",
+		body:        `[{"key": "1"}]`,
+		error:       "record #0 has no value",
+	}, {
+		contentType: "application/x-ndjson",
+		body:        `{"value": "Foo"}` + "\n" + `{"value": `,
+		error:       "failed to parse record #1: unexpected EOF",
+	}, {
+		contentType: "text/plain",
+		body:        `Foo`,
+		error:       "unsupported content type text/plain",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/topics/test.4/batch", tc.contentType, strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		body := ParseJSONBody(c, r).(map[string]interface{})
+		c.Assert(body["error"], Equals, tc.error, Commentf("case #%d", i))
+	}
+}
+
+// Messages of topics with Avro serialization are encoded with the latest
+// schema from the schema registry when produced, and decoded back to JSON
+// when consumed.
+func (s *ServiceHTTPSuite) TestProduceConsumeAvro(c *C) {
+	schema := `{\"type\": \"record\", \"name\": \"R\", \"fields\": [{\"name\": \"a\", \"type\": \"int\"}]}`
+	srMux := http.NewServeMux()
+	srMux.HandleFunc("/subjects/test.1-value/versions/latest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"subject": "test.1-value", "version": 1, "id": 5, "schema": "%s"}`, schema)
+	})
+	srMux.HandleFunc("/schemas/ids/5", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"schema": "%s"}`, schema)
+	})
+	srSrv := httptest.NewServer(srMux)
+	defer srSrv.Close()
+	s.cfg.Proxies["pxyD"].SchemaRegistry.URL = srSrv.URL
+	s.cfg.Proxies["pxyD"].SchemaRegistry.Topics = map[string]config.Serialization{"test.1": config.SerializationAvro}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.ResetOffsets("foo", "test.1")
+	offsetsBefore := s.kh.GetNewestOffsets("test.1")
+
+	// When
+	rInvalid, err := s.unixClient.Post("http://_/topics/test.1/messages?key=1&sync",
+		"application/json", strings.NewReader(`{"a": "foo"}`))
+	c.Assert(err, IsNil)
+	rProd, err := s.unixClient.Post("http://_/topics/test.1/messages?key=1&sync",
+		"application/json", strings.NewReader(`{"a": 1}`))
+	c.Assert(err, IsNil)
+	rCons, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+	c.Assert(err, IsNil)
+
+	// Then
+	c.Assert(rInvalid.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(ParseJSONBody(c, rInvalid).(map[string]interface{})["error"], Equals,
+		"invalid value: field R.a: int expected, got foo")
+	c.Assert(rProd.StatusCode, Equals, http.StatusOK)
+	offsetsAfter := s.kh.GetNewestOffsets("test.1")
+	msgs := s.kh.GetMessages("test.1", offsetsBefore, offsetsAfter)
+	c.Assert(msgs, DeepEquals, [][]string{{"\x00\x00\x00\x00\x05\x02"}})
+	c.Assert(rCons.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(ParseConsRes(c, rCons).Message), Equals, `{"a":1}`)
+}
+
+// Produce transformations are applied before a message is written to Kafka,
+// and consume transformations after it is read.
+func (s *ServiceHTTPSuite) TestProduceConsumeTransform(c *C) {
+	s.cfg.Proxies["pxyD"].Transform.Topics = map[string]config.TopicTransform{
+		"test.1": {
+			Produce: []config.TransformStage{{Type: config.TransformRedact, Fields: []string{"pwd"}}},
+			Consume: []config.TransformStage{{Type: config.TransformRename, Rename: map[string]string{"user": "login"}}},
+		},
+	}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.ResetOffsets("foo", "test.1")
+	offsetsBefore := s.kh.GetNewestOffsets("test.1")
+
+	// When
+	rInvalid, err := s.unixClient.Post("http://_/topics/test.1/messages?key=1&sync",
+		"text/plain", strings.NewReader("not json"))
+	c.Assert(err, IsNil)
+	rProd, err := s.unixClient.Post("http://_/topics/test.1/messages?key=1&sync",
+		"application/json", strings.NewReader(`{"user": "bob", "pwd": "secret"}`))
+	c.Assert(err, IsNil)
+	rCons, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+	c.Assert(err, IsNil)
+
+	// Then
+	c.Assert(rInvalid.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(rProd.StatusCode, Equals, http.StatusOK)
+	offsetsAfter := s.kh.GetNewestOffsets("test.1")
+	msgs := s.kh.GetMessages("test.1", offsetsBefore, offsetsAfter)
+	c.Assert(msgs, DeepEquals, [][]string{{`{"user":"bob"}`}})
+	c.Assert(rCons.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(ParseConsRes(c, rCons).Message), Equals, `{"login":"bob"}`)
+}
+
+// The result of an asynchronous produce request is posted to the callback
+// URL given in the request.
+func (s *ServiceHTTPSuite) TestProduceCallback(c *C) {
+	callbackCh := make(chan string, 1)
+	callbackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		callbackCh <- string(body)
+	}))
+	defer callbackSrv.Close()
+	s.cfg.Proxies["pxyD"].Webhook.ProduceCallbackURLs = []string{callbackSrv.URL + "/produced"}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	offsetsBefore := s.kh.GetNewestOffsets("test.1")
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.1/messages?callback="+
+		callbackSrv.URL+"/produced&callbackId=req-1", "text/plain", strings.NewReader("Bazinga!"))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	select {
+	case body := <-callbackCh:
+		c.Assert(body, Equals, fmt.Sprintf(`{"id":"req-1","topic":"test.1","partition":0,"offset":%d}`, offsetsBefore[0]))
+	case <-time.After(5 * time.Second):
+		c.Error("callback was not posted")
+	}
+}
+
+// Callbacks to URLs that are not allowed by config are rejected.
+func (s *ServiceHTTPSuite) TestProduceCallbackInvalid(c *C) {
+	s.cfg.Proxies["pxyD"].Webhook.ProduceCallbackURLs = []string{"http://localhost:8080/produced"}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		query string
+		err   string
+	}{{
+		query: "?callback=http://169.254.169.254/",
+		err:   "callback url is not allowed",
+	}, {
+		query: "?callback=http://localhost:8080/produced&sync",
+		err:   "callback cannot be used with sync",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/topics/test.1/messages"+tc.query,
+			"text/plain", strings.NewReader("Bazinga!"))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		body := ParseJSONBody(c, r).(map[string]interface{})
+		c.Assert(body["error"], Equals, tc.err, Commentf("case #%d", i))
+	}
+}
+
 func (s *ServiceHTTPSuite) TestConsumeNoGroup(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
@@ -404,38 +806,36 @@ func (s *ServiceHTTPSuite) TestConsumeAutoAck(c *C) {
 	assertMsgs(c, consumed, produced)
 }
 
-func (s *ServiceHTTPSuite) TestConsumeExplicitAck(c *C) {
+// Batch consume returns several messages per request, but not more than
+// requested.
+func (s *ServiceHTTPSuite) TestConsumeBatch(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 
 	s.kh.ResetOffsets("foo", "test.4")
-	produced := s.kh.PutMessages("explicit-ack", "test.4", map[string]int{"A": 17, "B": 19, "C": 23, "D": 29})
+	produced := s.kh.PutMessages("batch", "test.4", map[string]int{"A": 17, "B": 19, "C": 23, "D": 29})
 	consumed := make(map[string][]*pb.ConsRs)
 	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.4")
 
-	// When:
-
-	// First message has to be consumed with noAck.
-	res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&noAck")
-	c.Assert(err, IsNil, Commentf("failed to consume first message"))
-	consRes := ParseConsRes(c, res)
-	key := string(consRes.KeyValue)
-	consumed[key] = append(consumed[key], consRes)
-	// Whenever a message is consumed previous one is acked.
-	for i := 1; i < 88; i++ {
-		url := fmt.Sprintf("http://_/topics/test.4/messages?group=foo&ackPartition=%d&ackOffset=%d",
-			consRes.Partition, consRes.Offset)
-		res, err := s.unixClient.Get(url)
-		consRes = ParseConsRes(c, res)
-		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
-		key := string(consRes.KeyValue)
-		consumed[key] = append(consumed[key], consRes)
+	// When
+	consumedCount := 0
+	for i := 0; consumedCount < 88; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&maxMessages=10")
+		c.Assert(err, IsNil, Commentf("failed to consume batch #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusOK, Commentf("failed to consume batch #%d", i))
+		batch := ParseJSONBody(c, res).([]interface{})
+		c.Assert(len(batch) > 0 && len(batch) <= 10, Equals, true, Commentf("batch #%d size %d", i, len(batch)))
+		keySeqs := make(map[string]int)
+		for _, item := range batch {
+			consRes := parseConsRsItem(c, item.(map[string]interface{}))
+			key := string(consRes.KeyValue)
+			consumed[key] = append(consumed[key], consRes)
+			consumedCount++
+			// Messages are numbered per key within a batch.
+			keySeqs[key]++
+			c.Assert(item.(map[string]interface{})["key_seq"], Equals, float64(keySeqs[key]), Commentf("batch #%d", i))
+		}
 	}
-	// Ack last message.
-	url := fmt.Sprintf("http://_/topics/test.4/messages?group=foo&partition=%d&offset=%d",
-		consRes.Partition, consRes.Offset)
-	_, err = s.unixClient.Post(url, "text/plain", nil)
-	c.Assert(err, IsNil, Commentf("failed ack last message"))
 	svc.Stop()
 
 	// Then
@@ -448,159 +848,1905 @@ func (s *ServiceHTTPSuite) TestConsumeExplicitAck(c *C) {
 	assertMsgs(c, consumed, produced)
 }
 
-// If offsets for a group that does not exist are requested then -1 is returned
-// as the next offset to be consumed for all topic partitions.
-func (s *ServiceHTTPSuite) TestGetOffsetsNoSuchGroup(c *C) {
+// A batch can be grouped by key, with messages of every key in order.
+func (s *ServiceHTTPSuite) TestConsumeBatchGroupByKey(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
+	s.kh.ResetOffsets("foo", "test.4")
+	produced := s.kh.PutMessages("group", "test.4", map[string]int{"A": 3, "B": 4})
+	consumed := make(map[string][]*pb.ConsRs)
+
 	// When
-	r, err := s.unixClient.Get("http://_/topics/test.4/offsets?group=no_such_group")
+	consumedCount := 0
+	for i := 0; consumedCount < 7; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&maxMessages=10&groupByKey")
+		c.Assert(err, IsNil, Commentf("failed to consume batch #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusOK, Commentf("failed to consume batch #%d", i))
+
+		// Then
+		groups := ParseJSONBody(c, res).([]interface{})
+		seenKeys := make(map[string]bool)
+		for _, group := range groups {
+			group := group.(map[string]interface{})
+			key := ParseBase64(c, group["key"].(string))
+			c.Assert(seenKeys[key], Equals, false, Commentf("batch #%d, key %s", i, key))
+			seenKeys[key] = true
+			for j, item := range group["messages"].([]interface{}) {
+				consRes := parseConsRsItem(c, item.(map[string]interface{}))
+				c.Assert(string(consRes.KeyValue), Equals, key, Commentf("batch #%d", i))
+				c.Assert(item.(map[string]interface{})["key_seq"], Equals, float64(j+1), Commentf("batch #%d", i))
+				consumed[key] = append(consumed[key], consRes)
+				consumedCount++
+			}
+		}
+	}
+	assertMsgs(c, consumed, produced)
+}
+
+// If Kafka version supports timestamps, then they are returned in consume
+// responses.
+func (s *ServiceHTTPSuite) TestConsumeTimestamp(c *C) {
+	s.cfg.Proxies["pxyD"].Kafka.Version.Set(sarama.V0_10_1_0)
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	begin := time.Now().UnixNano() / int64(time.Millisecond)
+	r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader("Bazinga!"))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	end := time.Now().UnixNano() / int64(time.Millisecond)
+
+	// When
+	r, err = s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
 
 	// Then
 	c.Assert(err, IsNil)
 	c.Assert(r.StatusCode, Equals, http.StatusOK)
-	body := ParseJSONBody(c, r).([]interface{})
-	for i := 0; i < 4; i++ {
-		partitionView := body[i].(map[string]interface{})
-		c.Assert(partitionView["partition"].(float64), Equals, float64(i))
-		c.Assert(partitionView["offset"].(float64), Equals, float64(-1))
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(ParseBase64(c, body["value"].(string)), Equals, "Bazinga!")
+	timestamp := int64(body["timestamp"].(float64))
+	c.Assert(timestamp >= begin && timestamp <= end, Equals, true,
+		Commentf("timestamp=%d, begin=%d, end=%d", timestamp, begin, end))
+}
+
+// Consume responses tell the partition high water mark and how many messages
+// are left after the consumed one.
+func (s *ServiceHTTPSuite) TestConsumeLag(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	for i := 0; i < 3; i++ {
+		r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader("Bazinga!"))
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
 	}
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	offset := int64(body["offset"].(float64))
+	c.Assert(int64(body["high_watermark"].(float64)), Equals, offset+3)
+	c.Assert(int64(body["lag"].(float64)), Equals, int64(2))
 }
 
-// An attempt to retrieve offsets for a topic that does not exist fails with 404.
-func (s *ServiceHTTPSuite) TestGetOffsetsNoSuchTopic(c *C) {
+// If the raw format is accepted, then the response body is the message value
+// and the rest of the message is described by headers.
+func (s *ServiceHTTPSuite) TestConsumeRaw(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	r, err := s.unixClient.Post("http://_/topics/test.1/messages?key=bar&sync", "text/plain", strings.NewReader("\x00\xffBazinga!"))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	rq, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/messages?group=foo", nil)
+	c.Assert(err, IsNil)
+	rq.Header.Set("Accept", "application/json;q=0.5, application/octet-stream")
+
+	// When
+	r, err = s.unixClient.Do(rq)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(r.Header.Get("Content-Type"), Equals, "application/octet-stream")
+	c.Assert(r.Header.Get("Kafka-Key"), Equals, base64.StdEncoding.EncodeToString([]byte("bar")))
+	c.Assert(r.Header.Get("Kafka-Partition"), Not(Equals), "")
+	c.Assert(r.Header.Get("Kafka-Offset"), Not(Equals), "")
+	c.Assert(r.Header.Get("Kafka-Lag"), Equals, "0")
+	body, err := ioutil.ReadAll(r.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "\x00\xffBazinga!")
+}
+
+// If the decoded format is accepted, then JSON keys and values are embedded
+// in the response as JSON, and others as strings.
+func (s *ServiceHTTPSuite) TestConsumeDecoded(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	r, err := s.unixClient.Post("http://_/topics/test.1/messages?key=bar&sync", "application/json", strings.NewReader(`{"a": [1, "b"]}`))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	rq, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/messages?group=foo", nil)
+	c.Assert(err, IsNil)
+	rq.Header.Set("Accept", "application/vnd.kafka-pixy.decoded+json")
+
+	// When
+	r, err = s.unixClient.Do(rq)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(r.Header.Get("Content-Type"), Equals, "application/vnd.kafka-pixy.decoded+json")
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["key"], Equals, "bar")
+	c.Assert(body["value"], DeepEquals, map[string]interface{}{"a": []interface{}{1.0, "b"}})
+}
+
+// A consume request that accepts no supported media type is rejected before
+// a message is consumed.
+func (s *ServiceHTTPSuite) TestConsumeNotAcceptable(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		params string
+		accept string
+		error  string
+	}{{
+		accept: "text/plain",
+		error: `no acceptable media type in "text/plain", supported: ` +
+			`application/json, application/vnd.kafka-pixy.decoded+json, application/octet-stream`,
+	}, {
+		accept: "application/json;q=0",
+		error: `no acceptable media type in "application/json;q=0", supported: ` +
+			`application/json, application/vnd.kafka-pixy.decoded+json, application/octet-stream`,
+	}, {
+		params: "&maxMessages=10",
+		accept: "application/octet-stream",
+		error: `no acceptable media type in "application/octet-stream", supported: ` +
+			`application/json, application/vnd.kafka-pixy.decoded+json`,
+	}} {
+		rq, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/messages?group=foo"+tc.params, nil)
+		c.Assert(err, IsNil)
+		rq.Header.Set("Accept", tc.accept)
+
+		// When
+		res, err := s.unixClient.Do(rq)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusNotAcceptable, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestConsumeBatchInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		params string
+		error  string
+	}{{
+		params: "maxMessages=0",
+		error:  "bad maxMessages: 0",
+	}, {
+		params: "maxMessages=foo",
+		error:  "bad maxMessages: foo",
+	}, {
+		params: "maxMessages=10&maxBytes=-1",
+		error:  "bad maxBytes: -1",
+	}, {
+		params: "maxBytes=1000",
+		error:  "maxBytes can only be used with maxMessages",
+	}, {
+		params: "groupByKey",
+		error:  "groupByKey can only be used with maxMessages",
+	}} {
+		// When
+		res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&" + tc.params)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestPeek(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	for i := 0; i < 3; i++ {
+		r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader(fmt.Sprintf("peek-%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+	}
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.1")
+
+	// When
+	r1, err1 := s.unixClient.Get("http://_/topics/test.1/peek?group=foo&count=2")
+	r2, err2 := s.unixClient.Get("http://_/topics/test.1/peek?group=foo&count=2")
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(r1.StatusCode, Equals, http.StatusOK)
+	peeked := ParseJSONBody(c, r1).([]interface{})
+	c.Assert(len(peeked), Equals, 2)
+	c.Assert(err2, IsNil)
+	c.Assert(ParseJSONBody(c, r2), DeepEquals, peeked)
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.1"), DeepEquals, offsetsBefore)
+
+	// Peeked messages are the ones that are consumed next.
+	r, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	consumed := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(consumed["offset"], Equals, peeked[0].(map[string]interface{})["offset"])
+	c.Assert(consumed["value"], Equals, peeked[0].(map[string]interface{})["value"])
+}
+
+// Peeked messages have configured fields redacted, while consumed ones are
+// returned as they were produced.
+func (s *ServiceHTTPSuite) TestPeekRedacted(c *C) {
+	s.cfg.Proxies["pxyD"].Redaction.Fields = []string{"email"}
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "application/json", strings.NewReader(`{"email":"a@b.c","id":1}`))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r1, err1 := s.unixClient.Get("http://_/topics/test.1/peek?group=foo&count=1")
+	r2, err2 := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(r1.StatusCode, Equals, http.StatusOK)
+	peeked := ParseJSONBody(c, r1).([]interface{})
+	c.Assert(len(peeked), Equals, 1)
+	c.Assert(peeked[0].(map[string]interface{})["value"], Equals,
+		base64.StdEncoding.EncodeToString([]byte(`{"email":"[REDACTED]","id":1}`)))
+	c.Assert(err2, IsNil)
+	c.Assert(r2.StatusCode, Equals, http.StatusOK)
+	consumed := ParseJSONBody(c, r2).(map[string]interface{})
+	c.Assert(consumed["value"], Equals,
+		base64.StdEncoding.EncodeToString([]byte(`{"email":"a@b.c","id":1}`)))
+}
+
+// Responses are compressed with gzip if the client accepts it, unless they
+// are too short to bother.
+func (s *ServiceHTTPSuite) TestPeekGzip(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	for i := 0; i < 3; i++ {
+		r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader(strings.Repeat("Bazinga!", 200)))
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+	}
+	rq1, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/peek?group=foo&count=3", nil)
+	c.Assert(err, IsNil)
+	rq1.Header.Set("Accept-Encoding", "gzip")
+	rq2, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/peek?group=foo&count=bar", nil)
+	c.Assert(err, IsNil)
+	rq2.Header.Set("Accept-Encoding", "gzip")
+
+	// When
+	r1, err1 := s.unixClient.Do(rq1)
+	r2, err2 := s.unixClient.Do(rq2)
+
+	// Then
+	c.Assert(err1, IsNil)
+	c.Assert(r1.StatusCode, Equals, http.StatusOK)
+	c.Assert(r1.Header.Get("Content-Encoding"), Equals, "gzip")
+	gzipReader, err := gzip.NewReader(r1.Body)
+	c.Assert(err, IsNil)
+	var peeked []interface{}
+	c.Assert(json.NewDecoder(gzipReader).Decode(&peeked), IsNil)
+	c.Assert(len(peeked), Equals, 3)
+
+	c.Assert(err2, IsNil)
+	c.Assert(r2.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(r2.Header.Get("Content-Encoding"), Equals, "")
+	c.Assert(ParseJSONBody(c, r2), DeepEquals, map[string]interface{}{"error": "bad count: bar"})
+}
+
+func (s *ServiceHTTPSuite) TestPeekInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		url    string
+		status int
+		error  string
+	}{{
+		url:    "http://_/topics/test.1/peek",
+		status: http.StatusBadRequest,
+		error:  "one consumer group is expected, but 0 provided",
+	}, {
+		url:    "http://_/topics/test.1/peek?group=foo&count=0",
+		status: http.StatusBadRequest,
+		error:  "bad count: 0",
+	}, {
+		url:    "http://_/topics/test.1/peek?group=foo&count=101",
+		status: http.StatusBadRequest,
+		error:  "bad count: 101",
+	}, {
+		url:    "http://_/topics/no-such-topic/peek?group=foo",
+		status: http.StatusNotFound,
+		error:  "Unknown topic",
+	}} {
+		// When
+		res, err := s.unixClient.Get(tc.url)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestReadPartition(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	var partition, offset int64
+	for i := 0; i < 3; i++ {
+		r, err := s.unixClient.Post("http://_/topics/test.4/messages?key=read&sync", "text/plain", strings.NewReader(fmt.Sprintf("read-%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+		body := ParseJSONBody(c, r).(map[string]interface{})
+		if i == 0 {
+			partition = int64(body["partition"].(float64))
+			offset = int64(body["offset"].(float64))
+		}
+	}
+
+	// When
+	r, err := s.unixClient.Get(fmt.Sprintf("http://_/topics/test.4/partitions/%d/messages?offset=%d&count=2", partition, offset))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	msgs := ParseJSONBody(c, r).([]interface{})
+	c.Assert(len(msgs), Equals, 2)
+	for i, msg := range msgs {
+		msg := msg.(map[string]interface{})
+		c.Assert(int64(msg["partition"].(float64)), Equals, partition, Commentf("msg #%d", i))
+		c.Assert(int64(msg["offset"].(float64)), Equals, offset+int64(i), Commentf("msg #%d", i))
+		c.Assert(msg["value"], Equals, base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("read-%d", i))), Commentf("msg #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestReadPartitionInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		url    string
+		status int
+		error  string
+	}{{
+		url:    "http://_/topics/test.1/partitions/foo/messages?offset=0",
+		status: http.StatusBadRequest,
+		error:  "bad partition: foo",
+	}, {
+		url:    "http://_/topics/test.1/partitions/0/messages",
+		status: http.StatusBadRequest,
+		error:  "bad offset: ",
+	}, {
+		url:    "http://_/topics/test.1/partitions/0/messages?offset=0&count=101",
+		status: http.StatusBadRequest,
+		error:  "bad count: 101",
+	}, {
+		url:    "http://_/topics/test.1/partitions/0/messages?offset=9223372036854775807",
+		status: http.StatusNotFound,
+		error:  "Offset out of range",
+	}, {
+		url:    "http://_/topics/no-such-topic/partitions/0/messages?offset=0",
+		status: http.StatusNotFound,
+		error:  "Unknown topic or partition",
+	}} {
+		// When
+		res, err := s.unixClient.Get(tc.url)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestReprocess(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	var offset int64
+	for i := 0; i < 3; i++ {
+		r, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader(fmt.Sprintf("dead-%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+		if i == 0 {
+			offset = int64(ParseJSONBody(c, r).(map[string]interface{})["offset"].(float64))
+		}
+	}
+	endBefore := s.kh.GetNewestOffsets("test.4")
+
+	// When
+	url := fmt.Sprintf("http://_/topics/test.1/reprocess?partition=0&offset=%d&count=5&targetTopic=test.4&rate=100", offset)
+	r, err := s.unixClient.Post(url, "text/plain", nil)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"topic": "test.4", "reprocessed": float64(3)})
+	endAfter := s.kh.GetNewestOffsets("test.4")
+	var produced int64
+	for i := range endAfter {
+		produced += endAfter[i] - endBefore[i]
+	}
+	c.Assert(produced, Equals, int64(3))
+}
+
+func (s *ServiceHTTPSuite) TestReprocessInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		params string
+		status int
+		error  string
+	}{{
+		params: "offset=0&count=1&targetTopic=test.4",
+		status: http.StatusBadRequest,
+		error:  "bad partition: ",
+	}, {
+		params: "partition=0&count=1&targetTopic=test.4",
+		status: http.StatusBadRequest,
+		error:  "bad offset: ",
+	}, {
+		params: "partition=0&offset=0&count=10001&targetTopic=test.4",
+		status: http.StatusBadRequest,
+		error:  "bad count: 10001",
+	}, {
+		params: "partition=0&offset=0&count=1&targetTopic=test.4&rate=0",
+		status: http.StatusBadRequest,
+		error:  "bad rate: 0",
+	}, {
+		params: "partition=0&offset=0&count=1",
+		status: http.StatusBadRequest,
+		error:  "targetTopic must be provided, for it cannot be derived from consumer.dead_letter_topic",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/topics/test.1/reprocess?"+tc.params, "text/plain", nil)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestConsumeExplicitAck(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+
+	s.kh.ResetOffsets("foo", "test.4")
+	produced := s.kh.PutMessages("explicit-ack", "test.4", map[string]int{"A": 17, "B": 19, "C": 23, "D": 29})
+	consumed := make(map[string][]*pb.ConsRs)
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.4")
+
+	// When:
+
+	// First message has to be consumed with noAck.
+	res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&noAck")
+	c.Assert(err, IsNil, Commentf("failed to consume first message"))
+	consRes := ParseConsRes(c, res)
+	key := string(consRes.KeyValue)
+	consumed[key] = append(consumed[key], consRes)
+	// Whenever a message is consumed previous one is acked.
+	for i := 1; i < 88; i++ {
+		url := fmt.Sprintf("http://_/topics/test.4/messages?group=foo&ackPartition=%d&ackOffset=%d",
+			consRes.Partition, consRes.Offset)
+		res, err := s.unixClient.Get(url)
+		consRes = ParseConsRes(c, res)
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		key := string(consRes.KeyValue)
+		consumed[key] = append(consumed[key], consRes)
+	}
+	// Ack last message.
+	url := fmt.Sprintf("http://_/topics/test.4/acks?group=foo&partition=%d&offset=%d",
+		consRes.Partition, consRes.Offset)
+	res, err = s.unixClient.Post(url, "text/plain", nil)
+	c.Assert(err, IsNil, Commentf("failed ack last message"))
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	svc.Stop()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets("foo", "test.4")
+	c.Assert(offsetsAfter[0].Val, Equals, offsetsBefore[0].Val+17)
+	c.Assert(offsetsAfter[1].Val, Equals, offsetsBefore[1].Val+29)
+	c.Assert(offsetsAfter[2].Val, Equals, offsetsBefore[2].Val+23)
+	c.Assert(offsetsAfter[3].Val, Equals, offsetsBefore[3].Val+19)
+
+	assertMsgs(c, consumed, produced)
+}
+
+// Messages can be acknowledged by offset ranges and individually in one
+// batch ack request.
+func (s *ServiceHTTPSuite) TestAckBatch(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	s.kh.ResetOffsets("foo", "test.1")
+	s.kh.PutMessages("ack-batch", "test.1", map[string]int{"A": 5})
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.1")
+
+	var consumed []*pb.ConsRs
+	for i := 0; i < 5; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&noAck")
+		c.Assert(err, IsNil)
+		consumed = append(consumed, ParseConsRes(c, res))
+	}
+
+	// When
+	res, err := s.unixClient.Post("http://_/topics/test.1/acks/batch?group=foo", "application/json",
+		strings.NewReader(fmt.Sprintf(`[{"partition": 0, "from": %d, "to": %d}, {"partition": 0, "offset": %d}]`,
+			consumed[0].Offset, consumed[3].Offset, consumed[4].Offset)))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	svc.Stop()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets("foo", "test.1")
+	c.Assert(offsetsAfter[0].Val, Equals, offsetsBefore[0].Val+5)
+}
+
+func (s *ServiceHTTPSuite) TestAckBatchInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		body  string
+		error string
+	}{{
+		body:  `[]`,
+		error: "no acks",
+	}, {
+		body:  `[{"offset": 1}]`,
+		error: "ack #0 has no partition",
+	}, {
+		body:  `[{"partition": 0, "offset": 1}, {"partition": 0, "offset": 2, "from": 3, "to": 4}]`,
+		error: "ack #1 must have either offset, or from and to",
+	}, {
+		body:  `[{"partition": 0, "from": 5, "to": 4}]`,
+		error: "ack #0 has bad range: from=5, to=4",
+	}, {
+		body:  `[{"partition": 0, "from": 0, "to": 10000}]`,
+		error: "too many acks: limit=10000",
+	}, {
+		body:  `[{"partition": 0, "offset": 0}, {"partition": 0, "from": 0, "to": 9223372036854775807}]`,
+		error: "too many acks: limit=10000",
+	}, {
+		body:  `[{"partition": 0, "from": -9223372036854775808, "to": 9223372036854775807}]`,
+		error: "ack #0 has bad range: from=-9223372036854775808, to=9223372036854775807",
+	}, {
+		body:  `[{"partition": 0, "offset": -1}]`,
+		error: "ack #0 is invalid: bad offset: -1",
+	}} {
+		// When
+		res, err := s.unixClient.Post("http://_/topics/test.1/acks/batch?group=foo", "application/json",
+			strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// Metadata given with an ack is committed along with the offset.
+func (s *ServiceHTTPSuite) TestAckMetadata(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	s.kh.ResetOffsets("foo", "test.1")
+	s.kh.PutMessages("ack-metadata", "test.1", map[string]int{"A": 1})
+
+	res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&noAck")
+	c.Assert(err, IsNil)
+	consRes := ParseConsRes(c, res)
+
+	// When
+	url := fmt.Sprintf("http://_/topics/test.1/acks?group=foo&partition=%d&offset=%d&metadata=host1",
+		consRes.Partition, consRes.Offset)
+	res, err = s.unixClient.Post(url, "text/plain", nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	svc.Stop()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets("foo", "test.1")
+	c.Assert(offsettrk.AckMeta(offsetsAfter[consRes.Partition]), Equals, "host1")
+}
+
+// Invalid initial offset policy is rejected.
+func (s *ServiceHTTPSuite) TestConsumeInitialOffsetInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&initialOffset=bogus")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": "bad initialOffset: bogus"})
+}
+
+// A consume request waits for a message as long as its timeout parameter says.
+func (s *ServiceHTTPSuite) TestConsumeTimeout(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	begin := time.Now()
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/no-such-topic/messages?group=foo&timeout=500ms")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusRequestTimeout)
+	waited := time.Since(begin)
+	c.Assert(waited >= 500*time.Millisecond && waited < 1500*time.Millisecond, Equals, true,
+		Commentf("waited=%v", waited))
+}
+
+// A message is consumed from whichever of the listed topics has one.
+func (s *ServiceHTTPSuite) TestConsumeAny(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	s.kh.ResetOffsets("foo", "test.4")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	r, err := s.unixClient.Post("http://_/topics/test.4/messages?sync", "text/plain", strings.NewReader("Bazinga!"))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/messages?group=foo&topics=test.1,test.4")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["topic"], Equals, "test.4")
+	c.Assert(ParseBase64(c, body["value"].(string)), Equals, "Bazinga!")
+
+	// When
+	r, err = s.unixClient.Get("http://_/messages?group=foo&topics=test.1&topics=test.4&timeout=500ms")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusRequestTimeout)
+}
+
+// A message is consumed from whichever of the topics matching a pattern has
+// one.
+func (s *ServiceHTTPSuite) TestConsumeMatching(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	s.kh.ResetOffsets("foo", "test.4")
+	s.kh.ResetOffsets("foo", "test.64")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	r, err := s.unixClient.Post("http://_/topics/test.64/messages?sync", "text/plain", strings.NewReader("Bazinga!"))
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/messages?group=foo&topicPattern=test%5C..*")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["topic"], Equals, "test.64")
+	c.Assert(ParseBase64(c, body["value"].(string)), Equals, "Bazinga!")
+}
+
+func (s *ServiceHTTPSuite) TestConsumeAnyInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		params string
+		error  string
+	}{{
+		params: "group=foo",
+		error:  "either topics or topicPattern must be provided",
+	}, {
+		params: "group=foo&topics=test.1&topicPattern=test%5C..*",
+		error:  "topics and topicPattern cannot be used together",
+	}, {
+		params: "group=foo&topicPattern=test.(",
+		error:  "bad topicPattern: test.(",
+	}, {
+		params: "group=foo&topics=test.1,,test.4",
+		error:  "bad topics: test.1,,test.4",
+	}, {
+		params: "topics=test.1",
+		error:  "one consumer group is expected, but 0 provided",
+	}, {
+		params: "group=foo&topics=test.1&ackPartition=0&ackOffset=1",
+		error:  "ackPartition and ackOffset cannot be used with topics or topicPattern",
+	}} {
+		// When
+		res, err := s.unixClient.Get("http://_/messages?" + tc.params)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// A long polling consume request in progress is interrupted on shutdown with
+// a retriable error, rather than delay the shutdown until it times out.
+func (s *ServiceHTTPSuite) TestConsumeShuttingDown(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	resCh := make(chan *http.Response, 1)
+	go func() {
+		defer close(resCh)
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&timeout=10s")
+		c.Check(err, IsNil)
+		resCh <- res
+	}()
+	time.Sleep(500 * time.Millisecond)
+	begin := time.Now()
+
+	// When
+	svc.Stop()
+
+	// Then
+	c.Assert(time.Since(begin) < 5*time.Second, Equals, true)
+	res := <-resCh
+	c.Assert(res, NotNil)
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "0")
+	body := ParseJSONBody(c, res).(map[string]interface{})
+	c.Assert(body["reason"], Equals, "shutting_down")
+}
+
+// Consume requests beyond the concurrency cap are rejected right away, while
+// produce requests, that are capped separately, are still served.
+func (s *ServiceHTTPSuite) TestConsumeConcurrencyLimit(c *C) {
+	s.kh.ResetOffsets("foo", "test.1")
+	s.cfg.HTTP.Concurrency.MaxConsume = 1
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&timeout=3s")
+		c.Check(err, IsNil)
+		c.Check(res.StatusCode, Equals, http.StatusRequestTimeout)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=bar&timeout=3s")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "1")
+	c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{
+		"error":          "too many concurrent consume requests",
+		"reason":         "concurrency_limit",
+		"retry_after_ms": 1000.0,
+	})
+	res, err = s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader("foo"))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	<-doneCh
+}
+
+// Invalid long polling timeout is rejected.
+func (s *ServiceHTTPSuite) TestConsumeTimeoutInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, timeout := range []string{"0s", "-1s", "10"} {
+		// When
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo&timeout=" + timeout)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": "bad timeout: " + timeout},
+			Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestAckInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		params string
+		error  string
+	}{{
+		params: "group=foo",
+		error:  "partition and offset must be provided",
+	}, {
+		params: "group=foo&partition=1",
+		error:  "partition and offset must be provided",
+	}, {
+		params: "group=foo&partition=-1&offset=1",
+		error:  "bad partition: -1",
+	}, {
+		params: "group=foo&partition=1&offset=bar",
+		error:  "bad offset: bar",
+	}, {
+		params: "group=foo&metadata=host1",
+		error:  "metadata can only be used with partition and offset",
+	}, {
+		params: "group=foo&partition=1&offset=1&metadata=" + strings.Repeat("a", 257),
+		error:  "metadata is too long: limit=256",
+	}} {
+		// When
+		res, err := s.unixClient.Post("http://_/topics/test.4/acks?"+tc.params, "text/plain", nil)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// A nacked message is offered again right away, and when it has been offered
+// consumer.max_retries times, it is produced to the dead letter topic.
+func (s *ServiceHTTPSuite) TestNackDeadLetter(c *C) {
+	s.cfg.Proxies["pxyD"].Consumer.MaxRetries = 1
+	s.cfg.Proxies["pxyD"].Consumer.DeadLetterTopic = "test.1"
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	s.kh.ResetOffsets("foo", "test.4")
+	s.kh.ResetOffsets("bar", "test.1")
+	produced := s.kh.PutMessages("nack", "test.4", map[string]int{"A": 1})
+
+	// When
+	var offered []*pb.ConsRs
+	for i := 0; i < 2; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo&noAck")
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		consRes := ParseConsRes(c, res)
+		offered = append(offered, consRes)
+		url := fmt.Sprintf("http://_/topics/test.4/nacks?group=foo&partition=%d&offset=%d&reason=oops",
+			consRes.Partition, consRes.Offset)
+		res, err = s.unixClient.Post(url, "text/plain", nil)
+		c.Assert(err, IsNil, Commentf("failed to nack message #%d", i))
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+	}
+	res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=bar")
+	c.Assert(err, IsNil)
+
+	// Then
+	c.Assert(offered[1].Partition, Equals, offered[0].Partition)
+	c.Assert(offered[1].Offset, Equals, offered[0].Offset)
+	deadLettered := ParseConsRes(c, res)
+	c.Assert(string(deadLettered.KeyValue), Equals, "A")
+	c.Assert(string(deadLettered.Message), Equals, string(produced["A"][0].Value.(sarama.StringEncoder)))
+}
+
+func (s *ServiceHTTPSuite) TestConsumeWebSocket(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+
+	s.kh.ResetOffsets("foo", "test.4")
+	produced := s.kh.PutMessages("websocket", "test.4", map[string]int{"A": 17, "B": 19, "C": 23, "D": 29})
+	consumed := make(map[string][]*pb.ConsRs)
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.4")
+
+	// When
+	conn, err := websocket.Dial("tcp", s.cfg.TCPAddr, "/topics/test.4/ws?group=foo", 1<<20)
+	c.Assert(err, IsNil)
+	for i := 0; i < 88; i++ {
+		msg, err := conn.ReadMessage()
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		var body map[string]interface{}
+		c.Assert(json.Unmarshal(msg, &body), IsNil)
+		consRes := parseConsRsItem(c, body)
+		key := string(consRes.KeyValue)
+		consumed[key] = append(consumed[key], consRes)
+		ack := fmt.Sprintf(`{"partition": %d, "offset": %d}`, consRes.Partition, consRes.Offset)
+		c.Assert(conn.WriteMessage([]byte(ack)), IsNil)
+	}
+	// A malformed ack is reported back.
+	c.Assert(conn.WriteMessage([]byte(`{"partition": 1}`)), IsNil)
+	msg, err := conn.ReadMessage()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg), Equals, `{"error":"partition and offset must be provided"}`)
+	conn.Close()
+	svc.Stop()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets("foo", "test.4")
+	c.Assert(offsetsAfter[0].Val, Equals, offsetsBefore[0].Val+17)
+	c.Assert(offsetsAfter[1].Val, Equals, offsetsBefore[1].Val+29)
+	c.Assert(offsetsAfter[2].Val, Equals, offsetsBefore[2].Val+23)
+	c.Assert(offsetsAfter[3].Val, Equals, offsetsBefore[3].Val+19)
+
+	assertMsgs(c, consumed, produced)
+}
+
+func (s *ServiceHTTPSuite) TestConsumeSSE(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+
+	s.kh.ResetOffsets("foo", "test.4")
+	produced := s.kh.PutMessages("sse", "test.4", map[string]int{"A": 17, "B": 19, "C": 23, "D": 29})
+	consumed := make(map[string][]*pb.ConsRs)
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.4")
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.4/events?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream")
+	events := bufio.NewReader(res.Body)
+	for i := 0; i < 88; {
+		line, err := events.ReadString('\n')
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var body map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &body), IsNil)
+		consRes := parseConsRsItem(c, body)
+		key := string(consRes.KeyValue)
+		consumed[key] = append(consumed[key], consRes)
+		url := fmt.Sprintf("http://_/topics/test.4/acks?group=foo&partition=%d&offset=%d",
+			consRes.Partition, consRes.Offset)
+		ackRes, err := s.unixClient.Post(url, "text/plain", nil)
+		c.Assert(err, IsNil)
+		c.Assert(ackRes.StatusCode, Equals, http.StatusOK)
+		i++
+	}
+	res.Body.Close()
+	svc.Stop()
+
+	// Then
+	offsetsAfter := s.kh.GetCommittedOffsets("foo", "test.4")
+	c.Assert(offsetsAfter[0].Val, Equals, offsetsBefore[0].Val+17)
+	c.Assert(offsetsAfter[1].Val, Equals, offsetsBefore[1].Val+29)
+	c.Assert(offsetsAfter[2].Val, Equals, offsetsBefore[2].Val+23)
+	c.Assert(offsetsAfter[3].Val, Equals, offsetsBefore[3].Val+19)
+
+	assertMsgs(c, consumed, produced)
+}
+
+func (s *ServiceHTTPSuite) TestTail(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("tail-old", "test.1", map[string]int{"A": 3})
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.1/tail?count=2")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream")
+	defer res.Body.Close()
+	s.kh.PutMessages("tail-new", "test.1", map[string]int{"A": 1})
+
+	// Then
+	events := bufio.NewReader(res.Body)
+	var values []string
+	for len(values) < 3 {
+		line, err := events.ReadString('\n')
+		c.Assert(err, IsNil, Commentf("failed to tail message #%d", len(values)))
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var body map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &body), IsNil)
+		values = append(values, string(parseConsRsItem(c, body).Message))
+	}
+	c.Assert(values, DeepEquals, []string{"tail-old:A:1", "tail-old:A:2", "tail-new:A:0"})
+}
+
+// If no group is specified, then messages are streamed from the specified
+// initial offset without a consumer group.
+func (s *ServiceHTTPSuite) TestConsumeSSEGroupless(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("groupless-old", "test.1", map[string]int{"A": 1})
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.1/events?initialOffset=latest")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream")
+	defer res.Body.Close()
+	s.kh.PutMessages("groupless-new", "test.1", map[string]int{"A": 2})
+
+	// Then
+	events := bufio.NewReader(res.Body)
+	var values []string
+	for len(values) < 2 {
+		line, err := events.ReadString('\n')
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", len(values)))
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var body map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &body), IsNil)
+		values = append(values, string(parseConsRsItem(c, body).Message))
+	}
+	c.Assert(values, DeepEquals, []string{"groupless-new:A:0", "groupless-new:A:1"})
+}
+
+// If a consume request is not a WebSocket handshake, then it is rejected.
+func (s *ServiceHTTPSuite) TestConsumeWebSocketNotUpgrade(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	res, err := s.unixClient.Get("http://_/topics/test.4/ws?group=foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": "missing Connection: Upgrade header"})
+}
+
+// If offsets for a group that does not exist are requested then -1 is returned
+// as the next offset to be consumed for all topic partitions.
+func (s *ServiceHTTPSuite) TestGetOffsetsNoSuchGroup(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/test.4/offsets?group=no_such_group")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).([]interface{})
+	for i := 0; i < 4; i++ {
+		partitionView := body[i].(map[string]interface{})
+		c.Assert(partitionView["partition"].(float64), Equals, float64(i))
+		c.Assert(partitionView["offset"].(float64), Equals, float64(-1))
+	}
+}
+
+// An attempt to retrieve offsets for a topic that does not exist fails with 404.
+func (s *ServiceHTTPSuite) TestGetOffsetsNoSuchTopic(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/no_such_topic/offsets?group=foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["error"], Equals, "Unknown topic")
+}
+
+// Committed offsets are returned in a following GET request.
+func (s *ServiceHTTPSuite) TestSetOffsets(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
+		"application/json", strings.NewReader(
+			`[{"partition": 0, "offset": 1100, "metadata": "A100"},
+			  {"partition": 1, "offset": 1101, "metadata": "A101"},
+			  {"partition": 2, "offset": 1102, "metadata": "A102"},
+			  {"partition": 3, "offset": 1103, "metadata": "A103"}]`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	r, err = s.unixClient.Get("http://_/topics/test.4/offsets?group=foo")
+	c.Assert(err, IsNil)
+	body := ParseJSONBody(c, r).([]interface{})
+	for i := 0; i < 4; i++ {
+		partitionView := body[i].(map[string]interface{})
+		c.Assert(partitionView["partition"].(float64), Equals, float64(i))
+		c.Assert(partitionView["offset"].(float64), Equals, float64(1100+i))
+		c.Assert(partitionView["metadata"].(string), Equals, fmt.Sprintf("A10%d", i))
+		c.Assert(partitionView["count"], Equals, partitionView["end"].(float64)-partitionView["begin"].(float64))
+	}
+}
+
+// Result of setting offsets for a non-existent topic depends on the Kafka
+// version. It is ok for 0.8, but error for 0.9.x and higher.
+func (s *ServiceHTTPSuite) TestSetOffsetsNoSuchTopic(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/no_such_topic/offsets?group=foo",
+		"application/json", strings.NewReader(`[{"partition": 0, "offset": 1100, "metadata": "A100"}]`))
+
+	// Then
+	kafkaVersion := os.Getenv("KAFKA_VERSION")
+	if strings.HasPrefix(kafkaVersion, "0.8") {
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+		c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
+		return
+	}
+
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["error"], Equals, "Unknown topic")
+}
+
+// Setting offsets is refused if the group consumes the topic in other
+// Kafka-Pixy instances, unless it is forced.
+func (s *ServiceHTTPSuite) TestSetOffsetsGroupActive(c *C) {
+	s.kh.PutMessages("set", "test.4", map[string]int{"A": 1})
+	svc1 := spawnTestService(c, 55501)
+	defer svc1.Stop()
+	svc2 := spawnTestService(c, 55502)
+	defer svc2.Stop()
+	_, err := s.tcpClient.Get("http://127.0.0.1:55502/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	offsetBefore := s.kh.GetCommittedOffsets("foo", "test.4")[0]
+	body := fmt.Sprintf(`[{"partition": 0, "offset": %d}]`, offsetBefore.Val+1)
+
+	// When
+	r, err := s.tcpClient.Post("http://127.0.0.1:55501/topics/test.4/offsets?group=foo",
+		"application/json", strings.NewReader(body))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusConflict)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "members=[C55502]: group is consuming the topic in other instances"})
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.4")[0], Equals, offsetBefore)
+
+	// When
+	r, err = s.tcpClient.Post("http://127.0.0.1:55501/topics/test.4/offsets?group=foo&force",
+		"application/json", strings.NewReader(body))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.4")[0].Val, Equals, offsetBefore.Val+1)
+}
+
+// Invalid body is detected and properly reported.
+func (s *ServiceHTTPSuite) TestSetOffsetsInvalidBody(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
+		"application/json", strings.NewReader(`garbage`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusBadRequest)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	c.Assert(body["error"], Equals, "Failed to parse the request: err=(invalid character 'g' looking for beginning of value)")
+}
+
+// Seek makes a running partition consumer restart from the new offset, so
+// already consumed messages are consumed again.
+func (s *ServiceHTTPSuite) TestSeekOffsets(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	s.kh.ResetOffsets("foo", "test.1")
+	offsetsBefore := s.kh.GetCommittedOffsets("foo", "test.1")
+	s.kh.PutMessages("seek", "test.1", map[string]int{"A": 3})
+	var consumed []*pb.ConsRs
+	for i := 0; i < 3; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		consumed = append(consumed, ParseConsRes(c, res))
+	}
+
+	// When
+	r, err := s.unixClient.Post("http://_/groups/foo/topics/test.1/offsets",
+		"application/json", strings.NewReader(fmt.Sprintf(
+			`{"offsets": [{"partition": 0, "offset": %d}]}`, offsetsBefore[0].Val)))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, []interface{}{
+		map[string]interface{}{"partition": float64(0), "offset": float64(offsetsBefore[0].Val)},
+	})
+	for i := 0; i < 3; i++ {
+		res, err := s.unixClient.Get("http://_/topics/test.1/messages?group=foo")
+		c.Assert(err, IsNil, Commentf("failed to consume message #%d", i))
+		consRes := ParseConsRes(c, res)
+		c.Assert(consRes.Offset, Equals, consumed[i].Offset)
+		c.Assert(string(consRes.Message), Equals, string(consumed[i].Message))
+	}
+}
+
+// Exactly one of offsets, a timestamp or a position must be provided.
+func (s *ServiceHTTPSuite) TestSeekOffsetsInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		body  string
+		error string
+	}{{
+		body:  `{}`,
+		error: "one of offsets, timestamp or position must be provided",
+	}, {
+		body:  `{"offsets": [{"partition": 0, "offset": 1}], "timestamp": 1}`,
+		error: "one of offsets, timestamp or position must be provided",
+	}, {
+		body:  `{"timestamp": 1, "position": "latest"}`,
+		error: "one of offsets, timestamp or position must be provided",
+	}, {
+		body:  `{"position": "middle"}`,
+		error: "bad position: middle",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/groups/foo/topics/test.1/offsets",
+			"application/json", strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusBadRequest, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals,
+			map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// Offsets can be reset to the earliest or the latest available messages.
+func (s *ServiceHTTPSuite) TestSeekOffsetsPosition(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("seek", "test.4", map[string]int{"A": 3})
+
+	for i, position := range []string{"earliest", "latest"} {
+		// When
+		r, err := s.unixClient.Post("http://_/groups/foo/topics/test.4/offsets",
+			"application/json", strings.NewReader(fmt.Sprintf(`{"position": "%s"}`, position)))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("case #%d", i))
+		seekOffsets := ParseJSONBody(c, r).([]interface{})
+		r, err = s.unixClient.Get("http://_/groups/foo/topics/test.4/offsets")
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("case #%d", i))
+		offsets := ParseJSONBody(c, r).([]interface{})
+		c.Assert(len(offsets), Equals, 4, Commentf("case #%d", i))
+		for j, ov := range offsets {
+			offsetView := ov.(map[string]interface{})
+			want := offsetView["begin"]
+			if position == "latest" {
+				want = offsetView["end"]
+			}
+			c.Assert(offsetView["offset"], Equals, want, Commentf("case #%d", i))
+			c.Assert(seekOffsets[j].(map[string]interface{})["offset"], Equals, want, Commentf("case #%d", i))
+		}
+	}
+}
+
+func (s *ServiceHTTPSuite) TestLookupOffsets(c *C) {
+	s.cfg.Proxies["pxyD"].Kafka.Version.Set(sarama.V0_10_1_0)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("lookup", "test.4", map[string]int{"A": 3})
+	begin := s.kh.GetOldestOffsets("test.4")
+	end := s.kh.GetNewestOffsets("test.4")
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+
+	for i, tc := range []struct {
+		timestamp int64
+		want      []int64
+	}{{
+		timestamp: 0,
+		want:      begin,
+	}, {
+		timestamp: future,
+		want:      end,
+	}} {
+		// When
+		r, err := s.unixClient.Get(fmt.Sprintf("http://_/topics/test.4/offsets/lookup?timestamp=%d", tc.timestamp))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("case #%d", i))
+		offsets := ParseJSONBody(c, r).([]interface{})
+		c.Assert(len(offsets), Equals, 4, Commentf("case #%d", i))
+		for j, ov := range offsets {
+			offsetView := ov.(map[string]interface{})
+			c.Assert(offsetView["partition"], Equals, float64(j), Commentf("case #%d", i))
+			c.Assert(offsetView["offset"], Equals, float64(tc.want[j]), Commentf("case #%d", i))
+		}
+	}
+}
+
+// Offsets lookup is rejected with the default Kafka version, that cannot
+// resolve offsets by timestamp precisely.
+func (s *ServiceHTTPSuite) TestLookupOffsetsDefaultVersion(c *C) {
+	s.cfg.Proxies["pxyD"].Kafka.Version.Set(sarama.V0_8_2_2)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/test.4/offsets/lookup?timestamp=0")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusNotImplemented)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "offsets lookup by timestamp requires kafka.version 0.10.1.0 or later"})
+}
+
+func (s *ServiceHTTPSuite) TestLookupOffsetsInvalid(c *C) {
+	s.cfg.Proxies["pxyD"].Kafka.Version.Set(sarama.V0_10_1_0)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		url    string
+		status int
+		error  string
+	}{{
+		url:    "http://_/topics/test.4/offsets/lookup",
+		status: http.StatusBadRequest,
+		error:  "bad timestamp: ",
+	}, {
+		url:    "http://_/topics/test.4/offsets/lookup?timestamp=yesterday",
+		status: http.StatusBadRequest,
+		error:  "bad timestamp: yesterday",
+	}, {
+		url:    "http://_/topics/no-such-topic/offsets/lookup?timestamp=0",
+		status: http.StatusNotFound,
+		error:  "Unknown topic",
+	}} {
+		// When
+		res, err := s.unixClient.Get(tc.url)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(res.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, res), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// A seek is refused if the group consumes the topic in other Kafka-Pixy
+// instances, unless it is forced.
+func (s *ServiceHTTPSuite) TestSeekOffsetsGroupActive(c *C) {
+	s.kh.PutMessages("seek", "test.4", map[string]int{"A": 1})
+	svc1 := spawnTestService(c, 55501)
+	defer svc1.Stop()
+	svc2 := spawnTestService(c, 55502)
+	defer svc2.Stop()
+	_, err := s.tcpClient.Get("http://127.0.0.1:55502/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+
+	// When
+	r, err := s.tcpClient.Post("http://127.0.0.1:55501/groups/foo/topics/test.4/offsets",
+		"application/json", strings.NewReader(`{"position": "latest"}`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusConflict)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "members=[C55502]: group is consuming the topic in other instances"})
+
+	// When
+	r, err = s.tcpClient.Post("http://127.0.0.1:55501/groups/foo/topics/test.4/offsets",
+		"application/json", strings.NewReader(`{"position": "latest", "force": true}`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+}
+
+// It is not an error to set an offset for a missing partition.
+func (s *ServiceHTTPSuite) TestSetOffsetsInvalidPartition(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
+		"application/json", strings.NewReader(`[{"partition": 5}]`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
+}
+
+// Reported partition lags are correct, including those corresponding to -1 and
+// -2 special case offset values.
+func (s *ServiceHTTPSuite) TestGetOffsetsLag(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
+		"application/json", strings.NewReader(
+			`[{"partition": 0, "offset": -1},
+			  {"partition": 1, "offset": -2},
+			  {"partition": 2, "offset": 1}]`))
+	c.Assert(err, IsNil)
+
+	// When
+	r, err = s.unixClient.Get("http://_/topics/test.4/offsets?group=foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).([]interface{})
+	partition0View := body[0].(map[string]interface{})
+	c.Assert(partition0View["lag"], Equals, float64(0))
+	partition1View := body[1].(map[string]interface{})
+	c.Assert(partition1View["lag"], Equals, partition1View["end"].(float64)-partition1View["begin"].(float64))
+	partition2View := body[2].(map[string]interface{})
+	c.Assert(partition2View["lag"], Equals, partition2View["end"].(float64)-partition2View["offset"].(float64))
+}
+
+func (s *ServiceHTTPSuite) TestGetGroupLag(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.ResetOffsets("foo", "test.4")
+	s.kh.PutMessages("lag", "test.4", map[string]int{"A": 3, "B": 4})
+	// Consume a message to make the group register partition owners.
+	r, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/groups/foo/lag")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	topics := body["topics"].(map[string]interface{})
+	var totalLag float64
+	for _, topicView := range topics {
+		totalLag += topicView.(map[string]interface{})["lag"].(float64)
+	}
+	c.Assert(body["lag"], Equals, totalLag)
+	topicView := topics["test.4"].(map[string]interface{})
+	var topicLag float64
+	for _, pv := range topicView["partitions"].([]interface{}) {
+		partitionView := pv.(map[string]interface{})
+		c.Assert(partitionView["lag"], Equals, partitionView["end"].(float64)-partitionView["offset"].(float64))
+		topicLag += partitionView["lag"].(float64)
+	}
+	c.Assert(topicView["lag"], Equals, topicLag)
+}
+
+func (s *ServiceHTTPSuite) TestGetGroupLagNoSuchGroup(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	r, err := s.unixClient.Get("http://_/groups/no-such-group/lag")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "Unknown group"})
+}
+
+// Offsets exported from one group can be imported into another one.
+func (s *ServiceHTTPSuite) TestExportImportGroupOffsets(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.ResetOffsets("foo", "test.4")
+	s.kh.ResetOffsets("bar", "test.4")
+	s.kh.PutMessages("export", "test.4", map[string]int{"A": 3, "B": 4})
+	// Consume a message to make the group register partition owners.
+	r, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/groups/foo/offsets")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	exported, err := ioutil.ReadAll(r.Body)
+	c.Assert(err, IsNil)
+	r, err = s.unixClient.Post("http://_/groups/bar/offsets", "application/json", bytes.NewReader(exported))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{})
+	var groupOffsets struct {
+		Topics map[string][]struct {
+			Partition int32  `json:"partition"`
+			Offset    int64  `json:"offset"`
+			Metadata  string `json:"metadata"`
+		} `json:"topics"`
+	}
+	c.Assert(json.Unmarshal(exported, &groupOffsets), IsNil)
+	topicOffsets := groupOffsets.Topics["test.4"]
+	c.Assert(len(topicOffsets), Equals, 4)
+	imported := s.kh.GetCommittedOffsets("bar", "test.4")
+	for i, po := range topicOffsets {
+		c.Assert(po.Partition, Equals, int32(i))
+		c.Assert(imported[i], Equals, offsetmgr.Offset{Val: po.Offset, Meta: po.Metadata})
+	}
+}
+
+// An import is refused if the group consumes any of the topics in other
+// Kafka-Pixy instances, unless it is forced.
+func (s *ServiceHTTPSuite) TestImportGroupOffsetsGroupActive(c *C) {
+	s.kh.PutMessages("import", "test.4", map[string]int{"A": 1})
+	svc1 := spawnTestService(c, 55501)
+	defer svc1.Stop()
+	svc2 := spawnTestService(c, 55502)
+	defer svc2.Stop()
+	_, err := s.tcpClient.Get("http://127.0.0.1:55502/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	// The group does not consume test.1, but its offsets are not imported
+	// either, even though it goes first.
+	test1Before := s.kh.GetCommittedOffsets("foo", "test.1")[0]
+	body := fmt.Sprintf(`{"topics": {"test.1": [{"partition": 0, "offset": %d}], "test.4": [{"partition": 0, "offset": 0}]}`,
+		test1Before.Val+1)
+
+	// When
+	r, err := s.tcpClient.Post("http://127.0.0.1:55501/groups/foo/offsets", "application/json",
+		strings.NewReader(body+"}"))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusConflict)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+		"error": "topic=test.4: members=[C55502]: group is consuming the topic in other instances"})
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.1")[0], Equals, test1Before)
+
+	// When
+	r, err = s.tcpClient.Post("http://127.0.0.1:55501/groups/foo/offsets", "application/json",
+		strings.NewReader(body+`, "force": true}`))
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.1")[0].Val, Equals, test1Before.Val+1)
+}
+
+// A client can only export and import offsets of topics that it has access
+// to, regardless of the group that it has access to consuming other topics.
+func (s *ServiceHTTPSuite) TestExportImportGroupOffsetsACL(c *C) {
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55507"}
+	lsnCfg.Auth.Keys = []config.APIKey{{Key: "foo", Topics: []string{"test.4"}, Groups: []string{"foo"}}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("export", "test.1", map[string]int{"A": 1})
+	s.kh.PutMessages("export", "test.4", map[string]int{"A": 1})
+	// Consume messages to make the group register partition owners.
+	for _, topic := range []string{"test.1", "test.4"} {
+		r, err := s.unixClient.Get("http://_/topics/" + topic + "/messages?group=foo")
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK)
+	}
+	test4Before := s.kh.GetCommittedOffsets("foo", "test.4")[0]
+	do := func(method, body string) *http.Response {
+		req, err := http.NewRequest(method, "http://127.0.0.1:55507/groups/foo/offsets", strings.NewReader(body))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer foo")
+		req.Header.Set("Content-Type", "application/json")
+		r, err := s.tcpClient.Do(req)
+		c.Assert(err, IsNil)
+		return r
+	}
+
+	// When
+	r := do("GET", "")
+
+	// Then
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	topics := ParseJSONBody(c, r).(map[string]interface{})["topics"].(map[string]interface{})
+	_, ok := topics["test.1"]
+	c.Assert(ok, Equals, false)
+	_, ok = topics["test.4"]
+	c.Assert(ok, Equals, true)
+
+	// When
+	r = do("POST", `{"topics": {"test.1": [{"partition": 0, "offset": 0}], "test.4": [{"partition": 0, "offset": 0}]}, "force": true}`)
+
+	// Then
+	c.Assert(r.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "access to topic test.1 is not allowed"})
+	c.Assert(s.kh.GetCommittedOffsets("foo", "test.4")[0], Equals, test4Before)
+}
+
+func (s *ServiceHTTPSuite) TestImportGroupOffsetsInvalid(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		body   string
+		status int
+		error  string
+	}{{
+		body:   `{"topics": {}}`,
+		status: http.StatusBadRequest,
+		error:  "no topics to import offsets for",
+	}, {
+		body:   `{"topics": {"no-such-topic": [{"partition": 0, "offset": 1}]}}`,
+		status: http.StatusNotFound,
+		error:  "Unknown topic: no-such-topic",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/groups/bar/offsets", "application/json", strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+func (s *ServiceHTTPSuite) TestGetGroups(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("groups", "test.4", map[string]int{"A": 1})
+	r, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/groups")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	groups := ParseJSONBody(c, r).([]interface{})
+	found := false
+	for _, group := range groups {
+		found = found || group == "foo"
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (s *ServiceHTTPSuite) TestGetGroup(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("groups", "test.4", map[string]int{"A": 1})
+	// Consume a message to make the group register its member.
+	r, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/groups/foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	members := body["members"].(map[string]interface{})
+	c.Assert(len(members), Equals, 1)
+	for _, mv := range members {
+		memberView := mv.(map[string]interface{})
+		c.Assert(memberView["registered"], Equals, true)
+		c.Assert(memberView["subscriptions"], DeepEquals, []interface{}{"test.4"})
+		partitions := memberView["partitions"].(map[string]interface{})
+		c.Assert(len(partitions["test.4"].([]interface{})), Equals, 4)
+	}
+}
+
+// The internal state of consumers is reported for every cluster.
+func (s *ServiceHTTPSuite) TestGetState(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	s.kh.PutMessages("state", "test.4", map[string]int{"A": 1})
+	r, err := s.unixClient.Get("http://_/topics/test.4/messages?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	r, err = s.unixClient.Get("http://_/_debug/state")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	cluster := body["clusters"].(map[string]interface{})["pxyD"].(map[string]interface{})
+	groups := cluster["groups"].([]interface{})
+	c.Assert(len(groups), Equals, 1)
+	group := groups[0].(map[string]interface{})
+	c.Assert(group["group"], Equals, "foo")
+	topics := group["topics"].([]interface{})
+	c.Assert(len(topics), Equals, 1)
+	topic := topics[0].(map[string]interface{})
+	c.Assert(topic["topic"], Equals, "test.4")
+	partitions := topic["partitions"].([]interface{})
+	c.Assert(len(partitions), Equals, 4)
+	for i, p := range partitions {
+		partition := p.(map[string]interface{})
+		c.Assert(partition["partition"], Equals, float64(i))
+		c.Assert(partition["claimed"], Equals, true)
+	}
+}
+
+func (s *ServiceHTTPSuite) TestGetGroupNoSuchGroup(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
 	// When
-	r, err := s.unixClient.Get("http://_/topics/no_such_topic/offsets?group=foo")
+	r, err := s.unixClient.Get("http://_/groups/no-such-group")
 
 	// Then
 	c.Assert(err, IsNil)
 	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
-	body := ParseJSONBody(c, r).(map[string]interface{})
-	c.Assert(body["error"], Equals, "Unknown topic")
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "Unknown group"})
 }
 
-// Committed offsets are returned in a following GET request.
-func (s *ServiceHTTPSuite) TestSetOffsets(c *C) {
+func (s *ServiceHTTPSuite) TestGetTopics(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
 	// When
-	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
-		"application/json", strings.NewReader(
-			`[{"partition": 0, "offset": 1100, "metadata": "A100"},
-			  {"partition": 1, "offset": 1101, "metadata": "A101"},
-			  {"partition": 2, "offset": 1102, "metadata": "A102"},
-			  {"partition": 3, "offset": 1103, "metadata": "A103"}]`))
+	r, err := s.unixClient.Get("http://_/topics")
 
 	// Then
 	c.Assert(err, IsNil)
-	c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
 	c.Assert(r.StatusCode, Equals, http.StatusOK)
-
-	r, err = s.unixClient.Get("http://_/topics/test.4/offsets?group=foo")
-	c.Assert(err, IsNil)
-	body := ParseJSONBody(c, r).([]interface{})
-	for i := 0; i < 4; i++ {
-		partitionView := body[i].(map[string]interface{})
-		c.Assert(partitionView["partition"].(float64), Equals, float64(i))
-		c.Assert(partitionView["offset"].(float64), Equals, float64(1100+i))
-		c.Assert(partitionView["metadata"].(string), Equals, fmt.Sprintf("A10%d", i))
-		c.Assert(partitionView["count"], Equals, partitionView["end"].(float64)-partitionView["begin"].(float64))
-	}
+	body := ParseJSONBody(c, r).(map[string]interface{})
+	topic := body["test.4"].(map[string]interface{})
+	c.Assert(topic["partition_count"], Equals, float64(4))
+	c.Assert(len(topic["partitions"].([]interface{})), Equals, 4)
 }
 
-// Result of setting offsets for a non-existent topic depends on the Kafka
-// version. It is ok for 0.8, but error for 0.9.x and higher.
-func (s *ServiceHTTPSuite) TestSetOffsetsNoSuchTopic(c *C) {
+func (s *ServiceHTTPSuite) TestGetTopic(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
 	// When
-	r, err := s.unixClient.Post("http://_/topics/no_such_topic/offsets?group=foo",
-		"application/json", strings.NewReader(`[{"partition": 0, "offset": 1100, "metadata": "A100"}]`))
+	r, err := s.unixClient.Get("http://_/topics/test.4")
 
 	// Then
-	kafkaVersion := os.Getenv("KAFKA_VERSION")
-	if strings.HasPrefix(kafkaVersion, "0.8") {
-		c.Assert(err, IsNil)
-		c.Assert(r.StatusCode, Equals, http.StatusOK)
-		c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
-		return
-	}
-
 	c.Assert(err, IsNil)
-	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
 	body := ParseJSONBody(c, r).(map[string]interface{})
-	c.Assert(body["error"], Equals, "Unknown topic")
+	c.Assert(body["partition_count"], Equals, float64(4))
+	for i, p := range body["partitions"].([]interface{}) {
+		partition := p.(map[string]interface{})
+		c.Assert(partition["partition"], Equals, float64(i), Commentf("partition #%d", i))
+		c.Assert(partition["replicas"], Not(HasLen), 0, Commentf("partition #%d", i))
+		c.Assert(partition["isr"], Not(HasLen), 0, Commentf("partition #%d", i))
+	}
 }
 
-// Invalid body is detected and properly reported.
-func (s *ServiceHTTPSuite) TestSetOffsetsInvalidBody(c *C) {
+func (s *ServiceHTTPSuite) TestGetTopicNoSuchTopic(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
 	// When
-	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
-		"application/json", strings.NewReader(`garbage`))
+	r, err := s.unixClient.Get("http://_/topics/no-such-topic")
 
 	// Then
 	c.Assert(err, IsNil)
-	c.Assert(r.StatusCode, Equals, http.StatusBadRequest)
-	body := ParseJSONBody(c, r).(map[string]interface{})
-	c.Assert(body["error"], Equals, "Failed to parse the request: err=(invalid character 'g' looking for beginning of value)")
+	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "Unknown topic"})
 }
 
-// It is not an error to set an offset for a missing partition.
-func (s *ServiceHTTPSuite) TestSetOffsetsInvalidPartition(c *C) {
+func (s *ServiceHTTPSuite) TestCreateTopicInvalid(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
 
-	// When
-	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
-		"application/json", strings.NewReader(`[{"partition": 5}]`))
-
-	// Then
-	c.Assert(err, IsNil)
-	c.Assert(r.StatusCode, Equals, http.StatusOK)
-	c.Assert(ParseJSONBody(c, r), DeepEquals, httpsrv.EmptyResponse)
+	for i, tc := range []struct {
+		body   string
+		status int
+		error  string
+	}{{
+		body:   `{"topic": "foo", "partitions": 0, "replication_factor": 1}`,
+		status: http.StatusBadRequest,
+		error:  "partitions must be > 0",
+	}, {
+		body:   `{"topic": "test.1", "partitions": 1, "replication_factor": 1}`,
+		status: http.StatusConflict,
+		error:  "topic already exists",
+	}, {
+		body:   `[]`,
+		status: http.StatusBadRequest,
+		error:  "Failed to parse the request: err=(json: cannot unmarshal array into Go value of type httpsrv.createTopicRq)",
+	}} {
+		// When
+		r, err := s.unixClient.Post("http://_/topics", "application/json", strings.NewReader(tc.body))
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
 }
 
-// Reported partition lags are correct, including those corresponding to -1 and
-// -2 special case offset values.
-func (s *ServiceHTTPSuite) TestGetOffsetsLag(c *C) {
+func (s *ServiceHTTPSuite) TestDeleteTopicNoSuchTopic(c *C) {
 	svc, err := Spawn(s.cfg)
 	c.Assert(err, IsNil)
 	defer svc.Stop()
-	r, err := s.unixClient.Post("http://_/topics/test.4/offsets?group=foo",
-		"application/json", strings.NewReader(
-			`[{"partition": 0, "offset": -1},
-			  {"partition": 1, "offset": -2},
-			  {"partition": 2, "offset": 1}]`))
+	rq, err := http.NewRequest(http.MethodDelete, "http://_/topics/no-such-topic", nil)
 	c.Assert(err, IsNil)
 
 	// When
-	r, err = s.unixClient.Get("http://_/topics/test.4/offsets?group=foo")
+	r, err := s.unixClient.Do(rq)
 
 	// Then
 	c.Assert(err, IsNil)
-	c.Assert(r.StatusCode, Equals, http.StatusOK)
-	body := ParseJSONBody(c, r).([]interface{})
-	partition0View := body[0].(map[string]interface{})
-	c.Assert(partition0View["lag"], Equals, float64(0))
-	partition1View := body[1].(map[string]interface{})
-	c.Assert(partition1View["lag"], Equals, partition1View["end"].(float64)-partition1View["begin"].(float64))
-	partition2View := body[2].(map[string]interface{})
-	c.Assert(partition2View["lag"], Equals, partition2View["end"].(float64)-partition2View["offset"].(float64))
+	c.Assert(r.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "Unknown topic"})
 }
 
 // If a topic is not consumed by any member of a group at the moment then
@@ -756,6 +2902,29 @@ func (s *ServiceHTTPSuite) TestGetTopicConsumers(c *C) {
 	})
 }
 
+// When Kafka and ZooKeeper are reachable both health endpoints report all
+// checks passed.
+func (s *ServiceHTTPSuite) TestHealthzReadyz(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, url := range []string{"http://_/healthz", "http://_/readyz"} {
+		// When
+		r, err := s.unixClient.Get(url)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{
+			"status": "ok",
+			"clusters": map[string]interface{}{
+				"pxyD": map[string]interface{}{"kafka": "ok", "zookeeper": "ok"},
+			},
+		}, Commentf("case #%d", i))
+	}
+}
+
 // Reported partition lags are correct, including those corresponding to -1 and
 // -2 special case offset values.
 func (s *ServiceHTTPSuite) TestHealthCheck(c *C) {
@@ -774,6 +2943,496 @@ func (s *ServiceHTTPSuite) TestHealthCheck(c *C) {
 	c.Assert(string(body), Equals, "pong")
 }
 
+// Profiling data is served only if enabled in the config.
+func (s *ServiceHTTPSuite) TestPprof(c *C) {
+	for i, tc := range []struct {
+		pprof  bool
+		status int
+	}{
+		{pprof: false, status: http.StatusNotFound},
+		{pprof: true, status: http.StatusOK},
+	} {
+		s.cfg.HTTP.Pprof = tc.pprof
+		svc, err := Spawn(s.cfg)
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+
+		// When
+		r, err := s.unixClient.Get("http://_/debug/pprof/goroutine?debug=1")
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		r.Body.Close()
+		svc.Stop()
+	}
+}
+
+// The log level can be changed at runtime.
+func (s *ServiceHTTPSuite) TestLogLevel(c *C) {
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	defer logging.SetSeverity(log.SeverityInfo)
+
+	r, err := s.unixClient.Get("http://_/_log/level")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"level": "info"})
+
+	// When
+	rq, err := http.NewRequest(http.MethodPut, "http://_/_log/level", strings.NewReader(`{"level": "debug"}`))
+	c.Assert(err, IsNil)
+	r, err = s.unixClient.Do(rq)
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"level": "debug"})
+	c.Assert(logging.Severity(), Equals, log.SeverityDebug)
+
+	rq, err = http.NewRequest(http.MethodPut, "http://_/_log/level", strings.NewReader(`{"level": "verbose"}`))
+	c.Assert(err, IsNil)
+	r, err = s.unixClient.Do(rq)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "bad level: verbose"})
+}
+
+// Administrative requests that change state are recorded to the audit file,
+// along with their bodies, while other requests are not.
+func (s *ServiceHTTPSuite) TestAuditFile(c *C) {
+	auditFile, err := ioutil.TempFile("", "kafka-pixy-audit")
+	c.Assert(err, IsNil)
+	defer os.Remove(auditFile.Name())
+	auditFile.Close()
+	s.cfg.HTTP.Audit.File = auditFile.Name()
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer logging.SetSeverity(log.SeverityInfo)
+
+	r, err := s.unixClient.Get("http://_/_log/level")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// When
+	rq, err := http.NewRequest(http.MethodPut, "http://_/_log/level", strings.NewReader(`{"level": "debug"}`))
+	c.Assert(err, IsNil)
+	r, err = s.unixClient.Do(rq)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	svc.Stop()
+
+	// Then
+	data, err := ioutil.ReadFile(auditFile.Name())
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(len(lines), Equals, 1)
+	var rec map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &rec), IsNil)
+	c.Assert(rec["operation"], Equals, "set_log_level")
+	c.Assert(rec["method"], Equals, "PUT")
+	c.Assert(rec["path"], Equals, "/_log/level")
+	c.Assert(rec["body"], Equals, `{"level": "debug"}`)
+	c.Assert(rec["status"], Equals, float64(http.StatusOK))
+}
+
+// If a listener is configured with auth tokens then requests that do not
+// provide a valid one are rejected, while other listeners are not affected.
+func (s *ServiceHTTPSuite) TestListenerTokenAuth(c *C) {
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55502"}
+	lsnCfg.Auth.Tokens = []string{"foo", "bar"}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		authorization string
+		status        int
+	}{
+		{authorization: "", status: http.StatusUnauthorized},
+		{authorization: "Bearer bazz", status: http.StatusUnauthorized},
+		{authorization: "bar", status: http.StatusUnauthorized},
+		{authorization: "Bearer bar", status: http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:55502/_ping", nil)
+		c.Assert(err, IsNil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		// When
+		r, err := s.tcpClient.Do(req)
+
+		// Then
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+	}
+
+	// The Unix domain socket listener does not require authentication.
+	r, err := s.unixClient.Get("http://_/_ping")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+}
+
+// API keys restrict access to topics and groups they are configured with.
+func (s *ServiceHTTPSuite) TestListenerKeyAuth(c *C) {
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55502"}
+	lsnCfg.Auth.Keys = []config.APIKey{{Key: "foo", Topics: []string{"test.*"}, Groups: []string{"g1"}}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		url    string
+		status int
+		error  string
+	}{{
+		url:    "/topics/test.1/offsets?group=g1",
+		status: http.StatusOK,
+	}, {
+		url:    "/topics/foo/offsets?group=g1",
+		status: http.StatusForbidden,
+		error:  "access to topic foo is not allowed",
+	}, {
+		url:    "/topics/test.1/offsets?group=g2",
+		status: http.StatusForbidden,
+		error:  "access to group g2 is not allowed",
+	}, {
+		url:    "/messages?group=g1&topics=test.1,foo",
+		status: http.StatusForbidden,
+		error:  "access to topic foo is not allowed",
+	}, {
+		url:    "/messages?group=g1&topicPattern=test.*",
+		status: http.StatusForbidden,
+		error:  "topicPattern requires access to all topics",
+	}, {
+		url:    "/topics",
+		status: http.StatusForbidden,
+		error:  "access to cluster-wide endpoints is not allowed",
+	}} {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:55502"+tc.url, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer foo")
+
+		// When
+		r, err := s.tcpClient.Do(req)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		if tc.error != "" {
+			c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+		}
+	}
+}
+
+// The topic that messages are reprocessed to must be accessible and allow
+// the produce operation, whether it is explicitly given or derived from the
+// dead letter topic.
+func (s *ServiceHTTPSuite) TestReprocessACL(c *C) {
+	s.cfg.Proxies[s.cfg.DefaultCluster].Consumer.DeadLetterTopic = "{topic}.dlq"
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55507"}
+	lsnCfg.Auth.Keys = []config.APIKey{
+		{Key: "foo", Name: "restricted", Topics: []string{"test.1", "test.1.dlq"}},
+		{Key: "bar", Name: "admin"},
+	}
+	lsnCfg.Auth.ACL = []config.ACLRule{{
+		Principals: []string{"restricted"},
+		Operations: []config.ACLOperation{config.ACLProduce, config.ACLAdmin},
+		Topics:     []string{"test.*"},
+	}, {
+		Principals: []string{"admin"},
+		Operations: []config.ACLOperation{config.ACLAdmin},
+		Topics:     []string{"test.*"},
+	}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		token  string
+		url    string
+		status int
+		error  string
+	}{{
+		token:  "foo",
+		url:    "/topics/test.1/reprocess?partition=0&offset=0&count=1&targetTopic=test.4",
+		status: http.StatusForbidden,
+		error:  "access to topic test.4 is not allowed",
+	}, {
+		token:  "bar",
+		url:    "/topics/test.1/reprocess?partition=0&offset=0&count=1&targetTopic=test.4",
+		status: http.StatusForbidden,
+		error:  "operation produce is not allowed: topics=test.4",
+	}, {
+		token:  "bar",
+		url:    "/topics/test.4.dlq/reprocess?partition=0&offset=0&count=1",
+		status: http.StatusForbidden,
+		error:  "operation produce is not allowed: topics=test.4",
+	}} {
+		req, err := http.NewRequest("POST", "http://127.0.0.1:55507"+tc.url, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+
+		// When
+		r, err := s.tcpClient.Do(req)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+	}
+}
+
+// ACL rules grant clients particular operations on topics and groups.
+// A Unix domain socket listener sets the configured socket mode, and grants
+// local users access by their peer credentials.
+func (s *ServiceHTTPSuite) TestUnixPeerAuth(c *C) {
+	sockAddr := path.Join(os.TempDir(), "kafka-pixy-peers.sock")
+	os.Remove(sockAddr)
+	lsnCfg := config.Listener{Addr: sockAddr}
+	lsnCfg.Socket.Mode = "0600"
+	lsnCfg.Auth.Peers = []config.UnixPeer{{User: strconv.Itoa(os.Getuid()), Topics: []string{"test.*"}}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	client := testhelpers.NewUDSHTTPClient(sockAddr)
+
+	// When
+	fileInfo, err := os.Stat(sockAddr)
+	c.Assert(err, IsNil)
+	rOK, err1 := client.Get("http://_/topics/test.1/offsets?group=foo")
+	rForbidden, err2 := client.Get("http://_/topics/foo/offsets?group=foo")
+	rq, err := http.NewRequest(http.MethodGet, "http://_/topics/test.1/offsets?group=foo", nil)
+	c.Assert(err, IsNil)
+	rq.Header.Set("Authorization", "Bearer bar")
+	rBadToken, err3 := client.Do(rq)
+
+	// Then
+	c.Assert(fileInfo.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Assert(err1, IsNil)
+	c.Assert(rOK.StatusCode, Equals, http.StatusOK)
+	c.Assert(err2, IsNil)
+	c.Assert(rForbidden.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(err3, IsNil)
+	c.Assert(rBadToken.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (s *ServiceHTTPSuite) TestListenerACL(c *C) {
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55505"}
+	lsnCfg.Auth.Keys = []config.APIKey{{Key: "foo", Name: "producer"}}
+	lsnCfg.Auth.ACL = []config.ACLRule{{
+		Principals: []string{"producer"},
+		Operations: []config.ACLOperation{config.ACLProduce},
+		Topics:     []string{"test.*"},
+	}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	for i, tc := range []struct {
+		method string
+		url    string
+		status int
+		error  string
+	}{{
+		method: "POST",
+		url:    "/topics/test.1/messages?sync",
+		status: http.StatusOK,
+	}, {
+		method: "POST",
+		url:    "/topics/foo/messages?sync",
+		status: http.StatusForbidden,
+		error:  "operation produce is not allowed: topics=foo",
+	}, {
+		method: "GET",
+		url:    "/topics/test.1/messages?group=g1",
+		status: http.StatusForbidden,
+		error:  "operation consume is not allowed: topics=test.1, groups=g1",
+	}, {
+		method: "GET",
+		url:    "/topics/messages",
+		status: http.StatusForbidden,
+		error:  "operation admin is not allowed: topics=messages",
+	}, {
+		method: "GET",
+		url:    "/topics",
+		status: http.StatusForbidden,
+		error:  "operation admin is not allowed",
+	}, {
+		method: "GET",
+		url:    "/_ping",
+		status: http.StatusOK,
+	}} {
+		req, err := http.NewRequest(tc.method, "http://127.0.0.1:55505"+tc.url, strings.NewReader("Hello Kitty"))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer foo")
+		req.Header.Set("Content-Type", "text/plain")
+
+		// When
+		r, err := s.tcpClient.Do(req)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(r.StatusCode, Equals, tc.status, Commentf("case #%d", i))
+		if tc.error != "" {
+			c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": tc.error}, Commentf("case #%d", i))
+		}
+	}
+}
+
+// API keys assigned to a tenant are restricted to topics and groups of the
+// tenant, and share its quotas.
+func (s *ServiceHTTPSuite) TestTenantQuotas(c *C) {
+	s.cfg.HTTP.Tenants = map[string]config.Tenant{
+		"t1": {TopicPrefixes: []string{"test."}, GroupPrefixes: []string{"g"}, BytesPerSecond: 1, MaxLongPolls: 1},
+	}
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55504"}
+	lsnCfg.Auth.Keys = []config.APIKey{{Key: "foo", Tenant: "t1"}, {Key: "bar", Tenant: "t1"}}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	do := func(method, url, token string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, "http://127.0.0.1:55504"+url, body)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		r, err := s.tcpClient.Do(req)
+		c.Assert(err, IsNil)
+		return r
+	}
+
+	// Topics and groups outside of the tenant are not accessible.
+	r := do("GET", "/topics/foo/offsets?group=g1", "foo", nil)
+	c.Assert(r.StatusCode, Equals, http.StatusForbidden)
+	r = do("GET", "/topics/test.1/offsets?group=h1", "foo", nil)
+	c.Assert(r.StatusCode, Equals, http.StatusForbidden)
+
+	// A consume request of one key waiting for messages takes the only long
+	// polling slot of the tenant.
+	pollCh := make(chan *http.Response, 1)
+	go func() {
+		pollCh <- do("GET", "/topics/test.4/messages?group=g1&timeout=3s", "foo", nil)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	r = do("GET", "/topics/test.4/messages?group=g1", "bar", nil)
+	c.Assert(r.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "too many concurrent long polls"})
+	r = <-pollCh
+	c.Assert(r.StatusCode, Not(Equals), http.StatusTooManyRequests)
+	r.Body.Close()
+
+	// When
+	r1 := do("POST", "/topics/test.1/messages?sync", "foo", strings.NewReader("Hello Kitty"))
+	r2 := do("POST", "/topics/test.1/messages?sync", "bar", strings.NewReader("Hello Kitty"))
+
+	// Then
+	c.Assert(r1.StatusCode, Equals, http.StatusOK)
+	c.Assert(r2.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(r2.Header.Get("Retry-After"), Not(Equals), "")
+	c.Assert(ParseJSONBody(c, r2), DeepEquals, map[string]interface{}{"error": "tenant byte quota exceeded"})
+	// Requests of clients that are not assigned to a tenant count against
+	// quotas of the tenant that owns the topic.
+	r3, err := s.unixClient.Post("http://_/topics/test.1/messages?sync", "text/plain", strings.NewReader("Hello Kitty"))
+	c.Assert(err, IsNil)
+	c.Assert(r3.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(ParseJSONBody(c, r3), DeepEquals, map[string]interface{}{"error": "tenant byte quota exceeded"})
+}
+
+// Requests that exceed a rate limit are rejected with 429 and a hint when to
+// retry, while health checks are never limited.
+func (s *ServiceHTTPSuite) TestRateLimit(c *C) {
+	s.cfg.HTTP.RateLimit.PerTopic = config.RateLimit{Rate: 0.1, Burst: 2}
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	for i := 0; i < 2; i++ {
+		r, err := s.unixClient.Get("http://_/topics/test.1/offsets?group=foo")
+		c.Assert(err, IsNil)
+		c.Assert(r.StatusCode, Equals, http.StatusOK, Commentf("request #%d", i))
+	}
+
+	// When
+	r, err := s.unixClient.Get("http://_/topics/test.1/offsets?group=foo")
+
+	// Then
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(r.Header.Get("Retry-After"), Equals, "10")
+	c.Assert(ParseJSONBody(c, r), DeepEquals, map[string]interface{}{"error": "rate limit exceeded"})
+	// Other topics are not affected.
+	r, err = s.unixClient.Get("http://_/topics/test.4/offsets?group=foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	r, err = s.unixClient.Get("http://_/_ping")
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+}
+
+// If an admin address is configured, then administrative endpoints are only
+// served there, and data endpoints are not served there.
+func (s *ServiceHTTPSuite) TestAdminAddr(c *C) {
+	s.cfg.AdminAddr = "127.0.0.1:55503"
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+
+	// When
+	rData, err := s.unixClient.Get("http://_/topics/test.1/offsets?group=foo")
+	c.Assert(err, IsNil)
+	rAdmin, err := s.tcpClient.Get("http://127.0.0.1:55503/topics/test.1/offsets?group=foo")
+	c.Assert(err, IsNil)
+	rAdminProduce, err := s.tcpClient.Post("http://127.0.0.1:55503/topics/test.1/messages",
+		"text/plain", strings.NewReader("Foo"))
+	c.Assert(err, IsNil)
+
+	// Then
+	c.Assert(rData.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(rAdmin.StatusCode, Equals, http.StatusOK)
+	c.Assert(rAdminProduce.StatusCode, Equals, http.StatusNotFound)
+}
+
+// A metrics listener serves health check and metrics endpoints only, and
+// requires its own auth for the latter.
+func (s *ServiceHTTPSuite) TestMetricsListener(c *C) {
+	lsnCfg := config.Listener{Addr: "127.0.0.1:55506", API: config.ListenerAPIMetrics}
+	lsnCfg.Auth.Tokens = []string{"foo"}
+	s.cfg.Listeners = append(s.cfg.Listeners, lsnCfg)
+	svc, err := Spawn(s.cfg)
+	c.Assert(err, IsNil)
+	defer svc.Stop()
+	get := func(url, token string) *http.Response {
+		rq, err := http.NewRequest(http.MethodGet, url, nil)
+		c.Assert(err, IsNil)
+		if token != "" {
+			rq.Header.Set("Authorization", "Bearer "+token)
+		}
+		r, err := s.tcpClient.Do(rq)
+		c.Assert(err, IsNil)
+		return r
+	}
+
+	// When
+	rPing := get("http://127.0.0.1:55506/_ping", "foo")
+	rMetrics := get("http://127.0.0.1:55506/metrics", "foo")
+	rMetricsNoAuth := get("http://127.0.0.1:55506/metrics", "")
+	rOffsets := get("http://127.0.0.1:55506/topics/test.1/offsets?group=foo", "foo")
+	rConsume := get("http://127.0.0.1:55506/topics/test.1/messages?group=foo", "foo")
+
+	// Then
+	c.Assert(rPing.StatusCode, Equals, http.StatusOK)
+	c.Assert(rMetrics.StatusCode, Equals, http.StatusOK)
+	c.Assert(rMetricsNoAuth.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(rOffsets.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(rConsume.StatusCode, Equals, http.StatusNotFound)
+}
+
 // Ensure that API endpoints that explicitly select a proxy to operate on work.
 func (s *ServiceHTTPSuite) TestExplicitProxyAPIEndpoints(c *C) {
 	s.kh.ResetOffsets("foo", "test.1")
@@ -836,6 +3495,15 @@ func GenMessage(size int) string {
 	return string(b.Bytes()[:size])
 }
 
+func gzipBytes(c *C, data []byte) []byte {
+	var b bytes.Buffer
+	gzipWriter := gzip.NewWriter(&b)
+	_, err := gzipWriter.Write(data)
+	c.Assert(err, IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	return b.Bytes()
+}
+
 // ChunkReader allows reading its underlying buffer in chunks making the
 // specified pauses between the chunks. After each pause `Read()` returns
 // `0, nil`. This kind of reader is useful to simulate HTTP requests that
@@ -915,7 +3583,10 @@ func ParseJSONBody(c *C, res *http.Response) interface{} {
 }
 
 func ParseConsRes(c *C, res *http.Response) *pb.ConsRs {
-	body := ParseJSONBody(c, res).(map[string]interface{})
+	return parseConsRsItem(c, ParseJSONBody(c, res).(map[string]interface{}))
+}
+
+func parseConsRsItem(c *C, body map[string]interface{}) *pb.ConsRs {
 	return &pb.ConsRs{
 		KeyValue:  []byte(ParseBase64(c, body["key"].(string))),
 		Message:   []byte(ParseBase64(c, body["value"].(string))),
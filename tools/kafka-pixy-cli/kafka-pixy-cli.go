@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/client"
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: kafka-pixy-cli [options] <command> [command options]
+
+Commands:
+  tail           consume messages from a topic and print them to stdout
+  produce        produce lines read from stdin to a topic
+  lag            show the lag of a consumer group
+  reset-offsets  move offsets of a consumer group on a topic
+
+Run 'kafka-pixy-cli <command> -help' for command options.
+
+Options:
+`
+
+var (
+	addr       string
+	cluster    string
+	token      string
+	maxRetries int
+)
+
+type command func(ctx context.Context, clt *client.T, args []string) error
+
+var commands = map[string]command{
+	"tail":          tail,
+	"produce":       produce,
+	"lag":           lag,
+	"reset-offsets": resetOffsets,
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", "http://localhost:19092", "Kafka-Pixy HTTP API address, either a URL or a unix socket path")
+	flag.StringVar(&cluster, "cluster", "", "name of the cluster, the default cluster if empty")
+	flag.StringVar(&token, "token", "", "token to authenticate requests with")
+	flag.IntVar(&maxRetries, "retries", 3, "number of times failed requests are retried")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	clt, err := client.New(addr, client.Options{
+		Token:      token,
+		Cluster:    cluster,
+		MaxRetries: maxRetries,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	osSigCh := make(chan os.Signal, 1)
+	signal.Notify(osSigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-osSigCh
+		cancel()
+	}()
+
+	if err := cmd(ctx, clt, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// tail consumes messages from a topic on behalf of a consumer group and
+// prints them to stdout, one per line. Consumed messages are acknowledged, so
+// a group dedicated to the tool should be used.
+func tail(ctx context.Context, clt *client.T, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	group := fs.String("group", "kafka-pixy-cli", "name of the consumer group")
+	topic := fs.String("topic", "", "name of the topic")
+	count := fs.Int("count", 0, "number of messages to print, 0 means until interrupted")
+	verbose := fs.Bool("verbose", false, "print partition, offset, timestamp and key of messages")
+	fs.Parse(args)
+	if *topic == "" {
+		return errors.New("topic must be specified")
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for n := 0; *count == 0 || n < *count; {
+		msg, err := clt.Consume(ctx, *group, *topic, 0)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err == client.ErrRequestTimeout:
+			continue
+		case err != nil:
+			return err
+		}
+		if *verbose {
+			ts := ""
+			if !msg.Timestamp.IsZero() {
+				ts = msg.Timestamp.Format(time.RFC3339Nano)
+			}
+			fmt.Fprintf(out, "partition=%d offset=%d timestamp=%s key=%q value=",
+				msg.Partition, msg.Offset, ts, msg.Key)
+		}
+		out.Write(msg.Value)
+		out.WriteByte('\n')
+		out.Flush()
+		n++
+		if err := clt.Ack(ctx, *group, *topic, msg.Partition, msg.Offset); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// produce reads stdin line by line and produces every non-empty line as a
+// message to a topic.
+func produce(ctx context.Context, clt *client.T, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	topic := fs.String("topic", "", "name of the topic")
+	keySep := fs.String("key-separator", "", "if not empty, then lines are split into a key and a value by the first occurrence of it")
+	isSync := fs.Bool("sync", false, "wait for Kafka to confirm every write and print the partition and offset")
+	fs.Parse(args)
+	if *topic == "" {
+		return errors.New("topic must be specified")
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for lineNo := 1; ctx.Err() == nil; lineNo++ {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return errors.Wrap(readErr, "failed to read stdin")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			var key []byte
+			value := line
+			if *keySep != "" {
+				if i := strings.Index(line, *keySep); i >= 0 {
+					key, value = []byte(line[:i]), line[i+len(*keySep):]
+				}
+			}
+			if *isSync {
+				partition, offset, err := clt.Produce(ctx, *topic, key, []byte(value))
+				if err != nil {
+					return errors.Wrapf(err, "failed to produce line %d", lineNo)
+				}
+				fmt.Printf("partition=%d offset=%d\n", partition, offset)
+			} else if err := clt.AsyncProduce(ctx, *topic, key, []byte(value)); err != nil {
+				return errors.Wrapf(err, "failed to produce line %d", lineNo)
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+	return nil
+}
+
+// lag prints the lag of a consumer group per partition of every topic it has
+// committed offsets for.
+func lag(ctx context.Context, clt *client.T, args []string) error {
+	fs := flag.NewFlagSet("lag", flag.ExitOnError)
+	group := fs.String("group", "", "name of the consumer group")
+	fs.Parse(args)
+	if *group == "" {
+		return errors.New("group must be specified")
+	}
+
+	groupLag, err := clt.GetGroupLag(ctx, *group)
+	if err != nil {
+		return err
+	}
+	topics := make([]string, 0, len(groupLag.Topics))
+	for topic := range groupLag.Topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tPARTITION\tOFFSET\tEND\tLAG")
+	for _, topic := range topics {
+		for _, pl := range groupLag.Topics[topic].Partitions {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", topic, pl.Partition, pl.Offset, pl.End, pl.Lag)
+		}
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t\t%d\n", groupLag.Lag)
+	return w.Flush()
+}
+
+// resetOffsets moves offsets of a consumer group on a topic to the beginning
+// or the end of partitions, to a point in time, or to explicit offsets.
+func resetOffsets(ctx context.Context, clt *client.T, args []string) error {
+	fs := flag.NewFlagSet("reset-offsets", flag.ExitOnError)
+	group := fs.String("group", "", "name of the consumer group")
+	topic := fs.String("topic", "", "name of the topic")
+	to := fs.String("to", "", "where to move offsets: earliest, latest, an RFC3339 timestamp, "+
+		"or comma separated <partition>:<offset> pairs")
+	force := fs.Bool("force", false, "move offsets even if the group has active members")
+	fs.Parse(args)
+	if *group == "" || *topic == "" {
+		return errors.New("group and topic must be specified")
+	}
+	seek, err := parseSeek(*to)
+	if err != nil {
+		return err
+	}
+	seek.Force = *force
+
+	offsets, err := clt.SeekOffsets(ctx, *group, *topic, seek)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tOFFSET")
+	for _, po := range offsets {
+		fmt.Fprintf(w, "%d\t%d\n", po.Partition, po.Offset)
+	}
+	return w.Flush()
+}
+
+func parseSeek(to string) (client.Seek, error) {
+	switch {
+	case to == "":
+		return client.Seek{}, errors.New("target offsets must be specified")
+	case to == "earliest" || to == "latest":
+		return client.Seek{Position: to}, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, to); err == nil {
+		return client.Seek{Timestamp: ts}, nil
+	}
+	var seek client.Seek
+	for _, pair := range strings.Split(to, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return client.Seek{}, errors.Errorf("bad target offsets, %s", to)
+		}
+		partition, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil {
+			return client.Seek{}, errors.Errorf("bad partition, %s", parts[0])
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return client.Seek{}, errors.Errorf("bad offset, %s", parts[1])
+		}
+		seek.Offsets = append(seek.Offsets, client.PartitionOffset{Partition: int32(partition), Offset: offset})
+	}
+	return seek, nil
+}
@@ -0,0 +1,161 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// redactStage removes fields from a JSON message.
+type redactStage struct {
+	paths [][]string
+}
+
+func (s *redactStage) Transform(msg *Message) error {
+	return transformJSON(msg, func(obj map[string]interface{}) error {
+		for _, path := range s.paths {
+			deletePath(obj, path)
+		}
+		return nil
+	})
+}
+
+// renameStage renames fields of a JSON message. Fields are renamed in the
+// lexicographical order of their old names, so that the result does not
+// depend on the map iteration order.
+type renameStage struct {
+	from [][]string
+	to   [][]string
+}
+
+func newRenameStage(rename map[string]string) *renameStage {
+	s := &renameStage{}
+	for _, from := range sortedKeys(rename) {
+		s.from = append(s.from, splitPath(from))
+		s.to = append(s.to, splitPath(rename[from]))
+	}
+	return s
+}
+
+func (s *renameStage) Transform(msg *Message) error {
+	return transformJSON(msg, func(obj map[string]interface{}) error {
+		for i, from := range s.from {
+			v, ok := deletePath(obj, from)
+			if !ok {
+				continue
+			}
+			if err := setPath(obj, s.to[i], v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setStage sets fields of a JSON message to constant string values.
+type setStage struct {
+	paths  [][]string
+	values []string
+}
+
+func newSetStage(set map[string]string) *setStage {
+	s := &setStage{}
+	for _, path := range sortedKeys(set) {
+		s.paths = append(s.paths, splitPath(path))
+		s.values = append(s.values, set[path])
+	}
+	return s
+}
+
+func (s *setStage) Transform(msg *Message) error {
+	return transformJSON(msg, func(obj map[string]interface{}) error {
+		for i, path := range s.paths {
+			if err := setPath(obj, path, s.values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// transformJSON parses a message value as a JSON object, calls `fn` to
+// modify it, and puts the result back to the message.
+func transformJSON(msg *Message, fn func(obj map[string]interface{}) error) error {
+	decoder := json.NewDecoder(bytes.NewReader(msg.Value))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return errors.Wrap(err, "value is not a JSON object")
+	}
+	if obj == nil {
+		return errors.New("value is not a JSON object")
+	}
+	if err := fn(obj); err != nil {
+		return err
+	}
+	value, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal value")
+	}
+	msg.Value = value
+	return nil
+}
+
+// deletePath removes a field referred to by a path from a JSON object, and
+// returns its value.
+func deletePath(obj map[string]interface{}, path []string) (interface{}, bool) {
+	for _, name := range path[:len(path)-1] {
+		nested, ok := obj[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj = nested
+	}
+	name := path[len(path)-1]
+	v, ok := obj[name]
+	delete(obj, name)
+	return v, ok
+}
+
+// setPath sets a field referred to by a path in a JSON object, creating
+// missing intermediate objects.
+func setPath(obj map[string]interface{}, path []string, v interface{}) error {
+	for i, name := range path[:len(path)-1] {
+		switch nested := obj[name].(type) {
+		case map[string]interface{}:
+			obj = nested
+		case nil:
+			created := make(map[string]interface{})
+			obj[name] = created
+			obj = created
+		default:
+			return errors.Errorf("field %s is not an object", strings.Join(path[:i+1], "."))
+		}
+	}
+	obj[path[len(path)-1]] = v
+	return nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func splitPaths(paths []string) [][]string {
+	split := make([][]string, len(paths))
+	for i, path := range paths {
+		split[i] = splitPath(path)
+	}
+	return split
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,41 @@
+package transform
+
+import (
+	"plugin"
+
+	"github.com/pkg/errors"
+)
+
+// NewStageSymbol is the name of a function that a Go plugin must export to
+// implement a plugin stage. The function must have the NewStageFunc type.
+const NewStageSymbol = "NewStage"
+
+// NewStageFunc is the type of a plugin stage constructor. It is called once
+// when a pipeline is created with the `params` of the stage config.
+type NewStageFunc func(params map[string]string) (Stage, error)
+
+// loadPlugin opens a Go plugin and creates a stage with its constructor.
+func loadPlugin(path string, params map[string]string) (Stage, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open plugin, path=%s", path)
+	}
+	sym, err := p.Lookup(NewStageSymbol)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to lookup %s, path=%s", NewStageSymbol, path)
+	}
+	var newStage NewStageFunc
+	switch fn := sym.(type) {
+	case func(map[string]string) (Stage, error):
+		newStage = fn
+	case *NewStageFunc:
+		newStage = *fn
+	default:
+		return nil, errors.Errorf("%s has bad type %T, path=%s", NewStageSymbol, sym, path)
+	}
+	stage, err := newStage(params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create plugin stage, path=%s", path)
+	}
+	return stage, nil
+}
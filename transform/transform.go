@@ -0,0 +1,80 @@
+package transform
+
+import (
+	"fmt"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+)
+
+// Message is a message passed through a transformation pipeline. Stages may
+// modify both its key and value, the topic is for information only.
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// Stage is a single step of a transformation pipeline. Stages implemented by
+// Go plugins must satisfy this interface.
+type Stage interface {
+	// Transform modifies a message in place. If an error is returned, then
+	// the message is not passed to the following stages.
+	Transform(msg *Message) error
+}
+
+// FailedError is returned when a stage of a pipeline fails to transform a
+// message.
+type FailedError struct {
+	Stage int
+	Err   error
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("transform stage #%d failed: %v", e.Stage, e.Err)
+}
+
+// IsFailed returns true if `err` is caused by a stage that failed to
+// transform a message.
+func IsFailed(err error) bool {
+	_, ok := errors.Cause(err).(*FailedError)
+	return ok
+}
+
+// Pipeline is a sequence of stages that a message is passed through.
+type Pipeline []Stage
+
+// New creates a pipeline from stage configs. Plugins referred to by plugin
+// stages are loaded here.
+func New(stageCfgs []config.TransformStage) (Pipeline, error) {
+	pipeline := make(Pipeline, len(stageCfgs))
+	for i, stageCfg := range stageCfgs {
+		var err error
+		switch stageCfg.Type {
+		case config.TransformRedact:
+			pipeline[i] = &redactStage{paths: splitPaths(stageCfg.Fields)}
+		case config.TransformRename:
+			pipeline[i] = newRenameStage(stageCfg.Rename)
+		case config.TransformSet:
+			pipeline[i] = newSetStage(stageCfg.Set)
+		case config.TransformPlugin:
+			pipeline[i], err = loadPlugin(stageCfg.Plugin, stageCfg.Params)
+		default:
+			err = errors.Errorf("bad transform type, %s", stageCfg.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create stage #%d", i)
+		}
+	}
+	return pipeline, nil
+}
+
+// Apply passes a message through all stages of the pipeline in order.
+func (p Pipeline) Apply(msg *Message) error {
+	for i, stage := range p {
+		if err := stage.Transform(msg); err != nil {
+			return &FailedError{Stage: i, Err: err}
+		}
+	}
+	return nil
+}
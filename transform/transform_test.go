@@ -0,0 +1,126 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type TransformSuite struct{}
+
+var _ = Suite(&TransformSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *TransformSuite) TestStages(c *C) {
+	for i, tc := range []struct {
+		stage config.TransformStage
+		value string
+		want  string
+	}{{
+		stage: config.TransformStage{Type: config.TransformRedact, Fields: []string{"pwd", "card.number", "no.such"}},
+		value: `{"user": "bob", "pwd": "secret", "card": {"number": 4111, "exp": "01/20"}}`,
+		want:  `{"card":{"exp":"01/20"},"user":"bob"}`,
+	}, {
+		stage: config.TransformStage{Type: config.TransformRename, Rename: map[string]string{"a": "b.c", "x": "y"}},
+		value: `{"a": 1.50, "z": [1, 2]}`,
+		want:  `{"b":{"c":1.50},"z":[1,2]}`,
+	}, {
+		stage: config.TransformStage{Type: config.TransformSet, Set: map[string]string{"meta.source": "pixy", "v": "2"}},
+		value: `{"meta": {"id": 7}, "v": 1}`,
+		want:  `{"meta":{"id":7,"source":"pixy"},"v":"2"}`,
+	}} {
+		pipeline, err := New([]config.TransformStage{tc.stage})
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		msg := Message{Topic: "foo", Key: []byte("bar"), Value: []byte(tc.value)}
+
+		// When
+		err = pipeline.Apply(&msg)
+
+		// Then
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		c.Assert(string(msg.Value), Equals, tc.want, Commentf("case #%d", i))
+		c.Assert(string(msg.Key), Equals, "bar", Commentf("case #%d", i))
+	}
+}
+
+// Stages are applied in the order they are given, and a stage failure stops
+// the pipeline.
+func (s *TransformSuite) TestPipeline(c *C) {
+	var applied []string
+	pipeline := Pipeline{
+		stageFunc(func(msg *Message) error {
+			applied = append(applied, "first")
+			msg.Value = append(msg.Value, '1')
+			return nil
+		}),
+		stageFunc(func(msg *Message) error {
+			applied = append(applied, "second")
+			return errors.New("kaboom")
+		}),
+		stageFunc(func(msg *Message) error {
+			applied = append(applied, "third")
+			return nil
+		}),
+	}
+	msg := Message{Value: []byte("0")}
+
+	// When
+	err := pipeline.Apply(&msg)
+
+	// Then
+	c.Assert(err.Error(), Equals, "transform stage #1 failed: kaboom")
+	c.Assert(IsFailed(err), Equals, true)
+	c.Assert(applied, DeepEquals, []string{"first", "second"})
+	c.Assert(string(msg.Value), Equals, "01")
+}
+
+func (s *TransformSuite) TestInvalid(c *C) {
+	for i, tc := range []struct {
+		stage config.TransformStage
+		value string
+		err   string
+	}{{
+		stage: config.TransformStage{Type: config.TransformRedact, Fields: []string{"a"}},
+		value: `not json`,
+		err:   "transform stage #0 failed: value is not a JSON object: invalid character 'o' in literal null (expecting 'u')",
+	}, {
+		stage: config.TransformStage{Type: config.TransformRedact, Fields: []string{"a"}},
+		value: `null`,
+		err:   "transform stage #0 failed: value is not a JSON object",
+	}, {
+		stage: config.TransformStage{Type: config.TransformSet, Set: map[string]string{"a.b": "c"}},
+		value: `{"a": 1}`,
+		err:   "transform stage #0 failed: field a is not an object",
+	}} {
+		pipeline, err := New([]config.TransformStage{tc.stage})
+		c.Assert(err, IsNil, Commentf("case #%d", i))
+		msg := Message{Value: []byte(tc.value)}
+
+		// When
+		err = pipeline.Apply(&msg)
+
+		// Then
+		c.Assert(err.Error(), Equals, tc.err, Commentf("case #%d", i))
+		c.Assert(string(msg.Value), Equals, tc.value, Commentf("case #%d", i))
+	}
+}
+
+func (s *TransformSuite) TestPluginMissing(c *C) {
+	// When
+	_, err := New([]config.TransformStage{{Type: config.TransformPlugin, Plugin: "/no/such/plugin.so"}})
+
+	// Then
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, "failed to create stage #0: failed to open plugin, path=/no/such/plugin.so: .*")
+}
+
+type stageFunc func(msg *Message) error
+
+func (f stageFunc) Transform(msg *Message) error {
+	return f(msg)
+}
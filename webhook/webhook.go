@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/metrics"
+	"github.com/mailgun/kafka-pixy/proxy"
+	"github.com/mailgun/log"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Maximum number of bytes of an error response body to include in an error
+// message.
+const maxErrorBodySize = 1024
+
+// Proxy is the subset of `proxy.T` methods that a pusher needs.
+type Proxy interface {
+	Consume(ctx context.Context, group, topic string, ack proxy.Ack, timeout time.Duration) (consumer.Message, error)
+	Ack(group, topic string, ack proxy.Ack) error
+	Nack(group, topic string, ack proxy.Ack, reason string) error
+}
+
+// T pushes messages consumed by a group from a topic to an HTTP endpoint. A
+// message is acknowledged only if the endpoint responds with a 2xx status
+// code, otherwise it is rejected, so that the consumer offers it again.
+//
+// It implements `server.T`, so that it is started and stopped along with API
+// servers, before proxies are stopped.
+type T struct {
+	actorID   *actor.ID
+	cfg       *config.Proxy
+	sub       config.WebhookSubscription
+	pxy       Proxy
+	httpClt   *http.Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	errorCh   chan error
+	wg        sync.WaitGroup
+	delivered gometrics.Counter
+	failed    gometrics.Counter
+}
+
+// deliveryRq is a body of a webhook request. It has the same format as a
+// response to a consume request plus the topic.
+type deliveryRq struct {
+	Topic     string `json:"topic"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	// Milliseconds since epoch, omitted if Kafka does not provide it.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// The number of times the message has been offered to the group.
+	DeliveryAttempt int `json:"delivery_attempt,omitempty"`
+}
+
+// New creates a pusher for the specified subscription. It does nothing until
+// started.
+func New(namespace *actor.ID, cfg *config.Proxy, sub config.WebhookSubscription, pxy Proxy) *T {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &T{
+		actorID:   namespace.NewChild("webhook", sub.Group, sub.Topic),
+		cfg:       cfg,
+		sub:       sub,
+		pxy:       pxy,
+		httpClt:   &http.Client{Timeout: cfg.Webhook.Timeout},
+		ctx:       ctx,
+		cancel:    cancel,
+		errorCh:   make(chan error),
+		delivered: metrics.Counter("webhook_delivered", "cluster", cfg.Cluster, "group", sub.Group, "topic", sub.Topic),
+		failed:    metrics.Counter("webhook_failed", "cluster", cfg.Cluster, "group", sub.Group, "topic", sub.Topic),
+	}
+}
+
+// Start implements server.T.
+func (t *T) Start() {
+	concurrency := t.sub.Concurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		actor.Spawn(t.actorID.NewChild("w", i), &t.wg, t.run)
+	}
+}
+
+// Stop implements server.T. Pending consume and webhook requests are
+// canceled. A message that is being delivered when the pusher is stopped is
+// neither acknowledged nor rejected, so it is offered again later.
+func (t *T) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// ErrorCh implements server.T. Pushers never fail, delivery errors are
+// logged and counted.
+func (t *T) ErrorCh() <-chan error {
+	return t.errorCh
+}
+
+func (t *T) run() {
+	for {
+		msg, err := t.pxy.Consume(t.ctx, t.sub.Group, t.sub.Topic, proxy.NoAck(), 0)
+		if err != nil {
+			if err == consumer.ErrRequestCanceled {
+				return
+			}
+			if err == consumer.ErrRequestTimeout {
+				continue
+			}
+			if errors.Cause(err) != consumer.ErrTooManyRequests && !consumer.IsOverloaded(err) && !proxy.IsQuotaExceeded(err) {
+				log.Errorf("<%s> failed to consume: err=(%s)", t.actorID, err)
+			}
+			if !t.backoff() {
+				return
+			}
+			continue
+		}
+		ack, err := proxy.NewAck(msg.Partition, msg.Offset)
+		if err != nil {
+			log.Errorf("<%s> bad message: err=(%s)", t.actorID, err)
+			continue
+		}
+		if err := t.deliver(msg); err != nil {
+			if t.ctx.Err() != nil {
+				return
+			}
+			t.failed.Inc(1)
+			if err := t.pxy.Nack(t.sub.Group, t.sub.Topic, ack, err.Error()); err != nil {
+				log.Errorf("<%s> failed to nack: partition=%d, offset=%d, err=(%s)",
+					t.actorID, msg.Partition, msg.Offset, err)
+			}
+			if !t.backoff() {
+				return
+			}
+			continue
+		}
+		t.delivered.Inc(1)
+		if err := t.pxy.Ack(t.sub.Group, t.sub.Topic, ack); err != nil {
+			log.Errorf("<%s> failed to ack: partition=%d, offset=%d, err=(%s)",
+				t.actorID, msg.Partition, msg.Offset, err)
+		}
+	}
+}
+
+// deliver posts a message to the subscription endpoint. The request is
+// aborted if the pusher is stopped.
+func (t *T) deliver(msg consumer.Message) error {
+	rq := deliveryRq{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+
+		DeliveryAttempt: msg.DeliveryAttempt,
+	}
+	if !msg.Timestamp.IsZero() {
+		rq.Timestamp = msg.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	body, err := json.Marshal(rq)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+	httpRq, err := http.NewRequest(http.MethodPost, t.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	httpRq.Header.Set("Content-Type", "application/json")
+	rs, err := t.httpClt.Do(httpRq.WithContext(t.ctx))
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer rs.Body.Close()
+	if rs.StatusCode < 200 || rs.StatusCode > 299 {
+		rsBody, _ := ioutil.ReadAll(io.LimitReader(rs.Body, maxErrorBodySize))
+		return errors.Errorf("bad response: status=%d, body=%s", rs.StatusCode, rsBody)
+	}
+	io.Copy(ioutil.Discard, rs.Body)
+	return nil
+}
+
+// backoff waits for `Webhook.RetryBackoff`. It returns false if the pusher
+// was stopped in the meantime.
+func (t *T) backoff() bool {
+	select {
+	case <-time.After(t.cfg.Webhook.RetryBackoff):
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
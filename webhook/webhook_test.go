@@ -0,0 +1,198 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/kafka-pixy/actor"
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/mailgun/kafka-pixy/consumer"
+	"github.com/mailgun/kafka-pixy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+type WebhookSuite struct {
+	cfg *config.Proxy
+}
+
+var _ = Suite(&WebhookSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *WebhookSuite) SetUpTest(c *C) {
+	s.cfg = config.DefaultProxy()
+	s.cfg.Webhook.RetryBackoff = 10 * time.Millisecond
+	s.cfg.Webhook.Timeout = 200 * time.Millisecond
+}
+
+// Messages are posted to the endpoint, and acknowledged if it responds with a
+// 2xx status code.
+func (s *WebhookSuite) TestDeliver(c *C) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	pxy := newFakeProxy(2)
+	wh := New(actor.RootID, s.cfg, config.WebhookSubscription{Group: "g", Topic: "t", URL: srv.URL}, pxy)
+
+	// When
+	wh.Start()
+	pxy.waitDone(c, 2)
+	wh.Stop()
+
+	// Then
+	c.Assert(pxy.acks, DeepEquals, []string{"{0 0 }", "{0 1 }"})
+	c.Assert(pxy.nacks, IsNil)
+	c.Assert(bodies, DeepEquals, []string{
+		`{"topic":"t","key":"azA=","value":"djA=","partition":0,"offset":0,"timestamp":1000,"delivery_attempt":1}`,
+		`{"topic":"t","key":"azE=","value":"djE=","partition":0,"offset":1,"timestamp":1000,"delivery_attempt":1}`,
+	})
+}
+
+// Messages are rejected if the endpoint fails or does not respond in time.
+func (s *WebhookSuite) TestDeliverFailed(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "down")
+	}))
+	defer srv.Close()
+
+	for i, tc := range []struct {
+		path   string
+		reason string
+	}{{
+		path:   "/down",
+		reason: "bad response: status=503, body=down",
+	}, {
+		path:   "/slow",
+		reason: "request failed: .*",
+	}} {
+		pxy := newFakeProxy(1)
+		sub := config.WebhookSubscription{Group: "g", Topic: "t", URL: srv.URL + tc.path}
+		wh := New(actor.RootID, s.cfg, sub, pxy)
+
+		// When
+		wh.Start()
+		pxy.waitDone(c, 1)
+		wh.Stop()
+
+		// Then
+		c.Assert(pxy.acks, IsNil, Commentf("case #%d", i))
+		c.Assert(len(pxy.nacks), Equals, 1, Commentf("case #%d", i))
+		c.Assert(pxy.nacks[0], Matches, `\{0 0 \}: `+tc.reason, Commentf("case #%d", i))
+	}
+}
+
+// No more than `concurrency` requests are made to the endpoint at a time.
+func (s *WebhookSuite) TestConcurrency(c *C) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	pxy := newFakeProxy(12)
+	sub := config.WebhookSubscription{Group: "g", Topic: "t", URL: srv.URL, Concurrency: 3}
+	wh := New(actor.RootID, s.cfg, sub, pxy)
+
+	// When
+	wh.Start()
+	pxy.waitDone(c, 12)
+	wh.Stop()
+
+	// Then
+	c.Assert(len(pxy.acks), Equals, 12)
+	c.Assert(maxInFlight, Equals, 3)
+}
+
+// fakeProxy serves a fixed number of messages and records acks and nacks as
+// `{partition offset}` strings.
+type fakeProxy struct {
+	mu     sync.Mutex
+	next   int64
+	count  int64
+	acks   []string
+	nacks  []string
+	doneCh chan struct{}
+}
+
+func newFakeProxy(count int64) *fakeProxy {
+	return &fakeProxy{count: count, doneCh: make(chan struct{}, count)}
+}
+
+func (p *fakeProxy) Consume(ctx context.Context, group, topic string, ack proxy.Ack, timeout time.Duration) (consumer.Message, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next >= p.count {
+		select {
+		case <-ctx.Done():
+			return consumer.Message{}, consumer.ErrRequestCanceled
+		case <-time.After(10 * time.Millisecond):
+		}
+		return consumer.Message{}, consumer.ErrRequestTimeout
+	}
+	offset := p.next
+	p.next++
+	return consumer.Message{
+		Topic:     topic,
+		Key:       []byte(fmt.Sprintf("k%d", offset)),
+		Value:     []byte(fmt.Sprintf("v%d", offset)),
+		Offset:    offset,
+		Timestamp: time.Unix(1, 0),
+
+		DeliveryAttempt: 1,
+	}, nil
+}
+
+func (p *fakeProxy) Ack(group, topic string, ack proxy.Ack) error {
+	p.mu.Lock()
+	p.acks = append(p.acks, fmt.Sprint(ack))
+	p.mu.Unlock()
+	p.doneCh <- struct{}{}
+	return nil
+}
+
+func (p *fakeProxy) Nack(group, topic string, ack proxy.Ack, reason string) error {
+	p.mu.Lock()
+	p.nacks = append(p.nacks, fmt.Sprintf("%v: %s", ack, reason))
+	p.mu.Unlock()
+	p.doneCh <- struct{}{}
+	return nil
+}
+
+func (p *fakeProxy) waitDone(c *C, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-p.doneCh:
+		case <-time.After(3 * time.Second):
+			c.Fatalf("timeout waiting for message #%d", i)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// GUID that is concatenated with the client key to calculate the accept
+	// key as defined by RFC 6455.
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	// Close status codes.
+	closeNormal       = 1000
+	closeProtocolErr  = 1002
+	closeMsgTooBig    = 1009
+	maxControlPayload = 125
+)
+
+var (
+	// ErrClosed is returned by ReadMessage when the peer closed the
+	// connection.
+	ErrClosed = errors.New("connection closed")
+
+	errMsgTooBig = errors.New("message is too big")
+)
+
+// Conn is a WebSocket connection (RFC 6455). It supports just enough of the
+// protocol to exchange messages with a peer: fragmented messages are
+// reassembled, pings are answered, and close handshake is performed.
+// Extensions and subprotocols are not supported.
+//
+// ReadMessage must be called from one goroutine at a time, but WriteMessage
+// and Close can be called concurrently with it and with each other.
+type Conn struct {
+	conn       net.Conn
+	br         *bufio.Reader
+	maxMsgSize int
+	client     bool
+	writeMu    sync.Mutex
+	closeOnce  sync.Once
+}
+
+// Upgrade performs WebSocket opening handshake in response to an HTTP request
+// and returns a WebSocket connection. Messages received from the client that
+// are larger than `maxMsgSize` bytes make the connection fail. If an error is
+// returned, then nothing has been written to `w`, so the caller can respond
+// with an error.
+func Upgrade(w http.ResponseWriter, r *http.Request, maxMsgSize int) (*Conn, error) {
+	if r.Method != "GET" {
+		return nil, errors.Errorf("bad method %s", r.Method)
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return nil, errors.New("missing Connection: Upgrade header")
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("missing Upgrade: websocket header")
+	}
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		return nil, errors.Errorf("unsupported websocket version %s", version)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key header")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to hijack connection")
+	}
+	// Deadlines set by the HTTP server for the request are not applicable to
+	// a long living WebSocket connection.
+	conn.SetDeadline(time.Time{})
+	rs := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(rs)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to write handshake response")
+	}
+	return &Conn{conn: conn, br: brw.Reader, maxMsgSize: maxMsgSize}, nil
+}
+
+// Dial connects to a WebSocket server at the specified network address and
+// performs opening handshake for the specified request URI. It is mostly
+// intended for tests, since the server side is what Kafka-Pixy needs.
+func Dial(network, addr, uri string, maxMsgSize int) (*Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial")
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	rq := "GET " + uri + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(rq)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to write handshake request")
+	}
+	br := bufio.NewReader(conn)
+	rs, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read handshake response")
+	}
+	if rs.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.Errorf("handshake failed: status=%d", rs.StatusCode)
+	}
+	if rs.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("handshake failed: bad accept key")
+	}
+	return &Conn{conn: conn, br: br, maxMsgSize: maxMsgSize, client: true}, nil
+}
+
+// AcceptKey calculates a value of the Sec-WebSocket-Accept header for the
+// specified Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	digest := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// ReadMessage returns the next text or binary message received from the
+// peer. Control frames received in between are handled transparently. If
+// the peer closes the connection, then ErrClosed is returned.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	inMessage := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Cause(err) == errMsgTooBig {
+				c.closeWithStatus(closeMsgTooBig)
+			}
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.closeWithStatus(closeNormal)
+			return nil, ErrClosed
+		case opText, opBinary:
+			if inMessage {
+				c.closeWithStatus(closeProtocolErr)
+				return nil, errors.New("new message before previous one is finished")
+			}
+			inMessage = true
+		case opContinuation:
+			if !inMessage {
+				c.closeWithStatus(closeProtocolErr)
+				return nil, errors.New("continuation frame without a message")
+			}
+		default:
+			c.closeWithStatus(closeProtocolErr)
+			return nil, errors.Errorf("unsupported opcode %d", opcode)
+		}
+		if len(msg)+len(payload) > c.maxMsgSize {
+			c.closeWithStatus(closeMsgTooBig)
+			return nil, errMsgTooBig
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// WriteMessage sends a text message to the peer.
+func (c *Conn) WriteMessage(msg []byte) error {
+	return c.writeFrame(opText, msg)
+}
+
+// Close sends a close frame to the peer and closes the underlying network
+// connection. It is safe to call Close more than once.
+func (c *Conn) Close() error {
+	c.closeWithStatus(closeNormal)
+	return nil
+}
+
+func (c *Conn) closeWithStatus(status uint16) {
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, status)
+		// The connection is going down anyway, so the error is ignored.
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, payload)
+		c.conn.Close()
+	})
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, errors.Wrap(err, "failed to read frame header")
+	}
+	fin = header[0]&finBit != 0
+	opcode = header[0] & 0x0F
+	// Frames sent by a client must be masked, and frames sent by a server
+	// must not.
+	masked := header[1]&maskBit != 0
+	if masked == c.client {
+		return false, 0, nil, errors.Errorf("bad frame masking: masked=%t", masked)
+	}
+	payloadLen := uint64(header[1] & 0x7F)
+	switch payloadLen {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, errors.Wrap(err, "failed to read payload length")
+		}
+		payloadLen = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, errors.Wrap(err, "failed to read payload length")
+		}
+		payloadLen = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (payloadLen > maxControlPayload || !fin) {
+		return false, 0, nil, errors.New("bad control frame")
+	}
+	if payloadLen > uint64(c.maxMsgSize) {
+		return false, 0, nil, errMsgTooBig
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, errors.Wrap(err, "failed to read mask")
+		}
+	}
+	payload = make([]byte, payloadLen)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, errors.Wrap(err, "failed to read payload")
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = finBit | opcode
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	frame := payload
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return errors.Wrap(err, "failed to generate mask")
+		}
+		header[1] |= maskBit
+		header = append(header, mask[:]...)
+		frame = make([]byte, len(payload))
+		copy(frame, payload)
+		maskBytes(mask, frame)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(append(header, frame...)); err != nil {
+		return errors.Wrap(err, "failed to write frame")
+	}
+	return nil
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// headerContainsToken checks if a comma separated list value of the specified
+// header contains a token. Comparison is case insensitive.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
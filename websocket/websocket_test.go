@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type WebSocketSuite struct {
+	srv *httptest.Server
+}
+
+var _ = Suite(&WebSocketSuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (s *WebSocketSuite) SetUpTest(c *C) {
+	// The test server echoes all received messages back in upper case.
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, 16)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage([]byte(strings.ToUpper(string(msg)))); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func (s *WebSocketSuite) TearDownTest(c *C) {
+	s.srv.Close()
+}
+
+// The accept key is calculated as specified by the example in RFC 6455.
+func (s *WebSocketSuite) TestAcceptKey(c *C) {
+	c.Assert(AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func (s *WebSocketSuite) TestEcho(c *C) {
+	conn, err := Dial("tcp", s.srv.Listener.Addr().String(), "/", 1024)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	for _, msg := range []string{"foo", "", "bazinga!"} {
+		c.Assert(conn.WriteMessage([]byte(msg)), IsNil)
+		echo, err := conn.ReadMessage()
+		c.Assert(err, IsNil)
+		c.Assert(string(echo), Equals, strings.ToUpper(msg))
+	}
+}
+
+// If a client sends a message larger than the limit, then the server closes
+// the connection.
+func (s *WebSocketSuite) TestMessageTooBig(c *C) {
+	conn, err := Dial("tcp", s.srv.Listener.Addr().String(), "/", 1024)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	c.Assert(conn.WriteMessage([]byte("0123456789abcdefX")), IsNil)
+	_, err = conn.ReadMessage()
+	c.Assert(err, Equals, ErrClosed)
+}
+
+// A plain HTTP request is rejected.
+func (s *WebSocketSuite) TestNotUpgrade(c *C) {
+	rs, err := http.Get(s.srv.URL)
+	c.Assert(err, IsNil)
+	rs.Body.Close()
+	c.Assert(rs.StatusCode, Equals, http.StatusBadRequest)
+}